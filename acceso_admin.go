@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Restricción por IP de la administración: acceso_admin.denegadas se
+// rechaza siempre y, si acceso_admin.permitidas no está vacía, solo se
+// aceptan esas redes (oficina, VPN). /admin y /metrics se filtran antes del
+// token de administrador; fuera de ellas (/graphql, por ejemplo) el token
+// solo da autoridad de administrador desde una red aceptada (esAdmin,
+// verificarAdmin). Cada rechazo queda en AuditoriaAccesos. X-Forwarded-For
+// solo se tiene en cuenta si la conexión viene de un proxy de
+// acceso_admin.proxies_confiables, para que no se pueda falsificar la IP.
+
+// Motivos de rechazo
+const (
+	AccesoIPDenegada     = "ip_denegada"
+	AccesoIPNoPermitida  = "ip_no_permitida"
+	AccesoConfigInvalida = "config_invalida"
+)
+
+// Error cuando la red de la solicitud no puede administrar
+var errAccesoDenegado = errors.New("Acceso denegado")
+
+// Rechazos pendientes de guardar en AuditoriaAccesos. Un solo escritor los
+// guarda en orden; si la cola se llena (un barrido de IPs rechazadas) los
+// siguientes solo quedan en el log en lugar de abrir una goroutine y una
+// conexión por solicitud.
+const capacidadColaAccesos = 256
+
+var colaAccesosDenegados = make(chan AccesoDenegado, capacidadColaAccesos)
+
+// Intento de acceso rechazado
+type AccesoDenegado struct {
+	ID        int    `json:"id"`
+	IP        string `json:"ip"`
+	Metodo    string `json:"metodo"`
+	Ruta      string `json:"ruta"`
+	Motivo    string `json:"motivo"`
+	RequestID string `json:"request_id,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	CreadoEn  Fecha  `json:"creado_en"`
+}
+
+func rutaRestringida(ruta string) bool {
+	return ruta == "/admin" || strings.HasPrefix(ruta, "/admin/") || ruta == "/metrics"
+}
+
+// Redes de una lista de CIDR o IPs sueltas
+func parsearRedes(valores []string) ([]*net.IPNet, error) {
+	redes := make([]*net.IPNet, 0, len(valores))
+	for _, valor := range valores {
+		valor = strings.TrimSpace(valor)
+		if !strings.Contains(valor, "/") {
+			ip := net.ParseIP(valor)
+			if ip == nil {
+				return nil, fmt.Errorf("IP o CIDR inválido %q", valor)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			valor = fmt.Sprintf("%s/%d", valor, bits)
+		}
+		_, red, err := net.ParseCIDR(valor)
+		if err != nil {
+			return nil, fmt.Errorf("IP o CIDR inválido %q", valor)
+		}
+		redes = append(redes, red)
+	}
+	return redes, nil
+}
+
+func ipEnRedes(ip net.IP, redes []*net.IPNet) bool {
+	for _, red := range redes {
+		if red.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IP del cliente: la de la conexión o, si viene de un proxy confiable, la
+// primera de X-Forwarded-For (de derecha a izquierda) que no sea otro proxy
+// confiable. Las conexiones por socket Unix vienen del proxy local.
+func ipClienteConfiable(r *http.Request, proxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	local := ip == nil && (host == "" || host == "@")
+	if !local && (ip == nil || !ipEnRedes(ip, proxies)) {
+		return ip
+	}
+
+	reenviadas := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(reenviadas) - 1; i >= 0; i-- {
+		anterior := net.ParseIP(strings.TrimSpace(reenviadas[i]))
+		if anterior == nil {
+			break
+		}
+		ip = anterior
+		if !ipEnRedes(ip, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// IP del cliente según los proxies confiables configurados. La
+// configuración se valida al cargarla; si aun así una red es inválida no se
+// confía en ningún proxy y vale la IP de la conexión.
+func ipSolicitudConfiable(r *http.Request) net.IP {
+	proxies, err := parsearRedes(configActual().AccesoAdmin.ProxiesConfiables)
+	if err != nil {
+		proxies = nil
+	}
+	return ipClienteConfiable(r, proxies)
+}
+
+// Igual que ipSolicitudConfiable, como texto; vacía si no se puede
+// determinar
+func textoIPSolicitud(r *http.Request) string {
+	if ip := ipSolicitudConfiable(r); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Motivo por el que se rechaza la IP de la solicitud, o "" si se acepta.
+// Con una lista inválida se rechaza todo: ignorarla dejaría la
+// administración abierta a cualquier IP.
+func motivoAccesoDenegado(r *http.Request) (string, net.IP) {
+	ajustes := configActual().AccesoAdmin
+	if len(ajustes.Permitidas) == 0 && len(ajustes.Denegadas) == 0 {
+		return "", nil
+	}
+	permitidas, errPermitidas := parsearRedes(ajustes.Permitidas)
+	denegadas, errDenegadas := parsearRedes(ajustes.Denegadas)
+
+	ip := ipSolicitudConfiable(r)
+	switch {
+	case errPermitidas != nil || errDenegadas != nil:
+		return AccesoConfigInvalida, ip
+	case ip == nil:
+		return AccesoIPNoPermitida, nil
+	case ipEnRedes(ip, denegadas):
+		return AccesoIPDenegada, ip
+	case len(permitidas) > 0 && !ipEnRedes(ip, permitidas):
+		return AccesoIPNoPermitida, ip
+	}
+	return "", ip
+}
+
+// Middleware que aplica acceso_admin a /admin y /metrics
+func restringirIPsAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rutaRestringida(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		motivo, ip := motivoAccesoDenegado(r)
+		if motivo == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auditarAccesoDenegado(r, motivo, ip)
+		http.Error(w, "Acceso denegado", http.StatusForbidden)
+	})
+}
+
+// Dejar en el log y en la cola de AuditoriaAccesos un rechazo por IP
+func auditarAccesoDenegado(r *http.Request, motivo string, ip net.IP) {
+	acceso := AccesoDenegado{
+		IP:        r.RemoteAddr,
+		Metodo:    r.Method,
+		Ruta:      r.URL.Path,
+		Motivo:    motivo,
+		RequestID: idSolicitud(r.Context()),
+		UserAgent: r.UserAgent(),
+	}
+	if ip != nil {
+		acceso.IP = ip.String()
+	}
+	logSolicitud(r.Context(), fmt.Sprintf("Acceso denegado a %s %s desde %s (%s)", r.Method, r.URL.Path, acceso.IP, motivo))
+	if !escriturasBloqueadas() {
+		select {
+		case colaAccesosDenegados <- acceso:
+		default:
+		}
+	}
+}
+
+// Guardar los rechazos encolados por auditarAccesoDenegado
+func despacharAccesosDenegados() {
+	for acceso := range colaAccesosDenegados {
+		if err := registrarAccesoDenegado(acceso); err != nil {
+			log.Println("Error al registrar el acceso denegado:", err)
+		}
+	}
+}
+
+func insertarAccesoDenegado(db *sql.DB, acceso AccesoDenegado) error {
+	_, err := db.Exec(`
+		INSERT INTO AuditoriaAccesos (ip, metodo, ruta, motivo, request_id, user_agent)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))`,
+		acceso.IP, acceso.Metodo, acceso.Ruta, acceso.Motivo, acceso.RequestID, acceso.UserAgent)
+	return err
+}
+
+// Últimos accesos denegados
+func consultarAccesosDenegados(db *sql.DB, limite int) ([]AccesoDenegado, error) {
+	rows, err := db.Query(`
+		SELECT acceso_id, ip, metodo, ruta, motivo, request_id, coalesce(user_agent, ''), creado_en
+		FROM AuditoriaAccesos
+		ORDER BY creado_en DESC, acceso_id DESC
+		LIMIT $1`, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accesos := []AccesoDenegado{}
+	for rows.Next() {
+		var a AccesoDenegado
+		err := rows.Scan(&a.ID, &a.IP, &a.Metodo, &a.Ruta, &a.Motivo, &a.RequestID, &a.UserAgent, &a.CreadoEn)
+		if err != nil {
+			return nil, err
+		}
+		accesos = append(accesos, a)
+	}
+	return accesos, rows.Err()
+}
+
+// Handler para GET /admin/auditoria/accesos
+func accesosDenegadosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	accesos, err := obtenerAccesosDenegados(r.Context())
+	if err != nil {
+		http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accesos)
+}
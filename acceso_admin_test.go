@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsearRedes(t *testing.T) {
+	casos := []struct {
+		valor  string
+		red    string
+		valido bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		{"192.168.1.77/24", "192.168.1.0/24", true},
+		{"203.0.113.5", "203.0.113.5/32", true},
+		{" 203.0.113.5 ", "203.0.113.5/32", true},
+		{"2001:db8::/32", "2001:db8::/32", true},
+		{"::1", "::1/128", true},
+		{"10.0.0.0/33", "", false},
+		{"10.0.0.256", "", false},
+		{"oficina", "", false},
+		{"", "", false},
+	}
+	for _, caso := range casos {
+		redes, err := parsearRedes([]string{caso.valor})
+		if !caso.valido {
+			if err == nil {
+				t.Errorf("parsearRedes(%q) = %v, se esperaba un error", caso.valor, redes)
+			}
+			continue
+		}
+		if err != nil || len(redes) != 1 || redes[0].String() != caso.red {
+			t.Errorf("parsearRedes(%q) = %v, %v; se esperaba %s", caso.valor, redes, err, caso.red)
+		}
+	}
+
+	// Un valor inválido invalida toda la lista
+	if redes, err := parsearRedes([]string{"10.0.0.0/8", "10.0.0.0/99"}); err == nil {
+		t.Errorf("lista con un CIDR inválido aceptada: %v", redes)
+	}
+}
+
+func TestIPClienteConfiable(t *testing.T) {
+	proxies, err := parsearRedes([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	casos := []struct {
+		nombre    string
+		remota    string
+		reenviada string
+		esperada  string
+	}{
+		{"conexión directa", "198.51.100.7:5000", "", "198.51.100.7"},
+		{"directa ignora X-Forwarded-For", "198.51.100.7:5000", "203.0.113.9", "198.51.100.7"},
+		{"desde un proxy", "10.0.0.2:5000", "203.0.113.9", "203.0.113.9"},
+		{"cadena de proxies", "10.0.0.2:5000", "203.0.113.9, 10.1.1.1", "203.0.113.9"},
+		{"falsificada por el cliente", "10.0.0.2:5000", "1.2.3.4, 203.0.113.9", "203.0.113.9"},
+		{"valor inválido", "10.0.0.2:5000", "basura, 203.0.113.9", "203.0.113.9"},
+		{"proxy sin encabezado", "10.0.0.2:5000", "", "10.0.0.2"},
+		{"socket Unix", "@", "203.0.113.9", "203.0.113.9"},
+	}
+	for _, caso := range casos {
+		r := httptest.NewRequest("GET", "/admin/estado", nil)
+		r.RemoteAddr = caso.remota
+		if caso.reenviada != "" {
+			r.Header.Set("X-Forwarded-For", caso.reenviada)
+		}
+		if ip := ipClienteConfiable(r, proxies); !ip.Equal(net.ParseIP(caso.esperada)) {
+			t.Errorf("%s: %v, se esperaba %s", caso.nombre, ip, caso.esperada)
+		}
+	}
+}
+
+// Una red mal escrita rechaza todo en lugar de dejar la administración
+// abierta
+func TestMotivoAccesoDenegado(t *testing.T) {
+	anterior := config
+	defer func() { config = anterior }()
+
+	casos := []struct {
+		nombre     string
+		permitidas []string
+		denegadas  []string
+		remota     string
+		motivo     string
+	}{
+		{"sin restricciones", nil, nil, "198.51.100.7:5000", ""},
+		{"permitida", []string{"198.51.100.0/24"}, nil, "198.51.100.7:5000", ""},
+		{"fuera de las permitidas", []string{"198.51.100.0/24"}, nil, "203.0.113.9:5000", AccesoIPNoPermitida},
+		{"denegada", nil, []string{"203.0.113.9"}, "203.0.113.9:5000", AccesoIPDenegada},
+		{"denegada prevalece", []string{"203.0.113.0/24"}, []string{"203.0.113.9"}, "203.0.113.9:5000", AccesoIPDenegada},
+		{"permitidas inválidas", []string{"198.51.100.0/99"}, nil, "198.51.100.7:5000", AccesoConfigInvalida},
+		{"denegadas inválidas", nil, []string{"oficina"}, "198.51.100.7:5000", AccesoConfigInvalida},
+	}
+	for _, caso := range casos {
+		config.AccesoAdmin.Permitidas = caso.permitidas
+		config.AccesoAdmin.Denegadas = caso.denegadas
+		r := httptest.NewRequest("GET", "/admin/estado", nil)
+		r.RemoteAddr = caso.remota
+		if motivo, _ := motivoAccesoDenegado(r); motivo != caso.motivo {
+			t.Errorf("%s: %q, se esperaba %q", caso.nombre, motivo, caso.motivo)
+		}
+	}
+}
+
+// El token de administrador no sirve desde una red denegada, ni en /graphql
+// ni en los handlers con soloAdmin aunque no pasen por restringirIPsAdmin
+func TestAdminDesdeRedDenegada(t *testing.T) {
+	anterior := config
+	defer func() { config = anterior }()
+	config.Admin.Token = "secreto"
+	config.AccesoAdmin.Denegadas = []string{"203.0.113.0/24"}
+
+	casos := []struct {
+		ruta    string
+		cuerpo  string
+		handler http.HandlerFunc
+	}{
+		{"/graphql", `{"query":"mutation { revocarCertificado(numero: \"MC-1\") }"}`, graphqlHandler},
+		{"/graphql", `{"query":"{ certificadoAdmin(numero: \"MC-1\") { numero_certificado } }"}`, graphqlHandler},
+		{"/admin/certificados/MC-1/reemitir", `{"motivo":"error de nombre"}`, soloAdmin(certificadosAdminHandler)},
+	}
+	for _, caso := range casos {
+		r := httptest.NewRequest("POST", caso.ruta, strings.NewReader(caso.cuerpo))
+		r.RemoteAddr = "203.0.113.9:5000"
+		r.Header.Set("Authorization", "Bearer secreto")
+		w := httptest.NewRecorder()
+		caso.handler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: estado %d, se esperaba 403", caso.ruta, caso.cuerpo, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/buscar", nil)
+	r.RemoteAddr = "203.0.113.9:5000"
+	r.Header.Set("Authorization", "Bearer secreto")
+	if esAdmin(r) {
+		t.Error("esAdmin aceptó el token desde una red denegada")
+	}
+	r.RemoteAddr = "198.51.100.7:5000"
+	if !esAdmin(r) {
+		t.Error("esAdmin rechazó el token desde una red aceptada")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Verifica si la solicitud trae el token de administrador configurado en
+// el encabezado Authorization (formato "Bearer <token>") desde una red
+// aceptada por acceso_admin, o llega por la API interna con un certificado
+// de cliente válido
+func esAdmin(r *http.Request) bool {
+	if clienteInterno(r.Context()) != "" {
+		return true
+	}
+	if !tokenAdminValido(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		return false
+	}
+	motivo, _ := motivoAccesoDenegado(r)
+	return motivo == ""
+}
+
+// Compara un token con el de administrador en tiempo constante
+func tokenAdminValido(token string) bool {
+	esperado := configActual().Admin.Token
+	if esperado == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(esperado)) == 1
+}
+
+// Como esAdmin, pero deja constancia de los rechazos: una red no aceptada
+// se audita y devuelve errAccesoDenegado, y un token incorrecto cuenta como
+// fallo de login para los bloqueos y devuelve errNoAutorizado
+func verificarAdmin(r *http.Request) error {
+	if clienteInterno(r.Context()) != "" {
+		return nil
+	}
+	if motivo, ip := motivoAccesoDenegado(r); motivo != "" {
+		auditarAccesoDenegado(r, motivo, ip)
+		return errAccesoDenegado
+	}
+	if !tokenAdminValido(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		if r.Header.Get("Authorization") != "" {
+			registrarFallo(r, FalloLogin)
+		}
+		return errNoAutorizado
+	}
+	return nil
+}
+
+// Middleware que restringe un handler a los administradores
+func soloAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch verificarAdmin(r) {
+		case nil:
+			next(w, r)
+		case errAccesoDenegado:
+			http.Error(w, "Acceso denegado", http.StatusForbidden)
+		default:
+			http.Error(w, "No autorizado", http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Almacenamiento de archivos en un bucket compatible con S3 (AWS, MinIO,
+// Cloudflare R2...) firmando con AWS Signature V4, o en un directorio local
+// si no hay bucket configurado.
+
+const timeoutAlmacenamiento = 60 * time.Second
+
+// Guardar un archivo con la clave dada (una ruta relativa con "/")
+func guardarArchivo(ctx context.Context, clave string, contenido []byte, tipo string) error {
+	ajustes := configActual().Archivado
+	if ajustes.S3.Bucket != "" {
+		return subirObjetoS3(ctx, clave, contenido, tipo)
+	}
+
+	ruta := filepath.Join(ajustes.Directorio, filepath.FromSlash(clave))
+	if err := os.MkdirAll(filepath.Dir(ruta), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(ruta, contenido, 0o644)
+}
+
+// Leer un archivo guardado con guardarArchivo
+func leerArchivo(ctx context.Context, clave string) ([]byte, error) {
+	ajustes := configActual().Archivado
+	if ajustes.S3.Bucket != "" {
+		return descargarObjetoS3(ctx, clave)
+	}
+	return os.ReadFile(filepath.Join(ajustes.Directorio, filepath.FromSlash(clave)))
+}
+
+// Dirección del objeto en el bucket (direccionamiento por ruta:
+// endpoint/bucket/clave) y su ruta codificada para la firma
+func direccionObjetoS3(clave string) (string, string, error) {
+	s3 := configActual().Archivado.S3
+	endpoint, err := url.Parse(strings.TrimSuffix(s3.Endpoint, "/"))
+	if err != nil {
+		return "", "", fmt.Errorf("Error al leer archivado.s3.endpoint: %v", err)
+	}
+
+	segmentos := strings.Split(s3.Bucket+"/"+clave, "/")
+	for i, segmento := range segmentos {
+		segmentos[i] = url.PathEscape(segmento)
+	}
+	ruta := endpoint.Path + "/" + strings.Join(segmentos, "/")
+	return endpoint.Scheme + "://" + endpoint.Host + ruta, ruta, nil
+}
+
+// Subir un objeto con PUT al bucket
+func subirObjetoS3(ctx context.Context, clave string, contenido []byte, tipo string) error {
+	s3 := configActual().Archivado.S3
+	direccion, ruta, err := direccionObjetoS3(clave)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelar := context.WithTimeout(ctx, timeoutAlmacenamiento)
+	defer cancelar()
+	req, err := http.NewRequestWithContext(ctx, "PUT", direccion, bytes.NewReader(contenido))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", tipo)
+	firmarSolicitudS3(req, ruta, contenido, s3.Region, s3.AccessKey, s3.SecretKey, time.Now().UTC())
+
+	client := &http.Client{Timeout: timeoutAlmacenamiento}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error al subir %s: %v", clave, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detalle, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("El almacenamiento respondió con código de estado %d al subir %s: %s", resp.StatusCode, clave, detalle)
+	}
+	return nil
+}
+
+// Descargar un objeto con GET del bucket
+func descargarObjetoS3(ctx context.Context, clave string) ([]byte, error) {
+	s3 := configActual().Archivado.S3
+	direccion, ruta, err := direccionObjetoS3(clave)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancelar := context.WithTimeout(ctx, timeoutAlmacenamiento)
+	defer cancelar()
+	req, err := http.NewRequestWithContext(ctx, "GET", direccion, nil)
+	if err != nil {
+		return nil, err
+	}
+	firmarSolicitudS3(req, ruta, nil, s3.Region, s3.AccessKey, s3.SecretKey, time.Now().UTC())
+
+	client := &http.Client{Timeout: timeoutAlmacenamiento}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error al descargar %s: %v", clave, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detalle, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("El almacenamiento respondió con código de estado %d al descargar %s: %s", resp.StatusCode, clave, detalle)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Agregar los encabezados de AWS Signature V4 a la solicitud. ruta debe
+// venir ya codificada; Content-Type solo se firma si la solicitud lo lleva.
+func firmarSolicitudS3(req *http.Request, ruta string, contenido []byte, region, accessKey, secretKey string, ahora time.Time) {
+	fechaHora := ahora.Format("20060102T150405Z")
+	fecha := ahora.Format("20060102")
+	sumaContenido := sha256.Sum256(contenido)
+	hashContenido := hex.EncodeToString(sumaContenido[:])
+
+	req.Header.Set("X-Amz-Date", fechaHora)
+	req.Header.Set("X-Amz-Content-Sha256", hashContenido)
+
+	encabezadosFirmados := "host;x-amz-content-sha256;x-amz-date"
+	canonicos := []string{
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + hashContenido,
+		"x-amz-date:" + fechaHora,
+	}
+	if tipo := req.Header.Get("Content-Type"); tipo != "" {
+		encabezadosFirmados = "content-type;" + encabezadosFirmados
+		canonicos = append([]string{"content-type:" + tipo}, canonicos...)
+	}
+	solicitudCanonica := strings.Join([]string{
+		req.Method,
+		ruta,
+		"",
+		strings.Join(canonicos, "\n"),
+		"",
+		encabezadosFirmados,
+		hashContenido,
+	}, "\n")
+
+	alcance := fecha + "/" + region + "/s3/aws4_request"
+	sumaSolicitud := sha256.Sum256([]byte(solicitudCanonica))
+	textoAFirmar := "AWS4-HMAC-SHA256\n" + fechaHora + "\n" + alcance + "\n" + hex.EncodeToString(sumaSolicitud[:])
+
+	clave := []byte("AWS4" + secretKey)
+	for _, parte := range []string{fecha, region, "s3", "aws4_request"} {
+		clave = hmacSHA256(clave, parte)
+	}
+	firma := hex.EncodeToString(hmacSHA256(clave, textoAFirmar))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+alcance+
+		", SignedHeaders="+encabezadosFirmados+", Signature="+firma)
+}
+
+func hmacSHA256(clave []byte, datos string) []byte {
+	mac := hmac.New(sha256.New, clave)
+	mac.Write([]byte(datos))
+	return mac.Sum(nil)
+}
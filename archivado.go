@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Archivado de los registros antiguos para que las tablas de uso diario no
+// crezcan sin límite: las verificaciones y los registros de auditoría con
+// más de archivado.retencion_dias se borran de la base y se guardan como
+// JSON por líneas comprimido con gzip en el almacenamiento configurado
+// (almacenamiento.go), un archivo por tabla y lote.
+
+const (
+	intervaloArchivado = time.Hour
+	// Filas por archivo; las tablas con más se archivan en varios lotes
+	loteArchivado = 50000
+	// Clave en ReportesEnviados para archivar una sola vez por día
+	frecuenciaArchivado = "archivado"
+)
+
+// Tabla archivada, la columna de fecha que decide su antigüedad y una
+// condición adicional para las filas que se pueden archivar
+type tablaArchivada struct {
+	tabla     string
+	columna   string
+	condicion string
+}
+
+var tablasArchivadas = []tablaArchivada{
+	{"Verificaciones", "dia", ""},
+	// Solo los eventos ya publicados; los descartados esperan un reintento
+	{"Outbox", "creado_en", "publicado_en IS NOT NULL"},
+	{"HistorialConsentimientos", "registrado_en", ""},
+	{"FusionesClientes", "realizado_en", ""},
+	{"Escaneos", "creado_en", ""},
+	{"AuditoriaAccesos", "creado_en", ""},
+	{"EntregasWebhooks", "creado_en", ""},
+	// Solo los resueltos; descartar también fija resuelto_en. Los agotados
+	// quedan sin resolver hasta que se reintenten o se descarten a mano
+	{"WebhooksFallidos", "creado_en", "resuelto_en IS NOT NULL"},
+}
+
+// Archivar las filas de una tabla anteriores a limite. Cada lote se borra
+// en una transacción que solo se confirma si el archivo se guardó.
+func archivarTabla(ctx context.Context, db *sql.DB, t tablaArchivada, limite time.Time, marca string) (int, error) {
+	condicion := ""
+	if t.condicion != "" {
+		condicion = " AND " + t.condicion
+	}
+	consulta := fmt.Sprintf(`
+		DELETE FROM %[1]s AS t
+		WHERE ctid IN (SELECT ctid FROM %[1]s WHERE %[2]s < $1%[3]s LIMIT $2)
+		RETURNING row_to_json(t)::text`, t.tabla, t.columna, condicion)
+
+	total := 0
+	for lote := 1; ; lote++ {
+		var filas int
+		err := enTransaccion(db, func(tx *sql.Tx) error {
+			rows, err := tx.Query(consulta, limite, loteArchivado)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			var b bytes.Buffer
+			gz := gzip.NewWriter(&b)
+			for rows.Next() {
+				var fila string
+				if err := rows.Scan(&fila); err != nil {
+					return err
+				}
+				gz.Write([]byte(fila + "\n"))
+				filas++
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			if filas == 0 {
+				return nil
+			}
+
+			clave := fmt.Sprintf("%s%s/%s-%d.jsonl.gz", prefijoArchivado(), strings.ToLower(t.tabla), marca, lote)
+			return guardarArchivo(ctx, clave, b.Bytes(), "application/gzip")
+		})
+		if err != nil {
+			return total, fmt.Errorf("Error al archivar %s: %v", t.tabla, err)
+		}
+		total += filas
+		if filas < loteArchivado {
+			return total, nil
+		}
+	}
+}
+
+func prefijoArchivado() string {
+	prefijo := strings.Trim(configActual().Archivado.S3.Prefijo, "/")
+	if prefijo == "" {
+		return ""
+	}
+	return prefijo + "/"
+}
+
+// Archivar todas las tablas; devuelve las filas archivadas por tabla
+func archivarRegistrosAntiguos(ctx context.Context, db *sql.DB, ahora time.Time) (map[string]int, error) {
+	limite := ahora.AddDate(0, 0, -configActual().Archivado.RetencionDias)
+	// La marca de tiempo evita pisar los archivos de un intento anterior
+	marca := ahora.UTC().Format("20060102T150405Z")
+
+	archivadas := map[string]int{}
+	for _, t := range tablasArchivadas {
+		n, err := archivarTabla(ctx, db, t, limite, marca)
+		archivadas[t.tabla] = n
+		if err != nil {
+			return archivadas, err
+		}
+	}
+	return archivadas, nil
+}
+
+// Goroutine que archiva una vez al día a partir de archivado.hora. Se
+// reserva en ReportesEnviados para que solo lo haga una instancia.
+func despacharArchivado() {
+	for range time.Tick(intervaloArchivado) {
+		ajustes := configActual().Archivado
+		if ajustes.RetencionDias <= 0 || escriturasBloqueadas() {
+			continue
+		}
+		ahora := time.Now().In(zonaHoraria)
+		if ahora.Hour() < ajustes.Hora {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Archivado: error al conectar a la base de datos:", err)
+			continue
+		}
+		hoy := time.Date(ahora.Year(), ahora.Month(), ahora.Day(), 0, 0, 0, 0, zonaHoraria)
+		reservado, err := reservarReporte(db, frecuenciaArchivado, hoy)
+		if err != nil {
+			log.Println("Archivado:", err)
+			continue
+		}
+		if !reservado {
+			continue
+		}
+
+		archivadas, err := archivarRegistrosAntiguos(context.Background(), db, ahora)
+		for tabla, n := range archivadas {
+			if n > 0 {
+				logInfo("Archivado: %d filas de %s", n, tabla)
+			}
+		}
+		if err != nil {
+			// Se reintenta en el próximo ciclo
+			log.Println("Archivado:", err)
+			if err := liberarReporte(db, frecuenciaArchivado, hoy); err != nil {
+				log.Println("Archivado:", err)
+			}
+		}
+	}
+}
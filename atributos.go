@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Vocabularios controlados para tipo_cabello, color y longitud. Cada
+// atributo tiene valores canónicos con alias ("Lacio" es "Liso", "16"" es
+// "40 cm"); al escribir un producto el valor se resuelve a su forma
+// canónica y se rechaza si no está en el catálogo. El frontend arma los
+// desplegables de filtros con GET /atributos.
+
+// Atributos de cabello con vocabulario controlado, en el orden de los filtros
+var atributosCabello = []string{"tipo_cabello", "color", "longitud"}
+
+var (
+	errAtributoInexistente   = errors.New("Atributo no encontrado (tipo_cabello, color o longitud)")
+	errValorAtributoInvalido = errors.New("Valor no permitido; los valores válidos están en GET /atributos")
+)
+
+type ValorAtributo struct {
+	Valor string   `json:"valor"`
+	Alias []string `json:"alias"`
+	// Productos que tienen el valor, para mostrar en el filtro
+	Productos int `json:"productos"`
+}
+
+func atributoValido(atributo string) bool {
+	for _, a := range atributosCabello {
+		if a == atributo {
+			return true
+		}
+	}
+	return false
+}
+
+// Forma de comparación: sin tildes, en mayúsculas y sin espacios
+func claveAtributo(valor string) string {
+	return strings.Join(strings.Fields(strings.ToUpper(reemplazoTildes.Replace(valor))), "")
+}
+
+// Valores canónicos de un atributo con sus alias y la cantidad de productos
+// de cada uno
+func consultarVocabulario(q consultorFilas, atributo string) ([]ValorAtributo, error) {
+	// atributo ya se validó contra atributosCabello
+	rows, err := q.Query(`
+		SELECT v.valor,
+			coalesce((SELECT array_agg(a.alias ORDER BY a.alias) FROM AliasAtributo a
+				WHERE a.atributo = v.atributo AND a.valor = v.valor), '{}'),
+			(SELECT count(*) FROM Productos p WHERE p.`+atributo+` = v.valor)
+		FROM ValoresAtributo v
+		WHERE v.atributo = $1
+		ORDER BY v.orden, v.valor`, atributo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	valores := []ValorAtributo{}
+	for rows.Next() {
+		var v ValorAtributo
+		if err := rows.Scan(&v.Valor, pq.Array(&v.Alias), &v.Productos); err != nil {
+			return nil, err
+		}
+		valores = append(valores, v)
+	}
+	return valores, rows.Err()
+}
+
+// Forma canónica de un valor según el vocabulario del atributo
+func resolverAtributo(vocabulario []ValorAtributo, valor string) (string, bool) {
+	clave := claveAtributo(valor)
+	if clave == "" {
+		return "", false
+	}
+	for _, v := range vocabulario {
+		if claveAtributo(v.Valor) == clave {
+			return v.Valor, true
+		}
+		for _, alias := range v.Alias {
+			if claveAtributo(alias) == clave {
+				return v.Valor, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Guardar los atributos de cabello de un producto en su forma canónica. Los
+// atributos ausentes no se modifican.
+func guardarAtributosProducto(db *sql.DB, productoID int, valores map[string]string) (map[string]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	canonicos := map[string]string{}
+	for _, atributo := range atributosCabello {
+		valor, ok := valores[atributo]
+		if !ok {
+			continue
+		}
+		vocabulario, err := consultarVocabulario(tx, atributo)
+		if err != nil {
+			return nil, err
+		}
+		canonico, ok := resolverAtributo(vocabulario, valor)
+		if !ok {
+			return nil, errValorAtributoInvalido
+		}
+		resultado, err := tx.Exec(`UPDATE Productos SET `+atributo+` = $1 WHERE producto_id = $2`, canonico, productoID)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := resultado.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = errProductoInexistente
+			}
+			return nil, err
+		}
+		canonicos[atributo] = canonico
+	}
+	return canonicos, tx.Commit()
+}
+
+// Agregar o actualizar un valor canónico y reemplazar sus alias
+func guardarValorAtributo(db *sql.DB, atributo string, valor ValorAtributo, orden int) error {
+	valor.Valor = strings.TrimSpace(valor.Valor)
+	if valor.Valor == "" {
+		return errValorAtributoInvalido
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO ValoresAtributo (atributo, valor, orden) VALUES ($1, $2, $3)
+		ON CONFLICT (atributo, valor) DO UPDATE SET orden = EXCLUDED.orden`,
+		atributo, valor.Valor, orden)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM AliasAtributo WHERE atributo = $1 AND valor = $2`, atributo, valor.Valor)
+	if err != nil {
+		return err
+	}
+	for _, alias := range valor.Alias {
+		alias = strings.TrimSpace(alias)
+		if alias == "" {
+			continue
+		}
+		// Un alias apunta a un solo valor: si ya existía se reasigna
+		_, err = tx.Exec(`
+			INSERT INTO AliasAtributo (atributo, alias, valor) VALUES ($1, $2, $3)
+			ON CONFLICT (atributo, alias) DO UPDATE SET valor = EXCLUDED.valor`,
+			atributo, alias, valor.Valor)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Resultado de pasar los atributos de los productos a su forma canónica
+type ResumenAtributos struct {
+	Revisados    int
+	Normalizados int
+	// "producto 12: color \"Gris\"" para los valores fuera del catálogo
+	Invalidos []string
+}
+
+// Pasar a la forma canónica los atributos de todos los productos
+// (melenas migrate atributos). Los valores que no se pueden resolver se
+// reportan y quedan como están.
+func normalizarAtributosProductos(db *sql.DB) (ResumenAtributos, error) {
+	var resumen ResumenAtributos
+
+	tx, err := db.Begin()
+	if err != nil {
+		return resumen, err
+	}
+	defer tx.Rollback()
+
+	for _, atributo := range atributosCabello {
+		vocabulario, err := consultarVocabulario(tx, atributo)
+		if err != nil {
+			return resumen, err
+		}
+
+		rows, err := tx.Query(`
+			SELECT producto_id, ` + atributo + ` FROM Productos
+			WHERE ` + atributo + ` IS NOT NULL
+			ORDER BY producto_id
+			FOR UPDATE`)
+		if err != nil {
+			return resumen, err
+		}
+		cambios := map[int]string{}
+		for rows.Next() {
+			var productoID int
+			var valor string
+			if err := rows.Scan(&productoID, &valor); err != nil {
+				rows.Close()
+				return resumen, err
+			}
+			resumen.Revisados++
+			canonico, ok := resolverAtributo(vocabulario, valor)
+			if !ok {
+				resumen.Invalidos = append(resumen.Invalidos, fmt.Sprintf("producto %d: %s %q", productoID, atributo, valor))
+				continue
+			}
+			if canonico != valor {
+				cambios[productoID] = canonico
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return resumen, err
+		}
+
+		for productoID, canonico := range cambios {
+			_, err := tx.Exec(`UPDATE Productos SET `+atributo+` = $1 WHERE producto_id = $2`, canonico, productoID)
+			if err != nil {
+				return resumen, err
+			}
+			resumen.Normalizados++
+		}
+	}
+	return resumen, tx.Commit()
+}
+
+// Handler para GET /atributos (los tres vocabularios) y
+// GET /atributos/{atributo}
+func atributosHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	atributos := atributosCabello
+	if atributo := strings.Trim(strings.TrimPrefix(r.URL.Path, "/atributos"), "/"); atributo != "" {
+		if !atributoValido(atributo) {
+			http.Error(w, errAtributoInexistente.Error(), http.StatusNotFound)
+			return
+		}
+		atributos = []string{atributo}
+	}
+
+	vocabularios, err := obtenerVocabularios(r.Context(), atributos)
+	if err != nil {
+		http.Error(w, "Error al consultar los atributos", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	var respuesta interface{} = vocabularios
+	if len(atributos) == 1 {
+		respuesta = vocabularios[atributos[0]]
+	}
+	responderJSONConETag(w, r, respuesta, cacheControlProductos())
+}
+
+// Handler para PUT /admin/atributos/{atributo}
+// {"valor": "Rubio ceniza", "alias": ["Ash blonde"], "orden": 7}
+func editarAtributoHandler(w http.ResponseWriter, r *http.Request) {
+	atributo := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/atributos/"), "/")
+	if !atributoValido(atributo) {
+		http.Error(w, errAtributoInexistente.Error(), http.StatusNotFound)
+		return
+	}
+	if r.Method != "PUT" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		ValorAtributo
+		Orden int `json:"orden"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	if err := actualizarValorAtributo(atributo, solicitud.ValorAtributo, solicitud.Orden); err != nil {
+		responderErrorAtributo(w, r, err, "Error al guardar el valor")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler para PUT /admin/productos/{id}/atributos
+// {"tipo_cabello": "lacio", "color": "1B", "longitud": "16\""}; responde
+// con los valores canónicos guardados. DELETE /admin/productos/{id} y
+// POST /admin/productos/{id}/restore son el borrado lógico del producto.
+func atributosProductoHandler(w http.ResponseWriter, r *http.Request) {
+	id, accion, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/productos/"), "/"), "/")
+	productoID, err := strconv.Atoi(id)
+	if err != nil || productoID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if accion != "atributos" {
+		borradoLogicoHandler(w, r, entidadProductos, productoID, accion)
+		return
+	}
+	if r.Method != "PUT" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var valores map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&valores); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	for atributo := range valores {
+		if !atributoValido(atributo) {
+			http.Error(w, "Atributo desconocido: "+atributo, http.StatusBadRequest)
+			return
+		}
+	}
+
+	canonicos, err := actualizarAtributosProducto(productoID, valores)
+	if err != nil {
+		responderErrorAtributo(w, r, err, "Error al guardar los atributos")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(canonicos)
+}
+
+func responderErrorAtributo(w http.ResponseWriter, r *http.Request, err error, mensaje string) {
+	switch err {
+	case errValorAtributoInvalido:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errAtributoInexistente, errProductoInexistente:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, mensaje, http.StatusInternalServerError)
+	}
+	logSolicitud(r.Context(), err)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Avisos operativos al equipo por Slack (webhook entrante) y/o Telegram
+// (bot): certificados emitidos, sincronizaciones con Rocketfy fallidas,
+// errores del proveedor de pagos y un resumen diario de ventas. Un aviso que
+// no se puede entregar solo se registra en el log; nunca detiene la
+// operación que lo originó.
+
+// Tipos de aviso
+const (
+	AvisoCertificadoEmitido    = EventoCertificadoEmitido
+	AvisoSincronizacionFallida = "sincronizacion_fallida"
+	AvisoErrorPagos            = "error_pagos"
+	AvisoResumenDiario         = "resumen_diario"
+	AvisoEscaneosAnomalos      = EventoEscaneosAnomalos
+	AvisoCertificadoSenuelo    = EventoCertificadoSenuelo
+	AvisoCambioEsquema         = "cambio_esquema_rocketfy"
+	AvisoWebhookFallido        = "webhook_fallido"
+	AvisoEventoDescartado      = "evento_descartado"
+)
+
+var tiposAviso = []string{
+	AvisoCertificadoEmitido,
+	AvisoSincronizacionFallida,
+	AvisoErrorPagos,
+	AvisoResumenDiario,
+	AvisoEscaneosAnomalos,
+	AvisoCertificadoSenuelo,
+	AvisoCambioEsquema,
+	AvisoWebhookFallido,
+	AvisoEventoDescartado,
+}
+
+const (
+	timeoutTelegram = 10 * time.Second
+	// Cada cuánto se revisa si toca enviar el resumen diario
+	intervaloAvisos = 15 * time.Minute
+)
+
+// URL base de la API de bots de Telegram
+var urlTelegram = "https://api.telegram.org"
+
+func tipoAvisoValido(tipo string) bool {
+	for _, t := range tiposAviso {
+		if t == tipo {
+			return true
+		}
+	}
+	return false
+}
+
+// Hay algún canal configurado y el tipo está entre avisos.eventos (vacío
+// para todos)
+func avisoHabilitado(tipo string) bool {
+	ajustes := configActual().Avisos
+	if ajustes.SlackWebhook == "" && ajustes.TelegramToken == "" {
+		return false
+	}
+	if len(ajustes.Eventos) == 0 {
+		return true
+	}
+	for _, t := range ajustes.Eventos {
+		if t == tipo {
+			return true
+		}
+	}
+	return false
+}
+
+// Enviar un mensaje al chat con el bot de Telegram
+func enviarTelegram(token, chatID, texto string) error {
+	return llamarTelegram(context.Background(), token, "sendMessage",
+		map[string]string{"chat_id": chatID, "text": texto}, nil, timeoutTelegram)
+}
+
+// Enviar un aviso a todos los canales configurados si su tipo está habilitado
+func enviarAviso(tipo, texto string) error {
+	if !avisoHabilitado(tipo) {
+		return nil
+	}
+	ajustes := configActual().Avisos
+
+	var errores []string
+	if ajustes.SlackWebhook != "" {
+		if err := enviarSlack(ajustes.SlackWebhook, texto); err != nil {
+			errores = append(errores, fmt.Sprintf("Slack: %v", err))
+		}
+	}
+	if ajustes.TelegramToken != "" {
+		if err := enviarTelegram(ajustes.TelegramToken, ajustes.TelegramChatID, texto); err != nil {
+			errores = append(errores, fmt.Sprintf("Telegram: %v", err))
+		}
+	}
+	if len(errores) > 0 {
+		return errors.New(strings.Join(errores, "; "))
+	}
+	return nil
+}
+
+// Enviar un aviso registrando en el log si falla
+func avisar(tipo, texto string) {
+	if err := enviarAviso(tipo, texto); err != nil {
+		log.Printf("Error al enviar el aviso %s: %v", tipo, err)
+	}
+}
+
+// Publicador del outbox que avisa los certificados emitidos. Nunca devuelve
+// error para que un aviso fallido no haga reintentar el evento en los demás
+// destinos.
+func publicadorAvisos(evento Evento) error {
+	if evento.Tipo != EventoCertificadoEmitido || !avisoHabilitado(AvisoCertificadoEmitido) {
+		return nil
+	}
+
+	var certificado EventoCertificado
+	if datos, ok := evento.Datos.(json.RawMessage); ok {
+		if err := json.Unmarshal(datos, &certificado); err != nil {
+			log.Println("Avisos: evento de certificado inválido:", err)
+			return nil
+		}
+	}
+	if !certificado.notificar(NotificarAviso) {
+		return nil
+	}
+	texto := "Nuevo certificado emitido: " + certificado.NumeroCertificado
+	if certificado.CompraID != 0 {
+		texto += fmt.Sprintf(" (compra %d)", certificado.CompraID)
+	}
+	avisar(AvisoCertificadoEmitido, texto)
+	return nil
+}
+
+// Texto del resumen de ventas del día [desde, hasta)
+func generarResumenDiario(ctx context.Context, desde, hasta time.Time) (string, error) {
+	estadisticas, err := obtenerEstadisticas(ctx, desde, hasta)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Resumen del %s\n", desde.Format(formatoFechaEstadisticas))
+	fmt.Fprintf(&b, "Compras: %d\n", estadisticas.Compras)
+	fmt.Fprintf(&b, "Unidades: %d\n", estadisticas.Unidades)
+	fmt.Fprintf(&b, "Ingresos: $%s\n", estadisticas.Ingresos)
+	fmt.Fprintf(&b, "Certificados emitidos: %d", estadisticas.CertificadosEmitidos)
+	if len(estadisticas.TopProductos) > 0 {
+		top := estadisticas.TopProductos[0]
+		fmt.Fprintf(&b, "\nMás vendido: %s (%d unidades)", top.Nombre, top.Unidades)
+	}
+	return b.String(), nil
+}
+
+// Goroutine que envía el resumen del día anterior a partir de
+// avisos.hora_resumen. Se reserva en ReportesEnviados para que solo lo
+// envíe una instancia.
+func despacharAvisos() {
+	for range time.Tick(intervaloAvisos) {
+		if !avisoHabilitado(AvisoResumenDiario) || estadoActualMantenimiento().Modo == ModoMantenimiento {
+			continue
+		}
+		ahora := time.Now().In(zonaHoraria)
+		if ahora.Hour() < configActual().Avisos.HoraResumen {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Avisos: error al conectar a la base de datos:", err)
+			continue
+		}
+
+		hasta := time.Date(ahora.Year(), ahora.Month(), ahora.Day(), 0, 0, 0, 0, zonaHoraria)
+		desde := hasta.AddDate(0, 0, -1)
+		reservado, err := reservarReporte(db, AvisoResumenDiario, desde)
+		if err != nil {
+			log.Println("Avisos:", err)
+			continue
+		}
+		if !reservado {
+			continue
+		}
+
+		resumen, err := generarResumenDiario(context.Background(), desde, hasta)
+		if err == nil {
+			err = enviarAviso(AvisoResumenDiario, resumen)
+		}
+		if err != nil {
+			// Se reintenta en el próximo ciclo
+			log.Println("Avisos: error al enviar el resumen diario:", err)
+			if err := liberarReporte(db, AvisoResumenDiario, desde); err != nil {
+				log.Println("Avisos:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protección contra fuerza bruta: se cuentan por IP los tokens de
+// administrador rechazados y las consultas de certificados, enlaces o
+// tokens de QR inexistentes. Al superar proteccion.fallos_login o
+// proteccion.fallos_consulta dentro de proteccion.ventana_minutos la IP se
+// bloquea; cada bloqueo seguido dura el doble que el anterior hasta
+// proteccion.maximo_bloqueo_horas. Los bloqueos se guardan en BloqueosIP y
+// cada instancia los recarga periódicamente; las solicitudes desde
+// localhost nunca se bloquean, para poder levantar un bloqueo desde el
+// propio servidor.
+
+// Tipos de fallo
+const (
+	FalloLogin    = "login"
+	FalloConsulta = "consulta"
+)
+
+const (
+	// Cada cuánto se recargan los bloqueos y se limpian los contadores
+	intervaloBloqueos = time.Minute
+	// Tope de bloqueos vigentes que se cargan en memoria
+	maximoBloqueosCargados = 100000
+)
+
+// Bloqueo de una IP
+type BloqueoIP struct {
+	IP             string `json:"ip"`
+	Motivo         string `json:"motivo"`
+	Bloqueos       int    `json:"bloqueos"`
+	BloqueadoHasta Fecha  `json:"bloqueado_hasta"`
+	CreadoEn       *Fecha `json:"creado_en,omitempty"`
+	LevantadoEn    *Fecha `json:"levantado_en,omitempty"`
+}
+
+// Fallos de una IP en la ventana actual
+type fallosIP struct {
+	inicio   time.Time
+	login    int
+	consulta int
+}
+
+var (
+	muBloqueos sync.Mutex
+	// IP -> fin del bloqueo vigente
+	bloqueosActivos  = map[string]time.Time{}
+	contadoresFallos = map[string]*fallosIP{}
+)
+
+func proteccionActiva() bool {
+	ajustes := configActual().Proteccion
+	return ajustes.FallosLogin > 0 || ajustes.FallosConsulta > 0
+}
+
+// IP de la solicitud para los bloqueos; vacía si no se puede determinar o
+// es local
+func ipBloqueable(r *http.Request) string {
+	ip := ipSolicitudConfiable(r)
+	if ip == nil || ip.IsLoopback() {
+		return ""
+	}
+	return ip.String()
+}
+
+// Fin del bloqueo vigente de una IP
+func bloqueoVigente(ip string, ahora time.Time) (time.Time, bool) {
+	muBloqueos.Lock()
+	defer muBloqueos.Unlock()
+	hasta, ok := bloqueosActivos[ip]
+	if !ok || !hasta.After(ahora) {
+		return time.Time{}, false
+	}
+	return hasta, true
+}
+
+// Registrar un fallo de la solicitud y bloquear la IP si supera el umbral
+func registrarFallo(r *http.Request, tipo string) {
+	ip := ipBloqueable(r)
+	if ip == "" || !proteccionActiva() {
+		return
+	}
+	ajustes := configActual().Proteccion
+	ahora := time.Now()
+	ventana := time.Duration(ajustes.VentanaMinutos) * time.Minute
+
+	muBloqueos.Lock()
+	fallos, ok := contadoresFallos[ip]
+	if !ok || ahora.Sub(fallos.inicio) > ventana {
+		fallos = &fallosIP{inicio: ahora}
+		contadoresFallos[ip] = fallos
+	}
+	umbral, cantidad := ajustes.FallosConsulta, &fallos.consulta
+	if tipo == FalloLogin {
+		umbral, cantidad = ajustes.FallosLogin, &fallos.login
+	}
+	*cantidad++
+	bloquear := umbral > 0 && *cantidad >= umbral
+	if bloquear {
+		delete(contadoresFallos, ip)
+		// Bloqueo provisional mientras se guarda y se calcula su duración
+		bloqueosActivos[ip] = ahora.Add(time.Duration(ajustes.BloqueoMinutos) * time.Minute)
+	}
+	muBloqueos.Unlock()
+
+	if !bloquear {
+		return
+	}
+	logSolicitud(r.Context(), fmt.Sprintf("IP %s bloqueada por %d fallos de %s en %v", ip, umbral, tipo, ventana))
+	go func() {
+		bloqueo, err := guardarBloqueoIP(ip, tipo)
+		if err != nil {
+			log.Println("Error al guardar el bloqueo:", err)
+			return
+		}
+		muBloqueos.Lock()
+		bloqueosActivos[ip] = bloqueo.BloqueadoHasta.Time
+		muBloqueos.Unlock()
+	}()
+}
+
+// Middleware que rechaza las solicitudes de IPs bloqueadas
+func rechazarIPsBloqueadas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ipBloqueable(r)
+		if ip == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hasta, bloqueada := bloqueoVigente(ip, time.Now())
+		if !bloqueada {
+			next.ServeHTTP(w, r)
+			return
+		}
+		segundos := int(math.Ceil(time.Until(hasta).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(segundos))
+		http.Error(w, "Demasiados intentos fallidos; vuelva a intentarlo más tarde", http.StatusTooManyRequests)
+	})
+}
+
+// Guardar o alargar el bloqueo de una IP; la duración se duplica con cada
+// bloqueo seguido
+func insertarBloqueoIP(db *sql.DB, ip, motivo string) (BloqueoIP, error) {
+	ajustes := configActual().Proteccion
+	bloqueo := BloqueoIP{IP: ip, Motivo: motivo}
+	err := db.QueryRow(`
+		INSERT INTO BloqueosIP (ip, motivo, bloqueos, bloqueado_hasta)
+		VALUES ($1, $2, 1, now() + $3 * interval '1 minute')
+		ON CONFLICT (ip) DO UPDATE SET
+			motivo = EXCLUDED.motivo,
+			bloqueos = BloqueosIP.bloqueos + 1,
+			bloqueado_hasta = now() + least($3 * power(2, BloqueosIP.bloqueos), $4 * 60) * interval '1 minute',
+			actualizado_en = now(),
+			levantado_en = NULL
+		RETURNING bloqueos, bloqueado_hasta, creado_en`,
+		ip, motivo, ajustes.BloqueoMinutos, ajustes.MaximoBloqueoHoras).
+		Scan(&bloqueo.Bloqueos, &bloqueo.BloqueadoHasta, &bloqueo.CreadoEn)
+	return bloqueo, err
+}
+
+// Bloqueos vigentes o, con todos, también los vencidos y levantados
+func consultarBloqueosIP(db *sql.DB, todos bool, limite int) ([]BloqueoIP, error) {
+	rows, err := db.Query(`
+		SELECT ip, motivo, bloqueos, bloqueado_hasta, creado_en, levantado_en
+		FROM BloqueosIP
+		WHERE bloqueado_hasta > now() OR $1
+		ORDER BY actualizado_en DESC
+		LIMIT $2`, todos, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bloqueos := []BloqueoIP{}
+	for rows.Next() {
+		var b BloqueoIP
+		if err := rows.Scan(&b.IP, &b.Motivo, &b.Bloqueos, &b.BloqueadoHasta, &b.CreadoEn, &b.LevantadoEn); err != nil {
+			return nil, err
+		}
+		bloqueos = append(bloqueos, b)
+	}
+	return bloqueos, rows.Err()
+}
+
+// Levantar el bloqueo de una IP y reiniciar su escalamiento; sql.ErrNoRows
+// si no está bloqueada
+func levantarBloqueoIP(db *sql.DB, ip string) error {
+	resultado, err := db.Exec(`
+		UPDATE BloqueosIP SET bloqueado_hasta = now(), bloqueos = 0, levantado_en = now(), actualizado_en = now()
+		WHERE ip = $1 AND bloqueado_hasta > now()`, ip)
+	if err != nil {
+		return err
+	}
+	if n, err := resultado.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Recargar periódicamente los bloqueos vigentes (de esta y otras
+// instancias) y descartar los contadores vencidos
+func despacharBloqueos() {
+	for {
+		if proteccionActiva() {
+			bloqueos, err := obtenerBloqueosVigentes()
+			if err != nil {
+				log.Println("Error al cargar los bloqueos de IP:", err)
+			} else {
+				activos := make(map[string]time.Time, len(bloqueos))
+				for _, b := range bloqueos {
+					activos[b.IP] = b.BloqueadoHasta.Time
+				}
+				ventana := time.Duration(configActual().Proteccion.VentanaMinutos) * time.Minute
+				muBloqueos.Lock()
+				bloqueosActivos = activos
+				for ip, fallos := range contadoresFallos {
+					if time.Since(fallos.inicio) > ventana {
+						delete(contadoresFallos, ip)
+					}
+				}
+				muBloqueos.Unlock()
+			}
+		}
+		time.Sleep(intervaloBloqueos)
+	}
+}
+
+// Handler para GET /admin/bloqueos (?todos=true incluye los vencidos) y
+// POST /admin/bloqueos/{ip}/levantar
+func bloqueosHandler(w http.ResponseWriter, r *http.Request) {
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/bloqueos"), "/")
+	if ruta == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		bloqueos, err := obtenerBloqueosIP(r.Context(), r.URL.Query().Get("todos") == "true")
+		if err != nil {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bloqueos)
+		return
+	}
+
+	ip, accion, _ := strings.Cut(ruta, "/")
+	if net.ParseIP(ip) == nil || accion != "levantar" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	ip = net.ParseIP(ip).String()
+
+	err := quitarBloqueoIP(r.Context(), ip)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Error al levantar el bloqueo", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	// Un bloqueo que no se alcanzó a guardar solo está en memoria
+	muBloqueos.Lock()
+	_, enMemoria := bloqueosActivos[ip]
+	delete(bloqueosActivos, ip)
+	delete(contadoresFallos, ip)
+	muBloqueos.Unlock()
+	if err == sql.ErrNoRows && !enMemoria {
+		http.Error(w, "La IP no está bloqueada", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Borrado lógico de clientes, productos y certificados. DELETE en
+// /admin/{clientes,productos,certificados}/{id} marca eliminado_en y
+// POST .../{id}/restore lo quita. Los registros eliminados no aparecen en
+// las consultas públicas ni en la búsqueda; los administradores los ven
+// agregando ?include_deleted=true.
+
+var (
+	errRegistroYaEliminado = errors.New("El registro ya está eliminado")
+	errRegistroNoEliminado = errors.New("El registro no está eliminado")
+)
+
+// Tabla con borrado lógico y la columna por la que se identifica
+type entidadBorrable struct {
+	tabla       string
+	columnaID   string
+	inexistente error
+}
+
+var (
+	entidadClientes     = entidadBorrable{"Clientes", "cliente_id", errClienteInexistente}
+	entidadProductos    = entidadBorrable{"Productos", "producto_id", errProductoInexistente}
+	entidadCertificados = entidadBorrable{"Certificados", "numero_certificado", errCertificadoInexistente}
+)
+
+type claveIncluirEliminados struct{}
+
+// Contexto que incluye los registros eliminados si un administrador lo pide
+// con ?include_deleted=true
+func contextoIncluirEliminados(r *http.Request) context.Context {
+	if r.URL.Query().Get("include_deleted") == "true" && esAdmin(r) {
+		return context.WithValue(r.Context(), claveIncluirEliminados{}, true)
+	}
+	return r.Context()
+}
+
+func incluirEliminados(ctx context.Context) bool {
+	incluir, _ := ctx.Value(claveIncluirEliminados{}).(bool)
+	return incluir
+}
+
+// Marcar (eliminar) o desmarcar (restaurar) un registro
+func marcarEliminado(db *sql.DB, entidad entidadBorrable, id interface{}, eliminar bool) error {
+	nuevoValor := "NULL"
+	if eliminar {
+		nuevoValor = "now()"
+	}
+	resultado, err := db.Exec(fmt.Sprintf(
+		`UPDATE %s SET eliminado_en = %s WHERE %s = $1 AND (eliminado_en IS NULL) = $2`,
+		entidad.tabla, nuevoValor, entidad.columnaID), id, eliminar)
+	if err != nil {
+		return err
+	}
+	if filas, err := resultado.RowsAffected(); err != nil || filas > 0 {
+		return err
+	}
+
+	// Nada cambió: el registro no existe o ya estaba en ese estado
+	var existe int
+	err = db.QueryRow(fmt.Sprintf(`SELECT 1 FROM %s WHERE %s = $1`, entidad.tabla, entidad.columnaID), id).Scan(&existe)
+	if err == sql.ErrNoRows {
+		return entidad.inexistente
+	}
+	if err != nil {
+		return err
+	}
+	if eliminar {
+		return errRegistroYaEliminado
+	}
+	return errRegistroNoEliminado
+}
+
+// Responder DELETE (eliminar) o POST .../restore (restaurar) sobre un
+// registro. accion es lo que sigue al identificador en la ruta.
+func borradoLogicoHandler(w http.ResponseWriter, r *http.Request, entidad entidadBorrable, id interface{}, accion string) {
+	var eliminar bool
+	switch {
+	case accion == "" && r.Method == "DELETE":
+		eliminar = true
+	case accion == "restore" && r.Method == "POST":
+		eliminar = false
+	case accion == "" || accion == "restore":
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	err := cambiarEliminado(r.Context(), entidad, id, eliminar)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case entidad.inexistente:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errRegistroYaEliminado, errRegistroNoEliminado:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Error al actualizar el registro", http.StatusInternalServerError)
+	}
+	logSolicitud(r.Context(), err)
+}
+
+// Handler para DELETE /admin/certificados/{numero},
+// POST /admin/certificados/{numero}/restore,
+// GET /admin/certificados/{numero}/versiones,
+// GET /admin/certificados/{numero}/historial,
+// GET /admin/certificados/{numero}/qr,
+// GET|POST /admin/certificados/{numero}/nfc y
+// POST /admin/certificados/{numero}/reemitir
+func certificadosAdminHandler(w http.ResponseWriter, r *http.Request) {
+	numero, accion, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/certificados/"), "/"), "/")
+	if numero == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch accion {
+	case "versiones":
+		versionesCertificadoHandler(w, r, numero)
+		return
+	case "historial":
+		historialCertificadoHandler(w, r, numero)
+		return
+	case "qr":
+		tokenCertificadoHandler(w, r, numero)
+		return
+	case "nfc":
+		nfcCertificadoHandler(w, r, numero)
+		return
+	case "reemitir":
+		reemitirCertificadoHandler(w, r, numero)
+		return
+	}
+	borradoLogicoHandler(w, r, entidadCertificados, numero, accion)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Bot de Telegram para verificar certificados: el cliente le escribe el
+// número de su certificado y recibe el resultado con la foto del producto.
+// Las actualizaciones llegan por webhook (POST /telegram/webhook, registrado
+// en Telegram con setWebhook y secret_token) o por long polling con
+// getUpdates, según telegram.modo.
+
+// Modos de recibir las actualizaciones
+const (
+	TelegramWebhook = "webhook"
+	TelegramPolling = "polling"
+)
+
+const (
+	rutaWebhookTelegram = "/telegram/webhook"
+
+	// Segundos que Telegram retiene getUpdates esperando mensajes
+	esperaPollingTelegram = 30
+	pausaErrorTelegram    = 5 * time.Second
+	// Límite de Telegram para el pie de una foto
+	longitudMaximaPieFoto = 1024
+)
+
+var reNumeroCertificado = regexp.MustCompile(`(?i)\bMC-[A-Z0-9]{4,}\b`)
+
+// Actualización recibida de Telegram; solo interesan los mensajes de texto
+type actualizacionTelegram struct {
+	ID      int64 `json:"update_id"`
+	Mensaje *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		De *struct {
+			Idioma string `json:"language_code"`
+		} `json:"from"`
+		Texto string `json:"text"`
+	} `json:"message"`
+}
+
+// Llamar un método de la API de bots; resultado recibe el campo "result"
+func llamarTelegram(ctx context.Context, token, metodo string, datos, resultado interface{}, timeout time.Duration) error {
+	body, err := json.Marshal(datos)
+	if err != nil {
+		return err
+	}
+	ctx, cancelar := context.WithTimeout(ctx, timeout)
+	defer cancelar()
+	req, err := http.NewRequestWithContext(ctx, "POST", urlTelegram+"/bot"+token+"/"+metodo, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		// El error incluye la URL con el token
+		return fmt.Errorf("Error al hacer la solicitud %s a Telegram", metodo)
+	}
+	defer resp.Body.Close()
+
+	var respuesta struct {
+		OK          bool            `json:"ok"`
+		Descripcion string          `json:"description"`
+		Resultado   json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respuesta); err != nil {
+		return fmt.Errorf("Telegram respondió con código de estado: %d", resp.StatusCode)
+	}
+	if !respuesta.OK {
+		return fmt.Errorf("Telegram rechazó %s: %s", metodo, respuesta.Descripcion)
+	}
+	if resultado != nil {
+		return json.Unmarshal(respuesta.Resultado, resultado)
+	}
+	return nil
+}
+
+// Número de certificado escrito en el mensaje. Sin el formato MC- se toma
+// el mensaje completo si es una sola palabra (números anteriores).
+func numeroEnMensaje(texto string) string {
+	if numero := reNumeroCertificado.FindString(texto); numero != "" {
+		return strings.ToUpper(numero)
+	}
+	texto = strings.TrimSpace(texto)
+	if texto == "" || strings.HasPrefix(texto, "/") || strings.ContainsAny(texto, " \n\t") || len(texto) > 40 {
+		return ""
+	}
+	return texto
+}
+
+// Respuesta del bot a un mensaje: el texto y, si el certificado es válido y
+// el producto tiene foto, la URL de la foto
+func respuestaVerificacionTelegram(ctx context.Context, texto string) (respuesta, foto string, err error) {
+	idioma := idiomaSolicitud(ctx)
+	numero := numeroEnMensaje(texto)
+	if numero == "" {
+		return traducir(idioma, "Envíame el número de tu certificado (p. ej. MC-ABCDEFGHIJ) y te digo si es auténtico."), "", nil
+	}
+	if estadoActualMantenimiento().Modo == ModoMantenimiento {
+		return traducir(idioma, "Estamos realizando tareas de mantenimiento, vuelve a intentarlo en unos minutos"), "", nil
+	}
+
+	data, err := obtenerCertificado(ctx, numero)
+	if err == sql.ErrNoRows {
+		return traducir(idioma, "No encontramos el certificado") + " " + numero + ".", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	contarVerificacion(data.NumeroCertificado, VerificacionTelegram)
+
+	if data.Revocado {
+		return traducir(idioma, "Este certificado fue revocado y ya no es válido") + ": " + data.NumeroCertificado, "", nil
+	}
+	if data.ReemplazadoPor != nil {
+		return traducir(idioma, "Este certificado fue reemplazado por") + " " + *data.ReemplazadoPor, "", nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "✅ %s %s\n", traducir(idioma, "Producto original Melenas Co"), data.NumeroCertificado)
+	if productos := nombresProductos(data.Productos); productos != "" {
+		b.WriteString(productos + "\n")
+	}
+	if nombre := strings.TrimSpace(textoOVacio(data.NombreCliente)); nombre != "" {
+		fmt.Fprintf(&b, "%s: %s\n", traducir(idioma, "Titular"), nombre)
+	}
+	if data.FechaCompra != nil {
+		fmt.Fprintf(&b, "%s: %s\n", traducir(idioma, "Fecha de compra"), data.FechaCompra.Format(formatoFechaEstadisticas))
+	}
+	if base := strings.TrimSuffix(configActual().Publico.URLBase, "/"); base != "" {
+		b.WriteString(base + rutaPaginaCertificado(data.NumeroCertificado))
+	}
+	return strings.TrimSpace(b.String()), textoOVacio(data.ImagenURL), nil
+}
+
+// Procesar una actualización y responder en el mismo chat
+func atenderActualizacionTelegram(ctx context.Context, actualizacion actualizacionTelegram) error {
+	mensaje := actualizacion.Mensaje
+	if mensaje == nil || mensaje.Texto == "" {
+		return nil
+	}
+	if mensaje.De != nil {
+		ctx = context.WithValue(ctx, claveIdioma{}, preferirIdioma(mensaje.De.Idioma))
+	}
+
+	texto, foto, err := respuestaVerificacionTelegram(ctx, mensaje.Texto)
+	if err != nil {
+		logSolicitud(ctx, "Bot de Telegram:", err)
+		texto = traducir(idiomaSolicitud(ctx), "Error al consultar la base de datos")
+	}
+
+	token := configActual().Telegram.Token
+	if foto != "" && len(texto) <= longitudMaximaPieFoto {
+		err := llamarTelegram(ctx, token, "sendPhoto", map[string]interface{}{
+			"chat_id": mensaje.Chat.ID,
+			"photo":   foto,
+			"caption": texto,
+		}, nil, timeoutTelegram)
+		if err == nil {
+			return nil
+		}
+		// Telegram no pudo descargar la foto: se responde solo el texto
+		logSolicitud(ctx, "Bot de Telegram:", err)
+	}
+	return llamarTelegram(ctx, token, "sendMessage", map[string]interface{}{
+		"chat_id": mensaje.Chat.ID,
+		"text":    texto,
+	}, nil, timeoutTelegram)
+}
+
+// Goroutine que recibe las actualizaciones con getUpdates
+func despacharBotTelegram() {
+	var desplazamiento int64
+	for {
+		var actualizaciones []actualizacionTelegram
+		err := llamarTelegram(context.Background(), configActual().Telegram.Token, "getUpdates", map[string]interface{}{
+			"offset":          desplazamiento,
+			"timeout":         esperaPollingTelegram,
+			"allowed_updates": []string{"message"},
+		}, &actualizaciones, (esperaPollingTelegram+10)*time.Second)
+		if err != nil {
+			log.Println("Bot de Telegram:", err)
+			time.Sleep(pausaErrorTelegram)
+			continue
+		}
+
+		for _, actualizacion := range actualizaciones {
+			desplazamiento = actualizacion.ID + 1
+			if err := atenderActualizacionTelegram(context.Background(), actualizacion); err != nil {
+				log.Println("Bot de Telegram:", err)
+			}
+		}
+	}
+}
+
+// Handler para POST /telegram/webhook. Telegram reintenta las respuestas
+// distintas de 2xx, así que los errores al responder solo se registran.
+func webhookTelegramHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	ajustes := configActual().Telegram
+	if ajustes.Modo != TelegramWebhook || ajustes.Token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	secreto := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secreto), []byte(ajustes.SecretoWebhook)) != 1 {
+		http.Error(w, "No autorizado", http.StatusUnauthorized)
+		return
+	}
+
+	var actualizacion actualizacionTelegram
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&actualizacion); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	if err := atenderActualizacionTelegram(r.Context(), actualizacion); err != nil {
+		logSolicitud(r.Context(), "Bot de Telegram:", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// Máximo de resultados devueltos por cada tipo de búsqueda
+const limiteBusqueda = 20
+
+// ts_headline marca las coincidencias con estos caracteres de control y no
+// con <mark>: el texto de los productos puede traer HTML de Rocketfy, así
+// que el fragmento se escapa aquí y solo después se insertan las etiquetas
+const (
+	inicioResaltado = "\x02"
+	finResaltado    = "\x03"
+)
+
+// Opciones de ts_headline con los marcadores anteriores
+func opcionesResaltado(extra string) string {
+	return "StartSel=" + inicioResaltado + ", StopSel=" + finResaltado + ", " + extra
+}
+
+// Convertir un fragmento de ts_headline en HTML seguro: sin etiquetas, con
+// el texto escapado y las coincidencias entre <mark> y </mark>
+func fragmentoResaltado(fragmento string) string {
+	texto := html.EscapeString(textoPlano(fragmento))
+	return strings.NewReplacer(inicioResaltado, "<mark>", finResaltado, "</mark>").Replace(texto)
+}
+
+// Estructura para un resultado de la búsqueda de texto completo; Fragmento
+// es HTML escapado cuyas únicas etiquetas son <mark>
+type ResultadoBusqueda struct {
+	Tipo              string  `json:"tipo"`
+	ID                int     `json:"id,omitempty"`
+	NumeroCertificado string  `json:"numero_certificado,omitempty"`
+	Titulo            string  `json:"titulo"`
+	Fragmento         string  `json:"fragmento"`
+	Relevancia        float64 `json:"relevancia"`
+}
+
+// Handler para el endpoint de búsqueda de productos y certificados
+func buscarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Obtener el texto a buscar de la query string
+	consulta := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len([]rune(consulta)) < 2 {
+		http.Error(w, "La búsqueda requiere al menos 2 caracteres", http.StatusBadRequest)
+		return
+	}
+
+	// Los nombres de los clientes solo se exponen a los administradores
+	resultados, err := buscar(contextoIncluirEliminados(r), consulta, esAdmin(r))
+	if err != nil {
+		http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resultados)
+}
+
+func buscarProductos(db *sql.DB, consulta string, incluirEliminados bool) ([]ResultadoBusqueda, error) {
+	// Combina el ranking de texto completo con la similitud por trigramas
+	// para tolerar errores de escritura en el nombre del producto
+	sqlStatement := `
+		WITH docs AS (
+			SELECT
+				p.producto_id,
+				p.nombre,
+				coalesce(p.descripcion, '') AS descripcion,
+				to_tsvector('spanish',
+					coalesce(p.nombre, '') || ' ' ||
+					coalesce(p.descripcion, '') || ' ' ||
+					coalesce(p.tipo_cabello, '') || ' ' ||
+					coalesce(p.color, '')) AS documento
+			FROM Productos p
+			WHERE p.eliminado_en IS NULL OR $3
+		)
+		SELECT
+			producto_id,
+			nombre,
+			ts_headline('spanish', descripcion, plainto_tsquery('spanish', $1), $4),
+			ts_rank(documento, plainto_tsquery('spanish', $1)) + similarity(nombre, $1) AS relevancia
+		FROM docs
+		WHERE documento @@ plainto_tsquery('spanish', $1) OR nombre % $1
+		ORDER BY relevancia DESC
+		LIMIT $2`
+
+	rows, err := db.Query(sqlStatement, consulta, limiteBusqueda, incluirEliminados,
+		opcionesResaltado("MaxFragments=2"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resultados := []ResultadoBusqueda{}
+	for rows.Next() {
+		res := ResultadoBusqueda{Tipo: "producto"}
+		err := rows.Scan(&res.ID, &res.Titulo, &res.Fragmento, &res.Relevancia)
+		if err != nil {
+			return nil, err
+		}
+		res.Fragmento = fragmentoResaltado(res.Fragmento)
+		resultados = append(resultados, res)
+	}
+
+	return resultados, rows.Err()
+}
+
+func buscarCertificados(db *sql.DB, consulta string, incluirEliminados bool) ([]ResultadoBusqueda, error) {
+	sqlStatement := `
+		WITH docs AS (
+			SELECT
+				cer.numero_certificado,
+				coalesce(cer.nombre_titular, c.nombre, '') || ' ' || coalesce(cer.apellido_titular, c.apellido, '') AS nombre_cliente,
+				to_tsvector('spanish', coalesce(cer.nombre_titular, c.nombre, '') || ' ' || coalesce(cer.apellido_titular, c.apellido, '')) AS documento
+			FROM Certificados cer
+			JOIN Compras com ON cer.certificado_id = com.certificado_id
+			JOIN Clientes c ON com.cliente_id = c.cliente_id
+			WHERE cer.eliminado_en IS NULL AND c.eliminado_en IS NULL OR $3
+		)
+		SELECT
+			numero_certificado,
+			nombre_cliente,
+			ts_headline('spanish', nombre_cliente, plainto_tsquery('spanish', $1), $4),
+			ts_rank(documento, plainto_tsquery('spanish', $1)) + similarity(nombre_cliente, $1) AS relevancia
+		FROM docs
+		WHERE documento @@ plainto_tsquery('spanish', $1) OR nombre_cliente % $1
+		ORDER BY relevancia DESC
+		LIMIT $2`
+
+	rows, err := db.Query(sqlStatement, consulta, limiteBusqueda, incluirEliminados,
+		opcionesResaltado("HighlightAll=true"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resultados := []ResultadoBusqueda{}
+	for rows.Next() {
+		res := ResultadoBusqueda{Tipo: "certificado"}
+		err := rows.Scan(&res.NumeroCertificado, &res.Titulo, &res.Fragmento, &res.Relevancia)
+		if err != nil {
+			return nil, err
+		}
+		res.Fragmento = fragmentoResaltado(res.Fragmento)
+		resultados = append(resultados, res)
+	}
+
+	return resultados, rows.Err()
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+// El fragmento resaltado no deja pasar HTML del texto original
+func TestFragmentoResaltado(t *testing.T) {
+	casos := []struct {
+		fragmento string
+		esperado  string
+	}{
+		{"Cabello \x02liso\x03 natural", "Cabello <mark>liso</mark> natural"},
+		{"<p>Extensión <b>\x02lisa\x03</b></p>", "Extensión <mark>lisa</mark>"},
+		{"<img src=x onerror=alert(1)>\x02rizo\x03", "<mark>rizo</mark>"},
+		{"&lt;script&gt;alert(1)&lt;/script&gt; \x02ondas\x03", "&lt;script&gt;alert(1)&lt;/script&gt; <mark>ondas</mark>"},
+		{"Ana & \x02Luz\x03 \"O'Neil\"", "Ana &amp; <mark>Luz</mark> &#34;O&#39;Neil&#34;"},
+	}
+	for _, caso := range casos {
+		if obtenido := fragmentoResaltado(caso.fragmento); obtenido != caso.esperado {
+			t.Errorf("fragmentoResaltado(%q) = %q, se esperaba %q", caso.fragmento, obtenido, caso.esperado)
+		}
+	}
+}
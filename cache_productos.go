@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Caché de los productos de Rocketfy con stale-while-revalidate: durante
+// cache.fresco_productos_segundos desde la última descarga se sirven sin
+// consultar Rocketfy; durante los cache.obsoleto_productos_segundos
+// siguientes se siguen sirviendo al momento mientras una descarga en
+// segundo plano los actualiza, y pasado ese tiempo la solicitud espera la
+// descarga. Así la latencia del listado no depende de la de Rocketfy. Se
+// guarda el JSON recibido y cada solicitud lo decodifica en sus propios
+// mapas. Cambiar la URL de Rocketfy (sandbox) invalida la caché.
+
+// Estado de la caché al responder, en el encabezado X-Cache
+const (
+	CacheFresco   = "HIT"
+	CacheObsoleto = "STALE"
+	CacheFallo    = "MISS"
+)
+
+var cacheProductos struct {
+	sync.Mutex
+	cuerpo   []byte
+	base     string
+	obtenido time.Time
+	// Hay una actualización en segundo plano en curso
+	actualizando bool
+}
+
+// Guardar el JSON de una descarga correcta
+func guardarCacheProductos(cuerpo []byte) {
+	base, _, _ := destinoRocketfy()
+	cacheProductos.Lock()
+	defer cacheProductos.Unlock()
+	cacheProductos.cuerpo = cuerpo
+	cacheProductos.base = base
+	cacheProductos.obtenido = time.Now()
+}
+
+// Productos para servir a los clientes, desde la caché si es posible, y el
+// estado de la caché
+func obtenerProductosCache(ctx context.Context) ([]map[string]interface{}, string, error) {
+	ajustes := configActual().Cache
+	fresco := time.Duration(ajustes.FrescoProductosSegundos) * time.Second
+	obsoleto := fresco + time.Duration(ajustes.ObsoletoProductosSegundos)*time.Second
+	base, _, _ := destinoRocketfy()
+
+	cacheProductos.Lock()
+	cuerpo, edad := cacheProductos.cuerpo, time.Since(cacheProductos.obtenido)
+	estado := CacheFallo
+	if cuerpo != nil && cacheProductos.base == base {
+		switch {
+		case edad <= fresco:
+			estado = CacheFresco
+		case edad <= obsoleto:
+			estado = CacheObsoleto
+			if !cacheProductos.actualizando {
+				cacheProductos.actualizando = true
+				go actualizarCacheProductos(contextoDesacoplado{ctx})
+			}
+		}
+	}
+	cacheProductos.Unlock()
+
+	if estado == CacheFallo {
+		var err error
+		cuerpo, err = cuerpoProductos(ctx)
+		if err != nil {
+			return nil, estado, err
+		}
+	}
+	productos, err := decodificarProductos(cuerpo)
+	return productos, estado, err
+}
+
+// Descargar los productos en segundo plano; si falla se siguen sirviendo
+// los anteriores hasta que dejen de ser utilizables
+func actualizarCacheProductos(ctx context.Context) {
+	defer func() {
+		cacheProductos.Lock()
+		cacheProductos.actualizando = false
+		cacheProductos.Unlock()
+	}()
+	if _, err := cuerpoProductos(ctx); err != nil {
+		log.Println("Error al actualizar la caché de productos:", err)
+	}
+}
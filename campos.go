@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Respuestas parciales con ?fields=nombre_producto,imagen_url para que los
+// clientes móviles reciban solo lo que usan. Los campos anidados se piden
+// con puntos ("productos.nombre"); en las listas la selección se aplica a
+// cada elemento. Los campos que no existen se ignoran y el ETag se calcula
+// sobre la respuesta ya recortada.
+
+// Campo pedido y, si solo se pidieron algunos de sus campos, cuáles
+type nodoCampos struct {
+	completo bool
+	hijos    map[string]*nodoCampos
+}
+
+// Campos de ?fields=; nil si no se pidió una selección
+func camposSolicitados(r *http.Request) *nodoCampos {
+	valor := r.URL.Query().Get("fields")
+	if strings.TrimSpace(valor) == "" {
+		return nil
+	}
+	raiz := &nodoCampos{hijos: map[string]*nodoCampos{}}
+	for _, campo := range strings.Split(valor, ",") {
+		campo = strings.TrimSpace(campo)
+		if campo == "" {
+			continue
+		}
+		nodo := raiz
+		for _, parte := range strings.Split(campo, ".") {
+			hijo, ok := nodo.hijos[parte]
+			if !ok {
+				hijo = &nodoCampos{hijos: map[string]*nodoCampos{}}
+				nodo.hijos[parte] = hijo
+			}
+			nodo = hijo
+		}
+		// Pedir el campo entero gana sobre pedir algunos de sus campos
+		nodo.completo = true
+	}
+	return raiz
+}
+
+// Recortar un valor a los campos pedidos; sin selección se devuelve igual
+func seleccionarCampos(valor interface{}, campos *nodoCampos) (interface{}, error) {
+	if campos == nil {
+		return valor, nil
+	}
+	datos, err := json.Marshal(valor)
+	if err != nil {
+		return nil, err
+	}
+	// UseNumber conserva los números tal como venían
+	decodificador := json.NewDecoder(bytes.NewReader(datos))
+	decodificador.UseNumber()
+	var generico interface{}
+	if err := decodificador.Decode(&generico); err != nil {
+		return nil, err
+	}
+	return recortarCampos(generico, campos), nil
+}
+
+func recortarCampos(valor interface{}, campos *nodoCampos) interface{} {
+	switch v := valor.(type) {
+	case map[string]interface{}:
+		recortado := make(map[string]interface{}, len(campos.hijos))
+		for nombre, hijo := range campos.hijos {
+			campo, ok := v[nombre]
+			if !ok {
+				continue
+			}
+			if hijo.completo {
+				recortado[nombre] = campo
+			} else {
+				recortado[nombre] = recortarCampos(campo, hijo)
+			}
+		}
+		return recortado
+	case []interface{}:
+		for i, elemento := range v {
+			v[i] = recortarCampos(elemento, campos)
+		}
+		return v
+	}
+	return valor
+}
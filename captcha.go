@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Verificación anti-bots de los endpoints públicos que reciben datos de
+// personas (contacto, reportes de falsificación y consulta de envíos): con
+// captcha.proveedor configurado, exigirCaptcha valida el token con el
+// proveedor antes de llamar al handler. Los administradores no lo necesitan.
+
+// Proveedores de captcha soportados
+const (
+	CaptchaRecaptcha = "recaptcha"
+	CaptchaTurnstile = "turnstile"
+	CaptchaHcaptcha  = "hcaptcha"
+)
+
+// Endpoints de verificación de cada proveedor; todos reciben secret,
+// response y remoteip y responden success y error-codes
+var urlsVerificacionCaptcha = map[string]string{
+	CaptchaRecaptcha: "https://www.google.com/recaptcha/api/siteverify",
+	CaptchaTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	CaptchaHcaptcha:  "https://api.hcaptcha.com/siteverify",
+}
+
+// Campos de formulario donde puede llegar el token: el propio y los
+// estándar de cada proveedor
+var camposTokenCaptcha = []string{"captcha", "g-recaptcha-response", "cf-turnstile-response", "h-captcha-response"}
+
+const (
+	timeoutCaptcha = 5 * time.Second
+
+	// Encabezado con el token para las solicitudes sin cuerpo
+	encabezadoCaptcha = "X-Captcha-Token"
+)
+
+var errCaptchaInvalido = errors.New("No se pudo verificar que no eres un robot; intenta de nuevo")
+
+// Verificar el token del captcha con el proveedor configurado. Sin
+// proveedor configurado no se verifica nada.
+func verificarCaptcha(ctx context.Context, token, ip string) error {
+	ajustes := configActual().Captcha
+	if ajustes.Proveedor == "" {
+		return nil
+	}
+	if token == "" {
+		return errCaptchaInvalido
+	}
+
+	formulario := url.Values{"secret": {ajustes.Secreto}, "response": {token}}
+	if ip != "" {
+		formulario.Set("remoteip", ip)
+	}
+	ctx, cancelar := context.WithTimeout(ctx, timeoutCaptcha)
+	defer cancelar()
+	req, err := http.NewRequestWithContext(ctx, "POST", urlsVerificacionCaptcha[ajustes.Proveedor], strings.NewReader(formulario.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: timeoutCaptcha}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error al verificar el captcha: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var resultado struct {
+		Exito   bool     `json:"success"`
+		Errores []string `json:"error-codes"`
+		// Solo reCAPTCHA v3
+		Puntaje *float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&resultado); err != nil {
+		return fmt.Errorf("Error al leer la verificación del captcha: %v", err)
+	}
+	if !resultado.Exito {
+		logSolicitud(ctx, "Captcha rechazado:", resultado.Errores)
+		return errCaptchaInvalido
+	}
+	if ajustes.PuntajeMinimo > 0 && resultado.Puntaje != nil && *resultado.Puntaje < ajustes.PuntajeMinimo {
+		logSolicitud(ctx, "Captcha rechazado por puntaje:", *resultado.Puntaje)
+		return errCaptchaInvalido
+	}
+	return nil
+}
+
+// Token del captcha de la solicitud: del encabezado, del parámetro captcha
+// de la URL o del cuerpo (campo "captcha" del JSON o campos del
+// formulario). El cuerpo JSON se vuelve a dejar disponible para el handler.
+func tokenCaptchaSolicitud(r *http.Request) (string, error) {
+	if token := r.Header.Get(encabezadoCaptcha); token != "" {
+		return token, nil
+	}
+	if token := r.URL.Query().Get("captcha"); token != "" || r.Body == nil || r.Body == http.NoBody {
+		return token, nil
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		cuerpo, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(cuerpo))
+		var solicitud struct {
+			Captcha string `json:"captcha"`
+		}
+		// Un JSON inválido queda sin token y se rechaza como tal
+		json.Unmarshal(cuerpo, &solicitud)
+		return solicitud.Captcha, nil
+	}
+
+	// El formulario queda leído en r.Form y r.MultipartForm para el handler
+	if err := r.ParseMultipartForm(8 << 20); err != nil && err != http.ErrNotMultipart {
+		return "", err
+	}
+	for _, campo := range camposTokenCaptcha {
+		if valor := r.FormValue(campo); valor != "" {
+			return valor, nil
+		}
+	}
+	return "", nil
+}
+
+// Middleware que exige un captcha válido antes del handler; sin proveedor
+// configurado, en las preflight de CORS y para los administradores no
+// hace nada
+func exigirCaptcha(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if configActual().Captcha.Proveedor == "" || r.Method == "OPTIONS" || esAdmin(r) {
+			next(w, r)
+			return
+		}
+
+		// Los endpoints son públicos: el navegador debe poder leer el rechazo
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		token, err := tokenCaptchaSolicitud(r)
+		if err != nil {
+			http.Error(w, "Cuerpo inválido", http.StatusBadRequest)
+			return
+		}
+		if err := verificarCaptcha(r.Context(), token, textoIPSolicitud(r)); err != nil {
+			if err == errCaptchaInvalido {
+				http.Error(w, err.Error(), http.StatusForbidden)
+			} else {
+				http.Error(w, "Error al verificar el captcha", http.StatusBadGateway)
+			}
+			logSolicitud(r.Context(), err)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Certificado en PDF para descargar o imprimir, con todos los productos de
+// la compra y su guía de cuidado.
+
+const margenCertificadoPDF = 60.0
+
+// Partir un texto en líneas que quepan en el ancho dado
+func partirTextoPDF(texto string, tamano, ancho float64) []string {
+	var lineas []string
+	linea := ""
+	for _, palabra := range strings.Fields(texto) {
+		candidata := strings.TrimSpace(linea + " " + palabra)
+		if linea != "" && anchoTextoPDF(candidata, tamano) > ancho {
+			lineas = append(lineas, linea)
+			candidata = palabra
+		}
+		linea = candidata
+	}
+	if linea != "" {
+		lineas = append(lineas, linea)
+	}
+	return lineas
+}
+
+func generarPDFCertificado(data *CertificateData, idioma string) []byte {
+	margen := margenCertificadoPDF
+	ancho := anchoA4 - 2*margen
+
+	var pdf documentoPDF
+	pdf.nuevaPagina()
+	y := altoA4 - 70.0
+
+	// Escribir una línea pasando a otra página si no cabe
+	escribir := func(x, tamano float64, negrita bool, texto string) {
+		if y < margen+tamano {
+			pdf.nuevaPagina()
+			y = altoA4 - margen
+		}
+		pdf.texto(x, y, tamano, negrita, texto)
+		y -= tamano + 5
+	}
+	centrado := func(tamano float64, negrita bool, texto string) {
+		escribir((anchoA4-anchoTextoPDF(texto, tamano))/2, tamano, negrita, texto)
+	}
+
+	t := func(texto string) string { return traducir(idioma, texto) }
+	formatoFecha := "02/01/2006"
+	if idioma == IdiomaIngles {
+		formatoFecha = "01/02/2006"
+	}
+
+	centrado(12, true, "Melenas Co")
+	centrado(20, true, t("Certificado de autenticidad"))
+	y -= 6
+	centrado(16, false, data.NumeroCertificado)
+	y -= 10
+	if data.Revocado {
+		centrado(12, true, t("Este certificado fue revocado y ya no es válido"))
+	} else if data.ReemplazadoPor != nil {
+		centrado(12, true, t("Este certificado fue reemplazado por")+" "+*data.ReemplazadoPor)
+	} else {
+		centrado(12, false, t("Producto original Melenas Co"))
+	}
+
+	y -= 14
+	pdf.rectangulo(margen, y, ancho, 0.5)
+	y -= 20
+	if nombre := strings.TrimSpace(textoOVacio(data.NombreCliente) + " " + textoOVacio(data.ApellidoCliente)); nombre != "" {
+		escribir(margen, 10, false, t("Titular")+": "+nombre)
+	}
+	if data.FechaCompra != nil {
+		escribir(margen, 10, false, t("Fecha de compra")+": "+data.FechaCompra.In(zonaHoraria).Format(formatoFecha))
+	}
+	if data.FechaEmision != nil {
+		escribir(margen, 10, false, t("Fecha de emisión")+": "+data.FechaEmision.In(zonaHoraria).Format(formatoFecha))
+	}
+
+	for _, producto := range data.Productos {
+		y -= 12
+		pdf.rectangulo(margen, y, ancho, 0.5)
+		y -= 20
+
+		titulo := textoOVacio(producto.Nombre)
+		if producto.Cantidad > 1 {
+			titulo = fmt.Sprintf("%s x %d", titulo, producto.Cantidad)
+		}
+		escribir(margen, 12, true, titulo)
+		if producto.Kit != nil {
+			escribir(margen, 9, false, t("Incluido en el kit")+" "+*producto.Kit)
+		}
+		for _, linea := range partirTextoPDF(textoOVacio(producto.DescripcionTexto), 9, ancho) {
+			escribir(margen, 9, false, linea)
+		}
+		for _, atributo := range []struct {
+			nombre string
+			valor  *string
+		}{
+			{"Tipo de cabello", producto.TipoCabello},
+			{"Color", producto.Color},
+			{"Longitud", producto.Longitud},
+		} {
+			if valor := textoOVacio(atributo.valor); valor != "" {
+				escribir(margen, 9, false, t(atributo.nombre)+": "+valor)
+			}
+		}
+
+		if cuidados := producto.Cuidados; cuidados != nil {
+			y -= 4
+			escribir(margen, 10, true, t("Cuidados"))
+			for _, cuidado := range [][2]string{
+				{"Lavado", cuidados.Lavado},
+				{"Peinado", cuidados.Peinado},
+				{"Duración", cuidados.Duracion},
+			} {
+				if cuidado[1] == "" {
+					continue
+				}
+				for i, linea := range partirTextoPDF(t(cuidado[0])+": "+cuidado[1], 9, ancho) {
+					x := margen
+					if i > 0 {
+						x += 10
+					}
+					escribir(x, 9, false, linea)
+				}
+			}
+		}
+	}
+	return pdf.bytes()
+}
+
+// Handler para /certificados/{numero}/certificado.pdf. El PDF lleva el
+// nombre del titular, así que con los tokens de verificación activos en
+// lugar del número va el token, igual que en /c/
+func certificadoPDFHandler(w http.ResponseWriter, r *http.Request, clave string) {
+	numero, token := clave, ""
+	if esTokenVerificacion(clave) {
+		numero, token = "", clave
+	}
+	numero, err := numeroVerificacionPublica(r, numero, token)
+	if err != nil {
+		responderErrorVerificacion(w, r, err, clave, VerificacionWeb)
+		return
+	}
+
+	data, err := obtenerCertificado(r.Context(), numero)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			certificadoNoEncontrado(r, numero, VerificacionWeb)
+			http.Error(w, "Certificado no encontrado", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, data.NumeroCertificado))
+	w.Header().Set("Cache-Control", cacheCertificados)
+	w.Write(generarPDFCertificado(data, idiomaSolicitud(r.Context())))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Con los tokens de verificación activos un número suelto no recibe el PDF
+// (que lleva el nombre del titular) y responde como un certificado
+// inexistente; el rechazo ocurre antes de consultar la base
+func TestCertificadoPDFRequiereToken(t *testing.T) {
+	anterior := config
+	defer func() { config = anterior }()
+	config.Verificacion.ClaveTokens = claveTokensPrueba('a')
+
+	for _, ruta := range []string{
+		"/certificados/MC-000123/certificado.pdf",
+		"/certificados/MC-000123.zzzz.firma/certificado.pdf",
+	} {
+		w := httptest.NewRecorder()
+		certificadosHandler(w, httptest.NewRequest("GET", ruta, nil))
+		if w.Code != 404 {
+			t.Errorf("%s: estado %d, se esperaba 404", ruta, w.Code)
+		}
+		if tipo := w.Header().Get("Content-Type"); strings.Contains(tipo, "pdf") {
+			t.Errorf("%s: se entregó un PDF", ruta)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errores de dominio de la emisión y revocación de certificados
+var (
+	errCompraNoEncontrada     = errors.New("Compra no encontrada")
+	errCompraConCertificado   = errors.New("La compra ya tiene un certificado emitido")
+	errCertificadoYaRevocado  = errors.New("El certificado ya está revocado")
+	errCertificadoInexistente = errors.New("Certificado no encontrado")
+	errCertificadoReemplazado = errors.New("El certificado ya fue reemplazado por una versión más reciente")
+)
+
+// Datos publicados en los eventos de emisión y revocación
+type EventoCertificado struct {
+	NumeroCertificado string    `json:"numero_certificado"`
+	CompraID          int       `json:"compra_id,omitempty"`
+	Motivo            string    `json:"motivo,omitempty"`
+	Fecha             time.Time `json:"fecha"`
+	// En las reemisiones, el certificado reemplazado y la nueva versión
+	NumeroAnterior string `json:"numero_anterior,omitempty"`
+	Version        int    `json:"version,omitempty"`
+	// En las emisiones automáticas, la regla que las decidió y las
+	// notificaciones pedidas (vacías: todas)
+	Regla          string   `json:"regla,omitempty"`
+	Notificaciones []string `json:"notificaciones,omitempty"`
+}
+
+// Si el evento pide la notificación del canal
+func (e EventoCertificado) notificar(canal string) bool {
+	return len(e.Notificaciones) == 0 || contieneTexto(e.Notificaciones, canal)
+}
+
+// Versión de un certificado en su historial de reemisiones
+type VersionCertificado struct {
+	NumeroCertificado string  `json:"numero_certificado"`
+	Version           int     `json:"version"`
+	FechaEmision      *Fecha  `json:"fecha_emision"`
+	ReemplazadoEn     *Fecha  `json:"reemplazado_en,omitempty"`
+	Motivo            *string `json:"motivo,omitempty"`
+	NombreTitular     *string `json:"nombre_titular,omitempty"`
+	ApellidoTitular   *string `json:"apellido_titular,omitempty"`
+	Revocado          bool    `json:"revocado"`
+}
+
+// Generar un número de certificado aleatorio con el formato MC-XXXXXXXXXX
+func generarNumeroCertificado() (string, error) {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "MC-" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// Emitir un certificado para una compra y registrar el evento en el outbox
+// dentro de la misma transacción
+func insertarCertificado(db *sql.DB, compraID int) (string, error) {
+	var numero string
+	err := enTransaccion(db, func(tx *sql.Tx) error {
+		var err error
+		numero, err = emitirCertificadoTx(tx, compraID)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return numero, nil
+}
+
+// Emitir un certificado dentro de una transacción existente
+func emitirCertificadoTx(tx *sql.Tx, compraID int) (string, error) {
+	return emitirCertificadoReglaTx(tx, compraID, nil)
+}
+
+// Emitir un certificado con la plantilla y las notificaciones de una regla
+// de emisión automática (nil para las de la emisión manual)
+func emitirCertificadoReglaTx(tx *sql.Tx, compraID int, regla *ReglaEmision) (string, error) {
+	if regla == nil {
+		regla = &ReglaEmision{}
+	}
+	numero, err := generarNumeroCertificado()
+	if err != nil {
+		return "", err
+	}
+
+	// Bloquear la compra para evitar emisiones concurrentes
+	var certificadoID sql.NullInt64
+	err = tx.QueryRow(`SELECT certificado_id FROM Compras WHERE compra_id = $1 FOR UPDATE`, compraID).
+		Scan(&certificadoID)
+	if err == sql.ErrNoRows {
+		return "", errCompraNoEncontrada
+	}
+	if err != nil {
+		return "", err
+	}
+	if certificadoID.Valid {
+		return "", errCompraConCertificado
+	}
+
+	var fechaEmision time.Time
+	err = tx.QueryRow(`
+		INSERT INTO Certificados (numero_certificado, fecha_emision, plantilla, regla_emision)
+		VALUES ($1, now(), nullif($2, ''), nullif($3, ''))
+		RETURNING certificado_id, fecha_emision`, numero, regla.Plantilla, regla.Nombre).Scan(&certificadoID, &fechaEmision)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`UPDATE Compras SET certificado_id = $1 WHERE compra_id = $2`, certificadoID, compraID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = crearEnlaceCorto(tx, numero)
+	if err != nil {
+		return "", err
+	}
+
+	err = registrarEventoOutbox(tx, EventoCertificadoEmitido, EventoCertificado{
+		NumeroCertificado: numero,
+		CompraID:          compraID,
+		Fecha:             fechaEmision,
+		Regla:             regla.Nombre,
+		Notificaciones:    regla.Notificaciones,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return numero, nil
+}
+
+// Revocar un certificado y registrar el evento en el outbox
+func marcarCertificadoRevocado(db *sql.DB, numeroCertificado, motivo string) error {
+	return enTransaccion(db, func(tx *sql.Tx) error {
+		return revocarCertificadoTx(tx, numeroCertificado, motivo)
+	})
+}
+
+// Revocar un certificado dentro de una transacción existente
+func revocarCertificadoTx(tx *sql.Tx, numeroCertificado, motivo string) error {
+	var revocadoEn sql.NullTime
+	err := tx.QueryRow(`SELECT revocado_en FROM Certificados WHERE numero_certificado = $1 FOR UPDATE`,
+		numeroCertificado).Scan(&revocadoEn)
+	if err == sql.ErrNoRows {
+		return errCertificadoInexistente
+	}
+	if err != nil {
+		return err
+	}
+	if revocadoEn.Valid {
+		return errCertificadoYaRevocado
+	}
+
+	var fecha time.Time
+	err = tx.QueryRow(`
+		UPDATE Certificados SET revocado_en = now(), motivo_revocacion = $2
+		WHERE numero_certificado = $1
+		RETURNING revocado_en`, numeroCertificado, motivo).Scan(&fecha)
+	if err != nil {
+		return err
+	}
+
+	return registrarEventoOutbox(tx, EventoCertificadoRevocado, EventoCertificado{
+		NumeroCertificado: numeroCertificado,
+		Motivo:            motivo,
+		Fecha:             fecha,
+	})
+}
+
+// Reemitir un certificado: crear la versión siguiente con un número nuevo,
+// marcar como reemplazadas la actual y las anteriores y pasar la compra al
+// nuevo certificado. nombre y apellido corrigen el titular impreso; vacíos
+// se conserva el de la versión actual.
+func reemitirCertificadoTx(tx *sql.Tx, numeroCertificado, nombre, apellido, motivo string) (string, error) {
+	var certificadoID, version int
+	var revocadoEn, reemplazadoEn, eliminadoEn sql.NullTime
+	var nombreActual, apellidoActual, plantilla sql.NullString
+	err := tx.QueryRow(`
+		SELECT certificado_id, version, revocado_en, reemplazado_en, eliminado_en, nombre_titular, apellido_titular, plantilla
+		FROM Certificados WHERE numero_certificado = $1 FOR UPDATE`, numeroCertificado).
+		Scan(&certificadoID, &version, &revocadoEn, &reemplazadoEn, &eliminadoEn, &nombreActual, &apellidoActual, &plantilla)
+	if err == sql.ErrNoRows || eliminadoEn.Valid {
+		return "", errCertificadoInexistente
+	}
+	if err != nil {
+		return "", err
+	}
+	if reemplazadoEn.Valid {
+		return "", errCertificadoReemplazado
+	}
+	if revocadoEn.Valid {
+		return "", errCertificadoYaRevocado
+	}
+
+	var compraID int
+	err = tx.QueryRow(`SELECT compra_id FROM Compras WHERE certificado_id = $1 FOR UPDATE`, certificadoID).
+		Scan(&compraID)
+	if err == sql.ErrNoRows {
+		return "", errCompraNoEncontrada
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if nombre != "" {
+		nombreActual = sql.NullString{String: nombre, Valid: true}
+	}
+	if apellido != "" {
+		apellidoActual = sql.NullString{String: apellido, Valid: true}
+	}
+
+	numero, err := generarNumeroCertificado()
+	if err != nil {
+		return "", err
+	}
+	var nuevoID int
+	var fechaEmision time.Time
+	err = tx.QueryRow(`
+		INSERT INTO Certificados (numero_certificado, fecha_emision, version, motivo_reemision, nombre_titular, apellido_titular, plantilla)
+		VALUES ($1, now(), $2, $3, $4, $5, $6)
+		RETURNING certificado_id, fecha_emision`, numero, version+1, motivo, nombreActual, apellidoActual, plantilla).
+		Scan(&nuevoID, &fechaEmision)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE Certificados SET vigente_id = $1, reemplazado_en = coalesce(reemplazado_en, now())
+		WHERE certificado_id = $2 OR vigente_id = $2`, nuevoID, certificadoID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`UPDATE Compras SET certificado_id = $1 WHERE compra_id = $2`, nuevoID, compraID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = crearEnlaceCorto(tx, numero)
+	if err != nil {
+		return "", err
+	}
+
+	err = registrarEventoOutbox(tx, EventoCertificadoReemitido, EventoCertificado{
+		NumeroCertificado: numero,
+		CompraID:          compraID,
+		Motivo:            motivo,
+		Fecha:             fechaEmision,
+		NumeroAnterior:    numeroCertificado,
+		Version:           version + 1,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return numero, nil
+}
+
+// Historial de versiones del certificado al que pertenece el número dado
+// (cualquiera de sus versiones), de la primera a la vigente
+func consultarVersionesCertificado(db *sql.DB, numeroCertificado string) ([]VersionCertificado, error) {
+	rows, err := db.Query(`
+		WITH vigente AS (
+			SELECT coalesce(vigente_id, certificado_id) AS certificado_id
+			FROM Certificados WHERE numero_certificado = $1
+		)
+		SELECT cer.numero_certificado, cer.version, cer.fecha_emision, cer.reemplazado_en,
+			cer.motivo_reemision, cer.nombre_titular, cer.apellido_titular, cer.revocado_en IS NOT NULL
+		FROM Certificados cer, vigente v
+		WHERE cer.certificado_id = v.certificado_id OR cer.vigente_id = v.certificado_id
+		ORDER BY cer.version`, numeroCertificado)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versiones := []VersionCertificado{}
+	for rows.Next() {
+		var v VersionCertificado
+		err := rows.Scan(&v.NumeroCertificado, &v.Version, &v.FechaEmision, &v.ReemplazadoEn,
+			&v.Motivo, &v.NombreTitular, &v.ApellidoTitular, &v.Revocado)
+		if err != nil {
+			return nil, err
+		}
+		versiones = append(versiones, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(versiones) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return versiones, nil
+}
+
+// Código HTTP correspondiente a los errores de dominio
+func estadoErrorCertificado(err error) int {
+	switch err {
+	case errCompraNoEncontrada, errCertificadoInexistente:
+		return http.StatusNotFound
+	case errCompraConCertificado, errCertificadoYaRevocado, errCertificadoReemplazado:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// Handler para emitir el certificado de una compra
+func emitirCertificadoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		CompraID int `json:"compra_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&solicitud)
+	if err != nil || solicitud.CompraID <= 0 {
+		http.Error(w, "compra_id requerido", http.StatusBadRequest)
+		return
+	}
+
+	numero, err := emitirCertificado(solicitud.CompraID)
+	if err != nil {
+		estado := estadoErrorCertificado(err)
+		if estado == http.StatusInternalServerError {
+			http.Error(w, "Error al emitir el certificado", estado)
+		} else {
+			http.Error(w, err.Error(), estado)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"numero_certificado": numero})
+}
+
+// Handler para revocar un certificado
+func revocarCertificadoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		NumeroCertificado string `json:"numero_certificado"`
+		Motivo            string `json:"motivo"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&solicitud)
+	if err != nil || strings.TrimSpace(solicitud.NumeroCertificado) == "" {
+		http.Error(w, "numero_certificado requerido", http.StatusBadRequest)
+		return
+	}
+
+	err = revocarCertificado(solicitud.NumeroCertificado, solicitud.Motivo)
+	if err != nil {
+		estado := estadoErrorCertificado(err)
+		if estado == http.StatusInternalServerError {
+			http.Error(w, "Error al revocar el certificado", estado)
+		} else {
+			http.Error(w, err.Error(), estado)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Router de /certificados/:
+//   - GET /certificados/{numero}/barcode.png: código de barras
+//     (codigoBarrasHandler)
+//   - GET /certificados/{numero o token}/certificado.pdf: PDF del
+//     certificado (certificadoPDFHandler)
+func certificadosHandler(w http.ResponseWriter, r *http.Request) {
+	partes := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/certificados/"), "/"), "/")
+	if len(partes) != 2 || partes[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	numero, recurso := partes[0], partes[1]
+
+	if recurso != "barcode.png" && recurso != "certificado.pdf" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if recurso == "barcode.png" {
+		codigoBarrasHandler(w, r, numero)
+	} else {
+		certificadoPDFHandler(w, r, numero)
+	}
+}
+
+// Handler para POST /admin/certificados/{numero}/reemitir.
+// El PDF, el código de barras y el QR del enlace corto se generan a partir
+// del número, así que la nueva versión ya los tiene con el número nuevo.
+func reemitirCertificadoHandler(w http.ResponseWriter, r *http.Request, numero string) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		NombreCliente   string `json:"nombre_cliente"`
+		ApellidoCliente string `json:"apellido_cliente"`
+		Motivo          string `json:"motivo"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&solicitud)
+	if err != nil || strings.TrimSpace(solicitud.Motivo) == "" {
+		http.Error(w, "motivo requerido", http.StatusBadRequest)
+		return
+	}
+
+	nuevo, err := reemitirCertificado(r.Context(), numero, strings.TrimSpace(solicitud.NombreCliente),
+		strings.TrimSpace(solicitud.ApellidoCliente), strings.TrimSpace(solicitud.Motivo))
+	if err != nil {
+		estado := estadoErrorCertificado(err)
+		if estado == http.StatusInternalServerError {
+			http.Error(w, "Error al reemitir el certificado", estado)
+		} else {
+			http.Error(w, err.Error(), estado)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"numero_certificado": nuevo,
+		"numero_anterior":    numero,
+	})
+}
+
+// Handler para GET /admin/certificados/{numero}/versiones
+func versionesCertificadoHandler(w http.ResponseWriter, r *http.Request, numero string) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	versiones, err := obtenerVersionesCertificado(r.Context(), numero)
+	if err != nil {
+		estado := estadoErrorCertificado(err)
+		if estado == http.StatusInternalServerError {
+			http.Error(w, "Error al consultar la base de datos", estado)
+		} else {
+			http.Error(w, err.Error(), estado)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versiones)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Acciones masivas sobre certificados: revocar, reenviar por email el
+// certificado en PDF o regenerar la copia del PDF guardada en el
+// almacenamiento de archivado, para una lista de números o para los
+// certificados vigentes que cumplan un filtro. Se ejecutan en la cola de
+// trabajos (trabajos.go); POST /admin/certificados/bulk responde 202 con el
+// trabajo y su progreso se consulta en GET /admin/certificados/bulk/{id}.
+
+// Acciones masivas, que son también el tipo del trabajo
+const (
+	AccionRevocar       = "revocar"
+	AccionReenviarEmail = "reenviar_email"
+	AccionRegenerarPDF  = "regenerar_pdf"
+)
+
+// Certificados por trabajo
+const maxCertificadosMasivos = 10000
+
+var (
+	errAccionMasivaInvalida        = errors.New("accion debe ser revocar, reenviar_email o regenerar_pdf")
+	errSeleccionMasivaDoble        = errors.New("indique numeros o filtro, no ambos")
+	errSeleccionMasivaVacia        = errors.New("Ningún certificado coincide con la selección")
+	errSeleccionMasivaGrande       = fmt.Errorf("Se pueden procesar hasta %d certificados por trabajo", maxCertificadosMasivos)
+	errFiltroMasivoSinCriterio     = errors.New("el filtro debe tener al menos una condición")
+	errFiltroMasivoFecha           = errors.New("desde y hasta deben tener el formato AAAA-MM-DD")
+	errEmailNoConfigurado          = errors.New("email.servidor no está configurado")
+	errAlmacenamientoNoConfigurado = errors.New("archivado.directorio o archivado.s3 no está configurado")
+	errClienteSinEmail             = errors.New("El cliente no tiene email")
+)
+
+// Filtro de certificados vigentes (no revocados, reemplazados ni
+// eliminados)
+type FiltroCertificados struct {
+	// Fechas de emisión AAAA-MM-DD, ambas incluidas
+	Desde      string `json:"desde"`
+	Hasta      string `json:"hasta"`
+	ProductoID int    `json:"producto_id"`
+	EstadoPago string `json:"estado_pago"`
+}
+
+// Cuerpo de POST /admin/certificados/bulk
+type SolicitudAccionMasiva struct {
+	Accion  string              `json:"accion"`
+	Numeros []string            `json:"numeros"`
+	Filtro  *FiltroCertificados `json:"filtro"`
+	// Motivo de la revocación
+	Motivo string `json:"motivo"`
+}
+
+// Parámetros guardados con el trabajo
+type parametrosAccionMasiva struct {
+	Motivo string `json:"motivo,omitempty"`
+}
+
+// Validar la acción y que su canal esté configurado
+func validarAccionMasiva(accion string) error {
+	ajustes := configActual()
+	switch accion {
+	case AccionRevocar:
+	case AccionReenviarEmail:
+		if ajustes.Email.Servidor == "" {
+			return errEmailNoConfigurado
+		}
+	case AccionRegenerarPDF:
+		if ajustes.Archivado.Directorio == "" && ajustes.Archivado.S3.Bucket == "" {
+			return errAlmacenamientoNoConfigurado
+		}
+	default:
+		return errAccionMasivaInvalida
+	}
+	return nil
+}
+
+// Números de los certificados vigentes que cumplen el filtro; hasta limite
+func consultarNumerosFiltro(db *sql.DB, filtro FiltroCertificados, limite int) ([]string, error) {
+	if filtro.Desde == "" && filtro.Hasta == "" && filtro.ProductoID == 0 && filtro.EstadoPago == "" {
+		return nil, errFiltroMasivoSinCriterio
+	}
+	var desde, hasta sql.NullTime
+	for _, f := range []struct {
+		texto string
+		fecha *sql.NullTime
+		dias  int
+	}{{filtro.Desde, &desde, 0}, {filtro.Hasta, &hasta, 1}} {
+		if f.texto == "" {
+			continue
+		}
+		fecha, err := time.ParseInLocation(formatoFechaEstadisticas, f.texto, zonaHoraria)
+		if err != nil {
+			return nil, errFiltroMasivoFecha
+		}
+		*f.fecha = sql.NullTime{Time: fecha.AddDate(0, 0, f.dias), Valid: true}
+	}
+
+	rows, err := db.Query(`
+		SELECT cer.numero_certificado
+		FROM Certificados cer
+		JOIN Compras com ON com.certificado_id = cer.certificado_id
+		WHERE cer.revocado_en IS NULL AND cer.reemplazado_en IS NULL AND cer.eliminado_en IS NULL
+			AND ($1::timestamptz IS NULL OR cer.fecha_emision >= $1)
+			AND ($2::timestamptz IS NULL OR cer.fecha_emision < $2)
+			AND ($3 = 0 OR EXISTS (
+				SELECT 1 FROM DetallesCompra dc WHERE dc.compra_id = com.compra_id AND dc.producto_id = $3))
+			AND ($4 = '' OR com.estado_pago = $4)
+		ORDER BY cer.certificado_id
+		LIMIT $5`, desde, hasta, filtro.ProductoID, filtro.EstadoPago, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	numeros := []string{}
+	for rows.Next() {
+		var numero string
+		if err := rows.Scan(&numero); err != nil {
+			return nil, err
+		}
+		numeros = append(numeros, numero)
+	}
+	return numeros, rows.Err()
+}
+
+// Revocar un certificado de un trabajo masivo
+func revocarCertificadoMasivo(ctx context.Context, db *sql.DB, parametros json.RawMessage, numero string) error {
+	var p parametrosAccionMasiva
+	if err := json.Unmarshal(parametros, &p); err != nil {
+		return err
+	}
+	return marcarCertificadoRevocado(db, numero, p.Motivo)
+}
+
+// Certificado vigente para enviarlo o generar su PDF
+func certificadoMasivo(db *sql.DB, numero string) (*CertificateData, error) {
+	data, err := consultarCertificado(db, numero, false)
+	if err == sql.ErrNoRows {
+		return nil, errCertificadoInexistente
+	}
+	return data, err
+}
+
+// Reenviar al cliente el email con su certificado en PDF
+func reenviarEmailCertificado(ctx context.Context, db *sql.DB, parametros json.RawMessage, numero string) error {
+	data, err := certificadoMasivo(db, numero)
+	if err != nil {
+		return err
+	}
+	if data.EmailCliente == nil || *data.EmailCliente == "" {
+		return errClienteSinEmail
+	}
+
+	cuerpo := fmt.Sprintf("Adjuntamos tu certificado de autenticidad %s.\n", data.NumeroCertificado)
+	if base := strings.TrimSuffix(configActual().Publico.URLBase, "/"); base != "" {
+		cuerpo += "\nTambién puedes verlo en " + base + rutaPaginaCertificado(data.NumeroCertificado) + "\n"
+	}
+	return enviarEmailConAdjunto(*data.EmailCliente, "Tu certificado de autenticidad Melenas Co", cuerpo, &adjuntoEmail{
+		Nombre:    data.NumeroCertificado + ".pdf",
+		TipoMIME:  "application/pdf",
+		Contenido: generarPDFCertificado(data, IdiomaEspanol),
+	})
+}
+
+// Guardar el PDF actual del certificado en certificados/{numero}.pdf del
+// almacenamiento de archivado
+func regenerarPDFCertificado(ctx context.Context, db *sql.DB, parametros json.RawMessage, numero string) error {
+	data, err := certificadoMasivo(db, numero)
+	if err != nil {
+		return err
+	}
+	return guardarArchivo(ctx, "certificados/"+data.NumeroCertificado+".pdf",
+		generarPDFCertificado(data, IdiomaEspanol), "application/pdf")
+}
+
+// Código HTTP para los errores de las acciones masivas
+func estadoErrorMasivo(err error) int {
+	switch err {
+	case errAccionMasivaInvalida, errSeleccionMasivaDoble, errSeleccionMasivaVacia, errSeleccionMasivaGrande,
+		errFiltroMasivoSinCriterio, errFiltroMasivoFecha:
+		return http.StatusBadRequest
+	case errEmailNoConfigurado, errAlmacenamientoNoConfigurado:
+		return http.StatusConflict
+	case errTrabajoInexistente:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func responderErrorMasivo(w http.ResponseWriter, r *http.Request, err error, mensaje string) {
+	if estado := estadoErrorMasivo(err); estado != http.StatusInternalServerError {
+		http.Error(w, err.Error(), estado)
+	} else {
+		http.Error(w, mensaje, estado)
+	}
+	logSolicitud(r.Context(), err)
+}
+
+// Handler para /admin/certificados/bulk:
+//   - POST {"accion": "revocar", "numeros": ["MC-..."], "motivo": "..."} o
+//     {"accion": "reenviar_email", "filtro": {"desde": "2024-01-01"}} encola
+//     el trabajo y responde 202
+//   - GET lista los trabajos con su progreso
+//   - GET /{id} devuelve el progreso y los certificados que fallaron
+func certificadosMasivosHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/certificados/bulk"), "/")
+	if id != "" {
+		trabajoID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || trabajoID <= 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		trabajo, err := obtenerTrabajo(r.Context(), trabajoID)
+		if err != nil {
+			responderErrorMasivo(w, r, err, "Error al consultar el trabajo")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(trabajo)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		trabajos, err := obtenerTrabajos(r.Context())
+		if err != nil {
+			responderErrorMasivo(w, r, err, "Error al consultar los trabajos")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(trabajos)
+
+	case "POST":
+		var solicitud SolicitudAccionMasiva
+		if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+		trabajo, err := encolarAccionMasiva(r.Context(), solicitud)
+		if err != nil {
+			responderErrorMasivo(w, r, err, "Error al crear el trabajo")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/admin/certificados/bulk/%d", trabajo.ID))
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(trabajo)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Cifrado a nivel de aplicación del email y el teléfono de los clientes
+// (AES-256-GCM). Las claves se configuran en la sección cifrado de
+// config.yml en base64; un valor "env:NOMBRE" se lee de la variable de
+// entorno NOMBRE, que es como se inyectan las claves entregadas por el KMS.
+// Sin clave activa los datos se guardan en claro como antes.
+
+// Cantidad de clientes re-cifrados por transacción al rotar claves
+const loteRotacionPII = 500
+
+// Leer una clave de 32 bytes en base64, directamente o desde el entorno
+func decodificarClave(valor string) ([]byte, error) {
+	if strings.HasPrefix(valor, "env:") {
+		valor = os.Getenv(strings.TrimPrefix(valor, "env:"))
+	}
+	clave, err := base64.StdEncoding.DecodeString(strings.TrimSpace(valor))
+	if err != nil {
+		return nil, fmt.Errorf("Error al decodificar la clave: %v", err)
+	}
+	if len(clave) != 32 {
+		return nil, fmt.Errorf("la clave debe tener 32 bytes, tiene %d", len(clave))
+	}
+	return clave, nil
+}
+
+func cifradoPIIActivo() bool {
+	return config.Cifrado.ClaveActiva != ""
+}
+
+func aeadPII(id string) (cipher.AEAD, error) {
+	valor, ok := config.Cifrado.Claves[id]
+	if !ok {
+		return nil, fmt.Errorf("clave de cifrado desconocida: %q", id)
+	}
+	clave, err := decodificarClave(valor)
+	if err != nil {
+		return nil, fmt.Errorf("clave de cifrado %q: %v", id, err)
+	}
+	bloque, err := aes.NewCipher(clave)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(bloque)
+}
+
+// Cifrar un dato personal con la clave activa
+func cifrarPII(texto string) (string, error) {
+	id := config.Cifrado.ClaveActiva
+	aead, err := aeadPII(id)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	cifrado := aead.Seal(nonce, nonce, []byte(texto), []byte(id))
+	return id + ":" + base64.StdEncoding.EncodeToString(cifrado), nil
+}
+
+// Descifrar un valor producido por cifrarPII con cualquiera de las claves
+// configuradas
+func descifrarPII(valor string) (string, error) {
+	id, datos, ok := strings.Cut(valor, ":")
+	if !ok {
+		return "", fmt.Errorf("valor cifrado sin identificador de clave")
+	}
+	aead, err := aeadPII(id)
+	if err != nil {
+		return "", err
+	}
+	cifrado, err := base64.StdEncoding.DecodeString(datos)
+	if err != nil || len(cifrado) < aead.NonceSize() {
+		return "", fmt.Errorf("valor cifrado inválido")
+	}
+	nonce, cifrado := cifrado[:aead.NonceSize()], cifrado[aead.NonceSize():]
+	texto, err := aead.Open(nil, nonce, cifrado, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("Error al descifrar con la clave %q: %v", id, err)
+	}
+	return string(texto), nil
+}
+
+// Hash determinista del email normalizado para buscar clientes sin
+// descifrar; usa una clave propia para que no cambie al rotar las de cifrado
+func hashEmail(email string) string {
+	if config.Cifrado.ClaveHash == "" {
+		return ""
+	}
+	clave, err := decodificarClave(config.Cifrado.ClaveHash)
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, clave)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Valores de las columnas email, email_cifrado y email_hash para guardar
+// un email según la configuración de cifrado
+func columnasEmail(email string) (plano, cifrado, hash sql.NullString, err error) {
+	hash = sql.NullString{String: hashEmail(email), Valid: hashEmail(email) != ""}
+	if !cifradoPIIActivo() {
+		return sql.NullString{String: email, Valid: true}, cifrado, hash, nil
+	}
+	valor, err := cifrarPII(email)
+	if err != nil {
+		return plano, cifrado, hash, err
+	}
+	return plano, sql.NullString{String: valor, Valid: true}, hash, nil
+}
+
+// Valor de un dato personal a partir de sus columnas en claro y cifrada
+func valorPII(plano, cifrado sql.NullString) (*string, error) {
+	if cifrado.Valid {
+		email, err := descifrarPII(cifrado.String)
+		if err != nil {
+			return nil, err
+		}
+		return &email, nil
+	}
+	if plano.Valid {
+		return &plano.String, nil
+	}
+	return nil, nil
+}
+
+// Consultas sobre *sql.DB o *sql.Tx
+type consultorFila interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type consultorFilas interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Buscar un cliente por email, tanto por el hash como en los registros que
+// aún no se han cifrado. Si el email es de un cliente fusionado se devuelve
+// el cliente que se conservó.
+func buscarClientePorEmail(db consultorFila, email string) (int, error) {
+	var clienteID int
+	err := db.QueryRow(`
+		SELECT coalesce(fusionado_con, cliente_id) FROM Clientes
+		WHERE email_hash = $1 OR lower(email) = $2
+		ORDER BY fusionado_con IS NOT NULL
+		LIMIT 1`, hashEmail(email), strings.ToLower(email)).Scan(&clienteID)
+	return clienteID, err
+}
+
+// Clientes de varios emails en una sola consulta, con el mismo criterio que
+// buscarClientePorEmail. Los emails sin cliente no están en el mapa.
+func buscarClientesPorEmail(db consultorFilas, emails []string) (map[string]int, error) {
+	hashes := make([]string, len(emails))
+	minusculas := make([]string, len(emails))
+	for i, email := range emails {
+		hashes[i] = hashEmail(email)
+		minusculas[i] = strings.ToLower(email)
+	}
+
+	// Los clientes fusionados van primero para que el vigente los reemplace
+	rows, err := db.Query(`
+		SELECT coalesce(email_hash, ''), lower(coalesce(email, '')), coalesce(fusionado_con, cliente_id)
+		FROM Clientes
+		WHERE email_hash = ANY($1) OR lower(email) = ANY($2)
+		ORDER BY fusionado_con IS NULL`, pq.Array(hashes), pq.Array(minusculas))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	porHash := map[string]int{}
+	porEmail := map[string]int{}
+	for rows.Next() {
+		var hash, email string
+		var clienteID int
+		if err := rows.Scan(&hash, &email, &clienteID); err != nil {
+			return nil, err
+		}
+		if hash != "" {
+			porHash[hash] = clienteID
+		}
+		if email != "" {
+			porEmail[email] = clienteID
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	clientes := map[string]int{}
+	for i, email := range emails {
+		if clienteID, ok := porHash[hashes[i]]; ok && hashes[i] != "" {
+			clientes[email] = clienteID
+		} else if clienteID, ok := porEmail[minusculas[i]]; ok {
+			clientes[email] = clienteID
+		}
+	}
+	return clientes, nil
+}
+
+// Insertar un cliente cifrando sus datos personales si corresponde. El
+// teléfono debe venir normalizado; el email o el teléfono pueden faltar.
+func insertarCliente(tx *sql.Tx, nombre, apellido, email, telefono string) (int, error) {
+	var plano, cifrado, hash sql.NullString
+	var err error
+	if email != "" {
+		plano, cifrado, hash, err = columnasEmail(email)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var telefonoPlano, telefonoCifrado, telefonoHash sql.NullString
+	if telefono != "" {
+		telefonoPlano, telefonoCifrado, telefonoHash, err = columnasTelefono(telefono)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var clienteID int
+	err = tx.QueryRow(`
+		INSERT INTO Clientes (nombre, apellido, email, email_cifrado, email_hash, telefono, telefono_cifrado, telefono_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING cliente_id`, nombre, apellido, plano, cifrado, hash, telefonoPlano, telefonoCifrado, telefonoHash).Scan(&clienteID)
+	return clienteID, err
+}
+
+// Resultado de la rotación de claves
+type ResumenRotacion struct {
+	Revisados int
+	Cifrados  int
+}
+
+// Cifrar con la clave activa los datos en claro y los cifrados con claves
+// anteriores o sin el hash del teléfono. Se puede interrumpir y repetir sin
+// problema.
+func rotarClavesPII(db *sql.DB) (ResumenRotacion, error) {
+	var resumen ResumenRotacion
+	if !cifradoPIIActivo() {
+		return resumen, fmt.Errorf("no hay una clave de cifrado activa (cifrado.clave_activa)")
+	}
+	if config.Cifrado.ClaveHash == "" {
+		return resumen, fmt.Errorf("falta la clave para el hash de emails (cifrado.clave_hash)")
+	}
+	prefijoActivo := config.Cifrado.ClaveActiva + ":"
+
+	ultimoID := 0
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return resumen, err
+		}
+
+		rows, err := tx.Query(`
+			SELECT cliente_id, email, email_cifrado, telefono, telefono_cifrado, telefono_hash IS NOT NULL
+			FROM Clientes
+			WHERE cliente_id > $1
+			ORDER BY cliente_id
+			LIMIT $2
+			FOR UPDATE`, ultimoID, loteRotacionPII)
+		if err != nil {
+			tx.Rollback()
+			return resumen, err
+		}
+
+		type clientePII struct {
+			id                        int
+			email, emailCifrado       sql.NullString
+			telefono, telefonoCifrado sql.NullString
+			conHashTelefono           bool
+		}
+		var lote []clientePII
+		for rows.Next() {
+			var c clientePII
+			if err := rows.Scan(&c.id, &c.email, &c.emailCifrado, &c.telefono, &c.telefonoCifrado, &c.conHashTelefono); err != nil {
+				rows.Close()
+				tx.Rollback()
+				return resumen, err
+			}
+			lote = append(lote, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			tx.Rollback()
+			return resumen, err
+		}
+		if len(lote) == 0 {
+			tx.Rollback()
+			return resumen, nil
+		}
+
+		for _, c := range lote {
+			ultimoID = c.id
+			resumen.Revisados++
+
+			pendienteEmail := c.email.Valid || (c.emailCifrado.Valid && !strings.HasPrefix(c.emailCifrado.String, prefijoActivo))
+			// Los teléfonos cifrados antes de existir telefono_hash también se
+			// reescriben para calcularlo
+			pendienteTelefono := c.telefono.Valid ||
+				(c.telefonoCifrado.Valid && (!strings.HasPrefix(c.telefonoCifrado.String, prefijoActivo) || !c.conHashTelefono))
+			if !pendienteEmail && !pendienteTelefono {
+				continue
+			}
+
+			email, err := valorPII(c.email, c.emailCifrado)
+			if err != nil {
+				tx.Rollback()
+				return resumen, fmt.Errorf("cliente %d: %v", c.id, err)
+			}
+			telefono, err := valorPII(c.telefono, c.telefonoCifrado)
+			if err != nil {
+				tx.Rollback()
+				return resumen, fmt.Errorf("cliente %d: %v", c.id, err)
+			}
+
+			var emailCifrado, hash, telefonoCifrado, hashTelefono sql.NullString
+			if email != nil {
+				_, emailCifrado, hash, err = columnasEmail(*email)
+				if err != nil {
+					tx.Rollback()
+					return resumen, err
+				}
+			}
+			if telefono != nil {
+				_, telefonoCifrado, hashTelefono, err = columnasTelefono(*telefono)
+				if err != nil {
+					tx.Rollback()
+					return resumen, err
+				}
+			}
+
+			_, err = tx.Exec(`
+				UPDATE Clientes
+				SET email = NULL, email_cifrado = $2, email_hash = $3,
+					telefono = NULL, telefono_cifrado = $4, telefono_hash = $5
+				WHERE cliente_id = $1`, c.id, emailCifrado, hash, telefonoCifrado, hashTelefono)
+			if err != nil {
+				tx.Rollback()
+				return resumen, err
+			}
+			resumen.Cifrados++
+		}
+
+		if err := tx.Commit(); err != nil {
+			return resumen, err
+		}
+	}
+}
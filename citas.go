@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Agenda de citas de instalación. Las estilistas publican franjas de
+// disponibilidad y los clientes reservan una franja con el número de su
+// certificado; la confirmación llega por email con un archivo iCal.
+
+var (
+	errFranjaNoDisponible   = errors.New("La franja ya no está disponible")
+	errEstilistaInexistente = errors.New("Estilista no encontrada")
+	errEmailNoCoincide      = errors.New("El email no corresponde al certificado")
+)
+
+const (
+	// Rango máximo consultable de disponibilidad
+	rangoMaximoDisponibilidad = 60 * 24 * time.Hour
+	rangoDisponibilidad       = 14 * 24 * time.Hour
+	maximoFranjasPorSolicitud = 500
+)
+
+// Franja de disponibilidad de una estilista
+type Franja struct {
+	FranjaID    int64  `json:"franja_id"`
+	EstilistaID int    `json:"estilista_id"`
+	Estilista   string `json:"estilista"`
+	Inicio      Fecha  `json:"inicio"`
+	Fin         Fecha  `json:"fin"`
+}
+
+// Cita reservada
+type Cita struct {
+	CitaID            int64  `json:"cita_id"`
+	FranjaID          int64  `json:"franja_id"`
+	NumeroCertificado string `json:"numero_certificado"`
+	Estilista         string `json:"estilista"`
+	Inicio            Fecha  `json:"inicio"`
+	Fin               Fecha  `json:"fin"`
+	Notas             string `json:"notas,omitempty"`
+
+	emailEstilista sql.NullString
+}
+
+func insertarEstilista(db *sql.DB, nombre, email string) (int, error) {
+	var id int
+	err := db.QueryRow(`INSERT INTO Estilistas (nombre, email) VALUES ($1, NULLIF($2, '')) RETURNING estilista_id`,
+		nombre, email).Scan(&id)
+	return id, err
+}
+
+// Crear franjas consecutivas de la duración dada entre inicio y fin. Las
+// que ya existen se ignoran; devuelve la cantidad creada.
+func insertarFranjas(db *sql.DB, estilistaID int, inicio, fin time.Time, duracion time.Duration) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	creadas := 0
+	for desde := inicio; !desde.Add(duracion).After(fin); desde = desde.Add(duracion) {
+		resultado, err := tx.Exec(`
+			INSERT INTO FranjasDisponibles (estilista_id, inicio, fin)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (estilista_id, inicio) DO NOTHING`, estilistaID, desde, desde.Add(duracion))
+		if e, ok := err.(*pq.Error); ok && e.Code == "23503" {
+			return 0, errEstilistaInexistente
+		}
+		if err != nil {
+			return 0, err
+		}
+		n, _ := resultado.RowsAffected()
+		creadas += int(n)
+	}
+
+	return creadas, tx.Commit()
+}
+
+// Franjas libres de estilistas activas dentro del rango
+func consultarFranjasLibres(db *sql.DB, desde, hasta time.Time) ([]Franja, error) {
+	rows, err := db.Query(`
+		SELECT f.franja_id, f.estilista_id, e.nombre, f.inicio, f.fin
+		FROM FranjasDisponibles f
+		JOIN Estilistas e ON e.estilista_id = f.estilista_id
+		WHERE NOT f.reservada AND e.activo AND f.inicio > now() AND f.inicio >= $1 AND f.inicio < $2
+		ORDER BY f.inicio, e.nombre`, desde, hasta)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	franjas := []Franja{}
+	for rows.Next() {
+		var f Franja
+		if err := rows.Scan(&f.FranjaID, &f.EstilistaID, &f.Estilista, &f.Inicio, &f.Fin); err != nil {
+			return nil, err
+		}
+		franjas = append(franjas, f)
+	}
+	return franjas, rows.Err()
+}
+
+// Reservar una franja libre para un certificado
+func reservarFranja(db *sql.DB, franjaID int64, numeroCertificado, notas string) (*Cita, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	cita := Cita{FranjaID: franjaID, NumeroCertificado: numeroCertificado, Notas: notas}
+	err = tx.QueryRow(`
+		UPDATE FranjasDisponibles f SET reservada = true
+		FROM Estilistas e
+		WHERE f.franja_id = $1 AND NOT f.reservada AND f.inicio > now()
+			AND e.estilista_id = f.estilista_id AND e.activo
+		RETURNING e.nombre, e.email, f.inicio, f.fin`, franjaID).
+		Scan(&cita.Estilista, &cita.emailEstilista, &cita.Inicio, &cita.Fin)
+	if err == sql.ErrNoRows {
+		return nil, errFranjaNoDisponible
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO Citas (franja_id, numero_certificado, notas)
+		VALUES ($1, $2, $3)
+		RETURNING cita_id`, franjaID, numeroCertificado, notas).Scan(&cita.CitaID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cita, tx.Commit()
+}
+
+// Escapar un texto para un campo de iCalendar
+func textoICal(texto string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(texto)
+}
+
+// Evento iCalendar (RFC 5545) de una cita
+func iCalCita(cita *Cita) []byte {
+	formato := "20060102T150405Z"
+	lineas := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Melenas Co//Citas//ES",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:cita-%d@melenas.co", cita.CitaID),
+		"DTSTAMP:" + time.Now().UTC().Format(formato),
+		"DTSTART:" + cita.Inicio.UTC().Format(formato),
+		"DTEND:" + cita.Fin.UTC().Format(formato),
+		"SUMMARY:" + textoICal("Instalación Melenas Co con "+cita.Estilista),
+		"DESCRIPTION:" + textoICal("Certificado "+cita.NumeroCertificado),
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}
+	return []byte(strings.Join(lineas, "\r\n") + "\r\n")
+}
+
+// Enviar la confirmación al cliente y el aviso a la estilista
+func notificarCita(cita *Cita, emailCliente string) error {
+	horario := cita.Inicio.In(zonaHoraria).Format("02/01/2006 15:04")
+	adjunto := &adjuntoEmail{Nombre: "cita.ics", TipoMIME: "text/calendar; charset=utf-8; method=PUBLISH", Contenido: iCalCita(cita)}
+
+	err := enviarEmailConAdjunto(emailCliente, "Tu cita de instalación en Melenas Co",
+		fmt.Sprintf("Tu cita de instalación quedó reservada para el %s con %s.\n\nCertificado: %s\n",
+			horario, cita.Estilista, cita.NumeroCertificado), adjunto)
+	if err != nil {
+		return err
+	}
+
+	if cita.emailEstilista.Valid {
+		return enviarEmailConAdjunto(cita.emailEstilista.String, "Nueva cita de instalación",
+			fmt.Sprintf("Tienes una cita el %s.\n\nCertificado: %s\nNotas: %s\n",
+				horario, cita.NumeroCertificado, cita.Notas), adjunto)
+	}
+	return nil
+}
+
+func estadoErrorCita(err error) int {
+	switch err {
+	case errFranjaNoDisponible:
+		return http.StatusConflict
+	case errEstilistaInexistente:
+		return http.StatusNotFound
+	case errEmailNoCoincide:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func responderErrorCita(w http.ResponseWriter, r *http.Request, err error, mensaje string) {
+	estado := estadoErrorCita(err)
+	if estado == http.StatusInternalServerError {
+		http.Error(w, mensaje, estado)
+	} else {
+		http.Error(w, err.Error(), estado)
+	}
+	logSolicitud(r.Context(), err)
+}
+
+// Handler para /citas: GET lista las franjas libres (desde y hasta
+// opcionales en RFC3339) y POST reserva una
+func citasHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	switch r.Method {
+	case "OPTIONS":
+		w.WriteHeader(http.StatusOK)
+
+	case "GET":
+		desde, hasta := time.Now(), time.Now().Add(rangoDisponibilidad)
+		if valor := r.URL.Query().Get("desde"); valor != "" {
+			t, err := time.Parse(time.RFC3339, valor)
+			if err != nil {
+				http.Error(w, "desde debe estar en formato RFC3339", http.StatusBadRequest)
+				return
+			}
+			desde, hasta = t, t.Add(rangoDisponibilidad)
+		}
+		if valor := r.URL.Query().Get("hasta"); valor != "" {
+			t, err := time.Parse(time.RFC3339, valor)
+			if err != nil {
+				http.Error(w, "hasta debe estar en formato RFC3339", http.StatusBadRequest)
+				return
+			}
+			hasta = t
+		}
+		if !hasta.After(desde) || hasta.Sub(desde) > rangoMaximoDisponibilidad {
+			http.Error(w, "Rango de fechas inválido (máximo 60 días)", http.StatusBadRequest)
+			return
+		}
+
+		franjas, err := obtenerFranjasLibres(r.Context(), desde, hasta)
+		if err != nil {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(franjas)
+
+	case "POST":
+		var solicitud struct {
+			FranjaID          int64  `json:"franja_id"`
+			NumeroCertificado string `json:"numero_certificado"`
+			Email             string `json:"email"`
+			Notas             string `json:"notas"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&solicitud)
+		if err != nil || solicitud.FranjaID <= 0 || solicitud.NumeroCertificado == "" || solicitud.Email == "" {
+			http.Error(w, "franja_id, numero_certificado y email requeridos", http.StatusBadRequest)
+			return
+		}
+
+		cita, err := agendarCita(r.Context(), solicitud.FranjaID, solicitud.NumeroCertificado,
+			solicitud.Email, strings.TrimSpace(solicitud.Notas))
+		if err != nil {
+			if err == sql.ErrNoRows || err == errCertificadoYaRevocado {
+				http.Error(w, "Certificado no encontrado o revocado", http.StatusNotFound)
+				logSolicitud(r.Context(), err)
+				return
+			}
+			responderErrorCita(w, r, err, "Error al reservar la cita")
+			return
+		}
+
+		// La reserva ya quedó guardada aunque falle el envío del email
+		go func() {
+			if err := notificarCita(cita, solicitud.Email); err != nil {
+				logSolicitud(r.Context(), "Error al enviar la confirmación de la cita:", err)
+			}
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(cita)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handler para administrar la agenda:
+//   - POST /admin/estilistas {"nombre": "...", "email": "..."}
+//   - POST /admin/estilistas/{id}/franjas {"inicio": "...", "fin": "...", "duracion_minutos": 90}
+func estilistasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/estilistas"), "/")
+	if ruta == "" {
+		var solicitud struct {
+			Nombre string `json:"nombre"`
+			Email  string `json:"email"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&solicitud)
+		if err != nil || strings.TrimSpace(solicitud.Nombre) == "" {
+			http.Error(w, "nombre requerido", http.StatusBadRequest)
+			return
+		}
+		id, err := registrarEstilista(strings.TrimSpace(solicitud.Nombre), strings.TrimSpace(solicitud.Email))
+		if err != nil {
+			responderErrorCita(w, r, err, "Error al registrar la estilista")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]int{"estilista_id": id})
+		return
+	}
+
+	id, accion, _ := strings.Cut(ruta, "/")
+	estilistaID, err := strconv.Atoi(id)
+	if err != nil || estilistaID <= 0 || accion != "franjas" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var solicitud struct {
+		Inicio          time.Time `json:"inicio"`
+		Fin             time.Time `json:"fin"`
+		DuracionMinutos int       `json:"duracion_minutos"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&solicitud)
+	if err != nil || solicitud.DuracionMinutos <= 0 || !solicitud.Fin.After(solicitud.Inicio) {
+		http.Error(w, "inicio, fin (RFC3339) y duracion_minutos requeridos", http.StatusBadRequest)
+		return
+	}
+	duracion := time.Duration(solicitud.DuracionMinutos) * time.Minute
+	if solicitud.Fin.Sub(solicitud.Inicio)/duracion > maximoFranjasPorSolicitud {
+		http.Error(w, fmt.Sprintf("Máximo %d franjas por solicitud", maximoFranjasPorSolicitud), http.StatusBadRequest)
+		return
+	}
+
+	creadas, err := publicarFranjas(estilistaID, solicitud.Inicio, solicitud.Fin, duracion)
+	if err != nil {
+		responderErrorCita(w, r, err, "Error al crear las franjas")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int{"franjas_creadas": creadas})
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const usoCLI = `Uso: melenas <comando> [opciones]
+
+Comandos:
+  serve [--mock-rocketfy]    Inicia el servidor HTTP (por defecto)
+  migrate up                 Aplica las migraciones pendientes
+  migrate status             Lista las migraciones aplicadas y pendientes
+  migrate phones             Normaliza a E.164 los teléfonos de los clientes
+  migrate atributos          Pasa a su valor canónico el tipo, color y longitud
+                             de los productos
+  sync products              Sincroniza los productos desde Rocketfy
+  sync orders [--reset]      Sincroniza los pedidos de Rocketfy como compras y
+                             emite los certificados de los pagados (--reset
+                             los revisa todos desde el principio)
+  sync customers [--reset]   Vincula los clientes de Rocketfy con los locales y
+                             fusiona los duplicados
+  issue --file ventas.csv    Emite certificados para las ventas del archivo
+        [--dry-run] [--yes]  (valida sin escribir / no pide confirmación)
+  seed [--seed N]            Genera datos de prueba deterministas
+  pii rotate                 Cifra los datos personales con la clave activa
+  config check               Valida config.yml y la conexión a la base de datos
+  ubicaciones import --file divipola.csv
+                             Carga los municipios del listado DIVIPOLA del DANE
+  backup run                 Respalda la base con pg_dump en el almacenamiento
+  backup verify [--id N]     Restaura un respaldo (el último por defecto) en
+                             una base temporal para comprobar que sirve
+`
+
+// Ejecutar el subcomando indicado y devolver el código de salida
+func ejecutarComando(args []string) int {
+	if config.API.Mock {
+		if err := iniciarMockRocketfy(); err != nil {
+			log.Println("Error al iniciar Rocketfy simulado:", err)
+			return 1
+		}
+	}
+
+	if len(args) == 0 {
+		servir()
+		return 0
+	}
+
+	switch args[0] {
+	case "serve":
+		return comandoServe(args[1:])
+	case "migrate":
+		return comandoMigrate(args[1:])
+	case "sync":
+		return comandoSync(args[1:])
+	case "issue":
+		return comandoIssue(args[1:])
+	case "seed":
+		return comandoSeed(args[1:])
+	case "pii":
+		return comandoPII(args[1:])
+	case "config":
+		return comandoConfig(args[1:])
+	case "ubicaciones":
+		return comandoUbicaciones(args[1:])
+	case "backup":
+		return comandoBackup(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usoCLI)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Comando desconocido: %s\n\n%s", args[0], usoCLI)
+	return 2
+}
+
+func comandoServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	mock := flags.Bool("mock-rocketfy", false, "usa una API de Rocketfy simulada con productos de ejemplo")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// Con rocketfy.mock en config.yml el simulado ya está iniciado
+	if *mock && !config.API.Mock {
+		if err := iniciarMockRocketfy(); err != nil {
+			log.Println("Error al iniciar Rocketfy simulado:", err)
+			return 1
+		}
+	}
+
+	servir()
+	return 0
+}
+
+func comandoMigrate(args []string) int {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status" && args[0] != "phones" && args[0] != "atributos") {
+		fmt.Fprint(os.Stderr, "Uso: melenas migrate up|status|phones|atributos\n")
+		return 2
+	}
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	if args[0] == "phones" {
+		resumen, err := normalizarTelefonosClientes(db)
+		fmt.Printf("Teléfonos revisados: %d, normalizados: %d, inválidos: %d\n",
+			resumen.Revisados, resumen.Normalizados, len(resumen.Invalidos))
+		for _, clienteID := range resumen.Invalidos {
+			fmt.Printf("Cliente %d: teléfono inválido, corregir con PUT /admin/clientes/%d/telefono\n", clienteID, clienteID)
+		}
+		if err != nil {
+			log.Println("Error al normalizar los teléfonos:", err)
+			return 1
+		}
+		return 0
+	}
+
+	if args[0] == "atributos" {
+		resumen, err := normalizarAtributosProductos(db)
+		fmt.Printf("Atributos revisados: %d, normalizados: %d, fuera del catálogo: %d\n",
+			resumen.Revisados, resumen.Normalizados, len(resumen.Invalidos))
+		for _, invalido := range resumen.Invalidos {
+			fmt.Println(invalido)
+		}
+		if len(resumen.Invalidos) > 0 {
+			fmt.Println("Agregue el valor o un alias con PUT /admin/atributos/{atributo}, o corrija el producto con PUT /admin/productos/{id}/atributos")
+		}
+		if err != nil {
+			log.Println("Error al normalizar los atributos:", err)
+			return 1
+		}
+		return 0
+	}
+
+	if args[0] == "status" {
+		estados, err := estadoMigraciones(db)
+		if err != nil {
+			log.Println("Error al consultar las migraciones:", err)
+			return 1
+		}
+		for _, estado := range estados {
+			marca := "pendiente"
+			if estado.Aplicada {
+				marca = "aplicada"
+			}
+			fmt.Printf("%-40s %s\n", estado.Nombre, marca)
+		}
+		return 0
+	}
+
+	aplicadas, err := aplicarMigraciones(db)
+	for _, nombre := range aplicadas {
+		fmt.Println("Aplicada:", nombre)
+	}
+	if err != nil {
+		log.Println("Error al aplicar las migraciones:", err)
+		return 1
+	}
+	if len(aplicadas) == 0 {
+		fmt.Println("No hay migraciones pendientes")
+	}
+	return 0
+}
+
+func comandoSync(args []string) int {
+	if len(args) == 0 || (args[0] != "products" && args[0] != "orders" && args[0] != "customers") {
+		fmt.Fprint(os.Stderr, "Uso: melenas sync products | melenas sync orders [--reset] | melenas sync customers [--reset]\n")
+		return 2
+	}
+	if args[0] == "orders" {
+		return comandoSyncOrders(args[1:])
+	}
+	if args[0] == "customers" {
+		return comandoSyncCustomers(args[1:])
+	}
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, "Uso: melenas sync products\n")
+		return 2
+	}
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	resumen, err := sincronizarProductos(db)
+	for _, d := range resumen.CambiosEsquema {
+		fmt.Println("Cambio de esquema:", d)
+	}
+	if err != nil {
+		log.Println("Error al sincronizar productos:", err)
+		avisar(AvisoSincronizacionFallida, fmt.Sprintf("Falló la sincronización de productos con Rocketfy: %v", err))
+		return 1
+	}
+
+	fmt.Printf("Productos recibidos: %d, nuevos o modificados: %d\n", resumen.Recibidos, resumen.Modificados)
+	if resumen.Eliminados > 0 {
+		fmt.Printf("Productos eliminados en Rocketfy: %d\n", resumen.Eliminados)
+	}
+	if resumen.Kits > 0 || resumen.KitsOmitidos > 0 {
+		fmt.Printf("Kits sincronizados: %d, omitidos por SKU desconocido: %d\n", resumen.Kits, resumen.KitsOmitidos)
+	}
+	return 0
+}
+
+func comandoSyncOrders(args []string) int {
+	flags := flag.NewFlagSet("sync orders", flag.ContinueOnError)
+	reiniciar := flags.Bool("reset", false, "ignora el cursor guardado y revisa todos los pedidos")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	resumen, err := sincronizarPedidos(db, *reiniciar)
+	// Las páginas anteriores al error ya quedaron guardadas
+	if resumen.Recibidos > 0 || err == nil {
+		fmt.Printf("Pedidos recibidos: %d, compras nuevas: %d, actualizadas: %d, certificados emitidos: %d\n",
+			resumen.Recibidos, resumen.Nuevos, resumen.Actualizados, resumen.Certificados)
+		for _, omitido := range resumen.Omitidos {
+			fmt.Println("Omitido:", omitido)
+		}
+	}
+	if err != nil {
+		log.Println("Error al sincronizar pedidos:", err)
+		avisar(AvisoSincronizacionFallida, fmt.Sprintf("Falló la sincronización de pedidos con Rocketfy: %v", err))
+		return 1
+	}
+	return 0
+}
+
+func comandoSyncCustomers(args []string) int {
+	flags := flag.NewFlagSet("sync customers", flag.ContinueOnError)
+	reiniciar := flags.Bool("reset", false, "ignora el cursor guardado y revisa todos los clientes")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	resumen, err := sincronizarClientesRocketfy(db, *reiniciar)
+	// Las páginas anteriores al error ya quedaron guardadas
+	if resumen.Recibidos > 0 || err == nil {
+		fmt.Printf("Clientes recibidos: %d, nuevos: %d, vinculados o completados: %d, duplicados fusionados: %d\n",
+			resumen.Recibidos, resumen.Nuevos, resumen.Actualizados, resumen.Fusionados)
+		for _, omitido := range resumen.Omitidos {
+			fmt.Println("Omitido:", omitido)
+		}
+	}
+	if err != nil {
+		log.Println("Error al sincronizar clientes:", err)
+		avisar(AvisoSincronizacionFallida, fmt.Sprintf("Falló la sincronización de clientes con Rocketfy: %v", err))
+		return 1
+	}
+	return 0
+}
+
+func comandoIssue(args []string) int {
+	flags := flag.NewFlagSet("issue", flag.ContinueOnError)
+	archivo := flags.String("file", "", "archivo CSV con las ventas")
+	dryRun := flags.Bool("dry-run", false, "valida y muestra lo que se crearía sin escribir")
+	confirmar := flags.Bool("yes", false, "emite sin pedir confirmación")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *archivo == "" {
+		fmt.Fprint(os.Stderr, "Uso: melenas issue --file ventas.csv [--dry-run] [--yes]\n")
+		return 2
+	}
+
+	f, err := os.Open(*archivo)
+	if err != nil {
+		log.Println("Error al abrir el archivo:", err)
+		return 1
+	}
+	defer f.Close()
+
+	ventas, err := leerVentasCSV(f)
+	if err != nil {
+		log.Println("Error al leer el archivo:", err)
+		return 1
+	}
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	invalidas, err := validarVentas(db, ventas)
+	if err != nil {
+		log.Println("Error al validar las ventas:", err)
+		return 1
+	}
+
+	// Reporte de lo que se crearía por cada fila
+	for _, venta := range ventas {
+		if len(venta.Errores) > 0 {
+			fmt.Printf("Fila %d: ERROR: %s\n", venta.Fila, strings.Join(venta.Errores, "; "))
+			continue
+		}
+		cliente := "cliente nuevo"
+		if venta.ClienteID > 0 {
+			cliente = fmt.Sprintf("cliente existente #%d", venta.ClienteID)
+		}
+		fmt.Printf("Fila %d: %s <%s> (%s), producto %q, compra del %s (%s)\n",
+			venta.Fila, strings.TrimSpace(venta.Nombre+" "+venta.Apellido), venta.Email, cliente,
+			venta.NombreProducto, venta.FechaCompra, venta.EstadoPago)
+	}
+	fmt.Printf("Ventas: %d, válidas: %d, con error: %d\n", len(ventas), len(ventas)-invalidas, invalidas)
+
+	if invalidas > 0 {
+		fmt.Println("No se emitió ningún certificado: corrija las filas con error")
+		return 1
+	}
+	certificados := certificadosVentas(ventas)
+	if certificados != len(ventas) {
+		fmt.Printf("Certificados a emitir: %d (las filas de un mismo pedido comparten certificado)\n", certificados)
+	}
+	if *dryRun || len(ventas) == 0 {
+		return 0
+	}
+
+	if !*confirmar {
+		fmt.Printf("¿Emitir %d certificados? [s/N]: ", certificados)
+		respuesta, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		respuesta = strings.ToLower(strings.TrimSpace(respuesta))
+		if respuesta != "s" && respuesta != "si" && respuesta != "sí" {
+			fmt.Println("Emisión cancelada")
+			return 1
+		}
+	}
+
+	emitidos, err := emitirCertificadosVentas(db, ventas)
+	if err != nil {
+		log.Println("Error al emitir los certificados, no se guardó ningún cambio:", err)
+		return 1
+	}
+	for _, emitido := range emitidos {
+		fmt.Printf("Fila %d: certificado %s emitido para %s\n", emitido.Venta.Fila, emitido.Numero, emitido.Venta.Email)
+	}
+	fmt.Printf("Certificados emitidos: %d\n", certificados)
+	return 0
+}
+
+func comandoSeed(args []string) int {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	var opciones OpcionesSemilla
+	flags.Int64Var(&opciones.Semilla, "seed", 1, "semilla del generador (mismos datos para la misma semilla)")
+	flags.IntVar(&opciones.Productos, "productos", 20, "cantidad de productos")
+	flags.IntVar(&opciones.Clientes, "clientes", 50, "cantidad de clientes")
+	flags.IntVar(&opciones.Compras, "compras", 100, "cantidad de compras con certificado")
+	forzar := flags.Bool("force", false, "genera datos aunque la base ya tenga certificados")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	// Evitar mezclar datos falsos con datos reales por accidente
+	existentes, err := baseConCertificados(db)
+	if err != nil {
+		log.Println("Error al consultar la base de datos:", err)
+		return 1
+	}
+	if existentes && !*forzar {
+		fmt.Fprint(os.Stderr, "La base de datos ya tiene certificados; use --force para sembrar de todas formas\n")
+		return 1
+	}
+
+	resumen, err := sembrarDatos(db, opciones)
+	if err != nil {
+		log.Println("Error al generar los datos:", err)
+		return 1
+	}
+
+	fmt.Printf("Productos: %d, clientes: %d, certificados: %d\n", resumen.Productos, resumen.Clientes, resumen.Certificados)
+	return 0
+}
+
+func comandoPII(args []string) int {
+	if len(args) != 1 || args[0] != "rotate" {
+		fmt.Fprint(os.Stderr, "Uso: melenas pii rotate\n")
+		return 2
+	}
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	resumen, err := rotarClavesPII(db)
+	fmt.Printf("Clientes revisados: %d, cifrados con la clave %q: %d\n",
+		resumen.Revisados, config.Cifrado.ClaveActiva, resumen.Cifrados)
+	if err != nil {
+		log.Println("Error al rotar las claves de cifrado:", err)
+		return 1
+	}
+	return 0
+}
+
+func comandoConfig(args []string) int {
+	if len(args) != 1 || args[0] != "check" {
+		fmt.Fprint(os.Stderr, "Uso: melenas config check\n")
+		return 2
+	}
+
+	problemas := validarConfig(config)
+	if err := comprobarBaseDatos(); err != nil {
+		problemas = append(problemas, ProblemaConfig{Campo: "db", Mensaje: "no se pudo conectar: " + err.Error()})
+	}
+
+	imprimirProblemasConfig(os.Stdout, problemas)
+	if hayErroresConfig(problemas) {
+		fmt.Printf("%s tiene errores\n", archivoConfig)
+		return 1
+	}
+	fmt.Printf("%s es válido\n", archivoConfig)
+	return 0
+}
+
+func comandoUbicaciones(args []string) int {
+	flags := flag.NewFlagSet("ubicaciones import", flag.ContinueOnError)
+	archivo := flags.String("file", "", "archivo CSV DIVIPOLA del DANE")
+	if len(args) == 0 || args[0] != "import" || flags.Parse(args[1:]) != nil || *archivo == "" {
+		fmt.Fprint(os.Stderr, "Uso: melenas ubicaciones import --file divipola.csv\n")
+		return 2
+	}
+
+	f, err := os.Open(*archivo)
+	if err != nil {
+		log.Println("Error al abrir el archivo:", err)
+		return 1
+	}
+	defer f.Close()
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	municipios, err := importarDivipola(db, f)
+	if err != nil {
+		log.Println("Error al importar las ubicaciones:", err)
+		return 1
+	}
+	fmt.Printf("Municipios importados: %d\n", municipios)
+	return 0
+}
+
+func comandoBackup(args []string) int {
+	flags := flag.NewFlagSet("backup verify", flag.ContinueOnError)
+	id := flags.Int("id", 0, "respaldo a verificar; por defecto el último completado")
+	if len(args) == 0 || (args[0] != "run" && args[0] != "verify") || flags.Parse(args[1:]) != nil ||
+		(args[0] == "run" && flags.NFlag() > 0) {
+		fmt.Fprint(os.Stderr, "Uso: melenas backup run|verify [--id N]\n")
+		return 2
+	}
+
+	db, err := conectarDB()
+	if err != nil {
+		log.Println("Error al conectar a la base de datos:", err)
+		return 1
+	}
+	defer cerrarPool(db)
+
+	if args[0] == "run" {
+		respaldoID, err := registrarRespaldo(db)
+		if err == nil {
+			err = ejecutarRespaldo(context.Background(), db, respaldoID)
+		}
+		if err != nil {
+			log.Println("Error al respaldar la base de datos:", err)
+			return 1
+		}
+		fmt.Printf("Respaldo %d completado\n", respaldoID)
+		return 0
+	}
+
+	resumen, err := verificarRespaldo(context.Background(), db, *id)
+	if err != nil {
+		log.Println("Error al verificar el respaldo:", err)
+		return 1
+	}
+	fmt.Println("Respaldo restaurado correctamente.", resumen)
+	return 0
+}
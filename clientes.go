@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Derechos de los titulares (Habeas Data): exportación de todos los datos
+// de un cliente y anonimización. Al anonimizar se borran los datos
+// personales pero se conservan las compras y los certificados, de modo que
+// los certificados siguen verificándose y los totales de ventas no cambian.
+
+// Nombre que reemplaza al del cliente anonimizado
+const nombreAnonimizado = "Anónimo"
+
+var (
+	errClienteInexistente = errors.New("Cliente no encontrado")
+	errClienteAnonimizado = errors.New("El cliente ya fue anonimizado")
+)
+
+// Datos publicados en el evento de anonimización
+type EventoCliente struct {
+	ClienteID int       `json:"cliente_id"`
+	Fecha     time.Time `json:"fecha"`
+}
+
+// Todos los datos guardados de un cliente
+type DatosCliente struct {
+	ClienteID       int              `json:"cliente_id"`
+	Nombre          *string          `json:"nombre"`
+	Apellido        *string          `json:"apellido"`
+	Email           *string          `json:"email"`
+	Telefono        *string          `json:"telefono"`
+	AnonimizadoEn   *Fecha           `json:"anonimizado_en"`
+	Consentimientos []Consentimiento `json:"consentimientos"`
+	Compras         []CompraCliente  `json:"compras"`
+}
+
+type CompraCliente struct {
+	CompraID          int     `json:"compra_id"`
+	FechaCompra       *Fecha  `json:"fecha_compra"`
+	EstadoPago        *string `json:"estado_pago"`
+	Producto          *string `json:"producto"`
+	NumeroCertificado *string `json:"numero_certificado"`
+	FechaEmision      *Fecha  `json:"fecha_emision"`
+	Revocado          bool    `json:"revocado"`
+}
+
+// Leer los datos personales, compras y certificados de un cliente
+func consultarDatosCliente(db *sql.DB, clienteID int) (*DatosCliente, error) {
+	datos := DatosCliente{ClienteID: clienteID, Compras: []CompraCliente{}}
+	var email, emailCifrado, telefono, telefonoCifrado sql.NullString
+	err := db.QueryRow(`
+		SELECT nombre, apellido, email, email_cifrado, telefono, telefono_cifrado, anonimizado_en
+		FROM Clientes
+		WHERE cliente_id = $1`, clienteID).Scan(
+		&datos.Nombre, &datos.Apellido, &email, &emailCifrado, &telefono, &telefonoCifrado, &datos.AnonimizadoEn)
+	if err == sql.ErrNoRows {
+		return nil, errClienteInexistente
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	datos.Email, err = valorPII(email, emailCifrado)
+	if err != nil {
+		return nil, err
+	}
+	datos.Telefono, err = valorPII(telefono, telefonoCifrado)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT com.compra_id, com.fecha_compra, com.estado_pago, p.nombre,
+			cer.numero_certificado, cer.fecha_emision, cer.revocado_en IS NOT NULL
+		FROM Compras com
+		LEFT JOIN DetallesCompra dc ON dc.compra_id = com.compra_id
+		LEFT JOIN Productos p ON p.producto_id = dc.producto_id
+		LEFT JOIN Certificados cer ON cer.certificado_id = com.certificado_id
+		WHERE com.cliente_id = $1
+		ORDER BY com.fecha_compra, com.compra_id`, clienteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var compra CompraCliente
+		var revocado sql.NullBool
+		err := rows.Scan(&compra.CompraID, &compra.FechaCompra, &compra.EstadoPago, &compra.Producto,
+			&compra.NumeroCertificado, &compra.FechaEmision, &revocado)
+		if err != nil {
+			return nil, err
+		}
+		compra.Revocado = revocado.Bool
+		datos.Compras = append(datos.Compras, compra)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	datos.Consentimientos, err = consultarConsentimientos(db, clienteID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &datos, nil
+}
+
+// Borrar los datos personales de un cliente conservando sus compras y
+// certificados, y registrar el evento en el outbox
+func borrarDatosCliente(db *sql.DB, clienteID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var anonimizadoEn sql.NullTime
+	err = tx.QueryRow(`SELECT anonimizado_en FROM Clientes WHERE cliente_id = $1 FOR UPDATE`, clienteID).
+		Scan(&anonimizadoEn)
+	if err == sql.ErrNoRows {
+		return errClienteInexistente
+	}
+	if err != nil {
+		return err
+	}
+	if anonimizadoEn.Valid {
+		return errClienteAnonimizado
+	}
+
+	var fecha time.Time
+	err = tx.QueryRow(`
+		UPDATE Clientes
+		SET nombre = $2, apellido = '', email = NULL, email_cifrado = NULL, email_hash = NULL,
+			telefono = NULL, telefono_cifrado = NULL, telefono_hash = NULL, anonimizado_en = now()
+		WHERE cliente_id = $1
+		RETURNING anonimizado_en`, clienteID, nombreAnonimizado).Scan(&fecha)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM DispositivosCliente WHERE cliente_id = $1`, clienteID)
+	if err != nil {
+		return err
+	}
+	// Sin el vínculo, Rocketfy no vuelve a asociar sus pedidos a este registro
+	_, err = tx.Exec(`DELETE FROM ClientesRocketfy WHERE cliente_id = $1`, clienteID)
+	if err != nil {
+		return err
+	}
+
+	err = registrarEventoOutbox(tx, EventoClienteAnonimizado, EventoCliente{ClienteID: clienteID, Fecha: fecha})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func estadoErrorCliente(err error) int {
+	switch err {
+	case errClienteInexistente:
+		return http.StatusNotFound
+	case errClienteAnonimizado, errClienteFusionado:
+		return http.StatusConflict
+	case errFusionInvalida:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// Handler para /admin/clientes/{id} (DELETE),
+// /admin/clientes/{id}/restore (POST),
+// /admin/clientes/{id}/datos (GET),
+// /admin/clientes/{id}/anonimizar (POST),
+// /admin/clientes/{id}/consentimientos (GET, PUT) y
+// /admin/clientes/{id}/telefono (PUT)
+func clientesAdminHandler(w http.ResponseWriter, r *http.Request) {
+	partes := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/clientes/"), "/"), "/")
+	if len(partes) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	clienteID, err := strconv.Atoi(partes[0])
+	if err != nil || clienteID <= 0 {
+		http.Error(w, "Identificador de cliente inválido", http.StatusBadRequest)
+		return
+	}
+	if len(partes) == 1 || partes[1] == "restore" {
+		borradoLogicoHandler(w, r, entidadClientes, clienteID, strings.Join(partes[1:], ""))
+		return
+	}
+
+	switch partes[1] {
+	case "datos":
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		datos, err := exportarDatosCliente(r.Context(), clienteID)
+		if err != nil {
+			responderErrorCliente(w, r, err, "Error al exportar los datos del cliente")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cliente-%d.json"`, clienteID))
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(datos)
+
+	case "anonimizar":
+		if r.Method != "POST" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		err := anonimizarCliente(clienteID)
+		if err != nil {
+			responderErrorCliente(w, r, err, "Error al anonimizar el cliente")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "consentimientos":
+		consentimientosHandler(w, r, clienteID)
+
+	case "telefono":
+		telefonoClienteHandler(w, r, clienteID)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func responderErrorCliente(w http.ResponseWriter, r *http.Request, err error, mensaje string) {
+	estado := estadoErrorCliente(err)
+	if estado == http.StatusInternalServerError {
+		http.Error(w, mensaje, estado)
+	} else {
+		http.Error(w, err.Error(), estado)
+	}
+	logSolicitud(r.Context(), err)
+}
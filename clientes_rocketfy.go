@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sincronización de los clientes de Rocketfy (melenas sync customers y,
+// con rocketfy.intervalo_clientes_minutos, periódicamente). Cada cliente de
+// Rocketfy queda vinculado a uno local en ClientesRocketfy; los pedidos y
+// webhooks que traen su identificador se asocian por ese vínculo aunque el
+// cliente haya cambiado de email o teléfono. Si el vínculo, el email y el
+// teléfono apuntan a clientes locales distintos, son la misma persona: se
+// fusionan en el vinculado (o, sin vínculo, en el del email).
+
+const (
+	// Recurso en CursoresSincronizacion
+	recursoClientesRocketfy = "clientes"
+	motivoFusionRocketfy    = "Sincronización con Rocketfy"
+)
+
+// Cliente de Rocketfy con los campos que se guardan
+type ClienteRocketfy struct {
+	ID       string
+	Nombre   string
+	Apellido string
+	// Email y teléfono (E.164); los inválidos quedan vacíos
+	Email    string
+	Telefono string
+}
+
+// Resultado de vincular un cliente de Rocketfy con uno local
+type vinculoRocketfy struct {
+	ClienteID int
+	// Cliente local creado
+	Nuevo bool
+	// Cliente local existente vinculado por primera vez o completado
+	Actualizado bool
+	Fusionados  int
+}
+
+// Leer los datos de un cliente de Rocketfy (el recurso /customers o el
+// cliente dentro de un pedido)
+func leerClienteRocketfy(datos map[string]interface{}) ClienteRocketfy {
+	cliente := ClienteRocketfy{
+		ID:       textoRocketfy(datos, "id", "_id"),
+		Nombre:   textoRocketfy(datos, "firstName", "first_name", "name"),
+		Apellido: textoRocketfy(datos, "lastName", "last_name"),
+	}
+	if cliente.Apellido == "" {
+		// Rocketfy puede enviar el nombre completo en un solo campo
+		if nombre, apellido, ok := strings.Cut(cliente.Nombre, " "); ok {
+			cliente.Nombre, cliente.Apellido = nombre, strings.TrimSpace(apellido)
+		}
+	}
+	if email := textoRocketfy(datos, "email"); email != "" {
+		if direccion, err := mail.ParseAddress(email); err == nil {
+			cliente.Email = direccion.Address
+		}
+	}
+	if telefono, err := normalizarTelefono(textoRocketfy(datos, "phone", "telefono")); err == nil {
+		cliente.Telefono = telefono
+	}
+	return cliente
+}
+
+// Descargar los clientes desde el último cursor y vincularlos con los
+// locales. Con desdeInicio se ignora el cursor y se revisan todos.
+func sincronizarClientesRocketfy(db *sql.DB, desdeInicio bool) (ResumenRocketfy, error) {
+	return recorrerPaginasRocketfy(db, recursoClientesRocketfy, "/customers", desdeInicio, guardarClientesRocketfy)
+}
+
+// Guardar una página de clientes; los que no tienen identificador ni forma
+// de contacto se omiten
+func guardarClientesRocketfy(tx *sql.Tx, clientes []map[string]interface{}, resumen *ResumenRocketfy) error {
+	for _, datos := range clientes {
+		cliente := leerClienteRocketfy(datos)
+		if cliente.ID == "" {
+			resumen.Omitidos = append(resumen.Omitidos, "cliente sin identificador")
+			continue
+		}
+		if cliente.Email == "" && cliente.Telefono == "" {
+			resumen.Omitidos = append(resumen.Omitidos, fmt.Sprintf("%s: cliente sin email ni teléfono válidos", cliente.ID))
+			continue
+		}
+
+		vinculo, err := vincularClienteRocketfy(tx, cliente)
+		if err != nil {
+			return fmt.Errorf("Cliente %s: %v", cliente.ID, err)
+		}
+		if vinculo.Nuevo {
+			resumen.Nuevos++
+		} else if vinculo.Actualizado {
+			resumen.Actualizados++
+		}
+		resumen.Fusionados += vinculo.Fusionados
+	}
+	return nil
+}
+
+// Cliente local vinculado a un cliente de Rocketfy; sql.ErrNoRows si no hay
+// vínculo
+func buscarClientePorRocketfy(db consultorFila, rocketfyID string) (int, error) {
+	var clienteID int
+	err := db.QueryRow(`
+		SELECT coalesce(c.fusionado_con, c.cliente_id)
+		FROM ClientesRocketfy r
+		JOIN Clientes c ON c.cliente_id = r.cliente_id
+		WHERE r.rocketfy_id = $1`, rocketfyID).Scan(&clienteID)
+	return clienteID, err
+}
+
+// Encontrar (o crear) el cliente local de un cliente de Rocketfy, fusionar
+// los duplicados que aparezcan por el email o el teléfono, completar los
+// datos de contacto que falten y guardar el vínculo
+func vincularClienteRocketfy(tx *sql.Tx, cliente ClienteRocketfy) (vinculoRocketfy, error) {
+	var vinculo vinculoRocketfy
+	var candidatos []int
+	vinculado, err := buscarClientePorRocketfy(tx, cliente.ID)
+	if err != nil && err != sql.ErrNoRows {
+		return vinculo, err
+	}
+	if err == nil {
+		candidatos = append(candidatos, vinculado)
+	}
+	if cliente.Email != "" {
+		id, err := buscarClientePorEmail(tx, cliente.Email)
+		if err != nil && err != sql.ErrNoRows {
+			return vinculo, err
+		}
+		if err == nil {
+			candidatos = append(candidatos, id)
+		}
+	}
+	if cliente.Telefono != "" {
+		id, err := buscarClientePorTelefono(tx, cliente.Telefono)
+		if err != nil && err != sql.ErrNoRows {
+			return vinculo, err
+		}
+		if err == nil {
+			candidatos = append(candidatos, id)
+		}
+	}
+
+	if len(candidatos) == 0 {
+		vinculo.ClienteID, err = insertarCliente(tx, cliente.Nombre, cliente.Apellido, cliente.Email, cliente.Telefono)
+		if err != nil {
+			return vinculo, err
+		}
+		vinculo.Nuevo = true
+		return vinculo, guardarVinculoRocketfy(tx, cliente.ID, vinculo.ClienteID)
+	}
+
+	// Se conserva el primer candidato: el vinculado, el del email o el del
+	// teléfono, en ese orden
+	vinculo.ClienteID = candidatos[0]
+	vistos := map[int]bool{vinculo.ClienteID: true}
+	var duplicados []int
+	for _, id := range candidatos[1:] {
+		if !vistos[id] {
+			vistos[id] = true
+			duplicados = append(duplicados, id)
+		}
+	}
+	if len(duplicados) > 0 {
+		sort.Ints(duplicados)
+		if _, err := fusionarClientesTx(tx, vinculo.ClienteID, duplicados, motivoFusionRocketfy, ""); err != nil {
+			return vinculo, err
+		}
+		vinculo.Fusionados = len(duplicados)
+		vinculo.Actualizado = true
+	}
+
+	completado, err := completarContactoCliente(tx, vinculo.ClienteID, cliente.Email, cliente.Telefono)
+	if err != nil {
+		return vinculo, err
+	}
+	if completado || vinculado != vinculo.ClienteID {
+		vinculo.Actualizado = true
+	}
+	return vinculo, guardarVinculoRocketfy(tx, cliente.ID, vinculo.ClienteID)
+}
+
+// Guardar el email y el teléfono de un cliente solo si no los tiene; los
+// datos locales mandan sobre Rocketfy
+func completarContactoCliente(tx *sql.Tx, clienteID int, email, telefono string) (bool, error) {
+	var sinEmail, sinTelefono bool
+	err := tx.QueryRow(`
+		SELECT email IS NULL AND email_cifrado IS NULL, telefono IS NULL AND telefono_cifrado IS NULL
+		FROM Clientes
+		WHERE cliente_id = $1
+		FOR UPDATE`, clienteID).Scan(&sinEmail, &sinTelefono)
+	if err != nil {
+		return false, err
+	}
+
+	completado := false
+	if sinEmail && email != "" {
+		plano, cifrado, hash, err := columnasEmail(email)
+		if err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(`UPDATE Clientes SET email = $2, email_cifrado = $3, email_hash = $4 WHERE cliente_id = $1`,
+			clienteID, plano, cifrado, hash)
+		if err != nil {
+			return false, err
+		}
+		completado = true
+	}
+	if sinTelefono && telefono != "" {
+		plano, cifrado, hash, err := columnasTelefono(telefono)
+		if err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(`UPDATE Clientes SET telefono = $2, telefono_cifrado = $3, telefono_hash = $4 WHERE cliente_id = $1`,
+			clienteID, plano, cifrado, hash)
+		if err != nil {
+			return false, err
+		}
+		completado = true
+	}
+	return completado, nil
+}
+
+func guardarVinculoRocketfy(tx *sql.Tx, rocketfyID string, clienteID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO ClientesRocketfy (rocketfy_id, cliente_id) VALUES ($1, $2)
+		ON CONFLICT (rocketfy_id) DO UPDATE SET cliente_id = EXCLUDED.cliente_id, sincronizado_en = now()`,
+		rocketfyID, clienteID)
+	return err
+}
+
+// Sincronizar los clientes cada rocketfy.intervalo_clientes_minutos
+func despacharClientesRocketfy() {
+	var ultima time.Time
+	for range time.Tick(time.Minute) {
+		intervalo := time.Duration(configActual().API.IntervaloClientesMinutos) * time.Minute
+		if intervalo <= 0 || time.Since(ultima) < intervalo || escriturasBloqueadas() {
+			continue
+		}
+		ultima = time.Now()
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Clientes de Rocketfy: error al conectar a la base de datos:", err)
+			continue
+		}
+		resumen, err := sincronizarClientesRocketfy(db, false)
+		if err != nil {
+			log.Println("Error al sincronizar clientes:", err)
+			avisar(AvisoSincronizacionFallida, fmt.Sprintf("Falló la sincronización de clientes con Rocketfy: %v", err))
+			continue
+		}
+		if resumen.Nuevos > 0 || resumen.Actualizados > 0 || resumen.Fusionados > 0 || len(resumen.Omitidos) > 0 {
+			logInfo("Clientes de Rocketfy: %d nuevos, %d vinculados o completados, %d fusionados, %d omitidos",
+				resumen.Nuevos, resumen.Actualizados, resumen.Fusionados, len(resumen.Omitidos))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Codificación Code 128 (juego B) para las etiquetas con código de barras.
+// Cada patrón indica los anchos, en módulos, de barras y espacios
+// alternados empezando por una barra.
+var patronesCode128 = [...]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	inicioCode128B = 104
+	finCode128     = 106
+	// Zona en blanco a cada lado exigida por los lectores, en módulos
+	margenCode128 = 10
+)
+
+// Secuencia de módulos (true = barra) del texto codificado en Code 128 B
+func modulosCode128(texto string) ([]bool, error) {
+	valores := []int{inicioCode128B}
+	suma := inicioCode128B
+	for i, letra := range texto {
+		if letra < 32 || letra > 127 {
+			return nil, fmt.Errorf("carácter no representable en Code 128: %q", letra)
+		}
+		valor := int(letra) - 32
+		valores = append(valores, valor)
+		suma += (i + 1) * valor
+	}
+	valores = append(valores, suma%103, finCode128)
+
+	var modulos []bool
+	for _, valor := range valores {
+		barra := true
+		for _, ancho := range patronesCode128[valor] {
+			for j := 0; j < int(ancho-'0'); j++ {
+				modulos = append(modulos, barra)
+			}
+			barra = !barra
+		}
+	}
+	return modulos, nil
+}
+
+// Dibujar el código de barras con el texto legible debajo
+func imagenCode128(texto string, anchoModulo, altoBarras int) (*image.RGBA, error) {
+	modulos, err := modulosCode128(texto)
+	if err != nil {
+		return nil, err
+	}
+
+	escalaTexto := anchoModulo
+	altoTexto := (altoGlifo + 4) * escalaTexto
+	ancho := (len(modulos) + 2*margenCode128) * anchoModulo
+	alto := altoBarras + altoTexto + 2*anchoModulo
+
+	img := image.NewRGBA(image.Rect(0, 0, ancho, alto))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for i, barra := range modulos {
+		if !barra {
+			continue
+		}
+		x := (margenCode128 + i) * anchoModulo
+		draw.Draw(img, image.Rect(x, anchoModulo, x+anchoModulo, anchoModulo+altoBarras), image.Black, image.Point{}, draw.Src)
+	}
+
+	x := (ancho - anchoTexto(texto, escalaTexto)) / 2
+	dibujarTexto(img, x, anchoModulo+altoBarras+2*escalaTexto, texto, escalaTexto, color.Black)
+	return img, nil
+}
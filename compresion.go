@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compresión gzip de respuestas negociada con Accept-Encoding. Las
+// respuestas pequeñas, los tipos ya comprimidos y los streams SSE se envían
+// sin comprimir. Brotli no está disponible en la biblioteca estándar.
+
+const tamanoMinimoCompresionPorDefecto = 1024
+
+// Prefijos de Content-Type que no vale la pena comprimir
+var tiposSinCompresion = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/pdf", "application/octet-stream",
+	"text/event-stream",
+}
+
+var poolGzip = sync.Pool{
+	New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return gz
+	},
+}
+
+// Middleware de compresión
+func comprimirRespuestas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || !aceptaGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		minimo := configActual().Compresion.TamanoMinimo
+		if minimo <= 0 {
+			minimo = tamanoMinimoCompresionPorDefecto
+		}
+
+		respuesta := &respuestaComprimida{ResponseWriter: w, estado: http.StatusOK, minimo: minimo}
+		defer respuesta.cerrar()
+		next.ServeHTTP(respuesta, r)
+	})
+}
+
+// Verificar si el cliente acepta gzip (con q > 0)
+func aceptaGzip(acceptEncoding string) bool {
+	for _, parte := range strings.Split(acceptEncoding, ",") {
+		campos := strings.Split(strings.TrimSpace(parte), ";")
+		codificacion := strings.ToLower(strings.TrimSpace(campos[0]))
+		if codificacion != "gzip" && codificacion != "*" {
+			continue
+		}
+		q := 1.0
+		for _, parametro := range campos[1:] {
+			parametro = strings.TrimSpace(parametro)
+			if strings.HasPrefix(parametro, "q=") {
+				q, _ = strconv.ParseFloat(strings.TrimPrefix(parametro, "q="), 64)
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// ResponseWriter que acumula los primeros bytes para decidir si comprimir
+type respuestaComprimida struct {
+	http.ResponseWriter
+	estado   int
+	minimo   int
+	buffer   []byte
+	decidido bool
+	gz       *gzip.Writer
+}
+
+func (w *respuestaComprimida) WriteHeader(estado int) {
+	if w.decidido {
+		return
+	}
+	w.estado = estado
+	// Respuestas sin cuerpo
+	if estado < 200 || estado == http.StatusNoContent || estado == http.StatusNotModified {
+		w.decidir(false)
+	}
+}
+
+func (w *respuestaComprimida) Write(b []byte) (int, error) {
+	if w.decidido {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buffer = append(w.buffer, b...)
+	if len(w.buffer) >= w.minimo {
+		if err := w.decidir(w.comprimible()); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// El stream SSE fuerza la decisión en el primer Flush
+func (w *respuestaComprimida) Flush() {
+	if !w.decidido {
+		w.decidir(len(w.buffer) >= w.minimo && w.comprimible())
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *respuestaComprimida) comprimible() bool {
+	encabezados := w.ResponseWriter.Header()
+	if encabezados.Get("Content-Encoding") != "" {
+		return false
+	}
+	tipo := encabezados.Get("Content-Type")
+	if tipo == "" {
+		tipo = http.DetectContentType(w.buffer)
+	}
+	for _, prefijo := range tiposSinCompresion {
+		if strings.HasPrefix(tipo, prefijo) {
+			return false
+		}
+	}
+	return true
+}
+
+// Enviar los encabezados y el contenido acumulado, comprimido o no
+func (w *respuestaComprimida) decidir(comprimir bool) error {
+	w.decidido = true
+	encabezados := w.ResponseWriter.Header()
+
+	if comprimir {
+		if encabezados.Get("Content-Type") == "" {
+			encabezados.Set("Content-Type", http.DetectContentType(w.buffer))
+		}
+		encabezados.Set("Content-Encoding", "gzip")
+		encabezados.Del("Content-Length")
+		w.gz = poolGzip.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.estado)
+
+	buffer := w.buffer
+	w.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buffer)
+	} else {
+		_, err = w.ResponseWriter.Write(buffer)
+	}
+	return err
+}
+
+// Completar la respuesta al terminar el handler
+func (w *respuestaComprimida) cerrar() {
+	if !w.decidido {
+		w.decidir(len(w.buffer) >= w.minimo && w.comprimible())
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		poolGzip.Put(w.gz)
+		w.gz = nil
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Tolerancia a la conmutación de PostgreSQL (failover):
+//   - db.host acepta varios hosts separados por coma ("db1,db2:5433"), como
+//     libpq; se usa el primero que acepte escrituras.
+//   - Las conexiones que reciben un error de conexión o de solo lectura se
+//     descartan del pool en lugar de reutilizarse.
+//   - Las operaciones del servicio se reintentan con espera exponencial ante
+//     errores transitorios.
+//   - Una goroutine revisa la base cada intervaloSaludDB y, si no responde,
+//     cierra las conexiones inactivas para que las siguientes se abran
+//     contra el host que esté disponible.
+
+const (
+	intentosDB             = 4
+	esperaInicialReintento = 100 * time.Millisecond
+	intervaloSaludDB       = 15 * time.Second
+	timeoutSaludDB         = 5 * time.Second
+	// Conexiones inactivas del pool (el valor por defecto de database/sql)
+	conexionesInactivasDB = 2
+)
+
+var (
+	// Índice del último host que aceptó la conexión por lista de hosts, para
+	// no volver a intentar primero uno caído
+	muHostsDB     sync.Mutex
+	ultimoHostsDB = map[string]int{}
+)
+
+// Error que puede desaparecer al reintentar: la conexión se cayó, el
+// servidor se está reiniciando o cambió de rol, o la transacción chocó con
+// otra
+func errorTransitorioDB(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var errRed *net.OpError
+	if errors.As(err, &errRed) {
+		return true
+	}
+	var errPQ *pq.Error
+	if errors.As(err, &errPQ) {
+		switch errPQ.Code {
+		case "40001", "40P01":
+			return true
+		}
+		return errorConexionRota(errPQ)
+	}
+	return false
+}
+
+// Error tras el cual la conexión no debe volver al pool: excepción de
+// conexión, servidor apagándose o una base que pasó a ser de solo lectura
+func errorConexionRota(err error) bool {
+	var errPQ *pq.Error
+	if !errors.As(err, &errPQ) {
+		return false
+	}
+	if errPQ.Code.Class() == "08" {
+		return true
+	}
+	switch errPQ.Code {
+	case "57P01", "57P02", "57P03", "25006":
+		return true
+	}
+	return false
+}
+
+// Ejecutar una operación reintentándola con espera exponencial (y algo de
+// azar) mientras falle por un error transitorio
+func reintentarDB(ctx context.Context, operacion func() error) error {
+	espera := esperaInicialReintento
+	for intento := 1; ; intento++ {
+		err := operacion()
+		if intento == intentosDB || !errorTransitorioDB(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(espera + time.Duration(rand.Int63n(int64(espera/2)))):
+		}
+		espera *= 2
+	}
+}
+
+// Abrir una conexión con una cadena "clave=valor" cuyo host puede listar
+// varios hosts. Con target_session_attrs=read-write se saltan los que están
+// en recuperación (réplicas).
+func abrirConexionMultiHost(d driver.Driver, dsn string) (driver.Conn, error) {
+	if strings.Contains(dsn, "://") {
+		return d.Open(dsn)
+	}
+
+	var campos []string
+	var hosts []string
+	puerto := ""
+	soloEscritura := false
+	for _, campo := range strings.Fields(dsn) {
+		switch {
+		case strings.HasPrefix(campo, "host="):
+			hosts = strings.Split(strings.TrimPrefix(campo, "host="), ",")
+		case strings.HasPrefix(campo, "port="):
+			puerto = strings.TrimPrefix(campo, "port=")
+		case strings.HasPrefix(campo, "target_session_attrs="):
+			// pq no conoce el parámetro y lo enviaría al servidor
+			soloEscritura = strings.TrimPrefix(campo, "target_session_attrs=") == "read-write"
+		default:
+			campos = append(campos, campo)
+		}
+	}
+	if len(hosts) <= 1 && !soloEscritura {
+		return d.Open(dsn)
+	}
+
+	clave := strings.Join(hosts, ",")
+	muHostsDB.Lock()
+	inicio := ultimoHostsDB[clave]
+	muHostsDB.Unlock()
+
+	var fallos []string
+	var ultimoErr error
+	for i := range hosts {
+		indice := (inicio + i) % len(hosts)
+		host, puertoHost := hosts[indice], puerto
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, puertoHost = h, p
+		}
+		cadena := strings.Join(append(campos, "host="+host), " ")
+		if puertoHost != "" {
+			cadena += " port=" + puertoHost
+		}
+
+		conn, err := d.Open(cadena)
+		if err == nil && soloEscritura {
+			err = comprobarEscritura(conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			fallos = append(fallos, fmt.Sprintf("%s: %v", hosts[indice], err))
+			ultimoErr = err
+			continue
+		}
+
+		muHostsDB.Lock()
+		ultimoHostsDB[clave] = indice
+		muHostsDB.Unlock()
+		return conn, nil
+	}
+	return nil, fmt.Errorf("Error al conectar a la base de datos (%s): %w", strings.Join(fallos, "; "), ultimoErr)
+}
+
+// Fallar si el servidor de la conexión no acepta escrituras
+func comprobarEscritura(conn driver.Conn) error {
+	consultor, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return nil
+	}
+	rows, err := consultor.QueryContext(context.Background(), "SHOW transaction_read_only", nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	valores := make([]driver.Value, 1)
+	if err := rows.Next(valores); err != nil {
+		return err
+	}
+	if fmt.Sprintf("%s", valores[0]) == "on" {
+		return errors.New("el servidor es de solo lectura")
+	}
+	return nil
+}
+
+// Revisar que la base principal (y la réplica, si hay) responda. Si no,
+// se cierran las conexiones inactivas para no reutilizar conexiones al
+// servidor caído.
+func revisarSaludDB(db *sql.DB) error {
+	ctx, cancelar := context.WithTimeout(context.Background(), timeoutSaludDB)
+	defer cancelar()
+	if err := db.PingContext(ctx); err != nil {
+		db.SetMaxIdleConns(0)
+		db.SetMaxIdleConns(conexionesInactivasDB)
+		return err
+	}
+	return nil
+}
+
+// Goroutine que revisa la salud de la base de datos y registra en el log
+// cuándo se pierde y cuándo se recupera la conexión
+func vigilarBaseDatos() {
+	disponible := true
+	for range time.Tick(intervaloSaludDB) {
+		db, err := poolBaseDatos()
+		if err == nil {
+			err = revisarSaludDB(db)
+		}
+		if err != nil && disponible {
+			log.Println("Base de datos no disponible, se reintentará la conexión:", err)
+		} else if err == nil && !disponible {
+			logInfo("Conexión con la base de datos restablecida")
+		}
+		disponible = err == nil
+
+		muReplica.Lock()
+		replica := poolReplica
+		muReplica.Unlock()
+		if replica != nil {
+			if err := revisarSaludDB(replica); err != nil {
+				marcarReplicaCaida(err)
+			}
+		}
+	}
+}
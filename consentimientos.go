@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Consentimientos de comunicación y tratamiento de datos por cliente. Sin
+// registro el consentimiento se considera no otorgado: todo envío dirigido
+// a un cliente debe hacerse a través de enviarSiAutorizado.
+
+// Tipos de consentimiento
+const (
+	ConsentimientoMarketingEmail   = "marketing_email"
+	ConsentimientoWhatsApp         = "whatsapp"
+	ConsentimientoTratamientoDatos = "tratamiento_datos"
+	ConsentimientoPush             = "push"
+)
+
+var tiposConsentimiento = []string{
+	ConsentimientoMarketingEmail,
+	ConsentimientoWhatsApp,
+	ConsentimientoTratamientoDatos,
+	ConsentimientoPush,
+}
+
+// Estado vigente de un consentimiento
+type Consentimiento struct {
+	Tipo          string `json:"tipo"`
+	Otorgado      bool   `json:"otorgado"`
+	Fuente        string `json:"fuente"`
+	ActualizadoEn *Fecha `json:"actualizado_en"`
+}
+
+func tipoConsentimientoValido(tipo string) bool {
+	for _, t := range tiposConsentimiento {
+		if t == tipo {
+			return true
+		}
+	}
+	return false
+}
+
+// Consentimientos registrados de un cliente
+func consultarConsentimientos(db *sql.DB, clienteID int) ([]Consentimiento, error) {
+	rows, err := db.Query(`
+		SELECT tipo, otorgado, fuente, actualizado_en
+		FROM ConsentimientosCliente
+		WHERE cliente_id = $1
+		ORDER BY tipo`, clienteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consentimientos := []Consentimiento{}
+	for rows.Next() {
+		var c Consentimiento
+		if err := rows.Scan(&c.Tipo, &c.Otorgado, &c.Fuente, &c.ActualizadoEn); err != nil {
+			return nil, err
+		}
+		consentimientos = append(consentimientos, c)
+	}
+	return consentimientos, rows.Err()
+}
+
+// Registrar cambios de consentimiento con su fuente, guardando el historial
+func guardarConsentimientos(db *sql.DB, clienteID int, cambios map[string]bool, fuente string) error {
+	return enTransaccion(db, func(tx *sql.Tx) error {
+		return guardarConsentimientosTx(tx, clienteID, cambios, fuente)
+	})
+}
+
+// Registrar cambios de consentimiento dentro de una transacción existente
+func guardarConsentimientosTx(tx *sql.Tx, clienteID int, cambios map[string]bool, fuente string) error {
+	var existe int
+	err := tx.QueryRow(`SELECT 1 FROM Clientes WHERE cliente_id = $1 AND anonimizado_en IS NULL`, clienteID).
+		Scan(&existe)
+	if err == sql.ErrNoRows {
+		return errClienteInexistente
+	}
+	if err != nil {
+		return err
+	}
+
+	for tipo, otorgado := range cambios {
+		_, err = tx.Exec(`
+			INSERT INTO ConsentimientosCliente (cliente_id, tipo, otorgado, fuente, actualizado_en)
+			VALUES ($1, $2, $3, $4, now())
+			ON CONFLICT (cliente_id, tipo) DO UPDATE
+			SET otorgado = EXCLUDED.otorgado, fuente = EXCLUDED.fuente, actualizado_en = now()`,
+			clienteID, tipo, otorgado, fuente)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO HistorialConsentimientos (cliente_id, tipo, otorgado, fuente)
+			VALUES ($1, $2, $3, $4)`, clienteID, tipo, otorgado, fuente)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verificar si un cliente autorizó un tipo de comunicación. Los clientes sin
+// registro, anonimizados o eliminados no se contactan.
+func consentimientoOtorgado(db consultorFila, clienteID int, tipo string) (bool, error) {
+	var otorgado bool
+	err := db.QueryRow(`
+		SELECT cc.otorgado
+		FROM ConsentimientosCliente cc
+		JOIN Clientes c ON c.cliente_id = cc.cliente_id
+		WHERE cc.cliente_id = $1 AND cc.tipo = $2 AND c.anonimizado_en IS NULL AND c.eliminado_en IS NULL`, clienteID, tipo).Scan(&otorgado)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return otorgado, err
+}
+
+// Ejecutar un envío a un cliente solo si autorizó ese tipo de comunicación.
+// Devuelve false si el envío se omitió por falta de consentimiento.
+func enviarSiAutorizado(db consultorFila, clienteID int, tipo string, enviar func() error) (bool, error) {
+	otorgado, err := consentimientoOtorgado(db, clienteID, tipo)
+	if err != nil || !otorgado {
+		return false, err
+	}
+	return true, enviar()
+}
+
+// Handler para /admin/clientes/{id}/consentimientos: GET devuelve el estado
+// vigente y PUT registra cambios, p. ej.
+// {"consentimientos": {"whatsapp": false}, "fuente": "llamada"}
+func consentimientosHandler(w http.ResponseWriter, r *http.Request, clienteID int) {
+	switch r.Method {
+	case "GET":
+		consentimientos, err := obtenerConsentimientos(r.Context(), clienteID)
+		if err != nil {
+			responderErrorCliente(w, r, err, "Error al consultar los consentimientos")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(consentimientos)
+
+	case "PUT":
+		var solicitud struct {
+			Consentimientos map[string]bool `json:"consentimientos"`
+			Fuente          string          `json:"fuente"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&solicitud)
+		if err != nil || len(solicitud.Consentimientos) == 0 {
+			http.Error(w, "consentimientos requeridos", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(solicitud.Fuente) == "" {
+			http.Error(w, "fuente requerida", http.StatusBadRequest)
+			return
+		}
+		for tipo := range solicitud.Consentimientos {
+			if !tipoConsentimientoValido(tipo) {
+				http.Error(w, fmt.Sprintf("Tipo de consentimiento desconocido: %s", tipo), http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = actualizarConsentimientos(clienteID, solicitud.Consentimientos, strings.TrimSpace(solicitud.Fuente))
+		if err != nil {
+			responderErrorCliente(w, r, err, "Error al guardar los consentimientos")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
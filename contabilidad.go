@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Exportación contable por período en formato de libro diario: cada
+// operación genera asientos de partida doble con las cuentas del PUC
+// colombiano. Solo se incluyen las compras con el pago confirmado.
+
+// Cuentas del PUC usadas en los asientos
+const (
+	cuentaCaja               = "110505"
+	cuentaIngresosVentas     = "413595"
+	cuentaIVAGenerado        = "240801"
+	cuentaDevolucionesVentas = "417505"
+)
+
+// Estado de pago de las compras que se contabilizan
+const estadoPagoConfirmado = "pagado"
+
+const formatoPeriodoContable = "2006-01"
+
+var nombresCuentas = map[string]string{
+	cuentaCaja:               "Caja general",
+	cuentaIngresosVentas:     "Ventas de otros productos",
+	cuentaIVAGenerado:        "IVA generado",
+	cuentaDevolucionesVentas: "Devoluciones en ventas",
+}
+
+var encabezadoLibroContable = []string{
+	"fecha", "comprobante", "compra_id", "cuenta", "nombre_cuenta", "descripcion", "debito", "credito",
+}
+
+// Línea del libro diario; los montos en centavos
+type asientoContable struct {
+	Fecha       time.Time
+	Comprobante string
+	CompraID    int
+	Cuenta      string
+	Descripcion string
+	Debito      int64
+	Credito     int64
+}
+
+func (a asientoContable) registro() []string {
+	return []string{
+		a.Fecha.In(zonaHoraria).Format("2006-01-02"),
+		a.Comprobante,
+		strconv.Itoa(a.CompraID),
+		a.Cuenta,
+		nombresCuentas[a.Cuenta],
+		a.Descripcion,
+		formatoMonto(a.Debito),
+		formatoMonto(a.Credito),
+	}
+}
+
+// Origen de asientos del período; cada fuente escribe los suyos en orden
+type fuenteAsientos func(tx *sql.Tx, desde, hasta time.Time, emitir func(asientoContable) error) error
+
+var fuentesContables = []fuenteAsientos{asientosVentas, asientosDevoluciones}
+
+// Escribir el libro del período [desde, hasta) como CSV. Antes se liquida
+// el IVA de las compras pagadas del período que aún no lo tienen.
+func escribirLibroContable(db *sql.DB, desde, hasta time.Time, w io.Writer) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = liquidarImpuestosPeriodo(tx, desde, hasta)
+	if err != nil {
+		return err
+	}
+
+	escritor := csv.NewWriter(w)
+	err = escritor.Write(encabezadoLibroContable)
+	if err != nil {
+		return err
+	}
+	emitir := func(asiento asientoContable) error {
+		return escritor.Write(asiento.registro())
+	}
+	for _, fuente := range fuentesContables {
+		if err := fuente(tx, desde, hasta, emitir); err != nil {
+			return err
+		}
+	}
+	escritor.Flush()
+	if err := escritor.Error(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Compras pagadas del período con líneas con precio sin IVA liquidado
+func liquidarImpuestosPeriodo(tx *sql.Tx, desde, hasta time.Time) error {
+	rows, err := tx.Query(`
+		SELECT DISTINCT com.compra_id
+		FROM Compras com
+		JOIN DetallesCompra dc ON dc.compra_id = com.compra_id
+		WHERE com.estado_pago IN ($1, $4) AND com.fecha_compra >= $2 AND com.fecha_compra < $3
+			AND dc.precio_unitario IS NOT NULL AND dc.tarifa_iva IS NULL`, estadoPagoConfirmado, desde, hasta, estadoPagoReembolsado)
+	if err != nil {
+		return err
+	}
+	var compras []int
+	for rows.Next() {
+		var compraID int
+		if err := rows.Scan(&compraID); err != nil {
+			rows.Close()
+			return err
+		}
+		compras = append(compras, compraID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, compraID := range compras {
+		if _, err := calcularImpuestosCompra(tx, compraID); err != nil {
+			return fmt.Errorf("Error al liquidar el IVA de la compra %d: %v", compraID, err)
+		}
+	}
+	return nil
+}
+
+// Ventas: débito a caja por el total, crédito a ingresos por la base y a
+// IVA generado por el impuesto de cada tarifa. Las compras reembolsadas
+// también cuentan: la venta se reversa en asientosDevoluciones en el
+// período del reembolso.
+func asientosVentas(tx *sql.Tx, desde, hasta time.Time, emitir func(asientoContable) error) error {
+	rows, err := tx.Query(`
+		SELECT com.compra_id, com.fecha_compra, coalesce(f.prefijo || f.numero, ''),
+			i.tarifa::text, (i.base * 100)::bigint, (i.valor * 100)::bigint
+		FROM Compras com
+		JOIN ImpuestosCompra i ON i.compra_id = com.compra_id
+		LEFT JOIN Facturas f ON f.compra_id = com.compra_id
+		WHERE com.estado_pago IN ($1, $4) AND com.fecha_compra >= $2 AND com.fecha_compra < $3
+		ORDER BY com.fecha_compra, com.compra_id, i.tarifa DESC`, estadoPagoConfirmado, desde, hasta, estadoPagoReembolsado)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var asiento asientoContable
+		var fecha Fecha
+		var tarifa string
+		var base, iva int64
+		if err := rows.Scan(&asiento.CompraID, &fecha, &asiento.Comprobante, &tarifa, &base, &iva); err != nil {
+			return err
+		}
+		asiento.Fecha = fecha.Time
+		if asiento.Comprobante == "" {
+			asiento.Comprobante = fmt.Sprintf("C-%d", asiento.CompraID)
+		}
+
+		lineas := []asientoContable{
+			{Cuenta: cuentaCaja, Descripcion: "Venta IVA " + tarifa + " %", Debito: base + iva},
+			{Cuenta: cuentaIngresosVentas, Descripcion: "Venta IVA " + tarifa + " %", Credito: base},
+		}
+		if iva > 0 {
+			lineas = append(lineas, asientoContable{Cuenta: cuentaIVAGenerado, Descripcion: "IVA " + tarifa + " %", Credito: iva})
+		}
+		for _, linea := range lineas {
+			linea.Fecha, linea.Comprobante, linea.CompraID = asiento.Fecha, asiento.Comprobante, asiento.CompraID
+			if err := emitir(linea); err != nil {
+				return err
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// Handler para GET /admin/contabilidad/export?period=2024-05
+func exportarContabilidadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	periodo := r.URL.Query().Get("period")
+	desde, err := time.ParseInLocation(formatoPeriodoContable, periodo, zonaHoraria)
+	if err != nil {
+		http.Error(w, "period debe tener el formato AAAA-MM", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=contabilidad-%s.csv", periodo))
+
+	// El CSV se escribe a medida que se lee; si falla cuando ya se envió
+	// parte del contenido no se puede cambiar el código de estado
+	salida := &salidaIniciada{Writer: w}
+	err = exportarContabilidad(desde, desde.AddDate(0, 1, 0), salida)
+	if err != nil {
+		if !salida.iniciada {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "Error al exportar la contabilidad", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+	}
+}
+
+// Writer que recuerda si ya se escribió algo en la respuesta
+type salidaIniciada struct {
+	io.Writer
+	iniciada bool
+}
+
+func (s *salidaIniciada) Write(b []byte) (int, error) {
+	s.iniciada = true
+	return s.Writer.Write(b)
+}
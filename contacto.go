@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Formulario de contacto propio (POST /contacto) en lugar del de terceros.
+// Contra el spam se usa un campo trampa oculto (sitio_web) y el captcha de
+// exigirCaptcha (captcha.go). Los mensajes se guardan y se avisan al equipo
+// por email y Slack.
+
+const (
+	timeoutSlack = 10 * time.Second
+
+	longitudMaximaNombreContacto  = 100
+	longitudMaximaAsuntoContacto  = 150
+	longitudMinimaMensajeContacto = 10
+	longitudMaximaMensajeContacto = 5000
+)
+
+// Mensaje recibido por el formulario
+type MensajeContacto struct {
+	ID       int    `json:"id"`
+	Nombre   string `json:"nombre"`
+	Email    string `json:"email"`
+	Telefono string `json:"telefono,omitempty"`
+	Asunto   string `json:"asunto,omitempty"`
+	Mensaje  string `json:"mensaje"`
+	CreadoEn *Fecha `json:"creado_en,omitempty"`
+	ip       string
+	agente   string
+}
+
+// Validar y limpiar los campos del formulario; devuelve el primer problema
+func validarMensajeContacto(m *MensajeContacto) string {
+	m.Nombre = strings.TrimSpace(m.Nombre)
+	m.Email = strings.TrimSpace(m.Email)
+	m.Telefono = strings.TrimSpace(m.Telefono)
+	m.Asunto = strings.TrimSpace(m.Asunto)
+	m.Mensaje = strings.TrimSpace(m.Mensaje)
+
+	if m.Nombre == "" || utf8.RuneCountInString(m.Nombre) > longitudMaximaNombreContacto {
+		return fmt.Sprintf("nombre requerido (máximo %d caracteres)", longitudMaximaNombreContacto)
+	}
+	if direccion, err := mail.ParseAddress(m.Email); err != nil || direccion.Address != m.Email {
+		return "email inválido"
+	}
+	if m.Telefono != "" {
+		telefono, err := normalizarTelefono(m.Telefono)
+		if err != nil {
+			return "telefono inválido"
+		}
+		m.Telefono = telefono
+	}
+	if utf8.RuneCountInString(m.Asunto) > longitudMaximaAsuntoContacto {
+		return fmt.Sprintf("asunto demasiado largo (máximo %d caracteres)", longitudMaximaAsuntoContacto)
+	}
+	if n := utf8.RuneCountInString(m.Mensaje); n < longitudMinimaMensajeContacto || n > longitudMaximaMensajeContacto {
+		return fmt.Sprintf("mensaje debe tener entre %d y %d caracteres", longitudMinimaMensajeContacto, longitudMaximaMensajeContacto)
+	}
+	return ""
+}
+
+func insertarMensajeContacto(db *sql.DB, m *MensajeContacto) error {
+	return db.QueryRow(`
+		INSERT INTO MensajesContacto (nombre, email, telefono, asunto, mensaje, ip, user_agent)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, NULLIF($6, ''), NULLIF($7, ''))
+		RETURNING mensaje_id, creado_en`,
+		m.Nombre, m.Email, m.Telefono, m.Asunto, m.Mensaje, m.ip, m.agente).Scan(&m.ID, &m.CreadoEn)
+}
+
+// Mensajes más recientes primero
+func consultarMensajesContacto(db *sql.DB, limite int) ([]MensajeContacto, error) {
+	rows, err := db.Query(`
+		SELECT mensaje_id, nombre, email, coalesce(telefono, ''), coalesce(asunto, ''), mensaje, creado_en
+		FROM MensajesContacto
+		ORDER BY creado_en DESC, mensaje_id DESC
+		LIMIT $1`, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mensajes := []MensajeContacto{}
+	for rows.Next() {
+		var m MensajeContacto
+		if err := rows.Scan(&m.ID, &m.Nombre, &m.Email, &m.Telefono, &m.Asunto, &m.Mensaje, &m.CreadoEn); err != nil {
+			return nil, err
+		}
+		mensajes = append(mensajes, m)
+	}
+	return mensajes, rows.Err()
+}
+
+// Publicar un texto en el canal de Slack del webhook entrante
+func enviarSlack(webhook, texto string) error {
+	body, err := json.Marshal(map[string]string{"text": texto})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeoutSlack}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Slack respondió con código de estado: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Avisar al equipo de un mensaje nuevo por email y Slack
+func notificarMensajeContacto(m *MensajeContacto) error {
+	ajustes := configActual().Contacto
+	asunto := "Nuevo mensaje de contacto"
+	if m.Asunto != "" {
+		asunto += ": " + m.Asunto
+	}
+	cuerpo := fmt.Sprintf("De: %s <%s>\n", m.Nombre, m.Email)
+	if m.Telefono != "" {
+		cuerpo += "Teléfono: " + m.Telefono + "\n"
+	}
+	cuerpo += "\n" + m.Mensaje + "\n"
+
+	var errores []string
+	for _, destino := range ajustes.Destinatarios {
+		if err := enviarEmail(destino, asunto, cuerpo); err != nil {
+			errores = append(errores, fmt.Sprintf("email a %s: %v", destino, err))
+		}
+	}
+	if ajustes.SlackWebhook != "" {
+		if err := enviarSlack(ajustes.SlackWebhook, "*"+asunto+"*\n"+cuerpo); err != nil {
+			errores = append(errores, fmt.Sprintf("Slack: %v", err))
+		}
+	}
+	if len(errores) > 0 {
+		return errors.New(strings.Join(errores, "; "))
+	}
+	return nil
+}
+
+// Handler para POST /contacto. Acepta JSON o un formulario HTML; el captcha
+// ya lo verificó exigirCaptcha.
+func contactoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+encabezadoCaptcha)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		MensajeContacto
+		// Campo oculto que solo llenan los bots
+		SitioWeb string `json:"sitio_web"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Cuerpo inválido", http.StatusBadRequest)
+			return
+		}
+		solicitud.Nombre = r.PostForm.Get("nombre")
+		solicitud.Email = r.PostForm.Get("email")
+		solicitud.Telefono = r.PostForm.Get("telefono")
+		solicitud.Asunto = r.PostForm.Get("asunto")
+		solicitud.Mensaje = r.PostForm.Get("mensaje")
+		solicitud.SitioWeb = r.PostForm.Get("sitio_web")
+	}
+
+	// Al bot se le responde como si el mensaje se hubiera recibido
+	if solicitud.SitioWeb != "" {
+		logSolicitud(r.Context(), "Contacto: mensaje descartado por el campo trampa")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	mensaje := solicitud.MensajeContacto
+	if problema := validarMensajeContacto(&mensaje); problema != "" {
+		http.Error(w, problema, http.StatusBadRequest)
+		return
+	}
+	mensaje.ip = textoIPSolicitud(r)
+	mensaje.agente = r.UserAgent()
+
+	if err := registrarMensajeContacto(r.Context(), &mensaje); err != nil {
+		http.Error(w, "Error al guardar el mensaje", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	// El mensaje ya quedó guardado aunque falle el aviso
+	go func() {
+		if err := notificarMensajeContacto(&mensaje); err != nil {
+			logSolicitud(r.Context(), "Error al avisar el mensaje de contacto:", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Handler para GET /admin/contacto: los últimos mensajes recibidos
+func mensajesContactoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mensajes, err := obtenerMensajesContacto(r.Context())
+	if err != nil {
+		http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mensajes)
+}
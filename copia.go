@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Carga masiva con COPY para las importaciones: las filas se copian a una
+// tabla temporal de la transacción y desde ahí se insertan en la tabla
+// definitiva con un único INSERT ... SELECT, en lugar de un INSERT por fila.
+
+// Crear la tabla temporal con las columnas de la tabla de destino (se borra
+// al terminar la transacción) y copiar las filas en ella
+func copiarTemporal(tx *sql.Tx, temporal, destino string, columnas []string, filas [][]interface{}) error {
+	_, err := tx.Exec(fmt.Sprintf(
+		`CREATE TEMPORARY TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA`,
+		pq.QuoteIdentifier(temporal), columnasSQL(columnas), destino))
+	if err != nil {
+		return fmt.Errorf("Error al crear la tabla temporal %s: %v", temporal, err)
+	}
+
+	sentencia, err := tx.Prepare(pq.CopyIn(temporal, columnas...))
+	if err != nil {
+		return fmt.Errorf("Error al iniciar la copia a %s: %v", temporal, err)
+	}
+	for _, fila := range filas {
+		if _, err := sentencia.Exec(fila...); err != nil {
+			sentencia.Close()
+			return fmt.Errorf("Error al copiar a %s: %v", temporal, err)
+		}
+	}
+	// El Exec sin argumentos envía los datos pendientes y termina el COPY
+	if _, err := sentencia.Exec(); err != nil {
+		sentencia.Close()
+		return fmt.Errorf("Error al copiar a %s: %v", temporal, err)
+	}
+	return sentencia.Close()
+}
+
+func columnasSQL(columnas []string) string {
+	lista := ""
+	for i, columna := range columnas {
+		if i > 0 {
+			lista += ", "
+		}
+		lista += pq.QuoteIdentifier(columna)
+	}
+	return lista
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cotización del envío para el checkout de la tienda. Se consulta en
+// paralelo a cada transportadora configurada; las respuestas se guardan
+// por ciudad y kilos en TarifasEnvio y, si una API no responde, se usa la
+// última tarifa guardada.
+
+const rutaCotizarEnvio = "/envios/cotizar"
+
+// Origen del valor cotizado
+const (
+	FuenteCotizacionTransportadora = "transportadora"
+	FuenteCotizacionTarifa         = "tarifa_guardada"
+)
+
+const (
+	timeoutCotizacion   = 5 * time.Second
+	maxProductosCotizar = 100
+	maxGramosCotizar    = 150000
+)
+
+var errSinCotizaciones = errors.New("Ninguna transportadora pudo cotizar el envío")
+
+// Producto a enviar
+type PaqueteCotizacion struct {
+	PesoGramos int `json:"peso_gramos"`
+	Cantidad   int `json:"cantidad"`
+}
+
+// Cotización de una transportadora; el valor en pesos
+type CotizacionEnvio struct {
+	Transportadora string `json:"transportadora"`
+	Valor          string `json:"valor"`
+	DiasEntrega    *int   `json:"dias_entrega"`
+	Fuente         string `json:"fuente"`
+	ActualizadoEn  *Fecha `json:"actualizado_en,omitempty"`
+
+	centavos int64
+}
+
+// Kilos cobrados: el peso total redondeado hacia arriba, mínimo 1
+func kilosCotizacion(paquetes []PaqueteCotizacion) int {
+	gramos := 0
+	for _, p := range paquetes {
+		cantidad := p.Cantidad
+		if cantidad <= 0 {
+			cantidad = 1
+		}
+		gramos += p.PesoGramos * cantidad
+	}
+	kilos := (gramos + 999) / 1000
+	if kilos < 1 {
+		kilos = 1
+	}
+	return kilos
+}
+
+// Ciudad en mayúsculas y sin tildes, como clave de las tarifas
+func normalizarCiudad(ciudad string) string {
+	return strings.Join(strings.Fields(strings.ToUpper(reemplazoTildes.Replace(ciudad))), " ")
+}
+
+// Cotizar con POST {url}/cotizaciones {"ciudad_destino": "...", "peso_kg": 2}
+// y respuesta {"valor": 12500, "dias_entrega": 2}
+func cotizarTransportadora(ajustes ConfigTransportadora, ciudad string, kilos int) (int64, *int, error) {
+	if ajustes.URL == "" {
+		return 0, nil, errors.New("la transportadora no está configurada")
+	}
+	body, err := json.Marshal(map[string]interface{}{"ciudad_destino": ciudad, "peso_kg": kilos})
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(ajustes.URL, "/")+"/cotizaciones", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ajustes.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+ajustes.Token)
+	}
+
+	client := &http.Client{Timeout: timeoutCotizacion}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, nil, fmt.Errorf("la transportadora respondió con código de estado: %d", resp.StatusCode)
+	}
+	var respuesta struct {
+		Valor       *float64 `json:"valor"`
+		DiasEntrega *int     `json:"dias_entrega"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&respuesta); err != nil {
+		return 0, nil, fmt.Errorf("Error al leer la cotización: %v", err)
+	}
+	if respuesta.Valor == nil || *respuesta.Valor < 0 {
+		return 0, nil, errors.New("la cotización no tiene un valor válido")
+	}
+	return int64(math.Round(*respuesta.Valor * 100)), respuesta.DiasEntrega, nil
+}
+
+func guardarTarifaEnvio(db *sql.DB, transportadora, ciudad string, kilos int, centavos int64, dias *int) error {
+	_, err := db.Exec(`
+		INSERT INTO TarifasEnvio (transportadora, ciudad, kilos, valor, dias_entrega)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (transportadora, ciudad, kilos) DO UPDATE
+			SET valor = EXCLUDED.valor, dias_entrega = EXCLUDED.dias_entrega, actualizado_en = now()`,
+		transportadora, ciudad, kilos, formatoMonto(centavos), dias)
+	return err
+}
+
+// Tarifa guardada para la ciudad con el menor peso que cubra los kilos
+func consultarTarifaEnvio(db *sql.DB, transportadora, ciudad string, kilos int) (*CotizacionEnvio, error) {
+	cotizacion := CotizacionEnvio{Transportadora: transportadora, Fuente: FuenteCotizacionTarifa}
+	var dias sql.NullInt64
+	var actualizado Fecha
+	err := db.QueryRow(`
+		SELECT (valor * 100)::bigint, dias_entrega, actualizado_en
+		FROM TarifasEnvio
+		WHERE transportadora = $1 AND ciudad = $2 AND kilos >= $3
+		ORDER BY kilos
+		LIMIT 1`, transportadora, ciudad, kilos).Scan(&cotizacion.centavos, &dias, &actualizado)
+	if err != nil {
+		return nil, err
+	}
+	if dias.Valid {
+		d := int(dias.Int64)
+		cotizacion.DiasEntrega = &d
+	}
+	cotizacion.ActualizadoEn = &actualizado
+	cotizacion.Valor = formatoMonto(cotizacion.centavos)
+	return &cotizacion, nil
+}
+
+// Cotizar con todas las transportadoras configuradas; ordenadas de menor a
+// mayor valor
+func cotizarEnvio(db *sql.DB, ciudad string, paquetes []PaqueteCotizacion) ([]CotizacionEnvio, error) {
+	ciudad = normalizarCiudad(ciudad)
+	kilos := kilosCotizacion(paquetes)
+	ajustes := configActual().Envios.Transportadoras
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	cotizaciones := []CotizacionEnvio{}
+	for nombre, transportadora := range ajustes {
+		if _, ok := transportadoras[nombre]; !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(nombre string, transportadora ConfigTransportadora) {
+			defer wg.Done()
+
+			var cotizacion *CotizacionEnvio
+			centavos, dias, err := cotizarTransportadora(transportadora, ciudad, kilos)
+			if err == nil {
+				cotizacion = &CotizacionEnvio{Transportadora: nombre, Valor: formatoMonto(centavos),
+					DiasEntrega: dias, Fuente: FuenteCotizacionTransportadora, centavos: centavos}
+				if !escriturasBloqueadas() {
+					if err := guardarTarifaEnvio(db, nombre, ciudad, kilos, centavos, dias); err != nil {
+						log.Println("Error al guardar la tarifa de envío:", err)
+					}
+				}
+			} else {
+				log.Printf("Cotización de %s para %s: %v", nombre, ciudad, err)
+				cotizacion, err = consultarTarifaEnvio(db, nombre, ciudad, kilos)
+				if err != nil {
+					if err != sql.ErrNoRows {
+						log.Println("Error al consultar la tarifa de envío:", err)
+					}
+					return
+				}
+			}
+
+			mu.Lock()
+			cotizaciones = append(cotizaciones, *cotizacion)
+			mu.Unlock()
+		}(nombre, transportadora)
+	}
+	wg.Wait()
+
+	if len(cotizaciones) == 0 {
+		return nil, errSinCotizaciones
+	}
+	sort.Slice(cotizaciones, func(i, j int) bool {
+		if cotizaciones[i].centavos != cotizaciones[j].centavos {
+			return cotizaciones[i].centavos < cotizaciones[j].centavos
+		}
+		return cotizaciones[i].Transportadora < cotizaciones[j].Transportadora
+	})
+	return cotizaciones, nil
+}
+
+// Handler para POST /envios/cotizar
+// {"codigo_ciudad": "05001", "productos": [{"peso_gramos": 350, "cantidad": 2}]};
+// en lugar del código DANE se acepta "ciudad" con el nombre
+
+func cotizarEnvioHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		CodigoCiudad string              `json:"codigo_ciudad"`
+		Ciudad       string              `json:"ciudad"`
+		Productos    []PaqueteCotizacion `json:"productos"`
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&solicitud)
+	if err != nil || (solicitud.CodigoCiudad == "" && strings.TrimSpace(solicitud.Ciudad) == "") || len(solicitud.Productos) == 0 {
+		http.Error(w, "codigo_ciudad y productos requeridos", http.StatusBadRequest)
+		return
+	}
+	if solicitud.CodigoCiudad != "" && !codigoDANEValido(solicitud.CodigoCiudad) {
+		http.Error(w, "codigo_ciudad debe ser el código DANE de cinco dígitos", http.StatusBadRequest)
+		return
+	}
+	if len(solicitud.Productos) > maxProductosCotizar {
+		http.Error(w, fmt.Sprintf("Máximo %d productos por cotización", maxProductosCotizar), http.StatusBadRequest)
+		return
+	}
+	for _, p := range solicitud.Productos {
+		if p.PesoGramos <= 0 || p.PesoGramos > maxGramosCotizar || p.Cantidad < 0 || p.Cantidad > maxProductosCotizar {
+			http.Error(w, "peso_gramos o cantidad inválidos", http.StatusBadRequest)
+			return
+		}
+	}
+	if kilosCotizacion(solicitud.Productos)*1000 > maxGramosCotizar {
+		http.Error(w, "El peso total supera el máximo cotizable", http.StatusBadRequest)
+		return
+	}
+
+	ciudad, cotizaciones, err := obtenerCotizacionEnvio(solicitud.CodigoCiudad, solicitud.Ciudad, solicitud.Productos)
+	if err == errCiudadInexistente {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == errSinCotizaciones {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error al cotizar el envío", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ciudad":       ciudad,
+		"peso_kg":      kilosCotizacion(solicitud.Productos),
+		"cotizaciones": cotizaciones,
+	})
+}
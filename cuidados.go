@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Guías de cuidado por producto. Se consultan públicamente, se incluyen en
+// la respuesta y la página de cada certificado y se editan por la API de
+// administración.
+
+// Guía de cuidado de un producto
+type Cuidado struct {
+	ProductoID    int    `json:"producto_id"`
+	Lavado        string `json:"lavado"`
+	Peinado       string `json:"peinado"`
+	Duracion      string `json:"duracion"`
+	ActualizadoEn *Fecha `json:"actualizado_en,omitempty"`
+}
+
+func consultarCuidado(db *sql.DB, productoID int) (*Cuidado, error) {
+	cuidado := Cuidado{ProductoID: productoID}
+	err := db.QueryRow(`
+		SELECT lavado, peinado, duracion, actualizado_en
+		FROM Cuidados
+		WHERE producto_id = $1`, productoID).Scan(&cuidado.Lavado, &cuidado.Peinado, &cuidado.Duracion, &cuidado.ActualizadoEn)
+	if err != nil {
+		return nil, err
+	}
+	return &cuidado, nil
+}
+
+func guardarCuidado(db *sql.DB, cuidado Cuidado) error {
+	_, err := db.Exec(`
+		INSERT INTO Cuidados (producto_id, lavado, peinado, duracion, actualizado_en)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (producto_id) DO UPDATE
+		SET lavado = EXCLUDED.lavado, peinado = EXCLUDED.peinado,
+			duracion = EXCLUDED.duracion, actualizado_en = now()`,
+		cuidado.ProductoID, cuidado.Lavado, cuidado.Peinado, cuidado.Duracion)
+	return err
+}
+
+// Leer el identificador de producto al final de la ruta
+func productoIDDeRuta(ruta, prefijo string) (int, bool) {
+	id, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(ruta, prefijo), "/"))
+	return id, err == nil && id > 0
+}
+
+// Handler público para /cuidados/{producto_id}
+func cuidadosHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-None-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	productoID, ok := productoIDDeRuta(r.URL.Path, "/cuidados/")
+	if !ok {
+		http.Error(w, "Identificador de producto inválido", http.StatusBadRequest)
+		return
+	}
+
+	cuidado, err := obtenerCuidado(r.Context(), productoID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Guía de cuidado no encontrada", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	responderJSONConETag(w, r, cuidado, cacheControlProductos())
+}
+
+// Handler para editar la guía de cuidado de un producto:
+// PUT /admin/cuidados/{producto_id} {"lavado": "...", "peinado": "...", "duracion": "..."}
+func editarCuidadoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	productoID, ok := productoIDDeRuta(r.URL.Path, "/admin/cuidados/")
+	if !ok {
+		http.Error(w, "Identificador de producto inválido", http.StatusBadRequest)
+		return
+	}
+
+	var cuidado Cuidado
+	err := json.NewDecoder(r.Body).Decode(&cuidado)
+	if err != nil {
+		http.Error(w, "Cuerpo inválido", http.StatusBadRequest)
+		return
+	}
+	cuidado.ProductoID = productoID
+	cuidado.Lavado = strings.TrimSpace(cuidado.Lavado)
+	cuidado.Peinado = strings.TrimSpace(cuidado.Peinado)
+	cuidado.Duracion = strings.TrimSpace(cuidado.Duracion)
+	if cuidado.Lavado == "" && cuidado.Peinado == "" && cuidado.Duracion == "" {
+		http.Error(w, "Se requiere al menos lavado, peinado o duracion", http.StatusBadRequest)
+		return
+	}
+
+	err = actualizarCuidado(cuidado)
+	if err != nil {
+		// Violación de la llave foránea: el producto no existe
+		if e, ok := err.(*pq.Error); ok && e.Code == "23503" {
+			http.Error(w, "Producto no encontrado", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error al guardar la guía de cuidado", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
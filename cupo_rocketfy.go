@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Control del ritmo de las solicitudes a Rocketfy. Cada solicitud espera su
+// turno en una cola: los turnos se espacian según
+// rocketfy.solicitudes_por_minuto y, si Rocketfy informa su cupo
+// (X-RateLimit-Remaining y X-RateLimit-Reset o sus equivalentes sin X-),
+// el cupo restante se reparte hasta que se reinicie la ventana. Con el cupo
+// agotado, tras un 429 o si el turno tarda más de
+// rocketfy.espera_maxima_segundos, la solicitud falla de inmediato con
+// errorCupoRocketfy en lugar de quedar esperando.
+
+// Espera tras un 429 sin Retry-After
+const esperaPorDefectoCupoRocketfy = time.Minute
+
+// El cupo de Rocketfy se agotó hasta el momento indicado
+type errorCupoRocketfy struct {
+	hasta time.Time
+}
+
+func (e *errorCupoRocketfy) Error() string {
+	return fmt.Sprintf("Se agotó el cupo de solicitudes a Rocketfy; vuelva a intentarlo en %d segundos", e.segundos())
+}
+
+// Segundos que faltan para que haya cupo, para Retry-After
+func (e *errorCupoRocketfy) segundos() int {
+	segundos := int(time.Until(e.hasta).Seconds() + 0.999)
+	if segundos < 1 {
+		segundos = 1
+	}
+	return segundos
+}
+
+var (
+	muCupoRocketfy sync.Mutex
+	// Momento a partir del cual sale la próxima solicitud de la cola
+	turnoRocketfy time.Time
+	// Último cupo informado por Rocketfy; -1 si no se conoce
+	limiteRocketfy   = -1
+	restanteRocketfy = -1
+	reinicioRocketfy time.Time
+	// Solicitudes enviadas y rechazadas sin enviar por falta de cupo
+	solicitudesRocketfy uint64
+	rechazadasRocketfy  uint64
+)
+
+var esperaTurnoRocketfy = registrarHistograma(
+	"melenas_rocketfy_espera_segundos",
+	"Tiempo en cola de las solicitudes a Rocketfy por recurso",
+	"recurso",
+)
+
+func init() {
+	registrarMetricaCalculada("melenas_rocketfy_cupo_restante",
+		"Solicitudes restantes en la ventana actual de Rocketfy (-1 si no se conoce)", "gauge",
+		leerCupoRocketfy(func() float64 {
+			if !reinicioRocketfy.After(time.Now()) {
+				return -1
+			}
+			return float64(restanteRocketfy)
+		}))
+	registrarMetricaCalculada("melenas_rocketfy_cupo_limite",
+		"Solicitudes por ventana que permite Rocketfy (-1 si no se conoce)", "gauge",
+		leerCupoRocketfy(func() float64 { return float64(limiteRocketfy) }))
+	registrarMetricaCalculada("melenas_rocketfy_cupo_reinicio_segundos",
+		"Segundos hasta que Rocketfy reinicie el cupo (0 si no se conoce)", "gauge",
+		leerCupoRocketfy(func() float64 {
+			if restante := time.Until(reinicioRocketfy).Seconds(); restante > 0 {
+				return restante
+			}
+			return 0
+		}))
+	registrarMetricaCalculada("melenas_rocketfy_solicitudes_total",
+		"Solicitudes enviadas a Rocketfy", "counter",
+		leerCupoRocketfy(func() float64 { return float64(solicitudesRocketfy) }))
+	registrarMetricaCalculada("melenas_rocketfy_rechazadas_total",
+		"Solicitudes a Rocketfy rechazadas sin enviar por falta de cupo", "counter",
+		leerCupoRocketfy(func() float64 { return float64(rechazadasRocketfy) }))
+}
+
+// Leer el estado del cupo con el mutex tomado
+func leerCupoRocketfy(leer func() float64) func() float64 {
+	return func() float64 {
+		muCupoRocketfy.Lock()
+		defer muCupoRocketfy.Unlock()
+		return leer()
+	}
+}
+
+// Esperar el turno de una solicitud, o fallar si no hay cupo
+func esperarTurnoRocketfy(ctx context.Context, recurso string) error {
+	ajustes := configActual().API
+	ahora := time.Now()
+
+	muCupoRocketfy.Lock()
+	if !reinicioRocketfy.After(ahora) {
+		// Ventana vencida: el cupo vuelve a ser desconocido hasta la
+		// próxima respuesta
+		restanteRocketfy, reinicioRocketfy = -1, time.Time{}
+	}
+	if restanteRocketfy == 0 {
+		rechazadasRocketfy++
+		hasta := reinicioRocketfy
+		muCupoRocketfy.Unlock()
+		return &errorCupoRocketfy{hasta: hasta}
+	}
+
+	var intervalo time.Duration
+	if ajustes.SolicitudesPorMinuto > 0 {
+		intervalo = time.Minute / time.Duration(ajustes.SolicitudesPorMinuto)
+	}
+	if restanteRocketfy > 0 {
+		if repartido := reinicioRocketfy.Sub(ahora) / time.Duration(restanteRocketfy); repartido > intervalo {
+			intervalo = repartido
+		}
+		restanteRocketfy--
+	}
+	turno := turnoRocketfy
+	if turno.Before(ahora) {
+		turno = ahora
+	}
+	espera := turno.Sub(ahora)
+	if espera > time.Duration(ajustes.EsperaMaximaSegundos)*time.Second {
+		rechazadasRocketfy++
+		muCupoRocketfy.Unlock()
+		return &errorCupoRocketfy{hasta: turno}
+	}
+	turnoRocketfy = turno.Add(intervalo)
+	solicitudesRocketfy++
+	muCupoRocketfy.Unlock()
+
+	esperaTurnoRocketfy.observar(recurso, espera.Seconds())
+	if espera <= 0 {
+		return nil
+	}
+	temporizador := time.NewTimer(espera)
+	defer temporizador.Stop()
+	select {
+	case <-temporizador.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Guardar el cupo que informa una respuesta de Rocketfy
+func registrarCupoRocketfy(resp *http.Response) {
+	ahora := time.Now()
+	limite, hayLimite := encabezadoCupoRocketfy(resp.Header, "Limit")
+	restante, hayRestante := encabezadoCupoRocketfy(resp.Header, "Remaining")
+	reinicio, hayReinicio := encabezadoCupoRocketfy(resp.Header, "Reset")
+
+	muCupoRocketfy.Lock()
+	defer muCupoRocketfy.Unlock()
+	if hayLimite {
+		limiteRocketfy = limite
+	}
+	if hayReinicio {
+		// Segundos hasta el reinicio o, si es muy grande, hora Unix
+		if reinicio > 1000000000 {
+			reinicioRocketfy = time.Unix(int64(reinicio), 0)
+		} else {
+			reinicioRocketfy = ahora.Add(time.Duration(reinicio) * time.Second)
+		}
+	}
+	if hayRestante {
+		restanteRocketfy = restante
+		if !hayReinicio && !reinicioRocketfy.After(ahora) {
+			// Sin reinicio conocido se asume una ventana de un minuto
+			reinicioRocketfy = ahora.Add(time.Minute)
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		espera := esperaPorDefectoCupoRocketfy
+		if segundos, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && segundos > 0 {
+			espera = time.Duration(segundos) * time.Second
+		}
+		restanteRocketfy = 0
+		if hasta := ahora.Add(espera); hasta.After(reinicioRocketfy) {
+			reinicioRocketfy = hasta
+		}
+	}
+}
+
+// Valor entero de X-RateLimit-<nombre> o RateLimit-<nombre>
+func encabezadoCupoRocketfy(encabezados http.Header, nombre string) (int, bool) {
+	for _, prefijo := range []string{"X-RateLimit-", "RateLimit-"} {
+		if valor, err := strconv.Atoi(encabezados.Get(prefijo + nombre)); err == nil && valor >= 0 {
+			return valor, true
+		}
+	}
+	return 0, false
+}
+
+// Enviar una solicitud a Rocketfy en su turno y registrar el cupo que
+// informa. Un 429 se devuelve como errorCupoRocketfy.
+func hacerSolicitudRocketfy(cliente *http.Client, req *http.Request, recurso string) (*http.Response, error) {
+	if err := esperarTurnoRocketfy(req.Context(), recurso); err != nil {
+		return nil, err
+	}
+	resp, err := cliente.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error al hacer la solicitud: %v", err)
+	}
+	registrarCupoRocketfy(resp)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		muCupoRocketfy.Lock()
+		hasta := reinicioRocketfy
+		muCupoRocketfy.Unlock()
+		return nil, &errorCupoRocketfy{hasta: hasta}
+	}
+	return resp, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// Servidor de diagnóstico (pprof y /debug/vars) en un puerto separado.
+// Las solicitudes desde localhost se aceptan siempre; desde otras
+// direcciones se exige el token de administrador.
+func iniciarDiagnostico() {
+	if config.Diagnostico.Direccion == "" {
+		return
+	}
+
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("db", expvar.Func(func() interface{} {
+		muPoolDB.Lock()
+		defer muPoolDB.Unlock()
+		if poolDB == nil {
+			return nil
+		}
+		return poolDB.Stats()
+	}))
+	expvar.Publish("db_replica", expvar.Func(func() interface{} {
+		muReplica.Lock()
+		defer muReplica.Unlock()
+		if poolReplica == nil {
+			return nil
+		}
+		return poolReplica.Stats()
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		log.Println("Diagnóstico disponible en http://" + config.Diagnostico.Direccion + "/debug/pprof/")
+		err := escucharConReintento(func() error {
+			return http.ListenAndServe(config.Diagnostico.Direccion, soloLocalOAdmin(mux))
+		})
+		log.Println("Servidor de diagnóstico:", err)
+	}()
+}
+
+// Middleware que permite solicitudes locales o de administradores
+func soloLocalOAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err == nil && ip != nil && ip.IsLoopback() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !esAdmin(r) {
+			http.Error(w, "No autorizado", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
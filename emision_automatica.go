@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Reglas de emisión automática de certificados (emision_automatica.reglas
+// en config.yml). Cuando un pedido de Rocketfy o un webhook de pagos deja
+// una compra pagada, la primera regla cuyas condiciones coinciden decide si
+// se emite el certificado, con qué plantilla y qué notificaciones se
+// envían. Sin reglas se emite siempre con la plantilla del producto y
+// todas las notificaciones; con reglas, una compra que no coincide con
+// ninguna queda para la emisión manual. La emisión manual y la importación
+// de ventas no pasan por las reglas.
+
+// Notificaciones de un certificado emitido
+const (
+	// Aviso operativo certificado_emitido (avisos.go)
+	NotificarAviso = "aviso"
+	// Push al cliente (push.go)
+	NotificarPush = "push"
+	// Sin notificaciones
+	NotificarNinguna = "ninguna"
+)
+
+// Regla de emisión automática; las condiciones vacías coinciden con
+// cualquier compra
+type ReglaEmision struct {
+	Nombre string `yaml:"nombre"`
+	// Alguna línea de la compra es de una de estas categorías
+	Categorias []string `yaml:"categorias"`
+	// Estado informado por Rocketfy o el proveedor de pagos (approved,
+	// delivered...)
+	EstadosPago []string `yaml:"estados_pago"`
+	// Total de la compra en pesos; 0 sin límite
+	TotalMinimo float64 `yaml:"total_minimo"`
+	TotalMaximo float64 `yaml:"total_maximo"`
+	// Deja la compra para la emisión manual
+	Omitir bool `yaml:"omitir"`
+	// Plantilla del certificado; vacía usa la del producto
+	Plantilla string `yaml:"plantilla"`
+	// aviso, push o ninguna; vacía las envía todas
+	Notificaciones []string `yaml:"notificaciones"`
+}
+
+// Compra pagada evaluada por las reglas
+type compraEmision struct {
+	categorias   []string
+	estadoOrigen string
+	total        float64
+}
+
+func contieneTexto(lista []string, valor string) bool {
+	for _, v := range lista {
+		if strings.EqualFold(v, valor) {
+			return true
+		}
+	}
+	return false
+}
+
+func (regla ReglaEmision) coincide(compra compraEmision) bool {
+	if len(regla.EstadosPago) > 0 && !contieneTexto(regla.EstadosPago, compra.estadoOrigen) {
+		return false
+	}
+	if regla.TotalMinimo > 0 && compra.total < regla.TotalMinimo {
+		return false
+	}
+	if regla.TotalMaximo > 0 && compra.total > regla.TotalMaximo {
+		return false
+	}
+	if len(regla.Categorias) == 0 {
+		return true
+	}
+	for _, categoria := range compra.categorias {
+		if contieneTexto(regla.Categorias, categoria) {
+			return true
+		}
+	}
+	return false
+}
+
+// Primera regla que coincide con la compra; nil si ninguna
+func reglaEmision(reglas []ReglaEmision, compra compraEmision) *ReglaEmision {
+	for i := range reglas {
+		if reglas[i].coincide(compra) {
+			return &reglas[i]
+		}
+	}
+	return nil
+}
+
+// Categorías de los productos y total de una compra
+func consultarCompraEmision(tx *sql.Tx, compraID int) (compraEmision, error) {
+	var compra compraEmision
+	err := tx.QueryRow(`
+		SELECT
+			coalesce(array_agg(DISTINCT p.categoria) FILTER (WHERE p.categoria IS NOT NULL), '{}'),
+			coalesce(sum(dc.cantidad * dc.precio_unitario), 0)::float8
+		FROM DetallesCompra dc
+		JOIN Productos p ON p.producto_id = dc.producto_id
+		WHERE dc.compra_id = $1`, compraID).Scan(pq.Array(&compra.categorias), &compra.total)
+	return compra, err
+}
+
+// Emitir el certificado de una compra que acaba de quedar pagada según las
+// reglas configuradas; devuelve si se emitió
+func emitirCertificadoAutomaticoTx(tx *sql.Tx, compraID int, estadoOrigen string) (bool, error) {
+	reglas := configActual().EmisionAutomatica.Reglas
+	if len(reglas) == 0 {
+		_, err := emitirCertificadoTx(tx, compraID)
+		return err == nil, err
+	}
+
+	compra, err := consultarCompraEmision(tx, compraID)
+	if err != nil {
+		return false, err
+	}
+	compra.estadoOrigen = estadoOrigen
+	regla := reglaEmision(reglas, compra)
+	if regla == nil || regla.Omitir {
+		nombre := "ninguna"
+		if regla != nil {
+			nombre = regla.Nombre
+		}
+		logInfo("Emisión automática: la compra %d queda sin certificado (regla %s)", compraID, nombre)
+		return false, nil
+	}
+
+	_, err = emitirCertificadoReglaTx(tx, compraID, regla)
+	return err == nil, err
+}
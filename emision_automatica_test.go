@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// Gana la primera regla que coincide; sin coincidencias la compra queda
+// para la emisión manual
+func TestReglaEmision(t *testing.T) {
+	reglas := []ReglaEmision{
+		{Nombre: "mayoristas", TotalMinimo: 5000000, Omitir: true},
+		{Nombre: "pelucas aprobadas", Categorias: []string{"Pelucas"}, EstadosPago: []string{"approved", "delivered"}},
+		{Nombre: "extensiones", Categorias: []string{"extensiones"}, TotalMinimo: 100000, TotalMaximo: 2000000},
+	}
+
+	casos := []struct {
+		nombre   string
+		compra   compraEmision
+		esperada string
+	}{
+		{"supera el total mínimo", compraEmision{[]string{"pelucas"}, "approved", 6000000}, "mayoristas"},
+		{"categoría y estado", compraEmision{[]string{"Pelucas"}, "approved", 300000}, "pelucas aprobadas"},
+		{"sin distinguir mayúsculas", compraEmision{[]string{"PELUCAS"}, "Delivered", 300000}, "pelucas aprobadas"},
+		{"estado no incluido", compraEmision{[]string{"pelucas"}, "pending", 300000}, ""},
+		{"alguna línea de la categoría", compraEmision{[]string{"cuidado", "extensiones"}, "pending", 150000}, "extensiones"},
+		{"en el límite inferior", compraEmision{[]string{"extensiones"}, "", 100000}, "extensiones"},
+		{"en el límite superior", compraEmision{[]string{"extensiones"}, "", 2000000}, "extensiones"},
+		{"bajo el mínimo", compraEmision{[]string{"extensiones"}, "", 99999}, ""},
+		{"sobre el máximo", compraEmision{[]string{"extensiones"}, "", 2000001}, ""},
+		{"sin categorías", compraEmision{nil, "approved", 300000}, ""},
+	}
+	for _, caso := range casos {
+		regla := reglaEmision(reglas, caso.compra)
+		nombre := ""
+		if regla != nil {
+			nombre = regla.Nombre
+		}
+		if nombre != caso.esperada {
+			t.Errorf("%s: regla %q, se esperaba %q", caso.nombre, nombre, caso.esperada)
+		}
+	}
+
+	// Una regla sin condiciones coincide con cualquier compra
+	todas := []ReglaEmision{{Nombre: "todas"}}
+	if regla := reglaEmision(todas, compraEmision{}); regla == nil || regla.Nombre != "todas" {
+		t.Errorf("la regla sin condiciones no coincidió: %v", regla)
+	}
+}
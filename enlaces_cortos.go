@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// Enlaces cortos (/s/{codigo}) que redirigen a la página del certificado.
+// Se crean al emitir cada certificado para que el QR de las etiquetas sea
+// pequeño y fácil de escanear.
+
+// Alfabeto sin caracteres que se confunden al leerlos (0/o, 1/l/i)
+const alfabetoEnlaces = "23456789abcdefghjkmnpqrstuvwxyz"
+
+const (
+	// 12 caracteres de 31 dan unos 59 bits: recorrer los códigos no sirve
+	// para saltarse los tokens de verificación aunque la protección contra
+	// fuerza bruta esté desactivada. Los enlaces ya impresos con códigos
+	// más cortos siguen funcionando.
+	longitudCodigoEnlace = 12
+	intentosCodigoEnlace = 5
+)
+
+func generarCodigoEnlace() (string, error) {
+	var b strings.Builder
+	limite := big.NewInt(int64(len(alfabetoEnlaces)))
+	for i := 0; i < longitudCodigoEnlace; i++ {
+		n, err := rand.Int(rand.Reader, limite)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(alfabetoEnlaces[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// Crear el enlace corto de un certificado dentro de la transacción de
+// emisión. Los códigos repetidos se descartan sin abortar la transacción.
+func crearEnlaceCorto(tx *sql.Tx, numeroCertificado string) (string, error) {
+	for i := 0; i < intentosCodigoEnlace; i++ {
+		codigo, err := generarCodigoEnlace()
+		if err != nil {
+			return "", err
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO EnlacesCortos (codigo, numero_certificado, destino)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (codigo) DO NOTHING
+			RETURNING codigo`, codigo, numeroCertificado, "/c/"+numeroCertificado).Scan(&codigo)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		return codigo, err
+	}
+	return "", fmt.Errorf("no se pudo generar un código de enlace único")
+}
+
+// Registrar un clic y devolver el destino del enlace
+func registrarClicEnlace(db *sql.DB, codigo string) (string, error) {
+	var destino string
+	err := db.QueryRow(`
+		UPDATE EnlacesCortos
+		SET clics = clics + 1, ultimo_clic_en = now()
+		WHERE codigo = $1
+		RETURNING destino`, codigo).Scan(&destino)
+	return destino, err
+}
+
+// Handler para redirigir /s/{codigo} a la página del certificado
+func enlaceCortoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	codigo := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/s/"), "/"))
+	if codigo == "" || strings.Contains(codigo, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	destino, err := seguirEnlaceCorto(r.Context(), codigo)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			registrarFallo(r, FalloConsulta)
+			http.Error(w, "Enlace no encontrado", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	// Los enlaces guardan /c/{numero}; con los tokens activos se redirige
+	// a la ruta con un token vigente
+	if strings.HasPrefix(destino, "/c/") {
+		destino = rutaPaginaCertificado(strings.TrimPrefix(destino, "/c/"))
+	}
+
+	// 302 para que los navegadores no guarden la redirección y cada
+	// escaneo quede contado. Location lleva solo la ruta: el navegador la
+	// resuelve contra el mismo sitio, sin depender del Host de la solicitud
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, destino, http.StatusFound)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Seguimiento de envíos. Cada compra puede tener una guía de Servientrega,
+// Coordinadora o Interrapidísimo; un proceso periódico consulta el estado
+// en la API configurada para la transportadora y avisa al cliente por
+// email cuando el pedido sale a reparto y cuando se entrega.
+
+// Estados normalizados de un envío
+const (
+	EnvioRegistrado = "registrado"
+	EnvioEnTransito = "en_transito"
+	EnvioEnReparto  = "en_reparto"
+	EnvioEntregado  = "entregado"
+	EnvioNovedad    = "novedad"
+)
+
+// Transportadoras soportadas
+const (
+	TransportadoraServientrega    = "servientrega"
+	TransportadoraCoordinadora    = "coordinadora"
+	TransportadoraInterrapidisimo = "interrapidisimo"
+)
+
+const (
+	intervaloEnviosPorDefecto = 30 * time.Minute
+	loteEnvios                = 100
+	timeoutTransportadora     = 15 * time.Second
+)
+
+var (
+	errTransportadoraInvalida = errors.New("Transportadora no soportada")
+	errEnvioInexistente       = errors.New("Envío no encontrado")
+)
+
+// Acceso a la API de seguimiento de una transportadora
+type ConfigTransportadora struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+// Consulta del estado de una guía; devuelve el texto de estado de la
+// transportadora
+type consultaGuia func(ajustes ConfigTransportadora, guia string) (string, error)
+
+var transportadoras = map[string]consultaGuia{
+	// Cada API devuelve el estado en un campo distinto
+	TransportadoraServientrega:    consultaGuiaJSON("/guias/%s", "EstadoActual"),
+	TransportadoraCoordinadora:    consultaGuiaJSON("/seguimiento/%s", "estado"),
+	TransportadoraInterrapidisimo: consultaGuiaJSON("/rastreo/%s", "DescripcionEstado"),
+}
+
+// Palabras clave del texto de la transportadora para cada estado, en orden
+// de prioridad
+var palabrasEstadoEnvio = []struct {
+	palabra string
+	estado  string
+}{
+	{"NO ENTREGAD", EnvioNovedad},
+	{"ENTREGAD", EnvioEntregado},
+	{"REPARTO", EnvioEnReparto},
+	{"DISTRIBUCION", EnvioEnReparto},
+	{"DEVOL", EnvioNovedad},
+	{"NOVEDAD", EnvioNovedad},
+	{"TRANSITO", EnvioEnTransito},
+	{"VIAJANDO", EnvioEnTransito},
+	{"BODEGA", EnvioEnTransito},
+	{"CENTRO LOGISTICO", EnvioEnTransito},
+}
+
+// Envío de una compra con su historial
+type Envio struct {
+	CompraID             int           `json:"compra_id"`
+	Transportadora       string        `json:"transportadora"`
+	NumeroGuia           string        `json:"numero_guia"`
+	Estado               string        `json:"estado"`
+	EstadoTransportadora string        `json:"estado_transportadora"`
+	ConsultadoEn         *Fecha        `json:"consultado_en"`
+	EntregadoEn          *Fecha        `json:"entregado_en"`
+	Historial            []EventoEnvio `json:"historial"`
+}
+
+type EventoEnvio struct {
+	Estado  string `json:"estado"`
+	Detalle string `json:"detalle"`
+	Fecha   Fecha  `json:"fecha"`
+}
+
+// Consultar una guía con GET {url}{ruta} y leer el campo de estado de la
+// respuesta JSON
+func consultaGuiaJSON(ruta, campo string) consultaGuia {
+	return func(ajustes ConfigTransportadora, guia string) (string, error) {
+		if ajustes.URL == "" {
+			return "", errors.New("la transportadora no está configurada")
+		}
+		req, err := http.NewRequest("GET", strings.TrimSuffix(ajustes.URL, "/")+fmt.Sprintf(ruta, url.PathEscape(guia)), nil)
+		if err != nil {
+			return "", err
+		}
+		if ajustes.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+ajustes.Token)
+		}
+
+		client := &http.Client{Timeout: timeoutTransportadora}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return "", fmt.Errorf("la transportadora respondió con código de estado: %d", resp.StatusCode)
+		}
+		var respuesta map[string]interface{}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&respuesta); err != nil {
+			return "", fmt.Errorf("Error al leer la respuesta de la transportadora: %v", err)
+		}
+		estado, _ := respuesta[campo].(string)
+		if estado == "" {
+			return "", fmt.Errorf("la respuesta no tiene el campo %s", campo)
+		}
+		return estado, nil
+	}
+}
+
+// Traducir el texto de estado de la transportadora a un estado normalizado
+func normalizarEstadoEnvio(texto string) string {
+	texto = strings.ToUpper(reemplazoTildes.Replace(texto))
+	for _, p := range palabrasEstadoEnvio {
+		if strings.Contains(texto, p.palabra) {
+			return p.estado
+		}
+	}
+	return EnvioRegistrado
+}
+
+// Registrar o reemplazar la guía de una compra
+func guardarEnvio(db *sql.DB, compraID int, transportadora, guia string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var envioID int
+	err = tx.QueryRow(`
+		INSERT INTO Envios (compra_id, transportadora, numero_guia)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (compra_id) DO UPDATE
+			SET transportadora = EXCLUDED.transportadora, numero_guia = EXCLUDED.numero_guia,
+				estado = 'registrado', estado_transportadora = '', consultado_en = NULL, entregado_en = NULL
+		RETURNING envio_id`, compraID, transportadora, guia).Scan(&envioID)
+	if e, ok := err.(*pq.Error); ok && e.Code == "23503" {
+		return errCompraNoEncontrada
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO HistorialEnvios (envio_id, estado, detalle) VALUES ($1, $2, $3)`,
+		envioID, EnvioRegistrado, "Guía "+guia+" de "+transportadora)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func consultarEnvio(db *sql.DB, compraID int) (*Envio, error) {
+	envio := Envio{CompraID: compraID}
+	var envioID int
+	err := db.QueryRow(`
+		SELECT envio_id, transportadora, numero_guia, estado, estado_transportadora, consultado_en, entregado_en
+		FROM Envios WHERE compra_id = $1`, compraID).
+		Scan(&envioID, &envio.Transportadora, &envio.NumeroGuia, &envio.Estado, &envio.EstadoTransportadora,
+			&envio.ConsultadoEn, &envio.EntregadoEn)
+	if err == sql.ErrNoRows {
+		return nil, errEnvioInexistente
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	envio.Historial, err = consultarHistorialEnvio(db, int64(envioID))
+	if err != nil {
+		return nil, err
+	}
+	return &envio, nil
+}
+
+// Historial de estados de un envío
+func consultarHistorialEnvio(db *sql.DB, envioID int64) ([]EventoEnvio, error) {
+	historial := []EventoEnvio{}
+	rows, err := db.Query(`SELECT estado, detalle, fecha FROM HistorialEnvios WHERE envio_id = $1 ORDER BY fecha`, envioID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var evento EventoEnvio
+		if err := rows.Scan(&evento.Estado, &evento.Detalle, &evento.Fecha); err != nil {
+			return nil, err
+		}
+		historial = append(historial, evento)
+	}
+	return historial, rows.Err()
+}
+
+// Verificar que el email corresponda al cliente de la compra
+func emailDeCompra(db *sql.DB, compraID int, email string) (bool, error) {
+	var clienteID int
+	err := db.QueryRow(`SELECT cliente_id FROM Compras WHERE compra_id = $1`, compraID).Scan(&clienteID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	contacto, err := consultarContactoCliente(db, clienteID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return contacto.Email != nil && strings.EqualFold(*contacto.Email, strings.TrimSpace(email)), nil
+}
+
+// Goroutine que consulta periódicamente los envíos no entregados
+func despacharEnvios() {
+	intervalo := time.Duration(config.Envios.IntervaloMinutos) * time.Minute
+	if intervalo <= 0 {
+		intervalo = intervaloEnviosPorDefecto
+	}
+
+	for range time.Tick(intervalo) {
+		if escriturasBloqueadas() {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Envíos: error al conectar a la base de datos:", err)
+			continue
+		}
+
+		if err := actualizarEnvios(db, intervalo); err != nil {
+			log.Println("Envíos:", err)
+		}
+	}
+}
+
+// Consultar los envíos pendientes que no se revisaron en el último
+// intervalo y notificar los cambios de estado
+func actualizarEnvios(db *sql.DB, intervalo time.Duration) error {
+	rows, err := db.Query(`
+		SELECT envio_id, compra_id, transportadora, numero_guia, estado
+		FROM Envios
+		WHERE estado <> 'entregado' AND (consultado_en IS NULL OR consultado_en < $1)
+		ORDER BY consultado_en NULLS FIRST
+		LIMIT $2`, time.Now().Add(-intervalo), loteEnvios)
+	if err != nil {
+		return err
+	}
+	type pendiente struct {
+		envioID, compraID            int
+		transportadora, guia, estado string
+	}
+	var pendientes []pendiente
+	for rows.Next() {
+		var p pendiente
+		if err := rows.Scan(&p.envioID, &p.compraID, &p.transportadora, &p.guia, &p.estado); err != nil {
+			rows.Close()
+			return err
+		}
+		pendientes = append(pendientes, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ajustes := configActual().Envios.Transportadoras
+	for _, p := range pendientes {
+		consultar, ok := transportadoras[p.transportadora]
+		if !ok {
+			continue
+		}
+		texto, err := consultar(ajustes[p.transportadora], p.guia)
+		if err != nil {
+			log.Printf("Envíos: guía %s de %s: %v", p.guia, p.transportadora, err)
+			continue
+		}
+
+		estado := normalizarEstadoEnvio(texto)
+		cambio, err := registrarEstadoEnvio(db, p.envioID, estado, texto)
+		if err != nil {
+			return err
+		}
+		if cambio && (estado == EnvioEnReparto || estado == EnvioEntregado) {
+			if err := notificarEnvio(db, p.compraID, p.transportadora, p.guia, estado); err != nil {
+				log.Println("Envíos: error al notificar al cliente:", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Guardar el resultado de la consulta; devuelve si el estado cambió
+func registrarEstadoEnvio(db *sql.DB, envioID int, estado, texto string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var anterior string
+	err = tx.QueryRow(`SELECT estado FROM Envios WHERE envio_id = $1 FOR UPDATE`, envioID).Scan(&anterior)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE Envios SET estado = $2, estado_transportadora = $3, consultado_en = now(),
+			entregado_en = CASE WHEN $2 = 'entregado' THEN now() ELSE entregado_en END
+		WHERE envio_id = $1`, envioID, estado, texto)
+	if err != nil {
+		return false, err
+	}
+
+	cambio := anterior != estado
+	if cambio {
+		_, err = tx.Exec(`INSERT INTO HistorialEnvios (envio_id, estado, detalle) VALUES ($1, $2, $3)`,
+			envioID, estado, texto)
+		if err != nil {
+			return false, err
+		}
+	}
+	return cambio, tx.Commit()
+}
+
+// Avisar al cliente que su pedido salió a reparto o fue entregado
+func notificarEnvio(db *sql.DB, compraID int, transportadora, guia, estado string) error {
+	var clienteID int
+	err := db.QueryRow(`SELECT cliente_id FROM Compras WHERE compra_id = $1`, compraID).Scan(&clienteID)
+	if err != nil {
+		return err
+	}
+	contacto, err := consultarContactoCliente(db, clienteID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	asunto := "Tu pedido de Melenas Co está en camino"
+	mensaje := "salió a reparto y llegará hoy"
+	if estado == EnvioEntregado {
+		asunto = "Tu pedido de Melenas Co fue entregado"
+		mensaje = "fue entregado"
+	}
+
+	// El push no reemplaza al email
+	_, err = notificarPushCliente(db, clienteID, NotificacionPush{
+		Titulo: asunto,
+		Cuerpo: fmt.Sprintf("Tu pedido (guía %s de %s) %s.", guia, transportadora, mensaje),
+		Datos:  map[string]string{"tipo": "envio", "compra_id": strconv.Itoa(compraID), "estado": estado},
+	})
+	if err != nil {
+		log.Println("Envíos: error al enviar el push de la compra", compraID, ":", err)
+	}
+
+	if contacto.Email == nil {
+		return nil
+	}
+	return enviarEmail(*contacto.Email, asunto, fmt.Sprintf("Hola %s,\n\nTu pedido (guía %s de %s) %s.\n",
+		contacto.Nombre, guia, transportadora, mensaje))
+}
+
+func estadoErrorEnvio(err error) int {
+	switch err {
+	case errCompraNoEncontrada, errEnvioInexistente:
+		return http.StatusNotFound
+	case errTransportadoraInvalida:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func responderErrorEnvio(w http.ResponseWriter, r *http.Request, err error, mensaje string) {
+	estado := estadoErrorEnvio(err)
+	if estado == http.StatusInternalServerError {
+		http.Error(w, mensaje, estado)
+	} else {
+		http.Error(w, err.Error(), estado)
+	}
+	logSolicitud(r.Context(), err)
+}
+
+// Handler para PUT /admin/compras/{id}/envio {"transportadora": "...", "numero_guia": "..."}
+func registrarEnvioHandler(w http.ResponseWriter, r *http.Request, compraID int) {
+	if r.Method != "PUT" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		Transportadora string `json:"transportadora"`
+		NumeroGuia     string `json:"numero_guia"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&solicitud)
+	if err != nil || strings.TrimSpace(solicitud.NumeroGuia) == "" {
+		http.Error(w, "transportadora y numero_guia requeridos", http.StatusBadRequest)
+		return
+	}
+	transportadora := strings.ToLower(strings.TrimSpace(solicitud.Transportadora))
+	if _, ok := transportadoras[transportadora]; !ok {
+		responderErrorEnvio(w, r, errTransportadoraInvalida, "")
+		return
+	}
+
+	err = registrarGuia(compraID, transportadora, strings.TrimSpace(solicitud.NumeroGuia))
+	if err != nil {
+		responderErrorEnvio(w, r, err, "Error al registrar el envío")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler para GET /compras/{id}/envio?email=... (el email del cliente
+// de la compra, salvo para administradores). Con captcha configurado el
+// cliente envía también el token (exigirCaptcha).
+func envioHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", encabezadoCaptcha)
+
+	id, recurso, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/compras/"), "/"), "/")
+	compraID, err := strconv.Atoi(id)
+	if err != nil || compraID <= 0 || recurso != "envio" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	envio, err := obtenerEnvio(r.Context(), compraID, r.URL.Query().Get("email"), esAdmin(r))
+	if err != nil {
+		responderErrorEnvio(w, r, err, "Error al consultar el envío")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(envio)
+}
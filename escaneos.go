@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Detección de escaneos duplicados: cada verificación por HTTP se registra
+// en Escaneos con el hash de la IP, el país (del encabezado que agrega el
+// CDN, escaneos.encabezado_region, o de la base de geolocalización) y la
+// ciudad (de la base, geoip.go). Si un certificado se escanea desde
+// más de escaneos.umbral_ips IPs o escaneos.umbral_regiones regiones dentro
+// de escaneos.ventana_minutos, es probable que su número esté copiado en
+// productos falsificados: se abre una alerta, se publica el evento
+// escaneos_anomalos y se avisa al equipo.
+
+// Alerta de escaneos anómalos de un certificado
+type AlertaEscaneo struct {
+	ID                int    `json:"id"`
+	NumeroCertificado string `json:"numero_certificado"`
+	IPs               int    `json:"ips"`
+	Regiones          int    `json:"regiones"`
+	VentanaMinutos    int    `json:"ventana_minutos"`
+	DetectadaEn       Fecha  `json:"detectada_en"`
+	ResueltaEn        *Fecha `json:"resuelta_en,omitempty"`
+}
+
+// Hash de la IP para contar IPs distintas sin guardarlas; con
+// cifrado.clave_hash es un HMAC para que no se puedan recorrer las IPv4
+func hashIP(ip string) string {
+	var suma []byte
+	if clave, err := decodificarClave(config.Cifrado.ClaveHash); config.Cifrado.ClaveHash != "" && err == nil {
+		mac := hmac.New(sha256.New, clave)
+		mac.Write([]byte(ip))
+		suma = mac.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(ip))
+		suma = s[:]
+	}
+	return hex.EncodeToString(suma[:16])
+}
+
+// Escaneo de un certificado antes de guardarlo
+type Escaneo struct {
+	NumeroCertificado string
+	IPHash            string
+	Region            string
+	Ciudad            string
+	Canal             string
+}
+
+// Contar una verificación hecha por HTTP y registrar el escaneo para las
+// estadísticas y la detección de anomalías, en segundo plano
+func contarVerificacionSolicitud(r *http.Request, numeroCertificado, canal string) {
+	contarVerificacion(numeroCertificado, canal)
+	if escriturasBloqueadas() {
+		return
+	}
+
+	// Con la IP de X-Forwarded-For sin validar cualquiera podría simular
+	// escaneos desde muchas IPs, o esconder los suyos en una sola
+	ip := textoIPSolicitud(r)
+	escaneo := Escaneo{NumeroCertificado: numeroCertificado, IPHash: hashIP(ip), Canal: canal}
+	escaneo.Region, escaneo.Ciudad = ubicacionSolicitud(r, ip)
+	go func() {
+		alerta, err := registrarEscaneo(escaneo)
+		if err != nil {
+			log.Println("Error al registrar el escaneo:", err)
+			return
+		}
+		if alerta != nil {
+			avisar(AvisoEscaneosAnomalos, fmt.Sprintf(
+				"Certificado %s escaneado desde %d IPs y %d regiones en %d minutos; posible número copiado en falsificaciones",
+				alerta.NumeroCertificado, alerta.IPs, alerta.Regiones, alerta.VentanaMinutos))
+		}
+	}()
+}
+
+// País (del encabezado del CDN o de la base de geolocalización) y ciudad
+// desde donde se hace la solicitud; vacíos si no se conocen
+func ubicacionSolicitud(r *http.Request, ip string) (region, ciudad string) {
+	region = strings.ToUpper(strings.TrimSpace(r.Header.Get(configActual().Escaneos.EncabezadoRegion)))
+	// Cloudflare envía XX cuando no conoce el país y T1 para Tor
+	if region == "XX" || region == "T1" {
+		region = ""
+	}
+	if ubicacion, ok := ubicarIP(ip); ok {
+		if region == "" {
+			region = ubicacion.Pais
+		}
+		if region == ubicacion.Pais {
+			ciudad = ubicacion.Ciudad
+		}
+	}
+	return region, ciudad
+}
+
+// Registrar un escaneo y, si el certificado supera los umbrales y no
+// tiene una alerta abierta, abrirla con su evento en el outbox. Devuelve la
+// alerta nueva o nil.
+func insertarEscaneo(db *sql.DB, escaneo Escaneo) (*AlertaEscaneo, error) {
+	ajustes := configActual().Escaneos
+	numeroCertificado := escaneo.NumeroCertificado
+	var alerta *AlertaEscaneo
+	err := enTransaccion(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO Escaneos (numero_certificado, ip_hash, region, ciudad, canal)
+			VALUES ($1, $2, $3, $4, $5)`,
+			numeroCertificado, escaneo.IPHash, escaneo.Region, escaneo.Ciudad, escaneo.Canal)
+		if err != nil || ajustes.UmbralIPs <= 0 {
+			return err
+		}
+
+		var ips, regiones int
+		err = tx.QueryRow(`
+			SELECT count(DISTINCT ip_hash), count(DISTINCT NULLIF(region, ''))
+			FROM Escaneos
+			WHERE numero_certificado = $1 AND creado_en > now() - $2 * interval '1 minute'`,
+			numeroCertificado, ajustes.VentanaMinutos).Scan(&ips, &regiones)
+		if err != nil {
+			return err
+		}
+		if ips < ajustes.UmbralIPs && (ajustes.UmbralRegiones <= 0 || regiones < ajustes.UmbralRegiones) {
+			return nil
+		}
+
+		a := AlertaEscaneo{NumeroCertificado: numeroCertificado, IPs: ips, Regiones: regiones, VentanaMinutos: ajustes.VentanaMinutos}
+		err = tx.QueryRow(`
+			INSERT INTO AlertasEscaneo (numero_certificado, ips, regiones, ventana_minutos)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (numero_certificado) WHERE resuelta_en IS NULL DO NOTHING
+			RETURNING alerta_id, detectada_en`, numeroCertificado, ips, regiones, ajustes.VentanaMinutos).
+			Scan(&a.ID, &a.DetectadaEn)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		alerta = &a
+		return registrarEventoOutbox(tx, EventoEscaneosAnomalos, a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return alerta, nil
+}
+
+// Alertas abiertas (o todas con todas) más recientes primero
+func consultarAlertasEscaneo(db *sql.DB, todas bool, limite int) ([]AlertaEscaneo, error) {
+	rows, err := db.Query(`
+		SELECT alerta_id, numero_certificado, ips, regiones, ventana_minutos, detectada_en, resuelta_en
+		FROM AlertasEscaneo
+		WHERE resuelta_en IS NULL OR $1
+		ORDER BY detectada_en DESC, alerta_id DESC
+		LIMIT $2`, todas, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alertas := []AlertaEscaneo{}
+	for rows.Next() {
+		var a AlertaEscaneo
+		err := rows.Scan(&a.ID, &a.NumeroCertificado, &a.IPs, &a.Regiones, &a.VentanaMinutos, &a.DetectadaEn, &a.ResueltaEn)
+		if err != nil {
+			return nil, err
+		}
+		alertas = append(alertas, a)
+	}
+	return alertas, rows.Err()
+}
+
+// Marcar una alerta como resuelta; sql.ErrNoRows si no existe o ya estaba
+// resuelta
+func resolverAlertaEscaneo(db *sql.DB, alertaID int) error {
+	resultado, err := db.Exec(`
+		UPDATE AlertasEscaneo SET resuelta_en = now()
+		WHERE alerta_id = $1 AND resuelta_en IS NULL`, alertaID)
+	if err != nil {
+		return err
+	}
+	if n, err := resultado.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Handler para GET /admin/escaneos/alertas (?todas=true incluye las
+// resueltas) y POST /admin/escaneos/alertas/{id}/resolver
+func alertasEscaneoHandler(w http.ResponseWriter, r *http.Request) {
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/escaneos/alertas"), "/")
+	if ruta == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		alertas, err := obtenerAlertasEscaneo(r.Context(), r.URL.Query().Get("todas") == "true")
+		if err != nil {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(alertas)
+		return
+	}
+
+	id, accion, _ := strings.Cut(ruta, "/")
+	alertaID, err := strconv.Atoi(id)
+	if err != nil || alertaID <= 0 || accion != "resolver" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err = cerrarAlertaEscaneo(r.Context(), alertaID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Alerta no encontrada o ya resuelta", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error al actualizar la alerta", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Escaneos agrupados por país y ciudad
+type EscaneosUbicacion struct {
+	Pais         string `json:"pais"`
+	Ciudad       string `json:"ciudad"`
+	Escaneos     int    `json:"escaneos"`
+	IPs          int    `json:"ips"`
+	Certificados int    `json:"certificados"`
+}
+
+// Escaneos en [desde, hasta) por país y ciudad, los de más escaneos
+// primero; los que no se pudieron ubicar van con país y ciudad vacíos
+func consultarEscaneosPorUbicacion(db *sql.DB, desde, hasta time.Time) ([]EscaneosUbicacion, error) {
+	rows, err := db.Query(`
+		SELECT region, ciudad, count(*), count(DISTINCT ip_hash), count(DISTINCT numero_certificado)
+		FROM Escaneos
+		WHERE creado_en >= $1 AND creado_en < $2
+		GROUP BY region, ciudad
+		ORDER BY 3 DESC, 1, 2
+		LIMIT 500`, desde, hasta)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ubicaciones := []EscaneosUbicacion{}
+	for rows.Next() {
+		var u EscaneosUbicacion
+		if err := rows.Scan(&u.Pais, &u.Ciudad, &u.Escaneos, &u.IPs, &u.Certificados); err != nil {
+			return nil, err
+		}
+		ubicaciones = append(ubicaciones, u)
+	}
+	return ubicaciones, rows.Err()
+}
+
+// Handler para GET /admin/estadisticas/escaneos?desde=...&hasta=...
+func escaneosUbicacionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	desde, hasta, err := rangoFechasSolicitud(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ubicaciones, err := obtenerEscaneosPorUbicacion(r.Context(), desde, hasta)
+	if err != nil {
+		http.Error(w, "Error al consultar los escaneos", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"desde":       desde.Format(formatoFechaEstadisticas),
+		"hasta":       hasta.AddDate(0, 0, -1).Format(formatoFechaEstadisticas),
+		"ubicaciones": ubicaciones,
+	})
+}
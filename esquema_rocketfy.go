@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Validación de los productos de Rocketfy contra el esquema que espera la
+// tienda. En cada sincronización se comparan los campos recibidos con
+// esquemaProductoRocketfy: los campos desconocidos, los obligatorios que
+// faltan y los de tipo distinto se escriben en el log y se guardan en
+// CambiosEsquemaRocketfy; cada diferencia nueva se avisa una sola vez. Si
+// un campo obligatorio falta en todos los productos, Rocketfy cambió su
+// API y la sincronización se cancela para no dañar los datos de la tienda.
+
+// Tipos de valor JSON
+const (
+	tipoTexto    = "texto"
+	tipoNumero   = "número"
+	tipoBooleano = "booleano"
+	tipoLista    = "lista"
+	tipoObjeto   = "objeto"
+	tipoNulo     = "nulo"
+)
+
+// Problemas de un campo
+const (
+	CampoDesconocido = "desconocido"
+	CampoFaltante    = "faltante"
+	CampoTipo        = "tipo"
+)
+
+// Recurso de los productos en CambiosEsquemaRocketfy
+const recursoProductosRocketfy = "productos"
+
+// Campo esperado en un registro de Rocketfy
+type campoEsquema struct {
+	tipos       []string
+	obligatorio bool
+}
+
+// Campos de los productos que usa la tienda (o que Rocketfy envía y se
+// guardan sin usar). El identificador llega como id o _id.
+var esquemaProductoRocketfy = map[string]campoEsquema{
+	"id":          {tipos: []string{tipoTexto, tipoNumero}},
+	"_id":         {tipos: []string{tipoTexto, tipoNumero}},
+	"name":        {tipos: []string{tipoTexto}, obligatorio: true},
+	"sku":         {tipos: []string{tipoTexto}, obligatorio: true},
+	"price":       {tipos: []string{tipoNumero}, obligatorio: true},
+	"currency":    {tipos: []string{tipoTexto}},
+	"description": {tipos: []string{tipoTexto}},
+	"stock":       {tipos: []string{tipoNumero}},
+	"category":    {tipos: []string{tipoTexto}},
+	"images":      {tipos: []string{tipoLista}},
+	"updatedAt":   {tipos: []string{tipoTexto}},
+	"components":  {tipos: []string{tipoLista}},
+}
+
+// Diferencia entre los registros recibidos y el esquema esperado
+type DiferenciaEsquema struct {
+	Campo    string `json:"campo"`
+	Problema string `json:"problema"`
+	// Tipo recibido, para los de tipo distinto
+	Detalle string `json:"detalle,omitempty"`
+	// Registros afectados y el identificador de uno de ellos
+	Registros int    `json:"registros"`
+	Ejemplo   string `json:"ejemplo"`
+}
+
+func (d DiferenciaEsquema) String() string {
+	var texto string
+	switch d.Problema {
+	case CampoFaltante:
+		texto = fmt.Sprintf("falta el campo %q", d.Campo)
+	case CampoTipo:
+		texto = fmt.Sprintf("el campo %q cambió de tipo (%s)", d.Campo, d.Detalle)
+	default:
+		texto = fmt.Sprintf("campo desconocido %q", d.Campo)
+	}
+	return fmt.Sprintf("%s en %d registros, p. ej. %s", texto, d.Registros, d.Ejemplo)
+}
+
+func (d DiferenciaEsquema) clave() string {
+	return d.Campo + "/" + d.Problema + "/" + d.Detalle
+}
+
+// Tipo JSON de un valor decodificado
+func tipoValorJSON(valor interface{}) string {
+	switch valor.(type) {
+	case nil:
+		return tipoNulo
+	case string:
+		return tipoTexto
+	case float64, int, int64:
+		return tipoNumero
+	case bool:
+		return tipoBooleano
+	case []interface{}:
+		return tipoLista
+	case map[string]interface{}:
+		return tipoObjeto
+	}
+	return fmt.Sprintf("%T", valor)
+}
+
+// Comparar los registros con el esquema; las diferencias salen ordenadas
+// por campo
+func compararEsquema(registros []map[string]interface{}, esquema map[string]campoEsquema) []DiferenciaEsquema {
+	porClave := map[string]*DiferenciaEsquema{}
+	anotar := func(campo, problema, detalle, id string) {
+		d := DiferenciaEsquema{Campo: campo, Problema: problema, Detalle: detalle, Ejemplo: id}
+		if existente, ok := porClave[d.clave()]; ok {
+			existente.Registros++
+			return
+		}
+		d.Registros = 1
+		porClave[d.clave()] = &d
+	}
+
+	for _, registro := range registros {
+		id := idProductoRocketfy(registro)
+		for campo, valor := range registro {
+			esperado, ok := esquema[campo]
+			if !ok {
+				anotar(campo, CampoDesconocido, "", id)
+				continue
+			}
+			tipo := tipoValorJSON(valor)
+			if tipo == tipoNulo {
+				continue
+			}
+			valido := false
+			for _, t := range esperado.tipos {
+				valido = valido || t == tipo
+			}
+			if !valido {
+				anotar(campo, CampoTipo, fmt.Sprintf("se esperaba %s, llegó %s", strings.Join(esperado.tipos, " o "), tipo), id)
+			}
+		}
+		for campo, esperado := range esquema {
+			if valor, ok := registro[campo]; esperado.obligatorio && (!ok || valor == nil) {
+				anotar(campo, CampoFaltante, "", id)
+			}
+		}
+	}
+
+	diferencias := make([]DiferenciaEsquema, 0, len(porClave))
+	for _, d := range porClave {
+		diferencias = append(diferencias, *d)
+	}
+	sort.Slice(diferencias, func(i, j int) bool {
+		return diferencias[i].clave() < diferencias[j].clave()
+	})
+	return diferencias
+}
+
+// Campo obligatorio que falta en todos los registros; "" si no hay
+func campoObligatorioAusente(diferencias []DiferenciaEsquema, registros int) string {
+	for _, d := range diferencias {
+		if d.Problema == CampoFaltante && registros > 0 && d.Registros == registros {
+			return d.Campo
+		}
+	}
+	return ""
+}
+
+// Registrar en el log las diferencias de un recurso, guardarlas y avisar
+// las que no se habían visto
+func revisarCambiosEsquema(db *sql.DB, recurso string, diferencias []DiferenciaEsquema) error {
+	for _, d := range diferencias {
+		log.Printf("Esquema de %s de Rocketfy: %s", recurso, d)
+	}
+
+	nuevas, err := guardarCambiosEsquema(db, recurso, diferencias)
+	if err != nil {
+		return err
+	}
+	if len(nuevas) == 0 {
+		return nil
+	}
+	lineas := make([]string, len(nuevas))
+	for i, d := range nuevas {
+		lineas[i] = "- " + d.String()
+	}
+	avisar(AvisoCambioEsquema, fmt.Sprintf("Rocketfy cambió el formato de %s:\n%s", recurso, strings.Join(lineas, "\n")))
+	return nil
+}
+
+// Guardar las diferencias vigentes de un recurso y borrar las que ya no
+// aparecen. Devuelve las que no estaban guardadas.
+func guardarCambiosEsquema(db *sql.DB, recurso string, diferencias []DiferenciaEsquema) ([]DiferenciaEsquema, error) {
+	var nuevas []DiferenciaEsquema
+	err := enTransaccion(db, func(tx *sql.Tx) error {
+		nuevas = nil
+		claves := make([]string, len(diferencias))
+		for i, d := range diferencias {
+			claves[i] = d.clave()
+			resultado, err := tx.Exec(`
+				INSERT INTO CambiosEsquemaRocketfy (recurso, campo, problema, detalle, registros, ejemplo)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (recurso, campo, problema, detalle) DO NOTHING`,
+				recurso, d.Campo, d.Problema, d.Detalle, d.Registros, d.Ejemplo)
+			if err != nil {
+				return err
+			}
+			if n, err := resultado.RowsAffected(); err == nil && n > 0 {
+				nuevas = append(nuevas, d)
+				continue
+			}
+			_, err = tx.Exec(`
+				UPDATE CambiosEsquemaRocketfy SET registros = $5, ejemplo = $6, visto_en = now()
+				WHERE recurso = $1 AND campo = $2 AND problema = $3 AND detalle = $4`,
+				recurso, d.Campo, d.Problema, d.Detalle, d.Registros, d.Ejemplo)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`
+			DELETE FROM CambiosEsquemaRocketfy
+			WHERE recurso = $1 AND NOT (campo || '/' || problema || '/' || detalle = ANY($2))`,
+			recurso, pq.Array(claves))
+		return err
+	})
+	return nuevas, err
+}
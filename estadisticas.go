@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Estadísticas de ventas para el panel de administración. Solo cuentan las
+// compras con el pago confirmado; los ingresos son los precios cobrados
+// (con IVA si los precios lo incluyen).
+
+const (
+	formatoFechaEstadisticas = "2006-01-02"
+	rangoEstadisticas        = 30 * 24 * time.Hour
+	limiteTopEstadisticas    = 10
+)
+
+// Resumen de ventas de un rango de fechas
+type Estadisticas struct {
+	Desde                string            `json:"desde"`
+	Hasta                string            `json:"hasta"`
+	Ingresos             string            `json:"ingresos"`
+	Unidades             int               `json:"unidades"`
+	Compras              int               `json:"compras"`
+	CertificadosEmitidos int               `json:"certificados_emitidos"`
+	TopProductos         []ProductoVendido `json:"top_productos"`
+	TopCiudades          []CiudadVentas    `json:"top_ciudades"`
+}
+
+type ProductoVendido struct {
+	ProductoID int    `json:"producto_id"`
+	Nombre     string `json:"nombre"`
+	Unidades   int    `json:"unidades"`
+	Ingresos   string `json:"ingresos"`
+}
+
+type CiudadVentas struct {
+	Ciudad   string `json:"ciudad"`
+	Compras  int    `json:"compras"`
+	Ingresos string `json:"ingresos"`
+}
+
+// Calcular las estadísticas del rango [desde, hasta)
+func consultarEstadisticas(db *sql.DB, desde, hasta time.Time) (*Estadisticas, error) {
+	e := Estadisticas{
+		Desde:        desde.Format(formatoFechaEstadisticas),
+		Hasta:        hasta.AddDate(0, 0, -1).Format(formatoFechaEstadisticas),
+		TopProductos: []ProductoVendido{},
+		TopCiudades:  []CiudadVentas{},
+	}
+
+	err := db.QueryRow(`
+		SELECT coalesce(sum(dc.cantidad * dc.precio_unitario), 0)::text,
+			coalesce(sum(dc.cantidad), 0),
+			count(DISTINCT com.compra_id)
+		FROM Compras com
+		JOIN DetallesCompra dc ON dc.compra_id = com.compra_id
+		WHERE com.estado_pago = $1 AND com.fecha_compra >= $2 AND com.fecha_compra < $3`,
+		estadoPagoConfirmado, desde, hasta).Scan(&e.Ingresos, &e.Unidades, &e.Compras)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.QueryRow(`SELECT count(*) FROM Certificados WHERE fecha_emision >= $1 AND fecha_emision < $2`,
+		desde, hasta).Scan(&e.CertificadosEmitidos)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT p.producto_id, p.nombre, sum(dc.cantidad), coalesce(sum(dc.cantidad * dc.precio_unitario), 0)::text
+		FROM Compras com
+		JOIN DetallesCompra dc ON dc.compra_id = com.compra_id
+		JOIN Productos p ON p.producto_id = dc.producto_id
+		WHERE com.estado_pago = $1 AND com.fecha_compra >= $2 AND com.fecha_compra < $3
+		GROUP BY p.producto_id, p.nombre
+		ORDER BY sum(dc.cantidad) DESC, p.nombre
+		LIMIT $4`, estadoPagoConfirmado, desde, hasta, limiteTopEstadisticas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p ProductoVendido
+		if err := rows.Scan(&p.ProductoID, &p.Nombre, &p.Unidades, &p.Ingresos); err != nil {
+			return nil, err
+		}
+		e.TopProductos = append(e.TopProductos, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT coalesce(nullif(c.ciudad, ''), 'Sin ciudad'), count(DISTINCT com.compra_id),
+			coalesce(sum(dc.cantidad * dc.precio_unitario), 0)::text
+		FROM Compras com
+		JOIN Clientes c ON c.cliente_id = com.cliente_id
+		JOIN DetallesCompra dc ON dc.compra_id = com.compra_id
+		WHERE com.estado_pago = $1 AND com.fecha_compra >= $2 AND com.fecha_compra < $3
+		GROUP BY 1
+		ORDER BY 2 DESC, 1
+		LIMIT $4`, estadoPagoConfirmado, desde, hasta, limiteTopEstadisticas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CiudadVentas
+		if err := rows.Scan(&c.Ciudad, &c.Compras, &c.Ingresos); err != nil {
+			return nil, err
+		}
+		e.TopCiudades = append(e.TopCiudades, c)
+	}
+
+	return &e, rows.Err()
+}
+
+// Leer el rango desde/hasta (AAAA-MM-DD, hasta inclusive) de la query
+// string; por defecto los últimos 30 días
+func rangoFechasSolicitud(r *http.Request) (time.Time, time.Time, error) {
+	hoy := time.Now().In(zonaHoraria)
+	hasta := time.Date(hoy.Year(), hoy.Month(), hoy.Day(), 0, 0, 0, 0, zonaHoraria).AddDate(0, 0, 1)
+	desde := hasta.Add(-rangoEstadisticas)
+
+	if valor := r.URL.Query().Get("desde"); valor != "" {
+		t, err := time.ParseInLocation(formatoFechaEstadisticas, valor, zonaHoraria)
+		if err != nil {
+			return desde, hasta, errors.New("desde debe tener el formato AAAA-MM-DD")
+		}
+		desde = t
+	}
+	if valor := r.URL.Query().Get("hasta"); valor != "" {
+		t, err := time.ParseInLocation(formatoFechaEstadisticas, valor, zonaHoraria)
+		if err != nil {
+			return desde, hasta, errors.New("hasta debe tener el formato AAAA-MM-DD")
+		}
+		hasta = t.AddDate(0, 0, 1)
+	}
+	if !hasta.After(desde) {
+		return desde, hasta, errors.New("hasta debe ser posterior a desde")
+	}
+	return desde, hasta, nil
+}
+
+// Handler para GET /admin/estadisticas?desde=2024-05-01&hasta=2024-05-31
+func estadisticasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	desde, hasta, err := rangoFechasSolicitud(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	estadisticas, err := obtenerEstadisticas(r.Context(), desde, hasta)
+	if err != nil {
+		http.Error(w, "Error al calcular las estadísticas", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(estadisticas)
+}
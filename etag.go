@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Política de caché para los certificados, que pueden revocarse
+const cacheCertificados = "private, no-cache"
+
+// Política de caché para los productos según cache.max_age_productos
+func cacheControlProductos() string {
+	return "public, max-age=" + strconv.Itoa(configActual().Cache.MaxAgeProductos)
+}
+
+// Responder un valor en JSON con ETag calculado sobre el contenido. Si el
+// cliente ya tiene esa versión (If-None-Match) se responde 304 sin cuerpo.
+// El ETag es débil porque el cuerpo puede viajar comprimido.
+func responderJSONConETag(w http.ResponseWriter, r *http.Request, valor interface{}, cacheControl string) error {
+	body, err := json.Marshal(valor)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	suma := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(suma[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	if coincideETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(body)
+	return err
+}
+
+// Comparación débil de If-None-Match contra un ETag
+func coincideETag(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidato := range strings.Split(ifNoneMatch, ",") {
+		candidato = strings.TrimSpace(candidato)
+		if candidato == "*" || strings.TrimPrefix(candidato, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
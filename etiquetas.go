@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Códigos de barras Code 128 de los certificados y hojas de etiquetas en
+// PDF para el equipo de despacho.
+
+// Disposición de la hoja: 3 x 7 etiquetas de 63,5 x 38,1 mm en A4
+const (
+	columnasEtiquetas   = 3
+	filasEtiquetas      = 7
+	anchoEtiqueta       = 180.0
+	altoEtiqueta        = 108.0
+	margenHojaX         = 27.0
+	margenHojaY         = 43.0
+	maximoEtiquetasHoja = 210
+	// Largo máximo del texto de /certificados/{numero}/barcode.png
+	largoMaximoCodigoBarras = 40
+)
+
+// Handler para GET /certificados/{numero}/barcode.png (escala opcional
+// 1-6), que no revela si el certificado existe
+func codigoBarrasHandler(w http.ResponseWriter, r *http.Request, numero string) {
+	escala := 2
+	if valor := r.URL.Query().Get("escala"); valor != "" {
+		n, err := strconv.Atoi(valor)
+		if err != nil || n < 1 || n > 6 {
+			http.Error(w, "escala debe estar entre 1 y 6", http.StatusBadRequest)
+			return
+		}
+		escala = n
+	}
+
+	// Solo se codifica el número recibido, sin consultar la base: una
+	// respuesta distinta para los números inexistentes permitiría probarlos
+	// sin pasar por los tokens de verificación
+	if numero == "" || len(numero) > largoMaximoCodigoBarras {
+		http.Error(w, "Número de certificado inválido", http.StatusBadRequest)
+		return
+	}
+	img, err := imagenCode128(numero, escala, 40*escala)
+	if err != nil {
+		http.Error(w, "Número de certificado inválido", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, "Error al generar el código de barras", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(buf.Bytes())
+}
+
+// Dibujar una etiqueta con la esquina inferior izquierda en (x, y)
+func dibujarEtiqueta(pdf *documentoPDF, x, y float64, data *CertificateData) error {
+	modulos, err := modulosCode128(data.NumeroCertificado)
+	if err != nil {
+		return err
+	}
+
+	pdf.texto(x+10, y+altoEtiqueta-18, 9, true, "Melenas Co")
+	pdf.texto(x+65, y+altoEtiqueta-18, 7, false, "Certificado de autenticidad")
+
+	// Las barras ocupan el ancho útil de la etiqueta
+	anchoModulo := (anchoEtiqueta - 20) / float64(len(modulos))
+	for i := 0; i < len(modulos); {
+		if !modulos[i] {
+			i++
+			continue
+		}
+		inicio := i
+		for i < len(modulos) && modulos[i] {
+			i++
+		}
+		pdf.rectangulo(x+10+float64(inicio)*anchoModulo, y+32, float64(i-inicio)*anchoModulo, 48)
+	}
+
+	pdf.texto(x+(anchoEtiqueta-anchoTextoPDF(data.NumeroCertificado, 10))/2, y+20, 10, false, data.NumeroCertificado)
+
+	producto := textoOVacio(data.NombreProducto)
+	if len(data.Productos) > 1 {
+		producto = fmt.Sprintf("%s y %d más", producto, len(data.Productos)-1)
+	}
+	if runas := []rune(producto); len(runas) > 40 {
+		producto = string(runas[:37]) + "..."
+	}
+	pdf.texto(x+10, y+8, 7, false, producto)
+	return nil
+}
+
+// Handler para la hoja de etiquetas en PDF:
+// /admin/etiquetas.pdf?numeros=MC-XXX,MC-YYY (se puede repetir un número
+// para imprimir varias copias)
+func hojaEtiquetasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var numeros []string
+	for _, numero := range strings.Split(r.URL.Query().Get("numeros"), ",") {
+		if numero = strings.TrimSpace(numero); numero != "" {
+			numeros = append(numeros, numero)
+		}
+	}
+	if len(numeros) == 0 {
+		http.Error(w, "numeros requerido", http.StatusBadRequest)
+		return
+	}
+	if len(numeros) > maximoEtiquetasHoja {
+		http.Error(w, fmt.Sprintf("Máximo %d etiquetas por solicitud", maximoEtiquetasHoja), http.StatusBadRequest)
+		return
+	}
+
+	pdf := &documentoPDF{}
+	porPagina := columnasEtiquetas * filasEtiquetas
+	for i, numero := range numeros {
+		data, err := obtenerCertificado(r.Context(), numero)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Certificado no encontrado: "+numero, http.StatusNotFound)
+			} else {
+				http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			}
+			logSolicitud(r.Context(), err)
+			return
+		}
+
+		posicion := i % porPagina
+		if posicion == 0 {
+			pdf.nuevaPagina()
+		}
+		columna, fila := posicion%columnasEtiquetas, posicion/columnasEtiquetas
+		x := margenHojaX + float64(columna)*anchoEtiqueta
+		y := altoA4 - margenHojaY - float64(fila+1)*altoEtiqueta
+		if err := dibujarEtiqueta(pdf, x, y, data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="etiquetas.pdf"`)
+	w.Write(pdf.bytes())
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tipos de eventos publicados en tiempo real
+const (
+	EventoCertificadoEmitido   = "certificado_emitido"
+	EventoCertificadoRevocado  = "certificado_revocado"
+	EventoCertificadoReemitido = "certificado_reemitido"
+	EventoWebhookRecibido      = "webhook_recibido"
+	EventoClienteAnonimizado   = "cliente_anonimizado"
+	EventoFacturaEmitida       = "factura_emitida"
+	EventoCompraRegistrada     = "compra_registrada"
+	EventoPagoActualizado      = "compra_pago_actualizado"
+	EventoCompraReembolsada    = "compra_reembolsada"
+	EventoClientesFusionados   = "clientes_fusionados"
+	EventoEscaneosAnomalos     = "escaneos_anomalos"
+	EventoCertificadoSenuelo   = "certificado_senuelo_consultado"
+)
+
+// Origen de una compra en los eventos de compra
+const (
+	OrigenCompraRocketfy = "rocketfy"
+	OrigenCompraVentas   = "importacion"
+)
+
+// Datos publicados en los eventos de compra y de cambio de estado de pago
+type EventoCompra struct {
+	CompraID       int       `json:"compra_id"`
+	ClienteID      int       `json:"cliente_id,omitempty"`
+	EstadoPago     string    `json:"estado_pago"`
+	EstadoAnterior string    `json:"estado_anterior,omitempty"`
+	Origen         string    `json:"origen,omitempty"`
+	RocketfyID     string    `json:"rocketfy_id,omitempty"`
+	Fecha          time.Time `json:"fecha"`
+}
+
+// Intervalo entre comentarios de keep-alive en el stream SSE
+const intervaloKeepAlive = 15 * time.Second
+
+// Evento de dominio distribuido a los suscriptores
+type Evento struct {
+	Tipo  string      `json:"tipo"`
+	Datos interface{} `json:"datos"`
+	Fecha time.Time   `json:"fecha"`
+}
+
+// Distribuidor en memoria de eventos hacia los suscriptores conectados
+type busEventos struct {
+	mu           sync.Mutex
+	suscriptores map[chan Evento]struct{}
+}
+
+var eventos = &busEventos{suscriptores: map[chan Evento]struct{}{}}
+
+func (b *busEventos) suscribir() chan Evento {
+	canal := make(chan Evento, 16)
+	b.mu.Lock()
+	b.suscriptores[canal] = struct{}{}
+	b.mu.Unlock()
+	return canal
+}
+
+func (b *busEventos) cancelar(canal chan Evento) {
+	b.mu.Lock()
+	delete(b.suscriptores, canal)
+	b.mu.Unlock()
+}
+
+// Publicar un evento a todos los suscriptores sin bloquear al emisor;
+// los suscriptores lentos pierden el evento
+func publicarEvento(tipo string, datos interface{}) {
+	evento := Evento{Tipo: tipo, Datos: datos, Fecha: time.Now()}
+
+	eventos.mu.Lock()
+	defer eventos.mu.Unlock()
+	for canal := range eventos.suscriptores {
+		select {
+		case canal <- evento:
+		default:
+			log.Printf("Evento %s descartado para un suscriptor lento", tipo)
+		}
+	}
+}
+
+// Handler para el stream de eventos del panel de administración (SSE)
+func eventosHandler(w http.ResponseWriter, r *http.Request) {
+	// EventSource no permite encabezados personalizados, por lo que también
+	// se acepta el token en la query string
+	if !esAdmin(r) && !tokenAdminValido(r.URL.Query().Get("token")) {
+		if r.Header.Get("Authorization") != "" || r.URL.Query().Get("token") != "" {
+			registrarFallo(r, FalloLogin)
+		}
+		http.Error(w, "No autorizado", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming no soportado", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	canal := eventos.suscribir()
+	defer eventos.cancelar(canal)
+
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(intervaloKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case evento := <-canal:
+			data, err := json.Marshal(evento)
+			if err != nil {
+				logSolicitud(r.Context(), err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evento.Tipo, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Registros relacionados en la misma respuesta con
+// ?expand=cliente,producto,envio, para que el frontend no tenga que hacer
+// una llamada por cada uno. Se resuelven en pocas consultas con joins: una
+// sobre la compra con su cliente y su envío, otra para los productos y,
+// si hay envío, otra para su historial. El teléfono del cliente y el
+// envío de un certificado solo se incluyen para los administradores.
+
+// Valores admitidos en ?expand=
+const (
+	ExpandirCliente  = "cliente"
+	ExpandirProducto = "producto"
+	ExpandirEnvio    = "envio"
+)
+
+var (
+	errExpansionInvalida = errors.New("expand solo admite cliente, producto y envio")
+	errExpansionNoAdmin  = errors.New("expand=envio requiere el token de administrador")
+)
+
+// Registros relacionados pedidos
+type expansiones struct {
+	cliente  bool
+	producto bool
+	envio    bool
+}
+
+func (e expansiones) ninguna() bool {
+	return !e.cliente && !e.producto && !e.envio
+}
+
+// Expansiones de ?expand=; error si se pide una que no existe
+func expansionesSolicitadas(r *http.Request) (expansiones, error) {
+	var e expansiones
+	for _, valor := range strings.Split(r.URL.Query().Get("expand"), ",") {
+		switch strings.TrimSpace(valor) {
+		case "":
+		case ExpandirCliente:
+			e.cliente = true
+		case ExpandirProducto:
+			e.producto = true
+		case ExpandirEnvio:
+			e.envio = true
+		default:
+			return e, errExpansionInvalida
+		}
+	}
+	return e, nil
+}
+
+// Cliente de una compra con ?expand=cliente
+type ClienteRelacionado struct {
+	ClienteID int     `json:"cliente_id"`
+	Nombre    *string `json:"nombre"`
+	Apellido  *string `json:"apellido"`
+	Email     *string `json:"email"`
+	// Solo para los administradores
+	Telefono *string `json:"telefono,omitempty"`
+	Ciudad   *string `json:"ciudad"`
+}
+
+// Producto del catálogo con ?expand=producto
+type ProductoRelacionado struct {
+	ProductoID  int     `json:"producto_id"`
+	SKU         *string `json:"sku"`
+	Nombre      *string `json:"nombre"`
+	Categoria   *string `json:"categoria"`
+	TipoCabello *string `json:"tipo_cabello"`
+	Color       *string `json:"color"`
+	Longitud    *string `json:"longitud"`
+	ImagenURL   *string `json:"imagen_url"`
+}
+
+// Compra para GET /admin/compras/{id}
+type CompraDetalle struct {
+	CompraID          int           `json:"compra_id"`
+	ClienteID         int           `json:"cliente_id"`
+	FechaCompra       *Fecha        `json:"fecha_compra"`
+	EstadoPago        *string       `json:"estado_pago"`
+	ReferenciaPago    *string       `json:"referencia_pago"`
+	NumeroCertificado *string       `json:"numero_certificado"`
+	Lineas            []LineaCompra `json:"lineas"`
+	EliminadoEn       *Fecha        `json:"eliminado_en,omitempty"`
+	// Con ?expand=cliente y ?expand=envio; envio queda vacío si la compra
+	// no tiene guía
+	Cliente *ClienteRelacionado `json:"cliente,omitempty"`
+	Envio   *Envio              `json:"envio,omitempty"`
+}
+
+// Línea de una compra; producto solo con ?expand=producto
+type LineaCompra struct {
+	ProductoID     int                  `json:"producto_id"`
+	Cantidad       int                  `json:"cantidad"`
+	PrecioUnitario *string              `json:"precio_unitario"`
+	Producto       *ProductoRelacionado `json:"producto,omitempty"`
+}
+
+// Leer una compra con sus líneas y los registros relacionados pedidos. El
+// cliente y el envío salen del mismo join que la compra; el teléfono solo
+// se descifra para los administradores.
+func consultarCompra(db *sql.DB, compraID int, incluirEliminados bool, expandir expansiones, admin bool) (*CompraDetalle, error) {
+	compra := CompraDetalle{CompraID: compraID, Lineas: []LineaCompra{}}
+	var cliente ClienteRelacionado
+	var email, emailCifrado, telefono, telefonoCifrado sql.NullString
+	var envioID sql.NullInt64
+	var transportadora, numeroGuia, estadoEnvio, estadoTransportadora sql.NullString
+	var envio Envio
+	err := db.QueryRow(`
+		SELECT
+			com.cliente_id,
+			com.fecha_compra,
+			com.estado_pago,
+			com.referencia_pago,
+			cer.numero_certificado,
+			c.eliminado_en,
+			c.nombre,
+			c.apellido,
+			c.email,
+			c.email_cifrado,
+			c.telefono,
+			c.telefono_cifrado,
+			c.ciudad,
+			e.envio_id,
+			e.transportadora,
+			e.numero_guia,
+			e.estado,
+			e.estado_transportadora,
+			e.consultado_en,
+			e.entregado_en
+		FROM Compras com
+		JOIN Clientes c ON c.cliente_id = com.cliente_id
+		LEFT JOIN Certificados cer ON cer.certificado_id = com.certificado_id
+		LEFT JOIN Envios e ON e.compra_id = com.compra_id
+		WHERE com.compra_id = $1
+			AND (c.eliminado_en IS NULL OR $2)`, compraID, incluirEliminados).Scan(
+		&compra.ClienteID, &compra.FechaCompra, &compra.EstadoPago, &compra.ReferenciaPago, &compra.NumeroCertificado,
+		&compra.EliminadoEn, &cliente.Nombre, &cliente.Apellido, &email, &emailCifrado, &telefono, &telefonoCifrado,
+		&cliente.Ciudad, &envioID, &transportadora, &numeroGuia, &estadoEnvio, &estadoTransportadora,
+		&envio.ConsultadoEn, &envio.EntregadoEn)
+	if err == sql.ErrNoRows {
+		return nil, errCompraNoEncontrada
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if expandir.cliente {
+		cliente.ClienteID = compra.ClienteID
+		cliente.Email, err = valorPII(email, emailCifrado)
+		if err != nil {
+			return nil, err
+		}
+		if admin {
+			cliente.Telefono, err = valorPII(telefono, telefonoCifrado)
+			if err != nil {
+				return nil, err
+			}
+		}
+		compra.Cliente = &cliente
+	}
+
+	if expandir.envio && envioID.Valid {
+		envio.CompraID = compraID
+		envio.Transportadora = transportadora.String
+		envio.NumeroGuia = numeroGuia.String
+		envio.Estado = estadoEnvio.String
+		envio.EstadoTransportadora = estadoTransportadora.String
+		envio.Historial, err = consultarHistorialEnvio(db, envioID.Int64)
+		if err != nil {
+			return nil, err
+		}
+		compra.Envio = &envio
+	}
+
+	rows, err := db.Query(`
+		SELECT dc.producto_id, dc.cantidad, dc.precio_unitario::text,
+			p.sku, p.nombre, p.categoria, p.tipo_cabello, p.color, p.longitud, p.imagen_url
+		FROM DetallesCompra dc
+		JOIN Productos p ON p.producto_id = dc.producto_id
+		WHERE dc.compra_id = $1
+		ORDER BY dc.producto_id`, compraID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var linea LineaCompra
+		var producto ProductoRelacionado
+		err := rows.Scan(&linea.ProductoID, &linea.Cantidad, &linea.PrecioUnitario,
+			&producto.SKU, &producto.Nombre, &producto.Categoria, &producto.TipoCabello, &producto.Color,
+			&producto.Longitud, &producto.ImagenURL)
+		if err != nil {
+			return nil, err
+		}
+		if expandir.producto {
+			producto.ProductoID = linea.ProductoID
+			linea.Producto = &producto
+		}
+		compra.Lineas = append(compra.Lineas, linea)
+	}
+	return &compra, rows.Err()
+}
+
+// Productos del catálogo por identificador, en una sola consulta
+func consultarProductosRelacionados(db *sql.DB, ids []int) (map[int]*ProductoRelacionado, error) {
+	productos := make(map[int]*ProductoRelacionado, len(ids))
+	if len(ids) == 0 {
+		return productos, nil
+	}
+	rows, err := db.Query(`
+		SELECT producto_id, sku, nombre, categoria, tipo_cabello, color, longitud, imagen_url
+		FROM Productos
+		WHERE producto_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p ProductoRelacionado
+		err := rows.Scan(&p.ProductoID, &p.SKU, &p.Nombre, &p.Categoria, &p.TipoCabello, &p.Color, &p.Longitud, &p.ImagenURL)
+		if err != nil {
+			return nil, err
+		}
+		productos[p.ProductoID] = &p
+	}
+	return productos, rows.Err()
+}
+
+// Código HTTP para los errores de las expansiones
+func estadoErrorExpansion(err error) int {
+	switch err {
+	case errExpansionInvalida:
+		return http.StatusBadRequest
+	case errExpansionNoAdmin:
+		return http.StatusForbidden
+	case errCompraNoEncontrada:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// Handler para GET /admin/compras/{id}?expand=cliente,producto,envio
+func compraAdminHandler(w http.ResponseWriter, r *http.Request, compraID int) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	expandir, err := expansionesSolicitadas(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compra, err := obtenerCompra(contextoIncluirEliminados(r), compraID, expandir, true)
+	if err != nil {
+		if estado := estadoErrorExpansion(err); estado != http.StatusInternalServerError {
+			http.Error(w, err.Error(), estado)
+		} else {
+			http.Error(w, "Error al consultar la compra", estado)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(compra)
+}
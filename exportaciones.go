@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Exportaciones grandes por streaming: las filas se leen por páginas con un
+// cursor por identificador (WHERE id > cursor ORDER BY id LIMIT n) y cada
+// página se escribe y se envía al cliente antes de leer la siguiente, así
+// la memoria no crece con la cantidad de registros. Cada página es una
+// lectura corta que no mantiene una transacción abierta durante toda la
+// descarga. Si la lectura falla a mitad de la respuesta se corta la
+// conexión para que el cliente no tome el archivo incompleto por completo.
+
+// Filas por página de las exportaciones
+const tamanoPaginaExportacion = 1000
+
+// Formatos de las exportaciones por streaming
+const (
+	FormatoExportacionCSV   = "csv"
+	FormatoExportacionJSONL = "jsonl"
+)
+
+// Leer una consulta por páginas con un cursor por identificador. leer
+// consulta las filas con identificador mayor a despuesDe (como máximo
+// limite) y devuelve el último identificador y cuántas leyó; emitir escribe
+// la página leída antes de pasar a la siguiente.
+func recorrerPorCursor(ctx context.Context, nombre string, leer func(db *sql.DB, despuesDe int64, limite int) (int64, int, error), emitir func() error) error {
+	var cursor int64
+	for {
+		var ultimo int64
+		var filas int
+		err := trazarLectura(ctx, nombre, func(db *sql.DB) error {
+			var err error
+			ultimo, filas, err = leer(db, cursor, tamanoPaginaExportacion)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if filas == 0 {
+			return nil
+		}
+		if err := emitir(); err != nil {
+			return err
+		}
+		if filas < tamanoPaginaExportacion {
+			return nil
+		}
+		cursor = ultimo
+	}
+}
+
+// Certificado en la exportación de /admin/certificados/export
+type CertificadoExportado struct {
+	id                int64
+	NumeroCertificado string   `json:"numero_certificado"`
+	Version           int      `json:"version"`
+	FechaEmision      *Fecha   `json:"fecha_emision"`
+	Revocado          bool     `json:"revocado"`
+	ReemplazadoPor    *string  `json:"reemplazado_por,omitempty"`
+	CompraID          *int     `json:"compra_id"`
+	FechaCompra       *Fecha   `json:"fecha_compra"`
+	EstadoPago        *string  `json:"estado_pago"`
+	ClienteID         *int     `json:"cliente_id"`
+	NombreCliente     *string  `json:"nombre_cliente"`
+	ApellidoCliente   *string  `json:"apellido_cliente"`
+	Productos         []string `json:"productos"`
+	EliminadoEn       *Fecha   `json:"eliminado_en,omitempty"`
+}
+
+var encabezadoExportacionCertificados = []string{
+	"numero_certificado", "version", "fecha_emision", "revocado", "reemplazado_por", "compra_id",
+	"fecha_compra", "estado_pago", "cliente_id", "nombre_cliente", "apellido_cliente", "productos", "eliminado_en",
+}
+
+func (c CertificadoExportado) registro() []string {
+	fecha := func(f *Fecha) string {
+		if f == nil {
+			return ""
+		}
+		return f.In(zonaHoraria).Format(time.RFC3339)
+	}
+	entero := func(n *int) string {
+		if n == nil {
+			return ""
+		}
+		return strconv.Itoa(*n)
+	}
+	return []string{
+		c.NumeroCertificado, strconv.Itoa(c.Version), fecha(c.FechaEmision), strconv.FormatBool(c.Revocado),
+		textoOVacio(c.ReemplazadoPor), entero(c.CompraID), fecha(c.FechaCompra), textoOVacio(c.EstadoPago),
+		entero(c.ClienteID), textoOVacio(c.NombreCliente), textoOVacio(c.ApellidoCliente), strings.Join(c.Productos, "; "), fecha(c.EliminadoEn),
+	}
+}
+
+// Página de certificados con certificado_id mayor a despuesDe. Sin email ni
+// teléfono de los clientes; para eso está /admin/clientes/{id}/datos.
+func consultarPaginaCertificados(db *sql.DB, despuesDe int64, limite int, incluirEliminados bool) ([]CertificadoExportado, error) {
+	rows, err := db.Query(`
+		SELECT
+			cer.certificado_id,
+			cer.numero_certificado,
+			cer.version,
+			cer.fecha_emision,
+			cer.revocado_en IS NOT NULL,
+			vig.numero_certificado,
+			com.compra_id,
+			com.fecha_compra,
+			com.estado_pago,
+			c.cliente_id,
+			coalesce(cer.nombre_titular, c.nombre),
+			coalesce(cer.apellido_titular, c.apellido),
+			coalesce((
+				SELECT array_agg(p.nombre ORDER BY p.producto_id)
+				FROM DetallesCompra dc
+				JOIN Productos p ON p.producto_id = dc.producto_id
+				WHERE dc.compra_id = com.compra_id
+			), '{}'),
+			coalesce(cer.eliminado_en, c.eliminado_en)
+		FROM Certificados cer
+		LEFT JOIN Certificados vig ON vig.certificado_id = cer.vigente_id
+		LEFT JOIN Compras com ON com.certificado_id = coalesce(cer.vigente_id, cer.certificado_id)
+		LEFT JOIN Clientes c ON c.cliente_id = com.cliente_id
+		WHERE cer.certificado_id > $1
+			AND (cer.eliminado_en IS NULL AND c.eliminado_en IS NULL OR $3)
+		ORDER BY cer.certificado_id
+		LIMIT $2`, despuesDe, limite, incluirEliminados)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pagina []CertificadoExportado
+	for rows.Next() {
+		var c CertificadoExportado
+		err := rows.Scan(&c.id, &c.NumeroCertificado, &c.Version, &c.FechaEmision, &c.Revocado, &c.ReemplazadoPor,
+			&c.CompraID, &c.FechaCompra, &c.EstadoPago, &c.ClienteID, &c.NombreCliente, &c.ApellidoCliente,
+			pq.Array(&c.Productos), &c.EliminadoEn)
+		if err != nil {
+			return nil, err
+		}
+		pagina = append(pagina, c)
+	}
+	return pagina, rows.Err()
+}
+
+// Escritor de filas CSV o JSON Lines que envía cada página al cliente
+type escritorExportacion struct {
+	w      http.ResponseWriter
+	csv    *csv.Writer
+	json   *json.Encoder
+	salida *salidaIniciada
+}
+
+// Preparar la respuesta de una exportación; el encabezado CSV se escribe
+// con la primera página
+func nuevoEscritorExportacion(w http.ResponseWriter, formato, nombre string) *escritorExportacion {
+	e := &escritorExportacion{w: w, salida: &salidaIniciada{Writer: w}}
+	if formato == FormatoExportacionJSONL {
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		e.json = json.NewEncoder(e.salida)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		e.csv = csv.NewWriter(e.salida)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, nombre, formato))
+	w.Header().Set("Cache-Control", "no-store")
+	return e
+}
+
+// Escribir una fila: registro para CSV, valor para JSON Lines
+func (e *escritorExportacion) escribir(registro []string, valor interface{}) error {
+	if e.json != nil {
+		return e.json.Encode(valor)
+	}
+	return e.csv.Write(registro)
+}
+
+// Enviar al cliente lo escrito hasta ahora
+func (e *escritorExportacion) enviar() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Terminar la respuesta tras un error: 500 si todavía no se envió nada o
+// cortar la conexión si ya salió parte del archivo
+func (e *escritorExportacion) fallar(r *http.Request, err error, mensaje string) {
+	logSolicitud(r.Context(), err)
+	if e.salida.iniciada {
+		panic(http.ErrAbortHandler)
+	}
+	e.w.Header().Del("Content-Disposition")
+	http.Error(e.w, mensaje, http.StatusInternalServerError)
+}
+
+func formatoExportacion(r *http.Request) (string, bool) {
+	switch formato := r.URL.Query().Get("formato"); formato {
+	case "", FormatoExportacionCSV:
+		return FormatoExportacionCSV, true
+	case FormatoExportacionJSONL:
+		return formato, true
+	}
+	return "", false
+}
+
+// Handler para GET /admin/certificados/export?formato=csv|jsonl: todos los
+// certificados (con include_deleted=true también los eliminados)
+func exportarCertificadosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	formato, ok := formatoExportacion(r)
+	if !ok {
+		http.Error(w, "formato debe ser csv o jsonl", http.StatusBadRequest)
+		return
+	}
+	ctx := contextoIncluirEliminados(r)
+
+	escritor := nuevoEscritorExportacion(w, formato, "certificados-"+time.Now().Format("20060102"))
+	if formato == FormatoExportacionCSV {
+		escritor.csv.Write(encabezadoExportacionCertificados)
+	}
+	err := recorrerCertificados(ctx, incluirEliminados(ctx), func(pagina []CertificadoExportado) error {
+		for _, c := range pagina {
+			if err := escritor.escribir(c.registro(), c); err != nil {
+				return err
+			}
+		}
+		return escritor.enviar()
+	})
+	if err == nil {
+		err = escritor.enviar()
+	}
+	if err != nil {
+		escritor.fallar(r, err, "Error al exportar los certificados")
+	}
+}
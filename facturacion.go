@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Facturación electrónica DIAN. Cada compra genera una factura en UBL 2.1
+// con su CUFE y una representación gráfica en PDF; el proveedor tecnológico
+// configurado firma el XML y lo transmite a la DIAN. Los montos se manejan
+// en centavos.
+
+// Estados de una factura
+const (
+	FacturaPendiente = "pendiente"
+	FacturaAceptada  = "aceptada"
+	FacturaRechazada = "rechazada"
+)
+
+// Identificación del adquirente cuando la venta es a consumidor final
+const documentoConsumidorFinal = "222222222222"
+
+const timeoutProveedorFacturacion = 30 * time.Second
+
+var (
+	errFacturacionNoConfigurada = errors.New("La facturación electrónica no está configurada")
+	errCompraFacturada          = errors.New("La compra ya tiene una factura")
+	errCompraSinPrecios         = errors.New("La compra no tiene precios registrados")
+	errRangoFacturacionAgotado  = errors.New("Se agotó el rango de numeración autorizado")
+	errFacturaInexistente       = errors.New("Factura no encontrada")
+	errFacturaAceptada          = errors.New("La factura ya fue aceptada")
+)
+
+// Factura emitida para una compra
+type Factura struct {
+	FacturaID int    `json:"factura_id"`
+	CompraID  int    `json:"compra_id"`
+	Numero    string `json:"numero"`
+	Estado    string `json:"estado"`
+	CUFE      string `json:"cufe"`
+	Total     string `json:"total"`
+	Mensaje   string `json:"mensaje,omitempty"`
+	EmitidaEn Fecha  `json:"emitida_en"`
+	EnviadaEn *Fecha `json:"enviada_en"`
+}
+
+// Línea de la factura con su IVA ya liquidado
+type lineaFactura struct {
+	Descripcion string
+	Cantidad    int
+	TarifaIVA   int64
+	Base        int64
+	IVA         int64
+}
+
+// Precio unitario antes de IVA
+func (l lineaFactura) precioUnitario() int64 {
+	if l.Cantidad <= 0 {
+		return l.Base
+	}
+	return l.Base / int64(l.Cantidad)
+}
+
+// Desglose de IVA por tarifa
+type impuestoFactura struct {
+	Tarifa int64
+	Base   int64
+	Valor  int64
+}
+
+// Datos con los que se generan el XML, el CUFE y el PDF
+type documentoFactura struct {
+	Prefijo   string
+	Numero    int64
+	Emision   time.Time
+	Cliente   string
+	Email     string
+	Lineas    []lineaFactura
+	Impuestos []impuestoFactura
+	Subtotal  int64
+	IVA       int64
+	Total     int64
+}
+
+func (d *documentoFactura) numeroCompleto() string {
+	return d.Prefijo + strconv.FormatInt(d.Numero, 10)
+}
+
+// Monto en centavos con dos decimales y punto decimal
+func formatoMonto(centavos int64) string {
+	return fmt.Sprintf("%d.%02d", centavos/100, centavos%100)
+}
+
+// Leer un monto no negativo con hasta dos decimales ("1250000", "99.5")
+func parsearMonto(valor string) (int64, error) {
+	enteros, decimales, _ := strings.Cut(strings.TrimSpace(valor), ".")
+	if enteros == "" || len(decimales) > 2 {
+		return 0, fmt.Errorf("monto inválido: %q", valor)
+	}
+	decimales += strings.Repeat("0", 2-len(decimales))
+	e, err := strconv.ParseInt(enteros, 10, 64)
+	if err != nil || e < 0 {
+		return 0, fmt.Errorf("monto inválido: %q", valor)
+	}
+	d, err := strconv.ParseInt(decimales, 10, 64)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("monto inválido: %q", valor)
+	}
+	return e*100 + d, nil
+}
+
+// Sumar las líneas y agrupar el IVA por tarifa
+func (d *documentoFactura) totalizar() {
+	d.Impuestos, d.Subtotal, d.IVA = nil, 0, 0
+	for _, linea := range d.Lineas {
+		d.Subtotal += linea.Base
+		d.IVA += linea.IVA
+		agrupado := false
+		for i := range d.Impuestos {
+			if d.Impuestos[i].Tarifa == linea.TarifaIVA {
+				d.Impuestos[i].Base += linea.Base
+				d.Impuestos[i].Valor += linea.IVA
+				agrupado = true
+			}
+		}
+		if !agrupado {
+			d.Impuestos = append(d.Impuestos, impuestoFactura{Tarifa: linea.TarifaIVA, Base: linea.Base, Valor: linea.IVA})
+		}
+	}
+	d.Total = d.Subtotal + d.IVA
+}
+
+// Código Único de Factura Electrónica (anexo técnico DIAN 1.8): SHA-384 de
+// la concatenación de los datos de la factura. Solo se discrimina IVA
+// (01); INC (04) e ICA (03) van en cero.
+func calcularCUFE(d *documentoFactura) string {
+	c := config.Facturacion
+	fecha := d.Emision.In(zonaHoraria)
+	cadena := d.numeroCompleto() +
+		fecha.Format("2006-01-02") + fecha.Format("15:04:05-07:00") +
+		formatoMonto(d.Subtotal) +
+		"01" + formatoMonto(d.IVA) +
+		"04" + formatoMonto(0) +
+		"03" + formatoMonto(0) +
+		formatoMonto(d.Total) +
+		c.NIT + documentoConsumidorFinal + c.ClaveTecnica + c.Ambiente
+	suma := sha512.Sum384([]byte(cadena))
+	return hex.EncodeToString(suma[:])
+}
+
+// Estructuras UBL 2.1 (solo los elementos que genera este módulo; las
+// extensiones de firma las agrega el proveedor tecnológico)
+type montoUBL struct {
+	Moneda string `xml:"currencyID,attr"`
+	Valor  string `xml:",chardata"`
+}
+
+type idUBL struct {
+	Esquema string `xml:"schemeName,attr,omitempty"`
+	DV      string `xml:"schemeID,attr,omitempty"`
+	Valor   string `xml:",chardata"`
+}
+
+type parteUBL struct {
+	Nombre      string       `xml:"cac:PartyName>cbc:Name"`
+	RazonSocial string       `xml:"cac:PartyTaxScheme>cbc:RegistrationName"`
+	Documento   idUBL        `xml:"cac:PartyTaxScheme>cbc:CompanyID"`
+	Contacto    *contactoUBL `xml:"cac:Contact,omitempty"`
+}
+
+type contactoUBL struct {
+	Email string `xml:"cbc:ElectronicMail"`
+}
+
+type subtotalImpuestoUBL struct {
+	Base       montoUBL `xml:"cbc:TaxableAmount"`
+	Valor      montoUBL `xml:"cbc:TaxAmount"`
+	Porcentaje string   `xml:"cac:TaxCategory>cbc:Percent"`
+	Tributo    string   `xml:"cac:TaxCategory>cac:TaxScheme>cbc:ID"`
+	Nombre     string   `xml:"cac:TaxCategory>cac:TaxScheme>cbc:Name"`
+}
+
+type totalImpuestoUBL struct {
+	Valor      montoUBL              `xml:"cbc:TaxAmount"`
+	Subtotales []subtotalImpuestoUBL `xml:"cac:TaxSubtotal"`
+}
+
+func impuestoUBL(impuestos ...impuestoFactura) totalImpuestoUBL {
+	var total totalImpuestoUBL
+	var valor int64
+	for _, impuesto := range impuestos {
+		valor += impuesto.Valor
+		total.Subtotales = append(total.Subtotales, subtotalImpuestoUBL{
+			Base:       cop(impuesto.Base),
+			Valor:      cop(impuesto.Valor),
+			Porcentaje: formatoMonto(impuesto.Tarifa),
+			Tributo:    "01",
+			Nombre:     "IVA",
+		})
+	}
+	total.Valor = cop(valor)
+	return total
+}
+
+type lineaUBL struct {
+	ID          int              `xml:"cbc:ID"`
+	Cantidad    int              `xml:"cbc:InvoicedQuantity"`
+	Total       montoUBL         `xml:"cbc:LineExtensionAmount"`
+	Impuesto    totalImpuestoUBL `xml:"cac:TaxTotal"`
+	Descripcion string           `xml:"cac:Item>cbc:Description"`
+	Precio      montoUBL         `xml:"cac:Price>cbc:PriceAmount"`
+}
+
+type facturaUBL struct {
+	XMLName           xml.Name         `xml:"Invoice"`
+	Xmlns             string           `xml:"xmlns,attr"`
+	XmlnsCac          string           `xml:"xmlns:cac,attr"`
+	XmlnsCbc          string           `xml:"xmlns:cbc,attr"`
+	UBLVersion        string           `xml:"cbc:UBLVersionID"`
+	Personalizacion   string           `xml:"cbc:CustomizationID"`
+	Ambiente          string           `xml:"cbc:ProfileExecutionID"`
+	ID                string           `xml:"cbc:ID"`
+	CUFE              idUBL            `xml:"cbc:UUID"`
+	FechaEmision      string           `xml:"cbc:IssueDate"`
+	HoraEmision       string           `xml:"cbc:IssueTime"`
+	TipoFactura       string           `xml:"cbc:InvoiceTypeCode"`
+	Nota              string           `xml:"cbc:Note,omitempty"`
+	Moneda            string           `xml:"cbc:DocumentCurrencyCode"`
+	CantidadLineas    int              `xml:"cbc:LineCountNumeric"`
+	Emisor            parteUBL         `xml:"cac:AccountingSupplierParty>cac:Party"`
+	Adquirente        parteUBL         `xml:"cac:AccountingCustomerParty>cac:Party"`
+	Impuestos         totalImpuestoUBL `xml:"cac:TaxTotal"`
+	Subtotal          montoUBL         `xml:"cac:LegalMonetaryTotal>cbc:LineExtensionAmount"`
+	BaseImponible     montoUBL         `xml:"cac:LegalMonetaryTotal>cbc:TaxExclusiveAmount"`
+	TotalConImpuestos montoUBL         `xml:"cac:LegalMonetaryTotal>cbc:TaxInclusiveAmount"`
+	TotalAPagar       montoUBL         `xml:"cac:LegalMonetaryTotal>cbc:PayableAmount"`
+	Lineas            []lineaUBL       `xml:"cac:InvoiceLine"`
+}
+
+func cop(centavos int64) montoUBL {
+	return montoUBL{Moneda: "COP", Valor: formatoMonto(centavos)}
+}
+
+// Generar el XML UBL 2.1 de la factura
+func generarXMLFactura(d *documentoFactura, cufe string) ([]byte, error) {
+	c := config.Facturacion
+	fecha := d.Emision.In(zonaHoraria)
+	var baseGravada int64
+	for _, impuesto := range d.Impuestos {
+		if impuesto.Tarifa > 0 {
+			baseGravada += impuesto.Base
+		}
+	}
+	factura := facturaUBL{
+		Xmlns:           "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2",
+		XmlnsCac:        "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2",
+		XmlnsCbc:        "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2",
+		UBLVersion:      "UBL 2.1",
+		Personalizacion: "10",
+		Ambiente:        c.Ambiente,
+		ID:              d.numeroCompleto(),
+		CUFE:            idUBL{Esquema: "CUFE-SHA384", DV: c.Ambiente, Valor: cufe},
+		FechaEmision:    fecha.Format("2006-01-02"),
+		HoraEmision:     fecha.Format("15:04:05-07:00"),
+		TipoFactura:     "01",
+		Nota:            "Resolución DIAN " + c.Resolucion,
+		Moneda:          "COP",
+		CantidadLineas:  len(d.Lineas),
+		Emisor: parteUBL{
+			Nombre:      c.RazonSocial,
+			RazonSocial: c.RazonSocial,
+			Documento:   idUBL{Esquema: "31", DV: c.DV, Valor: c.NIT},
+		},
+		Adquirente: parteUBL{
+			Nombre:      d.Cliente,
+			RazonSocial: d.Cliente,
+			Documento:   idUBL{Esquema: "13", Valor: documentoConsumidorFinal},
+		},
+		Impuestos:         impuestoUBL(d.Impuestos...),
+		Subtotal:          cop(d.Subtotal),
+		BaseImponible:     cop(baseGravada),
+		TotalConImpuestos: cop(d.Total),
+		TotalAPagar:       cop(d.Total),
+	}
+	if d.Email != "" {
+		factura.Adquirente.Contacto = &contactoUBL{Email: d.Email}
+	}
+	for i, linea := range d.Lineas {
+		factura.Lineas = append(factura.Lineas, lineaUBL{
+			ID:          i + 1,
+			Cantidad:    linea.Cantidad,
+			Total:       cop(linea.Base),
+			Impuesto:    impuestoUBL(impuestoFactura{Tarifa: linea.TarifaIVA, Base: linea.Base, Valor: linea.IVA}),
+			Descripcion: linea.Descripcion,
+			Precio:      cop(linea.precioUnitario()),
+		})
+	}
+
+	contenido, err := xml.MarshalIndent(factura, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Error al generar el XML de la factura: %v", err)
+	}
+	return append([]byte(xml.Header), contenido...), nil
+}
+
+// Representación gráfica de la factura en PDF
+func generarPDFFactura(d *documentoFactura, cufe string) []byte {
+	c := config.Facturacion
+	margen := 50.0
+	y := altoA4 - 60
+
+	var pdf documentoPDF
+	pdf.nuevaPagina()
+	pdf.texto(margen, y, 16, true, c.RazonSocial)
+	pdf.texto(margen, y-18, 9, false, "NIT "+c.NIT+"-"+c.DV)
+	titulo := "Factura electrónica de venta " + d.numeroCompleto()
+	pdf.texto(anchoA4-margen-anchoTextoPDF(titulo, 11), y, 11, true, titulo)
+	emision := "Emitida el " + d.Emision.In(zonaHoraria).Format("02/01/2006 15:04")
+	pdf.texto(anchoA4-margen-anchoTextoPDF(emision, 9), y-18, 9, false, emision)
+
+	y -= 60
+	pdf.texto(margen, y, 10, true, "Cliente")
+	pdf.texto(margen, y-14, 10, false, d.Cliente+" - CC "+documentoConsumidorFinal)
+	if d.Email != "" {
+		pdf.texto(margen, y-28, 9, false, d.Email)
+	}
+
+	y -= 60
+	columnas := []float64{margen, 290, 340, 410, 480}
+	for i, titulo := range []string{"Descripción", "Cantidad", "Precio", "IVA", "Total"} {
+		pdf.texto(columnas[i], y, 9, true, titulo)
+	}
+	pdf.rectangulo(margen, y-5, anchoA4-2*margen, 0.5)
+	for _, linea := range d.Lineas {
+		y -= 16
+		pdf.texto(columnas[0], y, 9, false, linea.Descripcion)
+		pdf.texto(columnas[1], y, 9, false, strconv.Itoa(linea.Cantidad))
+		pdf.texto(columnas[2], y, 9, false, formatoMonto(linea.precioUnitario()))
+		pdf.texto(columnas[3], y, 9, false, formatoMonto(linea.TarifaIVA)+" %")
+		pdf.texto(columnas[4], y, 9, false, formatoMonto(linea.Base))
+	}
+
+	y -= 12
+	pdf.rectangulo(margen, y, anchoA4-2*margen, 0.5)
+	y -= 16
+	pdf.texto(columnas[2], y, 9, false, "Subtotal")
+	pdf.texto(columnas[4], y, 9, false, formatoMonto(d.Subtotal))
+	for _, impuesto := range d.Impuestos {
+		y -= 14
+		pdf.texto(columnas[2], y, 9, false, fmt.Sprintf("IVA %s %% sobre %s", formatoMonto(impuesto.Tarifa), formatoMonto(impuesto.Base)))
+		pdf.texto(columnas[4], y, 9, false, formatoMonto(impuesto.Valor))
+	}
+	y -= 16
+	pdf.texto(columnas[2], y, 10, true, "Total COP")
+	pdf.texto(columnas[4], y, 10, true, formatoMonto(d.Total))
+
+	y -= 40
+	pdf.texto(margen, y, 8, true, "CUFE")
+	pdf.texto(margen, y-12, 7, false, cufe[:len(cufe)/2])
+	pdf.texto(margen, y-22, 7, false, cufe[len(cufe)/2:])
+	pdf.texto(margen, y-40, 7, false, fmt.Sprintf("Resolución DIAN %s, numeración %s%d a %s%d",
+		c.Resolucion, c.Prefijo, c.RangoDesde, c.Prefijo, c.RangoHasta))
+	return pdf.bytes()
+}
+
+// Generar y guardar la factura de una compra. La numeración se asigna
+// bloqueando la tabla para que no haya huecos ni repetidos.
+func insertarFactura(db *sql.DB, compraID int) (*Factura, error) {
+	c := config.Facturacion
+	if c.NIT == "" || c.Prefijo == "" {
+		return nil, errFacturacionNoConfigurada
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var nombre, apellido, email, emailCifrado sql.NullString
+	err = tx.QueryRow(`
+		SELECT c.nombre, c.apellido, c.email, c.email_cifrado
+		FROM Compras com
+		JOIN Clientes c ON c.cliente_id = com.cliente_id
+		WHERE com.compra_id = $1
+		FOR UPDATE OF com`, compraID).Scan(&nombre, &apellido, &email, &emailCifrado)
+	if err == sql.ErrNoRows {
+		return nil, errCompraNoEncontrada
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var existe bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM Facturas WHERE compra_id = $1)`, compraID).Scan(&existe)
+	if err != nil {
+		return nil, err
+	}
+	if existe {
+		return nil, errCompraFacturada
+	}
+
+	documento := documentoFactura{
+		Prefijo: c.Prefijo,
+		Cliente: strings.TrimSpace(nombre.String + " " + apellido.String),
+		Emision: time.Now(),
+	}
+	if documento.Cliente == "" {
+		documento.Cliente = "Consumidor final"
+	}
+	emailPlano, err := valorPII(email, emailCifrado)
+	if err != nil {
+		return nil, err
+	}
+	if emailPlano != nil {
+		documento.Email = *emailPlano
+	}
+
+	_, err = calcularImpuestosCompra(tx, compraID)
+	if err != nil {
+		return nil, err
+	}
+	documento.Lineas, err = consultarLineasFactura(tx, compraID)
+	if err != nil {
+		return nil, err
+	}
+	documento.totalizar()
+
+	_, err = tx.Exec(`LOCK TABLE Facturas IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`SELECT coalesce(max(numero) + 1, $2) FROM Facturas WHERE prefijo = $1`,
+		c.Prefijo, c.RangoDesde).Scan(&documento.Numero)
+	if err != nil {
+		return nil, err
+	}
+	if documento.Numero > c.RangoHasta {
+		return nil, errRangoFacturacionAgotado
+	}
+
+	cufe := calcularCUFE(&documento)
+	contenidoXML, err := generarXMLFactura(&documento, cufe)
+	if err != nil {
+		return nil, err
+	}
+
+	factura := Factura{
+		CompraID:  compraID,
+		Numero:    documento.numeroCompleto(),
+		Estado:    FacturaPendiente,
+		CUFE:      cufe,
+		Total:     formatoMonto(documento.Total),
+		EmitidaEn: Fecha{documento.Emision},
+	}
+	err = tx.QueryRow(`
+		INSERT INTO Facturas (compra_id, prefijo, numero, cufe, xml, pdf, total, emitida_en)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING factura_id`, compraID, documento.Prefijo, documento.Numero, cufe, string(contenidoXML),
+		generarPDFFactura(&documento, cufe), factura.Total, documento.Emision).Scan(&factura.FacturaID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = registrarEventoOutbox(tx, EventoFacturaEmitida, factura)
+	if err != nil {
+		return nil, err
+	}
+
+	return &factura, tx.Commit()
+}
+
+// Líneas de la compra con el IVA liquidado por calcularImpuestosCompra
+func consultarLineasFactura(tx *sql.Tx, compraID int) ([]lineaFactura, error) {
+	rows, err := tx.Query(`
+		SELECT p.nombre, dc.cantidad, (dc.tarifa_iva * 100)::bigint, (dc.base * 100)::bigint, (dc.iva * 100)::bigint
+		FROM DetallesCompra dc
+		JOIN Productos p ON p.producto_id = dc.producto_id
+		WHERE dc.compra_id = $1
+		ORDER BY p.nombre`, compraID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lineas []lineaFactura
+	for rows.Next() {
+		var linea lineaFactura
+		if err := rows.Scan(&linea.Descripcion, &linea.Cantidad, &linea.TarifaIVA, &linea.Base, &linea.IVA); err != nil {
+			return nil, err
+		}
+		lineas = append(lineas, linea)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(lineas) == 0 {
+		return nil, errCompraSinPrecios
+	}
+	return lineas, nil
+}
+
+func consultarFactura(db *sql.DB, facturaID int) (*Factura, error) {
+	var f Factura
+	var prefijo string
+	var numero int64
+	var enviada sql.NullTime
+	err := db.QueryRow(`
+		SELECT factura_id, compra_id, prefijo, numero, estado, cufe, total::text, mensaje, emitida_en, enviada_en
+		FROM Facturas WHERE factura_id = $1`, facturaID).
+		Scan(&f.FacturaID, &f.CompraID, &prefijo, &numero, &f.Estado, &f.CUFE, &f.Total, &f.Mensaje, &f.EmitidaEn, &enviada)
+	if err == sql.ErrNoRows {
+		return nil, errFacturaInexistente
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Numero = prefijo + strconv.FormatInt(numero, 10)
+	if enviada.Valid {
+		f.EnviadaEn = &Fecha{enviada.Time}
+	}
+	return &f, nil
+}
+
+// Contenido XML o PDF guardado de una factura
+func consultarDocumentoFactura(db *sql.DB, facturaID int, columna string) ([]byte, error) {
+	var contenido []byte
+	err := db.QueryRow(`SELECT `+columna+` FROM Facturas WHERE factura_id = $1`, facturaID).Scan(&contenido)
+	if err == sql.ErrNoRows {
+		return nil, errFacturaInexistente
+	}
+	return contenido, err
+}
+
+// Respuesta esperada del proveedor tecnológico
+type respuestaProveedorFactura struct {
+	Estado  string `json:"estado"`
+	CUFE    string `json:"cufe"`
+	PDF     string `json:"pdf"`
+	Mensaje string `json:"mensaje"`
+}
+
+// Enviar la factura al proveedor tecnológico y guardar el resultado. El
+// proveedor recibe el XML sin firmar en base64 y responde con el estado
+// de validación de la DIAN y, opcionalmente, su propia representación
+// gráfica, que reemplaza a la generada localmente.
+func transmitirFactura(db *sql.DB, facturaID int) (*Factura, error) {
+	c := configActual().Facturacion
+	if c.URLProveedor == "" {
+		return nil, errFacturacionNoConfigurada
+	}
+
+	var prefijo, estado, cufe, contenidoXML string
+	var numero int64
+	err := db.QueryRow(`SELECT prefijo, numero, estado, cufe, xml FROM Facturas WHERE factura_id = $1`, facturaID).
+		Scan(&prefijo, &numero, &estado, &cufe, &contenidoXML)
+	if err == sql.ErrNoRows {
+		return nil, errFacturaInexistente
+	}
+	if err != nil {
+		return nil, err
+	}
+	if estado == FacturaAceptada {
+		return nil, errFacturaAceptada
+	}
+
+	respuesta, errEnvio := enviarFacturaProveedor(c.URLProveedor, c.TokenProveedor, map[string]interface{}{
+		"prefijo": prefijo,
+		"numero":  numero,
+		"cufe":    cufe,
+		"xml":     base64.StdEncoding.EncodeToString([]byte(contenidoXML)),
+	})
+	if errEnvio != nil {
+		// La factura queda pendiente para reintentar el envío
+		_, err = db.Exec(`UPDATE Facturas SET mensaje = $2 WHERE factura_id = $1`, facturaID, errEnvio.Error())
+		if err != nil {
+			return nil, err
+		}
+		return nil, errEnvio
+	}
+
+	estado = FacturaRechazada
+	if respuesta.Estado == FacturaAceptada {
+		estado = FacturaAceptada
+	}
+	if respuesta.CUFE != "" {
+		cufe = respuesta.CUFE
+	}
+	var pdf []byte
+	if respuesta.PDF != "" {
+		pdf, err = base64.StdEncoding.DecodeString(respuesta.PDF)
+		if err != nil {
+			return nil, fmt.Errorf("Error al decodificar el PDF del proveedor: %v", err)
+		}
+	}
+
+	_, err = db.Exec(`
+		UPDATE Facturas SET estado = $2, cufe = $3, mensaje = $4, pdf = coalesce($5, pdf), enviada_en = now()
+		WHERE factura_id = $1`, facturaID, estado, cufe, respuesta.Mensaje, pdf)
+	if err != nil {
+		return nil, err
+	}
+	return consultarFactura(db, facturaID)
+}
+
+func enviarFacturaProveedor(url, token string, datos interface{}) (*respuestaProveedorFactura, error) {
+	body, err := json.Marshal(datos)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(url, "/")+"/facturas", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: timeoutProveedorFacturacion}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error al enviar la factura al proveedor: %v", err)
+	}
+	defer resp.Body.Close()
+
+	contenido, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("El proveedor de facturación respondió con código de estado: %d", resp.StatusCode)
+	}
+
+	var respuesta respuestaProveedorFactura
+	err = json.Unmarshal(contenido, &respuesta)
+	if err != nil {
+		return nil, fmt.Errorf("Error al leer la respuesta del proveedor: %v", err)
+	}
+	return &respuesta, nil
+}
+
+func estadoErrorFactura(err error) int {
+	switch err {
+	case errCompraNoEncontrada, errFacturaInexistente:
+		return http.StatusNotFound
+	case errCompraFacturada, errFacturaAceptada, errRangoFacturacionAgotado:
+		return http.StatusConflict
+	case errCompraSinPrecios:
+		return http.StatusUnprocessableEntity
+	case errFacturacionNoConfigurada:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Handler para las facturas:
+//   - POST /admin/facturas {"compra_id": 123} emite y envía la factura
+//   - GET /admin/facturas/{id}, /admin/facturas/{id}/xml y /admin/facturas/{id}/pdf
+//   - POST /admin/facturas/{id}/enviar reintenta el envío al proveedor
+func facturasHandler(w http.ResponseWriter, r *http.Request) {
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/facturas"), "/")
+	if ruta == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		var solicitud struct {
+			CompraID int `json:"compra_id"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&solicitud)
+		if err != nil || solicitud.CompraID <= 0 {
+			http.Error(w, "compra_id requerido", http.StatusBadRequest)
+			return
+		}
+
+		factura, err := facturarCompra(solicitud.CompraID)
+		if err != nil {
+			responderErrorFactura(w, r, err, "Error al emitir la factura")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(factura)
+		return
+	}
+
+	id, accion, _ := strings.Cut(ruta, "/")
+	facturaID, err := strconv.Atoi(id)
+	if err != nil || facturaID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case accion == "enviar" && r.Method == "POST":
+		factura, err := reenviarFactura(facturaID)
+		if err != nil {
+			responderErrorFactura(w, r, err, "Error al enviar la factura")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(factura)
+
+	case (accion == "xml" || accion == "pdf") && r.Method == "GET":
+		contenido, err := obtenerDocumentoFactura(r.Context(), facturaID, accion)
+		if err != nil {
+			responderErrorFactura(w, r, err, "Error al consultar la factura")
+			return
+		}
+		if accion == "xml" {
+			w.Header().Set("Content-Type", "application/xml")
+		} else {
+			w.Header().Set("Content-Type", "application/pdf")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=factura-%d.%s", facturaID, accion))
+		w.Write(contenido)
+
+	case accion == "" && r.Method == "GET":
+		factura, err := obtenerFactura(r.Context(), facturaID)
+		if err != nil {
+			responderErrorFactura(w, r, err, "Error al consultar la factura")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(factura)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func responderErrorFactura(w http.ResponseWriter, r *http.Request, err error, mensaje string) {
+	estado := estadoErrorFactura(err)
+	if estado == http.StatusInternalServerError {
+		http.Error(w, mensaje, estado)
+	} else {
+		http.Error(w, err.Error(), estado)
+	}
+	logSolicitud(r.Context(), err)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Factura de un pedido de Rocketfy: los precios leídos del pedido son los
+// que se guardan en DetallesCompra, se liquidan con el IVA de la categoría
+// y terminan en el total, el CUFE y el XML.
+func TestFacturaPedidoSincronizado(t *testing.T) {
+	anterior := config
+	defer func() { config = anterior }()
+	config.Impuestos.IVAPorDefecto = 19
+	config.Impuestos.PreciosIncluyenIVA = true
+	config.Facturacion.NIT = "900123456"
+	config.Facturacion.ClaveTecnica = "clave"
+	config.Facturacion.Ambiente = "2"
+
+	pedido, problema := leerPedidoRocketfy(map[string]interface{}{
+		"id":            "ord-1",
+		"createdAt":     "2024-03-01T10:00:00Z",
+		"paymentStatus": "paid",
+		"customer":      map[string]interface{}{"email": "ana@example.com", "firstName": "Ana Gómez"},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "PEL-1", "quantity": float64(2), "price": float64(1190000)},
+			map[string]interface{}{"sku": "CEP-1", "quantity": "1", "price": "59500.50"},
+		},
+	})
+	if problema != "" {
+		t.Fatalf("pedido rechazado: %s", problema)
+	}
+	if pedido.EstadoPago != estadoPagoConfirmado {
+		t.Fatalf("estado = %q, se esperaba %q", pedido.EstadoPago, estadoPagoConfirmado)
+	}
+
+	documento := documentoFactura{
+		Prefijo: "MC",
+		Numero:  1,
+		Emision: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		Cliente: "Ana Gómez",
+	}
+	for _, p := range pedido.Productos {
+		if p.Precio == nil {
+			t.Fatalf("SKU %s sin precio", p.SKU)
+		}
+		tarifa, base, iva := liquidarLinea(p.Cantidad, *p.Precio, "", true)
+		documento.Lineas = append(documento.Lineas, lineaFactura{
+			Descripcion: p.SKU, Cantidad: p.Cantidad, TarifaIVA: tarifa, Base: base, IVA: iva,
+		})
+	}
+	documento.totalizar()
+
+	if documento.Total != 2*119000000+5950050 {
+		t.Errorf("total = %d, se esperaba el del pedido %d", documento.Total, 2*119000000+5950050)
+	}
+	if documento.Subtotal+documento.IVA != documento.Total || documento.IVA == 0 {
+		t.Errorf("desglose inconsistente: subtotal %d, IVA %d, total %d", documento.Subtotal, documento.IVA, documento.Total)
+	}
+
+	cufe := calcularCUFE(&documento)
+	if len(cufe) != 96 {
+		t.Errorf("CUFE de %d caracteres, se esperaban 96", len(cufe))
+	}
+	xml, err := generarXMLFactura(&documento, cufe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, esperado := range []string{cufe, formatoMonto(documento.Total), "MC1"} {
+		if !strings.Contains(string(xml), esperado) {
+			t.Errorf("el XML no contiene %q", esperado)
+		}
+	}
+}
+
+func TestPedidoPrecioInvalido(t *testing.T) {
+	_, problema := leerPedidoRocketfy(map[string]interface{}{
+		"id":        "ord-2",
+		"createdAt": "2024-03-01",
+		"customer":  map[string]interface{}{"email": "ana@example.com"},
+		"items":     []interface{}{map[string]interface{}{"sku": "PEL-1", "price": "gratis"}},
+	})
+	if !strings.Contains(problema, "precio inválido") {
+		t.Errorf("problema = %q, se esperaba un precio inválido", problema)
+	}
+}
+
+// CUFE calculado con la cadena del anexo técnico: fecha y hora en la zona
+// del negocio y montos con dos decimales
+func TestCalcularCUFE(t *testing.T) {
+	anterior, zonaAnterior := config, zonaHoraria
+	defer func() { config, zonaHoraria = anterior, zonaAnterior }()
+	bogota, err := time.LoadLocation("America/Bogota")
+	if err != nil {
+		t.Skip("sin base de zonas horarias:", err)
+	}
+	zonaHoraria = bogota
+	config.Facturacion.NIT = "900123456"
+	config.Facturacion.ClaveTecnica = "fc8eac422eba16e22ffd8c6f94b3f40a6e38162c"
+	config.Facturacion.Ambiente = "2"
+
+	casos := []struct {
+		nombre    string
+		documento documentoFactura
+		esperado  string
+	}{
+		{
+			"misma fecha",
+			documentoFactura{Prefijo: "SETP", Numero: 990000001,
+				Emision:  time.Date(2024, 3, 1, 15, 30, 0, 0, time.UTC),
+				Subtotal: 10000000, IVA: 1900000, Total: 11900000},
+			"9922e1b9c194328b9cc4b5f7c99eb655a0db276459d0a6cfc9070c77e216578657e803f7a895c090b1843277cbbe4866",
+		},
+		{
+			// 02:00 UTC todavía es el día anterior en Bogotá
+			"día anterior en la zona",
+			documentoFactura{Prefijo: "SETP", Numero: 990000002,
+				Emision:  time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC),
+				Subtotal: 840336, IVA: 159664, Total: 1000000},
+			"472d2a14b5b6e26374c739b996689f6748b34dce15a767cbb7b8646a94b6bd3fb6e6350ba7fc850cadfeeabf63bc2119",
+		},
+	}
+	for _, caso := range casos {
+		if cufe := calcularCUFE(&caso.documento); cufe != caso.esperado {
+			t.Errorf("%s: CUFE %s, se esperaba %s", caso.nombre, cufe, caso.esperado)
+		}
+	}
+}
+
+func TestMontos(t *testing.T) {
+	formatos := map[int64]string{0: "0.00", 5: "0.05", 99950: "999.50", 119000000: "1190000.00"}
+	for centavos, esperado := range formatos {
+		if texto := formatoMonto(centavos); texto != esperado {
+			t.Errorf("formatoMonto(%d) = %s, se esperaba %s", centavos, texto, esperado)
+		}
+	}
+
+	casos := []struct {
+		valor    string
+		centavos int64
+		valido   bool
+	}{
+		{"1250000", 125000000, true},
+		{"99.5", 9950, true},
+		{" 0.05 ", 5, true},
+		{"10.", 1000, true},
+		{"", 0, false},
+		{".50", 0, false},
+		{"1.005", 0, false},
+		{"-3", 0, false},
+		{"1.-5", 0, false},
+		{"1,50", 0, false},
+	}
+	for _, caso := range casos {
+		centavos, err := parsearMonto(caso.valor)
+		if (err == nil) != caso.valido || centavos != caso.centavos {
+			t.Errorf("parsearMonto(%q) = %d, %v; se esperaba %d, válido %v", caso.valor, centavos, err, caso.centavos, caso.valido)
+		}
+	}
+}
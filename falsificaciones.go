@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Reportes de falsificaciones (POST /reportar_falsificacion) de quienes
+// escanearon un producto sospechoso. Se guardan con sus fotos (en el
+// almacenamiento de archivos, almacenamiento.go), se avisan al equipo por
+// los mismos canales del formulario de contacto y se cruzan con las
+// verificaciones registradas del certificado: un número que nunca se
+// verificó o que ya tiene otros reportes es más sospechoso.
+
+const (
+	maximoFotosFalsificacion         = 5
+	tamanoMaximoFotoFalsificacion    = 5 << 20
+	longitudMinimaDescripcionReporte = 10
+	longitudMaximaDescripcionReporte = 5000
+	longitudMaximaLugarReporte       = 200
+)
+
+// Tipos de imagen aceptados y la extensión con la que se guardan
+var extensionesFotoFalsificacion = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/webp": "webp",
+}
+
+// Reporte de una posible falsificación
+type ReporteFalsificacion struct {
+	ID                int      `json:"id"`
+	NumeroCertificado string   `json:"numero_certificado,omitempty"`
+	Descripcion       string   `json:"descripcion"`
+	Email             string   `json:"email,omitempty"`
+	Lugar             string   `json:"lugar,omitempty"`
+	Latitud           *float64 `json:"latitud,omitempty"`
+	Longitud          *float64 `json:"longitud,omitempty"`
+	Fotos             []string `json:"fotos"`
+	CreadoEn          *Fecha   `json:"creado_en,omitempty"`
+	// Cruce con los certificados y las verificaciones, para el aviso al
+	// equipo y el listado de administración
+	Correlacion *CorrelacionFalsificacion `json:"correlacion,omitempty"`
+	ip          string
+	agente      string
+}
+
+// Lo que se sabe del número reportado
+type CorrelacionFalsificacion struct {
+	CertificadoExiste   bool   `json:"certificado_existe"`
+	Revocado            bool   `json:"revocado"`
+	Verificaciones      int    `json:"verificaciones"`
+	PrimeraVerificacion *Fecha `json:"primera_verificacion,omitempty"`
+	UltimaVerificacion  *Fecha `json:"ultima_verificacion,omitempty"`
+	// Otros reportes del mismo número
+	OtrosReportes int `json:"otros_reportes"`
+	// Si el número tiene una alerta de escaneos anómalos abierta
+	AlertaEscaneos bool `json:"alerta_escaneos"`
+}
+
+// Foto recibida con el reporte
+type fotoFalsificacion struct {
+	contenido []byte
+	tipo      string
+}
+
+// Validar y limpiar los campos del reporte; devuelve el primer problema
+func validarReporteFalsificacion(rep *ReporteFalsificacion) string {
+	rep.NumeroCertificado = strings.ToUpper(strings.TrimSpace(rep.NumeroCertificado))
+	rep.Descripcion = strings.TrimSpace(rep.Descripcion)
+	rep.Email = strings.TrimSpace(rep.Email)
+	rep.Lugar = strings.TrimSpace(rep.Lugar)
+
+	if n := utf8.RuneCountInString(rep.Descripcion); n < longitudMinimaDescripcionReporte || n > longitudMaximaDescripcionReporte {
+		return fmt.Sprintf("descripcion debe tener entre %d y %d caracteres", longitudMinimaDescripcionReporte, longitudMaximaDescripcionReporte)
+	}
+	if rep.Email != "" {
+		if direccion, err := mail.ParseAddress(rep.Email); err != nil || direccion.Address != rep.Email {
+			return "email inválido"
+		}
+	}
+	if utf8.RuneCountInString(rep.Lugar) > longitudMaximaLugarReporte {
+		return fmt.Sprintf("lugar demasiado largo (máximo %d caracteres)", longitudMaximaLugarReporte)
+	}
+	if (rep.Latitud == nil) != (rep.Longitud == nil) {
+		return "latitud y longitud van juntas"
+	}
+	if rep.Latitud != nil && (*rep.Latitud < -90 || *rep.Latitud > 90 || *rep.Longitud < -180 || *rep.Longitud > 180) {
+		return "latitud o longitud fuera de rango"
+	}
+	return ""
+}
+
+// Leer las fotos del formulario multipart y validar su tipo y tamaño
+func leerFotosFalsificacion(r *http.Request) ([]fotoFalsificacion, string) {
+	if r.MultipartForm == nil {
+		return nil, ""
+	}
+	archivos := r.MultipartForm.File["fotos"]
+	if len(archivos) > maximoFotosFalsificacion {
+		return nil, fmt.Sprintf("Máximo %d fotos por reporte", maximoFotosFalsificacion)
+	}
+
+	var fotos []fotoFalsificacion
+	for _, archivo := range archivos {
+		if archivo.Size > tamanoMaximoFotoFalsificacion {
+			return nil, fmt.Sprintf("Cada foto puede pesar máximo %d MB", tamanoMaximoFotoFalsificacion>>20)
+		}
+		f, err := archivo.Open()
+		if err != nil {
+			return nil, "Cuerpo inválido"
+		}
+		contenido, err := io.ReadAll(io.LimitReader(f, tamanoMaximoFotoFalsificacion+1))
+		f.Close()
+		if err != nil || len(contenido) > tamanoMaximoFotoFalsificacion {
+			return nil, "Cuerpo inválido"
+		}
+		tipo := http.DetectContentType(contenido)
+		if _, ok := extensionesFotoFalsificacion[tipo]; !ok {
+			return nil, "Las fotos deben ser JPEG, PNG o WebP"
+		}
+		fotos = append(fotos, fotoFalsificacion{contenido: contenido, tipo: tipo})
+	}
+	return fotos, ""
+}
+
+func insertarReporteFalsificacion(db *sql.DB, rep *ReporteFalsificacion) error {
+	return db.QueryRow(`
+		INSERT INTO ReportesFalsificacion
+			(numero_certificado, descripcion, email, lugar, latitud, longitud, fotos, ip, user_agent)
+		VALUES (NULLIF($1, ''), $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''))
+		RETURNING reporte_id, creado_en`,
+		rep.NumeroCertificado, rep.Descripcion, rep.Email, rep.Lugar, rep.Latitud, rep.Longitud,
+		pq.Array(rep.Fotos), rep.ip, rep.agente).Scan(&rep.ID, &rep.CreadoEn)
+}
+
+// Reportes más recientes primero con su correlación; con reporteID solo
+// ese reporte
+func consultarReportesFalsificacion(db *sql.DB, reporteID, limite int) ([]ReporteFalsificacion, error) {
+	rows, err := db.Query(`
+		SELECT
+			r.reporte_id, coalesce(r.numero_certificado, ''), r.descripcion, coalesce(r.email, ''),
+			coalesce(r.lugar, ''), r.latitud, r.longitud, r.fotos, r.creado_en,
+			cer.certificado_id IS NOT NULL, coalesce(cer.revocado_en IS NOT NULL, false),
+			coalesce(v.cantidad, 0), v.primera, v.ultima,
+			(SELECT count(*) FROM ReportesFalsificacion o
+			 WHERE o.numero_certificado = r.numero_certificado AND o.reporte_id <> r.reporte_id),
+			EXISTS (SELECT 1 FROM AlertasEscaneo a
+			 WHERE a.numero_certificado = r.numero_certificado AND a.resuelta_en IS NULL)
+		FROM ReportesFalsificacion r
+		LEFT JOIN Certificados cer ON cer.numero_certificado = r.numero_certificado
+		LEFT JOIN LATERAL (
+			SELECT sum(cantidad) AS cantidad, min(dia) AS primera, max(dia) AS ultima
+			FROM Verificaciones WHERE numero_certificado = r.numero_certificado
+		) v ON true
+		WHERE $1 = 0 OR r.reporte_id = $1
+		ORDER BY r.creado_en DESC, r.reporte_id DESC
+		LIMIT $2`, reporteID, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reportes := []ReporteFalsificacion{}
+	for rows.Next() {
+		var rep ReporteFalsificacion
+		var c CorrelacionFalsificacion
+		err := rows.Scan(&rep.ID, &rep.NumeroCertificado, &rep.Descripcion, &rep.Email,
+			&rep.Lugar, &rep.Latitud, &rep.Longitud, pq.Array(&rep.Fotos), &rep.CreadoEn,
+			&c.CertificadoExiste, &c.Revocado,
+			&c.Verificaciones, &c.PrimeraVerificacion, &c.UltimaVerificacion, &c.OtrosReportes, &c.AlertaEscaneos)
+		if err != nil {
+			return nil, err
+		}
+		if rep.NumeroCertificado != "" {
+			rep.Correlacion = &c
+		}
+		reportes = append(reportes, rep)
+	}
+	return reportes, rows.Err()
+}
+
+// Avisar al equipo de un reporte nuevo por email y Slack
+func notificarReporteFalsificacion(rep *ReporteFalsificacion) error {
+	ajustes := configActual().Contacto
+	asunto := "Nuevo reporte de falsificación"
+	if rep.NumeroCertificado != "" {
+		asunto += ": " + rep.NumeroCertificado
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Reporte %d\n", rep.ID)
+	if rep.Email != "" {
+		fmt.Fprintf(&b, "De: %s\n", rep.Email)
+	}
+	if rep.Lugar != "" {
+		fmt.Fprintf(&b, "Lugar: %s\n", rep.Lugar)
+	}
+	if rep.Latitud != nil {
+		fmt.Fprintf(&b, "Ubicación: %.6f, %.6f\n", *rep.Latitud, *rep.Longitud)
+	}
+	if c := rep.Correlacion; c != nil {
+		switch {
+		case !c.CertificadoExiste:
+			b.WriteString("El número no corresponde a ningún certificado emitido\n")
+		case c.Revocado:
+			b.WriteString("El certificado está revocado\n")
+		}
+		fmt.Fprintf(&b, "Verificaciones registradas: %d\n", c.Verificaciones)
+		if c.OtrosReportes > 0 {
+			fmt.Fprintf(&b, "Otros reportes del mismo número: %d\n", c.OtrosReportes)
+		}
+		if c.AlertaEscaneos {
+			b.WriteString("El número tiene una alerta abierta de escaneos desde muchas IPs o regiones\n")
+		}
+	}
+	fmt.Fprintf(&b, "Fotos: %d\n\n%s\n", len(rep.Fotos), rep.Descripcion)
+
+	var errores []string
+	for _, destino := range ajustes.Destinatarios {
+		if err := enviarEmail(destino, asunto, b.String()); err != nil {
+			errores = append(errores, fmt.Sprintf("email a %s: %v", destino, err))
+		}
+	}
+	if ajustes.SlackWebhook != "" {
+		if err := enviarSlack(ajustes.SlackWebhook, "*"+asunto+"*\n"+b.String()); err != nil {
+			errores = append(errores, fmt.Sprintf("Slack: %v", err))
+		}
+	}
+	if len(errores) > 0 {
+		return errors.New(strings.Join(errores, "; "))
+	}
+	return nil
+}
+
+// Leer una coordenada opcional del formulario
+func coordenadaFormulario(valor string) (*float64, bool) {
+	if valor = strings.TrimSpace(valor); valor == "" {
+		return nil, true
+	}
+	n, err := strconv.ParseFloat(valor, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &n, true
+}
+
+// Handler para POST /reportar_falsificacion. Acepta JSON o un formulario
+// (multipart con las fotos en el campo "fotos"); el captcha (exigirCaptcha)
+// y el campo trampa funcionan como en /contacto. numero_certificado puede ser también
+// el token del QR.
+func reportarFalsificacionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+encabezadoCaptcha)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		ReporteFalsificacion
+		SitioWeb string `json:"sitio_web"`
+	}
+	var fotos []fotoFalsificacion
+	r.Body = http.MaxBytesReader(w, r.Body, maximoFotosFalsificacion*tamanoMaximoFotoFalsificacion+(1<<20))
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseMultipartForm(8 << 20); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, "Cuerpo inválido", http.StatusBadRequest)
+			return
+		}
+		solicitud.NumeroCertificado = r.FormValue("numero_certificado")
+		solicitud.Descripcion = r.FormValue("descripcion")
+		solicitud.Email = r.FormValue("email")
+		solicitud.Lugar = r.FormValue("lugar")
+		solicitud.SitioWeb = r.FormValue("sitio_web")
+		var ok1, ok2 bool
+		solicitud.Latitud, ok1 = coordenadaFormulario(r.FormValue("latitud"))
+		solicitud.Longitud, ok2 = coordenadaFormulario(r.FormValue("longitud"))
+		if !ok1 || !ok2 {
+			http.Error(w, "latitud o longitud inválida", http.StatusBadRequest)
+			return
+		}
+		var problema string
+		if fotos, problema = leerFotosFalsificacion(r); problema != "" {
+			http.Error(w, problema, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Al bot se le responde como si el reporte se hubiera recibido
+	if solicitud.SitioWeb != "" {
+		logSolicitud(r.Context(), "Falsificación: reporte descartado por el campo trampa")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	reporte := solicitud.ReporteFalsificacion
+	if problema := validarReporteFalsificacion(&reporte); problema != "" {
+		http.Error(w, problema, http.StatusBadRequest)
+		return
+	}
+	if tokensVerificacionActivos() && strings.Count(reporte.NumeroCertificado, ".") == 2 {
+		// Los tokens distinguen mayúsculas, se valida el valor original
+		if numero, err := validarTokenVerificacion(strings.TrimSpace(solicitud.NumeroCertificado), time.Now()); err == nil {
+			reporte.NumeroCertificado = numero
+		}
+	}
+	reporte.ip = textoIPSolicitud(r)
+	reporte.agente = r.UserAgent()
+
+	// Las fotos se guardan antes que el reporte para registrar sus claves
+	marca := time.Now().UTC().Format("20060102T150405Z")
+	sufijo, err := generarCodigoEnlace()
+	if err != nil {
+		http.Error(w, "Error al guardar el reporte", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	reporte.Fotos = []string{}
+	for i, foto := range fotos {
+		clave := fmt.Sprintf("%sfalsificaciones/%s-%s/%d.%s", prefijoArchivado(), marca, sufijo, i+1, extensionesFotoFalsificacion[foto.tipo])
+		if err := guardarArchivo(r.Context(), clave, foto.contenido, foto.tipo); err != nil {
+			http.Error(w, "Error al guardar las fotos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		reporte.Fotos = append(reporte.Fotos, clave)
+	}
+
+	if err := registrarReporteFalsificacion(r.Context(), &reporte); err != nil {
+		http.Error(w, "Error al guardar el reporte", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	// El reporte ya quedó guardado aunque falle el aviso
+	go func() {
+		if err := notificarReporteFalsificacion(&reporte); err != nil {
+			logSolicitud(r.Context(), "Error al avisar el reporte de falsificación:", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"reporte_id": reporte.ID})
+}
+
+// Handler para GET /admin/falsificaciones: los últimos reportes con su
+// correlación con los certificados y las verificaciones
+func reportesFalsificacionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reportes, err := obtenerReportesFalsificacion(r.Context())
+	if err != nil {
+		http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reportes)
+}
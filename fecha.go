@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// Formatos aceptados al leer fechas guardadas como texto
+var formatosFecha = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07", "2006-01-02 15:04:05", "2006-01-02"}
+
+// Fecha leída de la base de datos que se serializa en JSON como RFC3339 en
+// la zona horaria configurada
+type Fecha struct {
+	time.Time
+}
+
+// pq devuelve DATE y TIMESTAMP (sin zona) en una zona fija sin nombre y
+// con desfase 0, pero su hora es la del negocio y no UTC: se reinterpreta
+// en zonaHoraria para que al convertir no se corra al día anterior. Los
+// TIMESTAMPTZ llegan en la zona de la sesión y se dejan como están.
+func sinZonaEnZonaHoraria(t time.Time) time.Time {
+	if nombre, desfase := t.Zone(); nombre != "" || desfase != 0 || t.Location() == time.UTC {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), zonaHoraria)
+}
+
+func (f Fecha) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + f.In(zonaHoraria).Format(time.RFC3339) + `"`), nil
+}
+
+func (f *Fecha) UnmarshalJSON(data []byte) error {
+	return f.Time.UnmarshalJSON(data)
+}
+
+// Aceptar columnas DATE/TIMESTAMP y también texto con fecha
+func (f *Fecha) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case time.Time:
+		f.Time = sinZonaEnZonaHoraria(v)
+		return nil
+	case []byte:
+		return f.parsear(string(v))
+	case string:
+		return f.parsear(v)
+	}
+	return fmt.Errorf("no se puede convertir %T a Fecha", src)
+}
+
+func (f Fecha) Value() (driver.Value, error) {
+	return f.Time, nil
+}
+
+func (f *Fecha) parsear(texto string) error {
+	for _, formato := range formatosFecha {
+		t, err := time.ParseInLocation(formato, texto, zonaHoraria)
+		if err == nil {
+			f.Time = t
+			return nil
+		}
+	}
+	return fmt.Errorf("fecha con formato desconocido: %q", texto)
+}
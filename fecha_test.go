@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Las columnas sin zona conservan su día; las TIMESTAMPTZ se convierten a
+// la zona del negocio
+func TestFechaZonaHoraria(t *testing.T) {
+	anterior := zonaHoraria
+	defer func() { zonaHoraria = anterior }()
+	bogota, err := time.LoadLocation("America/Bogota")
+	if err != nil {
+		t.Skip("sin base de zonas horarias:", err)
+	}
+	zonaHoraria = bogota
+
+	casos := []struct {
+		nombre   string
+		valor    time.Time
+		esperado string
+	}{
+		// Así devuelve pq un DATE o un TIMESTAMP
+		{"date", time.Date(2024, 3, 1, 0, 0, 0, 0, time.FixedZone("", 0)), `"2024-03-01T00:00:00-05:00"`},
+		{"timestamp", time.Date(2024, 3, 1, 10, 30, 0, 0, time.FixedZone("", 0)), `"2024-03-01T10:30:00-05:00"`},
+		// TIMESTAMPTZ en una sesión en UTC o con otro desfase
+		{"timestamptz utc", time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC), `"2024-02-29T21:00:00-05:00"`},
+		{"timestamptz desfase", time.Date(2024, 3, 1, 2, 0, 0, 0, time.FixedZone("", 3600)), `"2024-02-29T20:00:00-05:00"`},
+	}
+	for _, caso := range casos {
+		var f Fecha
+		if err := f.Scan(caso.valor); err != nil {
+			t.Fatalf("%s: %v", caso.nombre, err)
+		}
+		json, err := f.MarshalJSON()
+		if err != nil {
+			t.Fatalf("%s: %v", caso.nombre, err)
+		}
+		if string(json) != caso.esperado {
+			t.Errorf("%s: %s, se esperaba %s", caso.nombre, json, caso.esperado)
+		}
+	}
+
+	var f Fecha
+	f.Scan(time.Date(2024, 5, 31, 0, 0, 0, 0, time.FixedZone("", 0)))
+	asiento := asientoContable{Fecha: f.Time}
+	if dia := asiento.registro()[0]; dia != "2024-05-31" {
+		t.Errorf("registro contable con fecha %s, se esperaba 2024-05-31", dia)
+	}
+}
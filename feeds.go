@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feeds de catálogo para Google Merchant Center (RSS 2.0 con el espacio de
+// nombres g:) y Facebook (CSV), generados a partir de la copia local de los
+// productos de Rocketfy. Se regeneran cada feeds.intervalo_minutos y se
+// sirven desde memoria para que las plataformas de anuncios los descarguen
+// cuando quieran.
+
+const (
+	intervaloFeedsPorDefecto = 60 * time.Minute
+	marcaFeedsPorDefecto     = "Melenas Co"
+
+	rutaFeedGoogle   = "/feeds/google-merchant.xml"
+	rutaFeedFacebook = "/feeds/facebook.csv"
+)
+
+var reEtiquetaHTML = regexp.MustCompile(`<[^>]*>`)
+
+// Producto tal como se publica en los feeds
+type ProductoFeed struct {
+	ID          string
+	Titulo      string
+	Descripcion string
+	Enlace      string
+	Imagen      string
+	// "420000.00 COP"
+	Precio     string
+	Disponible bool
+	Categoria  string
+	SKU        string
+}
+
+// Última generación de los feeds
+var (
+	muFeeds sync.RWMutex
+	feeds   struct {
+		google, facebook []byte
+		generadosEn      time.Time
+	}
+)
+
+// Texto plano de una descripción con HTML
+func textoPlano(contenido string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(reEtiquetaHTML.ReplaceAllString(contenido, " "))), " ")
+}
+
+// Enlace a la página del producto en la tienda según feeds.url_producto,
+// que puede usar {id} y {sku}
+func enlaceProductoFeed(id, sku string) string {
+	plantilla := configActual().Feeds.URLProducto
+	if plantilla == "" {
+		plantilla = strings.TrimRight(configActual().Publico.URLBase, "/") + "/productos/{id}"
+	}
+	return strings.NewReplacer("{id}", id, "{sku}", sku).Replace(plantilla)
+}
+
+// Productos sincronizados con nombre, precio e imagen; los demás no cumplen
+// los requisitos de las plataformas y se omiten
+func consultarProductosFeed(db *sql.DB) ([]ProductoFeed, error) {
+	rows, err := db.Query(`
+		SELECT rocketfy_id, datos FROM ProductosSincronizados
+		WHERE eliminado_en IS NULL
+		ORDER BY rocketfy_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	productos := []ProductoFeed{}
+	for rows.Next() {
+		var id string
+		var datos []byte
+		if err := rows.Scan(&id, &datos); err != nil {
+			return nil, err
+		}
+		var producto struct {
+			Nombre      string   `json:"name"`
+			Descripcion string   `json:"description"`
+			SKU         string   `json:"sku"`
+			Precio      *float64 `json:"price"`
+			Moneda      string   `json:"currency"`
+			Stock       *float64 `json:"stock"`
+			Categoria   string   `json:"category"`
+			Imagenes    []string `json:"images"`
+		}
+		if err := json.Unmarshal(datos, &producto); err != nil {
+			return nil, fmt.Errorf("Error al leer el producto %s: %v", id, err)
+		}
+		if producto.Nombre == "" || producto.Precio == nil || len(producto.Imagenes) == 0 {
+			continue
+		}
+		if producto.Moneda == "" {
+			producto.Moneda = MonedaBase
+		}
+
+		productos = append(productos, ProductoFeed{
+			ID:          id,
+			Titulo:      producto.Nombre,
+			Descripcion: textoPlano(producto.Descripcion),
+			Enlace:      enlaceProductoFeed(id, producto.SKU),
+			Imagen:      producto.Imagenes[0],
+			Precio:      formatoMonto(int64(math.Round(*producto.Precio*100))) + " " + producto.Moneda,
+			Disponible:  producto.Stock == nil || *producto.Stock > 0,
+			Categoria:   producto.Categoria,
+			SKU:         producto.SKU,
+		})
+	}
+	return productos, rows.Err()
+}
+
+func marcaFeeds() string {
+	if marca := configActual().Feeds.Marca; marca != "" {
+		return marca
+	}
+	return marcaFeedsPorDefecto
+}
+
+// Feed RSS 2.0 para Google Merchant Center
+func generarFeedGoogle(productos []ProductoFeed) ([]byte, error) {
+	type itemGoogle struct {
+		ID             string `xml:"g:id"`
+		Titulo         string `xml:"title"`
+		Descripcion    string `xml:"description"`
+		Enlace         string `xml:"link"`
+		Imagen         string `xml:"g:image_link"`
+		Disponibilidad string `xml:"g:availability"`
+		Condicion      string `xml:"g:condition"`
+		Precio         string `xml:"g:price"`
+		Marca          string `xml:"g:brand"`
+		MPN            string `xml:"g:mpn,omitempty"`
+		TipoProducto   string `xml:"g:product_type,omitempty"`
+	}
+	type canal struct {
+		Titulo      string       `xml:"title"`
+		Enlace      string       `xml:"link"`
+		Descripcion string       `xml:"description"`
+		Items       []itemGoogle `xml:"item"`
+	}
+	type rss struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		G       string   `xml:"xmlns:g,attr"`
+		Canal   canal    `xml:"channel"`
+	}
+
+	feed := rss{
+		Version: "2.0",
+		G:       "http://base.google.com/ns/1.0",
+		Canal: canal{
+			Titulo:      marcaFeeds(),
+			Enlace:      configActual().Publico.URLBase,
+			Descripcion: "Catálogo de productos de " + marcaFeeds(),
+		},
+	}
+	for _, p := range productos {
+		disponibilidad := "out_of_stock"
+		if p.Disponible {
+			disponibilidad = "in_stock"
+		}
+		feed.Canal.Items = append(feed.Canal.Items, itemGoogle{
+			ID:             p.ID,
+			Titulo:         p.Titulo,
+			Descripcion:    p.Descripcion,
+			Enlace:         p.Enlace,
+			Imagen:         p.Imagen,
+			Disponibilidad: disponibilidad,
+			Condicion:      "new",
+			Precio:         p.Precio,
+			Marca:          marcaFeeds(),
+			MPN:            p.SKU,
+			TipoProducto:   p.Categoria,
+		})
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	codificador := xml.NewEncoder(&b)
+	codificador.Indent("", "  ")
+	if err := codificador.Encode(feed); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// Feed CSV para el catálogo de Facebook (Meta Commerce Manager)
+func generarFeedFacebook(productos []ProductoFeed) ([]byte, error) {
+	var b bytes.Buffer
+	escritor := csv.NewWriter(&b)
+	escritor.Write([]string{"id", "title", "description", "availability", "condition", "price", "link", "image_link", "brand", "product_type"})
+	for _, p := range productos {
+		disponibilidad := "out of stock"
+		if p.Disponible {
+			disponibilidad = "in stock"
+		}
+		descripcion := p.Descripcion
+		if descripcion == "" {
+			descripcion = p.Titulo
+		}
+		escritor.Write([]string{p.ID, p.Titulo, descripcion, disponibilidad, "new", p.Precio, p.Enlace, p.Imagen, marcaFeeds(), p.Categoria})
+	}
+	escritor.Flush()
+	return b.Bytes(), escritor.Error()
+}
+
+// Generar los dos feeds y reemplazar los servidos
+func regenerarFeeds(db *sql.DB) error {
+	productos, err := consultarProductosFeed(db)
+	if err != nil {
+		return err
+	}
+	google, err := generarFeedGoogle(productos)
+	if err != nil {
+		return fmt.Errorf("Error al generar el feed de Google: %v", err)
+	}
+	facebook, err := generarFeedFacebook(productos)
+	if err != nil {
+		return fmt.Errorf("Error al generar el feed de Facebook: %v", err)
+	}
+
+	muFeeds.Lock()
+	defer muFeeds.Unlock()
+	feeds.google, feeds.facebook, feeds.generadosEn = google, facebook, time.Now()
+	return nil
+}
+
+// Regenerar los feeds al iniciar y luego periódicamente
+func despacharFeeds() {
+	intervalo := time.Duration(config.Feeds.IntervaloMinutos) * time.Minute
+	if intervalo <= 0 {
+		intervalo = intervaloFeedsPorDefecto
+	}
+
+	for {
+		if db, err := poolBaseDatos(); err != nil {
+			log.Println("Feeds: error al conectar a la base de datos:", err)
+		} else if err := regenerarFeeds(db); err != nil {
+			log.Println("Feeds:", err)
+		}
+		time.Sleep(intervalo)
+	}
+}
+
+// Handler para GET /feeds/google-merchant.xml y /feeds/facebook.csv
+func feedsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	muFeeds.RLock()
+	google, facebook, generadosEn := feeds.google, feeds.facebook, feeds.generadosEn
+	muFeeds.RUnlock()
+
+	// Antes de la primera generación programada se generan en el momento
+	if generadosEn.IsZero() {
+		if err := actualizarFeeds(r.Context()); err != nil {
+			http.Error(w, "Error al generar el feed", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		muFeeds.RLock()
+		google, facebook, generadosEn = feeds.google, feeds.facebook, feeds.generadosEn
+		muFeeds.RUnlock()
+	}
+
+	var contenido []byte
+	switch r.URL.Path {
+	case rutaFeedGoogle:
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		contenido = google
+	case rutaFeedFacebook:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		contenido = facebook
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, "", generadosEn, bytes.NewReader(contenido))
+}
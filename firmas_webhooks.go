@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Verificación centralizada de las firmas de los webhooks entrantes: toda
+// ruta /webhooks/{origen} pasa por verificarFirmaWebhook antes de llegar a
+// su handler. Cada proveedor firma con su propia clave
+// (rocketfy.secreto_webhook, pagos.secreto_webhook) el texto
+// "{X-Timestamp}.{cuerpo}" con HMAC-SHA256 y envía la firma en X-Signature.
+// Una marca de tiempo fuera de webhooks_entrantes.tolerancia_segundos se
+// rechaza para que una solicitud capturada no se pueda reenviar más tarde,
+// y la firma se compara en tiempo constante.
+
+const (
+	// HMAC-SHA256 en hexadecimal, con o sin el prefijo sha256=
+	encabezadoFirmaWebhook = "X-Signature"
+	// Segundos Unix del envío, incluidos en la firma
+	encabezadoTiempoWebhook     = "X-Timestamp"
+	toleranciaWebhookPorDefecto = 300
+	// Por debajo de este largo `melenas config check` advierte que la clave es débil
+	longitudMinimaSecretoWebhook = 32
+)
+
+var (
+	errFirmaWebhookAusente  = errors.New("falta la firma o la marca de tiempo")
+	errFirmaWebhookVencida  = errors.New("la marca de tiempo está fuera de la tolerancia")
+	errFirmaWebhookInvalida = errors.New("la firma no coincide")
+)
+
+var firmasWebhookRechazadas uint64
+
+func init() {
+	registrarMetricaCalculada("melenas_webhooks_firmas_rechazadas_total",
+		"Webhooks entrantes rechazados por firma o marca de tiempo inválida", "counter",
+		func() float64 { return float64(atomic.LoadUint64(&firmasWebhookRechazadas)) })
+}
+
+// Origen de una ruta /webhooks/{origen}
+func origenWebhook(ruta string) string {
+	return strings.Trim(strings.TrimPrefix(ruta, "/webhooks/"), "/")
+}
+
+// Firma HMAC-SHA256 en hexadecimal de un cuerpo
+func firmarWebhook(secreto string, cuerpo []byte) string {
+	mac := hmac.New(sha256.New, []byte(secreto))
+	mac.Write(cuerpo)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Firma que debe traer un webhook entrante enviado en marca
+func firmarWebhookEntrante(secreto, marca string, cuerpo []byte) string {
+	return firmarWebhook(secreto, append([]byte(marca+"."), cuerpo...))
+}
+
+// Comprobar la marca de tiempo y la firma de un webhook entrante
+func verificarFirma(secreto string, cuerpo []byte, firma, marca string, ahora time.Time, tolerancia time.Duration) error {
+	segundos, err := strconv.ParseInt(marca, 10, 64)
+	if firma == "" || err != nil {
+		return errFirmaWebhookAusente
+	}
+	if desfase := ahora.Sub(time.Unix(segundos, 0)); desfase > tolerancia || desfase < -tolerancia {
+		return errFirmaWebhookVencida
+	}
+	recibida := strings.ToLower(strings.TrimPrefix(firma, "sha256="))
+	if !hmac.Equal([]byte(recibida), []byte(firmarWebhookEntrante(secreto, marca, cuerpo))) {
+		return errFirmaWebhookInvalida
+	}
+	return nil
+}
+
+// Middleware de /webhooks/*: sin clave configurada para el origen la ruta
+// no existe; con firma inválida responde 401. El cuerpo verificado queda
+// disponible para el handler.
+func verificarFirmaWebhook(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origen := origenWebhook(r.URL.Path)
+		ajustes := configActual()
+		secreto := ""
+		if webhook, ok := webhooksEntrantes[origen]; ok {
+			secreto = webhook.secreto(ajustes)
+		}
+		if secreto == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		cuerpo, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCuerpoWebhook))
+		if err != nil {
+			http.Error(w, "No se pudo leer el cuerpo", http.StatusBadRequest)
+			return
+		}
+		tolerancia := time.Duration(ajustes.WebhooksEntrantes.ToleranciaSegundos) * time.Second
+		err = verificarFirma(secreto, cuerpo, r.Header.Get(encabezadoFirmaWebhook), r.Header.Get(encabezadoTiempoWebhook), time.Now(), tolerancia)
+		if err != nil {
+			atomic.AddUint64(&firmasWebhookRechazadas, 1)
+			logSolicitud(r.Context(), "Webhook de", origen, "rechazado:", err)
+			http.Error(w, "No autorizado", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(cuerpo))
+		next.ServeHTTP(w, r)
+	})
+}
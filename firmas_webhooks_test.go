@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerificarFirma(t *testing.T) {
+	const secreto = "clave-del-proveedor-de-pagos-0123456789"
+	cuerpo := []byte(`{"compra_id":42,"estado":"approved"}`)
+	ahora := time.Unix(1700000000, 0)
+	marca := strconv.FormatInt(ahora.Unix(), 10)
+	firma := firmarWebhookEntrante(secreto, marca, cuerpo)
+	tolerancia := 5 * time.Minute
+
+	casos := []struct {
+		nombre   string
+		secreto  string
+		cuerpo   []byte
+		firma    string
+		marca    string
+		esperado error
+	}{
+		{"válida", secreto, cuerpo, firma, marca, nil},
+		{"con prefijo y en mayúsculas", secreto, cuerpo, "sha256=" + strings.ToUpper(firma), marca, nil},
+		{"dentro de la tolerancia", secreto, cuerpo,
+			firmarWebhookEntrante(secreto, "1699999760", cuerpo), "1699999760", nil},
+		{"otra clave", "otra-clave", cuerpo, firma, marca, errFirmaWebhookInvalida},
+		{"cuerpo alterado", secreto, []byte(`{"compra_id":43,"estado":"approved"}`), firma, marca, errFirmaWebhookInvalida},
+		{"firma de otra marca", secreto, cuerpo, firma, "1700000001", errFirmaWebhookInvalida},
+		{"vencida", secreto, cuerpo,
+			firmarWebhookEntrante(secreto, "1699999699", cuerpo), "1699999699", errFirmaWebhookVencida},
+		{"en el futuro", secreto, cuerpo,
+			firmarWebhookEntrante(secreto, "1700000301", cuerpo), "1700000301", errFirmaWebhookVencida},
+		{"sin firma", secreto, cuerpo, "", marca, errFirmaWebhookAusente},
+		{"marca no numérica", secreto, cuerpo, firma, "ayer", errFirmaWebhookAusente},
+		{"sin marca", secreto, cuerpo, firma, "", errFirmaWebhookAusente},
+	}
+	for _, caso := range casos {
+		err := verificarFirma(caso.secreto, caso.cuerpo, caso.firma, caso.marca, ahora, tolerancia)
+		if err != caso.esperado {
+			t.Errorf("%s: %v, se esperaba %v", caso.nombre, err, caso.esperado)
+		}
+	}
+}
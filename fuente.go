@@ -0,0 +1,120 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+)
+
+// Fuente de mapa de bits de 5x7 píxeles para dibujar texto en las imágenes
+// generadas sin depender de paquetes de fuentes. Solo cubre mayúsculas sin
+// tilde, dígitos y algunos signos; el resto se dibuja como espacio.
+
+const (
+	anchoGlifo = 5
+	altoGlifo  = 7
+)
+
+// Cada fila usa los 5 bits menos significativos, el más alto a la izquierda
+var glifos = map[rune][altoGlifo]uint8{
+	'A': {0x0E, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'B': {0x1E, 0x11, 0x11, 0x1E, 0x11, 0x11, 0x1E},
+	'C': {0x0E, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0E},
+	'D': {0x1E, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1E},
+	'E': {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x1F},
+	'F': {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x10},
+	'G': {0x0E, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0F},
+	'H': {0x11, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'I': {0x0E, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0C},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1F},
+	'M': {0x11, 0x1B, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0E, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'P': {0x1E, 0x11, 0x11, 0x1E, 0x10, 0x10, 0x10},
+	'Q': {0x0E, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0D},
+	'R': {0x1E, 0x11, 0x11, 0x1E, 0x14, 0x12, 0x11},
+	'S': {0x0F, 0x10, 0x10, 0x0E, 0x01, 0x01, 0x1E},
+	'T': {0x1F, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0A, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0A},
+	'X': {0x11, 0x11, 0x0A, 0x04, 0x0A, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x11, 0x0A, 0x04, 0x04, 0x04},
+	'Z': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1F},
+	'0': {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1': {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2': {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3': {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4': {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5': {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6': {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9': {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	'-': {0x00, 0x00, 0x00, 0x1F, 0x00, 0x00, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C},
+	',': {0x00, 0x00, 0x00, 0x00, 0x0C, 0x04, 0x08},
+	':': {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'"': {0x0A, 0x0A, 0x00, 0x00, 0x00, 0x00, 0x00},
+}
+
+var reemplazoTildes = strings.NewReplacer(
+	"Á", "A", "É", "E", "Í", "I", "Ó", "O", "Ú", "U", "Ü", "U", "Ñ", "N",
+	"á", "A", "é", "E", "í", "I", "ó", "O", "ú", "U", "ü", "U", "ñ", "N",
+)
+
+// Pasar un texto a la forma que la fuente puede dibujar
+func textoDibujable(texto string) string {
+	return strings.ToUpper(reemplazoTildes.Replace(texto))
+}
+
+// Ancho en píxeles de un texto dibujado con la escala dada (un píxel de
+// separación entre glifos)
+func anchoTexto(texto string, escala int) int {
+	n := len([]rune(textoDibujable(texto)))
+	if n == 0 {
+		return 0
+	}
+	return (n*(anchoGlifo+1) - 1) * escala
+}
+
+// Dibujar un texto con la esquina superior izquierda en (x, y)
+func dibujarTexto(img *image.RGBA, x, y int, texto string, escala int, c color.Color) {
+	for _, letra := range textoDibujable(texto) {
+		glifo := glifos[letra]
+		for fila := 0; fila < altoGlifo; fila++ {
+			for columna := 0; columna < anchoGlifo; columna++ {
+				if glifo[fila]&(1<<(anchoGlifo-1-columna)) == 0 {
+					continue
+				}
+				for dy := 0; dy < escala; dy++ {
+					for dx := 0; dx < escala; dx++ {
+						img.Set(x+columna*escala+dx, y+fila*escala+dy, c)
+					}
+				}
+			}
+		}
+		x += (anchoGlifo + 1) * escala
+	}
+}
+
+// Partir un texto en líneas de como máximo anchoMaximo píxeles
+func partirTexto(texto string, escala, anchoMaximo int) []string {
+	var lineas []string
+	linea := ""
+	for _, palabra := range strings.Fields(texto) {
+		candidata := strings.TrimSpace(linea + " " + palabra)
+		if linea != "" && anchoTexto(candidata, escala) > anchoMaximo {
+			lineas = append(lineas, linea)
+			candidata = palabra
+		}
+		linea = candidata
+	}
+	if linea != "" {
+		lineas = append(lineas, linea)
+	}
+	return lineas
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Detección y fusión de clientes duplicados. El mismo cliente aparece
+// varias veces por errores al escribir el email; el reporte compara los
+// clientes que comparten nombre, teléfono o usuario de email, y la fusión
+// pasa las compras (y con ellas los certificados) al registro que se
+// conserva, dejando constancia en FusionesClientes.
+
+// Grupos más grandes que esto no se comparan par a par (nombres muy comunes)
+const maxGrupoDuplicados = 50
+
+// Similitud mínima de los emails de dos clientes con el mismo nombre
+const similitudMinimaEmail = 0.8
+
+var (
+	errFusionInvalida   = errors.New("conservar y duplicados deben ser clientes distintos")
+	errClienteFusionado = errors.New("El cliente ya fue fusionado con otro")
+)
+
+// Cliente en el reporte de duplicados
+type ClienteDuplicado struct {
+	ClienteID int     `json:"cliente_id"`
+	Nombre    string  `json:"nombre"`
+	Email     *string `json:"email"`
+	Telefono  *string `json:"telefono"`
+	Compras   int     `json:"compras"`
+}
+
+// Par de clientes que probablemente son la misma persona
+type ParDuplicado struct {
+	Clientes  [2]ClienteDuplicado `json:"clientes"`
+	Motivos   []string            `json:"motivos"`
+	Similitud float64             `json:"similitud"`
+}
+
+// Resultado de una fusión
+type ResultadoFusion struct {
+	ClienteID          int   `json:"cliente_id"`
+	Fusionados         []int `json:"fusionados"`
+	ComprasReasignadas int   `json:"compras_reasignadas"`
+}
+
+// Datos publicados en el evento de fusión
+type EventoFusionClientes struct {
+	ClienteID  int       `json:"cliente_id"`
+	Fusionados []int     `json:"fusionados"`
+	Fecha      time.Time `json:"fecha"`
+}
+
+// Distancia de edición entre dos textos
+func distanciaEdicion(a, b string) int {
+	x, y := []rune(a), []rune(b)
+	anterior := make([]int, len(y)+1)
+	actual := make([]int, len(y)+1)
+	for j := range anterior {
+		anterior[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		actual[0] = i
+		for j := 1; j <= len(y); j++ {
+			costo := 1
+			if x[i-1] == y[j-1] {
+				costo = 0
+			}
+			actual[j] = minimo(anterior[j]+1, actual[j-1]+1, anterior[j-1]+costo)
+		}
+		anterior, actual = actual, anterior
+	}
+	return anterior[len(y)]
+}
+
+func minimo(valores ...int) int {
+	m := valores[0]
+	for _, v := range valores[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// Similitud entre 0 y 1 según la distancia de edición
+func similitudTexto(a, b string) float64 {
+	largo := len([]rune(a))
+	if n := len([]rune(b)); n > largo {
+		largo = n
+	}
+	if largo == 0 {
+		return 0
+	}
+	return 1 - float64(distanciaEdicion(a, b))/float64(largo)
+}
+
+// Comparar los clientes que comparten nombre, teléfono o usuario de email
+func buscarDuplicados(clientes []ClienteDuplicado) []ParDuplicado {
+	grupos := map[string][]int{}
+	for i, c := range clientes {
+		if nombre := strings.Join(strings.Fields(strings.ToUpper(reemplazoTildes.Replace(c.Nombre))), " "); nombre != "" {
+			grupos["nombre:"+nombre] = append(grupos["nombre:"+nombre], i)
+		}
+		if c.Telefono != nil {
+			grupos["telefono:"+*c.Telefono] = append(grupos["telefono:"+*c.Telefono], i)
+		}
+		if c.Email != nil {
+			if usuario, _, ok := strings.Cut(strings.ToLower(*c.Email), "@"); ok && usuario != "" {
+				grupos["usuario:"+usuario] = append(grupos["usuario:"+usuario], i)
+			}
+		}
+	}
+
+	pares := map[[2]int]*ParDuplicado{}
+	for clave, indices := range grupos {
+		if len(indices) < 2 || len(indices) > maxGrupoDuplicados {
+			continue
+		}
+		tipo, _, _ := strings.Cut(clave, ":")
+		for i := 0; i < len(indices); i++ {
+			for j := i + 1; j < len(indices); j++ {
+				a, b := clientes[indices[i]], clientes[indices[j]]
+				similitud := 0.0
+				if a.Email != nil && b.Email != nil {
+					similitud = similitudTexto(strings.ToLower(*a.Email), strings.ToLower(*b.Email))
+				}
+
+				var motivo string
+				switch tipo {
+				case "telefono":
+					motivo = "mismo teléfono"
+				case "nombre":
+					if similitud < similitudMinimaEmail {
+						continue
+					}
+					motivo = "mismo nombre y email parecido"
+				case "usuario":
+					// Mismo usuario con el dominio mal escrito (gmial.com)
+					_, dominioA, _ := strings.Cut(strings.ToLower(*a.Email), "@")
+					_, dominioB, _ := strings.Cut(strings.ToLower(*b.Email), "@")
+					if distanciaEdicion(dominioA, dominioB) > 2 {
+						continue
+					}
+					motivo = "mismo usuario de email"
+				}
+
+				clave := [2]int{a.ClienteID, b.ClienteID}
+				if clave[0] > clave[1] {
+					clave[0], clave[1] = clave[1], clave[0]
+					a, b = b, a
+				}
+				par, ok := pares[clave]
+				if !ok {
+					par = &ParDuplicado{Clientes: [2]ClienteDuplicado{a, b}, Similitud: similitud}
+					pares[clave] = par
+				}
+				par.Motivos = append(par.Motivos, motivo)
+			}
+		}
+	}
+
+	duplicados := make([]ParDuplicado, 0, len(pares))
+	for _, par := range pares {
+		sort.Strings(par.Motivos)
+		duplicados = append(duplicados, *par)
+	}
+	sort.Slice(duplicados, func(i, j int) bool {
+		if len(duplicados[i].Motivos) != len(duplicados[j].Motivos) {
+			return len(duplicados[i].Motivos) > len(duplicados[j].Motivos)
+		}
+		if duplicados[i].Similitud != duplicados[j].Similitud {
+			return duplicados[i].Similitud > duplicados[j].Similitud
+		}
+		return duplicados[i].Clientes[0].ClienteID < duplicados[j].Clientes[0].ClienteID
+	})
+	return duplicados
+}
+
+// Clientes vigentes (no anonimizados ni fusionados) con sus datos de
+// contacto descifrados
+func consultarClientesDuplicables(db *sql.DB) ([]ClienteDuplicado, error) {
+	rows, err := db.Query(`
+		SELECT c.cliente_id, trim(c.nombre || ' ' || coalesce(c.apellido, '')),
+			c.email, c.email_cifrado, c.telefono, c.telefono_cifrado,
+			(SELECT count(*) FROM Compras com WHERE com.cliente_id = c.cliente_id)
+		FROM Clientes c
+		WHERE c.anonimizado_en IS NULL AND c.fusionado_con IS NULL AND c.eliminado_en IS NULL
+		ORDER BY c.cliente_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clientes []ClienteDuplicado
+	for rows.Next() {
+		var c ClienteDuplicado
+		var email, emailCifrado, telefono, telefonoCifrado sql.NullString
+		if err := rows.Scan(&c.ClienteID, &c.Nombre, &email, &emailCifrado, &telefono, &telefonoCifrado, &c.Compras); err != nil {
+			return nil, err
+		}
+		if c.Email, err = valorPII(email, emailCifrado); err != nil {
+			return nil, err
+		}
+		if c.Telefono, err = valorPII(telefono, telefonoCifrado); err != nil {
+			return nil, err
+		}
+		clientes = append(clientes, c)
+	}
+	return clientes, rows.Err()
+}
+
+// Fusionar los duplicados en el cliente que se conserva: se reasignan las
+// compras y los recordatorios, los consentimientos que el conservado no
+// tiene, el historial de consentimientos y los vínculos con Rocketfy. Los
+// duplicados quedan marcados con fusionado_con.
+func fusionarClientes(db *sql.DB, conservar int, duplicados []int, motivo, solicitudID string) (*ResultadoFusion, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	resultado, err := fusionarClientesTx(tx, conservar, duplicados, motivo, solicitudID)
+	if err != nil {
+		return nil, err
+	}
+	return resultado, tx.Commit()
+}
+
+// Fusionar clientes dentro de una transacción ya abierta
+func fusionarClientesTx(tx *sql.Tx, conservar int, duplicados []int, motivo, solicitudID string) (*ResultadoFusion, error) {
+	// Bloquear todos los registros en orden para evitar interbloqueos
+	ids := append([]int{conservar}, duplicados...)
+	rows, err := tx.Query(`
+		SELECT cliente_id, anonimizado_en IS NOT NULL, fusionado_con IS NOT NULL
+		FROM Clientes
+		WHERE cliente_id = ANY($1)
+		ORDER BY cliente_id
+		FOR UPDATE`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	encontrados := map[int]bool{}
+	for rows.Next() {
+		var id int
+		var anonimizado, fusionado bool
+		if err := rows.Scan(&id, &anonimizado, &fusionado); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		encontrados[id] = true
+		if fusionado {
+			rows.Close()
+			return nil, errClienteFusionado
+		}
+		if anonimizado && id == conservar {
+			rows.Close()
+			return nil, errClienteAnonimizado
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if !encontrados[id] {
+			return nil, errClienteInexistente
+		}
+	}
+
+	resultado := ResultadoFusion{ClienteID: conservar, Fusionados: duplicados}
+	for _, duplicado := range duplicados {
+		res, err := tx.Exec(`UPDATE Compras SET cliente_id = $1 WHERE cliente_id = $2`, conservar, duplicado)
+		if err != nil {
+			return nil, err
+		}
+		compras, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		resultado.ComprasReasignadas += int(compras)
+
+		_, err = tx.Exec(`UPDATE RecordatoriosProgramados SET cliente_id = $1 WHERE cliente_id = $2`, conservar, duplicado)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`UPDATE DispositivosCliente SET cliente_id = $1 WHERE cliente_id = $2`, conservar, duplicado)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`UPDATE ClientesRocketfy SET cliente_id = $1 WHERE cliente_id = $2`, conservar, duplicado)
+		if err != nil {
+			return nil, err
+		}
+
+		// El consentimiento vigente del conservado prevalece
+		_, err = tx.Exec(`
+			INSERT INTO ConsentimientosCliente (cliente_id, tipo, otorgado, fuente, actualizado_en)
+			SELECT $1, tipo, otorgado, fuente, actualizado_en FROM ConsentimientosCliente WHERE cliente_id = $2
+			ON CONFLICT (cliente_id, tipo) DO NOTHING`, conservar, duplicado)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`DELETE FROM ConsentimientosCliente WHERE cliente_id = $1`, duplicado)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`UPDATE HistorialConsentimientos SET cliente_id = $1 WHERE cliente_id = $2`, conservar, duplicado)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE Clientes SET fusionado_con = $1, fusionado_en = now()
+			WHERE cliente_id = $2 OR fusionado_con = $2`, conservar, duplicado)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO FusionesClientes (cliente_conservado, cliente_fusionado, compras_reasignadas, motivo, solicitud_id)
+			VALUES ($1, $2, $3, $4, $5)`, conservar, duplicado, compras, motivo, solicitudID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = registrarEventoOutbox(tx, EventoClientesFusionados,
+		EventoFusionClientes{ClienteID: conservar, Fusionados: duplicados, Fecha: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	return &resultado, nil
+}
+
+// Handler para GET /admin/clientes/duplicados
+func duplicadosClientesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	duplicados, err := obtenerDuplicadosClientes(r.Context())
+	if err != nil {
+		http.Error(w, "Error al buscar clientes duplicados", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(duplicados)
+}
+
+// Handler para POST /admin/clientes/merge
+// {"conservar": 10, "duplicados": [11, 12], "motivo": "email mal escrito"}
+func fusionarClientesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		Conservar  int    `json:"conservar"`
+		Duplicados []int  `json:"duplicados"`
+		Motivo     string `json:"motivo"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil || solicitud.Conservar <= 0 || len(solicitud.Duplicados) == 0 {
+		http.Error(w, "conservar y duplicados requeridos", http.StatusBadRequest)
+		return
+	}
+	vistos := map[int]bool{solicitud.Conservar: true}
+	for _, id := range solicitud.Duplicados {
+		if id <= 0 || vistos[id] {
+			responderErrorCliente(w, r, errFusionInvalida, "")
+			return
+		}
+		vistos[id] = true
+	}
+
+	resultado, err := fusionarDuplicados(r.Context(), solicitud.Conservar, solicitud.Duplicados, solicitud.Motivo)
+	if err != nil {
+		responderErrorCliente(w, r, err, "Error al fusionar los clientes")
+		return
+	}
+	logSolicitud(r.Context(), "Clientes", solicitud.Duplicados, "fusionados en", solicitud.Conservar)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resultado)
+}
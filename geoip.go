@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ubicación aproximada de las IPs a partir de una base local de IP2Location
+// en CSV (LITE DB1, DB3, DB5 o DB11, IPv4 o IPv6): se carga en memoria al
+// iniciar y las consultas no salen del servidor. Enriquece los escaneos con
+// el país y la ciudad cuando el CDN no envía el país.
+
+// Ubicación de una IP
+type UbicacionIP struct {
+	// Código ISO 3166 del país
+	Pais   string `json:"pais"`
+	Region string `json:"region,omitempty"`
+	Ciudad string `json:"ciudad,omitempty"`
+}
+
+// Rango de IPs con su ubicación; las IPs van como 16 bytes big endian, las
+// IPv4 de una base IPv4 con los 12 primeros en cero
+type rangoGeoIP struct {
+	inicio, fin [16]byte
+	ubicacion   uint32
+}
+
+type baseGeoIP struct {
+	rangos      []rangoGeoIP
+	ubicaciones []UbicacionIP
+	// Si la base solo tiene IPv4 (números de 32 bits); las bases IPv6 de
+	// IP2Location guardan las IPv4 como ::ffff:a.b.c.d
+	soloIPv4 bool
+}
+
+var (
+	muGeoIP    sync.RWMutex
+	baseGeoIPs *baseGeoIP
+)
+
+// Número decimal de IP2Location como 16 bytes
+func numeroIPGeoIP(texto string) ([16]byte, error) {
+	var ip [16]byte
+	n, ok := new(big.Int).SetString(texto, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return ip, fmt.Errorf("número de IP inválido %q", texto)
+	}
+	n.FillBytes(ip[:])
+	return ip, nil
+}
+
+// Leer una base en CSV: ip_desde, ip_hasta, código de país, país y, en
+// las DB3 o superiores, región y ciudad
+func leerBaseGeoIP(lector io.Reader) (*baseGeoIP, error) {
+	csvLector := csv.NewReader(lector)
+	csvLector.FieldsPerRecord = -1
+	csvLector.ReuseRecord = true
+
+	base := &baseGeoIP{soloIPv4: true}
+	indices := map[UbicacionIP]uint32{}
+	for linea := 1; ; linea++ {
+		registro, err := csvLector.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(registro) < 3 {
+			return nil, fmt.Errorf("línea %d: se esperan al menos 3 columnas", linea)
+		}
+
+		var rango rangoGeoIP
+		if rango.inicio, err = numeroIPGeoIP(registro[0]); err != nil {
+			return nil, fmt.Errorf("línea %d: %v", linea, err)
+		}
+		if rango.fin, err = numeroIPGeoIP(registro[1]); err != nil {
+			return nil, fmt.Errorf("línea %d: %v", linea, err)
+		}
+		if bytes.Compare(rango.inicio[:], rango.fin[:]) > 0 {
+			return nil, fmt.Errorf("línea %d: rango invertido", linea)
+		}
+		if !bytes.Equal(rango.fin[:12], make([]byte, 12)) {
+			base.soloIPv4 = false
+		}
+
+		// "-" marca los rangos sin ubicación (reservados, privados)
+		if registro[2] == "-" || registro[2] == "" {
+			continue
+		}
+		ubicacion := UbicacionIP{Pais: registro[2]}
+		if len(registro) >= 6 {
+			ubicacion.Region, ubicacion.Ciudad = valorGeoIP(registro[4]), valorGeoIP(registro[5])
+		}
+		indice, ok := indices[ubicacion]
+		if !ok {
+			indice = uint32(len(base.ubicaciones))
+			indices[ubicacion] = indice
+			base.ubicaciones = append(base.ubicaciones, ubicacion)
+		}
+		rango.ubicacion = indice
+		base.rangos = append(base.rangos, rango)
+	}
+
+	sort.Slice(base.rangos, func(i, j int) bool {
+		return bytes.Compare(base.rangos[i].inicio[:], base.rangos[j].inicio[:]) < 0
+	})
+	return base, nil
+}
+
+func valorGeoIP(valor string) string {
+	if valor == "-" {
+		return ""
+	}
+	return valor
+}
+
+// Ubicación de una IP en la base
+func (b *baseGeoIP) buscar(ip net.IP) (UbicacionIP, bool) {
+	var clave [16]byte
+	if v4 := ip.To4(); v4 != nil && b.soloIPv4 {
+		copy(clave[12:], v4)
+	} else if v6 := ip.To16(); v6 != nil && !b.soloIPv4 {
+		copy(clave[:], v6)
+	} else {
+		return UbicacionIP{}, false
+	}
+
+	// Primer rango que empieza después de la IP; la IP cae en el anterior
+	i := sort.Search(len(b.rangos), func(i int) bool {
+		return bytes.Compare(b.rangos[i].inicio[:], clave[:]) > 0
+	})
+	if i == 0 || bytes.Compare(clave[:], b.rangos[i-1].fin[:]) > 0 {
+		return UbicacionIP{}, false
+	}
+	return b.ubicaciones[b.rangos[i-1].ubicacion], true
+}
+
+// Cargar la base de geoip.archivo; sin archivo no se ubica ninguna IP
+func cargarGeoIP(archivo string) error {
+	if archivo == "" {
+		return nil
+	}
+	inicio := time.Now()
+	f, err := os.Open(archivo)
+	if err != nil {
+		return fmt.Errorf("Error al abrir la base de geolocalización: %v", err)
+	}
+	defer f.Close()
+
+	base, err := leerBaseGeoIP(f)
+	if err != nil {
+		return fmt.Errorf("Error al leer la base de geolocalización %s: %v", archivo, err)
+	}
+
+	muGeoIP.Lock()
+	baseGeoIPs = base
+	muGeoIP.Unlock()
+	logInfo("Base de geolocalización cargada: %d rangos y %d ubicaciones en %v",
+		len(base.rangos), len(base.ubicaciones), time.Since(inicio).Round(time.Millisecond))
+	return nil
+}
+
+// Ubicación de una IP en texto; falso si no hay base cargada o la IP no
+// aparece
+func ubicarIP(texto string) (UbicacionIP, bool) {
+	ip := net.ParseIP(texto)
+	if ip == nil {
+		return UbicacionIP{}, false
+	}
+	muGeoIP.RLock()
+	base := baseGeoIPs
+	muGeoIP.RUnlock()
+	if base == nil {
+		return UbicacionIP{}, false
+	}
+	return base.buscar(ip)
+}
@@ -3,6 +3,6 @@ module example.com/certificados
 go 1.19
 
 require (
-	github.com/lib/pq v1.10.9 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/lib/pq v1.10.9
+	gopkg.in/yaml.v3 v3.0.1
 )
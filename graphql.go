@@ -0,0 +1,733 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Implementación mínima de GraphQL sobre la misma capa de servicio que los
+// handlers REST. Soporta operaciones query/mutation, alias, argumentos
+// (literales y $variables) y selecciones anidadas. Los campos anidados se
+// resuelven a partir de los nombres JSON de las estructuras devueltas.
+
+// Resolver de un campo raíz
+type resolverGraphQL func(r *http.Request, args map[string]interface{}) (interface{}, error)
+
+// Campo solicitado en una selección
+type campoGraphQL struct {
+	Alias      string
+	Nombre     string
+	Argumentos map[string]interface{}
+	Seleccion  []campoGraphQL
+}
+
+// Operación de un documento GraphQL
+type operacionGraphQL struct {
+	Tipo      string
+	Seleccion []campoGraphQL
+}
+
+// Solicitud recibida en /graphql
+type solicitudGraphQL struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Respuesta estándar de GraphQL
+type respuestaGraphQL struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []errorGraphQL         `json:"errors,omitempty"`
+
+	// Estado HTTP distinto de 200, p. ej. 403 si la red no puede administrar
+	estado int
+}
+
+type errorGraphQL struct {
+	Message string   `json:"message"`
+	Path    []string `json:"path,omitempty"`
+}
+
+// Error devuelto por los resolvers cuando se requiere un administrador
+var errNoAutorizado = errors.New("No autorizado")
+
+// Subconjunto público de un certificado (sin datos de contacto del cliente)
+type CertificadoPublico struct {
+	NombreCliente            *string               `json:"nombre_cliente"`
+	NombreProducto           *string               `json:"nombre_producto"`
+	DescripcionProducto      *string               `json:"descripcion_producto"`
+	DescripcionProductoHTML  *string               `json:"descripcion_producto_html"`
+	DescripcionProductoTexto *string               `json:"descripcion_producto_texto"`
+	TipoCabello              *string               `json:"tipo_cabello"`
+	Color                    *string               `json:"color"`
+	Longitud                 *string               `json:"longitud"`
+	ImagenURL                *string               `json:"imagen_url"`
+	FechaCompra              *Fecha                `json:"fecha_compra"`
+	FechaEmision             *Fecha                `json:"fecha_emision"`
+	NumeroCertificado        string                `json:"numero_certificado"`
+	EstadoPago               *string               `json:"estado_pago"`
+	Revocado                 bool                  `json:"revocado"`
+	ReemplazadoPor           *string               `json:"reemplazado_por,omitempty"`
+	CodigoCorto              *string               `json:"codigo_corto"`
+	Cuidados                 *Cuidado              `json:"cuidados"`
+	Productos                []ProductoCertificado `json:"productos"`
+}
+
+func certificadoPublico(data *CertificateData) CertificadoPublico {
+	return CertificadoPublico{
+		NombreCliente:            data.NombreCliente,
+		NombreProducto:           data.NombreProducto,
+		DescripcionProducto:      data.DescripcionProducto,
+		DescripcionProductoHTML:  data.DescripcionProductoHTML,
+		DescripcionProductoTexto: data.DescripcionProductoTexto,
+		TipoCabello:              data.TipoCabello,
+		Color:                    data.Color,
+		Longitud:                 data.Longitud,
+		ImagenURL:                data.ImagenURL,
+		FechaCompra:              data.FechaCompra,
+		FechaEmision:             data.FechaEmision,
+		NumeroCertificado:        data.NumeroCertificado,
+		EstadoPago:               data.EstadoPago,
+		Revocado:                 data.Revocado,
+		ReemplazadoPor:           data.ReemplazadoPor,
+		CodigoCorto:              data.CodigoCorto,
+		Cuidados:                 data.Cuidados,
+		Productos:                data.Productos,
+	}
+}
+
+// Campos raíz de tipo query
+var consultasGraphQL = map[string]resolverGraphQL{
+	"productos": func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+		productos, _, err := obtenerProductosCache(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		agregarDescripcionesRocketfy(productos)
+		return productos, nil
+	},
+	"certificado": func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+		// certificado(numero: "...") o, con los tokens de verificación
+		// activos, certificado(token: "...")
+		pedido, _ := args["numero"].(string)
+		token, _ := args["token"].(string)
+		if strings.TrimSpace(pedido) == "" && strings.TrimSpace(token) == "" {
+			return nil, fmt.Errorf("graphql: el argumento %q es requerido", "numero")
+		}
+		numero, err := numeroVerificacionPublica(r, pedido, token)
+		if err == errTokenVerificacionRequerido {
+			certificadoNoEncontrado(r, pedido, VerificacionGraphQL)
+		} else if err == errTokenVerificacionInvalido {
+			registrarFallo(r, FalloConsulta)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if numero == "" {
+			return nil, fmt.Errorf("graphql: el argumento %q es requerido", "numero")
+		}
+		data, err := obtenerCertificado(r.Context(), numero)
+		if err == sql.ErrNoRows {
+			certificadoNoEncontrado(r, numero, VerificacionGraphQL)
+		}
+		if err != nil {
+			return nil, err
+		}
+		contarVerificacionSolicitud(r, data.NumeroCertificado, VerificacionGraphQL)
+		return certificadoPublico(data), nil
+	},
+	"buscar": func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+		consulta, err := argumentoTexto(args, "q")
+		if err != nil {
+			return nil, err
+		}
+		return buscar(contextoIncluirEliminados(r), consulta, esAdmin(r))
+	},
+	"certificadoAdmin": func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+		if err := verificarAdmin(r); err != nil {
+			return nil, err
+		}
+		numero, err := argumentoTexto(args, "numero")
+		if err != nil {
+			return nil, err
+		}
+		return obtenerCertificado(contextoIncluirEliminados(r), numero)
+	},
+}
+
+// Campos raíz de tipo mutation (solo administradores)
+var mutacionesGraphQL = map[string]resolverGraphQL{
+	"emitirCertificado": func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+		if err := verificarAdmin(r); err != nil {
+			return nil, err
+		}
+		compraID, err := argumentoEntero(args, "compra_id")
+		if err != nil {
+			return nil, err
+		}
+		numero, err := emitirCertificado(compraID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"numero_certificado": numero}, nil
+	},
+	"revocarCertificado": func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+		if err := verificarAdmin(r); err != nil {
+			return nil, err
+		}
+		numero, err := argumentoTexto(args, "numero")
+		if err != nil {
+			return nil, err
+		}
+		motivo, _ := args["motivo"].(string)
+		err = revocarCertificado(numero, motivo)
+		if err != nil {
+			return nil, err
+		}
+		return true, nil
+	},
+	"reemitirCertificado": func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+		if err := verificarAdmin(r); err != nil {
+			return nil, err
+		}
+		numero, err := argumentoTexto(args, "numero")
+		if err != nil {
+			return nil, err
+		}
+		motivo, err := argumentoTexto(args, "motivo")
+		if err != nil {
+			return nil, err
+		}
+		nombre, _ := args["nombre_cliente"].(string)
+		apellido, _ := args["apellido_cliente"].(string)
+		nuevo, err := reemitirCertificado(r.Context(), numero, strings.TrimSpace(nombre),
+			strings.TrimSpace(apellido), strings.TrimSpace(motivo))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"numero_certificado": nuevo, "numero_anterior": numero}, nil
+	},
+}
+
+// Handler para el endpoint /graphql
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Leer la consulta desde el cuerpo (POST) o la query string (GET)
+	var solicitud solicitudGraphQL
+	switch r.Method {
+	case "POST":
+		err := json.NewDecoder(r.Body).Decode(&solicitud)
+		if err != nil {
+			http.Error(w, "Cuerpo JSON inválido", http.StatusBadRequest)
+			return
+		}
+	case "GET":
+		solicitud.Query = r.URL.Query().Get("query")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			err := json.Unmarshal([]byte(variables), &solicitud.Variables)
+			if err != nil {
+				http.Error(w, "Variables JSON inválidas", http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	operacion, err := parsearGraphQL(solicitud.Query, solicitud.Variables)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(respuestaGraphQL{Errors: []errorGraphQL{{Message: err.Error()}}})
+		return
+	}
+
+	// Las mutaciones no se aceptan por GET
+	if operacion.Tipo == "mutation" && r.Method != "POST" {
+		http.Error(w, "Las mutaciones requieren POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if operacion.Tipo == "mutation" && escriturasBloqueadas() {
+		responderMantenimiento(w, r, estadoActualMantenimiento())
+		return
+	}
+
+	respuesta := ejecutarGraphQL(r, operacion)
+	if respuesta.estado != 0 {
+		w.WriteHeader(respuesta.estado)
+	}
+	json.NewEncoder(w).Encode(respuesta)
+}
+
+// Ejecutar los campos raíz de una operación y proyectar la selección
+func ejecutarGraphQL(r *http.Request, operacion *operacionGraphQL) respuestaGraphQL {
+	raices := consultasGraphQL
+	if operacion.Tipo == "mutation" {
+		raices = mutacionesGraphQL
+	}
+
+	respuesta := respuestaGraphQL{Data: map[string]interface{}{}}
+	for _, campo := range operacion.Seleccion {
+		clave := campo.Alias
+		if clave == "" {
+			clave = campo.Nombre
+		}
+
+		if campo.Nombre == "__typename" {
+			respuesta.Data[clave] = map[string]string{"query": "Query", "mutation": "Mutation"}[operacion.Tipo]
+			continue
+		}
+
+		resolver, ok := raices[campo.Nombre]
+		if !ok {
+			respuesta.Data[clave] = nil
+			respuesta.Errors = append(respuesta.Errors, errorGraphQL{
+				Message: fmt.Sprintf("Campo desconocido: %s", campo.Nombre),
+				Path:    []string{clave},
+			})
+			continue
+		}
+
+		valor, err := resolver(r, campo.Argumentos)
+		if err == nil {
+			valor, err = proyectarGraphQL(valor, campo.Seleccion)
+		}
+		if err != nil {
+			if err == errAccesoDenegado {
+				respuesta.estado = http.StatusForbidden
+			}
+			respuesta.Data[clave] = nil
+			respuesta.Errors = append(respuesta.Errors, errorGraphQL{
+				Message: mensajeErrorGraphQL(err),
+				Path:    []string{clave},
+			})
+			logSolicitud(r.Context(), err)
+			continue
+		}
+		respuesta.Data[clave] = valor
+	}
+
+	return respuesta
+}
+
+// Traducir los errores internos a mensajes seguros para el cliente
+func mensajeErrorGraphQL(err error) string {
+	switch {
+	case err == sql.ErrNoRows:
+		return "No encontrado"
+	case err == errNoAutorizado, err == errAccesoDenegado:
+		return err.Error()
+	case estadoErrorCertificado(err) != http.StatusInternalServerError:
+		return err.Error()
+	case strings.HasPrefix(err.Error(), "graphql:"):
+		return strings.TrimSpace(strings.TrimPrefix(err.Error(), "graphql:"))
+	}
+	return "Error interno"
+}
+
+// Reducir un valor a los campos seleccionados usando sus nombres JSON
+func proyectarGraphQL(valor interface{}, seleccion []campoGraphQL) (interface{}, error) {
+	// Normalizar el valor a tipos genéricos de JSON
+	data, err := json.Marshal(valor)
+	if err != nil {
+		return nil, err
+	}
+	var generico interface{}
+	err = json.Unmarshal(data, &generico)
+	if err != nil {
+		return nil, err
+	}
+
+	return seleccionarGraphQL(generico, seleccion)
+}
+
+func seleccionarGraphQL(valor interface{}, seleccion []campoGraphQL) (interface{}, error) {
+	switch v := valor.(type) {
+	case []interface{}:
+		lista := make([]interface{}, 0, len(v))
+		for _, elemento := range v {
+			proyectado, err := seleccionarGraphQL(elemento, seleccion)
+			if err != nil {
+				return nil, err
+			}
+			lista = append(lista, proyectado)
+		}
+		return lista, nil
+	case map[string]interface{}:
+		if len(seleccion) == 0 {
+			return nil, fmt.Errorf("graphql: los objetos requieren una selección de campos")
+		}
+		objeto := map[string]interface{}{}
+		for _, campo := range seleccion {
+			clave := campo.Alias
+			if clave == "" {
+				clave = campo.Nombre
+			}
+			hijo, ok := v[campo.Nombre]
+			if !ok {
+				return nil, fmt.Errorf("graphql: campo desconocido: %s", campo.Nombre)
+			}
+			proyectado, err := seleccionarGraphQL(hijo, campo.Seleccion)
+			if err != nil {
+				return nil, err
+			}
+			objeto[clave] = proyectado
+		}
+		return objeto, nil
+	default:
+		if len(seleccion) > 0 {
+			return nil, fmt.Errorf("graphql: un valor escalar no admite selección de campos")
+		}
+		return v, nil
+	}
+}
+
+func argumentoTexto(args map[string]interface{}, nombre string) (string, error) {
+	valor, ok := args[nombre].(string)
+	if !ok || strings.TrimSpace(valor) == "" {
+		return "", fmt.Errorf("graphql: el argumento %q es requerido", nombre)
+	}
+	return valor, nil
+}
+
+// Entero positivo de un argumento: los literales llegan como int y las
+// $variables, decodificadas del JSON, como float64 o json.Number
+func argumentoEntero(args map[string]interface{}, nombre string) (int, error) {
+	var entero int
+	switch valor := args[nombre].(type) {
+	case int:
+		entero = valor
+	case float64:
+		if valor == math.Trunc(valor) && valor <= math.MaxInt32 {
+			entero = int(valor)
+		}
+	case json.Number:
+		if n, err := strconv.Atoi(valor.String()); err == nil {
+			entero = n
+		}
+	}
+	if entero <= 0 {
+		return 0, fmt.Errorf("graphql: el argumento %q es requerido", nombre)
+	}
+	return entero, nil
+}
+
+// Analizador léxico y sintáctico del subconjunto soportado de GraphQL
+
+// Anidamiento máximo de selecciones, listas y objetos: sin tope, un
+// documento como {a{a{a...}}} hace recursar al parser tanto como permita
+// el límite del cuerpo
+const profundidadMaximaGraphQL = 15
+
+type parserGraphQL struct {
+	tokens      []string
+	pos         int
+	variables   map[string]interface{}
+	profundidad int
+}
+
+func parsearGraphQL(query string, variables map[string]interface{}) (*operacionGraphQL, error) {
+	tokens, err := tokenizarGraphQL(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("Consulta vacía")
+	}
+
+	p := &parserGraphQL{tokens: tokens, variables: variables}
+	operacion := &operacionGraphQL{Tipo: "query"}
+
+	// Forma abreviada "{ ... }" o con palabra clave query/mutation
+	if p.actual() != "{" {
+		operacion.Tipo = p.siguiente()
+		if operacion.Tipo != "query" && operacion.Tipo != "mutation" {
+			return nil, fmt.Errorf("Operación no soportada: %s", operacion.Tipo)
+		}
+		if esNombreGraphQL(p.actual()) {
+			p.siguiente()
+		}
+		if p.actual() == "(" {
+			err := p.definicionesVariables()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	operacion.Seleccion, err = p.seleccion()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("Solo se admite una operación por documento")
+	}
+
+	return operacion, nil
+}
+
+func (p *parserGraphQL) actual() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parserGraphQL) siguiente() string {
+	token := p.actual()
+	p.pos++
+	return token
+}
+
+// Entrar en un nivel de anidamiento; salir se hace con p.profundidad--
+func (p *parserGraphQL) anidar() error {
+	p.profundidad++
+	if p.profundidad > profundidadMaximaGraphQL {
+		return fmt.Errorf("La consulta supera la profundidad máxima de %d niveles", profundidadMaximaGraphQL)
+	}
+	return nil
+}
+
+func (p *parserGraphQL) esperar(token string) error {
+	if p.siguiente() != token {
+		return fmt.Errorf("Se esperaba %q", token)
+	}
+	return nil
+}
+
+// Las definiciones de variables solo aportan valores por defecto; los tipos
+// no se validan
+func (p *parserGraphQL) definicionesVariables() error {
+	p.siguiente()
+	for p.actual() != ")" {
+		if p.actual() == "" {
+			return errors.New("Definición de variables incompleta")
+		}
+		token := p.siguiente()
+		if !strings.HasPrefix(token, "$") {
+			continue
+		}
+		nombre := token[1:]
+		if err := p.esperar(":"); err != nil {
+			return err
+		}
+		// Saltar el tipo (Nombre, [Nombre], Nombre!)
+		for p.actual() != "=" && p.actual() != ")" && p.actual() != "" && !strings.HasPrefix(p.actual(), "$") {
+			p.siguiente()
+		}
+		if p.actual() == "=" {
+			p.siguiente()
+			valor, err := p.valor()
+			if err != nil {
+				return err
+			}
+			if _, ok := p.variables[nombre]; !ok {
+				if p.variables == nil {
+					p.variables = map[string]interface{}{}
+				}
+				p.variables[nombre] = valor
+			}
+		}
+	}
+	p.siguiente()
+	return nil
+}
+
+func (p *parserGraphQL) seleccion() ([]campoGraphQL, error) {
+	if err := p.esperar("{"); err != nil {
+		return nil, err
+	}
+	if err := p.anidar(); err != nil {
+		return nil, err
+	}
+	defer func() { p.profundidad-- }()
+
+	var campos []campoGraphQL
+	for p.actual() != "}" {
+		if !esNombreGraphQL(p.actual()) {
+			return nil, fmt.Errorf("Nombre de campo inválido: %q", p.actual())
+		}
+		campo := campoGraphQL{Nombre: p.siguiente()}
+
+		if p.actual() == ":" {
+			p.siguiente()
+			if !esNombreGraphQL(p.actual()) {
+				return nil, fmt.Errorf("Nombre de campo inválido: %q", p.actual())
+			}
+			campo.Alias = campo.Nombre
+			campo.Nombre = p.siguiente()
+		}
+
+		if p.actual() == "(" {
+			args, err := p.argumentos()
+			if err != nil {
+				return nil, err
+			}
+			campo.Argumentos = args
+		}
+
+		if p.actual() == "{" {
+			seleccion, err := p.seleccion()
+			if err != nil {
+				return nil, err
+			}
+			campo.Seleccion = seleccion
+		}
+
+		campos = append(campos, campo)
+	}
+	p.siguiente()
+
+	return campos, nil
+}
+
+func (p *parserGraphQL) argumentos() (map[string]interface{}, error) {
+	p.siguiente()
+	args := map[string]interface{}{}
+	for p.actual() != ")" {
+		if !esNombreGraphQL(p.actual()) {
+			return nil, fmt.Errorf("Nombre de argumento inválido: %q", p.actual())
+		}
+		nombre := p.siguiente()
+		if err := p.esperar(":"); err != nil {
+			return nil, err
+		}
+		valor, err := p.valor()
+		if err != nil {
+			return nil, err
+		}
+		args[nombre] = valor
+	}
+	p.siguiente()
+	return args, nil
+}
+
+func (p *parserGraphQL) valor() (interface{}, error) {
+	token := p.siguiente()
+	if token == "[" || token == "{" {
+		if err := p.anidar(); err != nil {
+			return nil, err
+		}
+		defer func() { p.profundidad-- }()
+	}
+
+	switch {
+	case token == "":
+		return nil, errors.New("Valor incompleto")
+	case strings.HasPrefix(token, "$"):
+		return p.variables[token[1:]], nil
+	case strings.HasPrefix(token, `"`):
+		return strconv.Unquote(token)
+	case token == "true" || token == "false":
+		return token == "true", nil
+	case token == "null":
+		return nil, nil
+	case token == "[":
+		lista := []interface{}{}
+		for p.actual() != "]" {
+			elemento, err := p.valor()
+			if err != nil {
+				return nil, err
+			}
+			lista = append(lista, elemento)
+		}
+		p.siguiente()
+		return lista, nil
+	case token == "{":
+		objeto := map[string]interface{}{}
+		for p.actual() != "}" {
+			nombre := p.siguiente()
+			if err := p.esperar(":"); err != nil {
+				return nil, err
+			}
+			valor, err := p.valor()
+			if err != nil {
+				return nil, err
+			}
+			objeto[nombre] = valor
+		}
+		p.siguiente()
+		return objeto, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '-':
+		if entero, err := strconv.Atoi(token); err == nil {
+			return entero, nil
+		}
+		return strconv.ParseFloat(token, 64)
+	case esNombreGraphQL(token):
+		// Valores de enumeración
+		return token, nil
+	}
+	return nil, fmt.Errorf("Valor inválido: %q", token)
+}
+
+func esNombreGraphQL(token string) bool {
+	if token == "" {
+		return false
+	}
+	for i, c := range token {
+		if c == '_' || unicode.IsLetter(c) || (i > 0 && unicode.IsDigit(c)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func tokenizarGraphQL(query string) ([]string, error) {
+	var tokens []string
+	runas := []rune(query)
+	for i := 0; i < len(runas); {
+		c := runas[i]
+		switch {
+		case unicode.IsSpace(c) || c == ',':
+			i++
+		case c == '#':
+			for i < len(runas) && runas[i] != '\n' {
+				i++
+			}
+		case strings.ContainsRune("{}()[]:!=", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			inicio := i
+			i++
+			for i < len(runas) && runas[i] != '"' {
+				if runas[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(runas) {
+				return nil, errors.New("Cadena sin cerrar")
+			}
+			i++
+			tokens = append(tokens, string(runas[inicio:i]))
+		case c == '$' || c == '_' || c == '-' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			inicio := i
+			i++
+			for i < len(runas) && (runas[i] == '_' || runas[i] == '.' || unicode.IsLetter(runas[i]) || unicode.IsDigit(runas[i])) {
+				i++
+			}
+			tokens = append(tokens, string(runas[inicio:i]))
+		default:
+			return nil, fmt.Errorf("Carácter inesperado: %q", c)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Los tokens inválidos en /graphql cuentan para el bloqueo igual que en
+// /admin
+func TestGraphQLTokenInvalidoBloquea(t *testing.T) {
+	anterior := config
+	defer func() {
+		config = anterior
+		muBloqueos.Lock()
+		bloqueosActivos = map[string]time.Time{}
+		contadoresFallos = map[string]*fallosIP{}
+		muBloqueos.Unlock()
+	}()
+	config.Admin.Token = "secreto"
+	config.Proteccion.FallosLogin = 3
+	config.Proteccion.VentanaMinutos = 15
+	config.Proteccion.BloqueoMinutos = 15
+
+	handler := rechazarIPsBloqueadas(http.HandlerFunc(graphqlHandler))
+	consulta := `{"query":"mutation { revocarCertificado(numero: \"MC-1\") }"}`
+	for i := 1; i <= 4; i++ {
+		r := httptest.NewRequest("POST", "/graphql", strings.NewReader(consulta))
+		r.RemoteAddr = "198.51.100.7:5000"
+		r.Header.Set("Authorization", "Bearer adivinado")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		esperado := http.StatusOK
+		if i == 4 {
+			esperado = http.StatusTooManyRequests
+		}
+		if w.Code != esperado {
+			t.Fatalf("intento %d: estado %d, se esperaba %d", i, w.Code, esperado)
+		}
+		if i < 4 && !strings.Contains(w.Body.String(), "No autorizado") {
+			t.Fatalf("intento %d: %s", i, w.Body.String())
+		}
+	}
+}
+
+func TestParsearGraphQLProfundidad(t *testing.T) {
+	anidada := func(niveles int) string {
+		return strings.Repeat("{a", niveles) + strings.Repeat("}", niveles)
+	}
+	if _, err := parsearGraphQL(anidada(profundidadMaximaGraphQL), nil); err != nil {
+		t.Errorf("selección de %d niveles rechazada: %v", profundidadMaximaGraphQL, err)
+	}
+
+	casos := map[string]string{
+		"selección":          anidada(profundidadMaximaGraphQL + 1),
+		"selección profunda": anidada(100000),
+		"lista":              "{ buscar(q: " + strings.Repeat("[", 100) + strings.Repeat("]", 100) + ") }",
+		"objeto":             "{ buscar(q: " + strings.Repeat("{a:", 100) + "1" + strings.Repeat("}", 100) + ") }",
+		"valor por defecto":  "query ($q: X = " + strings.Repeat("[", 100) + strings.Repeat("]", 100) + ") { buscar(q: $q) }",
+	}
+	for nombre, consulta := range casos {
+		if _, err := parsearGraphQL(consulta, nil); err == nil || !strings.Contains(err.Error(), "profundidad máxima") {
+			t.Errorf("%s: %v, se esperaba el error de profundidad", nombre, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(anidada(50)), nil)
+	w := httptest.NewRecorder()
+	graphqlHandler(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"errors"`) {
+		t.Errorf("estado %d, %s; se esperaba un error GraphQL con 400", w.Code, w.Body.String())
+	}
+}
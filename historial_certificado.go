@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// Historial de un certificado armado con lo que ya registran las tablas:
+// emisión, reemisión, reemplazo, revocación y borrado lógico en
+// Certificados, y las verificaciones agregadas por día y canal en
+// Verificaciones (las archivadas ya no aparecen). La API no identifica a
+// cada administrador, así que el actor de las acciones administrativas es
+// "admin" y el de las verificaciones es su canal. Los certificados no se
+// envían por email ni se transfieren entre clientes, por eso no hay eventos
+// de ese tipo.
+
+// Evento del historial de un certificado
+type EventoHistorialCertificado struct {
+	// emitido | reemitido | reemplazado | revocado | eliminado | verificado
+	Tipo  string `json:"tipo"`
+	Fecha Fecha  `json:"fecha"`
+	Actor string `json:"actor,omitempty"`
+	// Motivo de la revocación o de la reemisión
+	Motivo string `json:"motivo,omitempty"`
+	// Versión anterior en las reemisiones, nueva en los reemplazos
+	NumeroRelacionado string `json:"numero_relacionado,omitempty"`
+	// Verificaciones del día por el canal
+	Cantidad int `json:"cantidad,omitempty"`
+}
+
+// Eventos del certificado en orden cronológico; sql.ErrNoRows si no existe
+func consultarHistorialCertificado(db *sql.DB, numeroCertificado string) ([]EventoHistorialCertificado, error) {
+	rows, err := db.Query(`
+		WITH cer AS (
+			SELECT * FROM Certificados WHERE numero_certificado = $1
+		)
+		SELECT
+			CASE WHEN cer.version > 1 THEN 'reemitido' ELSE 'emitido' END,
+			cer.fecha_emision,
+			CASE WHEN cer.version > 1 THEN 'admin' ELSE '' END,
+			coalesce(cer.motivo_reemision, ''),
+			coalesce((
+				SELECT a.numero_certificado FROM Certificados a
+				WHERE a.vigente_id = coalesce(cer.vigente_id, cer.certificado_id) AND a.version = cer.version - 1
+			), ''),
+			0
+		FROM cer
+		WHERE cer.fecha_emision IS NOT NULL
+		UNION ALL
+		SELECT 'reemplazado', cer.reemplazado_en, 'admin', '', vig.numero_certificado, 0
+		FROM cer
+		JOIN Certificados vig ON vig.certificado_id = cer.vigente_id
+		WHERE cer.reemplazado_en IS NOT NULL
+		UNION ALL
+		SELECT 'revocado', cer.revocado_en, 'admin', coalesce(cer.motivo_revocacion, ''), '', 0
+		FROM cer
+		WHERE cer.revocado_en IS NOT NULL
+		UNION ALL
+		SELECT 'eliminado', cer.eliminado_en, 'admin', '', '', 0
+		FROM cer
+		WHERE cer.eliminado_en IS NOT NULL
+		UNION ALL
+		SELECT 'verificado', v.dia::timestamptz, v.canal, '', '', v.cantidad
+		FROM Verificaciones v
+		WHERE v.numero_certificado = $1 AND EXISTS (SELECT 1 FROM cer)
+		ORDER BY 2, 1`, numeroCertificado)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	historial := []EventoHistorialCertificado{}
+	for rows.Next() {
+		var e EventoHistorialCertificado
+		err := rows.Scan(&e.Tipo, &e.Fecha, &e.Actor, &e.Motivo, &e.NumeroRelacionado, &e.Cantidad)
+		if err != nil {
+			return nil, err
+		}
+		historial = append(historial, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(historial) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return historial, nil
+}
+
+// Handler para GET /admin/certificados/{numero}/historial
+func historialCertificadoHandler(w http.ResponseWriter, r *http.Request, numero string) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	historial, err := obtenerHistorialCertificado(r.Context(), numero)
+	if err != nil {
+		estado := estadoErrorCertificado(err)
+		if estado == http.StatusInternalServerError {
+			http.Error(w, "Error al consultar la base de datos", estado)
+		} else {
+			http.Error(w, err.Error(), estado)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(historial)
+}
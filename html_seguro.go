@@ -0,0 +1,91 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Limpieza de las descripciones de productos, que desde Rocketfy a veces
+// llegan con HTML arbitrario. Las respuestas llevan dos versiones seguras
+// de cada descripción: descripcion_html, con solo las etiquetas de formato
+// de etiquetasHTMLPermitidas y sin atributos, que el frontend puede
+// insertar tal cual, y descripcion_texto, sin etiquetas, para los lugares
+// donde no se interpreta HTML.
+
+// Etiquetas que se conservan al limpiar una descripción
+var etiquetasHTMLPermitidas = map[string]bool{
+	"p": true, "br": true, "ul": true, "ol": true, "li": true,
+	"strong": true, "b": true, "em": true, "i": true, "u": true,
+	"h3": true, "h4": true,
+}
+
+var (
+	reEtiquetaPermitida = regexp.MustCompile(`<\s*(/?)\s*([a-zA-Z][a-zA-Z0-9]*)[^>]*>`)
+	reBloqueOcultoHTML  = regexp.MustCompile(`(?is)<\s*(script|style)[^>]*>.*?<\s*/\s*(script|style)\s*>`)
+)
+
+// Dejar en una descripción solo las etiquetas permitidas, sin atributos; el
+// contenido de script y style se descarta y el texto se vuelve a escapar
+func limpiarHTML(contenido string) string {
+	contenido = reBloqueOcultoHTML.ReplaceAllString(contenido, "")
+	var b strings.Builder
+	inicio := 0
+	for _, m := range reEtiquetaPermitida.FindAllStringSubmatchIndex(contenido, -1) {
+		b.WriteString(html.EscapeString(html.UnescapeString(contenido[inicio:m[0]])))
+		inicio = m[1]
+		cierre, nombre := contenido[m[2]:m[3]], strings.ToLower(contenido[m[4]:m[5]])
+		if !etiquetasHTMLPermitidas[nombre] {
+			continue
+		}
+		b.WriteString("<" + cierre + nombre + ">")
+	}
+	b.WriteString(html.EscapeString(html.UnescapeString(contenido[inicio:])))
+	return strings.TrimSpace(b.String())
+}
+
+// Versiones HTML limpia y texto plano de una descripción
+func descripcionesSeguras(descripcion string) (string, string) {
+	limpia := limpiarHTML(descripcion)
+	return limpia, textoPlano(limpia)
+}
+
+// Lo mismo para las descripciones que pueden ser NULL
+func descripcionesSegurasNulas(descripcion *string) (*string, *string) {
+	if descripcion == nil {
+		return nil, nil
+	}
+	limpia, texto := descripcionesSeguras(*descripcion)
+	return &limpia, &texto
+}
+
+// Limpiar la descripción de un producto de un certificado (la original se
+// reemplaza por la versión HTML limpia)
+func limpiarDescripcionCertificado(producto *ProductoCertificado) {
+	producto.DescripcionHTML, producto.DescripcionTexto = descripcionesSegurasNulas(producto.Descripcion)
+	producto.Descripcion = producto.DescripcionHTML
+}
+
+// Copiar al certificado las descripciones de su producto principal
+func copiarDescripcionPrincipal(data *CertificateData) {
+	principal := data.Productos[0]
+	data.DescripcionProducto = principal.Descripcion
+	data.DescripcionProductoHTML = principal.DescripcionHTML
+	data.DescripcionProductoTexto = principal.DescripcionTexto
+}
+
+// Agregar descripcion_html y descripcion_texto a los productos de Rocketfy
+// que se devuelven sin convertir y limpiar su description. Los mapas deben
+// ser propios de la respuesta.
+func agregarDescripcionesRocketfy(productos []map[string]interface{}) {
+	for _, producto := range productos {
+		descripcion, ok := producto["description"].(string)
+		if !ok {
+			continue
+		}
+		limpia, texto := descripcionesSeguras(descripcion)
+		producto["description"] = limpia
+		producto["descripcion_html"] = limpia
+		producto["descripcion_texto"] = texto
+	}
+}
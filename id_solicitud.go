@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// Identificador de solicitud para correlacionar logs, respuestas de error
+// y llamadas salientes
+
+const encabezadoIDSolicitud = "X-Request-ID"
+
+type claveIDSolicitud struct{}
+
+// IDs recibidos aceptados; cualquier otro valor se reemplaza por uno nuevo
+var reIDSolicitud = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Middleware que asigna el ID de la solicitud (o respeta el recibido) y lo
+// devuelve en la respuesta
+func asignarIDSolicitud(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(encabezadoIDSolicitud)
+		if !reIDSolicitud.MatchString(id) {
+			id = idAleatorio(16)
+		}
+
+		w.Header().Set(encabezadoIDSolicitud, id)
+		w.Header().Add("Access-Control-Expose-Headers", encabezadoIDSolicitud)
+		ctx := context.WithValue(r.Context(), claveIDSolicitud{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func idSolicitud(ctx context.Context) string {
+	id, _ := ctx.Value(claveIDSolicitud{}).(string)
+	return id
+}
+
+// Escribir en el log anteponiendo el ID de la solicitud, si existe
+func logSolicitud(ctx context.Context, v ...interface{}) {
+	if id := idSolicitud(ctx); id != "" {
+		v = append([]interface{}{"[" + id + "]"}, v...)
+	}
+	log.Println(v...)
+}
+
+// Niveles de log.nivel
+const (
+	NivelLogInfo  = "info"
+	NivelLogError = "error"
+)
+
+// Escribir un mensaje de rutina (resúmenes de las tareas periódicas,
+// recargas), que con log.nivel "error" se omite. Lee el nivel en cada
+// llamada para que una recarga lo cambie sin reiniciar.
+func logInfo(formato string, args ...interface{}) {
+	if configActual().Log.Nivel == NivelLogError {
+		return
+	}
+	log.Printf(formato, args...)
+}
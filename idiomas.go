@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Respuestas en español o inglés según Accept-Language (o ?lang=, útil en
+// los enlaces al PDF). Los textos de productos y guías de cuidado se
+// traducen con la tabla Traducciones; los mensajes de error y las
+// etiquetas del PDF con el catálogo de abajo. Lo que no tiene traducción
+// se devuelve en español.
+
+const (
+	IdiomaEspanol = "es"
+	IdiomaIngles  = "en"
+)
+
+// Idiomas en los que se responde; el primero es el de los datos
+var idiomasSoportados = []string{IdiomaEspanol, IdiomaIngles}
+
+// Campos traducibles de cada entidad de la tabla Traducciones
+var camposTraducibles = map[string][]string{
+	"producto": {"nombre", "descripcion"},
+	"cuidado":  {"lavado", "peinado", "duracion"},
+}
+
+// Mensajes de error y etiquetas en inglés. Los mensajes con detalle
+// ("Plantilla inválida: ...") se traducen por la parte antes de ": ".
+var textosIngles = map[string]string{
+	// Errores
+	"Método no permitido":                                             "Method not allowed",
+	"Error al consultar la base de datos":                             "Error querying the database",
+	"Certificado no encontrado":                                       "Certificate not found",
+	"Certificado no encontrado o revocado":                            "Certificate not found or revoked",
+	"Número de certificado requerido":                                 "Certificate number required",
+	"JSON inválido":                                                   "Invalid JSON",
+	"Cuerpo inválido":                                                 "Invalid body",
+	"Cuerpo JSON inválido":                                            "Invalid JSON body",
+	"No autorizado":                                                   "Unauthorized",
+	"Identificador de producto inválido":                              "Invalid product identifier",
+	"Producto no encontrado":                                          "Product not found",
+	"Guía de cuidado no encontrada":                                   "Care guide not found",
+	"Enlace de verificación no válido o vencido":                      "Verification link is invalid or expired",
+	"Error al validar el enlace":                                      "Error validating the link",
+	"Enlace no encontrado":                                            "Link not found",
+	"La búsqueda requiere al menos 2 caracteres":                      "Search requires at least 2 characters",
+	"Error al generar el código de barras":                            "Error generating the barcode",
+	"Error al generar la página":                                      "Error generating the page",
+	"Error al generar la imagen":                                      "Error generating the image",
+	"Error al consultar los kits":                                     "Error querying the kits",
+	"Error al consultar los atributos":                                "Error querying the attributes",
+	"Error al consultar las ubicaciones":                              "Error querying the locations",
+	"Error al cotizar el envío":                                       "Error quoting the shipment",
+	"codigo_ciudad y productos requeridos":                            "codigo_ciudad and productos required",
+	"codigo_ciudad debe ser el código DANE de cinco dígitos":          "codigo_ciudad must be the five-digit DANE code",
+	"peso_gramos o cantidad inválidos":                                "Invalid peso_gramos or cantidad",
+	"El peso total supera el máximo cotizable":                        "Total weight exceeds the maximum that can be quoted",
+	"franja_id, numero_certificado y email requeridos":                "franja_id, numero_certificado and email required",
+	"updated_since debe ser RFC3339 o segundos Unix":                  "updated_since must be RFC3339 or Unix seconds",
+	"Variables JSON inválidas":                                        "Invalid JSON variables",
+	"Las mutaciones requieren POST":                                   "Mutations require POST",
+	"Ciudad no encontrada":                                            "City not found",
+	"Kit no encontrado":                                               "Kit not found",
+	"Envío no encontrado":                                             "Shipment not found",
+	"Atributo no encontrado (tipo_cabello, color o longitud)":         "Attribute not found (tipo_cabello, color or longitud)",
+	"Valor no permitido; los valores válidos están en GET /atributos": "Value not allowed; valid values are listed at GET /atributos",
+	"No se pudo verificar que no eres un robot; intenta de nuevo":     "We could not verify that you are not a robot; please try again",
+	"Error al guardar el mensaje":                                     "Error saving the message",
+	"email inválido":                                                  "Invalid email",
+	"telefono inválido":                                               "Invalid phone number",
+	"latitud y longitud van juntas":                                   "latitud and longitud must be sent together",
+	"latitud o longitud fuera de rango":                               "latitud or longitud out of range",
+	"latitud o longitud inválida":                                     "Invalid latitud or longitud",
+	"Las fotos deben ser JPEG, PNG o WebP":                            "Photos must be JPEG, PNG or WebP",
+	"Error al guardar el reporte":                                     "Error saving the report",
+	"Error al guardar las fotos":                                      "Error saving the photos",
+	"Host de imagen no permitido":                                     "Image host not allowed",
+	"El registro ya está eliminado":                                   "The record is already deleted",
+	"El registro no está eliminado":                                   "The record is not deleted",
+	"Error al actualizar el registro":                                 "Error updating the record",
+	"La URL no es una imagen":                                         "The URL is not an image",
+	"Error al obtener la imagen":                                      "Error fetching the image",
+	"No encontramos el certificado":                                   "We could not find the certificate",
+	"Envíame el número de tu certificado (p. ej. MC-ABCDEFGHIJ) y te digo si es auténtico.": "Send me your certificate number (e.g. MC-ABCDEFGHIJ) and I will tell you if it is genuine.",
+	"Enlace inválido o vencido":                  "Invalid or expired link",
+	"Error al registrar la suscripción":          "Error registering the subscription",
+	"Error al actualizar la suscripción":         "Error updating the subscription",
+	"Tu suscripción al boletín quedó confirmada": "Your newsletter subscription is confirmed",
+	"Cancelaste tu suscripción al boletín":       "You have unsubscribed from the newsletter",
+	"Moneda no soportada":                        "Unsupported currency",
+	"Transportadora no soportada":                "Unsupported carrier",
+	"Estamos realizando tareas de mantenimiento, vuelve a intentarlo en unos minutos": "We are performing maintenance, please try again in a few minutes",
+	"Demasiados intentos fallidos; vuelva a intentarlo más tarde":                     "Too many failed attempts; please try again later",
+	"El cuerpo de la solicitud supera el tamaño máximo permitido":                     "The request body exceeds the maximum allowed size",
+	"El servidor está saturado; vuelva a intentarlo en unos segundos":                 "The server is overloaded; please try again in a few seconds",
+	"La solicitud tardó más del tiempo máximo permitido":                              "The request took longer than the maximum allowed time",
+
+	// Certificado en PDF
+	"Certificado de autenticidad":                     "Certificate of authenticity",
+	"Este certificado fue revocado y ya no es válido": "This certificate was revoked and is no longer valid",
+	"Este certificado fue reemplazado por":            "This certificate was replaced by",
+	"Producto original Melenas Co":                    "Genuine Melenas Co product",
+	"Titular":                                         "Holder",
+	"Fecha de compra":                                 "Purchase date",
+	"Fecha de emisión":                                "Issue date",
+	"Incluido en el kit":                              "Included in kit",
+	"Tipo de cabello":                                 "Hair type",
+	"Color":                                           "Color",
+	"Longitud":                                        "Length",
+	"Cuidados":                                        "Care",
+	"Lavado":                                          "Washing",
+	"Peinado":                                         "Styling",
+	"Duración":                                        "Lifespan",
+}
+
+// Texto en el idioma indicado, o el original si no hay traducción
+func traducir(idioma, texto string) string {
+	if idioma != IdiomaIngles {
+		return texto
+	}
+	if traducido, ok := textosIngles[texto]; ok {
+		return traducido
+	}
+	if inicio, detalle, ok := strings.Cut(texto, ": "); ok {
+		if traducido, ok := textosIngles[inicio]; ok {
+			return traducido + ": " + detalle
+		}
+	}
+	return texto
+}
+
+func idiomaSoportado(idioma string) bool {
+	for _, i := range idiomasSoportados {
+		if i == idioma {
+			return true
+		}
+	}
+	return false
+}
+
+// Idioma soportado preferido según Accept-Language ("en-US,en;q=0.9,es;q=0.8");
+// español si ninguno coincide
+func preferirIdioma(acceptLanguage string) string {
+	elegido, mejorQ := IdiomaEspanol, 0.0
+	for _, parte := range strings.Split(acceptLanguage, ",") {
+		campos := strings.Split(strings.TrimSpace(parte), ";")
+		idioma, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(campos[0])), "-")
+		if !idiomaSoportado(idioma) {
+			continue
+		}
+		q := 1.0
+		for _, parametro := range campos[1:] {
+			parametro = strings.TrimSpace(parametro)
+			if strings.HasPrefix(parametro, "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimPrefix(parametro, "q="), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > mejorQ {
+			elegido, mejorQ = idioma, q
+		}
+	}
+	return elegido
+}
+
+type claveIdioma struct{}
+
+// Middleware que elige el idioma de la respuesta, lo guarda en el contexto y
+// traduce los mensajes de error en texto plano
+func negociarIdioma(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idioma := strings.ToLower(r.URL.Query().Get("lang"))
+		if !idiomaSoportado(idioma) {
+			idioma = preferirIdioma(r.Header.Get("Accept-Language"))
+		}
+
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Set("Content-Language", idioma)
+		ctx := context.WithValue(r.Context(), claveIdioma{}, idioma)
+		if idioma != IdiomaEspanol {
+			w = &respuestaTraducida{ResponseWriter: w, idioma: idioma}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Idioma de la solicitud (español fuera de una solicitud HTTP)
+func idiomaSolicitud(ctx context.Context) string {
+	if idioma, ok := ctx.Value(claveIdioma{}).(string); ok {
+		return idioma
+	}
+	return IdiomaEspanol
+}
+
+// ResponseWriter que traduce los errores escritos con http.Error
+type respuestaTraducida struct {
+	http.ResponseWriter
+	idioma    string
+	traducida bool
+}
+
+func (w *respuestaTraducida) WriteHeader(estado int) {
+	w.traducida = estado >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain")
+	w.ResponseWriter.WriteHeader(estado)
+}
+
+func (w *respuestaTraducida) Write(b []byte) (int, error) {
+	if !w.traducida {
+		return w.ResponseWriter.Write(b)
+	}
+	// http.Error escribe el mensaje de una vez con un salto de línea
+	mensaje := strings.TrimSuffix(string(b), "\n")
+	if _, err := w.ResponseWriter.Write([]byte(traducir(w.idioma, mensaje) + "\n")); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *respuestaTraducida) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Traducciones de una entidad a un idioma: entidad_id -> campo -> texto
+func consultarTraducciones(db *sql.DB, entidad string, ids []int, idioma string) (map[int]map[string]string, error) {
+	rows, err := db.Query(`
+		SELECT entidad_id, campo, texto FROM Traducciones
+		WHERE entidad = $1 AND entidad_id = ANY($2) AND idioma = $3`,
+		entidad, pq.Array(ids), idioma)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	traducciones := map[int]map[string]string{}
+	for rows.Next() {
+		var id int
+		var campo, texto string
+		if err := rows.Scan(&id, &campo, &texto); err != nil {
+			return nil, err
+		}
+		if traducciones[id] == nil {
+			traducciones[id] = map[string]string{}
+		}
+		traducciones[id][campo] = texto
+	}
+	return traducciones, rows.Err()
+}
+
+// Guardar las traducciones de una entidad; un texto vacío borra la del campo
+func guardarTraducciones(db *sql.DB, entidad string, id int, idioma string, campos map[string]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for campo, texto := range campos {
+		if strings.TrimSpace(texto) == "" {
+			_, err = tx.Exec(`
+				DELETE FROM Traducciones
+				WHERE entidad = $1 AND entidad_id = $2 AND idioma = $3 AND campo = $4`,
+				entidad, id, idioma, campo)
+		} else {
+			_, err = tx.Exec(`
+				INSERT INTO Traducciones (entidad, entidad_id, idioma, campo, texto)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (entidad, entidad_id, idioma, campo) DO UPDATE
+				SET texto = EXCLUDED.texto, actualizado_en = now()`,
+				entidad, id, idioma, campo, texto)
+		}
+		if e, ok := err.(*pq.Error); ok && e.Code == "23503" {
+			return errProductoInexistente
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Reemplazar un texto por su traducción, si existe
+func aplicarTraduccion(texto **string, traducciones map[string]string, campo string) {
+	if traducido, ok := traducciones[campo]; ok {
+		*texto = &traducido
+	}
+}
+
+func aplicarTraduccionCuidado(cuidado *Cuidado, traducciones map[string]string) {
+	if cuidado == nil {
+		return
+	}
+	for campo, texto := range map[string]*string{
+		"lavado":   &cuidado.Lavado,
+		"peinado":  &cuidado.Peinado,
+		"duracion": &cuidado.Duracion,
+	} {
+		if traducido, ok := traducciones[campo]; ok {
+			*texto = traducido
+		}
+	}
+}
+
+// Traducir los productos y cuidados de un certificado
+func traducirCertificado(db *sql.DB, data *CertificateData, idioma string) error {
+	ids := make([]int, len(data.Productos))
+	for i, producto := range data.Productos {
+		ids[i] = producto.ProductoID
+	}
+	productos, err := consultarTraducciones(db, "producto", ids, idioma)
+	if err != nil {
+		return err
+	}
+	cuidados, err := consultarTraducciones(db, "cuidado", ids, idioma)
+	if err != nil {
+		return err
+	}
+
+	for i := range data.Productos {
+		producto := &data.Productos[i]
+		aplicarTraduccion(&producto.Nombre, productos[producto.ProductoID], "nombre")
+		aplicarTraduccion(&producto.Descripcion, productos[producto.ProductoID], "descripcion")
+		limpiarDescripcionCertificado(producto)
+		aplicarTraduccionCuidado(producto.Cuidados, cuidados[producto.ProductoID])
+	}
+	data.NombreProducto = data.Productos[0].Nombre
+	copiarDescripcionPrincipal(data)
+	return nil
+}
+
+// Traducir una guía de cuidado
+func traducirCuidado(db *sql.DB, cuidado *Cuidado, idioma string) error {
+	traducciones, err := consultarTraducciones(db, "cuidado", []int{cuidado.ProductoID}, idioma)
+	if err != nil {
+		return err
+	}
+	aplicarTraduccionCuidado(cuidado, traducciones[cuidado.ProductoID])
+	return nil
+}
+
+// Handler para PUT /admin/traducciones/{entidad}/{producto_id}/{idioma}
+// {"nombre": "...", "descripcion": "..."}
+func traduccionesHandler(w http.ResponseWriter, r *http.Request) {
+	partes := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/traducciones/"), "/"), "/")
+	if len(partes) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	entidad, idioma := partes[0], partes[2]
+	campos, ok := camposTraducibles[entidad]
+	if !ok {
+		http.Error(w, "Entidad inválida (producto o cuidado)", http.StatusBadRequest)
+		return
+	}
+	productoID, err := strconv.Atoi(partes[1])
+	if err != nil || productoID <= 0 {
+		http.Error(w, "Identificador de producto inválido", http.StatusBadRequest)
+		return
+	}
+	if !idiomaSoportado(idioma) || idioma == IdiomaEspanol {
+		http.Error(w, "Idioma inválido; el español se edita en la entidad", http.StatusBadRequest)
+		return
+	}
+	if r.Method != "PUT" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var textos map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&textos); err != nil || len(textos) == 0 {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	for campo := range textos {
+		valido := false
+		for _, c := range campos {
+			valido = valido || c == campo
+		}
+		if !valido {
+			http.Error(w, "Campo no traducible: "+campo, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := actualizarTraducciones(entidad, productoID, idioma, textos); err != nil {
+		if err == errProductoInexistente {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, "Error al guardar las traducciones", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// IVA por categoría de producto. La tarifa se fija en cada línea de compra
+// la primera vez que se calcula, de modo que cambiar las reglas no altera
+// compras ya liquidadas. Las tarifas se manejan en centésimas de punto
+// porcentual (1900 = 19 %) y los montos en centavos.
+
+// Tarifa de IVA para una categoría de producto
+type ReglaImpuesto struct {
+	Categoria string  `yaml:"categoria"`
+	IVA       float64 `yaml:"iva"`
+}
+
+// Desglose de IVA de una compra para una tarifa
+type ImpuestoCompra struct {
+	Tarifa string `json:"tarifa"`
+	Base   string `json:"base"`
+	Valor  string `json:"valor"`
+}
+
+// Precio unitario en pesos de una línea nueva: el informado (el parámetro
+// %[1]s, en centavos) o, si falta, el de catálogo del producto %[2]s, que es
+// el del kit o el del producto sincronizado de Rocketfy con el mismo SKU.
+// La migración 047 aplica la misma regla a las líneas anteriores.
+const sqlPrecioLinea = `coalesce(%[1]s::bigint / 100.0,
+	(SELECT k.precio FROM Kits k WHERE k.kit_id = %[2]s),
+	(SELECT round((ps.datos->>'price')::numeric, 2)
+		FROM ProductosSincronizados ps
+		JOIN Productos p ON p.sku = ps.datos->>'sku'
+		WHERE p.producto_id = %[2]s AND jsonb_typeof(ps.datos->'price') = 'number'
+			AND ps.eliminado_en IS NULL
+		LIMIT 1))`
+
+// Liquidar una línea: tarifa de su categoría, base e IVA del total
+func liquidarLinea(cantidad int, precio int64, categoria string, incluido bool) (tarifa, base, iva int64) {
+	tarifa = tarifaIVA(categoria)
+	base, iva = desglosarIVA(int64(cantidad)*precio, tarifa, incluido)
+	return tarifa, base, iva
+}
+
+// Tarifa configurada para la categoría (la tarifa por defecto si ninguna
+// regla coincide)
+func tarifaIVA(categoria string) int64 {
+	c := configActual().Impuestos
+	iva := c.IVAPorDefecto
+	for _, regla := range c.Reglas {
+		if strings.EqualFold(regla.Categoria, categoria) {
+			iva = regla.IVA
+			break
+		}
+	}
+	return int64(math.Round(iva * 100))
+}
+
+// Dividir el valor de una línea en base e IVA. Si los precios incluyen el
+// IVA se descuenta del total; si no, se suma a la base.
+func desglosarIVA(total, tarifa int64, incluido bool) (base, iva int64) {
+	if !incluido {
+		return total, (total*tarifa + 5000) / 10000
+	}
+	base = (total*10000*2 + 10000 + tarifa) / (2 * (10000 + tarifa))
+	return base, total - base
+}
+
+// Fijar la tarifa de las líneas que aún no la tienen y guardar el desglose
+// por tarifa de la compra
+func calcularImpuestosCompra(tx *sql.Tx, compraID int) ([]ImpuestoCompra, error) {
+	rows, err := tx.Query(`
+		SELECT dc.producto_id, dc.cantidad, (dc.precio_unitario * 100)::bigint, coalesce(p.categoria, '')
+		FROM DetallesCompra dc
+		JOIN Productos p ON p.producto_id = dc.producto_id
+		WHERE dc.compra_id = $1 AND dc.tarifa_iva IS NULL
+		FOR UPDATE OF dc`, compraID)
+	if err != nil {
+		return nil, err
+	}
+
+	type pendiente struct {
+		productoID int
+		cantidad   int
+		precio     sql.NullInt64
+		categoria  string
+	}
+	var pendientes []pendiente
+	for rows.Next() {
+		var p pendiente
+		if err := rows.Scan(&p.productoID, &p.cantidad, &p.precio, &p.categoria); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pendientes = append(pendientes, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	incluido := configActual().Impuestos.PreciosIncluyenIVA
+	for _, p := range pendientes {
+		if !p.precio.Valid {
+			return nil, errCompraSinPrecios
+		}
+		tarifa, base, iva := liquidarLinea(p.cantidad, p.precio.Int64, p.categoria, incluido)
+		_, err = tx.Exec(`
+			UPDATE DetallesCompra SET tarifa_iva = $3, base = $4, iva = $5
+			WHERE compra_id = $1 AND producto_id = $2 AND tarifa_iva IS NULL`,
+			compraID, p.productoID, formatoMonto(tarifa), formatoMonto(base), formatoMonto(iva))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM ImpuestosCompra WHERE compra_id = $1`, compraID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO ImpuestosCompra (compra_id, tarifa, base, valor)
+		SELECT compra_id, tarifa_iva, sum(base), sum(iva)
+		FROM DetallesCompra
+		WHERE compra_id = $1
+		GROUP BY compra_id, tarifa_iva`, compraID)
+	if err != nil {
+		return nil, err
+	}
+
+	return consultarImpuestosCompra(tx, compraID)
+}
+
+// Desglose guardado de una compra
+func consultarImpuestosCompra(db consultorFilas, compraID int) ([]ImpuestoCompra, error) {
+	rows, err := db.Query(`
+		SELECT tarifa::text, base::text, valor::text
+		FROM ImpuestosCompra
+		WHERE compra_id = $1
+		ORDER BY tarifa DESC`, compraID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	impuestos := []ImpuestoCompra{}
+	for rows.Next() {
+		var i ImpuestoCompra
+		if err := rows.Scan(&i.Tarifa, &i.Base, &i.Valor); err != nil {
+			return nil, err
+		}
+		impuestos = append(impuestos, i)
+	}
+	return impuestos, rows.Err()
+}
+
+// Calcular y guardar el desglose de IVA de una compra
+func liquidarImpuestosCompra(db *sql.DB, compraID int) ([]ImpuestoCompra, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var existe bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM Compras WHERE compra_id = $1)`, compraID).Scan(&existe)
+	if err != nil {
+		return nil, err
+	}
+	if !existe {
+		return nil, errCompraNoEncontrada
+	}
+
+	impuestos, err := calcularImpuestosCompra(tx, compraID)
+	if err != nil {
+		return nil, err
+	}
+	return impuestos, tx.Commit()
+}
+
+// Handler para /admin/compras/{id}/impuestos: GET devuelve el desglose
+// guardado y POST lo calcula para las líneas pendientes
+func impuestosCompraHandler(w http.ResponseWriter, r *http.Request, compraID int) {
+	var impuestos []ImpuestoCompra
+	var err error
+	switch r.Method {
+	case "GET":
+		impuestos, err = obtenerImpuestosCompra(r.Context(), compraID)
+	case "POST":
+		impuestos, err = liquidarImpuestos(compraID)
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		responderErrorFactura(w, r, err, "Error al calcular los impuestos")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(impuestos)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// El desglose redondea al centavo más cercano y base más IVA siempre suma
+// el total cuando el precio incluye el impuesto
+func TestDesglosarIVA(t *testing.T) {
+	casos := []struct {
+		nombre   string
+		total    int64
+		tarifa   int64
+		incluido bool
+		base     int64
+		iva      int64
+	}{
+		{"sin incluir", 10000, 1900, false, 10000, 1900},
+		{"sin incluir redondea hacia arriba", 3, 1900, false, 3, 1},
+		{"sin incluir redondea hacia abajo", 2, 1900, false, 2, 0},
+		{"sin incluir medio centavo", 5, 1000, false, 5, 1},
+		{"incluido exacto", 11900, 1900, true, 10000, 1900},
+		{"incluido con redondeo", 100, 1900, true, 84, 16},
+		{"incluido un millón", 1000000, 1900, true, 840336, 159664},
+		{"incluido cinco por ciento", 10500, 500, true, 10000, 500},
+		{"exento incluido", 5000, 0, true, 5000, 0},
+		{"exento sin incluir", 5000, 0, false, 5000, 0},
+		{"total cero", 0, 1900, true, 0, 0},
+	}
+	for _, caso := range casos {
+		base, iva := desglosarIVA(caso.total, caso.tarifa, caso.incluido)
+		if base != caso.base || iva != caso.iva {
+			t.Errorf("%s: base %d e IVA %d, se esperaba %d y %d", caso.nombre, base, iva, caso.base, caso.iva)
+		}
+		if caso.incluido && base+iva != caso.total {
+			t.Errorf("%s: base %d + IVA %d no suman el total %d", caso.nombre, base, iva, caso.total)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Kits: un producto que se vende como conjunto de otros (p. ej. "3 bundles +
+// cierre") con un precio propio. Se definen por la API de administración o
+// se toman de Rocketfy cuando el producto trae "components" con el SKU y la
+// cantidad de cada parte. En los certificados el kit se expande en sus
+// componentes y la disponibilidad se calcula con el stock de cada uno.
+
+// Origen de la definición de un kit
+const (
+	OrigenKitLocal    = "local"
+	OrigenKitRocketfy = "rocketfy"
+)
+
+var (
+	errKitInvalido    = errors.New("Un kit necesita precio y al menos un componente distinto del propio kit")
+	errKitAnidado     = errors.New("Un componente no puede ser otro kit")
+	errKitInexistente = errors.New("Kit no encontrado")
+
+	errProductoInexistente = errors.New("Producto no encontrado")
+)
+
+type ComponenteKit struct {
+	ProductoID int     `json:"producto_id"`
+	Nombre     string  `json:"nombre,omitempty"`
+	SKU        *string `json:"sku,omitempty"`
+	Cantidad   int     `json:"cantidad"`
+	// Stock del componente según la última sincronización con Rocketfy
+	Stock *int `json:"stock,omitempty"`
+}
+
+type Kit struct {
+	ProductoID  int             `json:"producto_id"`
+	Nombre      string          `json:"nombre"`
+	Precio      string          `json:"precio"`
+	Origen      string          `json:"origen"`
+	Componentes []ComponenteKit `json:"componentes"`
+	Moneda      string          `json:"moneda"`
+	// Tasa usada si el precio se pidió en otra moneda con ?currency=
+	TasaCambio *TasaCambio `json:"tasa_cambio,omitempty"`
+	// Kits que se pueden armar con el stock de los componentes; null si
+	// falta el stock de alguno
+	Disponibles *int `json:"disponibles"`
+}
+
+// Guardar la definición de un kit reemplazando sus componentes
+func guardarKit(tx *sql.Tx, kitID int, precio int64, origen string, componentes []ComponenteKit) error {
+	if precio < 0 || len(componentes) == 0 {
+		return errKitInvalido
+	}
+	for _, c := range componentes {
+		if c.ProductoID == kitID || c.Cantidad <= 0 {
+			return errKitInvalido
+		}
+	}
+
+	// Ni el kit puede ser componente de otro ni sus componentes pueden ser
+	// kits: la expansión es de un solo nivel
+	var anidado bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM ComponentesKit WHERE producto_id = $1)
+			OR EXISTS (SELECT 1 FROM Kits WHERE kit_id = ANY($2))`,
+		kitID, pq.Array(idsComponentes(componentes))).Scan(&anidado)
+	if err != nil {
+		return err
+	}
+	if anidado {
+		return errKitAnidado
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO Kits (kit_id, precio, origen) VALUES ($1, $2, $3)
+		ON CONFLICT (kit_id) DO UPDATE SET precio = EXCLUDED.precio, origen = EXCLUDED.origen, actualizado_en = now()`,
+		kitID, formatoMonto(precio), origen)
+	if e, ok := err.(*pq.Error); ok && e.Code == "23503" {
+		return errProductoInexistente
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM ComponentesKit WHERE kit_id = $1`, kitID)
+	if err != nil {
+		return err
+	}
+	for _, c := range componentes {
+		_, err = tx.Exec(`
+			INSERT INTO ComponentesKit (kit_id, producto_id, cantidad) VALUES ($1, $2, $3)
+			ON CONFLICT (kit_id, producto_id) DO UPDATE SET cantidad = ComponentesKit.cantidad + EXCLUDED.cantidad`,
+			kitID, c.ProductoID, c.Cantidad)
+		if e, ok := err.(*pq.Error); ok && e.Code == "23503" {
+			return errProductoInexistente
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func idsComponentes(componentes []ComponenteKit) []int {
+	ids := make([]int, len(componentes))
+	for i, c := range componentes {
+		ids[i] = c.ProductoID
+	}
+	return ids
+}
+
+// Definir un kit localmente; prevalece sobre la definición de Rocketfy
+func definirKit(db *sql.DB, kitID int, precio int64, componentes []ComponenteKit) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := guardarKit(tx, kitID, precio, OrigenKitLocal, componentes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func eliminarKit(db *sql.DB, kitID int) error {
+	resultado, err := db.Exec(`DELETE FROM Kits WHERE kit_id = $1`, kitID)
+	if err != nil {
+		return err
+	}
+	if n, err := resultado.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = errKitInexistente
+		}
+		return err
+	}
+	return nil
+}
+
+// Tomar los kits de los productos de Rocketfy que traen
+// "components": [{"sku": "...", "quantity": 3}]. El kit y sus componentes
+// se buscan por SKU entre los productos locales; los que no se encuentran
+// se omiten. Los kits definidos localmente no se modifican.
+func sincronizarKits(tx *sql.Tx, productos []map[string]interface{}) (sincronizados, omitidos int, err error) {
+	for _, producto := range productos {
+		partes, ok := producto["components"].([]interface{})
+		if !ok || len(partes) == 0 {
+			continue
+		}
+
+		sku, _ := producto["sku"].(string)
+		precio, _ := producto["price"].(float64)
+		var kitID int
+		var origen sql.NullString
+		err := tx.QueryRow(`
+			SELECT p.producto_id, k.origen
+			FROM Productos p LEFT JOIN Kits k ON k.kit_id = p.producto_id
+			WHERE p.sku = $1`, sku).Scan(&kitID, &origen)
+		if err == sql.ErrNoRows {
+			omitidos++
+			continue
+		}
+		if err != nil {
+			return sincronizados, omitidos, err
+		}
+		if origen.String == OrigenKitLocal {
+			continue
+		}
+
+		var componentes []ComponenteKit
+		completo := true
+		for _, parte := range partes {
+			datos, _ := parte.(map[string]interface{})
+			skuParte, _ := datos["sku"].(string)
+			cantidad, _ := datos["quantity"].(float64)
+			var componente ComponenteKit
+			err := tx.QueryRow(`SELECT producto_id FROM Productos WHERE sku = $1`, skuParte).Scan(&componente.ProductoID)
+			if err == sql.ErrNoRows || cantidad < 1 {
+				completo = false
+				break
+			}
+			if err != nil {
+				return sincronizados, omitidos, err
+			}
+			componente.Cantidad = int(cantidad)
+			componentes = append(componentes, componente)
+		}
+		if !completo {
+			omitidos++
+			continue
+		}
+
+		err = guardarKit(tx, kitID, int64(math.Round(precio*100)), OrigenKitRocketfy, componentes)
+		if err == errKitInvalido || err == errKitAnidado {
+			omitidos++
+			continue
+		}
+		if err != nil {
+			return sincronizados, omitidos, fmt.Errorf("Error al guardar el kit %s: %v", sku, err)
+		}
+		sincronizados++
+	}
+	return sincronizados, omitidos, nil
+}
+
+// Kits con sus componentes y el stock sincronizado de cada uno; los kits
+// cuyo producto está eliminado solo con incluirEliminados
+func consultarKits(db *sql.DB, incluirEliminados bool) ([]Kit, error) {
+	rows, err := db.Query(`
+		SELECT k.kit_id, pk.nombre, (k.precio * 100)::bigint, k.origen,
+			ck.producto_id, p.nombre, p.sku, ck.cantidad, (ps.datos->>'stock')::int
+		FROM Kits k
+		JOIN Productos pk ON pk.producto_id = k.kit_id
+		JOIN ComponentesKit ck ON ck.kit_id = k.kit_id
+		JOIN Productos p ON p.producto_id = ck.producto_id
+		LEFT JOIN ProductosSincronizados ps ON ps.datos->>'sku' = p.sku AND ps.eliminado_en IS NULL
+		WHERE pk.eliminado_en IS NULL OR $1
+		ORDER BY pk.nombre, k.kit_id, ck.producto_id`, incluirEliminados)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	kits := []Kit{}
+	for rows.Next() {
+		var kitID int
+		var nombre, origen string
+		var precio int64
+		var componente ComponenteKit
+		if err := rows.Scan(&kitID, &nombre, &precio, &origen,
+			&componente.ProductoID, &componente.Nombre, &componente.SKU, &componente.Cantidad, &componente.Stock); err != nil {
+			return nil, err
+		}
+		if len(kits) == 0 || kits[len(kits)-1].ProductoID != kitID {
+			kits = append(kits, Kit{ProductoID: kitID, Nombre: nombre, Precio: formatoMonto(precio), Origen: origen, Moneda: MonedaBase})
+		}
+		kit := &kits[len(kits)-1]
+		kit.Componentes = append(kit.Componentes, componente)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range kits {
+		kits[i].Disponibles = kitsDisponibles(kits[i].Componentes)
+	}
+	return kits, nil
+}
+
+// Kits completos que se pueden armar con el stock de los componentes
+func kitsDisponibles(componentes []ComponenteKit) *int {
+	disponibles := math.MaxInt32
+	for _, c := range componentes {
+		if c.Stock == nil {
+			return nil
+		}
+		if n := *c.Stock / c.Cantidad; n < disponibles {
+			disponibles = n
+		}
+	}
+	if disponibles < 0 {
+		disponibles = 0
+	}
+	return &disponibles
+}
+
+// Handler para GET /kits?currency=USD
+func kitsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tasa, ok := tasaSolicitada(w, r)
+	if !ok {
+		return
+	}
+
+	kits, err := obtenerKits(contextoIncluirEliminados(r))
+	if err != nil {
+		http.Error(w, "Error al consultar los kits", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	if tasa != nil {
+		for i := range kits {
+			precio, err := parsearMonto(kits[i].Precio)
+			if err != nil {
+				http.Error(w, "Error al consultar los kits", http.StatusInternalServerError)
+				logSolicitud(r.Context(), err)
+				return
+			}
+			kits[i].Precio = formatoMonto(convertirCentavos(precio, tasa))
+			kits[i].Moneda = tasa.Moneda
+			kits[i].TasaCambio = tasa
+		}
+	}
+	responderJSONConETag(w, r, kits, cacheControlProductos())
+}
+
+// Handler para /admin/kits/{producto_id}: PUT define el kit
+// {"precio": "1150000.00", "componentes": [{"producto_id": 3, "cantidad": 3}]}
+// y DELETE lo elimina
+func editarKitHandler(w http.ResponseWriter, r *http.Request) {
+	kitID, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/kits/"), "/"))
+	if err != nil || kitID <= 0 {
+		http.Error(w, "Identificador de producto inválido", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		var solicitud struct {
+			Precio      string          `json:"precio"`
+			Componentes []ComponenteKit `json:"componentes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+		precio, err := parsearMonto(solicitud.Precio)
+		if err != nil {
+			http.Error(w, "precio inválido", http.StatusBadRequest)
+			return
+		}
+		err = actualizarKit(kitID, precio, solicitud.Componentes)
+		if err != nil {
+			responderErrorKit(w, r, err, "Error al guardar el kit")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if err := borrarKit(kitID); err != nil {
+			responderErrorKit(w, r, err, "Error al eliminar el kit")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func responderErrorKit(w http.ResponseWriter, r *http.Request, err error, mensaje string) {
+	switch err {
+	case errKitInvalido, errKitAnidado:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errKitInexistente, errProductoInexistente:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, mensaje, http.StatusInternalServerError)
+	}
+	logSolicitud(r.Context(), err)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Límite del tamaño del cuerpo de las solicitudes: limites.cuerpo_maximo_kb
+// para todas las rutas y limites.rutas para las que reciben archivos (por
+// prefijo, gana el más largo). Un cuerpo que lo supera se rechaza con 413 en
+// JSON, ya sea por el Content-Length o al leerlo; los límites propios de
+// cada handler siguen aplicando dentro de este.
+
+// Límite por defecto de todas las rutas
+const cuerpoMaximoKBPorDefecto = 1024
+
+// Rutas que necesitan más que el límite global aunque no se configuren
+var limitesRutaPorDefecto = map[string]int{
+	"/reportar_falsificacion": (maximoFotosFalsificacion*tamanoMaximoFotoFalsificacion + 1<<20) >> 10,
+}
+
+// Límite en bytes del cuerpo de una ruta
+func limiteCuerpoRuta(ruta string) int64 {
+	ajustes := configActual().Limites
+	limite, largo := ajustes.CuerpoMaximoKB, -1
+	for _, rutas := range []map[string]int{limitesRutaPorDefecto, ajustes.Rutas} {
+		for prefijo, kb := range rutas {
+			// Las rutas configuradas reemplazan a las por defecto del mismo prefijo
+			if strings.HasPrefix(ruta, prefijo) && len(prefijo) >= largo {
+				limite, largo = kb, len(prefijo)
+			}
+		}
+	}
+	return int64(limite) << 10
+}
+
+// Responder 413 con el límite aplicado
+func responderCuerpoDemasiadoGrande(w http.ResponseWriter, r *http.Request, limite int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":        traducir(idiomaSolicitud(r.Context()), "El cuerpo de la solicitud supera el tamaño máximo permitido"),
+		"limite_bytes": limite,
+		"request_id":   idSolicitud(r.Context()),
+	})
+}
+
+// Middleware que limita el tamaño del cuerpo de las solicitudes
+func limitarCuerpo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limite := limiteCuerpoRuta(r.URL.Path)
+		if r.ContentLength > limite {
+			responderCuerpoDemasiadoGrande(w, r, limite)
+			return
+		}
+
+		cuerpo := &cuerpoLimitado{ReadCloser: http.MaxBytesReader(w, r.Body, limite)}
+		r.Body = cuerpo
+		next.ServeHTTP(&respuestaLimitada{ResponseWriter: w, solicitud: r, cuerpo: cuerpo, limite: limite}, r)
+	})
+}
+
+// Cuerpo que recuerda si se superó el límite
+type cuerpoLimitado struct {
+	io.ReadCloser
+	excedido bool
+}
+
+func (c *cuerpoLimitado) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	var errLimite *http.MaxBytesError
+	if errors.As(err, &errLimite) {
+		c.excedido = true
+	}
+	return n, err
+}
+
+// ResponseWriter que cambia el error que escriba el handler tras superar el
+// límite (un 400 por JSON inválido, p. ej.) por el 413
+type respuestaLimitada struct {
+	http.ResponseWriter
+	solicitud   *http.Request
+	cuerpo      *cuerpoLimitado
+	limite      int64
+	reemplazada bool
+}
+
+func (w *respuestaLimitada) WriteHeader(estado int) {
+	if w.reemplazada {
+		return
+	}
+	if w.cuerpo.excedido && estado >= 400 {
+		w.reemplazada = true
+		responderCuerpoDemasiadoGrande(w.ResponseWriter, w.solicitud, w.limite)
+		return
+	}
+	w.ResponseWriter.WriteHeader(estado)
+}
+
+func (w *respuestaLimitada) Write(b []byte) (int, error) {
+	if w.reemplazada {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *respuestaLimitada) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
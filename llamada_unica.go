@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Deduplicación de llamadas idénticas a servicios externos (como
+// golang.org/x/sync/singleflight): mientras una llamada con la misma clave
+// está en curso, las siguientes esperan su resultado en lugar de repetirla.
+// La llamada compartida no se cancela si quien la inició se va; cada
+// solicitud deja de esperar con su propio contexto.
+
+// Llamada en curso o terminada
+type llamadaUnica struct {
+	listo chan struct{}
+	valor interface{}
+	err   error
+}
+
+// Grupo de llamadas por clave
+type grupoLlamadas struct {
+	mu       sync.Mutex
+	llamadas map[string]*llamadaUnica
+	// Llamadas que se resolvieron con el resultado de otra
+	compartidas uint64
+}
+
+// Ejecutar f una sola vez por clave entre las llamadas concurrentes. f
+// recibe un contexto con los valores (ID de solicitud, traza) del que la
+// inicia pero sin su cancelación, limitado a plazo.
+func (g *grupoLlamadas) hacer(ctx context.Context, clave string, plazo time.Duration, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.llamadas == nil {
+		g.llamadas = map[string]*llamadaUnica{}
+	}
+	llamada, enCurso := g.llamadas[clave]
+	if enCurso {
+		atomic.AddUint64(&g.compartidas, 1)
+	} else {
+		llamada = &llamadaUnica{listo: make(chan struct{})}
+		g.llamadas[clave] = llamada
+	}
+	g.mu.Unlock()
+
+	if !enCurso {
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					llamada.err = fmt.Errorf("Error en la llamada compartida %s: %v", clave, p)
+				}
+				g.mu.Lock()
+				delete(g.llamadas, clave)
+				g.mu.Unlock()
+				close(llamada.listo)
+			}()
+			ctxLlamada, cancelar := context.WithTimeout(contextoDesacoplado{ctx}, plazo)
+			defer cancelar()
+			llamada.valor, llamada.err = f(ctxLlamada)
+		}()
+	}
+
+	select {
+	case <-llamada.listo:
+		return llamada.valor, llamada.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Contexto con los valores de otro pero sin su plazo ni su cancelación
+type contextoDesacoplado struct {
+	context.Context
+}
+
+func (contextoDesacoplado) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (contextoDesacoplado) Done() <-chan struct{}       { return nil }
+func (contextoDesacoplado) Err() error                  { return nil }
@@ -1,44 +1,97 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	_ "time/tzdata" // Zonas horarias embebidas para servidores sin tzdata
 
 	_ "github.com/lib/pq" // Driver de PostgreSQL
 	"gopkg.in/yaml.v3"
 )
 
-// Estructura para los datos del certificado
+// Estructura para los datos del certificado. Los campos que pueden ser
+// NULL en la base de datos son punteros y se serializan como null.
 type CertificateData struct {
-	NombreCliente        string `json:"nombre_cliente"`
-	ApellidoCliente      string `json:"apellido_cliente"`
-	EmailCliente         string `json:"email_cliente"`
-	NombreProducto       string `json:"nombre_producto"`
-	DescripcionProducto  string `json:"descripcion_producto"`
-	TipoCabello          string `json:"tipo_cabello"`
-	Color                string `json:"color"`
-	Longitud             string `json:"longitud"`
-	ImagenURL            string `json:"imagen_url"`
-	FechaCompra          string `json:"fecha_compra"`
-	FechaEmision         string `json:"fecha_emision"`
-	NumeroCertificado    string `json:"numero_certificado"`
-	EstadoPago           string `json:"estado_pago"`
+	NombreCliente       *string `json:"nombre_cliente"`
+	ApellidoCliente     *string `json:"apellido_cliente"`
+	EmailCliente        *string `json:"email_cliente"`
+	NombreProducto      *string `json:"nombre_producto"`
+	DescripcionProducto *string `json:"descripcion_producto"`
+	// Descripción con solo HTML de formato y en texto plano
+	DescripcionProductoHTML  *string  `json:"descripcion_producto_html"`
+	DescripcionProductoTexto *string  `json:"descripcion_producto_texto"`
+	TipoCabello              *string  `json:"tipo_cabello"`
+	Color                    *string  `json:"color"`
+	Longitud                 *string  `json:"longitud"`
+	ImagenURL                *string  `json:"imagen_url"`
+	FechaCompra              *Fecha   `json:"fecha_compra"`
+	FechaEmision             *Fecha   `json:"fecha_emision"`
+	NumeroCertificado        string   `json:"numero_certificado"`
+	EstadoPago               *string  `json:"estado_pago"`
+	Revocado                 bool     `json:"revocado"`
+	CodigoCorto              *string  `json:"codigo_corto"`
+	Cuidados                 *Cuidado `json:"cuidados"`
+	// Todas las líneas de la compra; los campos del producto de arriba son
+	// los del primero, para los clientes que leen un solo producto
+	Productos []ProductoCertificado `json:"productos"`
+	Plantilla *string               `json:"-"`
+	// Solo lo ven los administradores con include_deleted=true
+	EliminadoEn *Fecha `json:"eliminado_en,omitempty"`
+	// Versión del certificado y, si fue reemitido, el número que lo reemplaza
+	Version        int     `json:"version"`
+	ReemplazadoPor *string `json:"reemplazado_por,omitempty"`
+	// Con ?expand=cliente y ?expand=envio (expansion.go)
+	Cliente  *ClienteRelacionado `json:"cliente,omitempty"`
+	Envio    *Envio              `json:"envio,omitempty"`
+	compraID int
+}
+
+// Producto cubierto por un certificado
+type ProductoCertificado struct {
+	ProductoID int     `json:"producto_id"`
+	Nombre     *string `json:"nombre"`
+	// Igual a descripcion_html; se mantiene por compatibilidad
+	Descripcion      *string  `json:"descripcion"`
+	DescripcionHTML  *string  `json:"descripcion_html"`
+	DescripcionTexto *string  `json:"descripcion_texto"`
+	TipoCabello      *string  `json:"tipo_cabello"`
+	Color            *string  `json:"color"`
+	Longitud         *string  `json:"longitud"`
+	ImagenURL        *string  `json:"imagen_url"`
+	Cantidad         int      `json:"cantidad"`
+	Cuidados         *Cuidado `json:"cuidados"`
+	// Nombre del kit del que hace parte, si se vendió en un kit
+	Kit *string `json:"kit,omitempty"`
+	// Producto del catálogo con ?expand=producto
+	Producto *ProductoRelacionado `json:"producto,omitempty"`
 }
 
 // Estructura para los datos del producto
 type Product struct {
+	// Producto local con el mismo SKU; 0 si no existe
 	ID          int    `json:"id"`
+	RocketfyID  string `json:"rocketfy_id,omitempty"`
+	SKU         string `json:"sku,omitempty"`
 	Nombre      string `json:"nombre"`
 	Descripcion string `json:"descripcion"`
-	TipoCabello string `json:"tipo_cabello"`
-	Color       string `json:"color"`
-	Longitud    string `json:"longitud"`
-	ImagenURL   string `json:"imagen_url"`
+	// Descripción con solo HTML de formato y en texto plano
+	DescripcionHTML  string `json:"descripcion_html"`
+	DescripcionTexto string `json:"descripcion_texto"`
+	TipoCabello      string `json:"tipo_cabello"`
+	Color            string `json:"color"`
+	Longitud         string `json:"longitud"`
+	ImagenURL        string `json:"imagen_url"`
 }
 
 // Configuración leída desde el archivo YAML
@@ -49,54 +102,652 @@ type Config struct {
 		User     string `yaml:"user"`
 		Password string `yaml:"password"`
 		DBName   string `yaml:"dbname"`
+
+		// Las consultas que superen este umbral se registran en el log
+		UmbralConsultaLentaMs int `yaml:"umbral_consulta_lenta_ms"`
+
+		// Cadena de conexión de una réplica de solo lectura (opcional)
+		Replica string `yaml:"replica"`
+
+		// Conexiones abiertas a la vez con la base principal; 0 sin límite
+		MaxConexiones int `yaml:"max_conexiones"`
 	} `yaml:"db"`
 	API struct {
+		// URL base de la API; por defecto la de producción
+		URL     string `yaml:"url"`
 		XSecret string `yaml:"x_secret"`
 		XAPIKey string `yaml:"x_api_key"`
+		Mock    bool   `yaml:"mock"`
+		// Con activo se usan la URL y las credenciales del sandbox en lugar
+		// de las de producción, sin volver a estas si faltan
+		Sandbox struct {
+			Activo  bool   `yaml:"activo"`
+			URL     string `yaml:"url"`
+			XSecret string `yaml:"x_secret"`
+			XAPIKey string `yaml:"x_api_key"`
+		} `yaml:"sandbox"`
+		// Cada cuánto se sincronizan los clientes; 0 lo desactiva
+		IntervaloClientesMinutos int `yaml:"intervalo_clientes_minutos"`
+		// Ritmo máximo propio; 0 solo respeta el cupo que informa Rocketfy
+		SolicitudesPorMinuto int `yaml:"solicitudes_por_minuto"`
+		// Espera máxima en la cola antes de fallar por falta de cupo
+		EsperaMaximaSegundos int `yaml:"espera_maxima_segundos"`
+		// Reglas por campo de Product (mapeo_productos.go)
+		MapeoProductos map[string]ReglaMapeo `yaml:"mapeo_productos"`
+		// Clave HMAC de los webhooks de pedidos (webhooks.go); vacía los
+		// desactiva
+		SecretoWebhook string `yaml:"secreto_webhook"`
 	} `yaml:"rocketfy"`
+	ZonaHoraria string `yaml:"zona_horaria"`
+	// Dirección en la que escucha el servidor HTTP
+	Servidor struct {
+		Host string `yaml:"host"`
+		// La variable de entorno PORT tiene prioridad
+		Puerto int `yaml:"puerto"`
+		// Socket Unix para escuchar detrás de un proxy inverso; si se
+		// configura se ignoran host y puerto
+		Socket         string `yaml:"socket"`
+		PermisosSocket string `yaml:"permisos_socket"`
+		// Archivo en el que se escribe el PID al iniciar, también tras un
+		// reinicio sin cortes (SIGUSR2)
+		ArchivoPID string `yaml:"archivo_pid"`
+		// Espera máxima de las solicitudes en curso al apagar o reiniciar
+		EsperaApagadoSegundos int `yaml:"espera_apagado_segundos"`
+	} `yaml:"servidor"`
+	Admin struct {
+		Token string `yaml:"token"`
+	} `yaml:"admin"`
+	Cifrado struct {
+		Claves      map[string]string `yaml:"claves"`
+		ClaveActiva string            `yaml:"clave_activa"`
+		ClaveHash   string            `yaml:"clave_hash"`
+	} `yaml:"cifrado"`
+	Publico struct {
+		URLBase string `yaml:"url_base"`
+	} `yaml:"publico"`
+	// Tokens firmados para los QR de verificación (/v/{token})
+	Verificacion struct {
+		ClaveTokens  string `yaml:"clave_tokens"`
+		VigenciaDias int    `yaml:"vigencia_dias"`
+		// Vigencia de los enlaces grabados en etiquetas NFC, que una vez
+		// bloqueadas no se pueden reescribir; 0 usa vigencia_dias
+		VigenciaDiasNFC int `yaml:"vigencia_dias_nfc"`
+	} `yaml:"verificacion"`
+	// Detección de certificados escaneados desde muchas IPs o regiones
+	Escaneos struct {
+		VentanaMinutos int `yaml:"ventana_minutos"`
+		// IPs distintas en la ventana que abren una alerta; 0 desactiva la
+		// detección
+		UmbralIPs int `yaml:"umbral_ips"`
+		// Regiones distintas que abren una alerta; 0 solo cuenta IPs
+		UmbralRegiones int `yaml:"umbral_regiones"`
+		// Encabezado con el país del visitante que agrega el CDN
+		EncabezadoRegion string `yaml:"encabezado_region"`
+	} `yaml:"escaneos"`
+	// Redes desde las que se aceptan /admin y /metrics
+	AccesoAdmin struct {
+		// CIDR o IPs; vacía acepta cualquier red que no esté denegada
+		Permitidas []string `yaml:"permitidas"`
+		Denegadas  []string `yaml:"denegadas"`
+		// Proxies cuyo X-Forwarded-For se acepta
+		ProxiesConfiables []string `yaml:"proxies_confiables"`
+	} `yaml:"acceso_admin"`
+	// Bloqueos temporales de IPs por intentos fallidos
+	Proteccion struct {
+		// Fallos en la ventana que bloquean la IP; 0 no cuenta ese tipo
+		FallosLogin    int `yaml:"fallos_login"`
+		FallosConsulta int `yaml:"fallos_consulta"`
+		VentanaMinutos int `yaml:"ventana_minutos"`
+		// Duración del primer bloqueo; los siguientes la duplican
+		BloqueoMinutos     int `yaml:"bloqueo_minutos"`
+		MaximoBloqueoHoras int `yaml:"maximo_bloqueo_horas"`
+	} `yaml:"proteccion"`
+	// Descarte de las rutas de baja prioridad con el servidor saturado; 0
+	// en un umbral no lo usa
+	Saturacion struct {
+		MaxSolicitudesEnCurso int      `yaml:"max_solicitudes_en_curso"`
+		EsperaDBMs            int      `yaml:"espera_db_ms"`
+		RutasBajaPrioridad    []string `yaml:"rutas_baja_prioridad"`
+		ReintentarSegundos    int      `yaml:"reintentar_segundos"`
+	} `yaml:"saturacion"`
+	// Tamaño máximo del cuerpo de las solicitudes
+	Limites struct {
+		CuerpoMaximoKB int `yaml:"cuerpo_maximo_kb"`
+		// Límite en KB por prefijo de ruta
+		Rutas map[string]int `yaml:"rutas"`
+		// Plazo de las solicitudes en segundos y por prefijo de ruta (0 sin
+		// plazo)
+		TiempoMaximoSegundos int            `yaml:"tiempo_maximo_segundos"`
+		TiemposRutas         map[string]int `yaml:"tiempos_rutas"`
+	} `yaml:"limites"`
+	// Base local de geolocalización de IPs (CSV de IP2Location LITE)
+	GeoIP struct {
+		Archivo string `yaml:"archivo"`
+	} `yaml:"geoip"`
+	Mantenimiento struct {
+		Modo    string `yaml:"modo"`
+		Mensaje string `yaml:"mensaje"`
+	} `yaml:"mantenimiento"`
+	Recordatorios struct {
+		IntervaloMinutos int                 `yaml:"intervalo_minutos"`
+		Reglas           []ReglaRecordatorio `yaml:"reglas"`
+	} `yaml:"recordatorios"`
+	Email struct {
+		Servidor  string `yaml:"servidor"`
+		Usuario   string `yaml:"usuario"`
+		Clave     string `yaml:"clave"`
+		Remitente string `yaml:"remitente"`
+	} `yaml:"email"`
+	WhatsApp struct {
+		Token      string `yaml:"token"`
+		TelefonoID string `yaml:"telefono_id"`
+	} `yaml:"whatsapp"`
+	Facturacion struct {
+		// Proveedor tecnológico autorizado por la DIAN
+		URLProveedor   string `yaml:"url_proveedor"`
+		TokenProveedor string `yaml:"token_proveedor"`
+		// 1 producción, 2 pruebas
+		Ambiente     string `yaml:"ambiente"`
+		NIT          string `yaml:"nit"`
+		DV           string `yaml:"dv"`
+		RazonSocial  string `yaml:"razon_social"`
+		Resolucion   string `yaml:"resolucion"`
+		Prefijo      string `yaml:"prefijo"`
+		RangoDesde   int64  `yaml:"rango_desde"`
+		RangoHasta   int64  `yaml:"rango_hasta"`
+		ClaveTecnica string `yaml:"clave_tecnica"`
+	} `yaml:"facturacion"`
+	Impuestos struct {
+		// Tarifa de IVA (%) de las categorías sin regla
+		IVAPorDefecto      float64         `yaml:"iva_por_defecto"`
+		PreciosIncluyenIVA bool            `yaml:"precios_incluyen_iva"`
+		Reglas             []ReglaImpuesto `yaml:"reglas"`
+	} `yaml:"impuestos"`
+	Pagos struct {
+		// API del proveedor de pagos para los reembolsos; vacío para
+		// registrarlos como hechos por fuera
+		URLProveedor string `yaml:"url_proveedor"`
+		Token        string `yaml:"token"`
+		// Clave HMAC de los webhooks de estado de pago; vacía los desactiva
+		SecretoWebhook string `yaml:"secreto_webhook"`
+	} `yaml:"pagos"`
+	Reportes struct {
+		Destinatarios []string `yaml:"destinatarios"`
+		// semanal y/o mensual
+		Frecuencias []string `yaml:"frecuencias"`
+	} `yaml:"reportes"`
+	Envios struct {
+		// Cada cuánto se consulta el estado de las guías (30 por defecto)
+		IntervaloMinutos int                             `yaml:"intervalo_minutos"`
+		Transportadoras  map[string]ConfigTransportadora `yaml:"transportadoras"`
+	} `yaml:"envios"`
+	Outbox struct {
+		IntervaloSegundos int      `yaml:"intervalo_segundos"`
+		Webhooks          []string `yaml:"webhooks"`
+		SecretoWebhooks   string   `yaml:"secreto_webhooks"`
+		// Intentos de publicar un evento antes de descartarlo (10 por defecto)
+		MaxIntentos int `yaml:"max_intentos"`
+	} `yaml:"outbox"`
+	// Reglas de emisión automática de certificados (emision_automatica.go)
+	EmisionAutomatica struct {
+		Reglas []ReglaEmision `yaml:"reglas"`
+	} `yaml:"emision_automatica"`
+	// Firmas de los webhooks entrantes (firmas_webhooks.go)
+	WebhooksEntrantes struct {
+		// Desfase máximo de X-Timestamp (300 por defecto)
+		ToleranciaSegundos int `yaml:"tolerancia_segundos"`
+	} `yaml:"webhooks_entrantes"`
+	// Reintentos de los webhooks entrantes fallidos (webhooks_fallidos.go)
+	WebhooksFallidos struct {
+		// Reintentos antes de darlos por agotados y avisar (10 por defecto)
+		MaxIntentos int `yaml:"max_intentos"`
+	} `yaml:"webhooks_fallidos"`
+	Broker struct {
+		Tipo   string `yaml:"tipo"`
+		URL    string `yaml:"url"`
+		Topico string `yaml:"topico"`
+	} `yaml:"broker"`
+	Telemetria struct {
+		OTLPEndpoint string `yaml:"otlp_endpoint"`
+		Servicio     string `yaml:"servicio"`
+	} `yaml:"telemetria"`
+	// API interna con TLS mutuo para los demás servicios del backend
+	Interno struct {
+		Direccion   string `yaml:"direccion"`
+		Certificado string `yaml:"certificado"`
+		Clave       string `yaml:"clave"`
+		// CA que firma los certificados de los servicios clientes
+		CAClientes string `yaml:"ca_clientes"`
+		// CN o DNS de los certificados aceptados; vacía acepta todos los
+		// firmados por la CA
+		Clientes []string `yaml:"clientes"`
+	} `yaml:"interno"`
+	Diagnostico struct {
+		Direccion string `yaml:"direccion"`
+	} `yaml:"diagnostico"`
+	Log struct {
+		// info (predeterminado) o error
+		Nivel string `yaml:"nivel"`
+	} `yaml:"log"`
+	Sentry struct {
+		DSN     string `yaml:"dsn"`
+		Entorno string `yaml:"entorno"`
+	} `yaml:"sentry"`
+	Cache struct {
+		MaxAgeProductos int `yaml:"max_age_productos"`
+		// Segundos que los productos de Rocketfy se sirven desde la caché
+		// sin consultarlo (30 por defecto) y segundos adicionales en que se
+		// sirven mientras se actualizan en segundo plano (0 no los sirve)
+		FrescoProductosSegundos   int `yaml:"fresco_productos_segundos"`
+		ObsoletoProductosSegundos int `yaml:"obsoleto_productos_segundos"`
+	} `yaml:"cache"`
+	Compresion struct {
+		TamanoMinimo int `yaml:"tamano_minimo"`
+	} `yaml:"compresion"`
+	// Verificación anti-bots de los endpoints públicos (captcha.go)
+	Captcha struct {
+		// recaptcha | turnstile | hcaptcha; vacío no verifica
+		Proveedor string `yaml:"proveedor"`
+		Secreto   string `yaml:"secreto"`
+		// Puntaje mínimo de reCAPTCHA v3 (0 a 1); 0 no lo revisa
+		PuntajeMinimo float64 `yaml:"puntaje_minimo"`
+	} `yaml:"captcha"`
+	Contacto struct {
+		// Obsoletos: se usan como captcha.proveedor y captcha.secreto si
+		// esa sección no está configurada
+		Captcha        string `yaml:"captcha"`
+		SecretoCaptcha string `yaml:"secreto_captcha"`
+		// Emails del equipo que reciben los mensajes
+		Destinatarios []string `yaml:"destinatarios"`
+		// Webhook entrante de Slack (opcional)
+		SlackWebhook string `yaml:"slack_webhook"`
+	} `yaml:"contacto"`
+	ProxyImagenes struct {
+		// Hosts de los que se sirven imágenes; ".dominio.com" incluye los
+		// subdominios
+		Hosts []string `yaml:"hosts"`
+		// Caché en disco (por defecto en el directorio temporal)
+		Directorio string `yaml:"directorio"`
+		// Vigencia de la caché y del Cache-Control (30 por defecto)
+		MaxAgeDias int `yaml:"max_age_dias"`
+		// Tamaño máximo de la caché en disco (500 por defecto)
+		MaxMB int `yaml:"max_mb"`
+		// Parámetros de la URL que distinguen imágenes; los demás se
+		// descartan antes de descargar
+		Parametros []string `yaml:"parametros"`
+	} `yaml:"proxy_imagenes"`
+	FCM struct {
+		// JSON de la cuenta de servicio de Firebase; vacío para no enviar push
+		Credenciales string `yaml:"credenciales"`
+	} `yaml:"fcm"`
+	Telegram struct {
+		// Bot de verificación de certificados: webhook | polling; vacío
+		// para desactivarlo
+		Modo  string `yaml:"modo"`
+		Token string `yaml:"token"`
+		// secret_token registrado con setWebhook
+		SecretoWebhook string `yaml:"secreto_webhook"`
+	} `yaml:"telegram"`
+	Avisos struct {
+		// Canales de los avisos operativos: webhook entrante de Slack y/o
+		// bot de Telegram con el chat de destino
+		SlackWebhook   string `yaml:"slack_webhook"`
+		TelegramToken  string `yaml:"telegram_token"`
+		TelegramChatID string `yaml:"telegram_chat_id"`
+		// Tipos de aviso a enviar; vacío para todos
+		Eventos []string `yaml:"eventos"`
+		// Hora local (0-23) a partir de la que se envía el resumen diario
+		HoraResumen int `yaml:"hora_resumen"`
+	} `yaml:"avisos"`
+	Feeds struct {
+		// Cada cuánto se regeneran los feeds de catálogo (60 por defecto)
+		IntervaloMinutos int `yaml:"intervalo_minutos"`
+		// Página del producto en la tienda; admite {id} y {sku}
+		URLProducto string `yaml:"url_producto"`
+		Marca       string `yaml:"marca"`
+	} `yaml:"feeds"`
+	Monedas struct {
+		// API de tasas con base COP: GET devuelve {"rates": {"USD": 0.00024}}
+		URLTasas string `yaml:"url_tasas"`
+		// Minutos que se reutilizan las tasas descargadas (60 por defecto)
+		CacheMinutos int `yaml:"cache_minutos"`
+		// Tasas fijas desde COP si la API no está configurada o no responde
+		TasasRespaldo map[string]float64 `yaml:"tasas_respaldo"`
+	} `yaml:"monedas"`
+	Archivado struct {
+		// Días que se conservan en la base las verificaciones y los
+		// registros de auditoría; 0 desactiva el archivado
+		RetencionDias int `yaml:"retencion_dias"`
+		// Hora local (0-23) a partir de la que se archiva cada día
+		Hora int `yaml:"hora"`
+		// Directorio de los archivos si no se configura un bucket
+		Directorio string `yaml:"directorio"`
+		// Bucket compatible con S3 (AWS, MinIO, Cloudflare R2...)
+		S3 struct {
+			Endpoint  string `yaml:"endpoint"`
+			Region    string `yaml:"region"`
+			Bucket    string `yaml:"bucket"`
+			AccessKey string `yaml:"access_key"`
+			SecretKey string `yaml:"secret_key"`
+			Prefijo   string `yaml:"prefijo"`
+		} `yaml:"s3"`
+	} `yaml:"archivado"`
+	// Respaldos con pg_dump guardados en el almacenamiento del archivado
+	Respaldos struct {
+		// Respaldar una vez al día a partir de la hora local (0-23)
+		Diario bool `yaml:"diario"`
+		Hora   int  `yaml:"hora"`
+		// Rutas de pg_dump y pg_restore; por defecto se buscan en el PATH
+		PgDump    string `yaml:"pg_dump"`
+		PgRestore string `yaml:"pg_restore"`
+	} `yaml:"respaldos"`
 }
 
 var config Config
 
+// Archivo de configuración leído al iniciar y al recargar
+const archivoConfig = "config.yml"
+
+// Zona horaria configurada para serializar las fechas
+var zonaHoraria = time.UTC
+
+// URL base de la API de Rocketfy en producción
+const urlProduccionRocketfy = "https://ms-public-api.rocketfy.com/rocketfy/api/v1"
+
+// URL del Rocketfy simulado; si está iniciado reemplaza a la configurada
+var urlMockRocketfy string
+
+// URL base y credenciales de Rocketfy: las del sandbox si está activo, si
+// no las de producción
+func destinoRocketfy() (base, secreto, clave string) {
+	ajustes := configActual().API
+	base, secreto, clave = ajustes.URL, ajustes.XSecret, ajustes.XAPIKey
+	if ajustes.Sandbox.Activo {
+		base, secreto, clave = ajustes.Sandbox.URL, ajustes.Sandbox.XSecret, ajustes.Sandbox.XAPIKey
+	}
+	// El simulado exige x-api-key como la API real pero acepta cualquiera:
+	// se usan credenciales ficticias para poder desarrollar sin las reales
+	if urlMockRocketfy != "" {
+		base, secreto, clave = urlMockRocketfy, credencialMockRocketfy, credencialMockRocketfy
+	}
+	return strings.TrimSuffix(base, "/"), secreto, clave
+}
+
 func main() {
 	// Cargar la configuración desde el archivo YAML
-	err := loadConfig("config.yml")
+	err := loadConfig(archivoConfig)
 	if err != nil {
 		log.Fatal("Error al cargar la configuración:", err)
 	}
 
-	// Configura el manejador del endpoint
-	http.HandleFunc("/obtener_certificado", obtenerCertificadoHandler)
-	http.HandleFunc("/obtener_productos", obtenerProductosHandler)
+	// Sin argumentos se inicia el servidor (compatibilidad con start.sh)
+	os.Exit(ejecutarComando(os.Args[1:]))
+}
+
+// Iniciar el servidor HTTP
+func servir() {
+	// Configura el manejador del endpoint. Se usa un mux propio para que
+	// los handlers de diagnóstico (pprof, expvar) no queden expuestos.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/obtener_certificado", obtenerCertificadoHandler)
+	mux.HandleFunc("/obtener_productos", obtenerProductosHandler)
+	mux.HandleFunc("/productos", productosHandler)
+	mux.HandleFunc("/buscar", buscarHandler)
+	mux.HandleFunc("/graphql", graphqlHandler)
+	mux.HandleFunc("/c/", vistaCertificadoHandler)
+	mux.HandleFunc("/s/", enlaceCortoHandler)
+	mux.HandleFunc("/v/", tokenVerificacionHandler)
+	mux.HandleFunc("/certificados/", certificadosHandler)
+	mux.HandleFunc("/cuidados/", cuidadosHandler)
+	mux.HandleFunc("/kits", kitsHandler)
+	mux.HandleFunc("/atributos", atributosHandler)
+	mux.HandleFunc("/atributos/", atributosHandler)
+	mux.HandleFunc("/citas", citasHandler)
+	mux.HandleFunc("/contacto", exigirCaptcha(contactoHandler))
+	mux.HandleFunc("/reportar_falsificacion", exigirCaptcha(reportarFalsificacionHandler))
+	mux.HandleFunc("/dispositivos", dispositivosHandler)
+	mux.HandleFunc(rutaWebhookTelegram, webhookTelegramHandler)
+	mux.Handle("/webhooks/", verificarFirmaWebhook(http.HandlerFunc(webhookEntranteHandler)))
+	mux.HandleFunc("/newsletter/suscribir", suscribirNewsletterHandler)
+	mux.HandleFunc("/newsletter/confirmar", tokenNewsletterHandler)
+	mux.HandleFunc("/newsletter/baja", tokenNewsletterHandler)
+	mux.HandleFunc("/admin/eventos", eventosHandler)
+	mux.Handle(rutaPanelAdmin, panelAdminHandler())
+	mux.HandleFunc("/admin/contacto", soloAdmin(mensajesContactoHandler))
+	mux.HandleFunc("/admin/falsificaciones", soloAdmin(reportesFalsificacionHandler))
+	mux.HandleFunc("/admin/escaneos/alertas", soloAdmin(alertasEscaneoHandler))
+	mux.HandleFunc("/admin/escaneos/alertas/", soloAdmin(alertasEscaneoHandler))
+	mux.HandleFunc("/admin/senuelos", soloAdmin(senuelosHandler))
+	mux.HandleFunc("/admin/senuelos/", soloAdmin(senuelosHandler))
+	mux.HandleFunc("/admin/newsletter/export", soloAdmin(exportarNewsletterHandler))
+	mux.HandleFunc("/admin/certificados/emitir", soloAdmin(emitirCertificadoHandler))
+	mux.HandleFunc("/admin/certificados/export", soloAdmin(exportarCertificadosHandler))
+	mux.HandleFunc("/admin/certificados/revocar", soloAdmin(revocarCertificadoHandler))
+	mux.HandleFunc("/admin/certificados/bulk", soloAdmin(certificadosMasivosHandler))
+	mux.HandleFunc("/admin/certificados/bulk/", soloAdmin(certificadosMasivosHandler))
+	mux.HandleFunc("/admin/certificados/", soloAdmin(certificadosAdminHandler))
+	mux.HandleFunc("/admin/clientes/", soloAdmin(clientesAdminHandler))
+	mux.HandleFunc("/admin/clientes/duplicados", soloAdmin(duplicadosClientesHandler))
+	mux.HandleFunc("/admin/clientes/merge", soloAdmin(fusionarClientesHandler))
+	mux.HandleFunc("/admin/etiquetas.pdf", soloAdmin(hojaEtiquetasHandler))
+	mux.HandleFunc("/admin/plantillas/", soloAdmin(plantillasHandler))
+	mux.HandleFunc("/admin/cuidados/", soloAdmin(editarCuidadoHandler))
+	mux.HandleFunc("/admin/kits/", soloAdmin(editarKitHandler))
+	mux.HandleFunc("/admin/atributos/", soloAdmin(editarAtributoHandler))
+	mux.HandleFunc("/admin/traducciones/", soloAdmin(traduccionesHandler))
+	mux.HandleFunc("/admin/productos/", soloAdmin(atributosProductoHandler))
+	mux.HandleFunc("/admin/estilistas", soloAdmin(estilistasHandler))
+	mux.HandleFunc("/admin/estilistas/", soloAdmin(estilistasHandler))
+	mux.HandleFunc("/admin/facturas", soloAdmin(facturasHandler))
+	mux.HandleFunc("/admin/facturas/", soloAdmin(facturasHandler))
+	mux.HandleFunc("/admin/compras/", soloAdmin(comprasAdminHandler))
+	mux.HandleFunc("/admin/webhooks/entregas", soloAdmin(entregasWebhooksHandler))
+	mux.HandleFunc("/admin/webhooks/entregas/", soloAdmin(entregasWebhooksHandler))
+	mux.HandleFunc("/admin/webhooks/fallidos", soloAdmin(webhooksFallidosHandler))
+	mux.HandleFunc("/admin/webhooks/fallidos/", soloAdmin(webhooksFallidosHandler))
+	mux.HandleFunc("/admin/outbox/descartados", soloAdmin(eventosDescartadosHandler))
+	mux.HandleFunc("/admin/outbox/descartados/", soloAdmin(eventosDescartadosHandler))
+	mux.HandleFunc("/compras/", exigirCaptcha(envioHandler))
+	mux.HandleFunc(rutaCotizarEnvio, cotizarEnvioHandler)
+	mux.HandleFunc("/ubicaciones/", ubicacionesHandler)
+	mux.HandleFunc("/img-proxy", proxyImagenesHandler)
+	mux.HandleFunc(rutaFeedGoogle, feedsHandler)
+	mux.HandleFunc(rutaFeedFacebook, feedsHandler)
+	mux.HandleFunc(rutaSitemap, documentoPublicoHandler)
+	mux.HandleFunc(rutaRSSProductos, documentoPublicoHandler)
+	mux.HandleFunc("/admin/contabilidad/export", soloAdmin(exportarContabilidadHandler))
+	mux.HandleFunc("/admin/estadisticas", soloAdmin(estadisticasHandler))
+	mux.HandleFunc("/admin/estadisticas/verificaciones", soloAdmin(tasaVerificacionHandler))
+	mux.HandleFunc("/admin/estadisticas/escaneos", soloAdmin(escaneosUbicacionHandler))
+	mux.HandleFunc("/admin/reportes/enviar", soloAdmin(enviarReporteHandler))
+	mux.HandleFunc("/admin/respaldos", soloAdmin(respaldosHandler))
+	mux.HandleFunc("/admin/auditoria/accesos", soloAdmin(accesosDenegadosHandler))
+	mux.HandleFunc("/admin/bloqueos", soloAdmin(bloqueosHandler))
+	mux.HandleFunc("/admin/bloqueos/", soloAdmin(bloqueosHandler))
+	mux.HandleFunc(rutaMantenimiento, soloAdmin(mantenimientoHandler))
+	// Las conexiones locales no se eximen: detrás del proxy inverso todas
+	// lo son. Prometheus usa el token o la API interna con TLS mutuo
+	mux.HandleFunc("/metrics", soloAdmin(metricasHandler))
+
+	// Validar toda la configuración y reportar todos los problemas juntos
+	problemas := validarConfig(config)
+	// Sin base de datos el servidor arranca igual y el pool reintenta
+	if err := comprobarBaseDatos(); err != nil {
+		problemas = append(problemas, ProblemaConfig{Campo: "db", Mensaje: "no se pudo conectar: " + err.Error(), Advertencia: true})
+	}
+	imprimirProblemasConfig(os.Stderr, problemas)
+	if hayErroresConfig(problemas) {
+		log.Fatal("La configuración tiene errores; revise ", archivoConfig)
+	}
+
+	// Modo de operación inicial (normal si no se configura)
+	if config.Mantenimiento.Modo != "" {
+		cambiarModo(EstadoMantenimiento{Modo: config.Mantenimiento.Modo, Mensaje: config.Mantenimiento.Mensaje})
+	}
+
+	// Publicar en segundo plano los eventos registrados en el outbox
+	go despacharOutbox()
+
+	// Recordatorios de mantenimiento según las reglas configuradas
+	go despacharRecordatorios()
+
+	// Reportes de ventas programados para los administradores
+	go despacharReportes()
+
+	// Seguimiento de las guías de envío con las transportadoras
+	go despacharEnvios()
+
+	// Reintentos de los webhooks entrantes que no se pudieron procesar
+	go despacharWebhooksFallidos()
+
+	// Cola de trabajos en segundo plano, p. ej. las acciones masivas sobre
+	// certificados (trabajos.go)
+	go despacharTrabajos()
+
+	// Feeds de catálogo para Google Merchant Center y Facebook
+	go despacharFeeds()
+
+	// Resumen diario de ventas por Slack o Telegram
+	go despacharAvisos()
+
+	// Reconexión a la base de datos tras una caída o una conmutación
+	go vigilarBaseDatos()
+
+	// Archivado de verificaciones y auditoría antiguas
+	go despacharArchivado()
+
+	// Respaldo diario de la base de datos
+	go despacharRespaldos()
+
+	// Bloqueos de IPs por intentos fallidos guardados por cualquier instancia
+	go despacharBloqueos()
+
+	// Clientes de Rocketfy vinculados con los locales
+	go despacharClientesRocketfy()
+
+	// Auditoría de los accesos rechazados a la administración
+	go despacharAccesosDenegados()
+
+	// Lista de certificados señuelo y registro de sus consultas
+	go despacharSenuelos()
+
+	// Base de geolocalización de IPs; carga en segundo plano porque es grande
+	go func() {
+		if err := cargarGeoIP(config.GeoIP.Archivo); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	// Bot de verificación de certificados por Telegram sin webhook
+	if config.Telegram.Modo == TelegramPolling && config.Telegram.Token != "" {
+		go despacharBotTelegram()
+	}
+
+	iniciarTelemetria()
+	iniciarDiagnostico()
+	vigilarConfig(archivoConfig)
+
+	// Inicia el servidor en la dirección configurada
+	escucha, direccion, err := escucharServidor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Servidor iniciado en", direccion)
+	servidor := &http.Server{Handler: asignarIDSolicitud(trazarHTTP(comprimirRespuestas(recuperarPanico(negociarIdioma(rechazarIPsBloqueadas(limitarCuerpo(restringirIPsAdmin(controlarMantenimiento(descartarCarga(limitarTiempo(mux)))))))))))}
+	iniciarServidorInterno(servidor.Handler)
+	if err := atenderServidor(servidor, escucha); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Servidor detenido")
+}
+
+// Descargas de productos en curso, compartidas por las solicitudes
+// concurrentes
+var productosRocketfyEnCurso grupoLlamadas
+
+// Plazo de una descarga de productos compartida
+const plazoProductosRocketfy = time.Minute
+
+func init() {
+	registrarMetricaCalculada("melenas_rocketfy_productos_compartidos_total",
+		"Solicitudes de productos resueltas con la descarga en curso de otra", "counter",
+		func() float64 { return float64(atomic.LoadUint64(&productosRocketfyEnCurso.compartidas)) })
+}
 
-	// Inicia el servidor en el puerto 8080 (o el que prefieras)
-	log.Println("Servidor iniciado en http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+// Función para obtener productos desde la API externa. Las llamadas
+// concurrentes comparten una sola descarga y cada una recibe sus propios
+// mapas, que puede modificar. Para servirlos a los clientes se usa
+// obtenerProductosCache.
+func obtenerProductos(ctx context.Context) ([]map[string]interface{}, error) {
+	body, err := cuerpoProductos(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodificarProductos(body)
 }
 
-// Función para obtener productos desde la API externa
-func obtenerProductos() ([]map[string]interface{}, error) {
+// JSON de los productos, con la descarga compartida; el resultado válido
+// queda en la caché
+func cuerpoProductos(ctx context.Context) ([]byte, error) {
+	body, err := productosRocketfyEnCurso.hacer(ctx, "/products", plazoProductosRocketfy, func(ctx context.Context) (interface{}, error) {
+		body, err := descargarProductos(ctx)
+		if err == nil && json.Valid(body) {
+			guardarCacheProductos(body)
+		}
+		return body, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body.([]byte), nil
+}
+
+func decodificarProductos(body []byte) ([]map[string]interface{}, error) {
+	// Deserializar los datos JSON en una estructura genérica (map)
+	var result []map[string]interface{}
+	err := json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, fmt.Errorf("Error al deserializar los datos: %v", err)
+	}
+
+	return result, nil
+}
+
+// Descargar el JSON de los productos de Rocketfy
+func descargarProductos(ctx context.Context) (body []byte, err error) {
+	ctx, s := iniciarSpan(ctx, "GET rocketfy /products", spanCliente)
+	defer func() { s.finalizar(err) }()
+
 	// Hacer la solicitud GET a la API externa
-	req, err := http.NewRequest("GET", "https://ms-public-api.rocketfy.com/rocketfy/api/v1/products", nil)
+	base, secreto, clave := destinoRocketfy()
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/products", nil)
 	if err != nil {
 		return nil, fmt.Errorf("Error al crear la solicitud: %v", err)
 	}
+	s.atributo("http.url", req.URL.String())
+	if traceparent := s.traceparent(); traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
+	if id := idSolicitud(ctx); id != "" {
+		req.Header.Set(encabezadoIDSolicitud, id)
+	}
 
 	// Configuración de los headers usando datos del config.yml
 	req.Header.Set("accept", "application/json")
-	req.Header.Set("x-secret", config.API.XSecret)
-	req.Header.Set("x-api-key", config.API.XAPIKey)
+	req.Header.Set("x-secret", secreto)
+	req.Header.Set("x-api-key", clave)
 
 	// Ejecutar la solicitud
 	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := hacerSolicitudRocketfy(client, req, "/products")
 	if err != nil {
-		return nil, fmt.Errorf("Error al hacer la solicitud: %v", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	s.atributo("http.status_code", resp.StatusCode)
 
 	// Leer la respuesta
-	body, err := io.ReadAll(resp.Body)
+	body, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("Error al leer la respuesta: %v", err)
 	}
@@ -106,14 +757,7 @@ func obtenerProductos() ([]map[string]interface{}, error) {
 		return nil, fmt.Errorf("Error en la solicitud, código de estado: %d", resp.StatusCode)
 	}
 
-	// Deserializar los datos JSON en una estructura genérica (map)
-	var result []map[string]interface{}
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return nil, fmt.Errorf("Error al deserializar los datos: %v", err)
-	}
-
-	return result, nil
+	return body, nil
 }
 
 // Handler para el endpoint que devuelve los productos
@@ -121,30 +765,82 @@ func obtenerProductosHandler(w http.ResponseWriter, r *http.Request) {
 	// Permitir solicitudes desde cualquier origen
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "If-None-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Cache")
+
+	tasa, ok := tasaSolicitada(w, r)
+	if !ok {
+		return
+	}
 
-	// Obtener los productos desde la API externa
-	products, err := obtenerProductos()
+	// Con ?formato=producto se responden convertidos a Product
+	if r.URL.Query().Get("formato") == "producto" {
+		mapeados, estado, err := obtenerProductosMapeados(r.Context())
+		if err != nil {
+			responderErrorProductosRocketfy(w, r, err)
+			return
+		}
+		w.Header().Set("X-Cache", estado)
+		respuesta, err := seleccionarCampos(mapeados, camposSolicitados(r))
+		if err == nil {
+			err = responderJSONConETag(w, r, respuesta, cacheControlProductos())
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error al convertir productos a JSON: %v", err), http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+		}
+		return
+	}
+
+	// Obtener los productos desde la API externa (o su caché)
+	products, estado, err := obtenerProductosCache(r.Context())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error al obtener productos: %v", err), http.StatusInternalServerError)
-		log.Println(err)
+		responderErrorProductosRocketfy(w, r, err)
 		return
 	}
+	w.Header().Set("X-Cache", estado)
+
+	// Precios en la moneda pedida con ?currency=, con la tasa en cada producto
+	if tasa != nil {
+		for _, producto := range products {
+			convertirPrecioRocketfy(producto, tasa)
+			producto["tasa_cambio"] = tasa
+		}
+	}
+	agregarDescripcionesRocketfy(products)
 
-	// Convertir los productos a JSON y enviarlos como respuesta
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(products)
+	// Convertir los productos a JSON, solo con los campos pedidos con
+	// ?fields=, y enviarlos como respuesta (304 si no cambiaron)
+	respuesta, err := seleccionarCampos(products, camposSolicitados(r))
+	if err == nil {
+		err = responderJSONConETag(w, r, respuesta, cacheControlProductos())
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error al convertir productos a JSON: %v", err), http.StatusInternalServerError)
-		log.Println(err)
+		logSolicitud(r.Context(), err)
 		return
 	}
 }
 
+// Responder el error al obtener los productos: 503 con Retry-After si se
+// agotó el cupo de Rocketfy
+func responderErrorProductosRocketfy(w http.ResponseWriter, r *http.Request, err error) {
+	var cupo *errorCupoRocketfy
+	if errors.As(err, &cupo) {
+		w.Header().Set("Retry-After", strconv.Itoa(cupo.segundos()))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	} else {
+		http.Error(w, fmt.Sprintf("Error al obtener productos: %v", err), http.StatusInternalServerError)
+	}
+	logSolicitud(r.Context(), err)
+}
+
 func obtenerCertificadoHandler(w http.ResponseWriter, r *http.Request) {
 	// Permitir solicitudes desde cualquier origen (ajusta según sea necesario)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET") // Ajusta los métodos permitidos
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type") // Ajusta los encabezados permitidos
+	w.Header().Set("Access-Control-Allow-Methods", "GET")                         // Ajusta los métodos permitidos
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-None-Match") // Ajusta los encabezados permitidos
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 	// Si es una solicitud OPTIONS (preflight), responder sin procesar
 	if r.Method == "OPTIONS" {
@@ -152,49 +848,79 @@ func obtenerCertificadoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Obtener el número de certificado de la query string
-	numeroCertificado := r.URL.Query().Get("certificateNumber")
+	// Obtener el número de certificado de la query string, o del token
+	// firmado del QR
+	numeroCertificado, err := numeroVerificacionPublica(r, r.URL.Query().Get("certificateNumber"), r.URL.Query().Get("token"))
+	if err != nil {
+		responderErrorVerificacion(w, r, err, r.URL.Query().Get("certificateNumber"), VerificacionAPI)
+		return
+	}
 	if numeroCertificado == "" {
 		http.Error(w, "Número de certificado requerido", http.StatusBadRequest)
 		return
 	}
-
-	// Conectar a la base de datos
-	db, err := conectarDB()
+	expandir, err := expansionesSolicitadas(r)
 	if err != nil {
-		http.Error(w, "Error al conectar a la base de datos", http.StatusInternalServerError)
-		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
 
 	// Consultar la base de datos
-	data, err := consultarCertificado(db, numeroCertificado)
+	ctx := contextoIncluirEliminados(r)
+	data, err := obtenerCertificado(ctx, numeroCertificado)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			certificadoNoEncontrado(r, numeroCertificado, VerificacionAPI)
 			http.Error(w, "Certificado no encontrado", http.StatusNotFound)
 		} else {
 			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
 		}
-		log.Println(err)
+		logSolicitud(r.Context(), err)
 		return
 	}
+	contarVerificacionSolicitud(r, data.NumeroCertificado, VerificacionAPI)
 
-	// Convertir a JSON y enviar la respuesta
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	// Registros relacionados pedidos con ?expand=
+	if err := expandirCertificado(ctx, data, expandir, esAdmin(r)); err != nil {
+		if estado := estadoErrorExpansion(err); estado != http.StatusInternalServerError {
+			http.Error(w, err.Error(), estado)
+		} else {
+			http.Error(w, "Error al consultar la base de datos", estado)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	// Solo los campos pedidos con ?fields=
+	respuesta, err := seleccionarCampos(data, camposSolicitados(r))
+	if err != nil {
+		http.Error(w, "Error al convertir el certificado a JSON", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	// Convertir a JSON y enviar la respuesta (304 si no cambió)
+	responderJSONConETag(w, r, respuesta, cacheCertificados)
 }
 
-func conectarDB() (*sql.DB, error) {
-	// Construir la cadena de conexión
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+// Construir la cadena de conexión. Con varios hosts solo se acepta el que
+// admite escrituras (conmutacion_db.go).
+func cadenaConexion() string {
+	cadena := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		config.DB.Host, config.DB.Port, config.DB.User, config.DB.Password, config.DB.DBName)
+	if strings.Contains(config.DB.Host, ",") {
+		cadena += " target_session_attrs=read-write"
+	}
+	return cadena
+}
 
+func conectarDB() (*sql.DB, error) {
 	// Conectar a la base de datos
-	db, err := sql.Open("postgres", psqlInfo)
+	db, err := sql.Open(driverMedido, cadenaConexion())
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(config.DB.MaxConexiones)
 
 	// Verificar la conexión
 	err = db.Ping()
@@ -205,68 +931,269 @@ func conectarDB() (*sql.DB, error) {
 	return db, nil
 }
 
-func consultarCertificado(db *sql.DB, numeroCertificado string) (*CertificateData, error) {
+// Los certificados eliminados (y los de clientes eliminados) solo se
+// devuelven con incluirEliminados
+func consultarCertificado(db *sql.DB, numeroCertificado string, incluirEliminados bool) (*CertificateData, error) {
 	// Consulta SQL
 	sqlStatement := `
 		SELECT
-			c.nombre AS nombre_cliente,
-			c.apellido AS apellido_cliente,
+			com.compra_id,
+			coalesce(cer.nombre_titular, c.nombre) AS nombre_cliente,
+			coalesce(cer.apellido_titular, c.apellido) AS apellido_cliente,
 			c.email AS email_cliente,
-			p.nombre AS nombre_producto,
-			p.descripcion AS descripcion_producto,
-			p.tipo_cabello,
-			p.color,
-			p.longitud,
-			p.imagen_url,
+			c.email_cifrado,
 			com.fecha_compra,
 			cer.fecha_emision,
 			cer.numero_certificado,
-			com.estado_pago
+			com.estado_pago,
+			cer.revocado_en IS NOT NULL AS revocado,
+			coalesce(cer.eliminado_en, c.eliminado_en) AS eliminado_en,
+			ec.codigo AS codigo_corto,
+			cer.version,
+			vig.numero_certificado AS reemplazado_por,
+			cer.plantilla
 		FROM Certificados cer
-		JOIN Compras com ON cer.certificado_id = com.certificado_id
+		JOIN Compras com ON com.certificado_id = coalesce(cer.vigente_id, cer.certificado_id)
 		JOIN Clientes c ON com.cliente_id = c.cliente_id
-		JOIN DetallesCompra dc ON com.compra_id = dc.compra_id
-		JOIN Productos p ON dc.producto_id = p.producto_id
-		WHERE cer.numero_certificado = $1`
+		LEFT JOIN Certificados vig ON vig.certificado_id = cer.vigente_id
+		LEFT JOIN EnlacesCortos ec ON ec.numero_certificado = cer.numero_certificado
+		WHERE cer.numero_certificado = $1
+			AND (cer.eliminado_en IS NULL AND c.eliminado_en IS NULL OR $2)`
 
-	// Ejecutar la consulta
-	row := db.QueryRow(sqlStatement, numeroCertificado)
+	// Ejecutar la consulta con la sentencia preparada
+	sentencia, err := sentenciaPreparada(db, sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	row := sentencia.QueryRow(numeroCertificado, incluirEliminados)
 
 	// Escanear los resultados en la estructura CertificateData
 	var data CertificateData
-	err := row.Scan(
+	var compraID int
+	var email, emailCifrado sql.NullString
+	var plantilla *string
+	err = row.Scan(
+		&compraID,
 		&data.NombreCliente,
 		&data.ApellidoCliente,
-		&data.EmailCliente,
-		&data.NombreProducto,
-		&data.DescripcionProducto,
-		&data.TipoCabello,
-		&data.Color,
-		&data.Longitud,
-		&data.ImagenURL,
+		&email,
+		&emailCifrado,
 		&data.FechaCompra,
 		&data.FechaEmision,
 		&data.NumeroCertificado,
 		&data.EstadoPago,
+		&data.Revocado,
+		&data.EliminadoEn,
+		&data.CodigoCorto,
+		&data.Version,
+		&data.ReemplazadoPor,
+		&plantilla,
 	)
 	if err != nil {
 		return nil, err
 	}
+	data.compraID = compraID
+
+	// Productos de la compra; sin productos el certificado no se puede
+	// mostrar
+	var plantillas []*string
+	data.Productos, plantillas, err = consultarProductosCertificado(db, compraID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Productos) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	principal := data.Productos[0]
+	data.NombreProducto = principal.Nombre
+	copiarDescripcionPrincipal(&data)
+	data.TipoCabello = principal.TipoCabello
+	data.Color = principal.Color
+	data.Longitud = principal.Longitud
+	data.ImagenURL = principal.ImagenURL
+	data.Cuidados = principal.Cuidados
+	// La plantilla elegida por una regla de emisión manda sobre la del
+	// producto
+	data.Plantilla = plantillas[0]
+	if plantilla != nil {
+		data.Plantilla = plantilla
+	}
+
+	data.EmailCliente, err = valorPII(email, emailCifrado)
+	if err != nil {
+		return nil, err
+	}
 
 	return &data, nil
 }
 
+// Productos de las líneas de una compra, con los kits expandidos en sus
+// componentes, su guía de cuidado y la plantilla de certificado de cada uno
+// (la del kit si la tiene)
+func consultarProductosCertificado(db *sql.DB, compraID int) ([]ProductoCertificado, []*string, error) {
+	sentencia, err := sentenciaPreparada(db, `
+		SELECT
+			p.producto_id,
+			p.nombre,
+			p.descripcion,
+			p.tipo_cabello,
+			p.color,
+			p.longitud,
+			p.imagen_url,
+			u.cantidad,
+			k.nombre AS kit,
+			coalesce(k.plantilla, p.plantilla),
+			cu.lavado,
+			cu.peinado,
+			cu.duracion
+		FROM UnidadesCompra u
+		JOIN Productos p ON u.producto_id = p.producto_id
+		LEFT JOIN Productos k ON k.producto_id = u.kit_id
+		LEFT JOIN Cuidados cu ON cu.producto_id = p.producto_id
+		WHERE u.compra_id = $1
+		ORDER BY u.kit_id NULLS FIRST, p.producto_id`)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := sentencia.Query(compraID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var productos []ProductoCertificado
+	var plantillas []*string
+	for rows.Next() {
+		var producto ProductoCertificado
+		var plantilla *string
+		var lavado, peinado, duracion sql.NullString
+		err := rows.Scan(
+			&producto.ProductoID,
+			&producto.Nombre,
+			&producto.Descripcion,
+			&producto.TipoCabello,
+			&producto.Color,
+			&producto.Longitud,
+			&producto.ImagenURL,
+			&producto.Cantidad,
+			&producto.Kit,
+			&plantilla,
+			&lavado,
+			&peinado,
+			&duracion,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		limpiarDescripcionCertificado(&producto)
+
+		// Guía de cuidado del producto, si tiene
+		if lavado.Valid {
+			producto.Cuidados = &Cuidado{
+				ProductoID: producto.ProductoID,
+				Lavado:     lavado.String,
+				Peinado:    peinado.String,
+				Duracion:   duracion.String,
+			}
+		}
+		productos = append(productos, producto)
+		plantillas = append(plantillas, plantilla)
+	}
+	return productos, plantillas, rows.Err()
+}
+
 // Cargar la configuración desde el archivo YAML
 func loadConfig(filename string) error {
-	data, err := os.ReadFile(filename)
+	nueva, err := leerConfig(filename)
 	if err != nil {
 		return err
 	}
 
-	err = yaml.Unmarshal(data, &config)
+	// Zona horaria en la que se presentan las fechas
+	zonaHoraria, err = time.LoadLocation(nueva.ZonaHoraria)
 	if err != nil {
-		return err
+		return fmt.Errorf("zona_horaria inválida: %v", err)
 	}
 
+	config = nueva
 	return nil
 }
+
+// Leer y completar con valores por defecto el archivo de configuración
+func leerConfig(filename string) (Config, error) {
+	var nueva Config
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nueva, err
+	}
+
+	err = yaml.Unmarshal(data, &nueva)
+	if err != nil {
+		return nueva, err
+	}
+
+	if nueva.ZonaHoraria == "" {
+		nueva.ZonaHoraria = "America/Bogota"
+	}
+	if nueva.Cache.MaxAgeProductos <= 0 {
+		nueva.Cache.MaxAgeProductos = 60
+	}
+	if nueva.Cache.FrescoProductosSegundos <= 0 {
+		nueva.Cache.FrescoProductosSegundos = 30
+	}
+	if puerto := os.Getenv("PORT"); puerto != "" {
+		nueva.Servidor.Puerto, err = strconv.Atoi(puerto)
+		if err != nil {
+			return nueva, fmt.Errorf("PORT inválido: %q", puerto)
+		}
+	}
+	if nueva.Servidor.Puerto == 0 {
+		nueva.Servidor.Puerto = 8080
+	}
+	if nueva.Proteccion.VentanaMinutos <= 0 {
+		nueva.Proteccion.VentanaMinutos = 15
+	}
+	if nueva.Proteccion.BloqueoMinutos <= 0 {
+		nueva.Proteccion.BloqueoMinutos = 15
+	}
+	if nueva.Proteccion.MaximoBloqueoHoras <= 0 {
+		nueva.Proteccion.MaximoBloqueoHoras = 24
+	}
+	if nueva.Captcha.Proveedor == "" && nueva.Contacto.Captcha != "" {
+		nueva.Captcha.Proveedor = nueva.Contacto.Captcha
+		nueva.Captcha.Secreto = nueva.Contacto.SecretoCaptcha
+	}
+	if nueva.Limites.CuerpoMaximoKB <= 0 {
+		nueva.Limites.CuerpoMaximoKB = cuerpoMaximoKBPorDefecto
+	}
+	if nueva.WebhooksEntrantes.ToleranciaSegundos <= 0 {
+		nueva.WebhooksEntrantes.ToleranciaSegundos = toleranciaWebhookPorDefecto
+	}
+	if nueva.Outbox.MaxIntentos <= 0 {
+		nueva.Outbox.MaxIntentos = maxIntentosOutboxPorDefecto
+	}
+	if nueva.WebhooksFallidos.MaxIntentos <= 0 {
+		nueva.WebhooksFallidos.MaxIntentos = maxIntentosWebhookPorDefecto
+	}
+	if nueva.Saturacion.ReintentarSegundos <= 0 {
+		nueva.Saturacion.ReintentarSegundos = 5
+	}
+	if nueva.Limites.TiempoMaximoSegundos <= 0 {
+		nueva.Limites.TiempoMaximoSegundos = tiempoMaximoSegundosPorDefecto
+	}
+	if nueva.Servidor.EsperaApagadoSegundos <= 0 {
+		nueva.Servidor.EsperaApagadoSegundos = 30
+	}
+	if nueva.Servidor.PermisosSocket == "" {
+		nueva.Servidor.PermisosSocket = "0660"
+	}
+	if nueva.API.URL == "" {
+		nueva.API.URL = urlProduccionRocketfy
+	}
+	if nueva.API.EsperaMaximaSegundos <= 0 {
+		nueva.API.EsperaMaximaSegundos = 30
+	}
+
+	return nueva, nil
+}
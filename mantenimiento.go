@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Modos de operación de la API. En solo lectura se rechazan las escrituras
+// (métodos distintos de GET/HEAD/OPTIONS y mutaciones GraphQL); en
+// mantenimiento se rechaza todo salvo el propio endpoint de control. En
+// ambos casos se responde 503 con un cuerpo JSON.
+const (
+	ModoNormal        = "normal"
+	ModoSoloLectura   = "solo_lectura"
+	ModoMantenimiento = "mantenimiento"
+)
+
+// Ruta que permanece disponible en cualquier modo para poder volver a normal
+const rutaMantenimiento = "/admin/mantenimiento"
+
+// Segundos sugeridos al cliente antes de reintentar
+const reintentarMantenimiento = 120
+
+type EstadoMantenimiento struct {
+	Modo    string `json:"modo"`
+	Mensaje string `json:"mensaje,omitempty"`
+}
+
+var (
+	muMantenimiento     sync.RWMutex
+	estadoMantenimiento = EstadoMantenimiento{Modo: ModoNormal}
+)
+
+func modoValido(modo string) bool {
+	return modo == ModoNormal || modo == ModoSoloLectura || modo == ModoMantenimiento
+}
+
+func estadoActualMantenimiento() EstadoMantenimiento {
+	muMantenimiento.RLock()
+	defer muMantenimiento.RUnlock()
+	return estadoMantenimiento
+}
+
+func cambiarModo(estado EstadoMantenimiento) {
+	muMantenimiento.Lock()
+	estadoMantenimiento = estado
+	muMantenimiento.Unlock()
+}
+
+// Indica si las escrituras están bloqueadas por el modo actual
+func escriturasBloqueadas() bool {
+	return estadoActualMantenimiento().Modo != ModoNormal
+}
+
+func metodoDeLectura(metodo string) bool {
+	return metodo == "GET" || metodo == "HEAD" || metodo == "OPTIONS"
+}
+
+// Responder 503 con el modo y el mensaje configurado
+func responderMantenimiento(w http.ResponseWriter, r *http.Request, estado EstadoMantenimiento) {
+	mensaje := estado.Mensaje
+	if mensaje == "" {
+		mensaje = traducir(idiomaSolicitud(r.Context()), "Estamos realizando tareas de mantenimiento, vuelve a intentarlo en unos minutos")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(reintentarMantenimiento))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":      mensaje,
+		"modo":       estado.Modo,
+		"request_id": idSolicitud(r.Context()),
+	})
+}
+
+// Middleware que aplica el modo de mantenimiento o solo lectura. Las
+// consultas GraphQL por POST se dejan pasar y las mutaciones se rechazan
+// en el propio handler; la cotización de envíos no escribe nada esencial.
+func controlarMantenimiento(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		estado := estadoActualMantenimiento()
+		if estado.Modo == ModoNormal || r.URL.Path == rutaMantenimiento {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if estado.Modo == ModoSoloLectura && (metodoDeLectura(r.Method) || r.URL.Path == "/graphql" || r.URL.Path == rutaCotizarEnvio || r.URL.Path == rutaWebhookTelegram) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		responderMantenimiento(w, r, estado)
+	})
+}
+
+// Handler para consultar (GET) o cambiar (PUT) el modo de operación, p. ej.
+// {"modo": "solo_lectura", "mensaje": "Migración en curso"}
+func mantenimientoHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var estado EstadoMantenimiento
+		err := json.NewDecoder(r.Body).Decode(&estado)
+		if err != nil || !modoValido(estado.Modo) {
+			http.Error(w, "modo debe ser normal, solo_lectura o mantenimiento", http.StatusBadRequest)
+			return
+		}
+		cambiarModo(estado)
+		logSolicitud(r.Context(), "Modo de operación cambiado a", estado.Modo)
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estadoActualMantenimiento())
+}
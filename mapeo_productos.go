@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Conversión de los productos de Rocketfy a Product. Cada campo de Product
+// se llena según una regla de rocketfy.mapeo_productos: el campo de origen
+// (con puntos e índices para los anidados, p. ej. "images.0" o
+// "attributes.color") y una transformación opcional. Los campos sin regla
+// usan mapeoProductosPorDefecto. El resultado se guarda junto al producto
+// original en ProductosSincronizados.producto y se sirve con
+// /obtener_productos?formato=producto.
+
+// Transformaciones de un valor
+const (
+	// Texto sin cambios (por defecto)
+	TransformacionNinguna = ""
+	// HTML con solo las etiquetas de formato de etiquetasHTMLPermitidas y
+	// sin atributos
+	TransformacionHTML = "html"
+	// Texto plano, sin etiquetas
+	TransformacionTexto = "texto"
+	// Número de pulgadas a "41 cm"
+	TransformacionPulgadasCm = "pulgadas_a_cm"
+	// Número de centímetros a "40 cm"
+	TransformacionCm = "cm"
+)
+
+var transformacionesMapeo = []string{
+	TransformacionNinguna,
+	TransformacionHTML,
+	TransformacionTexto,
+	TransformacionPulgadasCm,
+	TransformacionCm,
+}
+
+// Regla de mapeo de un campo de Product
+type ReglaMapeo struct {
+	Campo          string `yaml:"campo"`
+	Transformacion string `yaml:"transformacion"`
+}
+
+// Campos de Product que se pueden mapear y las reglas por defecto
+var mapeoProductosPorDefecto = map[string]ReglaMapeo{
+	"nombre":       {Campo: "name"},
+	"descripcion":  {Campo: "description", Transformacion: TransformacionHTML},
+	"tipo_cabello": {Campo: "hair_type"},
+	"color":        {Campo: "color"},
+	"longitud":     {Campo: "length", Transformacion: TransformacionCm},
+	"imagen_url":   {Campo: "images.0"},
+}
+
+// Número al inicio de un valor ("16", "16\"", "40 cm")
+var reNumeroMapeo = regexp.MustCompile(`^\s*(\d+(?:[.,]\d+)?)`)
+
+// Reglas vigentes: las por defecto con las de la configuración encima
+func reglasMapeoProductos() map[string]ReglaMapeo {
+	reglas := make(map[string]ReglaMapeo, len(mapeoProductosPorDefecto))
+	for campo, regla := range mapeoProductosPorDefecto {
+		reglas[campo] = regla
+	}
+	for campo, regla := range configActual().API.MapeoProductos {
+		reglas[campo] = regla
+	}
+	return reglas
+}
+
+func transformacionValida(transformacion string) bool {
+	for _, t := range transformacionesMapeo {
+		if t == transformacion {
+			return true
+		}
+	}
+	return false
+}
+
+// Valor de una ruta con puntos dentro de un producto; nil si no existe
+func valorRutaRocketfy(datos map[string]interface{}, ruta string) interface{} {
+	var actual interface{} = datos
+	for _, parte := range strings.Split(ruta, ".") {
+		switch nodo := actual.(type) {
+		case map[string]interface{}:
+			actual = nodo[parte]
+		case []interface{}:
+			i, err := strconv.Atoi(parte)
+			if err != nil || i < 0 || i >= len(nodo) {
+				return nil
+			}
+			actual = nodo[i]
+		default:
+			return nil
+		}
+	}
+	return actual
+}
+
+// Aplicar una transformación a un valor de Rocketfy
+func transformarValor(valor interface{}, transformacion string) (string, error) {
+	if valor == nil {
+		return "", nil
+	}
+	texto := strings.TrimSpace(fmt.Sprint(valor))
+	switch transformacion {
+	case TransformacionHTML:
+		return limpiarHTML(texto), nil
+	case TransformacionTexto:
+		return textoPlano(texto), nil
+	case TransformacionPulgadasCm, TransformacionCm:
+		if texto == "" {
+			return "", nil
+		}
+		numero := reNumeroMapeo.FindStringSubmatch(texto)
+		if numero == nil {
+			return "", fmt.Errorf("%q no es una medida", texto)
+		}
+		medida, err := strconv.ParseFloat(strings.Replace(numero[1], ",", ".", 1), 64)
+		if err != nil {
+			return "", fmt.Errorf("%q no es una medida", texto)
+		}
+		if transformacion == TransformacionPulgadasCm {
+			medida *= 2.54
+		}
+		return fmt.Sprintf("%.0f cm", math.Round(medida)), nil
+	}
+	return texto, nil
+}
+
+// Convertir un producto de Rocketfy a Product según las reglas. Los valores
+// que no se pueden transformar quedan vacíos y se escriben en el log. El ID
+// local queda en 0; se completa por SKU con completarIDsProductos.
+func mapearProductoRocketfy(datos map[string]interface{}, reglas map[string]ReglaMapeo) Product {
+	producto := Product{RocketfyID: idProductoRocketfy(datos), SKU: textoRocketfy(datos, "sku")}
+	destinos := map[string]*string{
+		"nombre":       &producto.Nombre,
+		"descripcion":  &producto.Descripcion,
+		"tipo_cabello": &producto.TipoCabello,
+		"color":        &producto.Color,
+		"longitud":     &producto.Longitud,
+		"imagen_url":   &producto.ImagenURL,
+	}
+	for campo, regla := range reglas {
+		destino, ok := destinos[campo]
+		if !ok || regla.Campo == "" {
+			continue
+		}
+		valor, err := transformarValor(valorRutaRocketfy(datos, regla.Campo), regla.Transformacion)
+		if err != nil {
+			log.Printf("Mapeo de productos: producto %s, %s: %v", producto.RocketfyID, campo, err)
+			continue
+		}
+		*destino = valor
+	}
+	producto.DescripcionHTML, producto.DescripcionTexto = descripcionesSeguras(producto.Descripcion)
+	return producto
+}
+
+// Convertir una lista de productos con las reglas vigentes
+func mapearProductosRocketfy(productos []map[string]interface{}) []Product {
+	reglas := reglasMapeoProductos()
+	mapeados := make([]Product, 0, len(productos))
+	for _, datos := range productos {
+		mapeados = append(mapeados, mapearProductoRocketfy(datos, reglas))
+	}
+	return mapeados
+}
+
+// Poner el ID del producto local con el mismo SKU
+func completarIDsProductos(db consultorFilas, productos []Product) error {
+	skus := make([]string, 0, len(productos))
+	for _, p := range productos {
+		if p.SKU != "" {
+			skus = append(skus, p.SKU)
+		}
+	}
+	ids, err := productosPorSKU(db, skus)
+	if err != nil {
+		return err
+	}
+	for i := range productos {
+		productos[i].ID = ids[productos[i].SKU]
+	}
+	return nil
+}
+
+// Productos de Rocketfy convertidos a Product, con el ID local, y el
+// estado de la caché de la que salieron
+func obtenerProductosMapeados(ctx context.Context) ([]Product, string, error) {
+	datos, estado, err := obtenerProductosCache(ctx)
+	if err != nil {
+		return nil, estado, err
+	}
+	productos := mapearProductosRocketfy(datos)
+	err = trazarLectura(ctx, "productosPorSKU", func(db *sql.DB) error {
+		return completarIDsProductos(db, productos)
+	})
+	return productos, estado, err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Driver "postgres" envuelto para medir todas las consultas: registra la
+// duración por nombre de consulta y escribe en el log las que superan el
+// umbral configurado (db.umbral_consulta_lenta_ms), con los parámetros
+// ocultos.
+
+const driverMedido = "postgres-medido"
+
+var duracionConsultas = registrarHistograma(
+	"melenas_db_consulta_duracion_segundos",
+	"Duración de las consultas a la base de datos por nombre de consulta",
+	"consulta",
+)
+
+func init() {
+	sql.Register(driverMedido, driverConMedicion{pq.Driver{}})
+}
+
+// Expresiones para nombrar una consulta por su operación y tabla principal
+var (
+	reNombreComentario = regexp.MustCompile(`(?i)--\s*nombre:\s*(\w+)`)
+	reTablaConsulta    = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE|TABLE)\s+(?:IF\s+(?:NOT\s+)?EXISTS\s+)?(\w+)`)
+	reEspacios         = regexp.MustCompile(`\s+`)
+)
+
+// Nombre de una consulta: el indicado en un comentario "-- nombre: X" o la
+// operación seguida de la tabla principal (p. ej. "select_certificados")
+func nombreConsulta(consulta string) string {
+	if m := reNombreComentario.FindStringSubmatch(consulta); m != nil {
+		return m[1]
+	}
+
+	campos := strings.Fields(consulta)
+	operacion := "otra"
+	for _, campo := range campos {
+		if !strings.HasPrefix(campo, "--") {
+			operacion = strings.ToLower(campo)
+			break
+		}
+	}
+	if operacion == "with" {
+		operacion = "select"
+	}
+	if m := reTablaConsulta.FindStringSubmatch(consulta); m != nil {
+		return operacion + "_" + strings.ToLower(m[1])
+	}
+	return operacion
+}
+
+// Ocultar los valores de texto de los parámetros para no registrar datos
+// personales en el log
+func parametrosOcultos(args []driver.NamedValue) string {
+	partes := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch v := arg.Value.(type) {
+		case string:
+			partes = append(partes, fmt.Sprintf("<texto:%d>", len([]rune(v))))
+		case []byte:
+			partes = append(partes, fmt.Sprintf("<bytes:%d>", len(v)))
+		case nil:
+			partes = append(partes, "NULL")
+		default:
+			partes = append(partes, fmt.Sprint(v))
+		}
+	}
+	return "[" + strings.Join(partes, ", ") + "]"
+}
+
+func medirConsulta(consulta string, args []driver.NamedValue, inicio time.Time) {
+	duracion := time.Since(inicio)
+	duracionConsultas.observar(nombreConsulta(consulta), duracion.Seconds())
+
+	umbral := time.Duration(configActual().DB.UmbralConsultaLentaMs) * time.Millisecond
+	if umbral > 0 && duracion >= umbral {
+		log.Printf("Consulta lenta (%v) %s: %s parámetros: %s",
+			duracion.Round(time.Millisecond), nombreConsulta(consulta),
+			strings.TrimSpace(reEspacios.ReplaceAllString(consulta, " ")), parametrosOcultos(args))
+	}
+}
+
+type driverConMedicion struct {
+	driver.Driver
+}
+
+func (d driverConMedicion) Open(dsn string) (driver.Conn, error) {
+	conn, err := abrirConexionMultiHost(d.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conexionConMedicion{Conn: conn}, nil
+}
+
+// Conexión que mide las consultas y delega todo lo demás en pq
+type conexionConMedicion struct {
+	driver.Conn
+
+	// Recibió un error tras el cual no debe volver al pool
+	rota bool
+}
+
+// Marcar la conexión como rota si el error lo amerita
+func (c *conexionConMedicion) revisar(err error) error {
+	if err != nil && errorConexionRota(err) {
+		c.rota = true
+	}
+	return err
+}
+
+func (c *conexionConMedicion) QueryContext(ctx context.Context, consulta string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer medirConsulta(consulta, args, time.Now())
+	rows, err := queryer.QueryContext(ctx, consulta, args)
+	return rows, c.revisar(err)
+}
+
+func (c *conexionConMedicion) ExecContext(ctx context.Context, consulta string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer medirConsulta(consulta, args, time.Now())
+	resultado, err := execer.ExecContext(ctx, consulta, args)
+	return resultado, c.revisar(err)
+}
+
+func (c *conexionConMedicion) PrepareContext(ctx context.Context, consulta string) (driver.Stmt, error) {
+	var sentencia driver.Stmt
+	var err error
+	if preparador, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		sentencia, err = preparador.PrepareContext(ctx, consulta)
+	} else {
+		sentencia, err = c.Conn.Prepare(consulta)
+	}
+	if err != nil {
+		return nil, c.revisar(err)
+	}
+	// Un COPY se ejecuta una vez por fila; se mide el INSERT ... SELECT que
+	// lo sigue
+	if strings.HasPrefix(consulta, "COPY ") {
+		return sentencia, nil
+	}
+	return &sentenciaConMedicion{Stmt: sentencia, consulta: consulta, conexion: c}, nil
+}
+
+// Sentencia preparada que mide cada ejecución con el texto de su consulta
+type sentenciaConMedicion struct {
+	driver.Stmt
+	consulta string
+	conexion *conexionConMedicion
+}
+
+func (s *sentenciaConMedicion) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer medirConsulta(s.consulta, args, time.Now())
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err := queryer.QueryContext(ctx, args)
+		return rows, s.conexion.revisar(err)
+	}
+	rows, err := s.Stmt.Query(valoresSinNombre(args))
+	return rows, s.conexion.revisar(err)
+}
+
+func (s *sentenciaConMedicion) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer medirConsulta(s.consulta, args, time.Now())
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		resultado, err := execer.ExecContext(ctx, args)
+		return resultado, s.conexion.revisar(err)
+	}
+	resultado, err := s.Stmt.Exec(valoresSinNombre(args))
+	return resultado, s.conexion.revisar(err)
+}
+
+func valoresSinNombre(args []driver.NamedValue) []driver.Value {
+	valores := make([]driver.Value, len(args))
+	for i, arg := range args {
+		valores[i] = arg.Value
+	}
+	return valores
+}
+
+func (c *conexionConMedicion) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if iniciador, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err := iniciador.BeginTx(ctx, opts)
+		return tx, c.revisar(err)
+	}
+	tx, err := c.Conn.Begin()
+	return tx, c.revisar(err)
+}
+
+func (c *conexionConMedicion) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conexionConMedicion) ResetSession(ctx context.Context) error {
+	if c.rota {
+		return driver.ErrBadConn
+	}
+	if reseteable, ok := c.Conn.(driver.SessionResetter); ok {
+		return reseteable.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *conexionConMedicion) IsValid() bool {
+	if c.rota {
+		return false
+	}
+	if validador, ok := c.Conn.(driver.Validator); ok {
+		return validador.IsValid()
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registro mínimo de métricas expuestas en formato de texto de Prometheus
+
+// Límites superiores (en segundos) de los buckets de latencia
+var bucketsLatencia = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histograma con una etiqueta
+type histograma struct {
+	nombre   string
+	ayuda    string
+	etiqueta string
+
+	mu     sync.Mutex
+	series map[string]*serieHistograma
+}
+
+type serieHistograma struct {
+	buckets []uint64
+	suma    float64
+	total   uint64
+}
+
+// Métrica sin etiquetas cuyo valor se lee al exponerla
+type metricaCalculada struct {
+	nombre string
+	ayuda  string
+	// gauge o counter
+	tipo  string
+	valor func() float64
+}
+
+var (
+	muMetricas  sync.Mutex
+	histogramas []*histograma
+	calculadas  []metricaCalculada
+)
+
+func registrarHistograma(nombre, ayuda, etiqueta string) *histograma {
+	h := &histograma{nombre: nombre, ayuda: ayuda, etiqueta: etiqueta, series: map[string]*serieHistograma{}}
+	muMetricas.Lock()
+	histogramas = append(histogramas, h)
+	muMetricas.Unlock()
+	return h
+}
+
+func registrarMetricaCalculada(nombre, ayuda, tipo string, valor func() float64) {
+	muMetricas.Lock()
+	calculadas = append(calculadas, metricaCalculada{nombre: nombre, ayuda: ayuda, tipo: tipo, valor: valor})
+	muMetricas.Unlock()
+}
+
+// Registrar una observación para el valor de etiqueta dado
+func (h *histograma) observar(valorEtiqueta string, valor float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	serie, ok := h.series[valorEtiqueta]
+	if !ok {
+		serie = &serieHistograma{buckets: make([]uint64, len(bucketsLatencia))}
+		h.series[valorEtiqueta] = serie
+	}
+	for i, limite := range bucketsLatencia {
+		if valor <= limite {
+			serie.buckets[i]++
+		}
+	}
+	serie.suma += valor
+	serie.total++
+}
+
+func (h *histograma) escribir(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.nombre, h.ayuda, h.nombre)
+
+	valores := make([]string, 0, len(h.series))
+	for valor := range h.series {
+		valores = append(valores, valor)
+	}
+	sort.Strings(valores)
+
+	for _, valor := range valores {
+		serie := h.series[valor]
+		etiqueta := fmt.Sprintf("%s=%q", h.etiqueta, valor)
+		for i, limite := range bucketsLatencia {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%g\"} %d\n", h.nombre, etiqueta, limite, serie.buckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.nombre, etiqueta, serie.total)
+		fmt.Fprintf(b, "%s_sum{%s} %g\n", h.nombre, etiqueta, serie.suma)
+		fmt.Fprintf(b, "%s_count{%s} %d\n", h.nombre, etiqueta, serie.total)
+	}
+}
+
+// Handler para el endpoint /metrics
+func metricasHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	muMetricas.Lock()
+	for _, h := range histogramas {
+		h.escribir(&b)
+	}
+	for _, m := range calculadas {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.nombre, m.ayuda, m.nombre, m.tipo, m.nombre, m.valor())
+	}
+	muMetricas.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
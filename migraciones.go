@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"sort"
+)
+
+// Archivos SQL de migración, aplicados en orden alfabético
+//
+//go:embed migraciones/*.sql
+var archivosMigraciones embed.FS
+
+// Estado de una migración embebida
+type EstadoMigracion struct {
+	Nombre   string
+	Aplicada bool
+}
+
+func crearTablaMigraciones(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS MigracionesAplicadas (
+			nombre TEXT PRIMARY KEY,
+			aplicada_en TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+// Listar las migraciones embebidas indicando si ya fueron aplicadas
+func estadoMigraciones(db *sql.DB) ([]EstadoMigracion, error) {
+	err := crearTablaMigraciones(db)
+	if err != nil {
+		return nil, err
+	}
+
+	entradas, err := archivosMigraciones.ReadDir("migraciones")
+	if err != nil {
+		return nil, err
+	}
+
+	aplicadas := map[string]bool{}
+	rows, err := db.Query(`SELECT nombre FROM MigracionesAplicadas`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nombre string
+		if err := rows.Scan(&nombre); err != nil {
+			return nil, err
+		}
+		aplicadas[nombre] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var estados []EstadoMigracion
+	for _, entrada := range entradas {
+		estados = append(estados, EstadoMigracion{Nombre: entrada.Name(), Aplicada: aplicadas[entrada.Name()]})
+	}
+	sort.Slice(estados, func(i, j int) bool { return estados[i].Nombre < estados[j].Nombre })
+
+	return estados, nil
+}
+
+// Aplicar las migraciones pendientes, cada una en su propia transacción.
+// Devuelve los nombres de las migraciones aplicadas.
+func aplicarMigraciones(db *sql.DB) ([]string, error) {
+	estados, err := estadoMigraciones(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var aplicadas []string
+	for _, estado := range estados {
+		if estado.Aplicada {
+			continue
+		}
+
+		contenido, err := archivosMigraciones.ReadFile("migraciones/" + estado.Nombre)
+		if err != nil {
+			return aplicadas, err
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return aplicadas, err
+		}
+		_, err = tx.Exec(string(contenido))
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO MigracionesAplicadas (nombre) VALUES ($1)`, estado.Nombre)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return aplicadas, fmt.Errorf("%s: %v", estado.Nombre, err)
+		}
+
+		aplicadas = append(aplicadas, estado.Nombre)
+	}
+
+	return aplicadas, nil
+}
@@ -0,0 +1,20 @@
+-- Índices para la búsqueda de texto completo (GET /buscar)
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS productos_busqueda_idx ON Productos USING GIN (
+	to_tsvector('spanish',
+		coalesce(nombre, '') || ' ' ||
+		coalesce(descripcion, '') || ' ' ||
+		coalesce(tipo_cabello, '') || ' ' ||
+		coalesce(color, ''))
+);
+
+CREATE INDEX IF NOT EXISTS productos_nombre_trgm_idx ON Productos USING GIN (nombre gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS clientes_busqueda_idx ON Clientes USING GIN (
+	to_tsvector('spanish', coalesce(nombre, '') || ' ' || coalesce(apellido, ''))
+);
+
+CREATE INDEX IF NOT EXISTS clientes_nombre_trgm_idx ON Clientes USING GIN (
+	(coalesce(nombre, '') || ' ' || coalesce(apellido, '')) gin_trgm_ops
+);
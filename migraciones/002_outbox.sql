@@ -0,0 +1,16 @@
+-- Tabla outbox para la publicación confiable de eventos de dominio
+CREATE TABLE IF NOT EXISTS Outbox (
+	outbox_id BIGSERIAL PRIMARY KEY,
+	tipo TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	publicado_en TIMESTAMPTZ,
+	intentos INT NOT NULL DEFAULT 0,
+	ultimo_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pendientes_idx ON Outbox (outbox_id) WHERE publicado_en IS NULL;
+
+-- Revocación de certificados
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS revocado_en TIMESTAMPTZ;
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS motivo_revocacion TEXT;
@@ -0,0 +1,10 @@
+-- Copia local de los productos de Rocketfy (melenas sync products)
+CREATE TABLE IF NOT EXISTS ProductosSincronizados (
+	rocketfy_id TEXT PRIMARY KEY,
+	datos JSONB NOT NULL,
+	hash TEXT NOT NULL,
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	sincronizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS productos_sincronizados_actualizado_idx ON ProductosSincronizados (actualizado_en);
@@ -0,0 +1,9 @@
+-- Cifrado de datos personales de los clientes (Habeas Data). Los valores
+-- cifrados tienen el formato "<id de clave>:<base64>" y el email se busca
+-- por su hash HMAC determinista.
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS telefono TEXT;
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS email_cifrado TEXT;
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS email_hash TEXT;
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS telefono_cifrado TEXT;
+
+CREATE INDEX IF NOT EXISTS clientes_email_hash_idx ON Clientes (email_hash);
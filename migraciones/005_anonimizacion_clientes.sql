@@ -0,0 +1,2 @@
+-- Fecha en que se eliminaron los datos personales de un cliente
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS anonimizado_en TIMESTAMPTZ;
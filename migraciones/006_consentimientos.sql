@@ -0,0 +1,21 @@
+-- Consentimientos de los clientes (marketing por email, WhatsApp,
+-- tratamiento de datos) con su estado vigente e historial de cambios
+CREATE TABLE IF NOT EXISTS ConsentimientosCliente (
+	cliente_id INT NOT NULL REFERENCES Clientes (cliente_id),
+	tipo TEXT NOT NULL,
+	otorgado BOOLEAN NOT NULL,
+	fuente TEXT NOT NULL,
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (cliente_id, tipo)
+);
+
+CREATE TABLE IF NOT EXISTS HistorialConsentimientos (
+	historial_id BIGSERIAL PRIMARY KEY,
+	cliente_id INT NOT NULL REFERENCES Clientes (cliente_id),
+	tipo TEXT NOT NULL,
+	otorgado BOOLEAN NOT NULL,
+	fuente TEXT NOT NULL,
+	registrado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS historial_consentimientos_cliente_idx ON HistorialConsentimientos (cliente_id);
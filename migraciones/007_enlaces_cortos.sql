@@ -0,0 +1,15 @@
+-- Enlaces cortos para los códigos QR de los certificados, con conteo de clics
+CREATE TABLE IF NOT EXISTS EnlacesCortos (
+	codigo TEXT PRIMARY KEY,
+	numero_certificado TEXT NOT NULL UNIQUE,
+	destino TEXT NOT NULL,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	clics BIGINT NOT NULL DEFAULT 0,
+	ultimo_clic_en TIMESTAMPTZ
+);
+
+-- Enlaces para los certificados emitidos antes de esta migración
+INSERT INTO EnlacesCortos (codigo, numero_certificado, destino)
+SELECT substr(md5(random()::text || numero_certificado), 1, 8), numero_certificado, '/c/' || numero_certificado
+FROM Certificados
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,8 @@
+-- Plantillas HTML de certificado editables y su asignación por producto
+CREATE TABLE IF NOT EXISTS PlantillasCertificado (
+	nombre TEXT PRIMARY KEY,
+	html TEXT NOT NULL,
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE Productos ADD COLUMN IF NOT EXISTS plantilla TEXT;
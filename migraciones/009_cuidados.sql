@@ -0,0 +1,8 @@
+-- Guías de cuidado por producto (lavado, peinado y duración esperada)
+CREATE TABLE IF NOT EXISTS Cuidados (
+	producto_id INT PRIMARY KEY REFERENCES Productos (producto_id),
+	lavado TEXT NOT NULL DEFAULT '',
+	peinado TEXT NOT NULL DEFAULT '',
+	duracion TEXT NOT NULL DEFAULT '',
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,18 @@
+-- Recordatorios de mantenimiento programados por compra, regla y canal.
+-- Funciona como cola de trabajos: se procesan con FOR UPDATE SKIP LOCKED.
+CREATE TABLE IF NOT EXISTS RecordatoriosProgramados (
+	recordatorio_id BIGSERIAL PRIMARY KEY,
+	compra_id INT NOT NULL REFERENCES Compras (compra_id),
+	cliente_id INT NOT NULL REFERENCES Clientes (cliente_id),
+	regla TEXT NOT NULL,
+	canal TEXT NOT NULL,
+	programado_para TIMESTAMPTZ NOT NULL,
+	procesado_en TIMESTAMPTZ,
+	resultado TEXT,
+	intentos INT NOT NULL DEFAULT 0,
+	ultimo_error TEXT,
+	UNIQUE (compra_id, regla, canal)
+);
+
+CREATE INDEX IF NOT EXISTS recordatorios_pendientes_idx
+	ON RecordatoriosProgramados (programado_para) WHERE procesado_en IS NULL;
@@ -0,0 +1,26 @@
+-- Agenda de citas de instalación: estilistas, franjas disponibles y citas
+CREATE TABLE IF NOT EXISTS Estilistas (
+	estilista_id SERIAL PRIMARY KEY,
+	nombre TEXT NOT NULL,
+	email TEXT,
+	activo BOOLEAN NOT NULL DEFAULT true
+);
+
+CREATE TABLE IF NOT EXISTS FranjasDisponibles (
+	franja_id BIGSERIAL PRIMARY KEY,
+	estilista_id INT NOT NULL REFERENCES Estilistas (estilista_id),
+	inicio TIMESTAMPTZ NOT NULL,
+	fin TIMESTAMPTZ NOT NULL,
+	reservada BOOLEAN NOT NULL DEFAULT false,
+	UNIQUE (estilista_id, inicio)
+);
+
+CREATE INDEX IF NOT EXISTS franjas_libres_idx ON FranjasDisponibles (inicio) WHERE NOT reservada;
+
+CREATE TABLE IF NOT EXISTS Citas (
+	cita_id BIGSERIAL PRIMARY KEY,
+	franja_id BIGINT NOT NULL UNIQUE REFERENCES FranjasDisponibles (franja_id),
+	numero_certificado TEXT NOT NULL,
+	notas TEXT NOT NULL DEFAULT '',
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,21 @@
+-- Facturación electrónica (DIAN): precios de las líneas de compra y
+-- facturas emitidas por compra
+ALTER TABLE DetallesCompra ADD COLUMN IF NOT EXISTS cantidad INT NOT NULL DEFAULT 1;
+ALTER TABLE DetallesCompra ADD COLUMN IF NOT EXISTS precio_unitario NUMERIC(14, 2);
+
+CREATE TABLE IF NOT EXISTS Facturas (
+	factura_id SERIAL PRIMARY KEY,
+	compra_id INT NOT NULL UNIQUE REFERENCES Compras (compra_id),
+	prefijo TEXT NOT NULL,
+	numero BIGINT NOT NULL,
+	-- pendiente | aceptada | rechazada
+	estado TEXT NOT NULL DEFAULT 'pendiente',
+	cufe TEXT NOT NULL,
+	xml TEXT NOT NULL,
+	pdf BYTEA NOT NULL,
+	total NUMERIC(14, 2) NOT NULL,
+	mensaje TEXT NOT NULL DEFAULT '',
+	emitida_en TIMESTAMPTZ NOT NULL,
+	enviada_en TIMESTAMPTZ,
+	UNIQUE (prefijo, numero)
+);
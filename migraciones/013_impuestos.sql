@@ -0,0 +1,15 @@
+-- IVA por categoría de producto: tarifa aplicada a cada línea de compra y
+-- desglose por tarifa de cada compra
+ALTER TABLE Productos ADD COLUMN IF NOT EXISTS categoria TEXT;
+
+ALTER TABLE DetallesCompra ADD COLUMN IF NOT EXISTS tarifa_iva NUMERIC(5, 2);
+ALTER TABLE DetallesCompra ADD COLUMN IF NOT EXISTS base NUMERIC(14, 2);
+ALTER TABLE DetallesCompra ADD COLUMN IF NOT EXISTS iva NUMERIC(14, 2);
+
+CREATE TABLE IF NOT EXISTS ImpuestosCompra (
+	compra_id INT NOT NULL REFERENCES Compras (compra_id),
+	tarifa NUMERIC(5, 2) NOT NULL,
+	base NUMERIC(14, 2) NOT NULL,
+	valor NUMERIC(14, 2) NOT NULL,
+	PRIMARY KEY (compra_id, tarifa)
+);
@@ -0,0 +1,16 @@
+-- Reembolsos de compras. referencia_pago identifica la transacción en el
+-- proveedor de pagos.
+ALTER TABLE Compras ADD COLUMN IF NOT EXISTS referencia_pago TEXT;
+
+CREATE TABLE IF NOT EXISTS Reembolsos (
+	reembolso_id SERIAL PRIMARY KEY,
+	compra_id INT NOT NULL UNIQUE REFERENCES Compras (compra_id),
+	monto NUMERIC(14, 2) NOT NULL,
+	motivo TEXT NOT NULL DEFAULT '',
+	-- pendiente | completado | fallido
+	estado TEXT NOT NULL DEFAULT 'pendiente',
+	referencia_proveedor TEXT,
+	mensaje TEXT NOT NULL DEFAULT '',
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	completado_en TIMESTAMPTZ
+);
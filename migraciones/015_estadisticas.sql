@@ -0,0 +1,5 @@
+-- Ciudad de los clientes e índices para las estadísticas por rango de fechas
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS ciudad TEXT;
+
+CREATE INDEX IF NOT EXISTS compras_fecha_idx ON Compras (fecha_compra);
+CREATE INDEX IF NOT EXISTS certificados_fecha_emision_idx ON Certificados (fecha_emision);
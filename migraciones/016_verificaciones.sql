@@ -0,0 +1,10 @@
+-- Consultas públicas de certificados agregadas por día y canal
+CREATE TABLE IF NOT EXISTS Verificaciones (
+	numero_certificado TEXT NOT NULL,
+	dia DATE NOT NULL,
+	canal TEXT NOT NULL,
+	cantidad BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (numero_certificado, dia, canal)
+);
+
+CREATE INDEX IF NOT EXISTS verificaciones_dia_idx ON Verificaciones (dia);
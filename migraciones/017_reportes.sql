@@ -0,0 +1,8 @@
+-- Reportes programados ya enviados, para no repetirlos entre reinicios o
+-- instancias
+CREATE TABLE IF NOT EXISTS ReportesEnviados (
+	frecuencia TEXT NOT NULL,
+	desde DATE NOT NULL,
+	enviado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (frecuencia, desde)
+);
@@ -0,0 +1,25 @@
+-- Guías de envío por compra y su historial de estados
+CREATE TABLE IF NOT EXISTS Envios (
+	envio_id SERIAL PRIMARY KEY,
+	compra_id INT NOT NULL UNIQUE REFERENCES Compras (compra_id),
+	transportadora TEXT NOT NULL,
+	numero_guia TEXT NOT NULL,
+	-- registrado | en_transito | en_reparto | entregado | novedad
+	estado TEXT NOT NULL DEFAULT 'registrado',
+	estado_transportadora TEXT NOT NULL DEFAULT '',
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	consultado_en TIMESTAMPTZ,
+	entregado_en TIMESTAMPTZ,
+	UNIQUE (transportadora, numero_guia)
+);
+
+CREATE INDEX IF NOT EXISTS envios_pendientes_idx ON Envios (consultado_en) WHERE estado <> 'entregado';
+
+CREATE TABLE IF NOT EXISTS HistorialEnvios (
+	envio_id INT NOT NULL REFERENCES Envios (envio_id),
+	estado TEXT NOT NULL,
+	detalle TEXT NOT NULL DEFAULT '',
+	fecha TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS historial_envios_idx ON HistorialEnvios (envio_id, fecha);
@@ -0,0 +1,11 @@
+-- Última cotización de cada transportadora por ciudad y kilos, usada cuando
+-- la API de la transportadora no responde
+CREATE TABLE IF NOT EXISTS TarifasEnvio (
+	transportadora TEXT NOT NULL,
+	ciudad TEXT NOT NULL,
+	kilos INT NOT NULL,
+	valor NUMERIC(12, 2) NOT NULL,
+	dias_entrega INT,
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (transportadora, ciudad, kilos)
+);
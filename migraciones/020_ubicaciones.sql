@@ -0,0 +1,120 @@
+-- Departamentos y municipios con los códigos DIVIPOLA del DANE. Se cargan
+-- los departamentos y sus principales municipios; el listado completo se
+-- importa con `melenas ubicaciones import --file divipola.csv`.
+CREATE TABLE IF NOT EXISTS Departamentos (
+	codigo CHAR(2) PRIMARY KEY,
+	nombre TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS Ciudades (
+	codigo CHAR(5) PRIMARY KEY,
+	departamento CHAR(2) NOT NULL REFERENCES Departamentos (codigo),
+	nombre TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ciudades_departamento_idx ON Ciudades (departamento, nombre);
+
+INSERT INTO Departamentos (codigo, nombre) VALUES
+	('05', 'Antioquia'),
+	('08', 'Atlántico'),
+	('11', 'Bogotá, D.C.'),
+	('13', 'Bolívar'),
+	('15', 'Boyacá'),
+	('17', 'Caldas'),
+	('18', 'Caquetá'),
+	('19', 'Cauca'),
+	('20', 'Cesar'),
+	('23', 'Córdoba'),
+	('25', 'Cundinamarca'),
+	('27', 'Chocó'),
+	('41', 'Huila'),
+	('44', 'La Guajira'),
+	('47', 'Magdalena'),
+	('50', 'Meta'),
+	('52', 'Nariño'),
+	('54', 'Norte de Santander'),
+	('63', 'Quindío'),
+	('66', 'Risaralda'),
+	('68', 'Santander'),
+	('70', 'Sucre'),
+	('73', 'Tolima'),
+	('76', 'Valle del Cauca'),
+	('81', 'Arauca'),
+	('85', 'Casanare'),
+	('86', 'Putumayo'),
+	('88', 'Archipiélago de San Andrés, Providencia y Santa Catalina'),
+	('91', 'Amazonas'),
+	('94', 'Guainía'),
+	('95', 'Guaviare'),
+	('97', 'Vaupés'),
+	('99', 'Vichada')
+ON CONFLICT (codigo) DO NOTHING;
+
+INSERT INTO Ciudades (codigo, departamento, nombre) VALUES
+	('05001', '05', 'Medellín'),
+	('05088', '05', 'Bello'),
+	('05266', '05', 'Envigado'),
+	('05360', '05', 'Itagüí'),
+	('05615', '05', 'Rionegro'),
+	('05631', '05', 'Sabaneta'),
+	('05045', '05', 'Apartadó'),
+	('08001', '08', 'Barranquilla'),
+	('08758', '08', 'Soledad'),
+	('08433', '08', 'Malambo'),
+	('11001', '11', 'Bogotá, D.C.'),
+	('13001', '13', 'Cartagena de Indias'),
+	('13430', '13', 'Magangué'),
+	('15001', '15', 'Tunja'),
+	('15238', '15', 'Duitama'),
+	('15759', '15', 'Sogamoso'),
+	('17001', '17', 'Manizales'),
+	('18001', '18', 'Florencia'),
+	('19001', '19', 'Popayán'),
+	('20001', '20', 'Valledupar'),
+	('23001', '23', 'Montería'),
+	('25175', '25', 'Chía'),
+	('25269', '25', 'Facatativá'),
+	('25290', '25', 'Fusagasugá'),
+	('25307', '25', 'Girardot'),
+	('25754', '25', 'Soacha'),
+	('25899', '25', 'Zipaquirá'),
+	('27001', '27', 'Quibdó'),
+	('41001', '41', 'Neiva'),
+	('41551', '41', 'Pitalito'),
+	('44001', '44', 'Riohacha'),
+	('44430', '44', 'Maicao'),
+	('47001', '47', 'Santa Marta'),
+	('47189', '47', 'Ciénaga'),
+	('50001', '50', 'Villavicencio'),
+	('52001', '52', 'Pasto'),
+	('52356', '52', 'Ipiales'),
+	('54001', '54', 'Cúcuta'),
+	('54498', '54', 'Ocaña'),
+	('54874', '54', 'Villa del Rosario'),
+	('63001', '63', 'Armenia'),
+	('66001', '66', 'Pereira'),
+	('66170', '66', 'Dosquebradas'),
+	('68001', '68', 'Bucaramanga'),
+	('68081', '68', 'Barrancabermeja'),
+	('68276', '68', 'Floridablanca'),
+	('68307', '68', 'Girón'),
+	('68547', '68', 'Piedecuesta'),
+	('70001', '70', 'Sincelejo'),
+	('73001', '73', 'Ibagué'),
+	('76001', '76', 'Cali'),
+	('76109', '76', 'Buenaventura'),
+	('76147', '76', 'Cartago'),
+	('76364', '76', 'Jamundí'),
+	('76520', '76', 'Palmira'),
+	('76834', '76', 'Tuluá'),
+	('76892', '76', 'Yumbo'),
+	('81001', '81', 'Arauca'),
+	('85001', '85', 'Yopal'),
+	('86001', '86', 'Mocoa'),
+	('88001', '88', 'San Andrés'),
+	('91001', '91', 'Leticia'),
+	('94001', '94', 'Inírida'),
+	('95001', '95', 'San José del Guaviare'),
+	('97001', '97', 'Mitú'),
+	('99001', '99', 'Puerto Carreño')
+ON CONFLICT (codigo) DO NOTHING;
@@ -0,0 +1,16 @@
+-- Clientes duplicados fusionados en otro registro
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS fusionado_con INT REFERENCES Clientes (cliente_id);
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS fusionado_en TIMESTAMPTZ;
+
+-- Registro de auditoría de cada fusión
+CREATE TABLE IF NOT EXISTS FusionesClientes (
+	fusion_id BIGSERIAL PRIMARY KEY,
+	cliente_conservado INT NOT NULL REFERENCES Clientes (cliente_id),
+	cliente_fusionado INT NOT NULL REFERENCES Clientes (cliente_id),
+	compras_reasignadas INT NOT NULL,
+	motivo TEXT NOT NULL DEFAULT '',
+	solicitud_id TEXT NOT NULL DEFAULT '',
+	realizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS fusiones_clientes_conservado_idx ON FusionesClientes (cliente_conservado);
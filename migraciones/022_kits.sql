@@ -0,0 +1,30 @@
+-- Kits: productos vendidos como un conjunto de otros productos (p. ej. 3
+-- bundles + cierre) con precio propio. El SKU enlaza los productos locales
+-- con los de Rocketfy.
+ALTER TABLE Productos ADD COLUMN IF NOT EXISTS sku TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS productos_sku_idx ON Productos (sku) WHERE sku IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS Kits (
+	kit_id INT PRIMARY KEY REFERENCES Productos (producto_id),
+	precio NUMERIC(14, 2) NOT NULL,
+	-- local | rocketfy
+	origen TEXT NOT NULL DEFAULT 'local',
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS ComponentesKit (
+	kit_id INT NOT NULL REFERENCES Kits (kit_id) ON DELETE CASCADE,
+	producto_id INT NOT NULL REFERENCES Productos (producto_id),
+	cantidad INT NOT NULL CHECK (cantidad > 0),
+	PRIMARY KEY (kit_id, producto_id)
+);
+
+-- Unidades de cada producto por compra con los kits expandidos en sus
+-- componentes; kit_id indica de qué kit viene cada unidad
+CREATE OR REPLACE VIEW UnidadesCompra AS
+SELECT dc.compra_id,
+	coalesce(ck.producto_id, dc.producto_id) AS producto_id,
+	dc.cantidad * coalesce(ck.cantidad, 1) AS cantidad,
+	ck.kit_id
+FROM DetallesCompra dc
+LEFT JOIN ComponentesKit ck ON ck.kit_id = dc.producto_id;
@@ -0,0 +1,84 @@
+-- Vocabularios controlados para los atributos de cabello de los productos
+-- (tipo_cabello, color y longitud): valores canónicos y sus alias.
+CREATE TABLE IF NOT EXISTS ValoresAtributo (
+	atributo TEXT NOT NULL CHECK (atributo IN ('tipo_cabello', 'color', 'longitud')),
+	valor TEXT NOT NULL,
+	-- Orden en los desplegables del frontend
+	orden INT NOT NULL DEFAULT 0,
+	PRIMARY KEY (atributo, valor)
+);
+
+CREATE TABLE IF NOT EXISTS AliasAtributo (
+	atributo TEXT NOT NULL,
+	alias TEXT NOT NULL,
+	valor TEXT NOT NULL,
+	PRIMARY KEY (atributo, alias),
+	FOREIGN KEY (atributo, valor) REFERENCES ValoresAtributo (atributo, valor) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO ValoresAtributo (atributo, valor, orden) VALUES
+	('tipo_cabello', 'Liso', 1),
+	('tipo_cabello', 'Ondulado', 2),
+	('tipo_cabello', 'Rizado', 3),
+	('tipo_cabello', 'Afro', 4),
+	('color', 'Negro natural', 1),
+	('color', 'Castaño oscuro', 2),
+	('color', 'Castaño claro', 3),
+	('color', 'Rubio miel', 4),
+	('color', 'Rubio platino', 5),
+	('color', 'Borgoña', 6),
+	('longitud', '30 cm', 1),
+	('longitud', '40 cm', 2),
+	('longitud', '50 cm', 3),
+	('longitud', '60 cm', 4),
+	('longitud', '70 cm', 5)
+ON CONFLICT DO NOTHING;
+
+-- Los alias se comparan sin tildes, mayúsculas ni espacios
+INSERT INTO AliasAtributo (atributo, alias, valor) VALUES
+	('tipo_cabello', 'Lacio', 'Liso'),
+	('tipo_cabello', 'Straight', 'Liso'),
+	('tipo_cabello', 'Body wave', 'Ondulado'),
+	('tipo_cabello', 'Wavy', 'Ondulado'),
+	('tipo_cabello', 'Crespo', 'Rizado'),
+	('tipo_cabello', 'Curly', 'Rizado'),
+	('tipo_cabello', 'Kinky', 'Afro'),
+	('tipo_cabello', 'Kinky curly', 'Afro'),
+	('color', 'Negro', 'Negro natural'),
+	('color', '1B', 'Negro natural'),
+	('color', 'Natural black', 'Negro natural'),
+	('color', 'Marrón oscuro', 'Castaño oscuro'),
+	('color', 'Marrón claro', 'Castaño claro'),
+	('color', 'Miel', 'Rubio miel'),
+	('color', 'Honey blonde', 'Rubio miel'),
+	('color', '613', 'Rubio platino'),
+	('color', 'Platino', 'Rubio platino'),
+	('color', '99J', 'Borgoña'),
+	('color', 'Burgundy', 'Borgoña'),
+	('color', 'Vino tinto', 'Borgoña'),
+	('longitud', '12"', '30 cm'),
+	('longitud', '12 pulgadas', '30 cm'),
+	('longitud', '16"', '40 cm'),
+	('longitud', '16 pulgadas', '40 cm'),
+	('longitud', '20"', '50 cm'),
+	('longitud', '20 pulgadas', '50 cm'),
+	('longitud', '24"', '60 cm'),
+	('longitud', '24 pulgadas', '60 cm'),
+	('longitud', '28"', '70 cm'),
+	('longitud', '28 pulgadas', '70 cm')
+ON CONFLICT DO NOTHING;
+
+-- Pasar a la forma canónica los valores existentes que coinciden salvo
+-- mayúsculas y espacios; el resto se corrige con
+-- `melenas migrate atributos`
+UPDATE Productos p SET tipo_cabello = v.valor
+FROM ValoresAtributo v
+WHERE v.atributo = 'tipo_cabello' AND lower(trim(p.tipo_cabello)) = lower(v.valor) AND p.tipo_cabello <> v.valor;
+
+UPDATE Productos p SET color = v.valor
+FROM ValoresAtributo v
+WHERE v.atributo = 'color' AND lower(trim(p.color)) = lower(v.valor) AND p.color <> v.valor;
+
+UPDATE Productos p SET longitud = v.valor
+FROM ValoresAtributo v
+WHERE v.atributo = 'longitud' AND lower(trim(p.longitud)) = lower(v.valor) AND p.longitud <> v.valor;
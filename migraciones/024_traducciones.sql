@@ -0,0 +1,12 @@
+-- Traducciones de los textos de productos y guías de cuidado. El español
+-- está en las tablas de cada entidad; aquí se guardan los demás idiomas.
+CREATE TABLE IF NOT EXISTS Traducciones (
+	-- producto | cuidado (ambos por producto_id)
+	entidad TEXT NOT NULL CHECK (entidad IN ('producto', 'cuidado')),
+	entidad_id INT NOT NULL REFERENCES Productos (producto_id) ON DELETE CASCADE,
+	idioma TEXT NOT NULL,
+	campo TEXT NOT NULL,
+	texto TEXT NOT NULL,
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (entidad, entidad_id, idioma, campo)
+);
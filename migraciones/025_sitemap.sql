@@ -0,0 +1,17 @@
+-- Fecha en que cada producto apareció por primera vez en Rocketfy, para el
+-- RSS de productos nuevos; los existentes toman su última modificación
+ALTER TABLE ProductosSincronizados ADD COLUMN IF NOT EXISTS creado_en TIMESTAMPTZ;
+UPDATE ProductosSincronizados SET creado_en = actualizado_en WHERE creado_en IS NULL;
+ALTER TABLE ProductosSincronizados ALTER COLUMN creado_en SET DEFAULT now();
+ALTER TABLE ProductosSincronizados ALTER COLUMN creado_en SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS productos_sincronizados_creado_idx ON ProductosSincronizados (creado_en);
+
+-- Documentos públicos generados en cada sincronización (sitemap y RSS), para
+-- que el servidor los sirva aunque la sincronización corra en otro proceso
+CREATE TABLE IF NOT EXISTS DocumentosGenerados (
+	nombre TEXT PRIMARY KEY,
+	contenido BYTEA NOT NULL,
+	tipo_contenido TEXT NOT NULL,
+	generado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,14 @@
+-- Mensajes recibidos por el formulario de contacto (POST /contacto)
+CREATE TABLE IF NOT EXISTS MensajesContacto (
+	mensaje_id SERIAL PRIMARY KEY,
+	nombre TEXT NOT NULL,
+	email TEXT NOT NULL,
+	telefono TEXT,
+	asunto TEXT,
+	mensaje TEXT NOT NULL,
+	ip TEXT,
+	user_agent TEXT,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS mensajes_contacto_creado_idx ON MensajesContacto (creado_en);
@@ -0,0 +1,17 @@
+-- Suscriptores del boletín con doble confirmación (POST /newsletter/suscribir)
+CREATE TABLE IF NOT EXISTS SuscriptoresNewsletter (
+	suscriptor_id SERIAL PRIMARY KEY,
+	email TEXT NOT NULL UNIQUE,
+	nombre TEXT,
+	-- pendiente | confirmado | baja
+	estado TEXT NOT NULL DEFAULT 'pendiente',
+	token_confirmacion TEXT UNIQUE,
+	token_baja TEXT NOT NULL UNIQUE,
+	ip TEXT,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	confirmacion_enviada_en TIMESTAMPTZ,
+	confirmado_en TIMESTAMPTZ,
+	baja_en TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS suscriptores_newsletter_estado_idx ON SuscriptoresNewsletter (estado);
@@ -0,0 +1,11 @@
+-- Dispositivos de la app móvil registrados para notificaciones push (FCM)
+CREATE TABLE IF NOT EXISTS DispositivosCliente (
+	token TEXT PRIMARY KEY,
+	cliente_id INT NOT NULL REFERENCES Clientes (cliente_id),
+	-- android | ios | web
+	plataforma TEXT NOT NULL,
+	registrado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS dispositivos_cliente_idx ON DispositivosCliente (cliente_id);
@@ -0,0 +1,5 @@
+-- Borrado lógico de clientes, productos y certificados: DELETE marca
+-- eliminado_en en lugar de borrar la fila, y el registro se puede restaurar
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS eliminado_en TIMESTAMPTZ;
+ALTER TABLE Productos ADD COLUMN IF NOT EXISTS eliminado_en TIMESTAMPTZ;
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS eliminado_en TIMESTAMPTZ;
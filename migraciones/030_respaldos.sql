@@ -0,0 +1,17 @@
+-- Respaldos de la base con pg_dump y el resultado de su verificación
+-- restaurándolos en una base temporal
+CREATE TABLE IF NOT EXISTS Respaldos (
+	respaldo_id SERIAL PRIMARY KEY,
+	-- en_curso | completado | fallido
+	estado TEXT NOT NULL DEFAULT 'en_curso',
+	clave TEXT,
+	bytes BIGINT,
+	sha256 TEXT,
+	error TEXT,
+	iniciado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	terminado_en TIMESTAMPTZ,
+	verificado_en TIMESTAMPTZ,
+	-- Resumen de la restauración o el error que la impidió
+	verificacion TEXT,
+	verificacion_exitosa BOOLEAN
+);
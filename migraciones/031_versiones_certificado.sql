@@ -0,0 +1,13 @@
+-- Reemisión de certificados (POST /certificados/{numero}/reemitir): cada
+-- reemisión crea un certificado nuevo con la versión siguiente y la compra
+-- pasa a apuntar a él. Las versiones anteriores se conservan marcadas con
+-- reemplazado_en y vigente_id, el certificado que las reemplaza.
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS vigente_id INT REFERENCES Certificados (certificado_id);
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS reemplazado_en TIMESTAMPTZ;
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS motivo_reemision TEXT;
+-- Nombre del titular impreso en esta versión; NULL usa el del cliente
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS nombre_titular TEXT;
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS apellido_titular TEXT;
+
+CREATE INDEX IF NOT EXISTS certificados_vigente_idx ON Certificados (vigente_id);
@@ -0,0 +1,8 @@
+-- Escrituras de etiquetas NFC por certificado, registradas por el flujo de
+-- codificación (POST /admin/certificados/{numero}/nfc)
+CREATE TABLE IF NOT EXISTS EtiquetasNFC (
+	numero_certificado TEXT PRIMARY KEY,
+	escrituras INT NOT NULL DEFAULT 0,
+	ultima_escritura_en TIMESTAMPTZ,
+	bloqueada_en TIMESTAMPTZ
+);
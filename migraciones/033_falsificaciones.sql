@@ -0,0 +1,19 @@
+-- Reportes de productos sospechosos de ser falsificados
+-- (POST /reportar_falsificacion). Las fotos se guardan en el almacenamiento
+-- de archivos y aquí solo sus claves.
+CREATE TABLE IF NOT EXISTS ReportesFalsificacion (
+	reporte_id SERIAL PRIMARY KEY,
+	numero_certificado TEXT,
+	descripcion TEXT NOT NULL,
+	email TEXT,
+	lugar TEXT,
+	latitud DOUBLE PRECISION,
+	longitud DOUBLE PRECISION,
+	fotos TEXT[] NOT NULL DEFAULT '{}',
+	ip TEXT,
+	user_agent TEXT,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS reportes_falsificacion_numero_idx ON ReportesFalsificacion (numero_certificado);
+CREATE INDEX IF NOT EXISTS reportes_falsificacion_creado_idx ON ReportesFalsificacion (creado_en);
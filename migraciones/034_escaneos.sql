@@ -0,0 +1,28 @@
+-- Escaneos individuales de certificados (verificaciones desde la web, la API
+-- y GraphQL) con el hash de la IP y la región, para detectar números usados
+-- en varias falsificaciones. Se archivan como las verificaciones.
+CREATE TABLE IF NOT EXISTS Escaneos (
+	numero_certificado TEXT NOT NULL,
+	ip_hash TEXT NOT NULL,
+	region TEXT NOT NULL DEFAULT '',
+	canal TEXT NOT NULL,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS escaneos_numero_idx ON Escaneos (numero_certificado, creado_en);
+CREATE INDEX IF NOT EXISTS escaneos_creado_idx ON Escaneos (creado_en);
+
+-- Certificados escaneados desde demasiadas IPs o regiones en poco tiempo.
+-- Solo hay una alerta abierta por certificado.
+CREATE TABLE IF NOT EXISTS AlertasEscaneo (
+	alerta_id SERIAL PRIMARY KEY,
+	numero_certificado TEXT NOT NULL,
+	ips INT NOT NULL,
+	regiones INT NOT NULL,
+	ventana_minutos INT NOT NULL,
+	detectada_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	resuelta_en TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS alertas_escaneo_abierta_idx
+	ON AlertasEscaneo (numero_certificado) WHERE resuelta_en IS NULL;
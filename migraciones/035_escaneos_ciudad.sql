@@ -0,0 +1,5 @@
+-- Ciudad del escaneo según la base local de geolocalización (geoip.archivo);
+-- region sigue siendo el código del país, del CDN o de la misma base
+ALTER TABLE Escaneos ADD COLUMN IF NOT EXISTS ciudad TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS escaneos_region_idx ON Escaneos (creado_en, region, ciudad);
@@ -0,0 +1,14 @@
+-- Intentos de acceso a /admin y /metrics rechazados por la lista de IPs
+-- (acceso_admin). Se archivan como los demás registros de auditoría.
+CREATE TABLE IF NOT EXISTS AuditoriaAccesos (
+	acceso_id BIGSERIAL PRIMARY KEY,
+	ip TEXT NOT NULL,
+	metodo TEXT NOT NULL,
+	ruta TEXT NOT NULL,
+	motivo TEXT NOT NULL,
+	request_id TEXT NOT NULL DEFAULT '',
+	user_agent TEXT,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS auditoria_accesos_creado_idx ON AuditoriaAccesos (creado_en);
@@ -0,0 +1,14 @@
+-- IPs bloqueadas temporalmente por intentos fallidos (token de
+-- administrador o consultas de certificados inexistentes). bloqueos cuenta
+-- los bloqueos seguidos para alargar el siguiente; levantarlo lo reinicia.
+CREATE TABLE IF NOT EXISTS BloqueosIP (
+	ip TEXT PRIMARY KEY,
+	motivo TEXT NOT NULL,
+	bloqueos INT NOT NULL DEFAULT 1,
+	bloqueado_hasta TIMESTAMPTZ NOT NULL,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	levantado_en TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS bloqueos_ip_hasta_idx ON BloqueosIP (bloqueado_hasta);
@@ -0,0 +1,25 @@
+-- Números de certificado señuelo: nunca se venden ni existen en
+-- Certificados. Cada consulta de uno se guarda con los datos de quien la hizo
+-- para rastrear de dónde sacan los números los vendedores de falsificaciones;
+-- no se archivan.
+CREATE TABLE IF NOT EXISTS CertificadosSenuelo (
+	numero_certificado TEXT PRIMARY KEY,
+	nota TEXT,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS ConsultasSenuelo (
+	consulta_id BIGSERIAL PRIMARY KEY,
+	numero_certificado TEXT NOT NULL REFERENCES CertificadosSenuelo (numero_certificado) ON DELETE CASCADE,
+	canal TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	region TEXT NOT NULL DEFAULT '',
+	ciudad TEXT NOT NULL DEFAULT '',
+	user_agent TEXT,
+	referer TEXT,
+	idioma TEXT,
+	request_id TEXT NOT NULL DEFAULT '',
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS consultas_senuelo_numero_idx ON ConsultasSenuelo (numero_certificado, creado_en);
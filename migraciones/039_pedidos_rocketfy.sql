@@ -0,0 +1,14 @@
+-- Pedidos de Rocketfy sincronizados como compras (pedidos_rocketfy.go) y
+-- hash del teléfono para encontrar al cliente aunque esté cifrado.
+ALTER TABLE Compras ADD COLUMN IF NOT EXISTS rocketfy_id TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS compras_rocketfy_idx ON Compras (rocketfy_id) WHERE rocketfy_id IS NOT NULL;
+
+ALTER TABLE Clientes ADD COLUMN IF NOT EXISTS telefono_hash TEXT;
+CREATE INDEX IF NOT EXISTS clientes_telefono_hash_idx ON Clientes (telefono_hash);
+
+-- Última posición leída de cada recurso paginado de Rocketfy
+CREATE TABLE IF NOT EXISTS CursoresSincronizacion (
+	recurso TEXT PRIMARY KEY,
+	cursor TEXT NOT NULL,
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,10 @@
+-- Vínculo entre los clientes de Rocketfy y los locales
+-- (clientes_rocketfy.go), para reconocer al cliente de un pedido o webhook
+-- aunque cambie de email o teléfono.
+CREATE TABLE IF NOT EXISTS ClientesRocketfy (
+	rocketfy_id TEXT PRIMARY KEY,
+	cliente_id INT NOT NULL REFERENCES Clientes (cliente_id),
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	sincronizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS clientes_rocketfy_cliente_idx ON ClientesRocketfy (cliente_id);
@@ -0,0 +1,13 @@
+-- Diferencias vigentes entre los datos de Rocketfy y el esquema esperado
+-- (esquema_rocketfy.go); se avisa solo la primera vez que aparece cada una.
+CREATE TABLE IF NOT EXISTS CambiosEsquemaRocketfy (
+	recurso TEXT NOT NULL,
+	campo TEXT NOT NULL,
+	problema TEXT NOT NULL,
+	detalle TEXT NOT NULL DEFAULT '',
+	registros INT NOT NULL,
+	ejemplo TEXT NOT NULL DEFAULT '',
+	detectado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	visto_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (recurso, campo, problema, detalle)
+);
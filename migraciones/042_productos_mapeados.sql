@@ -0,0 +1,3 @@
+-- Producto de Rocketfy convertido a Product según rocketfy.mapeo_productos
+-- (mapeo_productos.go); se completa en la próxima sincronización.
+ALTER TABLE ProductosSincronizados ADD COLUMN IF NOT EXISTS producto JSONB;
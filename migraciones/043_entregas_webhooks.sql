@@ -0,0 +1,23 @@
+-- Registro de cada intento de entrega de los webhooks entrantes (Rocketfy,
+-- proveedor de pagos) y salientes (outbox) para inspeccionarlos y
+-- reintentar los fallidos (webhooks.go)
+CREATE TABLE IF NOT EXISTS EntregasWebhooks (
+	entrega_id BIGSERIAL PRIMARY KEY,
+	-- entrante | saliente
+	direccion TEXT NOT NULL,
+	-- rocketfy | pagos para los entrantes, la URL para los salientes
+	origen TEXT NOT NULL,
+	tipo TEXT NOT NULL DEFAULT '',
+	payload TEXT NOT NULL,
+	exitosa BOOLEAN NOT NULL,
+	codigo_estado INT,
+	respuesta TEXT,
+	error TEXT,
+	duracion_ms INT NOT NULL,
+	-- Entrega original si es un reintento manual; sin llave foránea para
+	-- poder archivar las antiguas
+	reintento_de BIGINT,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS entregas_webhooks_fallidas_idx ON EntregasWebhooks (entrega_id) WHERE NOT exitosa;
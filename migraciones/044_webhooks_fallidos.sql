@@ -0,0 +1,22 @@
+-- Cola de webhooks entrantes que no se pudieron procesar, reintentados con
+-- espera creciente (webhooks_fallidos.go)
+CREATE TABLE IF NOT EXISTS WebhooksFallidos (
+	fallido_id BIGSERIAL PRIMARY KEY,
+	origen TEXT NOT NULL,
+	-- SHA-256 del payload, para no duplicar los reenvíos del proveedor
+	hash TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	error TEXT NOT NULL,
+	-- Primera entrega fallida en EntregasWebhooks
+	entrega_id BIGINT,
+	intentos INT NOT NULL DEFAULT 0,
+	-- NULL si se agotaron los reintentos o ya se resolvió
+	proximo_intento TIMESTAMPTZ,
+	resuelto_en TIMESTAMPTZ,
+	descartado BOOLEAN NOT NULL DEFAULT false,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now(),
+	actualizado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS webhooks_fallidos_pendientes_idx ON WebhooksFallidos (origen, hash) WHERE resuelto_en IS NULL;
+CREATE INDEX IF NOT EXISTS webhooks_fallidos_proximo_idx ON WebhooksFallidos (proximo_intento) WHERE resuelto_en IS NULL;
@@ -0,0 +1,5 @@
+-- Plantilla elegida por la regla de emisión automática que emitió el
+-- certificado (emision_automatica.go); manda sobre la del producto.
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS plantilla TEXT;
+-- Regla que decidió la emisión, para auditar
+ALTER TABLE Certificados ADD COLUMN IF NOT EXISTS regla_emision TEXT;
@@ -0,0 +1,22 @@
+-- Cola de trabajos en segundo plano (trabajos.go): cada trabajo tiene sus
+-- elementos, que se reservan y procesan de a lotes
+CREATE TABLE IF NOT EXISTS Trabajos (
+	trabajo_id BIGSERIAL PRIMARY KEY,
+	tipo TEXT NOT NULL,
+	parametros TEXT NOT NULL,
+	creado_en TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS TrabajosElementos (
+	trabajo_id BIGINT NOT NULL REFERENCES Trabajos (trabajo_id) ON DELETE CASCADE,
+	elemento TEXT NOT NULL,
+	-- pendiente | hecho | fallido
+	estado TEXT NOT NULL DEFAULT 'pendiente',
+	error TEXT,
+	-- Mientras se procesa, hasta cuándo lo tiene reservado una instancia
+	reservado_hasta TIMESTAMPTZ,
+	procesado_en TIMESTAMPTZ,
+	PRIMARY KEY (trabajo_id, elemento)
+);
+
+CREATE INDEX IF NOT EXISTS trabajos_elementos_pendientes_idx ON TrabajosElementos (trabajo_id) WHERE estado = 'pendiente';
@@ -0,0 +1,13 @@
+-- Precio de las líneas de compra guardadas sin él: el de catálogo, que es
+-- el del kit o el del producto sincronizado de Rocketfy con el mismo SKU
+-- (sqlPrecioLinea en impuestos.go). Las líneas sin precio de catálogo
+-- siguen sin precio y no se pueden facturar.
+UPDATE DetallesCompra dc
+SET precio_unitario = coalesce(
+	(SELECT k.precio FROM Kits k WHERE k.kit_id = dc.producto_id),
+	(SELECT round((ps.datos->>'price')::numeric, 2)
+		FROM ProductosSincronizados ps
+		JOIN Productos p ON p.sku = ps.datos->>'sku'
+		WHERE p.producto_id = dc.producto_id AND jsonb_typeof(ps.datos->'price') = 'number'
+		LIMIT 1))
+WHERE dc.precio_unitario IS NULL AND dc.tarifa_iva IS NULL;
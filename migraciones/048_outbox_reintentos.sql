@@ -0,0 +1,10 @@
+-- Reintentos del outbox: proximo_intento reserva el evento mientras se
+-- publica fuera de la transacción y, si falla, programa el siguiente intento
+-- con espera creciente. Agotado outbox.max_intentos el evento queda
+-- descartado.
+ALTER TABLE Outbox ADD COLUMN IF NOT EXISTS proximo_intento TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE Outbox ADD COLUMN IF NOT EXISTS descartado_en TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS outbox_pendientes_idx;
+CREATE INDEX IF NOT EXISTS outbox_pendientes_idx ON Outbox (proximo_intento)
+	WHERE publicado_en IS NULL AND descartado_en IS NULL;
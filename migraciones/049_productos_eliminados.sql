@@ -0,0 +1,4 @@
+-- Productos que Rocketfy dejó de devolver: la fila se conserva con
+-- eliminado_en para que /productos informe el borrado a los clientes que
+-- consultan por updated_since.
+ALTER TABLE ProductosSincronizados ADD COLUMN IF NOT EXISTS eliminado_en TIMESTAMPTZ;
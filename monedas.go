@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conversión de precios de COP a otras monedas para los endpoints de
+// productos (?currency=USD). Las tasas se descargan de la API configurada
+// en monedas.url_tasas y se reutilizan durante monedas.cache_minutos; si
+// la API falla se usa la última tasa descargada y, sin ella, la fija de
+// monedas.tasas_respaldo. La respuesta indica la tasa, su fuente y cuándo
+// se obtuvo.
+
+// Moneda en la que están guardados todos los precios
+const MonedaBase = "COP"
+
+// Fuente de las tasas fijas de config.yml
+const fuenteTasasRespaldo = "tasas_respaldo"
+
+const (
+	minutosCacheTasasPorDefecto = 60
+	timeoutTasas                = 5 * time.Second
+)
+
+var (
+	reMoneda = regexp.MustCompile(`^[A-Z]{3}$`)
+
+	errMonedaNoSoportada = errors.New("Moneda no soportada")
+)
+
+// Tasa de conversión desde COP: un peso equivale a Tasa unidades de Moneda
+type TasaCambio struct {
+	Moneda     string    `json:"moneda"`
+	Tasa       float64   `json:"tasa"`
+	Fuente     string    `json:"fuente"`
+	ObtenidaEn time.Time `json:"obtenida_en"`
+}
+
+// Última descarga de tasas
+var (
+	muTasas    sync.Mutex
+	cacheTasas struct {
+		tasas      map[string]float64
+		fuente     string
+		obtenidaEn time.Time
+	}
+)
+
+// Descargar las tasas de la API: {"rates": {"USD": 0.00024, ...}} con
+// base COP
+func descargarTasas(ctx context.Context, direccion string) (map[string]float64, error) {
+	ctx, cancelar := context.WithTimeout(ctx, timeoutTasas)
+	defer cancelar()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", direccion, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeoutTasas}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("la API de tasas respondió %d", resp.StatusCode)
+	}
+
+	var respuesta struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respuesta); err != nil {
+		return nil, fmt.Errorf("Error al leer las tasas: %v", err)
+	}
+	if len(respuesta.Rates) == 0 {
+		return nil, errors.New("la API de tasas no devolvió tasas")
+	}
+	return respuesta.Rates, nil
+}
+
+// Tasa vigente de COP a la moneda indicada
+func tasaCambio(ctx context.Context, moneda string) (*TasaCambio, error) {
+	monedas := configActual().Monedas
+	duracion := time.Duration(monedas.CacheMinutos) * time.Minute
+	if duracion <= 0 {
+		duracion = minutosCacheTasasPorDefecto * time.Minute
+	}
+
+	muTasas.Lock()
+	defer muTasas.Unlock()
+
+	if monedas.URLTasas != "" && time.Since(cacheTasas.obtenidaEn) > duracion {
+		tasas, err := descargarTasas(ctx, monedas.URLTasas)
+		if err != nil {
+			logSolicitud(ctx, "Error al descargar las tasas de cambio:", err)
+		} else {
+			cacheTasas.tasas = tasas
+			cacheTasas.obtenidaEn = time.Now()
+			cacheTasas.fuente = monedas.URLTasas
+			if u, err := url.Parse(monedas.URLTasas); err == nil {
+				cacheTasas.fuente = u.Host
+			}
+		}
+	}
+
+	// Descargada (aunque esté vencida si la API falló) o de respaldo
+	if tasa, ok := cacheTasas.tasas[moneda]; ok && tasa > 0 {
+		return &TasaCambio{Moneda: moneda, Tasa: tasa, Fuente: cacheTasas.fuente, ObtenidaEn: cacheTasas.obtenidaEn}, nil
+	}
+	if tasa, ok := monedas.TasasRespaldo[moneda]; ok && tasa > 0 {
+		return &TasaCambio{Moneda: moneda, Tasa: tasa, Fuente: fuenteTasasRespaldo, ObtenidaEn: time.Now()}, nil
+	}
+	return nil, errMonedaNoSoportada
+}
+
+// Convertir centavos de COP a centavos de la moneda de la tasa
+func convertirCentavos(centavos int64, tasa *TasaCambio) int64 {
+	return int64(math.Round(float64(centavos) * tasa.Tasa))
+}
+
+// Convertir el precio ("price") de un producto de Rocketfy en COP y marcar
+// la moneda resultante
+func convertirPrecioRocketfy(producto map[string]interface{}, tasa *TasaCambio) {
+	precio, ok := producto["price"].(float64)
+	if !ok {
+		return
+	}
+	if moneda, _ := producto["currency"].(string); moneda != "" && moneda != MonedaBase {
+		return
+	}
+	producto["price"] = math.Round(precio*tasa.Tasa*100) / 100
+	producto["currency"] = tasa.Moneda
+}
+
+// Leer ?currency= de la solicitud; devuelve nil si se piden pesos. Si la
+// moneda no es válida o no hay tasa responde el error y devuelve false.
+func tasaSolicitada(w http.ResponseWriter, r *http.Request) (*TasaCambio, bool) {
+	moneda := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency")))
+	if moneda == "" || moneda == MonedaBase {
+		return nil, true
+	}
+	if !reMoneda.MatchString(moneda) {
+		http.Error(w, "currency debe ser un código ISO 4217 (p. ej. USD)", http.StatusBadRequest)
+		return nil, false
+	}
+
+	tasa, err := tasaCambio(r.Context(), moneda)
+	if err != nil {
+		http.Error(w, "Moneda no soportada: "+moneda, http.StatusBadRequest)
+		return nil, false
+	}
+	return tasa, true
+}
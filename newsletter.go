@@ -0,0 +1,378 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Suscripción al boletín con doble confirmación: POST /newsletter/suscribir
+// guarda al suscriptor como pendiente y le envía un enlace de confirmación;
+// solo los confirmados se exportan. Cada suscriptor tiene un token de baja
+// permanente para el enlace de "cancelar suscripción" de los envíos. Si el
+// email es de un cliente, confirmar y darse de baja actualizan también su
+// consentimiento marketing_email.
+
+// Estados de un suscriptor
+const (
+	SuscriptorPendiente  = "pendiente"
+	SuscriptorConfirmado = "confirmado"
+	SuscriptorBaja       = "baja"
+)
+
+// Formatos de exportación
+const (
+	FormatoMailchimp = "mailchimp"
+	FormatoBrevo     = "brevo"
+)
+
+const (
+	// Vigencia del enlace de confirmación
+	vigenciaConfirmacionNewsletter = 7 * 24 * time.Hour
+	// Tiempo mínimo entre dos emails de confirmación al mismo suscriptor
+	reenvioConfirmacionNewsletter = 10 * time.Minute
+
+	fuenteConsentimientoNewsletter = "newsletter"
+)
+
+var errTokenNewsletterInvalido = errors.New("Enlace inválido o vencido")
+
+// Suscriptor del boletín
+type SuscriptorNewsletter struct {
+	ID           int    `json:"id"`
+	Email        string `json:"email"`
+	Nombre       string `json:"nombre,omitempty"`
+	Estado       string `json:"estado"`
+	CreadoEn     *Fecha `json:"creado_en,omitempty"`
+	ConfirmadoEn *Fecha `json:"confirmado_en,omitempty"`
+}
+
+// Registrar una suscripción. Devuelve los tokens si hay que enviar el email
+// de confirmación: no se envía a los ya confirmados ni más de uno cada
+// reenvioConfirmacionNewsletter.
+func suscribirNewsletter(db *sql.DB, email, nombre, ip string) (confirmacion, baja string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var estado string
+	var enviadaEn *time.Time
+	err = tx.QueryRow(`
+		SELECT estado, confirmacion_enviada_en, token_baja
+		FROM SuscriptoresNewsletter WHERE email = $1
+		FOR UPDATE`, email).Scan(&estado, &enviadaEn, &baja)
+	switch {
+	case err == sql.ErrNoRows:
+		confirmacion, baja = idAleatorio(24), idAleatorio(24)
+		_, err = tx.Exec(`
+			INSERT INTO SuscriptoresNewsletter (email, nombre, token_confirmacion, token_baja, ip, confirmacion_enviada_en)
+			VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), now())`,
+			email, nombre, confirmacion, baja, ip)
+	case err != nil:
+		return "", "", err
+	case estado == SuscriptorConfirmado:
+		return "", "", nil
+	case estado == SuscriptorPendiente && enviadaEn != nil && time.Since(*enviadaEn) < reenvioConfirmacionNewsletter:
+		return "", "", nil
+	default:
+		// Pendiente sin confirmar o dado de baja que vuelve a suscribirse
+		confirmacion = idAleatorio(24)
+		_, err = tx.Exec(`
+			UPDATE SuscriptoresNewsletter
+			SET estado = $2, nombre = coalesce(NULLIF($3, ''), nombre), token_confirmacion = $4,
+				ip = coalesce(NULLIF($5, ''), ip), confirmacion_enviada_en = now()
+			WHERE email = $1`,
+			email, SuscriptorPendiente, nombre, confirmacion, ip)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return confirmacion, baja, tx.Commit()
+}
+
+// Confirmar la suscripción del token; devuelve el email confirmado
+func confirmarSuscriptorNewsletter(db consultorFila, token string) (string, error) {
+	var email string
+	err := db.QueryRow(`
+		UPDATE SuscriptoresNewsletter
+		SET estado = $2, confirmado_en = now(), token_confirmacion = NULL
+		WHERE token_confirmacion = $1 AND estado = $3
+			AND confirmacion_enviada_en > now() - $4::interval
+		RETURNING email`,
+		token, SuscriptorConfirmado, SuscriptorPendiente, fmt.Sprintf("%d seconds", int(vigenciaConfirmacionNewsletter.Seconds()))).
+		Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", errTokenNewsletterInvalido
+	}
+	return email, err
+}
+
+// Dar de baja al suscriptor del token; repetir la baja no es un error
+func darBajaSuscriptorNewsletter(db consultorFila, token string) (string, error) {
+	var email string
+	err := db.QueryRow(`
+		UPDATE SuscriptoresNewsletter
+		SET estado = $2, baja_en = coalesce(baja_en, now()), token_confirmacion = NULL
+		WHERE token_baja = $1
+		RETURNING email`, token, SuscriptorBaja).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", errTokenNewsletterInvalido
+	}
+	return email, err
+}
+
+// Suscriptores en un estado, los más antiguos primero
+func consultarSuscriptoresNewsletter(db *sql.DB, estado string, despuesDe int64, limite int) ([]SuscriptorNewsletter, error) {
+	rows, err := db.Query(`
+		SELECT suscriptor_id, email, coalesce(nombre, ''), estado, creado_en, confirmado_en
+		FROM SuscriptoresNewsletter
+		WHERE estado = $1 AND suscriptor_id > $2
+		ORDER BY suscriptor_id
+		LIMIT $3`, estado, despuesDe, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suscriptores := []SuscriptorNewsletter{}
+	for rows.Next() {
+		var s SuscriptorNewsletter
+		if err := rows.Scan(&s.ID, &s.Email, &s.Nombre, &s.Estado, &s.CreadoEn, &s.ConfirmadoEn); err != nil {
+			return nil, err
+		}
+		suscriptores = append(suscriptores, s)
+	}
+	return suscriptores, rows.Err()
+}
+
+// Reflejar la suscripción en el consentimiento del cliente con ese email,
+// si lo hay
+func sincronizarConsentimientoNewsletter(tx *sql.Tx, email string, otorgado bool) error {
+	clienteID, err := buscarClientePorEmail(tx, email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = guardarConsentimientosTx(tx, clienteID, map[string]bool{ConsentimientoMarketingEmail: otorgado}, fuenteConsentimientoNewsletter)
+	if err == errClienteInexistente {
+		return nil
+	}
+	return err
+}
+
+// Encabezados del CSV para importar en Mailchimp (sus campos por defecto) o
+// en Brevo (atributos EMAIL, FIRSTNAME y LASTNAME separados por punto y coma)
+var encabezadosExportacionNewsletter = map[string][]string{
+	FormatoMailchimp: {"Email Address", "First Name", "Last Name", "Opt-in Time"},
+	FormatoBrevo:     {"EMAIL", "FIRSTNAME", "LASTNAME", "OPT_IN_DATE"},
+}
+
+// Fila de un suscriptor en el CSV del formato
+func registroSuscriptorNewsletter(s SuscriptorNewsletter, formato string) []string {
+	nombre, apellido, _ := strings.Cut(strings.TrimSpace(s.Nombre), " ")
+	var confirmado string
+	if s.ConfirmadoEn != nil {
+		if formato == FormatoMailchimp {
+			confirmado = s.ConfirmadoEn.Time.UTC().Format("2006-01-02 15:04:05")
+		} else {
+			confirmado = s.ConfirmadoEn.Time.Format("2006-01-02")
+		}
+	}
+	return []string{s.Email, nombre, strings.TrimSpace(apellido), confirmado}
+}
+
+// Email con el enlace de confirmación y el de baja
+func enviarConfirmacionNewsletter(base, email, confirmacion, baja string) error {
+	cuerpo := fmt.Sprintf(`Hola,
+
+Recibimos una solicitud para suscribir %s al boletín de %s.
+Para confirmarla abre este enlace (vence en %d días):
+
+%s/newsletter/confirmar?token=%s
+
+Si no fuiste tú, ignora este mensaje y no recibirás más correos.
+Para cancelar la suscripción en cualquier momento:
+%s/newsletter/baja?token=%s
+`, email, marcaFeeds(), int(vigenciaConfirmacionNewsletter.Hours()/24),
+		base, url.QueryEscape(confirmacion), base, url.QueryEscape(baja))
+	return enviarEmail(email, "Confirma tu suscripción al boletín", cuerpo)
+}
+
+// Handler para POST /newsletter/suscribir. Acepta JSON o un formulario HTML
+// con email y opcionalmente nombre; siempre responde 202 para no revelar si
+// el email ya estaba suscrito.
+func suscribirNewsletterHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		Email  string `json:"email"`
+		Nombre string `json:"nombre"`
+		// Campo oculto que solo llenan los bots
+		SitioWeb string `json:"sitio_web"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Cuerpo inválido", http.StatusBadRequest)
+			return
+		}
+		solicitud.Email = r.PostForm.Get("email")
+		solicitud.Nombre = r.PostForm.Get("nombre")
+		solicitud.SitioWeb = r.PostForm.Get("sitio_web")
+	}
+
+	if solicitud.SitioWeb != "" {
+		logSolicitud(r.Context(), "Newsletter: suscripción descartada por el campo trampa")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(solicitud.Email))
+	if direccion, err := mail.ParseAddress(email); err != nil || direccion.Address != email {
+		http.Error(w, "email inválido", http.StatusBadRequest)
+		return
+	}
+	nombre := strings.TrimSpace(solicitud.Nombre)
+	if utf8.RuneCountInString(nombre) > longitudMaximaNombreContacto {
+		http.Error(w, fmt.Sprintf("nombre demasiado largo (máximo %d caracteres)", longitudMaximaNombreContacto), http.StatusBadRequest)
+		return
+	}
+
+	// La base va en los enlaces del email; sin ella no se registra nada
+	base, err := urlBasePublica()
+	if err != nil {
+		http.Error(w, "Error al registrar la suscripción", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	confirmacion, baja, err := registrarSuscripcionNewsletter(r.Context(), email, nombre, textoIPSolicitud(r))
+	if err != nil {
+		http.Error(w, "Error al registrar la suscripción", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	if confirmacion != "" {
+		go func() {
+			if err := enviarConfirmacionNewsletter(base, email, confirmacion, baja); err != nil {
+				logSolicitud(r.Context(), "Error al enviar la confirmación del boletín:", err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Handler para GET /newsletter/confirmar?token= (enlace del email de
+// confirmación) y GET o POST /newsletter/baja?token= (el POST permite la
+// baja con un clic de List-Unsubscribe-Post)
+func tokenNewsletterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	// Los GET también escriben
+	if escriturasBloqueadas() {
+		http.Error(w, "Estamos realizando tareas de mantenimiento, vuelve a intentarlo en unos minutos", http.StatusServiceUnavailable)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, errTokenNewsletterInvalido.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var mensaje string
+	var err error
+	switch r.URL.Path {
+	case "/newsletter/confirmar":
+		err = confirmarNewsletter(r.Context(), token)
+		mensaje = "Tu suscripción al boletín quedó confirmada"
+	case "/newsletter/baja":
+		err = cancelarNewsletter(r.Context(), token)
+		mensaje = "Cancelaste tu suscripción al boletín"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err == errTokenNewsletterInvalido {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error al actualizar la suscripción", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, traducir(idiomaSolicitud(r.Context()), mensaje))
+}
+
+// Handler para GET /admin/newsletter/export?formato=mailchimp|brevo: los
+// suscriptores confirmados en CSV
+func exportarNewsletterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	formato := r.URL.Query().Get("formato")
+	if formato == "" {
+		formato = FormatoMailchimp
+	}
+	if formato != FormatoMailchimp && formato != FormatoBrevo {
+		http.Error(w, "formato debe ser mailchimp o brevo", http.StatusBadRequest)
+		return
+	}
+
+	// Se envía por páginas a medida que se lee
+	escritor := nuevoEscritorExportacion(w, FormatoExportacionCSV, fmt.Sprintf("newsletter-%s-%s", formato, time.Now().Format("20060102")))
+	if formato == FormatoBrevo {
+		escritor.csv.Comma = ';'
+	}
+	escritor.csv.Write(encabezadosExportacionNewsletter[formato])
+	err := recorrerSuscriptoresNewsletter(r.Context(), SuscriptorConfirmado, func(pagina []SuscriptorNewsletter) error {
+		for _, s := range pagina {
+			if err := escritor.escribir(registroSuscriptorNewsletter(s, formato), nil); err != nil {
+				return err
+			}
+		}
+		return escritor.enviar()
+	})
+	if err == nil {
+		err = escritor.enviar()
+	}
+	if err != nil {
+		escritor.fallar(r, err, "Error al generar la exportación")
+	}
+}
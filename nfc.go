@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Etiquetas NFC de las pelucas premium: el flujo de codificación pide el
+// mensaje NDEF con el enlace firmado de verificación (tokens_verificacion.go),
+// lo graba y registra la escritura. Las respuestas incluyen cuántas veces se
+// grabó y si conviene bloquear la etiqueta para que no se pueda reescribir.
+
+// Prefijos de URI abreviados del registro NDEF "U" (NFC Forum URI RTD),
+// los más largos primero
+var prefijosURINDEF = []struct {
+	codigo  byte
+	prefijo string
+}{
+	{0x02, "https://www."},
+	{0x01, "http://www."},
+	{0x04, "https://"},
+	{0x03, "http://"},
+}
+
+// Estado de las escrituras de la etiqueta de un certificado
+type EtiquetaNFC struct {
+	Escrituras        int    `json:"escrituras"`
+	UltimaEscrituraEn *Fecha `json:"ultima_escritura_en,omitempty"`
+	BloqueadaEn       *Fecha `json:"bloqueada_en,omitempty"`
+}
+
+// Mensaje NDEF para grabar en la etiqueta de un certificado
+type PayloadNFC struct {
+	NumeroCertificado string `json:"numero_certificado"`
+	URL               string `json:"url"`
+	VenceEn           Fecha  `json:"vence_en"`
+	NDEFHex           string `json:"ndef_hex"`
+	NDEFBase64        string `json:"ndef_base64"`
+	Bytes             int    `json:"bytes"`
+	EtiquetaNFC
+	// Si se debe bloquear la etiqueta después de comprobar la lectura
+	Bloquear bool   `json:"bloquear"`
+	Aviso    string `json:"aviso"`
+}
+
+// Mensaje NDEF de un único registro URI (TNF well-known, tipo "U")
+func mensajeNDEFURI(uri string) []byte {
+	codigo := byte(0x00)
+	for _, p := range prefijosURINDEF {
+		if strings.HasPrefix(uri, p.prefijo) {
+			codigo = p.codigo
+			uri = strings.TrimPrefix(uri, p.prefijo)
+			break
+		}
+	}
+	contenido := append([]byte{codigo}, uri...)
+
+	// MB y ME (único registro), TNF 0x01; SR si el contenido cabe en un byte
+	encabezado := byte(0xC1)
+	if len(contenido) < 256 {
+		return append([]byte{encabezado | 0x10, 1, byte(len(contenido)), 'U'}, contenido...)
+	}
+	mensaje := []byte{encabezado, 1, 0, 0, 0, 0, 'U'}
+	binary.BigEndian.PutUint32(mensaje[2:6], uint32(len(contenido)))
+	return append(mensaje, contenido...)
+}
+
+func consultarEtiquetaNFC(db *sql.DB, numeroCertificado string) (EtiquetaNFC, error) {
+	var etiqueta EtiquetaNFC
+	err := db.QueryRow(`
+		SELECT escrituras, ultima_escritura_en, bloqueada_en
+		FROM EtiquetasNFC WHERE numero_certificado = $1`, numeroCertificado).
+		Scan(&etiqueta.Escrituras, &etiqueta.UltimaEscrituraEn, &etiqueta.BloqueadaEn)
+	if err == sql.ErrNoRows {
+		return etiqueta, nil
+	}
+	return etiqueta, err
+}
+
+// Registrar que se grabó una etiqueta y, si se indica, que quedó bloqueada
+func insertarEscrituraNFC(db *sql.DB, numeroCertificado string, bloqueada bool) (EtiquetaNFC, error) {
+	var etiqueta EtiquetaNFC
+	err := db.QueryRow(`
+		INSERT INTO EtiquetasNFC (numero_certificado, escrituras, ultima_escritura_en, bloqueada_en)
+		VALUES ($1, 1, now(), CASE WHEN $2 THEN now() END)
+		ON CONFLICT (numero_certificado) DO UPDATE SET
+			escrituras = EtiquetasNFC.escrituras + 1,
+			ultima_escritura_en = now(),
+			bloqueada_en = coalesce(EtiquetasNFC.bloqueada_en, EXCLUDED.bloqueada_en)
+		RETURNING escrituras, ultima_escritura_en, bloqueada_en`, numeroCertificado, bloqueada).
+		Scan(&etiqueta.Escrituras, &etiqueta.UltimaEscrituraEn, &etiqueta.BloqueadaEn)
+	return etiqueta, err
+}
+
+// Recomendación de bloqueo según las escrituras registradas
+func avisoEtiquetaNFC(etiqueta EtiquetaNFC) (bool, string) {
+	switch {
+	case etiqueta.BloqueadaEn != nil:
+		return false, "La etiqueta ya está bloqueada; para reemplazarla se graba una etiqueta nueva"
+	case etiqueta.Escrituras > 0:
+		return true, fmt.Sprintf("Ya se grabaron %d etiquetas sin bloquear; bloquear después de comprobar la lectura", etiqueta.Escrituras)
+	}
+	return true, "Bloquear la etiqueta después de comprobar la lectura"
+}
+
+// Handler para GET y POST /admin/certificados/{numero}/nfc. GET devuelve el
+// mensaje NDEF a grabar; POST registra una escritura con
+// {"bloqueada": true|false}.
+func nfcCertificadoHandler(w http.ResponseWriter, r *http.Request, numero string) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tokensVerificacionActivos() {
+		http.Error(w, "Falta configurar verificacion.clave_tokens", http.StatusServiceUnavailable)
+		return
+	}
+
+	data, err := obtenerCertificado(r.Context(), numero)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Certificado no encontrado", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+	if data.Revocado || data.ReemplazadoPor != nil {
+		http.Error(w, "El certificado está revocado o fue reemplazado; no se debe grabar", http.StatusConflict)
+		return
+	}
+
+	if r.Method == "POST" {
+		var solicitud struct {
+			Bloqueada bool `json:"bloqueada"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+			http.Error(w, "Cuerpo JSON inválido", http.StatusBadRequest)
+			return
+		}
+		etiqueta, err := registrarEscrituraNFC(r.Context(), data.NumeroCertificado, solicitud.Bloqueada)
+		if err != nil {
+			http.Error(w, "Error al registrar la escritura", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(etiqueta)
+		return
+	}
+
+	etiqueta, err := obtenerEtiquetaNFC(r.Context(), data.NumeroCertificado)
+	if err != nil {
+		http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	dias := config.Verificacion.VigenciaDiasNFC
+	if dias == 0 {
+		dias = config.Verificacion.VigenciaDias
+	}
+	vence := time.Now().AddDate(0, 0, dias)
+	token, err := generarTokenVerificacion(data.NumeroCertificado, vence)
+	if err != nil {
+		http.Error(w, "Error al generar el token", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	base, err := urlBasePublica()
+	if err != nil {
+		http.Error(w, "Error al generar la URL", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	url := base + "/v/" + token
+	mensaje := mensajeNDEFURI(url)
+	payload := PayloadNFC{
+		NumeroCertificado: data.NumeroCertificado,
+		URL:               url,
+		VenceEn:           Fecha{vence},
+		NDEFHex:           hex.EncodeToString(mensaje),
+		NDEFBase64:        base64.StdEncoding.EncodeToString(mensaje),
+		Bytes:             len(mensaje),
+		EtiquetaNFC:       etiqueta,
+	}
+	payload.Bloquear, payload.Aviso = avisoEtiquetaNFC(etiqueta)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payload)
+}
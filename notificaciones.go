@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Envío de mensajes a los clientes por email (SMTP) y WhatsApp (API Cloud
+// de WhatsApp Business). Los envíos de marketing deben pasar por
+// enviarSiAutorizado para respetar los consentimientos.
+
+// Canales de notificación a clientes
+const (
+	CanalEmail    = "email"
+	CanalWhatsApp = "whatsapp"
+	CanalPush     = "push"
+)
+
+// Consentimiento requerido por cada canal para mensajes no transaccionales
+var consentimientoPorCanal = map[string]string{
+	CanalEmail:    ConsentimientoMarketingEmail,
+	CanalWhatsApp: ConsentimientoWhatsApp,
+	CanalPush:     ConsentimientoPush,
+}
+
+var urlWhatsApp = "https://graph.facebook.com/v19.0"
+
+const timeoutWhatsApp = 10 * time.Second
+
+// Datos de contacto de un cliente (descifrados si corresponde)
+type ContactoCliente struct {
+	Nombre   string
+	Email    *string
+	Telefono *string
+}
+
+func consultarContactoCliente(db consultorFila, clienteID int) (*ContactoCliente, error) {
+	var contacto ContactoCliente
+	var email, emailCifrado, telefono, telefonoCifrado sql.NullString
+	err := db.QueryRow(`
+		SELECT nombre, email, email_cifrado, telefono, telefono_cifrado
+		FROM Clientes
+		WHERE cliente_id = $1 AND anonimizado_en IS NULL AND eliminado_en IS NULL`, clienteID).
+		Scan(&contacto.Nombre, &email, &emailCifrado, &telefono, &telefonoCifrado)
+	if err != nil {
+		return nil, err
+	}
+
+	contacto.Email, err = valorPII(email, emailCifrado)
+	if err != nil {
+		return nil, err
+	}
+	contacto.Telefono, err = valorPII(telefono, telefonoCifrado)
+	if err != nil {
+		return nil, err
+	}
+	return &contacto, nil
+}
+
+// Enviar un email de texto plano
+func enviarEmail(destino, asunto, cuerpo string) error {
+	return enviarEmailConAdjunto(destino, asunto, cuerpo, nil)
+}
+
+// Archivo adjunto de un email
+type adjuntoEmail struct {
+	Nombre    string
+	TipoMIME  string
+	Contenido []byte
+}
+
+// Enviar un email de texto plano con un adjunto opcional
+func enviarEmailConAdjunto(destino, asunto, cuerpo string, adjunto *adjuntoEmail) error {
+	return enviarMensajeEmail(destino, asunto, "text/plain", cuerpo, adjunto)
+}
+
+// Enviar un email HTML
+func enviarEmailHTML(destino, asunto, html string) error {
+	return enviarMensajeEmail(destino, asunto, "text/html", html, nil)
+}
+
+func enviarMensajeEmail(destino, asunto, tipo, cuerpo string, adjunto *adjuntoEmail) error {
+	ajustes := configActual().Email
+	if ajustes.Servidor == "" {
+		return fmt.Errorf("no hay servidor SMTP configurado (email.servidor)")
+	}
+	host, _, err := net.SplitHostPort(ajustes.Servidor)
+	if err != nil {
+		return fmt.Errorf("email.servidor inválido: %v", err)
+	}
+
+	var mensaje bytes.Buffer
+	fmt.Fprintf(&mensaje, "From: %s\r\n", ajustes.Remitente)
+	fmt.Fprintf(&mensaje, "To: %s\r\n", destino)
+	fmt.Fprintf(&mensaje, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", asunto))
+	fmt.Fprintf(&mensaje, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	mensaje.WriteString("MIME-Version: 1.0\r\n")
+
+	texto := strings.ReplaceAll(cuerpo, "\n", "\r\n")
+	if adjunto == nil {
+		fmt.Fprintf(&mensaje, "Content-Type: %s; charset=utf-8\r\n\r\n", tipo)
+		mensaje.WriteString(texto)
+	} else {
+		limite := "melenas-" + idAleatorio(12)
+		fmt.Fprintf(&mensaje, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", limite)
+		fmt.Fprintf(&mensaje, "--%s\r\nContent-Type: %s; charset=utf-8\r\n\r\n%s\r\n", limite, tipo, texto)
+		fmt.Fprintf(&mensaje, "--%s\r\nContent-Type: %s\r\nContent-Transfer-Encoding: base64\r\n", limite, adjunto.TipoMIME)
+		fmt.Fprintf(&mensaje, "Content-Disposition: attachment; filename=%q\r\n\r\n", adjunto.Nombre)
+		codificado := base64.StdEncoding.EncodeToString(adjunto.Contenido)
+		for len(codificado) > 76 {
+			mensaje.WriteString(codificado[:76] + "\r\n")
+			codificado = codificado[76:]
+		}
+		mensaje.WriteString(codificado + "\r\n")
+		fmt.Fprintf(&mensaje, "--%s--\r\n", limite)
+	}
+
+	var auth smtp.Auth
+	if ajustes.Usuario != "" {
+		auth = smtp.PlainAuth("", ajustes.Usuario, ajustes.Clave, host)
+	}
+	return smtp.SendMail(ajustes.Servidor, auth, ajustes.Remitente, []string{destino}, mensaje.Bytes())
+}
+
+// Enviar un mensaje de plantilla aprobada por WhatsApp. Los mensajes
+// iniciados por la empresa solo pueden usar plantillas.
+func enviarWhatsApp(telefono, plantilla string, parametros []string) error {
+	ajustes := configActual().WhatsApp
+	if ajustes.Token == "" || ajustes.TelefonoID == "" {
+		return fmt.Errorf("WhatsApp no está configurado (whatsapp.token, whatsapp.telefono_id)")
+	}
+	// Los números guardados antes de la normalización pueden venir sin
+	// indicativo o con separadores
+	destino, err := normalizarTelefono(telefono)
+	if err != nil {
+		return fmt.Errorf("%v: %q", err, telefono)
+	}
+
+	var valores []map[string]string
+	for _, parametro := range parametros {
+		valores = append(valores, map[string]string{"type": "text", "text": parametro})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                strings.TrimPrefix(destino, "+"),
+		"type":              "template",
+		"template": map[string]interface{}{
+			"name":     plantilla,
+			"language": map[string]string{"code": "es"},
+			"components": []interface{}{map[string]interface{}{
+				"type":       "body",
+				"parameters": valores,
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", urlWhatsApp+"/"+ajustes.TelefonoID+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ajustes.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: timeoutWhatsApp}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("WhatsApp respondió con código de estado: %d", resp.StatusCode)
+	}
+	return nil
+}
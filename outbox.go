@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Máximo de eventos publicados por cada ciclo del despachador
+	loteOutbox = 50
+	// Tiempo que un evento queda reservado mientras se publica
+	reservaOutbox               = 2 * time.Minute
+	esperaBaseOutbox            = 10 * time.Second
+	esperaMaximaOutbox          = time.Hour
+	maxIntentosOutboxPorDefecto = 10
+)
+
+// Destino al que el despachador entrega los eventos del outbox
+type publicadorEventos func(evento Evento) error
+
+var errEventoDescartadoInexistente = errors.New("Evento descartado no encontrado")
+
+// Evento que agotó sus intentos de publicación (dead letter). Se conserva
+// hasta que un administrador lo reintenta; el archivado no lo toca.
+type EventoDescartado struct {
+	ID           int64           `json:"id"`
+	Tipo         string          `json:"tipo"`
+	Payload      json.RawMessage `json:"payload"`
+	Intentos     int             `json:"intentos"`
+	UltimoError  *string         `json:"ultimo_error"`
+	CreadoEn     Fecha           `json:"creado_en"`
+	DescartadoEn Fecha           `json:"descartado_en"`
+}
+
+// Registrar un evento de dominio dentro de la transacción del cambio
+func registrarEventoOutbox(tx *sql.Tx, tipo string, datos interface{}) error {
+	payload, err := json.Marshal(datos)
+	if err != nil {
+		return fmt.Errorf("Error al serializar el evento: %v", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO Outbox (tipo, payload) VALUES ($1, $2)`, tipo, payload)
+	return err
+}
+
+// Goroutine que publica periódicamente los eventos pendientes del outbox
+func despacharOutbox() {
+	intervalo := time.Duration(config.Outbox.IntervaloSegundos) * time.Second
+	if intervalo <= 0 {
+		intervalo = 5 * time.Second
+	}
+
+	// La publicación es "al menos una vez": si un destino falla, el evento
+	// completo se reintenta. El bus local va al final para evitar duplicados
+	// en el panel cuando falla un webhook; los avisos y
+	// los push nunca fallan.
+	var publicadores []publicadorEventos
+	for _, url := range config.Outbox.Webhooks {
+		publicadores = append(publicadores, publicadorWebhook(url))
+	}
+	if config.Broker.Tipo != "" {
+		publicador, err := publicadorBroker()
+		if err != nil {
+			log.Println("Outbox:", err)
+		} else {
+			publicadores = append(publicadores, publicador)
+		}
+	}
+	publicadores = append(publicadores, publicadorAvisos, publicadorPush, publicarEventoLocal)
+
+	for range time.Tick(intervalo) {
+		// En mantenimiento no se toca la base de datos
+		if estadoActualMantenimiento().Modo == ModoMantenimiento {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Outbox: error al conectar a la base de datos:", err)
+			continue
+		}
+
+		err = publicarPendientesOutbox(db, publicadores)
+		if err != nil {
+			log.Println("Outbox:", err)
+		}
+	}
+}
+
+// Evento reservado para publicarlo
+type pendienteOutbox struct {
+	id       int64
+	intentos int
+	evento   Evento
+}
+
+// Espera antes del siguiente intento tras intentos fallidos: 10 s, 20 s,
+// 40 s... hasta esperaMaximaOutbox
+func esperaOutbox(intentos int) time.Duration {
+	espera := esperaBaseOutbox
+	for i := 1; i < intentos && espera < esperaMaximaOutbox; i++ {
+		espera *= 2
+	}
+	if espera > esperaMaximaOutbox {
+		espera = esperaMaximaOutbox
+	}
+	return espera
+}
+
+// Reservar un lote de eventos pendientes. La reserva es el mismo
+// proximo_intento: mientras dura ninguna otra instancia los toma y, si esta
+// se cae sin anotar el resultado, se retoman al vencer. SKIP LOCKED evita
+// que dos instancias se esperen por las mismas filas.
+func reservarPendientesOutbox(db *sql.DB, limite int) ([]pendienteOutbox, error) {
+	rows, err := db.Query(`
+		UPDATE Outbox SET proximo_intento = now() + $2 * interval '1 second'
+		WHERE outbox_id IN (
+			SELECT outbox_id FROM Outbox
+			WHERE publicado_en IS NULL AND descartado_en IS NULL AND proximo_intento <= now()
+			ORDER BY outbox_id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING outbox_id, intentos, tipo, payload, creado_en`, limite, reservaOutbox.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pendientes []pendienteOutbox
+	for rows.Next() {
+		var p pendienteOutbox
+		var payload []byte
+		err := rows.Scan(&p.id, &p.intentos, &p.evento.Tipo, &payload, &p.evento.Fecha)
+		if err != nil {
+			return nil, err
+		}
+		p.evento.Datos = json.RawMessage(payload)
+		pendientes = append(pendientes, p)
+	}
+	// RETURNING no respeta el ORDER BY de la subconsulta
+	sort.Slice(pendientes, func(i, j int) bool { return pendientes[i].id < pendientes[j].id })
+	return pendientes, rows.Err()
+}
+
+// Anotar el resultado de publicar un evento. Uno fallido se reintenta con
+// espera creciente hasta outbox.max_intentos; después queda descartado
+// (dead letter) hasta que se reintente desde /admin/outbox/descartados y
+// se avisa al equipo.
+func anotarPublicacionOutbox(db *sql.DB, p pendienteOutbox, errPublicacion error) error {
+	intentos := p.intentos + 1
+	if errPublicacion == nil {
+		_, err := db.Exec(`
+			UPDATE Outbox SET intentos = $2, publicado_en = now(), ultimo_error = NULL
+			WHERE outbox_id = $1`, p.id, intentos)
+		return err
+	}
+
+	agotado := intentos >= configActual().Outbox.MaxIntentos
+	_, err := db.Exec(`
+		UPDATE Outbox SET intentos = $2, ultimo_error = $3,
+			proximo_intento = now() + $4 * interval '1 second',
+			descartado_en = CASE WHEN $5 THEN now() END
+		WHERE outbox_id = $1`, p.id, intentos, errPublicacion.Error(), esperaOutbox(intentos).Seconds(), agotado)
+	if err != nil {
+		return err
+	}
+	if agotado {
+		avisar(AvisoEventoDescartado, fmt.Sprintf(
+			"El evento %s %d del outbox falló %d veces y queda descartado hasta que se reintente: %v",
+			p.evento.Tipo, p.id, intentos, errPublicacion))
+	}
+	return nil
+}
+
+// Publicar un lote de eventos pendientes. Se publican fuera de cualquier
+// transacción para no tener filas bloqueadas ni una conexión ocupada
+// mientras responden los webhooks y el broker.
+func publicarPendientesOutbox(db *sql.DB, publicadores []publicadorEventos) error {
+	pendientes, err := reservarPendientesOutbox(db, loteOutbox)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pendientes {
+		var errPublicacion error
+		for _, publicar := range publicadores {
+			if err := publicar(p.evento); err != nil {
+				errPublicacion = err
+				break
+			}
+		}
+		if err := anotarPublicacionOutbox(db, p, errPublicacion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Eventos descartados, del más reciente al más antiguo
+func consultarEventosDescartados(db *sql.DB, limite int) ([]EventoDescartado, error) {
+	rows, err := db.Query(`
+		SELECT outbox_id, tipo, payload, intentos, ultimo_error, creado_en, descartado_en
+		FROM Outbox
+		WHERE descartado_en IS NOT NULL AND publicado_en IS NULL
+		ORDER BY outbox_id DESC
+		LIMIT $1`, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	eventos := []EventoDescartado{}
+	for rows.Next() {
+		var e EventoDescartado
+		var payload []byte
+		err := rows.Scan(&e.ID, &e.Tipo, &payload, &e.Intentos, &e.UltimoError, &e.CreadoEn, &e.DescartadoEn)
+		if err != nil {
+			return nil, err
+		}
+		e.Payload = json.RawMessage(payload)
+		eventos = append(eventos, e)
+	}
+	return eventos, rows.Err()
+}
+
+// Devolver un evento descartado a la cola con los intentos en cero; el
+// despachador lo publica en el próximo ciclo
+func reintentarEventoDescartado(db *sql.DB, id int64) error {
+	resultado, err := db.Exec(`
+		UPDATE Outbox SET descartado_en = NULL, intentos = 0, proximo_intento = now()
+		WHERE outbox_id = $1 AND descartado_en IS NOT NULL AND publicado_en IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := resultado.RowsAffected(); n == 0 {
+		return errEventoDescartadoInexistente
+	}
+	return nil
+}
+
+// Handler para GET /admin/outbox/descartados y POST
+// /admin/outbox/descartados/{id}/reintentar
+func eventosDescartadosHandler(w http.ResponseWriter, r *http.Request) {
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/outbox/descartados"), "/")
+	if ruta == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		eventos, err := obtenerEventosDescartados(r.Context())
+		if err != nil {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(eventos)
+		return
+	}
+
+	id, accion, _ := strings.Cut(ruta, "/")
+	eventoID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || eventoID <= 0 || accion != "reintentar" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err = reintentarEventoDescartadoID(r.Context(), eventoID)
+	if err == errEventoDescartadoInexistente {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error al reintentar el evento", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Publicar en el bus en memoria (stream SSE del panel de administración)
+func publicarEventoLocal(evento Evento) error {
+	publicarEvento(evento.Tipo, evento.Datos)
+	return nil
+}
+
+// Publicar un evento por POST a un webhook externo, firmado con
+// HMAC-SHA256; cada intento queda en EntregasWebhooks (webhooks.go)
+func publicadorWebhook(url string) publicadorEventos {
+	return func(evento Evento) error {
+		body, err := json.Marshal(evento)
+		if err != nil {
+			return err
+		}
+		_, err = entregarWebhookSaliente(url, evento.Tipo, body, nil)
+		return err
+	}
+}
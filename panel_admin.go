@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Panel de administración (SPA) embebido en el binario y servido en
+// /admin/. El build del frontend se copia en panel_admin/ antes de compilar
+// (index.html y los archivos con hash en assets/). Las rutas de la API bajo
+// /admin/ tienen su propio patrón en el mux y prevalecen; cualquier otra
+// ruta sin extensión devuelve index.html para que el enrutador del frontend
+// la resuelva.
+
+//go:embed all:panel_admin
+var archivosPanelAdmin embed.FS
+
+const (
+	rutaPanelAdmin = "/admin/"
+
+	// Los assets llevan el hash en el nombre y no cambian nunca
+	cacheAssetsPanel = "public, max-age=31536000, immutable"
+	// index.html se revalida siempre para tomar el último build
+	cacheIndexPanel = "no-cache"
+)
+
+// Archivo del panel en memoria con su ETag
+type archivoPanel struct {
+	contenido []byte
+	tipo      string
+	etag      string
+}
+
+// Cargar los archivos del panel indexados por su ruta relativa
+func cargarPanelAdmin() (map[string]archivoPanel, error) {
+	raiz, err := fs.Sub(archivosPanelAdmin, "panel_admin")
+	if err != nil {
+		return nil, err
+	}
+
+	archivos := map[string]archivoPanel{}
+	err = fs.WalkDir(raiz, ".", func(ruta string, entrada fs.DirEntry, err error) error {
+		if err != nil || entrada.IsDir() || strings.HasPrefix(entrada.Name(), ".") {
+			return err
+		}
+		contenido, err := fs.ReadFile(raiz, ruta)
+		if err != nil {
+			return err
+		}
+		tipo := mime.TypeByExtension(path.Ext(ruta))
+		if tipo == "" {
+			tipo = http.DetectContentType(contenido)
+		}
+		suma := sha256.Sum256(contenido)
+		archivos[ruta] = archivoPanel{
+			contenido: contenido,
+			tipo:      tipo,
+			etag:      `W/"` + hex.EncodeToString(suma[:16]) + `"`,
+		}
+		return nil
+	})
+	return archivos, err
+}
+
+// Handler para GET /admin/ y las rutas del panel. Los archivos son
+// públicos: el panel pide el token de administrador al iniciar sesión y lo
+// envía a la API.
+func panelAdminHandler() http.HandlerFunc {
+	archivos, err := cargarPanelAdmin()
+	if err != nil {
+		log.Println("Error al cargar el panel de administración:", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ruta := strings.TrimPrefix(path.Clean(r.URL.Path), "/admin")
+		ruta = strings.TrimPrefix(ruta, "/")
+		archivo, ok := archivos[ruta]
+		switch {
+		case ok:
+			if strings.HasPrefix(ruta, "assets/") {
+				w.Header().Set("Cache-Control", cacheAssetsPanel)
+			} else {
+				w.Header().Set("Cache-Control", cacheIndexPanel)
+			}
+		case path.Ext(ruta) != "":
+			// Un asset inexistente no debe recibir el HTML
+			http.NotFound(w, r)
+			return
+		default:
+			// Ruta del enrutador del frontend
+			archivo, ok = archivos["index.html"]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Cache-Control", cacheIndexPanel)
+		}
+
+		w.Header().Set("Content-Type", archivo.tipo)
+		w.Header().Set("ETag", archivo.etag)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archivo.contenido))
+	}
+}
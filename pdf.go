@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Generador mínimo de PDF (rectángulos y texto en Helvetica) para las
+// hojas de etiquetas. Las coordenadas están en puntos con el origen en la
+// esquina inferior izquierda de la página.
+
+// Tamaño A4 en puntos
+const (
+	anchoA4 = 595.28
+	altoA4  = 841.89
+)
+
+type documentoPDF struct {
+	paginas []*bytes.Buffer
+}
+
+// Agregar una página vacía y devolverla como página actual
+func (d *documentoPDF) nuevaPagina() {
+	d.paginas = append(d.paginas, &bytes.Buffer{})
+}
+
+func (d *documentoPDF) actual() *bytes.Buffer {
+	return d.paginas[len(d.paginas)-1]
+}
+
+// Rectángulo relleno en negro
+func (d *documentoPDF) rectangulo(x, y, ancho, alto float64) {
+	fmt.Fprintf(d.actual(), "%.2f %.2f %.2f %.2f re f\n", x, y, ancho, alto)
+}
+
+// Texto con la línea base en (x, y); negrita usa Helvetica-Bold
+func (d *documentoPDF) texto(x, y, tamano float64, negrita bool, texto string) {
+	fuente := "F1"
+	if negrita {
+		fuente = "F2"
+	}
+	fmt.Fprintf(d.actual(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", fuente, tamano, x, y, textoPDF(texto))
+}
+
+// Ancho aproximado de un texto en Helvetica (el ancho medio de un glifo es
+// ~0,5 em), suficiente para centrar y recortar
+func anchoTextoPDF(texto string, tamano float64) float64 {
+	return float64(len([]rune(texto))) * tamano * 0.5
+}
+
+// Escapar un texto para una cadena literal de PDF en WinAnsiEncoding
+func textoPDF(texto string) string {
+	var b strings.Builder
+	for _, letra := range texto {
+		switch {
+		case letra == '(' || letra == ')' || letra == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(letra)
+		case letra < 32:
+			b.WriteByte(' ')
+		case letra < 128:
+			b.WriteRune(letra)
+		case letra < 256:
+			// Latin-1 coincide con WinAnsi para las letras con tilde
+			fmt.Fprintf(&b, "\\%03o", letra)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Serializar el documento completo
+func (d *documentoPDF) bytes() []byte {
+	var salida bytes.Buffer
+	var posiciones []int
+
+	objeto := func(contenido string) {
+		posiciones = append(posiciones, salida.Len())
+		fmt.Fprintf(&salida, "%d 0 obj\n%s\nendobj\n", len(posiciones), contenido)
+	}
+
+	salida.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// 1: catálogo, 2: árbol de páginas, 3 y 4: fuentes, luego página y
+	// contenido por cada página
+	var hijos []string
+	for i := range d.paginas {
+		hijos = append(hijos, fmt.Sprintf("%d 0 R", 5+2*i))
+	}
+	objeto("<< /Type /Catalog /Pages 2 0 R >>")
+	objeto(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(hijos, " "), len(d.paginas)))
+	objeto("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	objeto("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, pagina := range d.paginas {
+		objeto(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", anchoA4, altoA4, 6+2*i))
+		objeto(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", pagina.Len(), pagina.String()))
+	}
+
+	inicioXref := salida.Len()
+	fmt.Fprintf(&salida, "xref\n0 %d\n0000000000 65535 f \n", len(posiciones)+1)
+	for _, posicion := range posiciones {
+		fmt.Fprintf(&salida, "%010d 00000 n \n", posicion)
+	}
+	fmt.Fprintf(&salida, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(posiciones)+1, inicioXref)
+	return salida.Bytes()
+}
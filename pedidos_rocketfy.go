@@ -0,0 +1,364 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Sincronización de los pedidos de Rocketfy con las compras locales
+// (melenas sync orders). Los pedidos se leen por páginas
+// (rocketfy_paginado.go) y cada uno se guarda una sola vez como compra
+// (Compras.rocketfy_id), con el cliente vinculado por su identificador de
+// Rocketfy (clientes_rocketfy.go) o, si el pedido no lo trae, buscado por
+// email o teléfono o creado si no existe, y los productos por SKU; los
+// pedidos pagados sin certificado lo reciben en la misma transacción.
+
+const (
+	// Recurso en CursoresSincronizacion
+	recursoPedidosRocketfy = "pedidos"
+	// Estado local de los pedidos cancelados o reembolsados en Rocketfy
+	estadoPagoCancelado = "cancelado"
+	estadoPagoPendiente = "pendiente"
+	// Motivo de la revocación al cancelarse o reembolsarse en el proveedor
+	// una compra pagada
+	motivoPagoAnulado = "Pago cancelado o reembolsado en el proveedor"
+)
+
+// Estados de pago de Rocketfy y su equivalente local; los demás quedan
+// pendientes
+var estadosPagoRocketfy = map[string]string{
+	"paid":        estadoPagoConfirmado,
+	"pagado":      estadoPagoConfirmado,
+	"approved":    estadoPagoConfirmado,
+	"aprobado":    estadoPagoConfirmado,
+	"completed":   estadoPagoConfirmado,
+	"delivered":   estadoPagoConfirmado,
+	"entregado":   estadoPagoConfirmado,
+	"cancelled":   estadoPagoCancelado,
+	"canceled":    estadoPagoCancelado,
+	"cancelado":   estadoPagoCancelado,
+	"refunded":    estadoPagoCancelado,
+	"reembolsado": estadoPagoCancelado,
+	"rejected":    estadoPagoCancelado,
+	"rechazado":   estadoPagoCancelado,
+}
+
+// Producto de un pedido
+type productoPedido struct {
+	SKU      string
+	Cantidad int
+	// Precio unitario en centavos; nil si el pedido no lo trae
+	Precio *int64
+}
+
+// Pedido de Rocketfy con los campos que se guardan
+type PedidoRocketfy struct {
+	ID         string
+	Fecha      time.Time
+	EstadoPago string
+	// Estado tal como lo informa Rocketfy, para las reglas de emisión
+	EstadoOrigen string
+	// Cliente con email o teléfono; el identificador puede faltar
+	Cliente   ClienteRocketfy
+	Productos []productoPedido
+	// Pedido tal como llegó, para dejarlo en la cola de fallidos
+	datos map[string]interface{}
+}
+
+// Leer un pedido de Rocketfy; devuelve el problema si no se puede guardar
+func leerPedidoRocketfy(datos map[string]interface{}) (PedidoRocketfy, string) {
+	pedido := PedidoRocketfy{ID: textoRocketfy(datos, "id", "_id"), datos: datos}
+	if pedido.ID == "" {
+		return pedido, "pedido sin identificador"
+	}
+
+	fecha := textoRocketfy(datos, "createdAt", "created_at", "date")
+	var err error
+	if pedido.Fecha, err = time.Parse(time.RFC3339, fecha); err != nil {
+		if pedido.Fecha, err = time.Parse("2006-01-02", fecha); err != nil {
+			return pedido, fmt.Sprintf("fecha inválida %q", fecha)
+		}
+	}
+
+	pedido.EstadoPago = estadoPagoPendiente
+	estado := strings.ToLower(textoRocketfy(datos, "paymentStatus", "payment_status", "status"))
+	pedido.EstadoOrigen = estado
+	if local, ok := estadosPagoRocketfy[estado]; ok {
+		pedido.EstadoPago = local
+	}
+
+	cliente, _ := datos["customer"].(map[string]interface{})
+	if cliente == nil {
+		pedido.Cliente = leerClienteRocketfy(datos)
+		pedido.Cliente.ID = ""
+	} else {
+		pedido.Cliente = leerClienteRocketfy(cliente)
+	}
+	if pedido.Cliente.ID == "" {
+		pedido.Cliente.ID = textoRocketfy(datos, "customerId", "customer_id")
+	}
+	if pedido.Cliente.Email == "" && pedido.Cliente.Telefono == "" {
+		return pedido, "cliente sin email ni teléfono válidos"
+	}
+
+	productos, _ := datos["items"].([]interface{})
+	if productos == nil {
+		productos, _ = datos["products"].([]interface{})
+	}
+	for _, p := range productos {
+		item, _ := p.(map[string]interface{})
+		sku := textoRocketfy(item, "sku")
+		if sku == "" {
+			return pedido, "producto sin SKU"
+		}
+		cantidad, err := strconv.Atoi(textoRocketfy(item, "quantity", "cantidad"))
+		if err != nil || cantidad <= 0 {
+			cantidad = 1
+		}
+		producto := productoPedido{SKU: sku, Cantidad: cantidad}
+		if texto := textoRocketfy(item, "price", "unitPrice", "unit_price", "precio"); texto != "" {
+			precio, err := strconv.ParseFloat(texto, 64)
+			if err != nil || precio < 0 {
+				return pedido, fmt.Sprintf("precio inválido %q del SKU %s", texto, sku)
+			}
+			centavos := int64(math.Round(precio * 100))
+			producto.Precio = &centavos
+		}
+		pedido.Productos = append(pedido.Productos, producto)
+	}
+	if len(pedido.Productos) == 0 {
+		return pedido, "pedido sin productos"
+	}
+	return pedido, ""
+}
+
+// Descargar los pedidos desde el último cursor y guardarlos como compras.
+// Con desdeInicio se ignora el cursor y se revisan todos los pedidos.
+func sincronizarPedidos(db *sql.DB, desdeInicio bool) (ResumenRocketfy, error) {
+	return recorrerPaginasRocketfy(db, recursoPedidosRocketfy, "/orders", desdeInicio, guardarPaginaPedidosRocketfy)
+}
+
+// Guardar una página de la sincronización. El cursor avanza sobre los
+// pedidos con SKU desconocido, así que quedan en la cola de webhooks
+// fallidos (webhooks_fallidos.go), que los reintenta hasta que el producto
+// exista.
+func guardarPaginaPedidosRocketfy(tx *sql.Tx, pedidos []map[string]interface{}, resumen *ResumenRocketfy) error {
+	if err := guardarPedidosRocketfy(tx, pedidos, resumen); err != nil {
+		return err
+	}
+	for _, pendiente := range resumen.pendientes {
+		payload, err := json.Marshal(pendiente.datos)
+		if err != nil {
+			return err
+		}
+		if err := guardarWebhookFallido(tx, OrigenWebhookRocketfy, payload, pendiente.motivo, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Guardar una página de pedidos; los pedidos inválidos se omiten
+func guardarPedidosRocketfy(tx *sql.Tx, pedidos []map[string]interface{}, resumen *ResumenRocketfy) error {
+	leidos := make([]PedidoRocketfy, 0, len(pedidos))
+	var skus []string
+	for _, datos := range pedidos {
+		pedido, problema := leerPedidoRocketfy(datos)
+		if problema != "" {
+			resumen.Omitidos = append(resumen.Omitidos, fmt.Sprintf("%s: %s", pedido.ID, problema))
+			continue
+		}
+		leidos = append(leidos, pedido)
+		for _, p := range pedido.Productos {
+			skus = append(skus, p.SKU)
+		}
+	}
+
+	productos, err := productosPorSKU(tx, skus)
+	if err != nil {
+		return err
+	}
+	for _, pedido := range leidos {
+		if err := guardarPedidoRocketfy(tx, pedido, productos, resumen); err != nil {
+			return fmt.Errorf("Pedido %s: %v", pedido.ID, err)
+		}
+	}
+	return nil
+}
+
+// Productos locales de los SKU dados
+func productosPorSKU(db consultorFilas, skus []string) (map[string]int, error) {
+	productos := map[string]int{}
+	if len(skus) == 0 {
+		return productos, nil
+	}
+	rows, err := db.Query(`SELECT sku, producto_id FROM Productos WHERE sku = ANY($1)`, pq.Array(skus))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sku string
+		var productoID int
+		if err := rows.Scan(&sku, &productoID); err != nil {
+			return nil, err
+		}
+		productos[sku] = productoID
+	}
+	return productos, rows.Err()
+}
+
+// Crear o actualizar la compra de un pedido y emitir su certificado si
+// está pagado. Un pedido ya guardado solo cambia de estado mientras siga
+// pendiente localmente o si Rocketfy cancela o reembolsa uno pagado: los
+// reembolsos locales mandan sobre Rocketfy.
+func guardarPedidoRocketfy(tx *sql.Tx, pedido PedidoRocketfy, productos map[string]int, resumen *ResumenRocketfy) error {
+	var compraID int
+	var estado sql.NullString
+	var certificadoID sql.NullInt64
+	err := tx.QueryRow(`
+		SELECT compra_id, estado_pago, certificado_id FROM Compras
+		WHERE rocketfy_id = $1
+		FOR UPDATE`, pedido.ID).Scan(&compraID, &estado, &certificadoID)
+	switch {
+	case err == sql.ErrNoRows:
+		for _, p := range pedido.Productos {
+			if _, ok := productos[p.SKU]; !ok {
+				motivo := fmt.Sprintf("%s: SKU %s desconocido", pedido.ID, p.SKU)
+				resumen.Omitidos = append(resumen.Omitidos, motivo)
+				resumen.pendientes = append(resumen.pendientes, pedidoPendiente{pedido.datos, motivo})
+				return nil
+			}
+		}
+		if compraID, err = insertarCompraPedido(tx, pedido, productos); err != nil {
+			return err
+		}
+		estado = sql.NullString{String: pedido.EstadoPago, Valid: true}
+		resumen.Nuevos++
+	case err != nil:
+		return err
+	}
+
+	actualizado, emitido, err := aplicarEstadoPagoTx(tx, compraID, estado, certificadoID, pedido.EstadoPago, pedido.EstadoOrigen)
+	if err != nil {
+		return err
+	}
+	if actualizado {
+		resumen.Actualizados++
+	}
+	if emitido {
+		resumen.Certificados++
+	}
+	return nil
+}
+
+// Aplicar a una compra el estado de pago informado por Rocketfy o por el
+// proveedor de pagos y, si quedó pagada, emitir su certificado según las
+// reglas de emisión automática (emision_automatica.go). El estado cambia
+// mientras siga pendiente localmente; una compra pagada que el proveedor
+// cancela o reembolsa queda cancelada y se revoca su certificado.
+func aplicarEstadoPagoTx(tx *sql.Tx, compraID int, estado sql.NullString, certificadoID sql.NullInt64, nuevo, estadoOrigen string) (actualizado, emitido bool, err error) {
+	pendiente := (!estado.Valid || estado.String == estadoPagoPendiente) && nuevo != estadoPagoPendiente
+	anulada := estado.String == estadoPagoConfirmado && nuevo == estadoPagoCancelado
+	if pendiente || anulada {
+		_, err = tx.Exec(`UPDATE Compras SET estado_pago = $2 WHERE compra_id = $1`, compraID, nuevo)
+		if err != nil {
+			return false, false, err
+		}
+		err = registrarEventoOutbox(tx, EventoPagoActualizado, EventoCompra{
+			CompraID:       compraID,
+			EstadoPago:     nuevo,
+			EstadoAnterior: estado.String,
+			Fecha:          time.Now(),
+		})
+		if err != nil {
+			return false, false, err
+		}
+		estado = sql.NullString{String: nuevo, Valid: true}
+		actualizado = true
+	}
+
+	if anulada && certificadoID.Valid {
+		var numero string
+		err = tx.QueryRow(`SELECT numero_certificado FROM Certificados WHERE certificado_id = $1`, certificadoID.Int64).
+			Scan(&numero)
+		if err != nil {
+			return actualizado, false, err
+		}
+		if err = revocarCertificadoTx(tx, numero, motivoPagoAnulado); err != nil && err != errCertificadoYaRevocado {
+			return actualizado, false, err
+		}
+		return actualizado, false, nil
+	}
+
+	if estado.String != estadoPagoConfirmado || certificadoID.Valid {
+		return actualizado, false, nil
+	}
+	emitido, err = emitirCertificadoAutomaticoTx(tx, compraID, estadoOrigen)
+	if err != nil {
+		return actualizado, false, err
+	}
+	return actualizado, emitido, nil
+}
+
+// Registrar la compra de un pedido nuevo con su cliente y sus productos
+func insertarCompraPedido(tx *sql.Tx, pedido PedidoRocketfy, productos map[string]int) (int, error) {
+	clienteID, err := 0, sql.ErrNoRows
+	cliente := pedido.Cliente
+	if cliente.ID != "" {
+		var vinculo vinculoRocketfy
+		vinculo, err = vincularClienteRocketfy(tx, cliente)
+		clienteID = vinculo.ClienteID
+	} else {
+		if cliente.Email != "" {
+			clienteID, err = buscarClientePorEmail(tx, cliente.Email)
+		}
+		if err == sql.ErrNoRows && cliente.Telefono != "" {
+			clienteID, err = buscarClientePorTelefono(tx, cliente.Telefono)
+		}
+		if err == sql.ErrNoRows {
+			clienteID, err = insertarCliente(tx, cliente.Nombre, cliente.Apellido, cliente.Email, cliente.Telefono)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var compraID int
+	err = tx.QueryRow(`
+		INSERT INTO Compras (cliente_id, fecha_compra, estado_pago, rocketfy_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING compra_id`, clienteID, pedido.Fecha, pedido.EstadoPago, pedido.ID).Scan(&compraID)
+	if err != nil {
+		return 0, err
+	}
+	err = registrarEventoOutbox(tx, EventoCompraRegistrada, EventoCompra{
+		CompraID:   compraID,
+		ClienteID:  clienteID,
+		EstadoPago: pedido.EstadoPago,
+		Origen:     OrigenCompraRocketfy,
+		RocketfyID: pedido.ID,
+		Fecha:      time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range pedido.Productos {
+		_, err := tx.Exec(`
+			INSERT INTO DetallesCompra (compra_id, producto_id, cantidad, precio_unitario)
+			VALUES ($1, $2, $3, `+fmt.Sprintf(sqlPrecioLinea, "$4", "$2")+`)`,
+			compraID, productos[p.SKU], p.Cantidad, p.Precio)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return compraID, nil
+}
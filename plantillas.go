@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Plantillas de la página del certificado. Cada producto puede indicar una
+// plantilla (Productos.plantilla); se busca primero en la tabla
+// PlantillasCertificado y luego entre las embebidas en plantillas/. Si no
+// existe se usa la plantilla por defecto.
+
+//go:embed plantillas/*.html
+var archivosPlantillas embed.FS
+
+const plantillaPorDefecto = "certificado"
+
+// Tamaño máximo de una plantilla subida por la API
+const tamanoMaximoPlantilla = 256 << 10
+
+var errPlantillaInexistente = errors.New("Plantilla no encontrada")
+
+var reNombrePlantilla = regexp.MustCompile(`^[a-z0-9_-]{1,40}$`)
+
+// Funciones disponibles dentro de las plantillas
+var funcionesPlantilla = template.FuncMap{
+	"fecha": func(f *Fecha) string { return f.In(zonaHoraria).Format("02/01/2006") },
+}
+
+func parsearPlantilla(nombre, html string) (*template.Template, error) {
+	return template.New(nombre).Funcs(funcionesPlantilla).Parse(html)
+}
+
+// Leer una plantilla guardada en la base de datos o embebida
+func consultarPlantilla(db *sql.DB, nombre string) (string, error) {
+	var html string
+	err := db.QueryRow(`SELECT html FROM PlantillasCertificado WHERE nombre = $1`, nombre).Scan(&html)
+	if err != sql.ErrNoRows {
+		return html, err
+	}
+
+	contenido, err := archivosPlantillas.ReadFile("plantillas/" + nombre + ".html")
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", errPlantillaInexistente
+	}
+	return string(contenido), err
+}
+
+func guardarPlantilla(db *sql.DB, nombre, html string) error {
+	_, err := db.Exec(`
+		INSERT INTO PlantillasCertificado (nombre, html, actualizado_en)
+		VALUES ($1, $2, now())
+		ON CONFLICT (nombre) DO UPDATE SET html = EXCLUDED.html, actualizado_en = now()`, nombre, html)
+	return err
+}
+
+// Asignar una plantilla a productos; devuelve la cantidad actualizada
+func asignarPlantillaProductos(db *sql.DB, nombre string, productoIDs []int) (int64, error) {
+	var total int64
+	for _, id := range productoIDs {
+		resultado, err := db.Exec(`UPDATE Productos SET plantilla = $1 WHERE producto_id = $2`, nombre, id)
+		if err != nil {
+			return total, err
+		}
+		n, _ := resultado.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+// Handler para /admin/plantillas/{nombre}:
+//   - GET devuelve el HTML de la plantilla
+//   - PUT guarda el HTML del cuerpo (se valida antes de guardar)
+//   - /vista-previa?numero=MC-... renderiza un certificado con ella
+//   - PUT /productos {"producto_ids": [1, 2]} la asigna a productos
+func plantillasHandler(w http.ResponseWriter, r *http.Request) {
+	nombre, accion, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/plantillas/"), "/"), "/")
+	if !reNombrePlantilla.MatchString(nombre) {
+		http.Error(w, "Nombre de plantilla inválido (a-z, 0-9, _ y -)", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case accion == "" && r.Method == "GET":
+		html, err := obtenerPlantilla(nombre)
+		if err != nil {
+			responderErrorPlantilla(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, html)
+
+	case accion == "" && r.Method == "PUT":
+		cuerpo, err := io.ReadAll(io.LimitReader(r.Body, tamanoMaximoPlantilla+1))
+		if err != nil || len(cuerpo) == 0 || len(cuerpo) > tamanoMaximoPlantilla {
+			http.Error(w, "Cuerpo de la plantilla vacío o demasiado grande", http.StatusBadRequest)
+			return
+		}
+		if _, err := parsearPlantilla(nombre, string(cuerpo)); err != nil {
+			http.Error(w, "Plantilla inválida: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := actualizarPlantilla(nombre, string(cuerpo)); err != nil {
+			responderErrorPlantilla(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case accion == "vista-previa" && r.Method == "GET":
+		numero := r.URL.Query().Get("numero")
+		if numero == "" {
+			http.Error(w, "numero requerido", http.StatusBadRequest)
+			return
+		}
+		html, err := obtenerPlantilla(nombre)
+		if err != nil {
+			responderErrorPlantilla(w, r, err)
+			return
+		}
+		plantilla, err := parsearPlantilla(nombre, html)
+		if err != nil {
+			http.Error(w, "Plantilla inválida: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := obtenerCertificado(r.Context(), numero)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Certificado no encontrado", http.StatusNotFound)
+			} else {
+				http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			}
+			logSolicitud(r.Context(), err)
+			return
+		}
+		responderVistaCertificado(w, r, plantilla, certificadoPublico(data))
+
+	case accion == "productos" && r.Method == "PUT":
+		var solicitud struct {
+			ProductoIDs []int `json:"producto_ids"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&solicitud)
+		if err != nil || len(solicitud.ProductoIDs) == 0 {
+			http.Error(w, "producto_ids requerido", http.StatusBadRequest)
+			return
+		}
+		if _, err := obtenerPlantilla(nombre); err != nil {
+			responderErrorPlantilla(w, r, err)
+			return
+		}
+		actualizados, err := asignarPlantilla(nombre, solicitud.ProductoIDs)
+		if err != nil {
+			responderErrorPlantilla(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"productos_actualizados": actualizados})
+
+	case accion == "" || accion == "vista-previa" || accion == "productos":
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func responderErrorPlantilla(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errPlantillaInexistente {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else {
+		http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+	}
+	logSolicitud(r.Context(), err)
+}
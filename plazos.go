@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Plazo máximo de las solicitudes: limites.tiempo_maximo_segundos para
+// todas las rutas y limites.tiempos_rutas por prefijo (gana el más largo; 0
+// sin plazo, para las que transmiten eventos). El contexto de la solicitud
+// vence al cumplirse el plazo, lo que cancela las consultas en curso, y si
+// el handler todavía no respondió se contesta 504 en JSON en lugar de dejar
+// la conexión colgada. Lo que el handler escriba después se descarta.
+
+// Plazo por defecto de todas las rutas
+const tiempoMaximoSegundosPorDefecto = 30
+
+// Plazos propios de algunas rutas aunque no se configuren: las
+// verificaciones deben responder rápido, las exportaciones tardan más y los
+// eventos no terminan. Las exportaciones por páginas (exportaciones.go)
+// tampoco tienen plazo: envían datos todo el tiempo y cada página es una
+// consulta corta.
+var tiemposRutaPorDefecto = map[string]int{
+	"/obtener_certificado":       3,
+	"/c/":                        3,
+	"/v/":                        3,
+	"/s/":                        3,
+	"/admin/contabilidad/export": 10,
+	"/admin/etiquetas.pdf":       10,
+	"/admin/newsletter/export":   0,
+	"/admin/certificados/export": 0,
+	"/admin/eventos":             0,
+}
+
+// Solicitudes respondidas con 504 por vencer su plazo
+var solicitudesTiempoAgotado uint64
+
+func init() {
+	registrarMetricaCalculada("melenas_http_tiempo_agotado_total",
+		"Solicitudes respondidas con 504 por superar el plazo de su ruta", "counter",
+		func() float64 { return float64(atomic.LoadUint64(&solicitudesTiempoAgotado)) })
+}
+
+// Plazo de una ruta; 0 si no tiene
+func tiempoMaximoRuta(ruta string) time.Duration {
+	ajustes := configActual().Limites
+	segundos, largo := ajustes.TiempoMaximoSegundos, -1
+	for _, rutas := range []map[string]int{tiemposRutaPorDefecto, ajustes.TiemposRutas} {
+		for prefijo, s := range rutas {
+			// Las rutas configuradas reemplazan a las por defecto del mismo prefijo
+			if strings.HasPrefix(ruta, prefijo) && len(prefijo) >= largo {
+				segundos, largo = s, len(prefijo)
+			}
+		}
+	}
+	return time.Duration(segundos) * time.Second
+}
+
+// Responder 504 con el plazo aplicado
+func responderTiempoAgotado(w http.ResponseWriter, r *http.Request, plazo time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":           traducir(idiomaSolicitud(r.Context()), "La solicitud tardó más del tiempo máximo permitido"),
+		"limite_segundos": plazo.Seconds(),
+		"request_id":      idSolicitud(r.Context()),
+	})
+}
+
+// Middleware que aplica el plazo de cada ruta
+func limitarTiempo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plazo := tiempoMaximoRuta(r.URL.Path)
+		if plazo <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancelar := context.WithTimeout(r.Context(), plazo)
+		defer cancelar()
+		r = r.WithContext(ctx)
+
+		respuesta := &respuestaConPlazo{ResponseWriter: w, ctx: ctx, encabezados: http.Header{}}
+		terminado := make(chan struct{})
+		panico := make(chan interface{})
+		go func() {
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p != http.ErrAbortHandler {
+					p = panicConStack{valor: p, stack: debug.Stack()}
+				}
+				// Se relanza en la goroutine de la solicitud para que lo
+				// atienda recuperarPanico; si ya venció el plazo nadie lo
+				// espera y se reporta aquí
+				select {
+				case panico <- p:
+				case <-ctx.Done():
+					if relanzado, ok := p.(panicConStack); ok {
+						reportarPanico(r, relanzado.valor, relanzado.stack)
+					}
+				}
+			}()
+			next.ServeHTTP(respuesta, r)
+			close(terminado)
+		}()
+
+		select {
+		case p := <-panico:
+			panic(p)
+		case <-terminado:
+		case <-ctx.Done():
+		}
+
+		respuesta.mu.Lock()
+		defer respuesta.mu.Unlock()
+		if ctx.Err() == nil {
+			// Encabezados de un handler que no escribió nada
+			respuesta.escribirEncabezados(http.StatusOK)
+			return
+		}
+		respuesta.vencida = true
+		if ctx.Err() != context.DeadlineExceeded {
+			// El cliente cerró la conexión
+			return
+		}
+		atomic.AddUint64(&solicitudesTiempoAgotado, 1)
+		log.Printf("Plazo de %v vencido en %s %s (id %s)", plazo, r.Method, r.URL.Path, idSolicitud(r.Context()))
+		if !respuesta.escrita {
+			responderTiempoAgotado(w, r, plazo)
+		}
+	})
+}
+
+// ResponseWriter del handler con plazo: los encabezados son propios hasta
+// que se escriben y, vencido el plazo, ya no llega nada a la conexión
+type respuestaConPlazo struct {
+	http.ResponseWriter
+	ctx         context.Context
+	mu          sync.Mutex
+	encabezados http.Header
+	escrita     bool
+	vencida     bool
+}
+
+func (w *respuestaConPlazo) Header() http.Header {
+	return w.encabezados
+}
+
+func (w *respuestaConPlazo) WriteHeader(estado int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.escribirEncabezados(estado)
+}
+
+// Pasar los encabezados a la conexión, con el mutex tomado
+func (w *respuestaConPlazo) escribirEncabezados(estado int) {
+	if w.ctx.Err() == context.DeadlineExceeded {
+		// Lo que el handler responda al cancelarse sus consultas no reemplaza
+		// al 504
+		w.vencida = true
+	}
+	if w.escrita || w.vencida {
+		return
+	}
+	w.escrita = true
+	destino := w.ResponseWriter.Header()
+	for clave, valores := range w.encabezados {
+		destino[clave] = valores
+	}
+	w.ResponseWriter.WriteHeader(estado)
+}
+
+func (w *respuestaConPlazo) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.vencida {
+		return 0, http.ErrHandlerTimeout
+	}
+	w.escribirEncabezados(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *respuestaConPlazo) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.vencida {
+		return
+	}
+	w.escribirEncabezados(http.StatusOK)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Log seguro para leerlo mientras otra goroutine escribe
+type logPrueba struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logPrueba) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logPrueba) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func handlerQueFalla(w http.ResponseWriter, r *http.Request) {
+	panic("falla del handler")
+}
+
+// El panic de un handler con plazo llega a recuperarPanico con el stack
+// del handler, y el que ocurre después del plazo también queda en el log
+func TestLimitarTiempoPanico(t *testing.T) {
+	anterior := config
+	defer func() { config = anterior }()
+	config.Limites.TiempoMaximoSegundos = 1
+
+	salida := &logPrueba{}
+	log.SetOutput(salida)
+	defer log.SetOutput(os.Stderr)
+
+	handler := recuperarPanico(limitarTiempo(http.HandlerFunc(handlerQueFalla)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/productos", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("estado %d, se esperaba 500", w.Code)
+	}
+	if registro := salida.String(); !strings.Contains(registro, "handlerQueFalla") {
+		t.Errorf("el log no tiene el stack del handler:\n%s", registro)
+	}
+
+	tardio := make(chan struct{})
+	handler = recuperarPanico(limitarTiempo(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		defer close(tardio)
+		panic("falla después del plazo")
+	})))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/productos", nil))
+	<-tardio
+	for i := 0; i < 100 && !strings.Contains(salida.String(), "falla después del plazo"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if registro := salida.String(); !strings.Contains(registro, "falla después del plazo") {
+		t.Errorf("el panic tardío no quedó en el log:\n%s", registro)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Respuesta del endpoint incremental de productos
+type RespuestaProductos struct {
+	Productos []json.RawMessage `json:"productos"`
+	// rocketfy_id de los productos eliminados desde updated_since
+	Eliminados []string `json:"eliminados"`
+	// Valor a enviar como updated_since en la siguiente consulta
+	ActualizadoHasta time.Time `json:"actualizado_hasta"`
+	// Moneda de los precios y tasa usada si se pidió con ?currency=
+	Moneda     string      `json:"moneda"`
+	TasaCambio *TasaCambio `json:"tasa_cambio,omitempty"`
+}
+
+// Leer updated_since como RFC3339 o como segundos Unix
+func parsearMarcaTiempo(valor string) (time.Time, error) {
+	if segundos, err := strconv.ParseInt(valor, 10, 64); err == nil {
+		return time.Unix(segundos, 0), nil
+	}
+	return time.Parse(time.RFC3339, valor)
+}
+
+// Consultar los productos sincronizados modificados después de una fecha
+// (todos si desde es cero) y los eliminados en ese lapso
+func consultarProductosSincronizados(db *sql.DB, desde time.Time) (*RespuestaProductos, error) {
+	rows, err := db.Query(`
+		SELECT rocketfy_id, datos, actualizado_en, eliminado_en IS NOT NULL
+		FROM ProductosSincronizados
+		WHERE actualizado_en > $1
+		ORDER BY actualizado_en, rocketfy_id`, desde)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	respuesta := &RespuestaProductos{
+		Productos:        []json.RawMessage{},
+		Eliminados:       []string{},
+		ActualizadoHasta: desde,
+		Moneda:           MonedaBase,
+	}
+	for rows.Next() {
+		var id string
+		var datos []byte
+		var actualizado time.Time
+		var eliminado bool
+		if err := rows.Scan(&id, &datos, &actualizado, &eliminado); err != nil {
+			return nil, err
+		}
+		if eliminado {
+			respuesta.Eliminados = append(respuesta.Eliminados, id)
+		} else {
+			respuesta.Productos = append(respuesta.Productos, json.RawMessage(datos))
+		}
+		if actualizado.After(respuesta.ActualizadoHasta) {
+			respuesta.ActualizadoHasta = actualizado
+		}
+	}
+
+	return respuesta, rows.Err()
+}
+
+// Expresar los precios de la respuesta en la moneda de la tasa
+func convertirRespuestaProductos(respuesta *RespuestaProductos, tasa *TasaCambio) error {
+	for i, datos := range respuesta.Productos {
+		var producto map[string]interface{}
+		if err := json.Unmarshal(datos, &producto); err != nil {
+			return err
+		}
+		convertirPrecioRocketfy(producto, tasa)
+		convertido, err := json.Marshal(producto)
+		if err != nil {
+			return err
+		}
+		respuesta.Productos[i] = convertido
+	}
+	respuesta.Moneda = tasa.Moneda
+	respuesta.TasaCambio = tasa
+	return nil
+}
+
+// Dejar en cada producto solo los campos pedidos con ?fields=
+func seleccionarCamposProductos(respuesta *RespuestaProductos, campos *nodoCampos) error {
+	if campos == nil {
+		return nil
+	}
+	for i, datos := range respuesta.Productos {
+		recortado, err := seleccionarCampos(datos, campos)
+		if err != nil {
+			return err
+		}
+		if respuesta.Productos[i], err = json.Marshal(recortado); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler para GET /productos?updated_since=<timestamp>&currency=USD&fields=nombre,precio
+func productosHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "If-None-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var desde time.Time
+	if valor := r.URL.Query().Get("updated_since"); valor != "" {
+		var err error
+		desde, err = parsearMarcaTiempo(valor)
+		if err != nil {
+			http.Error(w, "updated_since debe ser RFC3339 o segundos Unix", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tasa, ok := tasaSolicitada(w, r)
+	if !ok {
+		return
+	}
+
+	respuesta, err := obtenerProductosModificados(r.Context(), desde)
+	if err == nil && tasa != nil {
+		err = convertirRespuestaProductos(respuesta, tasa)
+	}
+	if err == nil {
+		err = seleccionarCamposProductos(respuesta, camposSolicitados(r))
+	}
+	if err != nil {
+		http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	responderJSONConETag(w, r, respuesta, cacheControlProductos())
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxy con caché para las fotos de productos alojadas por Rocketfy
+// (GET /img-proxy?url=...). Las sirve desde nuestro dominio por HTTPS,
+// evitando el contenido mixto y el bloqueo por hotlinking, y con caché de
+// larga duración. Solo se descargan imágenes de los hosts de
+// proxy_imagenes.hosts; cada imagen se guarda en disco la primera vez y se
+// vuelve a descargar pasados proxy_imagenes.max_age_dias. La caché se
+// indexa por la URL normalizada (sin los parámetros que no están en
+// proxy_imagenes.parametros, para que agregar ?x=1 no la llene de copias) y
+// al superar proxy_imagenes.max_mb se borran las imágenes más antiguas.
+
+const (
+	maxAgeProxyImagenesPorDefecto = 30
+	maxMBProxyImagenesPorDefecto  = 500
+	// Extensión del archivo que guarda el Content-Type de cada imagen
+	extensionTipoImagen = ".tipo"
+	// Al podar se deja la caché en esta fracción del máximo para no podar
+	// con cada descarga
+	fraccionPodaImagenes = 0.9
+)
+
+// Evita dos podas simultáneas; si ya hay una en curso no se lanza otra
+var muPodaImagenes sync.Mutex
+
+var (
+	errHostNoPermitido = errors.New("Host de imagen no permitido")
+	errNoEsImagen      = errors.New("La URL no es una imagen")
+)
+
+// Validar la URL pedida contra los hosts permitidos. Un host que empieza
+// con punto (.rocketfy.com) permite también sus subdominios.
+func urlImagenPermitida(direccion string) (*url.URL, error) {
+	u, err := url.Parse(direccion)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, errors.New("url debe ser una URL http(s) absoluta")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, permitido := range configActual().ProxyImagenes.Hosts {
+		permitido = strings.ToLower(permitido)
+		if host == strings.TrimPrefix(permitido, ".") ||
+			(strings.HasPrefix(permitido, ".") && strings.HasSuffix(host, permitido)) {
+			return u, nil
+		}
+	}
+	return nil, errHostNoPermitido
+}
+
+// URL canónica de una imagen: esquema y host en minúsculas, sin puerto por
+// defecto ni fragmento y solo con los parámetros de
+// proxy_imagenes.parametros, ordenados. Es la que se descarga y la clave de
+// la caché.
+func normalizarURLImagen(u *url.URL) *url.URL {
+	normalizada := *u
+	normalizada.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	if puerto := u.Port(); puerto != "" &&
+		!(normalizada.Scheme == "http" && puerto == "80") && !(normalizada.Scheme == "https" && puerto == "443") {
+		host = net.JoinHostPort(host, puerto)
+	}
+	normalizada.Host = host
+	normalizada.User = nil
+	normalizada.Fragment = ""
+	normalizada.RawFragment = ""
+
+	consulta := u.Query()
+	permitidos := url.Values{}
+	for _, parametro := range configActual().ProxyImagenes.Parametros {
+		if valores, ok := consulta[parametro]; ok {
+			permitidos[parametro] = valores
+		}
+	}
+	normalizada.RawQuery = permitidos.Encode()
+	normalizada.ForceQuery = false
+	return &normalizada
+}
+
+func directorioProxyImagenes() string {
+	if directorio := configActual().ProxyImagenes.Directorio; directorio != "" {
+		return directorio
+	}
+	return filepath.Join(os.TempDir(), "melenas-imagenes")
+}
+
+// Ruta en caché de la imagen de una URL
+func archivoImagenCache(direccion string) string {
+	suma := sha256.Sum256([]byte(direccion))
+	return filepath.Join(directorioProxyImagenes(), hex.EncodeToString(suma[:]))
+}
+
+// Descargar una imagen y guardarla en la caché junto con su Content-Type.
+// Se escribe en un temporal y se renombra para no servir archivos a medias.
+func descargarImagenCache(ctx context.Context, u *url.URL, archivo string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeoutImagenProducto)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout: timeoutImagenProducto,
+		// Las redirecciones también deben ir a hosts permitidos
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("demasiadas redirecciones")
+			}
+			_, err := urlImagenPermitida(req.URL.String())
+			return err
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("la imagen respondió con código de estado: %d", resp.StatusCode)
+	}
+	tipo := resp.Header.Get("Content-Type")
+	// SVG puede llevar scripts que correrían en nuestro dominio
+	if !strings.HasPrefix(tipo, "image/") || strings.HasPrefix(tipo, "image/svg") {
+		return errNoEsImagen
+	}
+	if resp.ContentLength > tamanoMaximoImagen {
+		return fmt.Errorf("la imagen supera %d bytes", tamanoMaximoImagen)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(archivo), 0o755); err != nil {
+		return err
+	}
+	temporal, err := os.CreateTemp(filepath.Dir(archivo), "descarga-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporal.Name())
+
+	n, err := io.Copy(temporal, io.LimitReader(resp.Body, tamanoMaximoImagen+1))
+	if cerrar := temporal.Close(); err == nil {
+		err = cerrar
+	}
+	if err != nil {
+		return err
+	}
+	if n > tamanoMaximoImagen {
+		return fmt.Errorf("la imagen supera %d bytes", tamanoMaximoImagen)
+	}
+
+	if err := os.WriteFile(archivo+extensionTipoImagen, []byte(tipo), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporal.Name(), archivo)
+}
+
+// Handler para GET /img-proxy?url=...
+func proxyImagenesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u, err := urlImagenPermitida(r.URL.Query().Get("url"))
+	if err == errHostNoPermitido {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dias := configActual().ProxyImagenes.MaxAgeDias
+	if dias <= 0 {
+		dias = maxAgeProxyImagenesPorDefecto
+	}
+	vigencia := time.Duration(dias) * 24 * time.Hour
+
+	// Se descarga si no está en caché o si venció; si la descarga de una
+	// vencida falla se sirve la que hay
+	u = normalizarURLImagen(u)
+	archivo := archivoImagenCache(u.String())
+	info, err := os.Stat(archivo)
+	if os.IsNotExist(err) || (err == nil && time.Since(info.ModTime()) > vigencia) {
+		errDescarga := descargarImagenCache(r.Context(), u, archivo)
+		if errDescarga != nil && info != nil {
+			logSolicitud(r.Context(), "Proxy de imágenes: se sirve la copia vencida de", u.String(), errDescarga)
+		} else {
+			err = errDescarga
+		}
+		if errDescarga == nil {
+			go podarCacheImagenes()
+		}
+		if err == nil {
+			info, err = os.Stat(archivo)
+		}
+	}
+	if err != nil {
+		if err == errNoEsImagen || err == errHostNoPermitido {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Error al obtener la imagen", http.StatusBadGateway)
+		}
+		logSolicitud(r.Context(), "Proxy de imágenes:", u.String(), err)
+		return
+	}
+
+	f, err := os.Open(archivo)
+	if err != nil {
+		http.Error(w, "Error al obtener la imagen", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	defer f.Close()
+	tipo, err := os.ReadFile(archivo + extensionTipoImagen)
+	if err != nil {
+		tipo = []byte("application/octet-stream")
+	}
+
+	w.Header().Set("Content-Type", string(tipo))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(vigencia.Seconds())))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// Borrar las imágenes más antiguas hasta dejar la caché por debajo de
+// proxy_imagenes.max_mb. Se llama después de cada descarga.
+func podarCacheImagenes() {
+	if !muPodaImagenes.TryLock() {
+		return
+	}
+	defer muPodaImagenes.Unlock()
+
+	maximo := int64(configActual().ProxyImagenes.MaxMB)
+	if maximo <= 0 {
+		maximo = maxMBProxyImagenesPorDefecto
+	}
+	maximo *= 1 << 20
+
+	directorio := directorioProxyImagenes()
+	entradas, err := os.ReadDir(directorio)
+	if err != nil {
+		log.Println("Proxy de imágenes: error al revisar la caché:", err)
+		return
+	}
+	type imagenCache struct {
+		archivo    string
+		tamano     int64
+		modificada time.Time
+	}
+	var imagenes []imagenCache
+	var total int64
+	for _, entrada := range entradas {
+		info, err := entrada.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		total += info.Size()
+		// El .tipo se borra junto con su imagen; los temporales de una
+		// descarga en curso no se tocan
+		nombre := entrada.Name()
+		if strings.HasSuffix(nombre, extensionTipoImagen) || strings.HasPrefix(nombre, "descarga-") {
+			continue
+		}
+		imagenes = append(imagenes, imagenCache{filepath.Join(directorio, nombre), info.Size(), info.ModTime()})
+	}
+	if total <= maximo {
+		return
+	}
+
+	sort.Slice(imagenes, func(i, j int) bool { return imagenes[i].modificada.Before(imagenes[j].modificada) })
+	objetivo := int64(float64(maximo) * fraccionPodaImagenes)
+	borradas := 0
+	for _, imagen := range imagenes {
+		if total <= objetivo {
+			break
+		}
+		if err := os.Remove(imagen.archivo); err != nil && !os.IsNotExist(err) {
+			log.Println("Proxy de imágenes: error al podar la caché:", err)
+			continue
+		}
+		total -= imagen.tamano
+		if info, err := os.Stat(imagen.archivo + extensionTipoImagen); err == nil {
+			total -= info.Size()
+		}
+		os.Remove(imagen.archivo + extensionTipoImagen)
+		borradas++
+	}
+	logInfo("Proxy de imágenes: se borraron %d imágenes antiguas de la caché", borradas)
+}
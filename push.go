@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notificaciones push a la app móvil con Firebase Cloud Messaging (API HTTP
+// v1). La app registra el token FCM del dispositivo con el número de un
+// certificado y el email del cliente; a partir de ahí el cliente recibe
+// push de sus envíos, de los certificados emitidos y, con el
+// consentimiento "push", de los recordatorios de mantenimiento.
+
+// Plataformas de los dispositivos
+const (
+	PlataformaAndroid = "android"
+	PlataformaIOS     = "ios"
+	PlataformaWeb     = "web"
+)
+
+// URL base de la API de FCM
+var urlFCM = "https://fcm.googleapis.com/v1"
+
+const (
+	alcanceFCM = "https://www.googleapis.com/auth/firebase.messaging"
+	timeoutFCM = 10 * time.Second
+	// Los tokens FCM tienen alrededor de 160 caracteres
+	longitudMaximaTokenFCM = 4096
+
+	fuenteConsentimientoApp = "app"
+)
+
+var (
+	errDispositivoNoAutorizado = errors.New("El email no corresponde al certificado")
+	// FCM indicó que el token ya no es válido
+	errDispositivoNoRegistrado = errors.New("dispositivo no registrado en FCM")
+)
+
+// Mensaje push
+type NotificacionPush struct {
+	Titulo string
+	Cuerpo string
+	// Datos para que la app abra la pantalla correspondiente
+	Datos map[string]string
+}
+
+// Cuenta de servicio de Google con acceso a FCM
+type credencialesFCM struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	llave       *rsa.PrivateKey
+}
+
+// Credenciales cargadas y token de acceso OAuth vigente
+var (
+	muFCM    sync.Mutex
+	cacheFCM struct {
+		archivo      string
+		credenciales *credencialesFCM
+		token        string
+		venceEn      time.Time
+	}
+)
+
+// Consultas y escrituras sobre *sql.DB o *sql.Tx
+type ejecutorConsultas interface {
+	consultorFilas
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func plataformaValida(plataforma string) bool {
+	return plataforma == PlataformaAndroid || plataforma == PlataformaIOS || plataforma == PlataformaWeb
+}
+
+func pushConfigurado() bool {
+	return configActual().FCM.Credenciales != ""
+}
+
+// Leer el JSON de la cuenta de servicio descargado de la consola de Firebase
+func cargarCredencialesFCM(archivo string) (*credencialesFCM, error) {
+	contenido, err := os.ReadFile(archivo)
+	if err != nil {
+		return nil, fmt.Errorf("Error al leer las credenciales de FCM: %v", err)
+	}
+	var c credencialesFCM
+	if err := json.Unmarshal(contenido, &c); err != nil {
+		return nil, fmt.Errorf("Error al leer las credenciales de FCM: %v", err)
+	}
+	if c.ProjectID == "" || c.ClientEmail == "" {
+		return nil, errors.New("las credenciales de FCM no tienen project_id o client_email")
+	}
+	if c.TokenURI == "" {
+		c.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	bloque, _ := pem.Decode([]byte(c.PrivateKey))
+	if bloque == nil {
+		return nil, errors.New("la llave privada de FCM no es PEM")
+	}
+	llave, err := x509.ParsePKCS8PrivateKey(bloque.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error al leer la llave privada de FCM: %v", err)
+	}
+	rsaLlave, ok := llave.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("la llave privada de FCM no es RSA")
+	}
+	c.llave = rsaLlave
+	return &c, nil
+}
+
+// JWT firmado con la cuenta de servicio para pedir el token de acceso
+func firmarJWTFCM(c *credencialesFCM, ahora time.Time) (string, error) {
+	codificar := func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b), err
+	}
+	encabezado, err := codificar(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	reclamos, err := codificar(map[string]interface{}{
+		"iss":   c.ClientEmail,
+		"scope": alcanceFCM,
+		"aud":   c.TokenURI,
+		"iat":   ahora.Unix(),
+		"exp":   ahora.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	contenido := encabezado + "." + reclamos
+	resumen := sha256.Sum256([]byte(contenido))
+	firma, err := rsa.SignPKCS1v15(rand.Reader, c.llave, crypto.SHA256, resumen[:])
+	if err != nil {
+		return "", err
+	}
+	return contenido + "." + base64.RawURLEncoding.EncodeToString(firma), nil
+}
+
+// Token de acceso OAuth vigente y el proyecto de Firebase
+func tokenAccesoFCM(ctx context.Context) (token, proyecto string, err error) {
+	archivo := configActual().FCM.Credenciales
+
+	muFCM.Lock()
+	defer muFCM.Unlock()
+
+	if cacheFCM.credenciales == nil || cacheFCM.archivo != archivo {
+		credenciales, err := cargarCredencialesFCM(archivo)
+		if err != nil {
+			return "", "", err
+		}
+		cacheFCM.archivo, cacheFCM.credenciales, cacheFCM.token = archivo, credenciales, ""
+	}
+	c := cacheFCM.credenciales
+	if cacheFCM.token != "" && time.Now().Before(cacheFCM.venceEn) {
+		return cacheFCM.token, c.ProjectID, nil
+	}
+
+	assertion, err := firmarJWTFCM(c, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	formulario := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	ctx, cancelar := context.WithTimeout(ctx, timeoutFCM)
+	defer cancelar()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.TokenURI, strings.NewReader(formulario.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: timeoutFCM}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("Error al obtener el token de FCM: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("Google respondió %d al pedir el token de FCM", resp.StatusCode)
+	}
+	var respuesta struct {
+		Token    string `json:"access_token"`
+		Segundos int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respuesta); err != nil {
+		return "", "", fmt.Errorf("Error al leer el token de FCM: %v", err)
+	}
+
+	// Se renueva un minuto antes de que venza
+	cacheFCM.token = respuesta.Token
+	cacheFCM.venceEn = time.Now().Add(time.Duration(respuesta.Segundos)*time.Second - time.Minute)
+	return cacheFCM.token, c.ProjectID, nil
+}
+
+// Enviar un push a un dispositivo
+func enviarPush(ctx context.Context, dispositivo string, notificacion NotificacionPush) error {
+	acceso, proyecto, err := tokenAccesoFCM(ctx)
+	if err != nil {
+		return err
+	}
+
+	mensaje := map[string]interface{}{
+		"token": dispositivo,
+		"notification": map[string]string{
+			"title": notificacion.Titulo,
+			"body":  notificacion.Cuerpo,
+		},
+	}
+	if len(notificacion.Datos) > 0 {
+		mensaje["data"] = notificacion.Datos
+	}
+	body, err := json.Marshal(map[string]interface{}{"message": mensaje})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelar := context.WithTimeout(ctx, timeoutFCM)
+	defer cancelar()
+	req, err := http.NewRequestWithContext(ctx, "POST", urlFCM+"/projects/"+proyecto+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+acceso)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: timeoutFCM}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error al enviar el push: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+
+	var respuesta struct {
+		Error struct {
+			Estado  string `json:"status"`
+			Mensaje string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&respuesta)
+	if respuesta.Error.Estado == "NOT_FOUND" || respuesta.Error.Estado == "UNREGISTERED" ||
+		(respuesta.Error.Estado == "INVALID_ARGUMENT" && strings.Contains(respuesta.Error.Mensaje, "token")) {
+		return errDispositivoNoRegistrado
+	}
+	return fmt.Errorf("FCM respondió con código de estado %d: %s", resp.StatusCode, respuesta.Error.Mensaje)
+}
+
+func consultarDispositivosCliente(db consultorFilas, clienteID int) ([]string, error) {
+	rows, err := db.Query(`SELECT token FROM DispositivosCliente WHERE cliente_id = $1 ORDER BY registrado_en`, clienteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// Enviar un push a todos los dispositivos del cliente, borrando los que FCM
+// ya no reconoce. Devuelve a cuántos se envió; sin FCM configurado no se
+// envía nada.
+func notificarPushCliente(db ejecutorConsultas, clienteID int, notificacion NotificacionPush) (int, error) {
+	if !pushConfigurado() {
+		return 0, nil
+	}
+	dispositivos, err := consultarDispositivosCliente(db, clienteID)
+	if err != nil {
+		return 0, err
+	}
+
+	enviados := 0
+	var errores []string
+	for _, dispositivo := range dispositivos {
+		err := enviarPush(context.Background(), dispositivo, notificacion)
+		switch {
+		case err == errDispositivoNoRegistrado:
+			if _, err := db.Exec(`DELETE FROM DispositivosCliente WHERE token = $1`, dispositivo); err != nil {
+				return enviados, err
+			}
+		case err != nil:
+			errores = append(errores, err.Error())
+		default:
+			enviados++
+		}
+	}
+	if len(errores) > 0 {
+		return enviados, errors.New(strings.Join(errores, "; "))
+	}
+	return enviados, nil
+}
+
+// Cliente dueño de un certificado vigente, verificando su email
+func clienteDeCertificado(db *sql.DB, numeroCertificado, email string) (int, error) {
+	var compraID, clienteID int
+	err := db.QueryRow(`
+		SELECT com.compra_id, com.cliente_id
+		FROM Certificados c
+		JOIN Compras com ON com.certificado_id = c.certificado_id
+		WHERE c.numero_certificado = $1 AND c.revocado_en IS NULL`, numeroCertificado).Scan(&compraID, &clienteID)
+	if err == sql.ErrNoRows {
+		return 0, errCertificadoInexistente
+	}
+	if err != nil {
+		return 0, err
+	}
+	coincide, err := emailDeCompra(db, compraID, email)
+	if err != nil {
+		return 0, err
+	}
+	if !coincide {
+		return 0, errDispositivoNoAutorizado
+	}
+	return clienteID, nil
+}
+
+// Registrar (o reasignar) el token de un dispositivo
+func guardarDispositivo(db ejecutorConsultas, token, plataforma string, clienteID int) error {
+	_, err := db.Exec(`
+		INSERT INTO DispositivosCliente (token, cliente_id, plataforma)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO UPDATE SET cliente_id = EXCLUDED.cliente_id,
+			plataforma = EXCLUDED.plataforma, actualizado_en = now()`,
+		token, clienteID, plataforma)
+	return err
+}
+
+func eliminarDispositivo(db *sql.DB, token string) error {
+	_, err := db.Exec(`DELETE FROM DispositivosCliente WHERE token = $1`, token)
+	return err
+}
+
+// Publicador del outbox que avisa al cliente por push que su certificado
+// fue emitido. Como publicadorAvisos, nunca devuelve error.
+func publicadorPush(evento Evento) error {
+	if evento.Tipo != EventoCertificadoEmitido || !pushConfigurado() {
+		return nil
+	}
+	var certificado EventoCertificado
+	if datos, ok := evento.Datos.(json.RawMessage); ok {
+		if err := json.Unmarshal(datos, &certificado); err != nil {
+			log.Println("Push: evento de certificado inválido:", err)
+			return nil
+		}
+	}
+	if certificado.CompraID == 0 || !certificado.notificar(NotificarPush) {
+		return nil
+	}
+	if err := notificarCertificadoPush(certificado.CompraID, certificado.NumeroCertificado); err != nil {
+		log.Println("Push: error al avisar el certificado", certificado.NumeroCertificado, ":", err)
+	}
+	return nil
+}
+
+// Handler para POST /dispositivos {"token": "...", "plataforma": "android",
+// "numero_certificado": "MC-...", "email": "...", "recordatorios": true} y
+// DELETE /dispositivos?token=... (al cerrar sesión en la app)
+func dispositivosHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	switch r.Method {
+	case "OPTIONS":
+		w.WriteHeader(http.StatusOK)
+
+	case "POST":
+		var solicitud struct {
+			Token             string `json:"token"`
+			Plataforma        string `json:"plataforma"`
+			NumeroCertificado string `json:"numero_certificado"`
+			Email             string `json:"email"`
+			// Consentimiento para los recordatorios de mantenimiento
+			Recordatorios *bool `json:"recordatorios"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&solicitud); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+		solicitud.Token = strings.TrimSpace(solicitud.Token)
+		if solicitud.Token == "" || len(solicitud.Token) > longitudMaximaTokenFCM {
+			http.Error(w, "token requerido", http.StatusBadRequest)
+			return
+		}
+		if !plataformaValida(solicitud.Plataforma) {
+			http.Error(w, "plataforma debe ser android, ios o web", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(solicitud.NumeroCertificado) == "" || strings.TrimSpace(solicitud.Email) == "" {
+			http.Error(w, "numero_certificado y email requeridos", http.StatusBadRequest)
+			return
+		}
+
+		err := registrarDispositivo(r.Context(), solicitud.Token, solicitud.Plataforma,
+			strings.TrimSpace(solicitud.NumeroCertificado), solicitud.Email, solicitud.Recordatorios)
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errCertificadoInexistente:
+			http.Error(w, "Certificado no encontrado o revocado", http.StatusNotFound)
+		case errDispositivoNoAutorizado:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "Error al registrar el dispositivo", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+		}
+
+	case "DELETE":
+		token := strings.TrimSpace(r.URL.Query().Get("token"))
+		if token == "" {
+			http.Error(w, "token requerido", http.StatusBadRequest)
+			return
+		}
+		if err := eliminarRegistroDispositivo(r.Context(), token); err != nil {
+			http.Error(w, "Error al eliminar el dispositivo", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Recarga en caliente de config.yml, al recibir SIGHUP o al detectar que el
+// archivo cambió. Solo se aplican los ajustes que no requieren reiniciar
+// (URL, credenciales, sandbox, ritmo y mapeo de productos de Rocketfy,
+// sincronización de clientes, claves y tolerancia de los webhooks
+// entrantes, email y WhatsApp, token de administrador, TTL de caché,
+// umbrales de compresión y de consultas lentas, réplica de lectura, reglas de recordatorios,
+// IVA y emisión automática, reportes programados, APIs de transportadoras,
+// tasas de cambio, datos de los feeds, formulario de contacto, captcha,
+// avisos operativos, credenciales de FCM, proxy de imágenes, archivado,
+// respaldos, detección de escaneos, límites del cuerpo, plazos de las
+// rutas, descarte de carga, reintentos de webhooks fallidos y del outbox,
+// redes permitidas para la administración, bloqueos por intentos
+// fallidos y nivel del log); el resto se ignora hasta el próximo inicio. Quien lea estos
+// ajustes en tiempo de ejecución debe hacerlo con configActual().
+
+// Cada cuánto se revisa la fecha de modificación del archivo
+const intervaloVigilanciaConfig = 5 * time.Second
+
+var muConfig sync.RWMutex
+
+// Copia de la configuración protegida contra recargas concurrentes
+func configActual() Config {
+	muConfig.RLock()
+	defer muConfig.RUnlock()
+	return config
+}
+
+// Releer el archivo y aplicar los ajustes recargables
+func recargarConfig(archivo string) error {
+	nueva, err := leerConfig(archivo)
+	if err != nil {
+		return err
+	}
+	// Las mismas validaciones del arranque: una lista de IPs o una URL
+	// inválida no debe reemplazar a la configuración que funciona
+	problemas := validarConfig(nueva)
+	if hayErroresConfig(problemas) {
+		var errores []string
+		for _, problema := range problemas {
+			if !problema.Advertencia {
+				errores = append(errores, problema.Campo+": "+problema.Mensaje)
+			}
+		}
+		return fmt.Errorf("configuración inválida (%s)", strings.Join(errores, "; "))
+	}
+
+	if nueva.DB.Replica != configActual().DB.Replica {
+		// Se registra antes que el Unlock para que corra después de aplicar
+		// la configuración nueva
+		defer reabrirReplica()
+	}
+
+	muConfig.Lock()
+	defer muConfig.Unlock()
+
+	// URL y credenciales cambian juntas para no mezclar sandbox y producción
+	config.API.URL = nueva.API.URL
+	config.API.XSecret = nueva.API.XSecret
+	config.API.XAPIKey = nueva.API.XAPIKey
+	config.API.Sandbox = nueva.API.Sandbox
+	config.API.IntervaloClientesMinutos = nueva.API.IntervaloClientesMinutos
+	config.API.SolicitudesPorMinuto = nueva.API.SolicitudesPorMinuto
+	config.API.EsperaMaximaSegundos = nueva.API.EsperaMaximaSegundos
+	config.API.MapeoProductos = nueva.API.MapeoProductos
+	config.API.SecretoWebhook = nueva.API.SecretoWebhook
+	config.Pagos.SecretoWebhook = nueva.Pagos.SecretoWebhook
+	config.Admin.Token = nueva.Admin.Token
+	config.Cache = nueva.Cache
+	config.Compresion = nueva.Compresion
+	config.DB.UmbralConsultaLentaMs = nueva.DB.UmbralConsultaLentaMs
+	config.DB.Replica = nueva.DB.Replica
+	config.Email = nueva.Email
+	config.WhatsApp = nueva.WhatsApp
+	config.Recordatorios.Reglas = nueva.Recordatorios.Reglas
+	config.Impuestos = nueva.Impuestos
+	config.Reportes = nueva.Reportes
+	config.Envios.Transportadoras = nueva.Envios.Transportadoras
+	config.Monedas = nueva.Monedas
+	config.Contacto = nueva.Contacto
+	config.Captcha = nueva.Captcha
+	config.Avisos = nueva.Avisos
+	config.FCM = nueva.FCM
+	config.ProxyImagenes = nueva.ProxyImagenes
+	config.Archivado = nueva.Archivado
+	config.Respaldos = nueva.Respaldos
+	config.Escaneos = nueva.Escaneos
+	config.Limites = nueva.Limites
+	config.Saturacion = nueva.Saturacion
+	config.EmisionAutomatica = nueva.EmisionAutomatica
+	config.WebhooksEntrantes = nueva.WebhooksEntrantes
+	config.WebhooksFallidos = nueva.WebhooksFallidos
+	config.Outbox.MaxIntentos = nueva.Outbox.MaxIntentos
+	config.AccesoAdmin = nueva.AccesoAdmin
+	config.Proteccion = nueva.Proteccion
+	config.Feeds.URLProducto = nueva.Feeds.URLProducto
+	config.Feeds.Marca = nueva.Feeds.Marca
+	config.Log = nueva.Log
+	return nil
+}
+
+// Vigilar el archivo de configuración y la señal SIGHUP
+func vigilarConfig(archivo string) {
+	senales := make(chan os.Signal, 1)
+	signal.Notify(senales, syscall.SIGHUP)
+
+	var modificado time.Time
+	if info, err := os.Stat(archivo); err == nil {
+		modificado = info.ModTime()
+	}
+
+	go func() {
+		ticker := time.NewTicker(intervaloVigilanciaConfig)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-senales:
+			case <-ticker.C:
+				info, err := os.Stat(archivo)
+				if err != nil || !info.ModTime().After(modificado) {
+					continue
+				}
+				modificado = info.ModTime()
+			}
+
+			// Si el archivo nuevo es inválido se mantiene la configuración anterior
+			if err := recargarConfig(archivo); err != nil {
+				log.Println("Error al recargar la configuración:", err)
+				continue
+			}
+			logInfo("Configuración recargada desde %s", archivo)
+		}
+	}()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"text/template"
+	"time"
+)
+
+// Recordatorios de mantenimiento ("es hora de hidratar tus extensiones")
+// enviados N semanas después de la compra según las reglas de
+// recordatorios.reglas en config.yml. Un programador registra los
+// recordatorios vencidos en RecordatoriosProgramados y luego los envía;
+// cada envío respeta el consentimiento del cliente para ese canal.
+
+// Regla de recordatorio configurable por tipo de cabello
+type ReglaRecordatorio struct {
+	Nombre            string   `yaml:"nombre"`
+	TipoCabello       string   `yaml:"tipo_cabello"`
+	Semanas           int      `yaml:"semanas"`
+	Canales           []string `yaml:"canales"`
+	Asunto            string   `yaml:"asunto"`
+	Mensaje           string   `yaml:"mensaje"`
+	PlantillaWhatsApp string   `yaml:"plantilla_whatsapp"`
+}
+
+// Resultados con los que se cierra un recordatorio
+const (
+	RecordatorioEnviado           = "enviado"
+	RecordatorioSinConsentimiento = "sin_consentimiento"
+	RecordatorioSinContacto       = "sin_contacto"
+	RecordatorioReglaEliminada    = "regla_eliminada"
+	RecordatorioFallido           = "fallido"
+)
+
+const (
+	// Solo se programan compras que vencieron en esta ventana, para no
+	// enviar recordatorios atrasados al activar una regla nueva
+	ventanaRecordatorios       = 7 * 24 * time.Hour
+	loteRecordatorios          = 50
+	maximoIntentosRecordatorio = 5
+)
+
+// Datos disponibles en el asunto y el mensaje de un recordatorio
+type datosRecordatorio struct {
+	Nombre   string
+	Producto string
+	Semanas  int
+}
+
+// Goroutine que programa y envía los recordatorios periódicamente
+func despacharRecordatorios() {
+	intervalo := time.Duration(config.Recordatorios.IntervaloMinutos) * time.Minute
+	if intervalo <= 0 {
+		intervalo = time.Hour
+	}
+
+	for range time.Tick(intervalo) {
+		if estadoActualMantenimiento().Modo == ModoMantenimiento {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Recordatorios: error al conectar a la base de datos:", err)
+			continue
+		}
+
+		reglas := configActual().Recordatorios.Reglas
+		if err := programarRecordatorios(db, reglas); err != nil {
+			log.Println("Recordatorios:", err)
+		}
+		if err := enviarRecordatoriosPendientes(db, reglas); err != nil {
+			log.Println("Recordatorios:", err)
+		}
+	}
+}
+
+// Registrar los recordatorios de las compras que cumplieron el plazo de
+// cada regla; los ya registrados se ignoran
+func programarRecordatorios(db *sql.DB, reglas []ReglaRecordatorio) error {
+	for _, regla := range reglas {
+		for _, canal := range regla.Canales {
+			_, err := db.Exec(`
+				INSERT INTO RecordatoriosProgramados (compra_id, cliente_id, regla, canal, programado_para)
+				SELECT com.compra_id, com.cliente_id, $1, $2, com.fecha_compra + make_interval(weeks => $3)
+				FROM Compras com
+				JOIN DetallesCompra dc ON dc.compra_id = com.compra_id
+				JOIN Productos p ON p.producto_id = dc.producto_id
+				WHERE ($4 = '' OR p.tipo_cabello = $4)
+					AND com.fecha_compra + make_interval(weeks => $3) BETWEEN now() - $5::interval AND now()
+				ON CONFLICT (compra_id, regla, canal) DO NOTHING`,
+				regla.Nombre, canal, regla.Semanas, regla.TipoCabello,
+				fmt.Sprintf("%d seconds", int(ventanaRecordatorios.Seconds())))
+			if err != nil {
+				return fmt.Errorf("Error al programar la regla %s: %v", regla.Nombre, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Enviar un lote de recordatorios vencidos
+func enviarRecordatoriosPendientes(db *sql.DB, reglas []ReglaRecordatorio) error {
+	porNombre := map[string]ReglaRecordatorio{}
+	for _, regla := range reglas {
+		porNombre[regla.Nombre] = regla
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT r.recordatorio_id, r.cliente_id, r.regla, r.canal, COALESCE(p.nombre, '')
+		FROM RecordatoriosProgramados r
+		LEFT JOIN DetallesCompra dc ON dc.compra_id = r.compra_id
+		LEFT JOIN Productos p ON p.producto_id = dc.producto_id
+		WHERE r.procesado_en IS NULL AND r.programado_para <= now() AND r.intentos < $1
+		ORDER BY r.recordatorio_id
+		LIMIT $2
+		FOR UPDATE OF r SKIP LOCKED`, maximoIntentosRecordatorio, loteRecordatorios)
+	if err != nil {
+		return err
+	}
+
+	type pendiente struct {
+		id                     int64
+		clienteID              int
+		regla, canal, producto string
+	}
+	var pendientes []pendiente
+	for rows.Next() {
+		var p pendiente
+		if err := rows.Scan(&p.id, &p.clienteID, &p.regla, &p.canal, &p.producto); err != nil {
+			rows.Close()
+			return err
+		}
+		pendientes = append(pendientes, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range pendientes {
+		resultado, errEnvio := enviarRecordatorio(tx, porNombre, p.regla, p.canal, p.clienteID, p.producto)
+		if errEnvio != nil {
+			_, err = tx.Exec(`
+				UPDATE RecordatoriosProgramados
+				SET intentos = intentos + 1, ultimo_error = $2,
+					procesado_en = CASE WHEN intentos + 1 >= $3 THEN now() END,
+					resultado = CASE WHEN intentos + 1 >= $3 THEN $4 END
+				WHERE recordatorio_id = $1`, p.id, errEnvio.Error(), maximoIntentosRecordatorio, RecordatorioFallido)
+		} else {
+			_, err = tx.Exec(`
+				UPDATE RecordatoriosProgramados
+				SET procesado_en = now(), resultado = $2, intentos = intentos + 1
+				WHERE recordatorio_id = $1`, p.id, resultado)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Enviar un recordatorio y devolver el resultado con el que se cierra
+func enviarRecordatorio(tx *sql.Tx, reglas map[string]ReglaRecordatorio, nombreRegla, canal string, clienteID int, producto string) (string, error) {
+	regla, ok := reglas[nombreRegla]
+	if !ok {
+		return RecordatorioReglaEliminada, nil
+	}
+
+	contacto, err := consultarContactoCliente(tx, clienteID)
+	if err == sql.ErrNoRows {
+		return RecordatorioSinContacto, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	datos := datosRecordatorio{Nombre: contacto.Nombre, Producto: producto, Semanas: regla.Semanas}
+	var enviar func() error
+	switch canal {
+	case CanalEmail:
+		if contacto.Email == nil {
+			return RecordatorioSinContacto, nil
+		}
+		asunto, err := textoRecordatorio(regla.Asunto, datos)
+		if err != nil {
+			return "", err
+		}
+		mensaje, err := textoRecordatorio(regla.Mensaje, datos)
+		if err != nil {
+			return "", err
+		}
+		enviar = func() error { return enviarEmail(*contacto.Email, asunto, mensaje) }
+	case CanalWhatsApp:
+		if contacto.Telefono == nil {
+			return RecordatorioSinContacto, nil
+		}
+		enviar = func() error {
+			return enviarWhatsApp(*contacto.Telefono, regla.PlantillaWhatsApp, []string{datos.Nombre, datos.Producto})
+		}
+	case CanalPush:
+		dispositivos, err := consultarDispositivosCliente(tx, clienteID)
+		if err != nil {
+			return "", err
+		}
+		if len(dispositivos) == 0 {
+			return RecordatorioSinContacto, nil
+		}
+		asunto, err := textoRecordatorio(regla.Asunto, datos)
+		if err != nil {
+			return "", err
+		}
+		mensaje, err := textoRecordatorio(regla.Mensaje, datos)
+		if err != nil {
+			return "", err
+		}
+		enviar = func() error {
+			_, err := notificarPushCliente(tx, clienteID, NotificacionPush{
+				Titulo: asunto,
+				Cuerpo: mensaje,
+				Datos:  map[string]string{"tipo": "recordatorio", "regla": regla.Nombre},
+			})
+			return err
+		}
+	default:
+		return "", fmt.Errorf("canal desconocido: %s", canal)
+	}
+
+	enviado, err := enviarSiAutorizado(tx, clienteID, consentimientoPorCanal[canal], enviar)
+	if err != nil {
+		return "", err
+	}
+	if !enviado {
+		return RecordatorioSinConsentimiento, nil
+	}
+	return RecordatorioEnviado, nil
+}
+
+func textoRecordatorio(plantilla string, datos datosRecordatorio) (string, error) {
+	t, err := template.New("recordatorio").Parse(plantilla)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, datos)
+	return buf.String(), err
+}
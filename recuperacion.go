@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Middleware que convierte un panic en un handler en una respuesta 500 en
+// JSON, registra el stack en el log y, si hay DSN configurado, lo reporta
+// a Sentry
+func recuperarPanico(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			valor := recover()
+			if valor == nil {
+				return
+			}
+			// El servidor usa este panic para abortar respuestas a propósito
+			if valor == http.ErrAbortHandler {
+				panic(valor)
+			}
+
+			stack := debug.Stack()
+			// Un panic relanzado desde otra goroutine (limitarTiempo) trae
+			// el stack del handler
+			if relanzado, ok := valor.(panicConStack); ok {
+				valor, stack = relanzado.valor, relanzado.stack
+			}
+			reportarPanico(r, valor, stack)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":      "Error interno del servidor",
+				"request_id": idSolicitud(r.Context()),
+			})
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Panic capturado en la goroutine de un handler, con el stack de esa
+// goroutine, para relanzarlo en la de la solicitud
+type panicConStack struct {
+	valor interface{}
+	stack []byte
+}
+
+// Registrar un panic en el log y, si hay DSN configurado, en Sentry
+func reportarPanico(r *http.Request, valor interface{}, stack []byte) {
+	logSolicitud(r.Context(), fmt.Sprintf("Panic en %s %s: %v\n%s", r.Method, r.URL.Path, valor, stack))
+
+	if config.Sentry.DSN != "" {
+		go func() {
+			err := reportarSentry(r, valor, stack)
+			if err != nil {
+				log.Println("Error al reportar a Sentry:", err)
+			}
+		}()
+	}
+}
+
+// Enviar un evento a la API "store" de Sentry a partir del DSN
+// (https://<clave>@<host>/<proyecto>)
+func reportarSentry(r *http.Request, valor interface{}, stack []byte) error {
+	dsn, err := url.Parse(config.Sentry.DSN)
+	if err != nil || dsn.User == nil {
+		return fmt.Errorf("DSN de Sentry inválido")
+	}
+	proyecto := strings.Trim(dsn.Path, "/")
+	endpoint := fmt.Sprintf("%s://%s/api/%s/store/", dsn.Scheme, dsn.Host, proyecto)
+
+	evento := map[string]interface{}{
+		"event_id":    idAleatorio(16),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       "fatal",
+		"platform":    "go",
+		"logger":      "melenas",
+		"environment": config.Sentry.Entorno,
+		"message":     fmt.Sprint(valor),
+		"exception": map[string]interface{}{
+			"values": []interface{}{map[string]interface{}{
+				"type":  "panic",
+				"value": fmt.Sprint(valor),
+			}},
+		},
+		"request": map[string]interface{}{
+			"url":    r.URL.Path,
+			"method": r.Method,
+		},
+		"tags": map[string]interface{}{
+			"request_id": idSolicitud(r.Context()),
+		},
+		"extra": map[string]interface{}{
+			"stack": string(stack),
+		},
+	}
+	body, err := json.Marshal(evento)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf(
+		"Sentry sentry_version=7, sentry_client=melenas/1.0, sentry_key=%s", dsn.User.Username()))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Sentry respondió con código de estado: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reembolso total de una compra: se registra como pendiente, se solicita al
+// proveedor de pagos y, si lo aprueba, se marca la compra como reembolsada
+// y se revoca su certificado en una misma transacción.
+
+// Estados de un reembolso
+const (
+	ReembolsoPendiente  = "pendiente"
+	ReembolsoCompletado = "completado"
+	ReembolsoFallido    = "fallido"
+)
+
+// Estado de pago de una compra reembolsada
+const estadoPagoReembolsado = "reembolsado"
+
+const timeoutProveedorPagos = 30 * time.Second
+
+// Un reembolso que sigue pendiente pasado este tiempo quedó a medias (el
+// proceso se cayó o falló el registro después de que el proveedor lo
+// aceptara) y se puede volver a solicitar; la clave de idempotencia hace
+// que el proveedor devuelva el mismo reembolso en vez de crear otro.
+const vencimientoReembolsoPendiente = 5 * time.Minute
+
+var (
+	errCompraNoPagada    = errors.New("La compra no tiene un pago confirmado")
+	errCompraReembolsada = errors.New("La compra ya fue reembolsada")
+	errReembolsoEnCurso  = errors.New("Ya hay un reembolso en curso para la compra")
+)
+
+// Reembolso de una compra
+type Reembolso struct {
+	ReembolsoID         int     `json:"reembolso_id"`
+	CompraID            int     `json:"compra_id"`
+	Monto               string  `json:"monto"`
+	Motivo              string  `json:"motivo"`
+	Estado              string  `json:"estado"`
+	ReferenciaProveedor *string `json:"referencia_proveedor"`
+	Mensaje             string  `json:"mensaje,omitempty"`
+	CreadoEn            Fecha   `json:"creado_en"`
+
+	clienteID      int
+	referenciaPago sql.NullString
+}
+
+// Datos publicados en el evento de reembolso
+type EventoReembolso struct {
+	CompraID          int       `json:"compra_id"`
+	Monto             string    `json:"monto"`
+	NumeroCertificado string    `json:"numero_certificado,omitempty"`
+	Fecha             time.Time `json:"fecha"`
+}
+
+// Registrar el reembolso pendiente de una compra pagada. Un reembolso
+// fallido o pendiente vencido se puede reintentar conservando su
+// reembolso_id; el monto es el total con IVA.
+func registrarReembolso(db *sql.DB, compraID int, motivo string) (*Reembolso, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	reembolso := Reembolso{CompraID: compraID, Motivo: motivo}
+	var estadoPago sql.NullString
+	err = tx.QueryRow(`
+		SELECT estado_pago, referencia_pago, cliente_id
+		FROM Compras WHERE compra_id = $1
+		FOR UPDATE`, compraID).Scan(&estadoPago, &reembolso.referenciaPago, &reembolso.clienteID)
+	if err == sql.ErrNoRows {
+		return nil, errCompraNoEncontrada
+	}
+	if err != nil {
+		return nil, err
+	}
+	if estadoPago.String == estadoPagoReembolsado {
+		return nil, errCompraReembolsada
+	}
+	if estadoPago.String != estadoPagoConfirmado {
+		return nil, errCompraNoPagada
+	}
+
+	impuestos, err := calcularImpuestosCompra(tx, compraID)
+	if err != nil {
+		return nil, err
+	}
+	if len(impuestos) == 0 {
+		return nil, errCompraSinPrecios
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO Reembolsos (compra_id, monto, motivo)
+		SELECT $1, sum(base + valor), $2 FROM ImpuestosCompra WHERE compra_id = $1
+		ON CONFLICT (compra_id) DO UPDATE
+			SET monto = EXCLUDED.monto, motivo = EXCLUDED.motivo, estado = 'pendiente', mensaje = '', creado_en = now()
+			WHERE Reembolsos.estado = 'fallido'
+				OR (Reembolsos.estado = 'pendiente' AND Reembolsos.creado_en < now() - $3 * interval '1 second')
+		RETURNING reembolso_id, monto::text, estado, creado_en`, compraID, motivo, int(vencimientoReembolsoPendiente.Seconds())).
+		Scan(&reembolso.ReembolsoID, &reembolso.Monto, &reembolso.Estado, &reembolso.CreadoEn)
+	if err == sql.ErrNoRows {
+		return nil, errReembolsoEnCurso
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &reembolso, tx.Commit()
+}
+
+// Marcar el reembolso como completado, la compra como reembolsada y
+// revocar el certificado si lo tiene
+func completarReembolso(db *sql.DB, reembolso *Reembolso, referencia string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var fecha time.Time
+	err = tx.QueryRow(`
+		UPDATE Reembolsos SET estado = 'completado', referencia_proveedor = $2, completado_en = now()
+		WHERE reembolso_id = $1
+		RETURNING completado_en`, reembolso.ReembolsoID, referencia).Scan(&fecha)
+	if err != nil {
+		return "", err
+	}
+
+	var numero sql.NullString
+	err = tx.QueryRow(`
+		UPDATE Compras com SET estado_pago = $2
+		WHERE com.compra_id = $1
+		RETURNING (SELECT numero_certificado FROM Certificados WHERE certificado_id = com.certificado_id)`,
+		reembolso.CompraID, estadoPagoReembolsado).Scan(&numero)
+	if err != nil {
+		return "", err
+	}
+
+	if numero.Valid {
+		err = revocarCertificadoTx(tx, numero.String, "Compra reembolsada")
+		if err != nil && err != errCertificadoYaRevocado {
+			return "", err
+		}
+	}
+
+	err = registrarEventoOutbox(tx, EventoCompraReembolsada, EventoReembolso{
+		CompraID:          reembolso.CompraID,
+		Monto:             reembolso.Monto,
+		NumeroCertificado: numero.String,
+		Fecha:             fecha,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return numero.String, tx.Commit()
+}
+
+func marcarReembolsoFallido(db *sql.DB, reembolsoID int, mensaje string) error {
+	_, err := db.Exec(`UPDATE Reembolsos SET estado = 'fallido', mensaje = $2 WHERE reembolso_id = $1`,
+		reembolsoID, mensaje)
+	return err
+}
+
+// Solicitar el reembolso al proveedor de pagos y devolver su referencia. La
+// clave de idempotencia evita reembolsar dos veces si se reintenta.
+func solicitarReembolsoProveedor(reembolso *Reembolso) (string, error) {
+	c := configActual().Pagos
+	if c.URLProveedor == "" {
+		// Sin proveedor configurado el reembolso se hace por fuera
+		return "manual", nil
+	}
+	if !reembolso.referenciaPago.Valid {
+		return "", errors.New("La compra no tiene referencia de pago")
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"referencia_pago": reembolso.referenciaPago.String,
+		"monto":           reembolso.Monto,
+		"moneda":          "COP",
+		"motivo":          reembolso.Motivo,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.URLProveedor, "/")+"/reembolsos", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("reembolso-%d", reembolso.ReembolsoID))
+
+	client := &http.Client{Timeout: timeoutProveedorPagos}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error al solicitar el reembolso: %v", err)
+	}
+	defer resp.Body.Close()
+
+	contenido, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("El proveedor de pagos respondió con código de estado %d: %s",
+			resp.StatusCode, strings.TrimSpace(string(contenido)))
+	}
+
+	var respuesta struct {
+		ID string `json:"id"`
+	}
+	err = json.Unmarshal(contenido, &respuesta)
+	if err != nil {
+		return "", fmt.Errorf("Error al leer la respuesta del proveedor de pagos: %v", err)
+	}
+	return respuesta.ID, nil
+}
+
+// Registrar el resultado del proveedor y notificar al cliente
+func procesarReembolso(db *sql.DB, reembolso *Reembolso) error {
+	referencia, err := solicitarReembolsoProveedor(reembolso)
+	if err != nil {
+		reembolso.Estado = ReembolsoFallido
+		reembolso.Mensaje = err.Error()
+		go avisar(AvisoErrorPagos, fmt.Sprintf("Falló el reembolso de la compra %d con el proveedor de pagos: %v", reembolso.CompraID, err))
+		return marcarReembolsoFallido(db, reembolso.ReembolsoID, err.Error())
+	}
+
+	numero, err := completarReembolso(db, reembolso, referencia)
+	if err != nil {
+		return err
+	}
+	reembolso.Estado = ReembolsoCompletado
+	reembolso.ReferenciaProveedor = &referencia
+
+	go func() {
+		if err := notificarReembolso(db, reembolso, numero); err != nil {
+			log.Println("Error al notificar el reembolso de la compra", reembolso.CompraID, ":", err)
+		}
+	}()
+	return nil
+}
+
+// Avisar al cliente que se procesó el reembolso
+func notificarReembolso(db *sql.DB, reembolso *Reembolso, numeroCertificado string) error {
+	contacto, err := consultarContactoCliente(db, reembolso.clienteID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if contacto.Email == nil {
+		return nil
+	}
+
+	cuerpo := fmt.Sprintf("Hola %s,\n\nProcesamos el reembolso de tu compra por $%s COP.", contacto.Nombre, reembolso.Monto)
+	if numeroCertificado != "" {
+		cuerpo += fmt.Sprintf(" El certificado %s quedó anulado.", numeroCertificado)
+	}
+	return enviarEmail(*contacto.Email, "Reembolso de tu compra en Melenas Co", cuerpo+"\n")
+}
+
+// Agregar los reembolsos completados del período al libro contable:
+// débito a devoluciones e IVA generado, crédito a caja
+func asientosDevoluciones(tx *sql.Tx, desde, hasta time.Time, emitir func(asientoContable) error) error {
+	rows, err := tx.Query(`
+		SELECT r.compra_id, r.completado_en, i.tarifa::text, (i.base * 100)::bigint, (i.valor * 100)::bigint
+		FROM Reembolsos r
+		JOIN ImpuestosCompra i ON i.compra_id = r.compra_id
+		WHERE r.estado = 'completado' AND r.completado_en >= $1 AND r.completado_en < $2
+		ORDER BY r.completado_en, r.compra_id, i.tarifa DESC`, desde, hasta)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var compraID int
+		var fecha time.Time
+		var tarifa string
+		var base, iva int64
+		if err := rows.Scan(&compraID, &fecha, &tarifa, &base, &iva); err != nil {
+			return err
+		}
+		comprobante := fmt.Sprintf("R-%d", compraID)
+
+		lineas := []asientoContable{
+			{Cuenta: cuentaDevolucionesVentas, Descripcion: "Reembolso IVA " + tarifa + " %", Debito: base},
+		}
+		if iva > 0 {
+			lineas = append(lineas, asientoContable{Cuenta: cuentaIVAGenerado, Descripcion: "Reversión IVA " + tarifa + " %", Debito: iva})
+		}
+		lineas = append(lineas, asientoContable{Cuenta: cuentaCaja, Descripcion: "Reembolso IVA " + tarifa + " %", Credito: base + iva})
+		for _, linea := range lineas {
+			linea.Fecha, linea.Comprobante, linea.CompraID = fecha, comprobante, compraID
+			if err := emitir(linea); err != nil {
+				return err
+			}
+		}
+	}
+	return rows.Err()
+}
+
+func estadoErrorReembolso(err error) int {
+	switch err {
+	case errCompraNoEncontrada:
+		return http.StatusNotFound
+	case errCompraNoPagada, errCompraReembolsada, errReembolsoEnCurso:
+		return http.StatusConflict
+	case errCompraSinPrecios:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// Handler para POST /admin/compras/{id}/reembolsar {"motivo": "..."}
+func reembolsarCompraHandler(w http.ResponseWriter, r *http.Request, compraID int) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		Motivo string `json:"motivo"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+	}
+
+	reembolso, err := reembolsarCompra(compraID, strings.TrimSpace(solicitud.Motivo))
+	if err != nil {
+		estado := estadoErrorReembolso(err)
+		if estado == http.StatusInternalServerError {
+			http.Error(w, "Error al procesar el reembolso", estado)
+		} else {
+			http.Error(w, err.Error(), estado)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if reembolso.Estado == ReembolsoFallido {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(reembolso)
+}
+
+// Handler para /admin/compras/{id} y /admin/compras/{id}/{accion}
+func comprasAdminHandler(w http.ResponseWriter, r *http.Request) {
+	id, accion, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/compras"), "/"), "/")
+	compraID, err := strconv.Atoi(id)
+	if err != nil || compraID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch accion {
+	case "":
+		compraAdminHandler(w, r, compraID)
+	case "impuestos":
+		impuestosCompraHandler(w, r, compraID)
+	case "reembolsar":
+		reembolsarCompraHandler(w, r, compraID)
+	case "envio":
+		registrarEnvioHandler(w, r, compraID)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// Réplica de solo lectura (db.replica) para las consultas públicas: la
+// verificación de certificados y la lectura de productos, kits, cuidados y
+// ubicaciones. Las escrituras siempre van a la base principal. Si una
+// consulta falla en la réplica se repite en la principal y la réplica deja
+// de usarse durante pausaReplicaCaida.
+
+const pausaReplicaCaida = 30 * time.Second
+
+var (
+	poolReplica *sql.DB
+	// Momento en que la réplica falló por última vez
+	replicaCaidaEn time.Time
+	muReplica      sync.Mutex
+)
+
+// Pool de la réplica, o nil si no está configurada o está en pausa tras
+// un fallo
+func replicaDisponible() *sql.DB {
+	dsn := configActual().DB.Replica
+	if dsn == "" {
+		return nil
+	}
+
+	muReplica.Lock()
+	defer muReplica.Unlock()
+	if time.Since(replicaCaidaEn) < pausaReplicaCaida {
+		return nil
+	}
+	if poolReplica == nil {
+		// sql.Open no se conecta; los errores de conexión aparecen en la
+		// primera consulta
+		db, err := sql.Open(driverMedido, dsn)
+		if err != nil {
+			log.Println("Error al abrir la réplica de lectura:", err)
+			replicaCaidaEn = time.Now()
+			return nil
+		}
+		poolReplica = db
+	}
+	return poolReplica
+}
+
+// Cerrar el pool de la réplica para que el siguiente uso lo abra con la
+// cadena de conexión vigente
+func reabrirReplica() {
+	muReplica.Lock()
+	anterior := poolReplica
+	poolReplica = nil
+	replicaCaidaEn = time.Time{}
+	muReplica.Unlock()
+
+	if anterior != nil {
+		if err := cerrarPool(anterior); err != nil {
+			log.Println("Error al cerrar la réplica de lectura anterior:", err)
+		}
+	}
+}
+
+func marcarReplicaCaida(err error) {
+	muReplica.Lock()
+	defer muReplica.Unlock()
+	if time.Since(replicaCaidaEn) >= pausaReplicaCaida {
+		log.Printf("Réplica de lectura no disponible, se usa la base principal durante %v: %v", pausaReplicaCaida, err)
+	}
+	replicaCaidaEn = time.Now()
+}
+
+// Ejecutar una consulta de solo lectura en la réplica, o en la base
+// principal si no hay réplica o la consulta falla en ella
+func trazarLectura(ctx context.Context, nombre string, consulta func(db *sql.DB) error) error {
+	if replica := replicaDisponible(); replica != nil {
+		// Si la réplica falla se pasa directo a la principal
+		err := trazarConsultaSinReintento(ctx, nombre, func() error {
+			return consulta(replica)
+		})
+		if err == nil || err == sql.ErrNoRows || ctx.Err() != nil {
+			return err
+		}
+		marcarReplicaCaida(err)
+	}
+
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+	return trazarConsulta(ctx, nombre, func() error {
+		return consulta(db)
+	})
+}
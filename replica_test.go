@@ -0,0 +1,33 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// Al cambiar db.replica el pool anterior se cierra y el siguiente uso abre
+// uno nuevo con la cadena vigente
+func TestReabrirReplica(t *testing.T) {
+	anteriorConfig := config
+	defer func() { config = anteriorConfig }()
+	config.DB.Replica = "host=replica-nueva dbname=melenas"
+
+	anterior, err := sql.Open(driverMedido, "host=replica-anterior dbname=melenas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	muReplica.Lock()
+	poolReplica = anterior
+	muReplica.Unlock()
+
+	reabrirReplica()
+
+	if err := anterior.Ping(); err == nil || err.Error() != "sql: database is closed" {
+		t.Errorf("el pool anterior debería estar cerrado, Ping devolvió %v", err)
+	}
+	nuevo := replicaDisponible()
+	if nuevo == nil || nuevo == anterior {
+		t.Fatal("se esperaba un pool nuevo para la réplica")
+	}
+	reabrirReplica()
+}
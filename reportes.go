@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Reportes de ventas por email a los administradores. Cada frecuencia
+// configurada cubre el período anterior completo (la semana de lunes a
+// domingo o el mes calendario) y se envía una sola vez; el registro en
+// ReportesEnviados evita duplicados entre instancias.
+
+// Frecuencias de los reportes
+const (
+	ReporteSemanal = "semanal"
+	ReporteMensual = "mensual"
+)
+
+// Cada cuánto se revisa si hay reportes por enviar
+const intervaloReportes = time.Hour
+
+var errFrecuenciaInvalida = errors.New("La frecuencia debe ser semanal o mensual")
+
+//go:embed plantillas/email/reporte.html
+var htmlReporte string
+
+var plantillaReporte = template.Must(template.New("reporte").Funcs(template.FuncMap{
+	"porcentaje": func(tasa float64) string { return fmt.Sprintf("%.1f %%", tasa*100) },
+}).Parse(htmlReporte))
+
+// Datos del reporte
+type Reporte struct {
+	Frecuencia     string
+	Estadisticas   *Estadisticas
+	Verificaciones []VerificacionProducto
+}
+
+func frecuenciaValida(frecuencia string) bool {
+	return frecuencia == ReporteSemanal || frecuencia == ReporteMensual
+}
+
+// Período [desde, hasta) anterior al que contiene la fecha dada
+func periodoAnterior(frecuencia string, fecha time.Time) (time.Time, time.Time) {
+	fecha = fecha.In(zonaHoraria)
+	if frecuencia == ReporteMensual {
+		hasta := time.Date(fecha.Year(), fecha.Month(), 1, 0, 0, 0, 0, zonaHoraria)
+		return hasta.AddDate(0, -1, 0), hasta
+	}
+	dia := time.Date(fecha.Year(), fecha.Month(), fecha.Day(), 0, 0, 0, 0, zonaHoraria)
+	// El lunes es el primer día de la semana
+	hasta := dia.AddDate(0, 0, -(int(dia.Weekday())+6)%7)
+	return hasta.AddDate(0, 0, -7), hasta
+}
+
+// Generar el HTML del reporte del período
+func generarReporte(ctx context.Context, frecuencia string, desde, hasta time.Time) ([]byte, error) {
+	estadisticas, err := obtenerEstadisticas(ctx, desde, hasta)
+	if err != nil {
+		return nil, err
+	}
+	verificaciones, err := obtenerTasaVerificacion(ctx, desde, hasta)
+	if err != nil {
+		return nil, err
+	}
+
+	var html bytes.Buffer
+	err = plantillaReporte.Execute(&html, Reporte{
+		Frecuencia:     frecuencia,
+		Estadisticas:   estadisticas,
+		Verificaciones: verificaciones,
+	})
+	return html.Bytes(), err
+}
+
+// Enviar el reporte a todos los destinatarios configurados; devuelve a
+// cuántos se envió
+func enviarReporte(ctx context.Context, frecuencia string, desde, hasta time.Time) (int, error) {
+	destinatarios := configActual().Reportes.Destinatarios
+	if len(destinatarios) == 0 {
+		return 0, errors.New("no hay destinatarios configurados (reportes.destinatarios)")
+	}
+
+	html, err := generarReporte(ctx, frecuencia, desde, hasta)
+	if err != nil {
+		return 0, err
+	}
+
+	asunto := fmt.Sprintf("Reporte %s Melenas Co: %s al %s", frecuencia,
+		desde.Format(formatoFechaEstadisticas), hasta.AddDate(0, 0, -1).Format(formatoFechaEstadisticas))
+	enviados := 0
+	for _, destino := range destinatarios {
+		if err := enviarEmailHTML(destino, asunto, string(html)); err != nil {
+			return enviados, fmt.Errorf("Error al enviar el reporte a %s: %v", destino, err)
+		}
+		enviados++
+	}
+	return enviados, nil
+}
+
+// Reservar el envío de un período; false si otra instancia ya lo hizo
+func reservarReporte(db *sql.DB, frecuencia string, desde time.Time) (bool, error) {
+	resultado, err := db.Exec(`
+		INSERT INTO ReportesEnviados (frecuencia, desde) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, frecuencia, desde.Format(formatoFechaEstadisticas))
+	if err != nil {
+		return false, err
+	}
+	n, err := resultado.RowsAffected()
+	return n == 1, err
+}
+
+func liberarReporte(db *sql.DB, frecuencia string, desde time.Time) error {
+	_, err := db.Exec(`DELETE FROM ReportesEnviados WHERE frecuencia = $1 AND desde = $2`,
+		frecuencia, desde.Format(formatoFechaEstadisticas))
+	return err
+}
+
+// Goroutine que envía los reportes programados pendientes
+func despacharReportes() {
+	for range time.Tick(intervaloReportes) {
+		frecuencias := configActual().Reportes.Frecuencias
+		if len(frecuencias) == 0 || estadoActualMantenimiento().Modo == ModoMantenimiento {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Reportes: error al conectar a la base de datos:", err)
+			continue
+		}
+
+		for _, frecuencia := range frecuencias {
+			desde, hasta := periodoAnterior(frecuencia, time.Now())
+			reservado, err := reservarReporte(db, frecuencia, desde)
+			if err != nil {
+				log.Println("Reportes:", err)
+				continue
+			}
+			if !reservado {
+				continue
+			}
+
+			_, err = enviarReporte(context.Background(), frecuencia, desde, hasta)
+			if err != nil {
+				// Se reintenta en el próximo ciclo
+				log.Println("Reportes:", err)
+				if err := liberarReporte(db, frecuencia, desde); err != nil {
+					log.Println("Reportes:", err)
+				}
+			}
+		}
+	}
+}
+
+// Handler para POST /admin/reportes/enviar {"frecuencia": "semanal", "desde": "2024-05-06"}
+// que envía un reporte en el momento; sin desde se usa el período anterior
+func enviarReporteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		Frecuencia string `json:"frecuencia"`
+		Desde      string `json:"desde"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&solicitud)
+	if err != nil || !frecuenciaValida(solicitud.Frecuencia) {
+		http.Error(w, errFrecuenciaInvalida.Error(), http.StatusBadRequest)
+		return
+	}
+
+	referencia := time.Now()
+	if solicitud.Desde != "" {
+		desde, err := time.ParseInLocation(formatoFechaEstadisticas, solicitud.Desde, zonaHoraria)
+		if err != nil {
+			http.Error(w, "desde debe tener el formato AAAA-MM-DD", http.StatusBadRequest)
+			return
+		}
+		// El período que empieza en desde es el anterior al siguiente
+		if solicitud.Frecuencia == ReporteMensual {
+			referencia = desde.AddDate(0, 1, 0)
+		} else {
+			referencia = desde.AddDate(0, 0, 7)
+		}
+	}
+	desde, hasta := periodoAnterior(solicitud.Frecuencia, referencia)
+
+	enviados, err := enviarReporte(r.Context(), solicitud.Frecuencia, desde, hasta)
+	if err != nil {
+		http.Error(w, "Error al enviar el reporte", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"desde":    desde.Format(formatoFechaEstadisticas),
+		"hasta":    hasta.AddDate(0, 0, -1).Format(formatoFechaEstadisticas),
+		"enviados": enviados,
+	})
+}
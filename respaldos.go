@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Respaldos de la base con pg_dump en formato custom, guardados en el
+// almacenamiento del archivado (almacenamiento.go) bajo respaldos/. Cada
+// respaldo queda registrado en la tabla Respaldos, y `melenas backup verify`
+// lo restaura con pg_restore para comprobar que sirve. pg_restore recrea los
+// objetos en su esquema original, así que la restauración se hace en una
+// base temporal y no en un esquema aparte de la base de producción.
+
+const (
+	intervaloRespaldos = time.Hour
+	// Clave en ReportesEnviados para respaldar una sola vez por día
+	frecuenciaRespaldos = "respaldo"
+	// Tiempo tras el que un respaldo en curso se da por abandonado (la
+	// instancia que lo hacía se detuvo) y se permite iniciar otro
+	vigenciaRespaldoEnCurso = 2 * time.Hour
+)
+
+var (
+	errRespaldoEnCurso     = errors.New("Ya hay un respaldo en curso")
+	errRespaldoInexistente = errors.New("No hay un respaldo completado con ese id")
+)
+
+// Registro de un respaldo
+type Respaldo struct {
+	RespaldoID          int     `json:"respaldo_id"`
+	Estado              string  `json:"estado"`
+	Clave               *string `json:"clave,omitempty"`
+	Bytes               *int64  `json:"bytes,omitempty"`
+	SHA256              *string `json:"sha256,omitempty"`
+	Error               *string `json:"error,omitempty"`
+	IniciadoEn          Fecha   `json:"iniciado_en"`
+	TerminadoEn         *Fecha  `json:"terminado_en,omitempty"`
+	VerificadoEn        *Fecha  `json:"verificado_en,omitempty"`
+	Verificacion        *string `json:"verificacion,omitempty"`
+	VerificacionExitosa *bool   `json:"verificacion_exitosa,omitempty"`
+}
+
+// Tablas cuyas filas se cuentan en la base restaurada
+var tablasVerificacionRespaldo = []string{"MigracionesAplicadas", "Clientes", "Productos", "Compras", "Certificados"}
+
+// Cadena de conexión para pg_dump y pg_restore; la contraseña va en
+// PGPASSWORD para que no aparezca en la lista de procesos
+func cadenaHerramientasDB(dbname string) string {
+	cadena := fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable",
+		config.DB.Host, config.DB.Port, config.DB.User, dbname)
+	if strings.Contains(config.DB.Host, ",") {
+		cadena += " target_session_attrs=read-write"
+	}
+	return cadena
+}
+
+func herramientaDB(ruta, porDefecto string) string {
+	if ruta == "" {
+		return porDefecto
+	}
+	return ruta
+}
+
+// Ejecutar pg_dump o pg_restore; el error incluye lo que escribió en stderr
+func ejecutarHerramientaDB(ctx context.Context, salida *bytes.Buffer, programa string, args ...string) error {
+	cmd := exec.CommandContext(ctx, programa, args...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+config.DB.Password)
+	var errores bytes.Buffer
+	cmd.Stdout = salida
+	cmd.Stderr = &errores
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error al ejecutar %s: %v: %s", programa, err, strings.TrimSpace(errores.String()))
+	}
+	return nil
+}
+
+// Registrar un respaldo en curso; falla con errRespaldoEnCurso si otra
+// instancia ya está respaldando
+func registrarRespaldo(db *sql.DB) (int, error) {
+	var id int
+	err := db.QueryRow(`
+		INSERT INTO Respaldos (estado)
+		SELECT 'en_curso'
+		WHERE NOT EXISTS (
+			SELECT 1 FROM Respaldos
+			WHERE estado = 'en_curso' AND iniciado_en > now() - $1 * interval '1 second'
+		)
+		RETURNING respaldo_id`, int(vigenciaRespaldoEnCurso.Seconds())).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errRespaldoEnCurso
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error al registrar el respaldo: %v", err)
+	}
+	return id, nil
+}
+
+// Hacer el respaldo registrado con pg_dump, guardarlo y anotar el resultado
+func ejecutarRespaldo(ctx context.Context, db *sql.DB, id int) error {
+	var volcado bytes.Buffer
+	err := ejecutarHerramientaDB(ctx, &volcado, herramientaDB(configActual().Respaldos.PgDump, "pg_dump"),
+		"--format=custom", "--no-owner", "--no-privileges", "--dbname="+cadenaHerramientasDB(config.DB.DBName))
+
+	clave := fmt.Sprintf("%srespaldos/%s-%d.dump", prefijoArchivado(), time.Now().UTC().Format("20060102T150405Z"), id)
+	if err == nil {
+		err = guardarArchivo(ctx, clave, volcado.Bytes(), "application/octet-stream")
+	}
+	if err != nil {
+		if _, errActualizar := db.Exec(`
+			UPDATE Respaldos SET estado = 'fallido', error = $2, terminado_en = now()
+			WHERE respaldo_id = $1`, id, err.Error()); errActualizar != nil {
+			log.Println("Respaldo: error al registrar el fallo:", errActualizar)
+		}
+		return err
+	}
+
+	suma := sha256.Sum256(volcado.Bytes())
+	_, err = db.Exec(`
+		UPDATE Respaldos SET estado = 'completado', clave = $2, bytes = $3, sha256 = $4, terminado_en = now()
+		WHERE respaldo_id = $1`, id, clave, volcado.Len(), hex.EncodeToString(suma[:]))
+	if err != nil {
+		return fmt.Errorf("Error al registrar el respaldo: %v", err)
+	}
+	return nil
+}
+
+// Listar los respaldos más recientes
+func consultarRespaldos(db consultorFilas, limite int) ([]Respaldo, error) {
+	rows, err := db.Query(`
+		SELECT respaldo_id, estado, clave, bytes, sha256, error, iniciado_en, terminado_en,
+			verificado_en, verificacion, verificacion_exitosa
+		FROM Respaldos
+		ORDER BY respaldo_id DESC
+		LIMIT $1`, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	respaldos := []Respaldo{}
+	for rows.Next() {
+		var r Respaldo
+		err := rows.Scan(&r.RespaldoID, &r.Estado, &r.Clave, &r.Bytes, &r.SHA256, &r.Error, &r.IniciadoEn,
+			&r.TerminadoEn, &r.VerificadoEn, &r.Verificacion, &r.VerificacionExitosa)
+		if err != nil {
+			return nil, err
+		}
+		respaldos = append(respaldos, r)
+	}
+	return respaldos, rows.Err()
+}
+
+// Restaurar un respaldo completado (el último si id es 0) en una base
+// temporal, contar las filas de las tablas principales y anotar el
+// resultado. La base temporal se borra al terminar; el usuario de la base
+// necesita el permiso CREATEDB.
+func verificarRespaldo(ctx context.Context, db *sql.DB, id int) (string, error) {
+	var clave, suma string
+	err := db.QueryRow(`
+		SELECT respaldo_id, clave, sha256 FROM Respaldos
+		WHERE estado = 'completado' AND ($1 = 0 OR respaldo_id = $1)
+		ORDER BY respaldo_id DESC
+		LIMIT 1`, id).Scan(&id, &clave, &suma)
+	if err == sql.ErrNoRows {
+		return "", errRespaldoInexistente
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error al consultar el respaldo: %v", err)
+	}
+
+	resumen, err := restaurarRespaldo(ctx, db, id, clave, suma)
+	exitosa := err == nil
+	if err != nil {
+		resumen = err.Error()
+	}
+	if _, errActualizar := db.Exec(`
+		UPDATE Respaldos SET verificado_en = now(), verificacion = $2, verificacion_exitosa = $3
+		WHERE respaldo_id = $1`, id, resumen, exitosa); errActualizar != nil {
+		return resumen, fmt.Errorf("Error al registrar la verificación: %v", errActualizar)
+	}
+	return resumen, err
+}
+
+func restaurarRespaldo(ctx context.Context, db *sql.DB, id int, clave, suma string) (string, error) {
+	contenido, err := leerArchivo(ctx, clave)
+	if err != nil {
+		return "", fmt.Errorf("Error al leer el respaldo %s: %v", clave, err)
+	}
+	sumaLeida := sha256.Sum256(contenido)
+	if hex.EncodeToString(sumaLeida[:]) != suma {
+		return "", fmt.Errorf("El respaldo %s no coincide con su sha256", clave)
+	}
+
+	archivo, err := os.CreateTemp("", "melenas-respaldo-*.dump")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(archivo.Name())
+	_, err = archivo.Write(contenido)
+	if errCerrar := archivo.Close(); err == nil {
+		err = errCerrar
+	}
+	if err != nil {
+		return "", err
+	}
+
+	temporal := fmt.Sprintf("%s_verificacion_%d", config.DB.DBName, id)
+	if _, err := db.Exec(`DROP DATABASE IF EXISTS ` + pq.QuoteIdentifier(temporal)); err != nil {
+		return "", fmt.Errorf("Error al borrar la base temporal: %v", err)
+	}
+	if _, err := db.Exec(`CREATE DATABASE ` + pq.QuoteIdentifier(temporal)); err != nil {
+		return "", fmt.Errorf("Error al crear la base temporal: %v", err)
+	}
+	defer func() {
+		if _, err := db.Exec(`DROP DATABASE IF EXISTS ` + pq.QuoteIdentifier(temporal)); err != nil {
+			log.Println("Respaldo: error al borrar la base temporal:", err)
+		}
+	}()
+
+	err = ejecutarHerramientaDB(ctx, &bytes.Buffer{}, herramientaDB(configActual().Respaldos.PgRestore, "pg_restore"),
+		"--no-owner", "--no-privileges", "--exit-on-error", "--dbname="+cadenaHerramientasDB(temporal), archivo.Name())
+	if err != nil {
+		return "", err
+	}
+
+	restaurada, err := sql.Open(driverMedido, cadenaHerramientasDB(temporal)+" password="+config.DB.Password)
+	if err != nil {
+		return "", err
+	}
+	defer restaurada.Close()
+
+	var conteos []string
+	for _, tabla := range tablasVerificacionRespaldo {
+		var filas int
+		if err := restaurada.QueryRow(`SELECT count(*) FROM ` + tabla).Scan(&filas); err != nil {
+			return "", fmt.Errorf("Error al contar %s en la base restaurada: %v", tabla, err)
+		}
+		if tabla == "MigracionesAplicadas" && filas == 0 {
+			return "", fmt.Errorf("La base restaurada no tiene migraciones aplicadas")
+		}
+		conteos = append(conteos, fmt.Sprintf("%s: %d", tabla, filas))
+	}
+	return strings.Join(conteos, ", "), nil
+}
+
+// Goroutine que respalda una vez al día a partir de respaldos.hora si
+// respaldos.diario está activo. Se reserva en ReportesEnviados para que
+// solo lo haga una instancia.
+func despacharRespaldos() {
+	for range time.Tick(intervaloRespaldos) {
+		ajustes := configActual().Respaldos
+		if !ajustes.Diario {
+			continue
+		}
+		ahora := time.Now().In(zonaHoraria)
+		if ahora.Hour() < ajustes.Hora {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Respaldo: error al conectar a la base de datos:", err)
+			continue
+		}
+		hoy := time.Date(ahora.Year(), ahora.Month(), ahora.Day(), 0, 0, 0, 0, zonaHoraria)
+		reservado, err := reservarReporte(db, frecuenciaRespaldos, hoy)
+		if err != nil {
+			log.Println("Respaldo:", err)
+			continue
+		}
+		if !reservado {
+			continue
+		}
+
+		id, err := registrarRespaldo(db)
+		if err == nil {
+			err = ejecutarRespaldo(context.Background(), db, id)
+		}
+		if err != nil {
+			// Se reintenta en el próximo ciclo
+			log.Println("Respaldo:", err)
+			if err := liberarReporte(db, frecuenciaRespaldos, hoy); err != nil {
+				log.Println("Respaldo:", err)
+			}
+			continue
+		}
+		logInfo("Respaldo %d completado", id)
+	}
+}
+
+// GET /admin/respaldos lista los últimos respaldos; POST inicia uno y
+// responde 202 con su id sin esperar a que termine
+func respaldosHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		respaldos, err := obtenerRespaldos(r.Context())
+		if err != nil {
+			logSolicitud(r.Context(), err)
+			http.Error(w, "Error al consultar los respaldos", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(respaldos)
+	case "POST":
+		id, err := iniciarRespaldo(r.Context())
+		if errors.Is(err, errRespaldoEnCurso) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logSolicitud(r.Context(), err)
+			http.Error(w, "Error al iniciar el respaldo", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]int{"respaldo_id": id})
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Productos de ejemplo servidos por el Rocketfy simulado
+//
+//go:embed fixtures/rocketfy_productos.json
+var productosMockRocketfy []byte
+
+// Pedidos de ejemplo, servidos por páginas con el índice como cursor
+//
+//go:embed fixtures/rocketfy_pedidos.json
+var pedidosMockRocketfy []byte
+
+// Clientes de ejemplo, servidos igual que los pedidos
+//
+//go:embed fixtures/rocketfy_clientes.json
+var clientesMockRocketfy []byte
+
+// x-secret y x-api-key que el cliente envía al simulado
+const credencialMockRocketfy = "mock"
+
+// Iniciar un servidor local que imita la API de Rocketfy y apuntar el
+// cliente hacia él, para desarrollar sin credenciales reales
+func iniciarMockRocketfy() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rocketfy/api/v1/products", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") == "" {
+			http.Error(w, `{"message":"x-api-key requerido"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(productosMockRocketfy)
+	})
+
+	mux.HandleFunc("/rocketfy/api/v1/orders", paginarMockRocketfy(pedidosMockRocketfy))
+	mux.HandleFunc("/rocketfy/api/v1/customers", paginarMockRocketfy(clientesMockRocketfy))
+
+	go func() {
+		log.Println("Rocketfy simulado:", http.Serve(listener, mux))
+	}()
+
+	urlMockRocketfy = "http://" + listener.Addr().String() + "/rocketfy/api/v1"
+	log.Println("Usando Rocketfy simulado en", urlMockRocketfy)
+	return nil
+}
+
+// Handler que sirve una lista de ejemplo por páginas, con el índice del
+// primer registro como cursor
+func paginarMockRocketfy(lista []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") == "" {
+			http.Error(w, `{"message":"x-api-key requerido"}`, http.StatusUnauthorized)
+			return
+		}
+		var datos []json.RawMessage
+		if err := json.Unmarshal(lista, &datos); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inicio, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		limite, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limite <= 0 {
+			limite = 2
+		}
+		if inicio < 0 || inicio > len(datos) {
+			inicio = len(datos)
+		}
+		fin, siguiente := inicio+limite, ""
+		if fin < len(datos) {
+			siguiente = strconv.Itoa(fin)
+		} else {
+			fin = len(datos)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": datos[inicio:fin], "next_cursor": siguiente})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lectura por páginas de los recursos de Rocketfy que se copian a la base
+// (pedidos, clientes). Cada página se guarda en una transacción junto con
+// el cursor de la siguiente en CursoresSincronizacion, así una
+// sincronización interrumpida sigue donde quedó; la fila del cursor se
+// bloquea mientras tanto para que dos instancias no guarden la misma
+// página a la vez.
+
+// Registros por página
+const tamanoPaginaRocketfy = 100
+
+// Resultado de una sincronización; cada recurso usa los contadores que le
+// corresponden
+type ResumenRocketfy struct {
+	Recibidos    int `json:"recibidos"`
+	Nuevos       int `json:"nuevos"`
+	Actualizados int `json:"actualizados"`
+	// Clientes locales duplicados fusionados al vincularlos
+	Fusionados int `json:"fusionados"`
+	// Certificados emitidos para pedidos pagados
+	Certificados int `json:"certificados"`
+	// Registros que no se pudieron guardar y el motivo
+	Omitidos []string `json:"omitidos"`
+	// Pedidos omitidos que se pueden reintentar (SKU desconocido)
+	pendientes []pedidoPendiente
+}
+
+// Pedido omitido con el motivo
+type pedidoPendiente struct {
+	datos  map[string]interface{}
+	motivo string
+}
+
+// Página de un recurso paginado de Rocketfy (pedidos, clientes)
+type paginaRocketfy struct {
+	Datos []map[string]interface{} `json:"data"`
+	// Vacío en la última página
+	Siguiente string `json:"next_cursor"`
+}
+
+// Primer valor no vacío entre varias claves posibles de Rocketfy
+func textoRocketfy(datos map[string]interface{}, claves ...string) string {
+	for _, clave := range claves {
+		if valor, ok := datos[clave]; ok && valor != nil {
+			if texto := strings.TrimSpace(fmt.Sprint(valor)); texto != "" {
+				return texto
+			}
+		}
+	}
+	return ""
+}
+
+// Descargar una página de un recurso ("/orders", "/customers") desde el
+// cursor dado ("" para el inicio)
+func obtenerPaginaRocketfy(ctx context.Context, recurso, cursor string) (pagina paginaRocketfy, err error) {
+	ctx, s := iniciarSpan(ctx, "GET rocketfy "+recurso, spanCliente)
+	defer func() { s.finalizar(err) }()
+
+	parametros := url.Values{"limit": {strconv.Itoa(tamanoPaginaRocketfy)}}
+	if cursor != "" {
+		parametros.Set("cursor", cursor)
+	}
+	base, secreto, clave := destinoRocketfy()
+	req, err := http.NewRequestWithContext(ctx, "GET", base+recurso+"?"+parametros.Encode(), nil)
+	if err != nil {
+		return pagina, fmt.Errorf("Error al crear la solicitud: %v", err)
+	}
+	s.atributo("http.url", req.URL.String())
+	if traceparent := s.traceparent(); traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("x-secret", secreto)
+	req.Header.Set("x-api-key", clave)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := hacerSolicitudRocketfy(client, req, recurso)
+	if err != nil {
+		return pagina, err
+	}
+	defer resp.Body.Close()
+	s.atributo("http.status_code", resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return pagina, fmt.Errorf("Error al leer la respuesta: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return pagina, fmt.Errorf("Error en la solicitud, código de estado: %d", resp.StatusCode)
+	}
+
+	// Con UseNumber los identificadores numéricos no pasan a notación
+	// científica
+	decodificador := json.NewDecoder(bytes.NewReader(body))
+	decodificador.UseNumber()
+	if err := decodificador.Decode(&pagina); err != nil {
+		return pagina, fmt.Errorf("Error al deserializar la página: %v", err)
+	}
+	return pagina, nil
+}
+
+// Cursor guardado de un recurso; "" si nunca se sincronizó
+func leerCursorSincronizacion(db consultorFila, recurso string) (string, error) {
+	var cursor string
+	err := db.QueryRow(`SELECT cursor FROM CursoresSincronizacion WHERE recurso = $1`, recurso).Scan(&cursor)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return cursor, err
+}
+
+func guardarCursorSincronizacion(tx *sql.Tx, recurso, cursor string) error {
+	_, err := tx.Exec(`
+		INSERT INTO CursoresSincronizacion (recurso, cursor) VALUES ($1, $2)
+		ON CONFLICT (recurso) DO UPDATE SET cursor = EXCLUDED.cursor, actualizado_en = now()`, recurso, cursor)
+	return err
+}
+
+// Recorrer un recurso desde el último cursor (o desde el inicio) y guardar
+// cada página con guardar. recurso identifica el cursor y ruta es la de la
+// API ("/orders").
+func recorrerPaginasRocketfy(db *sql.DB, recurso, ruta string, desdeInicio bool,
+	guardar func(tx *sql.Tx, datos []map[string]interface{}, resumen *ResumenRocketfy) error) (ResumenRocketfy, error) {
+	resumen := ResumenRocketfy{Omitidos: []string{}}
+	cursor := ""
+	if !desdeInicio {
+		var err error
+		if cursor, err = leerCursorSincronizacion(db, recurso); err != nil {
+			return resumen, err
+		}
+	}
+
+	for {
+		pagina, err := obtenerPaginaRocketfy(context.Background(), ruta, cursor)
+		if err != nil {
+			return resumen, err
+		}
+
+		// Sin página siguiente se queda el cursor de esta, para releerla en
+		// la próxima sincronización con los registros nuevos
+		siguiente := pagina.Siguiente
+		if siguiente == "" {
+			siguiente = cursor
+		}
+		var parcial ResumenRocketfy
+		err = enTransaccion(db, func(tx *sql.Tx) error {
+			parcial = ResumenRocketfy{Omitidos: []string{}}
+			if err := bloquearCursorSincronizacion(tx, recurso); err != nil {
+				return err
+			}
+			if err := guardar(tx, pagina.Datos, &parcial); err != nil {
+				return err
+			}
+			return guardarCursorSincronizacion(tx, recurso, siguiente)
+		})
+		if err != nil {
+			return resumen, err
+		}
+		resumen.Recibidos += len(pagina.Datos)
+		resumen.Nuevos += parcial.Nuevos
+		resumen.Actualizados += parcial.Actualizados
+		resumen.Fusionados += parcial.Fusionados
+		resumen.Certificados += parcial.Certificados
+		resumen.Omitidos = append(resumen.Omitidos, parcial.Omitidos...)
+
+		if pagina.Siguiente == "" || pagina.Siguiente == cursor {
+			return resumen, nil
+		}
+		cursor = pagina.Siguiente
+	}
+}
+
+// Bloquear el cursor de un recurso hasta el fin de la transacción; otra
+// instancia que sincronice lo mismo espera a que termine la página
+func bloquearCursorSincronizacion(tx *sql.Tx, recurso string) error {
+	_, err := tx.Exec(`
+		INSERT INTO CursoresSincronizacion (recurso, cursor) VALUES ($1, '')
+		ON CONFLICT (recurso) DO NOTHING`, recurso)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`SELECT 1 FROM CursoresSincronizacion WHERE recurso = $1 FOR UPDATE`, recurso)
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Descarte de carga cuando el servidor se satura: si las solicitudes en
+// curso superan saturacion.max_solicitudes_en_curso o la espera media por
+// una conexión del pool de la base en el último segundo supera
+// saturacion.espera_db_ms, las rutas de baja prioridad (el listado de
+// productos, la búsqueda, los feeds) se rechazan con 503 y Retry-After. El
+// resto, en especial la verificación de certificados, se sigue atendiendo.
+// La espera del pool solo existe con db.max_conexiones.
+
+// Rutas de baja prioridad si saturacion.rutas_baja_prioridad queda vacía
+var rutasBajaPrioridadPorDefecto = []string{
+	"/obtener_productos",
+	"/productos",
+	"/buscar",
+	"/kits",
+	"/atributos",
+	"/img-proxy",
+	"/feeds/",
+	rutaSitemap,
+}
+
+// Cada cuánto se vuelve a medir la espera del pool
+const intervaloMuestraPoolDB = time.Second
+
+var (
+	solicitudesEnCurso     int64
+	solicitudesDescartadas uint64
+	muMuestraPoolDB        sync.Mutex
+	muestraPoolDB          time.Time
+	esperasPoolDB          int64
+	duracionEsperasPoolDB  time.Duration
+	esperaMediaPoolDB      time.Duration
+)
+
+func init() {
+	registrarMetricaCalculada("melenas_http_solicitudes_en_curso",
+		"Solicitudes que se están atendiendo", "gauge",
+		func() float64 { return float64(atomic.LoadInt64(&solicitudesEnCurso)) })
+	registrarMetricaCalculada("melenas_http_descartadas_total",
+		"Solicitudes de baja prioridad rechazadas con 503 por saturación", "counter",
+		func() float64 { return float64(atomic.LoadUint64(&solicitudesDescartadas)) })
+	registrarMetricaCalculada("melenas_db_espera_pool_segundos",
+		"Espera media por una conexión del pool de la base en el último segundo", "gauge",
+		func() float64 { return esperaPoolDB().Seconds() })
+}
+
+// Espera media por una conexión de las solicitudes que esperaron desde la
+// muestra anterior
+func esperaPoolDB() time.Duration {
+	muMuestraPoolDB.Lock()
+	defer muMuestraPoolDB.Unlock()
+	if time.Since(muestraPoolDB) < intervaloMuestraPoolDB {
+		return esperaMediaPoolDB
+	}
+
+	muPoolDB.Lock()
+	db := poolDB
+	muPoolDB.Unlock()
+	if db == nil {
+		return 0
+	}
+	estado := db.Stats()
+	esperaMediaPoolDB = 0
+	if esperas := estado.WaitCount - esperasPoolDB; esperas > 0 {
+		esperaMediaPoolDB = (estado.WaitDuration - duracionEsperasPoolDB) / time.Duration(esperas)
+	}
+	muestraPoolDB = time.Now()
+	esperasPoolDB, duracionEsperasPoolDB = estado.WaitCount, estado.WaitDuration
+	return esperaMediaPoolDB
+}
+
+func rutaBajaPrioridad(ruta string) bool {
+	rutas := configActual().Saturacion.RutasBajaPrioridad
+	if len(rutas) == 0 {
+		rutas = rutasBajaPrioridadPorDefecto
+	}
+	for _, prefijo := range rutas {
+		if strings.HasPrefix(ruta, prefijo) {
+			return true
+		}
+	}
+	return false
+}
+
+// Motivo por el que el servidor está saturado; "" si no lo está
+func motivoSaturacion(enCurso int64) string {
+	ajustes := configActual().Saturacion
+	if ajustes.MaxSolicitudesEnCurso > 0 && enCurso > int64(ajustes.MaxSolicitudesEnCurso) {
+		return "solicitudes en curso: " + strconv.FormatInt(enCurso, 10)
+	}
+	if ajustes.EsperaDBMs > 0 {
+		if espera := esperaPoolDB(); espera > time.Duration(ajustes.EsperaDBMs)*time.Millisecond {
+			return "espera del pool de la base: " + espera.String()
+		}
+	}
+	return ""
+}
+
+// Responder 503 con Retry-After
+func responderSaturado(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(configActual().Saturacion.ReintentarSegundos))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      traducir(idiomaSolicitud(r.Context()), "El servidor está saturado; vuelva a intentarlo en unos segundos"),
+		"request_id": idSolicitud(r.Context()),
+	})
+}
+
+// Middleware que cuenta las solicitudes en curso y rechaza las de baja
+// prioridad mientras el servidor esté saturado
+func descartarCarga(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enCurso := atomic.AddInt64(&solicitudesEnCurso, 1)
+		defer atomic.AddInt64(&solicitudesEnCurso, -1)
+
+		if rutaBajaPrioridad(r.URL.Path) {
+			if motivo := motivoSaturacion(enCurso); motivo != "" {
+				if atomic.AddUint64(&solicitudesDescartadas, 1)%100 == 1 {
+					// Uno de cada cien, para no llenar el log durante la saturación
+					log.Printf("Servidor saturado (%s), se descartan solicitudes de baja prioridad como %s", motivo, r.URL.Path)
+				}
+				responderSaturado(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
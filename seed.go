@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Catálogos para generar datos de prueba realistas
+var (
+	nombresSemilla    = []string{"Valentina", "Camila", "Mariana", "Daniela", "Sofía", "Isabella", "Laura", "Natalia", "Paula", "Andrea", "Juliana", "Carolina", "Luisa", "Manuela", "Sara"}
+	apellidosSemilla  = []string{"Rodríguez", "Gómez", "González", "Martínez", "García", "López", "Hernández", "Sánchez", "Ramírez", "Pérez", "Díaz", "Torres", "Vargas", "Moreno", "Castro"}
+	dominiosSemilla   = []string{"gmail.com", "hotmail.com", "outlook.com", "yahoo.com"}
+	tiposSemilla      = []string{"Liso", "Ondulado", "Rizado", "Afro"}
+	coloresSemilla    = []string{"Negro natural", "Castaño oscuro", "Castaño claro", "Rubio miel", "Rubio platino", "Borgoña"}
+	longitudesSemilla = []string{"30 cm", "40 cm", "50 cm", "60 cm", "70 cm"}
+	lineasSemilla     = []string{"Extensiones clip-in", "Peluca lace front", "Bundle", "Cierre 4x4", "Frontal 13x4"}
+	estadosSemilla    = []string{"pagado", "pagado", "pagado", "pendiente"}
+)
+
+// Opciones del comando seed
+type OpcionesSemilla struct {
+	Semilla   int64
+	Clientes  int
+	Productos int
+	Compras   int
+}
+
+// Resultado de la generación de datos
+type ResumenSemilla struct {
+	Productos    int
+	Clientes     int
+	Certificados int
+}
+
+// Verificar si la base de datos ya tiene certificados emitidos
+func baseConCertificados(db *sql.DB) (bool, error) {
+	var existe bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM Certificados)`).Scan(&existe)
+	return existe, err
+}
+
+// Generar productos, clientes, compras y certificados de prueba en una
+// transacción. La misma semilla produce siempre los mismos datos (salvo los
+// números de certificado, que son aleatorios).
+func sembrarDatos(db *sql.DB, opciones OpcionesSemilla) (ResumenSemilla, error) {
+	var resumen ResumenSemilla
+	aleatorio := rand.New(rand.NewSource(opciones.Semilla))
+	elegir := func(lista []string) string {
+		return lista[aleatorio.Intn(len(lista))]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return resumen, err
+	}
+	defer tx.Rollback()
+
+	var productos []int
+	for i := 0; i < opciones.Productos; i++ {
+		linea, tipo, color, longitud := elegir(lineasSemilla), elegir(tiposSemilla), elegir(coloresSemilla), elegir(longitudesSemilla)
+		nombre := fmt.Sprintf("%s %s %s %s", linea, strings.ToLower(tipo), strings.ToLower(color), longitud)
+		descripcion := fmt.Sprintf("%s de cabello 100%% humano, textura %s, color %s, largo %s.",
+			linea, strings.ToLower(tipo), strings.ToLower(color), longitud)
+
+		var id int
+		err := tx.QueryRow(`
+			INSERT INTO Productos (nombre, descripcion, tipo_cabello, color, longitud, imagen_url)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING producto_id`,
+			nombre, descripcion, tipo, color, longitud,
+			fmt.Sprintf("https://picsum.photos/seed/melenas-%d/600/600", i+1)).Scan(&id)
+		if err != nil {
+			return resumen, err
+		}
+		productos = append(productos, id)
+	}
+	resumen.Productos = len(productos)
+
+	type clienteSemilla struct{ nombre, apellido, email string }
+	var clientes []clienteSemilla
+	for i := 0; i < opciones.Clientes; i++ {
+		nombre, apellido := elegir(nombresSemilla), elegir(apellidosSemilla)
+		usuario := strings.NewReplacer("á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u").
+			Replace(strings.ToLower(nombre + "." + apellido))
+		cliente := clienteSemilla{
+			nombre:   nombre,
+			apellido: apellido,
+			email:    fmt.Sprintf("%s%d@%s", usuario, i+1, elegir(dominiosSemilla)),
+		}
+
+		_, err := insertarCliente(tx, cliente.nombre, cliente.apellido, cliente.email, "")
+		if err != nil {
+			return resumen, err
+		}
+		clientes = append(clientes, cliente)
+	}
+	resumen.Clientes = len(clientes)
+
+	if len(productos) == 0 || len(clientes) == 0 {
+		return resumen, tx.Commit()
+	}
+
+	// Compras distribuidas a lo largo de 2024
+	inicio := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < opciones.Compras; i++ {
+		cliente := clientes[aleatorio.Intn(len(clientes))]
+		venta := Venta{
+			Fila:        i + 1,
+			Nombre:      cliente.nombre,
+			Apellido:    cliente.apellido,
+			Email:       cliente.email,
+			ProductoID:  productos[aleatorio.Intn(len(productos))],
+			FechaCompra: inicio.AddDate(0, 0, aleatorio.Intn(365)).Format("2006-01-02"),
+			EstadoPago:  elegir(estadosSemilla),
+		}
+
+		_, _, err := emitirCertificadoVenta(tx, venta)
+		if err != nil {
+			return resumen, err
+		}
+		resumen.Certificados++
+	}
+
+	return resumen, tx.Commit()
+}
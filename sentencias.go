@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// Sentencias preparadas reutilizadas para las consultas más frecuentes
+// (verificación de certificados). Se preparan la primera vez que se usan y
+// database/sql las vuelve a preparar en cada conexión del pool que las
+// ejecute, así PostgreSQL no analiza y planifica la consulta en cada
+// solicitud. Las consultas siguen escritas a mano: sqlc no forma parte de
+// las herramientas de compilación del proyecto.
+//
+// Las sentencias quedan ligadas al pool que las preparó; un pool que se
+// cierra o se reemplaza debe pasar por cerrarPool para que sus sentencias
+// no se acumulen en el mapa.
+
+var (
+	muSentencias sync.Mutex
+	sentencias   = map[*sql.DB]map[string]*sql.Stmt{}
+)
+
+// Sentencia preparada para la consulta en el pool dado
+func sentenciaPreparada(db *sql.DB, consulta string) (*sql.Stmt, error) {
+	muSentencias.Lock()
+	defer muSentencias.Unlock()
+
+	porConsulta, ok := sentencias[db]
+	if !ok {
+		porConsulta = map[string]*sql.Stmt{}
+		sentencias[db] = porConsulta
+	}
+	if sentencia, ok := porConsulta[consulta]; ok {
+		return sentencia, nil
+	}
+
+	sentencia, err := db.Prepare(consulta)
+	if err != nil {
+		return nil, err
+	}
+	porConsulta[consulta] = sentencia
+	return sentencia, nil
+}
+
+// Cerrar las sentencias preparadas en el pool y después el pool
+func cerrarPool(db *sql.DB) error {
+	muSentencias.Lock()
+	for _, sentencia := range sentencias[db] {
+		sentencia.Close()
+	}
+	delete(sentencias, db)
+	muSentencias.Unlock()
+
+	return db.Close()
+}
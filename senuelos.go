@@ -0,0 +1,375 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificados señuelo: números con el formato de los reales que nunca se
+// venden. Se imprimen en etiquetas que solo llegan a canales vigilados; si
+// alguien verifica uno, el número se filtró. La consulta responde igual que
+// la de un certificado inexistente, pero se guarda con la IP, ubicación,
+// navegador y referer de quien la hizo, se publica el evento
+// certificado_senuelo_consultado y se avisa al equipo.
+//
+// Cada instancia guarda los números de los señuelos en memoria y los
+// recarga periódicamente; solo las consultas de un señuelo van a la base,
+// por una cola acotada, para que un barrido de números inexistentes no
+// abra una goroutine y una conexión por solicitud.
+
+const (
+	// Máximo de señuelos por solicitud
+	maximoSenuelosPorSolicitud = 100
+	// Cada cuánto se recargan los números de los señuelos
+	intervaloSenuelos = time.Minute
+	// Consultas de señuelos pendientes de guardar
+	capacidadColaSenuelos = 64
+)
+
+var (
+	muSenuelos sync.RWMutex
+	// Números de los señuelos; nil hasta la primera carga
+	numerosSenuelo map[string]bool
+
+	colaConsultasSenuelo = make(chan ConsultaSenuelo, capacidadColaSenuelos)
+)
+
+// Certificado señuelo con el resumen de sus consultas
+type CertificadoSenuelo struct {
+	NumeroCertificado string `json:"numero_certificado"`
+	Nota              string `json:"nota,omitempty"`
+	// Página pública de verificación, con publico.url_base configurado
+	URL            string `json:"url,omitempty"`
+	Consultas      int    `json:"consultas"`
+	UltimaConsulta *Fecha `json:"ultima_consulta,omitempty"`
+	CreadoEn       Fecha  `json:"creado_en"`
+}
+
+// Consulta de un certificado señuelo y quién la hizo
+type ConsultaSenuelo struct {
+	ID                int    `json:"id"`
+	NumeroCertificado string `json:"numero_certificado"`
+	Nota              string `json:"nota,omitempty"`
+	Canal             string `json:"canal"`
+	IP                string `json:"ip"`
+	Region            string `json:"region,omitempty"`
+	Ciudad            string `json:"ciudad,omitempty"`
+	UserAgent         string `json:"user_agent,omitempty"`
+	Referer           string `json:"referer,omitempty"`
+	Idioma            string `json:"idioma,omitempty"`
+	RequestID         string `json:"request_id,omitempty"`
+	CreadoEn          Fecha  `json:"creado_en"`
+}
+
+// URL pública de verificación de un número
+func urlPaginaCertificado(numeroCertificado string) string {
+	base := strings.TrimSuffix(configActual().Publico.URLBase, "/")
+	if base == "" {
+		return ""
+	}
+	return base + rutaPaginaCertificado(numeroCertificado)
+}
+
+// Tratar la consulta de un certificado inexistente: cuenta como fallo para
+// los bloqueos y, si el número es un señuelo, encola la consulta para
+// guardarla en segundo plano
+func certificadoNoEncontrado(r *http.Request, numeroCertificado, canal string) {
+	registrarFallo(r, FalloConsulta)
+	numeroCertificado = strings.TrimSpace(numeroCertificado)
+	if numeroCertificado == "" || escriturasBloqueadas() || !posibleSenuelo(numeroCertificado) {
+		return
+	}
+
+	consulta := ConsultaSenuelo{
+		NumeroCertificado: numeroCertificado,
+		Canal:             canal,
+		IP:                textoIPSolicitud(r),
+		UserAgent:         r.UserAgent(),
+		Referer:           r.Referer(),
+		Idioma:            r.Header.Get("Accept-Language"),
+		RequestID:         idSolicitud(r.Context()),
+	}
+	consulta.Region, consulta.Ciudad = ubicacionSolicitud(r, consulta.IP)
+	select {
+	case colaConsultasSenuelo <- consulta:
+	default:
+		log.Println("Cola de consultas de señuelos llena; se descarta la consulta de", numeroCertificado)
+	}
+}
+
+// Si el número puede ser un señuelo. Mientras no se cargó la lista se
+// revisa en la base.
+func posibleSenuelo(numeroCertificado string) bool {
+	muSenuelos.RLock()
+	defer muSenuelos.RUnlock()
+	return numerosSenuelo == nil || numerosSenuelo[numeroCertificado]
+}
+
+// Agregar a la lista en memoria los señuelos recién creados, sin esperar
+// a la próxima recarga
+func agregarNumerosSenuelo(senuelos []CertificadoSenuelo) {
+	muSenuelos.Lock()
+	defer muSenuelos.Unlock()
+	if numerosSenuelo == nil {
+		return
+	}
+	for _, s := range senuelos {
+		numerosSenuelo[s.NumeroCertificado] = true
+	}
+}
+
+func recargarNumerosSenuelo() {
+	numeros, err := obtenerNumerosSenuelo()
+	if err != nil {
+		log.Println("Error al cargar los certificados señuelo:", err)
+		return
+	}
+	conjunto := make(map[string]bool, len(numeros))
+	for _, numero := range numeros {
+		conjunto[numero] = true
+	}
+	muSenuelos.Lock()
+	numerosSenuelo = conjunto
+	muSenuelos.Unlock()
+}
+
+// Guardar una consulta encolada y avisar si era de un señuelo
+func atenderConsultaSenuelo(consulta ConsultaSenuelo) {
+	senuelo, err := registrarConsultaSenuelo(consulta)
+	if err != nil {
+		log.Println("Error al revisar los certificados señuelo:", err)
+		return
+	}
+	if senuelo == nil {
+		return
+	}
+	ubicacion := strings.Trim(senuelo.Ciudad+", "+senuelo.Region, ", ")
+	if ubicacion == "" {
+		ubicacion = "ubicación desconocida"
+	}
+	avisar(AvisoCertificadoSenuelo, fmt.Sprintf(
+		"Certificado señuelo %s verificado (%s) desde %s, %s; el número se filtró",
+		senuelo.NumeroCertificado, senuelo.Canal, senuelo.IP, ubicacion))
+}
+
+// Goroutine que recarga los señuelos y guarda sus consultas
+func despacharSenuelos() {
+	recargarNumerosSenuelo()
+	ticker := time.NewTicker(intervaloSenuelos)
+	defer ticker.Stop()
+	for {
+		select {
+		case consulta := <-colaConsultasSenuelo:
+			atenderConsultaSenuelo(consulta)
+		case <-ticker.C:
+			recargarNumerosSenuelo()
+		}
+	}
+}
+
+// Números de todos los señuelos
+func consultarNumerosSenuelo(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT numero_certificado FROM CertificadosSenuelo`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var numeros []string
+	for rows.Next() {
+		var numero string
+		if err := rows.Scan(&numero); err != nil {
+			return nil, err
+		}
+		numeros = append(numeros, numero)
+	}
+	return numeros, rows.Err()
+}
+
+// Crear señuelos con números que no existen como certificados
+func insertarCertificadosSenuelo(db *sql.DB, cantidad int, nota string) ([]CertificadoSenuelo, error) {
+	senuelos := []CertificadoSenuelo{}
+	err := enTransaccion(db, func(tx *sql.Tx) error {
+		for len(senuelos) < cantidad {
+			numero, err := generarNumeroCertificado()
+			if err != nil {
+				return err
+			}
+			s := CertificadoSenuelo{NumeroCertificado: numero, Nota: nota}
+			err = tx.QueryRow(`
+				INSERT INTO CertificadosSenuelo (numero_certificado, nota)
+				SELECT $1, NULLIF($2, '')
+				WHERE NOT EXISTS (SELECT 1 FROM Certificados WHERE numero_certificado = $1)
+				ON CONFLICT (numero_certificado) DO NOTHING
+				RETURNING creado_en`, numero, nota).Scan(&s.CreadoEn)
+			// Número repetido: se genera otro
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			s.URL = urlPaginaCertificado(numero)
+			senuelos = append(senuelos, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return senuelos, nil
+}
+
+// Señuelos con su número de consultas, los más recientes primero
+func consultarCertificadosSenuelo(db *sql.DB) ([]CertificadoSenuelo, error) {
+	rows, err := db.Query(`
+		SELECT s.numero_certificado, coalesce(s.nota, ''), count(c.consulta_id), max(c.creado_en), s.creado_en
+		FROM CertificadosSenuelo s
+		LEFT JOIN ConsultasSenuelo c ON c.numero_certificado = s.numero_certificado
+		GROUP BY s.numero_certificado
+		ORDER BY s.creado_en DESC, s.numero_certificado`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	senuelos := []CertificadoSenuelo{}
+	for rows.Next() {
+		var s CertificadoSenuelo
+		if err := rows.Scan(&s.NumeroCertificado, &s.Nota, &s.Consultas, &s.UltimaConsulta, &s.CreadoEn); err != nil {
+			return nil, err
+		}
+		s.URL = urlPaginaCertificado(s.NumeroCertificado)
+		senuelos = append(senuelos, s)
+	}
+	return senuelos, rows.Err()
+}
+
+// Guardar la consulta si el número es un señuelo, con su evento en el
+// outbox. Devuelve la consulta guardada o nil si no es un señuelo.
+func insertarConsultaSenuelo(db *sql.DB, consulta ConsultaSenuelo) (*ConsultaSenuelo, error) {
+	var guardada *ConsultaSenuelo
+	err := enTransaccion(db, func(tx *sql.Tx) error {
+		c := consulta
+		err := tx.QueryRow(`
+			INSERT INTO ConsultasSenuelo (numero_certificado, canal, ip, region, ciudad, user_agent, referer, idioma, request_id)
+			SELECT numero_certificado, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), $9
+			FROM CertificadosSenuelo
+			WHERE numero_certificado = $1
+			RETURNING consulta_id, creado_en, (SELECT coalesce(nota, '') FROM CertificadosSenuelo WHERE numero_certificado = $1)`,
+			c.NumeroCertificado, c.Canal, c.IP, c.Region, c.Ciudad, c.UserAgent, c.Referer, c.Idioma, c.RequestID).
+			Scan(&c.ID, &c.CreadoEn, &c.Nota)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		guardada = &c
+		return registrarEventoOutbox(tx, EventoCertificadoSenuelo, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return guardada, nil
+}
+
+// Últimas consultas de señuelos, de uno solo si se indica el número
+func consultarConsultasSenuelo(db *sql.DB, numeroCertificado string, limite int) ([]ConsultaSenuelo, error) {
+	rows, err := db.Query(`
+		SELECT c.consulta_id, c.numero_certificado, coalesce(s.nota, ''), c.canal, c.ip, c.region, c.ciudad,
+			coalesce(c.user_agent, ''), coalesce(c.referer, ''), coalesce(c.idioma, ''), c.request_id, c.creado_en
+		FROM ConsultasSenuelo c
+		JOIN CertificadosSenuelo s ON s.numero_certificado = c.numero_certificado
+		WHERE $1 = '' OR c.numero_certificado = $1
+		ORDER BY c.creado_en DESC, c.consulta_id DESC
+		LIMIT $2`, numeroCertificado, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consultas := []ConsultaSenuelo{}
+	for rows.Next() {
+		var c ConsultaSenuelo
+		err := rows.Scan(&c.ID, &c.NumeroCertificado, &c.Nota, &c.Canal, &c.IP, &c.Region, &c.Ciudad,
+			&c.UserAgent, &c.Referer, &c.Idioma, &c.RequestID, &c.CreadoEn)
+		if err != nil {
+			return nil, err
+		}
+		consultas = append(consultas, c)
+	}
+	return consultas, rows.Err()
+}
+
+// Handler para GET y POST /admin/senuelos (listar o crear señuelos, con
+// {"cantidad": n, "nota": "..."}) y GET /admin/senuelos/consultas
+// (?numero= filtra por señuelo)
+func senuelosHandler(w http.ResponseWriter, r *http.Request) {
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/senuelos"), "/")
+	if ruta == "consultas" {
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		consultas, err := obtenerConsultasSenuelo(r.Context(), strings.TrimSpace(r.URL.Query().Get("numero")))
+		if err != nil {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(consultas)
+		return
+	}
+	if ruta != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		senuelos, err := obtenerCertificadosSenuelo(r.Context())
+		if err != nil {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(senuelos)
+	case "POST":
+		var solicitud struct {
+			Cantidad int    `json:"cantidad"`
+			Nota     string `json:"nota"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+		if solicitud.Cantidad == 0 {
+			solicitud.Cantidad = 1
+		}
+		if solicitud.Cantidad < 0 || solicitud.Cantidad > maximoSenuelosPorSolicitud {
+			http.Error(w, fmt.Sprintf("cantidad debe estar entre 1 y %d", maximoSenuelosPorSolicitud), http.StatusBadRequest)
+			return
+		}
+
+		senuelos, err := crearCertificadosSenuelo(r.Context(), solicitud.Cantidad, strings.TrimSpace(solicitud.Nota))
+		if err != nil {
+			http.Error(w, "Error al crear los señuelos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(senuelos)
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
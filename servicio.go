@@ -0,0 +1,1530 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capa de servicio compartida por los handlers REST y GraphQL.
+// Todas las funciones usan el pool de conexiones compartido del servidor;
+// las lecturas públicas usan la réplica si está configurada (replica.go).
+
+var (
+	poolDB   *sql.DB
+	muPoolDB sync.Mutex
+)
+
+// Pool de conexiones compartido; se crea en el primer uso y se reintenta
+// en la siguiente llamada si la base de datos no está disponible
+func poolBaseDatos() (*sql.DB, error) {
+	muPoolDB.Lock()
+	defer muPoolDB.Unlock()
+
+	if poolDB == nil {
+		db, err := conectarDB()
+		if err != nil {
+			return nil, err
+		}
+		poolDB = db
+	}
+	return poolDB, nil
+}
+
+// Obtener un certificado completo por su número
+func obtenerCertificado(ctx context.Context, numeroCertificado string) (*CertificateData, error) {
+	var data *CertificateData
+	err := trazarLectura(ctx, "consultarCertificado", func(db *sql.DB) error {
+		var err error
+		data, err = consultarCertificado(db, numeroCertificado, incluirEliminados(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if idioma := idiomaSolicitud(ctx); idioma != IdiomaEspanol {
+		err = trazarLectura(ctx, "consultarTraducciones", func(db *sql.DB) error {
+			return traducirCertificado(db, data, idioma)
+		})
+	}
+	return data, err
+}
+
+// Agregar a un certificado los registros relacionados pedidos con
+// ?expand=; el envío solo lo ven los administradores
+func expandirCertificado(ctx context.Context, data *CertificateData, expandir expansiones, admin bool) error {
+	if expandir.ninguna() {
+		return nil
+	}
+	if expandir.envio && !admin {
+		return errExpansionNoAdmin
+	}
+	return trazarLectura(ctx, "expandirCertificado", func(db *sql.DB) error {
+		if expandir.cliente || expandir.envio {
+			// El certificado ya se filtró por borrado lógico
+			compra, err := consultarCompra(db, data.compraID, true,
+				expansiones{cliente: expandir.cliente, envio: expandir.envio}, admin)
+			if err != nil {
+				return err
+			}
+			data.Cliente, data.Envio = compra.Cliente, compra.Envio
+		}
+		if expandir.producto {
+			ids := make([]int, len(data.Productos))
+			for i, producto := range data.Productos {
+				ids[i] = producto.ProductoID
+			}
+			productos, err := consultarProductosRelacionados(db, ids)
+			if err != nil {
+				return err
+			}
+			for i := range data.Productos {
+				data.Productos[i].Producto = productos[data.Productos[i].ProductoID]
+			}
+		}
+		return nil
+	})
+}
+
+// Compra con sus líneas y los registros relacionados pedidos con ?expand=
+func obtenerCompra(ctx context.Context, compraID int, expandir expansiones, admin bool) (*CompraDetalle, error) {
+	var compra *CompraDetalle
+	err := trazarLectura(ctx, "consultarCompra", func(db *sql.DB) error {
+		var err error
+		compra, err = consultarCompra(db, compraID, incluirEliminados(ctx), expandir, admin)
+		return err
+	})
+	return compra, err
+}
+
+// Buscar productos y, si se solicita, certificados por nombre de cliente.
+// Los resultados se devuelven ordenados por relevancia.
+func buscar(ctx context.Context, consulta string, incluirCertificados bool) ([]ResultadoBusqueda, error) {
+	var resultados []ResultadoBusqueda
+	err := trazarLectura(ctx, "buscarProductos", func(db *sql.DB) error {
+		var err error
+		resultados, err = buscarProductos(db, consulta, incluirEliminados(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if incluirCertificados {
+		var certificados []ResultadoBusqueda
+		err = trazarLectura(ctx, "buscarCertificados", func(db *sql.DB) error {
+			var err error
+			certificados, err = buscarCertificados(db, consulta, incluirEliminados(ctx))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		resultados = append(resultados, certificados...)
+	}
+
+	sort.SliceStable(resultados, func(i, j int) bool {
+		return resultados[i].Relevancia > resultados[j].Relevancia
+	})
+
+	return resultados, nil
+}
+
+// Emitir el certificado de una compra existente
+func emitirCertificado(compraID int) (string, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return "", err
+	}
+
+	return insertarCertificado(db, compraID)
+}
+
+// Revocar un certificado emitido
+func revocarCertificado(numeroCertificado, motivo string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return marcarCertificadoRevocado(db, numeroCertificado, motivo)
+}
+
+// Reemitir un certificado con una nueva versión; devuelve el número nuevo
+func reemitirCertificado(ctx context.Context, numeroCertificado, nombre, apellido, motivo string) (string, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return "", err
+	}
+
+	var numero string
+	err = trazarConsultaSinReintento(ctx, "reemitirCertificado", func() error {
+		return enTransaccion(db, func(tx *sql.Tx) error {
+			numero, err = reemitirCertificadoTx(tx, numeroCertificado, nombre, apellido, motivo)
+			return err
+		})
+	})
+	return numero, err
+}
+
+// Historial de versiones de un certificado
+func obtenerVersionesCertificado(ctx context.Context, numeroCertificado string) ([]VersionCertificado, error) {
+	var versiones []VersionCertificado
+	err := trazarLectura(ctx, "consultarVersionesCertificado", func(db *sql.DB) error {
+		var err error
+		versiones, err = consultarVersionesCertificado(db, numeroCertificado)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, errCertificadoInexistente
+	}
+	return versiones, err
+}
+
+// Escrituras registradas de la etiqueta NFC de un certificado
+func obtenerEtiquetaNFC(ctx context.Context, numeroCertificado string) (EtiquetaNFC, error) {
+	var etiqueta EtiquetaNFC
+	err := trazarLectura(ctx, "consultarEtiquetaNFC", func(db *sql.DB) error {
+		var err error
+		etiqueta, err = consultarEtiquetaNFC(db, numeroCertificado)
+		return err
+	})
+	return etiqueta, err
+}
+
+// Registrar la escritura de una etiqueta NFC. Sin reintentos para no
+// contar dos veces la misma escritura.
+func registrarEscrituraNFC(ctx context.Context, numeroCertificado string, bloqueada bool) (EtiquetaNFC, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return EtiquetaNFC{}, err
+	}
+
+	var etiqueta EtiquetaNFC
+	err = trazarConsultaSinReintento(ctx, "insertarEscrituraNFC", func() error {
+		etiqueta, err = insertarEscrituraNFC(db, numeroCertificado, bloqueada)
+		return err
+	})
+	return etiqueta, err
+}
+
+// Historial de eventos de un certificado
+func obtenerHistorialCertificado(ctx context.Context, numeroCertificado string) ([]EventoHistorialCertificado, error) {
+	var historial []EventoHistorialCertificado
+	err := trazarLectura(ctx, "consultarHistorialCertificado", func(db *sql.DB) error {
+		var err error
+		historial, err = consultarHistorialCertificado(db, numeroCertificado)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, errCertificadoInexistente
+	}
+	return historial, err
+}
+
+// Plantilla de la página de un certificado; si la asignada al producto no
+// existe o es inválida se usa la plantilla por defecto
+func plantillaDeCertificado(ctx context.Context, nombre string) (*template.Template, error) {
+	if nombre == "" {
+		nombre = plantillaPorDefecto
+	}
+
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var html string
+	err = trazarConsulta(ctx, "consultarPlantilla", func() error {
+		var err error
+		html, err = consultarPlantilla(db, nombre)
+		return err
+	})
+	if err == nil {
+		plantilla, errParseo := parsearPlantilla(nombre, html)
+		if errParseo == nil {
+			return plantilla, nil
+		}
+		err = errParseo
+	}
+	if nombre == plantillaPorDefecto {
+		return nil, err
+	}
+
+	logSolicitud(ctx, "Plantilla", nombre, "no disponible, se usa la plantilla por defecto:", err)
+	return plantillaDeCertificado(ctx, plantillaPorDefecto)
+}
+
+// Leer el HTML de una plantilla
+func obtenerPlantilla(nombre string) (string, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return "", err
+	}
+
+	return consultarPlantilla(db, nombre)
+}
+
+// Guardar el HTML de una plantilla
+func actualizarPlantilla(nombre, html string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return guardarPlantilla(db, nombre, html)
+}
+
+// Asignar una plantilla a productos
+func asignarPlantilla(nombre string, productoIDs []int) (int64, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return 0, err
+	}
+
+	return asignarPlantillaProductos(db, nombre, productoIDs)
+}
+
+// Guía de cuidado de un producto
+func obtenerCuidado(ctx context.Context, productoID int) (*Cuidado, error) {
+	var cuidado *Cuidado
+	err := trazarLectura(ctx, "consultarCuidado", func(db *sql.DB) error {
+		var err error
+		cuidado, err = consultarCuidado(db, productoID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if idioma := idiomaSolicitud(ctx); idioma != IdiomaEspanol {
+		err = trazarLectura(ctx, "consultarTraducciones", func(db *sql.DB) error {
+			return traducirCuidado(db, cuidado, idioma)
+		})
+	}
+	return cuidado, err
+}
+
+// Crear o reemplazar la guía de cuidado de un producto
+func actualizarCuidado(cuidado Cuidado) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return guardarCuidado(db, cuidado)
+}
+
+// Franjas libres para citas de instalación
+func obtenerFranjasLibres(ctx context.Context, desde, hasta time.Time) ([]Franja, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var franjas []Franja
+	err = trazarConsulta(ctx, "consultarFranjasLibres", func() error {
+		var err error
+		franjas, err = consultarFranjasLibres(db, desde, hasta)
+		return err
+	})
+	return franjas, err
+}
+
+// Reservar una cita para el titular de un certificado vigente; el email
+// debe coincidir con el del cliente del certificado
+func agendarCita(ctx context.Context, franjaID int64, numeroCertificado, email, notas string) (*Cita, error) {
+	data, err := obtenerCertificado(ctx, numeroCertificado)
+	if err != nil {
+		return nil, err
+	}
+	if data.Revocado {
+		return nil, errCertificadoYaRevocado
+	}
+	if data.EmailCliente == nil || !strings.EqualFold(strings.TrimSpace(email), *data.EmailCliente) {
+		return nil, errEmailNoCoincide
+	}
+
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	return reservarFranja(db, franjaID, data.NumeroCertificado, notas)
+}
+
+// Registrar una estilista
+func registrarEstilista(nombre, email string) (int, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return 0, err
+	}
+
+	return insertarEstilista(db, nombre, email)
+}
+
+// Publicar franjas de disponibilidad de una estilista
+func publicarFranjas(estilistaID int, inicio, fin time.Time, duracion time.Duration) (int, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return 0, err
+	}
+
+	return insertarFranjas(db, estilistaID, inicio, fin, duracion)
+}
+
+// Emitir la factura electrónica de una compra y enviarla al proveedor. Si
+// el envío falla la factura queda pendiente y se devuelve igualmente.
+func facturarCompra(compraID int) (*Factura, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	factura, err := insertarFactura(db, compraID)
+	if err != nil || configActual().Facturacion.URLProveedor == "" {
+		return factura, err
+	}
+
+	enviada, err := transmitirFactura(db, factura.FacturaID)
+	if err != nil {
+		log.Println("Error al enviar la factura", factura.Numero+":", err)
+		factura.Mensaje = err.Error()
+		return factura, nil
+	}
+	return enviada, nil
+}
+
+// Reintentar el envío de una factura al proveedor
+func reenviarFactura(facturaID int) (*Factura, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	return transmitirFactura(db, facturaID)
+}
+
+func obtenerFactura(ctx context.Context, facturaID int) (*Factura, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var factura *Factura
+	err = trazarConsulta(ctx, "consultarFactura", func() error {
+		var err error
+		factura, err = consultarFactura(db, facturaID)
+		return err
+	})
+	return factura, err
+}
+
+// XML o PDF de una factura
+func obtenerDocumentoFactura(ctx context.Context, facturaID int, formato string) ([]byte, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var contenido []byte
+	err = trazarConsulta(ctx, "consultarDocumentoFactura", func() error {
+		var err error
+		contenido, err = consultarDocumentoFactura(db, facturaID, formato)
+		return err
+	})
+	return contenido, err
+}
+
+// Desglose de IVA guardado de una compra
+func obtenerImpuestosCompra(ctx context.Context, compraID int) ([]ImpuestoCompra, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var impuestos []ImpuestoCompra
+	err = trazarConsulta(ctx, "consultarImpuestosCompra", func() error {
+		var err error
+		impuestos, err = consultarImpuestosCompra(db, compraID)
+		return err
+	})
+	return impuestos, err
+}
+
+// Liquidar el IVA de las líneas pendientes de una compra
+func liquidarImpuestos(compraID int) ([]ImpuestoCompra, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	return liquidarImpuestosCompra(db, compraID)
+}
+
+// Escribir el libro contable del período [desde, hasta) en CSV
+func exportarContabilidad(desde, hasta time.Time, w io.Writer) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return escribirLibroContable(db, desde, hasta, w)
+}
+
+// Reembolsar una compra pagada. Si el proveedor rechaza el reembolso se
+// devuelve en estado fallido para reintentarlo.
+func reembolsarCompra(compraID int, motivo string) (*Reembolso, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	reembolso, err := registrarReembolso(db, compraID, motivo)
+	if err != nil {
+		return nil, err
+	}
+	return reembolso, procesarReembolso(db, reembolso)
+}
+
+// Estadísticas de ventas del rango [desde, hasta)
+func obtenerEstadisticas(ctx context.Context, desde, hasta time.Time) (*Estadisticas, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var estadisticas *Estadisticas
+	err = trazarConsulta(ctx, "consultarEstadisticas", func() error {
+		var err error
+		estadisticas, err = consultarEstadisticas(db, desde, hasta)
+		return err
+	})
+	return estadisticas, err
+}
+
+// Contar una verificación pública de un certificado
+func registrarVerificacion(numeroCertificado, canal string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return incrementarVerificacion(db, numeroCertificado, canal)
+}
+
+// Registrar un escaneo; devuelve la alerta si el escaneo abrió una
+func registrarEscaneo(escaneo Escaneo) (*AlertaEscaneo, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	return insertarEscaneo(db, escaneo)
+}
+
+// Alertas de escaneos anómalos, solo las abiertas salvo que se pidan todas
+func obtenerAlertasEscaneo(ctx context.Context, todas bool) ([]AlertaEscaneo, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var alertas []AlertaEscaneo
+	err = trazarConsulta(ctx, "consultarAlertasEscaneo", func() error {
+		var err error
+		alertas, err = consultarAlertasEscaneo(db, todas, 100)
+		return err
+	})
+	return alertas, err
+}
+
+// Escaneos del rango agrupados por país y ciudad
+func obtenerEscaneosPorUbicacion(ctx context.Context, desde, hasta time.Time) ([]EscaneosUbicacion, error) {
+	var ubicaciones []EscaneosUbicacion
+	err := trazarLectura(ctx, "consultarEscaneosPorUbicacion", func(db *sql.DB) error {
+		var err error
+		ubicaciones, err = consultarEscaneosPorUbicacion(db, desde, hasta)
+		return err
+	})
+	return ubicaciones, err
+}
+
+// Marcar como resuelta una alerta de escaneos
+func cerrarAlertaEscaneo(ctx context.Context, alertaID int) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsulta(ctx, "resolverAlertaEscaneo", func() error {
+		return resolverAlertaEscaneo(db, alertaID)
+	})
+}
+
+// Registrar la consulta de un número inexistente si es un señuelo;
+// devuelve la consulta guardada o nil
+func registrarConsultaSenuelo(consulta ConsultaSenuelo) (*ConsultaSenuelo, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	return insertarConsultaSenuelo(db, consulta)
+}
+
+// Crear certificados señuelo
+func crearCertificadosSenuelo(ctx context.Context, cantidad int, nota string) ([]CertificadoSenuelo, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var senuelos []CertificadoSenuelo
+	err = trazarConsultaSinReintento(ctx, "insertarCertificadosSenuelo", func() error {
+		var err error
+		senuelos, err = insertarCertificadosSenuelo(db, cantidad, nota)
+		return err
+	})
+	if err == nil {
+		agregarNumerosSenuelo(senuelos)
+	}
+	return senuelos, err
+}
+
+// Números de los certificados señuelo para la lista en memoria
+func obtenerNumerosSenuelo() ([]string, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var numeros []string
+	err = trazarConsulta(context.Background(), "consultarNumerosSenuelo", func() error {
+		var err error
+		numeros, err = consultarNumerosSenuelo(db)
+		return err
+	})
+	return numeros, err
+}
+
+// Certificados señuelo con el resumen de sus consultas
+func obtenerCertificadosSenuelo(ctx context.Context) ([]CertificadoSenuelo, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var senuelos []CertificadoSenuelo
+	err = trazarConsulta(ctx, "consultarCertificadosSenuelo", func() error {
+		var err error
+		senuelos, err = consultarCertificadosSenuelo(db)
+		return err
+	})
+	return senuelos, err
+}
+
+// Últimas consultas de señuelos, de uno solo si se indica el número
+func obtenerConsultasSenuelo(ctx context.Context, numeroCertificado string) ([]ConsultaSenuelo, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var consultas []ConsultaSenuelo
+	err = trazarConsulta(ctx, "consultarConsultasSenuelo", func() error {
+		var err error
+		consultas, err = consultarConsultasSenuelo(db, numeroCertificado, 200)
+		return err
+	})
+	return consultas, err
+}
+
+// Tasa de verificación por producto de los certificados emitidos en el rango
+func obtenerTasaVerificacion(ctx context.Context, desde, hasta time.Time) ([]VerificacionProducto, error) {
+	var productos []VerificacionProducto
+	err := trazarLectura(ctx, "consultarTasaVerificacion", func(db *sql.DB) error {
+		var err error
+		productos, err = consultarTasaVerificacion(db, desde, hasta)
+		return err
+	})
+	return productos, err
+}
+
+// Resolver un enlace corto contando el clic
+func seguirEnlaceCorto(ctx context.Context, codigo string) (string, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return "", err
+	}
+
+	var destino string
+	err = trazarConsultaSinReintento(ctx, "registrarClicEnlace", func() error {
+		var err error
+		destino, err = registrarClicEnlace(db, codigo)
+		return err
+	})
+	return destino, err
+}
+
+// Exportar todos los datos guardados de un cliente
+func exportarDatosCliente(ctx context.Context, clienteID int) (*DatosCliente, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var datos *DatosCliente
+	err = trazarConsulta(ctx, "consultarDatosCliente", func() error {
+		var err error
+		datos, err = consultarDatosCliente(db, clienteID)
+		return err
+	})
+	return datos, err
+}
+
+// Anonimizar un cliente conservando sus compras y certificados
+func anonimizarCliente(clienteID int) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return borrarDatosCliente(db, clienteID)
+}
+
+// Guardar el teléfono normalizado de un cliente
+func actualizarTelefonoCliente(clienteID int, telefono string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return guardarTelefonoCliente(db, clienteID, telefono)
+}
+
+// Pares de clientes que probablemente son la misma persona
+func obtenerDuplicadosClientes(ctx context.Context) ([]ParDuplicado, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var clientes []ClienteDuplicado
+	err = trazarConsulta(ctx, "consultarClientesDuplicables", func() error {
+		var err error
+		clientes, err = consultarClientesDuplicables(db)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buscarDuplicados(clientes), nil
+}
+
+// Fusionar clientes duplicados en el que se conserva
+func fusionarDuplicados(ctx context.Context, conservar int, duplicados []int, motivo string) (*ResultadoFusion, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	return fusionarClientes(db, conservar, duplicados, motivo, idSolicitud(ctx))
+}
+
+// Consentimientos vigentes de un cliente
+func obtenerConsentimientos(ctx context.Context, clienteID int) ([]Consentimiento, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var consentimientos []Consentimiento
+	err = trazarConsulta(ctx, "consultarConsentimientos", func() error {
+		var err error
+		consentimientos, err = consultarConsentimientos(db, clienteID)
+		return err
+	})
+	return consentimientos, err
+}
+
+// Registrar cambios en los consentimientos de un cliente
+func actualizarConsentimientos(clienteID int, cambios map[string]bool, fuente string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return guardarConsentimientos(db, clienteID, cambios, fuente)
+}
+
+// Departamentos del catálogo DANE
+func obtenerDepartamentos(ctx context.Context) ([]Departamento, error) {
+	var departamentos []Departamento
+	err := trazarLectura(ctx, "consultarDepartamentos", func(db *sql.DB) error {
+		var err error
+		departamentos, err = consultarDepartamentos(db)
+		return err
+	})
+	return departamentos, err
+}
+
+// Municipios de un departamento del catálogo DANE
+func obtenerCiudades(ctx context.Context, departamento string) ([]Ciudad, error) {
+	var ciudades []Ciudad
+	err := trazarLectura(ctx, "consultarCiudades", func(db *sql.DB) error {
+		var err error
+		ciudades, err = consultarCiudades(db, departamento)
+		return err
+	})
+	return ciudades, err
+}
+
+// Productos de la copia local modificados después de una fecha
+func obtenerProductosModificados(ctx context.Context, desde time.Time) (*RespuestaProductos, error) {
+	var respuesta *RespuestaProductos
+	err := trazarLectura(ctx, "consultarProductosSincronizados", func(db *sql.DB) error {
+		var err error
+		respuesta, err = consultarProductosSincronizados(db, desde)
+		return err
+	})
+	return respuesta, err
+}
+
+// Registrar la guía de envío de una compra
+func registrarGuia(compraID int, transportadora, guia string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return guardarEnvio(db, compraID, transportadora, guia)
+}
+
+// Envío de una compra; quien no es administrador debe indicar el email del
+// cliente de la compra
+func obtenerEnvio(ctx context.Context, compraID int, email string, admin bool) (*Envio, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var envio *Envio
+	err = trazarConsulta(ctx, "consultarEnvio", func() error {
+		if !admin {
+			coincide, err := emailDeCompra(db, compraID, email)
+			if err != nil {
+				return err
+			}
+			if !coincide {
+				return errEnvioInexistente
+			}
+		}
+		var err error
+		envio, err = consultarEnvio(db, compraID)
+		return err
+	})
+	return envio, err
+}
+
+// Cotizar el envío de unos productos a una ciudad, indicada por su código
+// DANE o por el nombre; devuelve el nombre de la ciudad cotizada
+func obtenerCotizacionEnvio(codigoCiudad, ciudad string, paquetes []PaqueteCotizacion) (string, []CotizacionEnvio, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if codigoCiudad != "" {
+		encontrada, err := consultarCiudad(db, codigoCiudad)
+		if err != nil {
+			return "", nil, err
+		}
+		ciudad = encontrada.Nombre
+	}
+	cotizaciones, err := cotizarEnvio(db, ciudad, paquetes)
+	return ciudad, cotizaciones, err
+}
+
+// Kits con sus componentes y disponibilidad
+func obtenerKits(ctx context.Context) ([]Kit, error) {
+	var kits []Kit
+	err := trazarLectura(ctx, "consultarKits", func(db *sql.DB) error {
+		var err error
+		kits, err = consultarKits(db, incluirEliminados(ctx))
+		return err
+	})
+	return kits, err
+}
+
+// Definir o reemplazar un kit
+func actualizarKit(kitID int, precio int64, componentes []ComponenteKit) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return definirKit(db, kitID, precio, componentes)
+}
+
+// Eliminar un kit; el producto sigue existiendo
+func borrarKit(kitID int) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return eliminarKit(db, kitID)
+}
+
+// Vocabularios de los atributos de cabello indicados
+func obtenerVocabularios(ctx context.Context, atributos []string) (map[string][]ValorAtributo, error) {
+	vocabularios := map[string][]ValorAtributo{}
+	err := trazarLectura(ctx, "consultarVocabulario", func(db *sql.DB) error {
+		for _, atributo := range atributos {
+			valores, err := consultarVocabulario(db, atributo)
+			if err != nil {
+				return err
+			}
+			vocabularios[atributo] = valores
+		}
+		return nil
+	})
+	return vocabularios, err
+}
+
+// Agregar o actualizar un valor del vocabulario de un atributo
+func actualizarValorAtributo(atributo string, valor ValorAtributo, orden int) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return guardarValorAtributo(db, atributo, valor, orden)
+}
+
+// Validar y guardar los atributos de cabello de un producto
+func actualizarAtributosProducto(productoID int, valores map[string]string) (map[string]string, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	return guardarAtributosProducto(db, productoID, valores)
+}
+
+// Guardar las traducciones de un producto o de su guía de cuidado
+func actualizarTraducciones(entidad string, productoID int, idioma string, textos map[string]string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return guardarTraducciones(db, entidad, productoID, idioma, textos)
+}
+
+// Regenerar los feeds de catálogo en el momento
+func actualizarFeeds(ctx context.Context) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsulta(ctx, "consultarProductosFeed", func() error {
+		return regenerarFeeds(db)
+	})
+}
+
+// Sitemap o RSS guardado; si aún no existe se genera con la URL base dada
+func obtenerDocumentoGenerado(ctx context.Context, nombre, base string) ([]byte, string, time.Time, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	var contenido []byte
+	var tipo string
+	var generadoEn time.Time
+	err = trazarConsulta(ctx, "consultarDocumentoGenerado", func() error {
+		var err error
+		contenido, tipo, generadoEn, err = consultarDocumentoGenerado(db, nombre)
+		if err == sql.ErrNoRows {
+			if err := regenerarDocumentosPublicos(db, base); err != nil {
+				return err
+			}
+			contenido, tipo, generadoEn, err = consultarDocumentoGenerado(db, nombre)
+		}
+		return err
+	})
+	return contenido, tipo, generadoEn, err
+}
+
+// Guardar un mensaje del formulario de contacto
+func registrarMensajeContacto(ctx context.Context, mensaje *MensajeContacto) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsultaSinReintento(ctx, "insertarMensajeContacto", func() error {
+		return insertarMensajeContacto(db, mensaje)
+	})
+}
+
+// Guardar un reporte de falsificación y cargar su correlación con los
+// certificados y las verificaciones para el aviso al equipo
+func registrarReporteFalsificacion(ctx context.Context, reporte *ReporteFalsificacion) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	err = trazarConsultaSinReintento(ctx, "insertarReporteFalsificacion", func() error {
+		return insertarReporteFalsificacion(db, reporte)
+	})
+	if err != nil || reporte.NumeroCertificado == "" {
+		return err
+	}
+
+	err = trazarConsulta(ctx, "consultarReportesFalsificacion", func() error {
+		reportes, err := consultarReportesFalsificacion(db, reporte.ID, 1)
+		if err == nil && len(reportes) == 1 {
+			reporte.Correlacion = reportes[0].Correlacion
+		}
+		return err
+	})
+	if err != nil {
+		// El reporte ya quedó guardado; se avisa sin la correlación
+		logSolicitud(ctx, "Error al correlacionar el reporte de falsificación:", err)
+	}
+	return nil
+}
+
+// Últimos reportes de falsificación
+func obtenerReportesFalsificacion(ctx context.Context) ([]ReporteFalsificacion, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var reportes []ReporteFalsificacion
+	err = trazarConsulta(ctx, "consultarReportesFalsificacion", func() error {
+		var err error
+		reportes, err = consultarReportesFalsificacion(db, 0, 100)
+		return err
+	})
+	return reportes, err
+}
+
+// Registrar un intento de acceso rechazado por la lista de IPs
+func registrarAccesoDenegado(acceso AccesoDenegado) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return insertarAccesoDenegado(db, acceso)
+}
+
+// Últimos accesos rechazados por la lista de IPs
+func obtenerAccesosDenegados(ctx context.Context) ([]AccesoDenegado, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var accesos []AccesoDenegado
+	err = trazarConsulta(ctx, "consultarAccesosDenegados", func() error {
+		var err error
+		accesos, err = consultarAccesosDenegados(db, 200)
+		return err
+	})
+	return accesos, err
+}
+
+// Guardar o alargar el bloqueo de una IP
+func guardarBloqueoIP(ip, motivo string) (BloqueoIP, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return BloqueoIP{}, err
+	}
+
+	return insertarBloqueoIP(db, ip, motivo)
+}
+
+// Bloqueos vigentes para la caché de cada instancia
+func obtenerBloqueosVigentes() ([]BloqueoIP, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	return consultarBloqueosIP(db, false, maximoBloqueosCargados)
+}
+
+// Bloqueos de IP vigentes o, con todos, los más recientes
+func obtenerBloqueosIP(ctx context.Context, todos bool) ([]BloqueoIP, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var bloqueos []BloqueoIP
+	err = trazarConsulta(ctx, "consultarBloqueosIP", func() error {
+		var err error
+		bloqueos, err = consultarBloqueosIP(db, todos, 500)
+		return err
+	})
+	return bloqueos, err
+}
+
+// Levantar el bloqueo de una IP
+func quitarBloqueoIP(ctx context.Context, ip string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsulta(ctx, "levantarBloqueoIP", func() error {
+		return levantarBloqueoIP(db, ip)
+	})
+}
+
+// Últimos mensajes del formulario de contacto
+func obtenerMensajesContacto(ctx context.Context) ([]MensajeContacto, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var mensajes []MensajeContacto
+	err = trazarConsulta(ctx, "consultarMensajesContacto", func() error {
+		var err error
+		mensajes, err = consultarMensajesContacto(db, 100)
+		return err
+	})
+	return mensajes, err
+}
+
+// Registrar una suscripción al boletín; ver suscribirNewsletter
+func registrarSuscripcionNewsletter(ctx context.Context, email, nombre, ip string) (confirmacion, baja string, err error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return "", "", err
+	}
+
+	err = trazarConsultaSinReintento(ctx, "suscribirNewsletter", func() error {
+		var err error
+		confirmacion, baja, err = suscribirNewsletter(db, email, nombre, ip)
+		return err
+	})
+	return confirmacion, baja, err
+}
+
+// Confirmar una suscripción al boletín y otorgar el consentimiento de
+// marketing al cliente con el mismo email
+func confirmarNewsletter(ctx context.Context, token string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsulta(ctx, "confirmarSuscriptorNewsletter", func() error {
+		return enTransaccion(db, func(tx *sql.Tx) error {
+			email, err := confirmarSuscriptorNewsletter(tx, token)
+			if err != nil {
+				return err
+			}
+			return sincronizarConsentimientoNewsletter(tx, email, true)
+		})
+	})
+}
+
+// Dar de baja una suscripción al boletín y retirar el consentimiento de
+// marketing al cliente con el mismo email
+func cancelarNewsletter(ctx context.Context, token string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsulta(ctx, "darBajaSuscriptorNewsletter", func() error {
+		return enTransaccion(db, func(tx *sql.Tx) error {
+			email, err := darBajaSuscriptorNewsletter(tx, token)
+			if err != nil {
+				return err
+			}
+			return sincronizarConsentimientoNewsletter(tx, email, false)
+		})
+	})
+}
+
+// Suscriptores del boletín en un estado, por páginas
+func recorrerSuscriptoresNewsletter(ctx context.Context, estado string, emitir func([]SuscriptorNewsletter) error) error {
+	var pagina []SuscriptorNewsletter
+	return recorrerPorCursor(ctx, "consultarSuscriptoresNewsletter", func(db *sql.DB, despuesDe int64, limite int) (int64, int, error) {
+		var err error
+		pagina, err = consultarSuscriptoresNewsletter(db, estado, despuesDe, limite)
+		if err != nil || len(pagina) == 0 {
+			return 0, 0, err
+		}
+		return int64(pagina[len(pagina)-1].ID), len(pagina), nil
+	}, func() error {
+		return emitir(pagina)
+	})
+}
+
+// Todos los certificados para exportarlos, por páginas
+func recorrerCertificados(ctx context.Context, incluirEliminados bool, emitir func([]CertificadoExportado) error) error {
+	var pagina []CertificadoExportado
+	return recorrerPorCursor(ctx, "consultarPaginaCertificados", func(db *sql.DB, despuesDe int64, limite int) (int64, int, error) {
+		var err error
+		pagina, err = consultarPaginaCertificados(db, despuesDe, limite, incluirEliminados)
+		if err != nil || len(pagina) == 0 {
+			return 0, 0, err
+		}
+		return pagina[len(pagina)-1].id, len(pagina), nil
+	}, func() error {
+		return emitir(pagina)
+	})
+}
+
+// Registrar el dispositivo del dueño de un certificado y, si se indica, su
+// consentimiento para los recordatorios por push
+func registrarDispositivo(ctx context.Context, token, plataforma, numeroCertificado, email string, recordatorios *bool) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsulta(ctx, "guardarDispositivo", func() error {
+		clienteID, err := clienteDeCertificado(db, numeroCertificado, email)
+		if err != nil {
+			return err
+		}
+		return enTransaccion(db, func(tx *sql.Tx) error {
+			if err := guardarDispositivo(tx, token, plataforma, clienteID); err != nil {
+				return err
+			}
+			if recordatorios == nil {
+				return nil
+			}
+			return guardarConsentimientosTx(tx, clienteID, map[string]bool{ConsentimientoPush: *recordatorios}, fuenteConsentimientoApp)
+		})
+	})
+}
+
+// Dejar de enviar push a un dispositivo
+func eliminarRegistroDispositivo(ctx context.Context, token string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsulta(ctx, "eliminarDispositivo", func() error {
+		return eliminarDispositivo(db, token)
+	})
+}
+
+// Avisar por push al cliente de la compra que su certificado fue emitido
+func notificarCertificadoPush(compraID int, numeroCertificado string) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	var clienteID int
+	err = db.QueryRow(`SELECT cliente_id FROM Compras WHERE compra_id = $1`, compraID).Scan(&clienteID)
+	if err != nil {
+		return err
+	}
+	_, err = notificarPushCliente(db, clienteID, NotificacionPush{
+		Titulo: "Tu certificado de autenticidad está listo",
+		Cuerpo: "Ya puedes ver y compartir el certificado " + numeroCertificado + ".",
+		Datos:  map[string]string{"tipo": EventoCertificadoEmitido, "numero_certificado": numeroCertificado},
+	})
+	return err
+}
+
+// Eliminar (borrado lógico) o restaurar un cliente, producto o certificado
+func cambiarEliminado(ctx context.Context, entidad entidadBorrable, id interface{}, eliminar bool) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+
+	return trazarConsulta(ctx, "marcarEliminado", func() error {
+		return marcarEliminado(db, entidad, id, eliminar)
+	})
+}
+
+// Listar los últimos respaldos de la base
+func obtenerRespaldos(ctx context.Context) ([]Respaldo, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var respaldos []Respaldo
+	err = trazarConsulta(ctx, "consultarRespaldos", func() error {
+		respaldos, err = consultarRespaldos(db, 50)
+		return err
+	})
+	return respaldos, err
+}
+
+// Registrar un respaldo y hacerlo en segundo plano; devuelve su id
+func iniciarRespaldo(ctx context.Context) (int, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = trazarConsultaSinReintento(ctx, "registrarRespaldo", func() error {
+		id, err = registrarRespaldo(db)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		if err := ejecutarRespaldo(context.Background(), db, id); err != nil {
+			log.Println("Respaldo:", err)
+			return
+		}
+		logInfo("Respaldo %d completado", id)
+	}()
+	return id, nil
+}
+
+// Guardar una entrega de webhook
+func registrarEntregaWebhook(ctx context.Context, entrega *EntregaWebhook) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+	return trazarConsultaSinReintento(ctx, "guardarEntregaWebhook", func() error {
+		return guardarEntregaWebhook(db, entrega)
+	})
+}
+
+// Entregas de webhooks según los filtros
+func obtenerEntregasWebhooks(ctx context.Context, filtro filtroEntregas) ([]EntregaWebhook, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var entregas []EntregaWebhook
+	err = trazarConsulta(ctx, "consultarEntregasWebhooks", func() error {
+		var err error
+		entregas, err = consultarEntregasWebhooks(db, filtro)
+		return err
+	})
+	return entregas, err
+}
+
+// Una entrega de webhook con su payload
+func obtenerEntregaWebhook(ctx context.Context, id int64) (*EntregaWebhook, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var entrega *EntregaWebhook
+	err = trazarConsulta(ctx, "consultarEntregaWebhook", func() error {
+		var err error
+		entrega, err = consultarEntregaWebhook(db, id)
+		return err
+	})
+	return entrega, err
+}
+
+// Reintentar una entrega fallida: un webhook entrante se vuelve a procesar
+// y uno saliente se reenvía si su URL sigue configurada. El reintento queda
+// como una entrega nueva que apunta a la original.
+func reintentarEntregaWebhook(ctx context.Context, id int64) (*EntregaWebhook, error) {
+	original, err := obtenerEntregaWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if original.Exitosa {
+		return nil, errEntregaExitosa
+	}
+
+	if original.Direccion == WebhookEntrante {
+		if _, ok := webhooksEntrantes[original.Origen]; !ok {
+			return nil, errWebhookNoConfigurado
+		}
+		entrega, _ := atenderWebhookEntrante(ctx, original.Origen, []byte(original.Payload), &original.ID)
+		return entrega, nil
+	}
+	configurado := false
+	for _, url := range configActual().Outbox.Webhooks {
+		configurado = configurado || url == original.Origen
+	}
+	if !configurado {
+		return nil, errWebhookNoConfigurado
+	}
+	// El error queda en la entrega
+	entrega, _ := entregarWebhookSaliente(original.Origen, original.Tipo, []byte(original.Payload), &original.ID)
+	return entrega, nil
+}
+
+// Webhooks entrantes en la cola de fallidos
+func obtenerWebhooksFallidos(ctx context.Context, todos bool) ([]WebhookFallido, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var fallidos []WebhookFallido
+	err = trazarConsulta(ctx, "consultarWebhooksFallidos", func() error {
+		var err error
+		fallidos, err = consultarWebhooksFallidos(db, todos, 500)
+		return err
+	})
+	return fallidos, err
+}
+
+// Reintentar al momento un webhook de la cola de fallidos
+func reintentarWebhookFallidoID(ctx context.Context, id int64) (*EntregaWebhook, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var fallido *WebhookFallido
+	err = trazarConsulta(ctx, "reservarWebhookFallido", func() error {
+		var err error
+		fallido, err = reservarWebhookFallido(db, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reintentarWebhookFallido(ctx, db, *fallido)
+}
+
+// Sacar un webhook de la cola de fallidos sin procesarlo
+func descartarWebhookFallidoID(ctx context.Context, id int64) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+	return trazarConsulta(ctx, "descartarWebhookFallido", func() error {
+		return descartarWebhookFallido(db, id)
+	})
+}
+
+func obtenerEventosDescartados(ctx context.Context) ([]EventoDescartado, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var eventos []EventoDescartado
+	err = trazarConsulta(ctx, "consultarEventosDescartados", func() error {
+		var err error
+		eventos, err = consultarEventosDescartados(db, 500)
+		return err
+	})
+	return eventos, err
+}
+
+func reintentarEventoDescartadoID(ctx context.Context, id int64) error {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return err
+	}
+	return trazarConsultaSinReintento(ctx, "reintentarEventoDescartado", func() error {
+		return reintentarEventoDescartado(db, id)
+	})
+}
+
+// Encolar una acción masiva sobre los certificados de la lista o del
+// filtro; devuelve el trabajo creado
+func encolarAccionMasiva(ctx context.Context, solicitud SolicitudAccionMasiva) (*Trabajo, error) {
+	if err := validarAccionMasiva(solicitud.Accion); err != nil {
+		return nil, err
+	}
+	if len(solicitud.Numeros) > 0 && solicitud.Filtro != nil {
+		return nil, errSeleccionMasivaDoble
+	}
+
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	numeros := []string{}
+	for _, numero := range solicitud.Numeros {
+		if numero = strings.TrimSpace(numero); numero != "" {
+			numeros = append(numeros, numero)
+		}
+	}
+	if solicitud.Filtro != nil {
+		err = trazarConsulta(ctx, "consultarNumerosFiltro", func() error {
+			var err error
+			numeros, err = consultarNumerosFiltro(db, *solicitud.Filtro, maxCertificadosMasivos+1)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(numeros) == 0 {
+		return nil, errSeleccionMasivaVacia
+	}
+	if len(numeros) > maxCertificadosMasivos {
+		return nil, errSeleccionMasivaGrande
+	}
+
+	parametros := parametrosAccionMasiva{Motivo: solicitud.Motivo}
+	var trabajoID int64
+	err = trazarConsultaSinReintento(ctx, "crearTrabajo", func() error {
+		var err error
+		trabajoID, err = crearTrabajo(db, solicitud.Accion, parametros, numeros)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return obtenerTrabajo(ctx, trabajoID)
+}
+
+// Trabajos de la cola con su progreso
+func obtenerTrabajos(ctx context.Context) ([]Trabajo, error) {
+	var trabajos []Trabajo
+	err := trazarLectura(ctx, "consultarTrabajos", func(db *sql.DB) error {
+		var err error
+		trabajos, err = consultarTrabajos(db, 0, 100)
+		return err
+	})
+	return trabajos, err
+}
+
+// Progreso de un trabajo de la cola
+func obtenerTrabajo(ctx context.Context, trabajoID int64) (*Trabajo, error) {
+	db, err := poolBaseDatos()
+	if err != nil {
+		return nil, err
+	}
+
+	var trabajo *Trabajo
+	err = trazarConsulta(ctx, "consultarTrabajo", func() error {
+		var err error
+		trabajo, err = consultarTrabajo(db, trabajoID)
+		return err
+	})
+	return trabajo, err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Reinicios sin cortes: con SIGUSR2 el servidor ejecuta de nuevo su binario
+// (el que quedó en la misma ruta tras el despliegue) y le pasa el socket en
+// el que escucha. Cuando el proceso nuevo avisa que está atendiendo, el
+// anterior deja de aceptar conexiones, termina las solicitudes en curso y
+// sale. Si el proceso nuevo no arranca, el anterior sigue atendiendo.
+// SIGTERM e SIGINT también esperan las solicitudes en curso.
+
+const (
+	// Variable de entorno con la que el proceso nuevo sabe que hereda el
+	// socket (descriptor 3) y el aviso de listo (descriptor 4)
+	variableEscuchaHeredada = "MELENAS_ESCUCHA_HEREDADA"
+	// Cuánto se espera a que el proceso nuevo esté listo
+	esperaProcesoNuevo = 30 * time.Second
+)
+
+// Ruta del binario al iniciar; tras reemplazarlo en el despliegue apunta al
+// nuevo, a diferencia de /proc/self/exe
+var ejecutableServidor, _ = os.Executable()
+
+// Listener heredado del proceso anterior en un reinicio sin cortes
+func escuchaHeredada() (net.Listener, error) {
+	if os.Getenv(variableEscuchaHeredada) == "" {
+		return nil, nil
+	}
+	f := os.NewFile(3, "escucha")
+	defer f.Close()
+	escucha, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error al heredar el socket del proceso anterior: %v", err)
+	}
+	return escucha, nil
+}
+
+// Abrir el listener del servidor HTTP según servidor.socket o
+// servidor.host y servidor.puerto (o PORT); devuelve también la dirección
+// para el log
+func escucharServidor() (net.Listener, string, error) {
+	ajustes := config.Servidor
+	if escucha, err := escuchaHeredada(); escucha != nil || err != nil {
+		return escucha, "socket heredado " + direccionEscucha(escucha), err
+	}
+	if ajustes.Socket == "" {
+		direccion := net.JoinHostPort(ajustes.Host, strconv.Itoa(ajustes.Puerto))
+		escucha, err := net.Listen("tcp", direccion)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error al escuchar en %s: %v", direccion, err)
+		}
+		return escucha, "http://" + escucha.Addr().String(), nil
+	}
+
+	// Un socket que quedó de una ejecución anterior impide escuchar; solo se
+	// borra si de verdad es un socket
+	if info, err := os.Lstat(ajustes.Socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, "", fmt.Errorf("Error al escuchar en %s: el archivo existe y no es un socket", ajustes.Socket)
+		}
+		if err := os.Remove(ajustes.Socket); err != nil {
+			return nil, "", fmt.Errorf("Error al borrar el socket anterior: %v", err)
+		}
+	}
+
+	escucha, err := net.Listen("unix", ajustes.Socket)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error al escuchar en %s: %v", ajustes.Socket, err)
+	}
+	permisos, _ := strconv.ParseUint(ajustes.PermisosSocket, 8, 32)
+	if err := os.Chmod(ajustes.Socket, os.FileMode(permisos)); err != nil {
+		escucha.Close()
+		return nil, "", fmt.Errorf("Error al cambiar los permisos del socket: %v", err)
+	}
+	return escucha, "unix:" + ajustes.Socket, nil
+}
+
+func direccionEscucha(escucha net.Listener) string {
+	if escucha == nil {
+		return ""
+	}
+	return escucha.Addr().Network() + ":" + escucha.Addr().String()
+}
+
+// Avisar al proceso anterior que el nuevo ya atiende y registrar el PID
+func avisarServidorListo() {
+	if archivo := config.Servidor.ArchivoPID; archivo != "" {
+		if err := os.WriteFile(archivo, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			log.Println("Error al escribir el archivo del PID:", err)
+		}
+	}
+	if os.Getenv(variableEscuchaHeredada) == "" {
+		return
+	}
+	os.Unsetenv(variableEscuchaHeredada)
+	aviso := os.NewFile(4, "aviso")
+	aviso.Write([]byte{1})
+	aviso.Close()
+}
+
+// Atender el servidor hasta que termine por una señal; devuelve cuando las
+// solicitudes en curso terminaron o venció la espera
+func atenderServidor(servidor *http.Server, escucha net.Listener) error {
+	apagado := make(chan struct{})
+	senales := make(chan os.Signal, 1)
+	signal.Notify(senales, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		for senal := range senales {
+			if senal == syscall.SIGUSR2 {
+				if err := iniciarProcesoNuevo(escucha); err != nil {
+					log.Println("Error en el reinicio sin cortes; se sigue atendiendo:", err)
+					continue
+				}
+				log.Println("Proceso nuevo listo; terminando las solicitudes en curso")
+			} else {
+				log.Println("Señal", senal, "recibida; terminando las solicitudes en curso")
+			}
+			signal.Stop(senales)
+			apagarServidor(servidor)
+			close(apagado)
+			return
+		}
+	}()
+
+	avisarServidorListo()
+	if err := servidor.Serve(escucha); err != http.ErrServerClosed {
+		return err
+	}
+	<-apagado
+	return nil
+}
+
+// Dejar de aceptar conexiones y esperar las solicitudes en curso hasta
+// servidor.espera_apagado_segundos
+func apagarServidor(servidor *http.Server) {
+	espera := time.Duration(config.Servidor.EsperaApagadoSegundos) * time.Second
+	ctx, cancelar := context.WithTimeout(context.Background(), espera)
+	defer cancelar()
+	if servidorInterno != nil {
+		go servidorInterno.Shutdown(ctx)
+	}
+	if err := servidor.Shutdown(ctx); err != nil {
+		log.Println("Error al esperar las solicitudes en curso:", err)
+	}
+}
+
+// Ejecutar el binario con el socket heredado y esperar a que avise que
+// está listo
+func iniciarProcesoNuevo(escucha net.Listener) error {
+	conArchivo, ok := escucha.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("el listener no admite pasarse a otro proceso")
+	}
+	archivo, err := conArchivo.File()
+	if err != nil {
+		return err
+	}
+	defer archivo.Close()
+
+	lectura, escritura, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer lectura.Close()
+
+	cmd := exec.Command(ejecutableServidor, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), variableEscuchaHeredada+"=1")
+	cmd.ExtraFiles = []*os.File{archivo, escritura}
+	err = cmd.Start()
+	escritura.Close()
+	if err != nil {
+		return err
+	}
+	terminado := make(chan error, 1)
+	go func() { terminado <- cmd.Wait() }()
+
+	listo := make(chan error, 1)
+	go func() {
+		_, err := lectura.Read(make([]byte, 1))
+		listo <- err
+	}()
+
+	select {
+	case err := <-listo:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("el proceso nuevo terminó sin avisar que estaba listo")
+		}
+	case err := <-terminado:
+		return fmt.Errorf("el proceso nuevo terminó al iniciar: %v", err)
+	case <-time.After(esperaProcesoNuevo):
+		cmd.Process.Kill()
+		return fmt.Errorf("el proceso nuevo no estuvo listo en %v", esperaProcesoNuevo)
+	}
+
+	// El socket Unix ahora es del proceso nuevo; al cerrarlo aquí no se debe
+	// borrar el archivo
+	if unix, ok := escucha.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(false)
+	}
+	log.Println("Proceso nuevo iniciado con PID", cmd.Process.Pid)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// API interna para los demás servicios del backend: con interno.direccion
+// se sirve la misma API en un segundo puerto con TLS mutuo. Solo se aceptan
+// clientes con un certificado firmado por interno.ca_clientes (y, si se
+// configura, con un nombre de interno.clientes); esos clientes cuentan como
+// administradores, así que no necesitan el token compartido. No hay API
+// gRPC: la superficie interna es la misma API HTTP.
+
+var servidorInterno *http.Server
+
+type claveClienteInterno struct{}
+
+// Nombre del servicio autenticado por certificado, vacío fuera de la API
+// interna
+func clienteInterno(ctx context.Context) string {
+	nombre, _ := ctx.Value(claveClienteInterno{}).(string)
+	return nombre
+}
+
+// Configuración TLS que exige certificado de cliente
+func configuracionTLSInterna() (*tls.Config, error) {
+	ajustes := config.Interno
+	certificado, err := tls.LoadX509KeyPair(ajustes.Certificado, ajustes.Clave)
+	if err != nil {
+		return nil, fmt.Errorf("Error al cargar el certificado de la API interna: %v", err)
+	}
+	pem, err := os.ReadFile(ajustes.CAClientes)
+	if err != nil {
+		return nil, fmt.Errorf("Error al leer la CA de clientes: %v", err)
+	}
+	clientes := x509.NewCertPool()
+	if !clientes.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Error al leer la CA de clientes: %s no tiene certificados PEM", ajustes.CAClientes)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificado},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientes,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Nombre del certificado de cliente si está en interno.clientes (o si la
+// lista está vacía): el CN o alguno de sus DNS
+func nombreClientePermitido(certificado *x509.Certificate) (string, bool) {
+	permitidos := configActual().Interno.Clientes
+	nombres := append([]string{certificado.Subject.CommonName}, certificado.DNSNames...)
+	if len(permitidos) == 0 {
+		return nombres[0], true
+	}
+	for _, nombre := range nombres {
+		for _, permitido := range permitidos {
+			if nombre != "" && nombre == permitido {
+				return nombre, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Middleware que identifica al servicio cliente por su certificado
+func autenticarClienteInterno(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "Certificado de cliente requerido", http.StatusUnauthorized)
+			return
+		}
+		nombre, ok := nombreClientePermitido(r.TLS.VerifiedChains[0][0])
+		if !ok {
+			logSolicitud(r.Context(), fmt.Sprintf("Cliente interno no permitido: %s", r.TLS.VerifiedChains[0][0].Subject))
+			http.Error(w, "Cliente no permitido", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claveClienteInterno{}, nombre)))
+	})
+}
+
+// Iniciar la API interna con el mismo handler del servidor público
+func iniciarServidorInterno(handler http.Handler) {
+	if config.Interno.Direccion == "" {
+		return
+	}
+	configuracion, err := configuracionTLSInterna()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	servidorInterno = &http.Server{
+		Addr:      config.Interno.Direccion,
+		Handler:   autenticarClienteInterno(handler),
+		TLSConfig: configuracion,
+	}
+
+	go func() {
+		log.Println("API interna con TLS mutuo en https://" + config.Interno.Direccion)
+		err := escucharConReintento(func() error {
+			return servidorInterno.ListenAndServeTLS("", "")
+		})
+		if err != http.ErrServerClosed {
+			log.Println("API interna:", err)
+		}
+	}()
+}
+
+// Escuchar reintentando mientras la dirección esté ocupada: en un reinicio
+// sin cortes el proceso anterior la mantiene hasta terminar sus solicitudes
+func escucharConReintento(escuchar func() error) error {
+	limite := time.Now().Add(time.Duration(config.Servidor.EsperaApagadoSegundos)*time.Second + esperaProcesoNuevo)
+	for {
+		err := escuchar()
+		if !errors.Is(err, syscall.EADDRINUSE) || time.Now().After(limite) {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Resultado de una sincronización de productos
+type ResumenSincronizacion struct {
+	Recibidos   int `json:"recibidos"`
+	Modificados int `json:"modificados"`
+	// Productos que Rocketfy dejó de devolver, marcados con eliminado_en
+	Eliminados int `json:"eliminados"`
+	Kits       int `json:"kits"`
+	// Kits de Rocketfy cuyo SKU o el de algún componente no existe localmente
+	KitsOmitidos int `json:"kits_omitidos"`
+	// Diferencias de los productos con el esquema esperado
+	CambiosEsquema []DiferenciaEsquema `json:"cambios_esquema,omitempty"`
+}
+
+// Identificador de un producto de Rocketfy ("id" o "_id")
+func idProductoRocketfy(producto map[string]interface{}) string {
+	for _, clave := range []string{"id", "_id"} {
+		if valor, ok := producto[clave]; ok && valor != nil {
+			return fmt.Sprint(valor)
+		}
+	}
+	return ""
+}
+
+// Descargar los productos de Rocketfy, revisar su esquema
+// (esquema_rocketfy.go) y guardarlos en ProductosSincronizados, el original
+// y el convertido a Product (mapeo_productos.go).
+// actualizado_en solo cambia cuando el contenido del producto es distinto
+// o cuando el producto se elimina o reaparece.
+// Los productos se copian con COPY a una tabla temporal y se guardan todos
+// con un único INSERT.
+func sincronizarProductos(db *sql.DB) (ResumenSincronizacion, error) {
+	var resumen ResumenSincronizacion
+
+	productos, err := obtenerProductos(context.Background())
+	if err != nil {
+		return resumen, err
+	}
+	resumen.Recibidos = len(productos)
+
+	// Las diferencias se guardan y avisan aunque la sincronización se
+	// cancele después
+	resumen.CambiosEsquema = compararEsquema(productos, esquemaProductoRocketfy)
+	if err := revisarCambiosEsquema(db, recursoProductosRocketfy, resumen.CambiosEsquema); err != nil {
+		log.Println("Error al guardar los cambios de esquema de Rocketfy:", err)
+	}
+	if campo := campoObligatorioAusente(resumen.CambiosEsquema, len(productos)); campo != "" {
+		return resumen, fmt.Errorf("Ningún producto de Rocketfy trae el campo %q; no se sincroniza para no dañar los datos de la tienda", campo)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return resumen, err
+	}
+	defer tx.Rollback()
+
+	// Si Rocketfy repite un producto queda la última versión; un mismo
+	// INSERT ... ON CONFLICT no puede modificar dos veces la misma fila
+	mapeados := mapearProductosRocketfy(productos)
+	if err := completarIDsProductos(tx, mapeados); err != nil {
+		return resumen, err
+	}
+	filas := make([][]interface{}, 0, len(productos))
+	posiciones := map[string]int{}
+	for i, producto := range productos {
+		id := idProductoRocketfy(producto)
+		if id == "" {
+			return resumen, fmt.Errorf("Producto sin identificador: %v", producto["nombre"])
+		}
+
+		datos, err := json.Marshal(producto)
+		if err != nil {
+			return resumen, fmt.Errorf("Error al serializar el producto %s: %v", id, err)
+		}
+		suma := sha256.Sum256(datos)
+		mapeado, err := json.Marshal(mapeados[i])
+		if err != nil {
+			return resumen, fmt.Errorf("Error al serializar el producto %s: %v", id, err)
+		}
+
+		fila := []interface{}{id, string(datos), hex.EncodeToString(suma[:]), string(mapeado)}
+		if i, ok := posiciones[id]; ok {
+			filas[i] = fila
+			continue
+		}
+		posiciones[id] = len(filas)
+		filas = append(filas, fila)
+	}
+
+	err = copiarTemporal(tx, "productos_rocketfy", "ProductosSincronizados",
+		[]string{"rocketfy_id", "datos", "hash", "producto"}, filas)
+	if err != nil {
+		return resumen, err
+	}
+	err = tx.QueryRow(`
+		WITH guardados AS (
+			INSERT INTO ProductosSincronizados (rocketfy_id, datos, hash, producto)
+			SELECT rocketfy_id, datos, hash, producto FROM productos_rocketfy
+			ON CONFLICT (rocketfy_id) DO UPDATE SET
+				datos = EXCLUDED.datos,
+				hash = EXCLUDED.hash,
+				producto = EXCLUDED.producto,
+				sincronizado_en = now(),
+				eliminado_en = NULL,
+				actualizado_en = CASE
+					WHEN ProductosSincronizados.hash <> EXCLUDED.hash
+						OR ProductosSincronizados.eliminado_en IS NOT NULL THEN now()
+					ELSE ProductosSincronizados.actualizado_en
+				END
+			RETURNING actualizado_en = now() AS modificado
+		)
+		SELECT count(*) FILTER (WHERE modificado) FROM guardados`).Scan(&resumen.Modificados)
+	if err != nil {
+		return resumen, err
+	}
+
+	// Los que ya no vienen quedan eliminados. Una respuesta vacía se toma
+	// como una falla de Rocketfy y no borra el catálogo
+	if len(filas) > 0 {
+		resultado, err := tx.Exec(`
+			UPDATE ProductosSincronizados
+			SET eliminado_en = now(), actualizado_en = now()
+			WHERE eliminado_en IS NULL
+				AND rocketfy_id NOT IN (SELECT rocketfy_id FROM productos_rocketfy)`)
+		if err != nil {
+			return resumen, err
+		}
+		eliminados, err := resultado.RowsAffected()
+		if err != nil {
+			return resumen, err
+		}
+		resumen.Eliminados = int(eliminados)
+	}
+
+	resumen.Kits, resumen.KitsOmitidos, err = sincronizarKits(tx, productos)
+	if err != nil {
+		return resumen, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return resumen, err
+	}
+
+	// El sitemap y el RSS de productos nuevos se regeneran en cada
+	// sincronización; si fallan, la sincronización igual queda hecha
+	if err := regenerarDocumentosPublicos(db, configActual().Publico.URLBase); err != nil {
+		log.Println("Error al regenerar el sitemap y el RSS de productos:", err)
+	}
+	return resumen, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sitemap (/sitemap.xml) con las páginas de los productos y las de
+// verificación de los certificados vigentes, y RSS (/feeds/productos.rss)
+// con los productos agregados recientemente. Se regeneran en cada
+// sincronización de productos y se guardan en DocumentosGenerados, ya que la
+// sincronización puede correr en otro proceso (melenas sync products).
+
+const (
+	rutaSitemap      = "/sitemap.xml"
+	rutaRSSProductos = "/feeds/productos.rss"
+
+	// Límite de URLs de un sitemap según el protocolo
+	maximoURLsSitemap = 50000
+	// Productos más recientes incluidos en el RSS
+	limiteItemsRSS = 50
+)
+
+var errSinURLBase = errors.New("publico.url_base es obligatorio para generar URLs públicas")
+
+// Producto sincronizado con sus fechas
+type productoPublico struct {
+	ID          string
+	Nombre      string
+	SKU         string
+	Descripcion string
+	CreadoEn    time.Time
+	Actualizado time.Time
+}
+
+func consultarProductosPublicos(db *sql.DB, orden string, limite int) ([]productoPublico, error) {
+	// orden es una constante de este archivo
+	rows, err := db.Query(`
+		SELECT rocketfy_id, coalesce(datos->>'name', ''), coalesce(datos->>'sku', ''),
+			coalesce(datos->>'description', ''), creado_en, actualizado_en
+		FROM ProductosSincronizados
+		WHERE coalesce(datos->>'name', '') <> '' AND eliminado_en IS NULL
+		ORDER BY `+orden+`
+		LIMIT $1`, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var productos []productoPublico
+	for rows.Next() {
+		var p productoPublico
+		if err := rows.Scan(&p.ID, &p.Nombre, &p.SKU, &p.Descripcion, &p.CreadoEn, &p.Actualizado); err != nil {
+			return nil, err
+		}
+		productos = append(productos, p)
+	}
+	return productos, rows.Err()
+}
+
+// Generar el sitemap con las URLs públicas bajo base
+func generarSitemap(db *sql.DB, base string) ([]byte, error) {
+	type urlSitemap struct {
+		Loc     string `xml:"loc"`
+		Lastmod string `xml:"lastmod,omitempty"`
+	}
+	type urlset struct {
+		XMLName xml.Name     `xml:"urlset"`
+		Xmlns   string       `xml:"xmlns,attr"`
+		URLs    []urlSitemap `xml:"url"`
+	}
+	sitemap := urlset{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+
+	productos, err := consultarProductosPublicos(db, "rocketfy_id", maximoURLsSitemap)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range productos {
+		sitemap.URLs = append(sitemap.URLs, urlSitemap{Loc: enlaceProductoFeed(p.ID, p.SKU), Lastmod: p.Actualizado.Format("2006-01-02")})
+	}
+
+	// Con los tokens de verificación activos las páginas de los
+	// certificados no se publican: el sitemap repartiría un token de cada uno
+	if tokensVerificacionActivos() {
+		return codificarXML(sitemap)
+	}
+
+	// Certificados vigentes, los más recientes primero si no caben todos
+	rows, err := db.Query(`
+		SELECT numero_certificado, fecha_emision
+		FROM Certificados
+		WHERE revocado_en IS NULL AND reemplazado_en IS NULL
+		ORDER BY fecha_emision DESC NULLS LAST, numero_certificado
+		LIMIT $1`, maximoURLsSitemap-len(sitemap.URLs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var numero string
+		var emision *time.Time
+		if err := rows.Scan(&numero, &emision); err != nil {
+			return nil, err
+		}
+		url := urlSitemap{Loc: base + "/c/" + numero}
+		if emision != nil {
+			url.Lastmod = emision.Format("2006-01-02")
+		}
+		sitemap.URLs = append(sitemap.URLs, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return codificarXML(sitemap)
+}
+
+// Generar el RSS 2.0 de los productos agregados recientemente
+func generarRSSProductos(db *sql.DB, base string) ([]byte, error) {
+	type guid struct {
+		EsEnlace bool   `xml:"isPermaLink,attr"`
+		Valor    string `xml:",chardata"`
+	}
+	type item struct {
+		Titulo      string `xml:"title"`
+		Enlace      string `xml:"link"`
+		Descripcion string `xml:"description,omitempty"`
+		GUID        guid   `xml:"guid"`
+		Fecha       string `xml:"pubDate"`
+	}
+	type canal struct {
+		Titulo      string `xml:"title"`
+		Enlace      string `xml:"link"`
+		Descripcion string `xml:"description"`
+		Items       []item `xml:"item"`
+	}
+	type rss struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Canal   canal    `xml:"channel"`
+	}
+
+	productos, err := consultarProductosPublicos(db, "creado_en DESC, rocketfy_id", limiteItemsRSS)
+	if err != nil {
+		return nil, err
+	}
+	feed := rss{Version: "2.0", Canal: canal{
+		Titulo:      "Productos nuevos de " + marcaFeeds(),
+		Enlace:      base,
+		Descripcion: "Productos agregados recientemente al catálogo de " + marcaFeeds(),
+	}}
+	for _, p := range productos {
+		feed.Canal.Items = append(feed.Canal.Items, item{
+			Titulo:      p.Nombre,
+			Enlace:      enlaceProductoFeed(p.ID, p.SKU),
+			Descripcion: textoPlano(p.Descripcion),
+			GUID:        guid{Valor: "rocketfy:" + p.ID},
+			Fecha:       p.CreadoEn.Format(time.RFC1123Z),
+		})
+	}
+	return codificarXML(feed)
+}
+
+func codificarXML(documento interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	codificador := xml.NewEncoder(&b)
+	codificador.Indent("", "  ")
+	if err := codificador.Encode(documento); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// Generar el sitemap y el RSS y guardarlos para servirlos
+func regenerarDocumentosPublicos(db *sql.DB, base string) error {
+	base = strings.TrimSuffix(base, "/")
+	if base == "" {
+		return errSinURLBase
+	}
+
+	sitemap, err := generarSitemap(db, base)
+	if err != nil {
+		return err
+	}
+	rss, err := generarRSSProductos(db, base)
+	if err != nil {
+		return err
+	}
+
+	for _, documento := range []struct {
+		nombre, tipo string
+		contenido    []byte
+	}{
+		{rutaSitemap, "application/xml; charset=utf-8", sitemap},
+		{rutaRSSProductos, "application/rss+xml; charset=utf-8", rss},
+	} {
+		_, err := db.Exec(`
+			INSERT INTO DocumentosGenerados (nombre, contenido, tipo_contenido, generado_en)
+			VALUES ($1, $2, $3, now())
+			ON CONFLICT (nombre) DO UPDATE SET contenido = EXCLUDED.contenido,
+				tipo_contenido = EXCLUDED.tipo_contenido, generado_en = now()`,
+			documento.nombre, documento.contenido, documento.tipo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func consultarDocumentoGenerado(db *sql.DB, nombre string) (contenido []byte, tipo string, generadoEn time.Time, err error) {
+	err = db.QueryRow(`
+		SELECT contenido, tipo_contenido, generado_en
+		FROM DocumentosGenerados WHERE nombre = $1`, nombre).Scan(&contenido, &tipo, &generadoEn)
+	return contenido, tipo, generadoEn, err
+}
+
+// Handler para GET /sitemap.xml y /feeds/productos.rss. Si todavía no se
+// sincronizó ninguna vez se generan en el momento.
+func documentoPublicoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contenido, tipo, generadoEn, err := obtenerDocumentoGenerado(r.Context(), r.URL.Path, configActual().Publico.URLBase)
+	if err != nil {
+		http.Error(w, "Error al generar el documento", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", tipo)
+	w.Header().Set("Cache-Control", cacheControlProductos())
+	http.ServeContent(w, r, "", generadoEn, bytes.NewReader(contenido))
+}
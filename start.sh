@@ -1,5 +1,11 @@
 # chmod +x melenasb
-kill -9 $(cat melenasb.pid)
+# Si el servidor ya corre se le pide un reinicio sin cortes: ejecuta el
+# binario nuevo, le pasa el socket y escribe su PID en melenasb.pid
+# (servidor.archivo_pid)
+if kill -USR2 $(cat melenasb.pid) 2>/dev/null; then
+	echo "Reinicio sin cortes solicitado a melenas Backend con PID $(cat melenasb.pid)"
+	exit 0
+fi
 nohup bash -c 'exec -a meleneasb ./main' > melenas.nohup.out 2>&1 &
 echo $! > melenasb.pid
 PID=$(cat melenasb.pid)
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Normalización de los teléfonos de los clientes a E.164 (+573001234567).
+// Los números sin indicativo de país se toman como colombianos. Los envíos
+// por WhatsApp fallaban con números guardados con espacios, guiones o sin
+// indicativo.
+
+const indicativoPorDefecto = "57"
+
+var errTelefonoInvalido = errors.New("Teléfono inválido")
+
+const loteTelefonos = 500
+
+// Normalizar un teléfono a E.164. En Colombia se aceptan celulares (10
+// dígitos empezando por 3) y fijos con el marcado nacional de 10 dígitos
+// (60 + indicativo de departamento).
+func normalizarTelefono(texto string) (string, error) {
+	texto = strings.TrimSpace(texto)
+	internacional := strings.HasPrefix(texto, "+")
+	var digitos strings.Builder
+	for _, c := range texto {
+		switch {
+		case c >= '0' && c <= '9':
+			digitos.WriteRune(c)
+		case c == '+' && digitos.Len() == 0, c == ' ', c == '-', c == '.', c == '(', c == ')':
+		default:
+			return "", errTelefonoInvalido
+		}
+	}
+	numero := digitos.String()
+
+	if !internacional && strings.HasPrefix(numero, "00") {
+		numero, internacional = numero[2:], true
+	}
+	if !internacional {
+		if len(numero) == 12 && strings.HasPrefix(numero, indicativoPorDefecto) {
+			numero = numero[len(indicativoPorDefecto):]
+		}
+		numero = indicativoPorDefecto + numero
+	}
+
+	// E.164: hasta 15 dígitos y el indicativo no empieza por 0
+	if len(numero) < 8 || len(numero) > 15 || numero[0] == '0' {
+		return "", errTelefonoInvalido
+	}
+	if nacional := strings.TrimPrefix(numero, "57"); nacional != numero {
+		if len(nacional) != 10 || !(nacional[0] == '3' || strings.HasPrefix(nacional, "60")) {
+			return "", errTelefonoInvalido
+		}
+	}
+	return "+" + numero, nil
+}
+
+// Valores de las columnas telefono, telefono_cifrado y telefono_hash según
+// la configuración de cifrado
+func columnasTelefono(telefono string) (plano, cifrado, hash sql.NullString, err error) {
+	hash = sql.NullString{String: hashTelefono(telefono), Valid: hashTelefono(telefono) != ""}
+	if !cifradoPIIActivo() {
+		return sql.NullString{String: telefono, Valid: true}, cifrado, hash, nil
+	}
+	valor, err := cifrarPII(telefono)
+	if err != nil {
+		return plano, cifrado, hash, err
+	}
+	return plano, sql.NullString{String: valor, Valid: true}, hash, nil
+}
+
+// Hash del teléfono normalizado para buscar clientes sin descifrar, con la
+// misma clave que el de los emails
+func hashTelefono(telefono string) string {
+	if config.Cifrado.ClaveHash == "" {
+		return ""
+	}
+	clave, err := decodificarClave(config.Cifrado.ClaveHash)
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, clave)
+	mac.Write([]byte(telefono))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Buscar un cliente por su teléfono normalizado, por el hash o en los
+// registros sin cifrar. Si es de un cliente fusionado se devuelve el que
+// se conservó.
+func buscarClientePorTelefono(db consultorFila, telefono string) (int, error) {
+	var clienteID int
+	err := db.QueryRow(`
+		SELECT coalesce(fusionado_con, cliente_id) FROM Clientes
+		WHERE telefono_hash = $1 OR telefono = $2
+		ORDER BY fusionado_con IS NOT NULL
+		LIMIT 1`, hashTelefono(telefono), telefono).Scan(&clienteID)
+	return clienteID, err
+}
+
+// Guardar el teléfono (ya normalizado) de un cliente
+func guardarTelefonoCliente(db *sql.DB, clienteID int, telefono string) error {
+	plano, cifrado, hash, err := columnasTelefono(telefono)
+	if err != nil {
+		return err
+	}
+
+	resultado, err := db.Exec(`
+		UPDATE Clientes SET telefono = $2, telefono_cifrado = $3, telefono_hash = $4
+		WHERE cliente_id = $1 AND anonimizado_en IS NULL`, clienteID, plano, cifrado, hash)
+	if err != nil {
+		return err
+	}
+	if n, err := resultado.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	var existe bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM Clientes WHERE cliente_id = $1)`, clienteID).Scan(&existe)
+	if err != nil {
+		return err
+	}
+	if existe {
+		return errClienteAnonimizado
+	}
+	return errClienteInexistente
+}
+
+// Resultado de la normalización de los teléfonos guardados
+type ResumenTelefonos struct {
+	Revisados    int
+	Normalizados int
+	// Clientes con un teléfono que no se pudo normalizar; se dejan como
+	// están para corregirlos a mano
+	Invalidos []int
+}
+
+// Normalizar los teléfonos ya guardados. Se puede interrumpir y repetir
+// sin problema.
+func normalizarTelefonosClientes(db *sql.DB) (ResumenTelefonos, error) {
+	var resumen ResumenTelefonos
+	ultimoID := 0
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return resumen, err
+		}
+
+		rows, err := tx.Query(`
+			SELECT cliente_id, telefono, telefono_cifrado
+			FROM Clientes
+			WHERE cliente_id > $1 AND (telefono IS NOT NULL OR telefono_cifrado IS NOT NULL)
+			ORDER BY cliente_id
+			LIMIT $2
+			FOR UPDATE`, ultimoID, loteTelefonos)
+		if err != nil {
+			tx.Rollback()
+			return resumen, err
+		}
+
+		type telefonoCliente struct {
+			id                        int
+			telefono, telefonoCifrado sql.NullString
+		}
+		var lote []telefonoCliente
+		for rows.Next() {
+			var c telefonoCliente
+			if err := rows.Scan(&c.id, &c.telefono, &c.telefonoCifrado); err != nil {
+				rows.Close()
+				tx.Rollback()
+				return resumen, err
+			}
+			lote = append(lote, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			tx.Rollback()
+			return resumen, err
+		}
+		if len(lote) == 0 {
+			tx.Rollback()
+			return resumen, nil
+		}
+
+		for _, c := range lote {
+			ultimoID = c.id
+			resumen.Revisados++
+
+			telefono, err := valorPII(c.telefono, c.telefonoCifrado)
+			if err != nil {
+				tx.Rollback()
+				return resumen, fmt.Errorf("cliente %d: %v", c.id, err)
+			}
+			normalizado, err := normalizarTelefono(*telefono)
+			if err != nil {
+				resumen.Invalidos = append(resumen.Invalidos, c.id)
+				continue
+			}
+			if normalizado == *telefono {
+				continue
+			}
+
+			plano, cifrado, hash, err := columnasTelefono(normalizado)
+			if err != nil {
+				tx.Rollback()
+				return resumen, err
+			}
+			_, err = tx.Exec(`UPDATE Clientes SET telefono = $2, telefono_cifrado = $3, telefono_hash = $4 WHERE cliente_id = $1`,
+				c.id, plano, cifrado, hash)
+			if err != nil {
+				tx.Rollback()
+				return resumen, err
+			}
+			resumen.Normalizados++
+		}
+
+		if err := tx.Commit(); err != nil {
+			return resumen, err
+		}
+	}
+}
+
+// Handler para PUT /admin/clientes/{id}/telefono {"telefono": "300 123 4567"}
+func telefonoClienteHandler(w http.ResponseWriter, r *http.Request, clienteID int) {
+	if r.Method != "PUT" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var solicitud struct {
+		Telefono string `json:"telefono"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&solicitud); err != nil {
+		http.Error(w, "telefono requerido", http.StatusBadRequest)
+		return
+	}
+	telefono, err := normalizarTelefono(solicitud.Telefono)
+	if err != nil {
+		http.Error(w, "telefono debe ser un celular o fijo colombiano de 10 dígitos o un número internacional con +", http.StatusBadRequest)
+		return
+	}
+
+	err = actualizarTelefonoCliente(clienteID, telefono)
+	if err != nil {
+		responderErrorCliente(w, r, err, "Error al guardar el teléfono")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"telefono": telefono})
+}
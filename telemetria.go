@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trazas distribuidas exportadas en formato OTLP/HTTP (JSON) al endpoint
+// configurado en la sección telemetria de config.yml. Si no hay endpoint,
+// los spans no se registran.
+
+// Tipos de span según OTLP
+const (
+	spanServidor = 2
+	spanCliente  = 3
+)
+
+// Parámetros del exportador
+const (
+	loteSpans              = 100
+	intervaloExportacion   = 5 * time.Second
+	capacidadColaDeSpans   = 2048
+	timeoutExportacionOTLP = 10 * time.Second
+)
+
+type claveSpan struct{}
+
+// Span en curso; un span nil no registra nada
+type span struct {
+	traceID    string
+	spanID     string
+	padreID    string
+	nombre     string
+	tipo       int
+	inicio     time.Time
+	fin        time.Time
+	atributos  map[string]interface{}
+	errorTexto string
+}
+
+var colaSpans chan *span
+
+// Iniciar el exportador si hay un endpoint OTLP configurado
+func iniciarTelemetria() {
+	if config.Telemetria.OTLPEndpoint == "" {
+		return
+	}
+	colaSpans = make(chan *span, capacidadColaDeSpans)
+	go exportarSpans()
+	log.Println("Exportando trazas a", config.Telemetria.OTLPEndpoint)
+}
+
+func idAleatorio(bytes int) string {
+	b := make([]byte, bytes)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Iniciar un span hijo del span presente en el contexto (si lo hay)
+func iniciarSpan(ctx context.Context, nombre string, tipo int) (context.Context, *span) {
+	if colaSpans == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		spanID:    idAleatorio(8),
+		nombre:    nombre,
+		tipo:      tipo,
+		inicio:    time.Now(),
+		atributos: map[string]interface{}{},
+	}
+	if padre, ok := ctx.Value(claveSpan{}).(*span); ok && padre != nil {
+		s.traceID = padre.traceID
+		s.padreID = padre.spanID
+	} else {
+		s.traceID = idAleatorio(16)
+	}
+
+	return context.WithValue(ctx, claveSpan{}, s), s
+}
+
+func (s *span) atributo(clave string, valor interface{}) {
+	if s != nil {
+		s.atributos[clave] = valor
+	}
+}
+
+// Finalizar el span y encolarlo para exportación
+func (s *span) finalizar(err error) {
+	if s == nil {
+		return
+	}
+	s.fin = time.Now()
+	if err != nil {
+		s.errorTexto = err.Error()
+	}
+
+	select {
+	case colaSpans <- s:
+	default:
+		// Si el colector no da abasto se descartan spans antes que bloquear
+	}
+}
+
+// Encabezado W3C traceparent para propagar la traza en llamadas salientes
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.traceID, s.spanID)
+}
+
+// Ejecutar una operación de base de datos dentro de un span de cliente,
+// reintentándola ante errores transitorios (conmutacion_db.go).
+// sql.ErrNoRows no se marca como error del span.
+func trazarConsulta(ctx context.Context, nombre string, operacion func() error) error {
+	return trazarConsultaSinReintento(ctx, nombre, func() error {
+		return reintentarDB(ctx, operacion)
+	})
+}
+
+// Como trazarConsulta pero sin reintentar los errores transitorios. Es la
+// que usan las escrituras que no son idempotentes: si el commit llegó al
+// servidor pero se perdió la respuesta, reintentar duplicaría la fila.
+func trazarConsultaSinReintento(ctx context.Context, nombre string, operacion func() error) error {
+	_, s := iniciarSpan(ctx, nombre, spanCliente)
+	s.atributo("db.system", "postgresql")
+	s.atributo("db.name", config.DB.DBName)
+
+	err := operacion()
+	if err == sql.ErrNoRows {
+		s.finalizar(nil)
+	} else {
+		s.finalizar(err)
+	}
+	return err
+}
+
+// Leer el encabezado traceparent entrante y crear un span remoto como padre
+func contextoDesdeTraceparent(ctx context.Context, encabezado string) context.Context {
+	partes := strings.Split(encabezado, "-")
+	if len(partes) != 4 || len(partes[1]) != 32 || len(partes[2]) != 16 {
+		return ctx
+	}
+	return context.WithValue(ctx, claveSpan{}, &span{traceID: partes[1], spanID: partes[2]})
+}
+
+// ResponseWriter que recuerda el código de estado
+type respuestaConEstado struct {
+	http.ResponseWriter
+	estado int
+}
+
+func (w *respuestaConEstado) WriteHeader(estado int) {
+	w.estado = estado
+	w.ResponseWriter.WriteHeader(estado)
+}
+
+// Necesario para el stream SSE
+func (w *respuestaConEstado) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware que crea un span de servidor por cada solicitud HTTP
+func trazarHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if colaSpans == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := contextoDesdeTraceparent(r.Context(), r.Header.Get("traceparent"))
+		ctx, s := iniciarSpan(ctx, r.Method+" "+r.URL.Path, spanServidor)
+		s.atributo("http.method", r.Method)
+		s.atributo("http.target", r.URL.Path)
+		s.atributo("http.user_agent", r.UserAgent())
+		s.atributo("http.request_id", idSolicitud(r.Context()))
+
+		respuesta := &respuestaConEstado{ResponseWriter: w, estado: http.StatusOK}
+		next.ServeHTTP(respuesta, r.WithContext(ctx))
+
+		s.atributo("http.status_code", respuesta.estado)
+		var err error
+		if respuesta.estado >= 500 {
+			err = fmt.Errorf("HTTP %d", respuesta.estado)
+		}
+		s.finalizar(err)
+	})
+}
+
+// Agrupar los spans encolados y enviarlos periódicamente al colector
+func exportarSpans() {
+	client := &http.Client{Timeout: timeoutExportacionOTLP}
+	ticker := time.NewTicker(intervaloExportacion)
+	defer ticker.Stop()
+
+	var lote []*span
+	for {
+		select {
+		case s := <-colaSpans:
+			lote = append(lote, s)
+			if len(lote) < loteSpans {
+				continue
+			}
+		case <-ticker.C:
+			if len(lote) == 0 {
+				continue
+			}
+		}
+
+		err := enviarSpansOTLP(client, lote)
+		if err != nil {
+			log.Println("Error al exportar trazas:", err)
+		}
+		lote = nil
+	}
+}
+
+func valorOTLP(valor interface{}) map[string]interface{} {
+	switch v := valor.(type) {
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(valor)}
+}
+
+func atributosOTLP(atributos map[string]interface{}) []map[string]interface{} {
+	lista := make([]map[string]interface{}, 0, len(atributos))
+	for clave, valor := range atributos {
+		lista = append(lista, map[string]interface{}{"key": clave, "value": valorOTLP(valor)})
+	}
+	return lista
+}
+
+func enviarSpansOTLP(client *http.Client, lote []*span) error {
+	spans := make([]map[string]interface{}, 0, len(lote))
+	for _, s := range lote {
+		estado := map[string]interface{}{"code": 1}
+		if s.errorTexto != "" {
+			estado = map[string]interface{}{"code": 2, "message": s.errorTexto}
+		}
+		spans = append(spans, map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"parentSpanId":      s.padreID,
+			"name":              s.nombre,
+			"kind":              s.tipo,
+			"startTimeUnixNano": strconv.FormatInt(s.inicio.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.fin.UnixNano(), 10),
+			"attributes":        atributosOTLP(s.atributos),
+			"status":            estado,
+		})
+	}
+
+	servicio := config.Telemetria.Servicio
+	if servicio == "" {
+		servicio = "melenas-backend"
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": atributosOTLP(map[string]interface{}{"service.name": servicio}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "melenas"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(config.Telemetria.OTLPEndpoint, "/") + "/v1/traces"
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("el colector respondió con código de estado: %d", resp.StatusCode)
+	}
+	return nil
+}
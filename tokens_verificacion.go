@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tokens de verificación para los QR: en lugar del número del certificado
+// el QR lleva /v/{numero}.{vencimiento}.{firma}, con la firma HMAC-SHA256
+// de verificacion.clave_tokens. La firma y el vencimiento se validan antes
+// de consultar la base, así que probar números al azar no sirve de nada.
+// Con la clave configurada las rutas públicas (/c/, /obtener_certificado y
+// certificado de GraphQL) solo aceptan el token; los números sueltos se
+// rechazan salvo para los administradores.
+
+// Bytes de la firma incluidos en el token; 128 bits bastan y el QR queda
+// más pequeño
+const longitudFirmaToken = 16
+
+var (
+	errTokenVerificacionInvalido  = errors.New("Enlace de verificación no válido o vencido")
+	errTokenVerificacionRequerido = errors.New("Se requiere el enlace de verificación del certificado")
+)
+
+func tokensVerificacionActivos() bool {
+	return configActual().Verificacion.ClaveTokens != ""
+}
+
+// Un token tiene tres partes separadas por puntos; los números no tienen
+// puntos
+func esTokenVerificacion(valor string) bool {
+	return strings.Count(valor, ".") == 2
+}
+
+func firmarTokenVerificacion(contenido string) (string, error) {
+	clave, err := decodificarClave(configActual().Verificacion.ClaveTokens)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, clave)
+	mac.Write([]byte(contenido))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:longitudFirmaToken]), nil
+}
+
+// Generar el token de un certificado que vence en la fecha dada
+func generarTokenVerificacion(numeroCertificado string, vence time.Time) (string, error) {
+	contenido := numeroCertificado + "." + strconv.FormatInt(vence.Unix(), 36)
+	firma, err := firmarTokenVerificacion(contenido)
+	if err != nil {
+		return "", err
+	}
+	return contenido + "." + firma, nil
+}
+
+// Validar la firma y el vencimiento de un token y devolver el número del
+// certificado
+func validarTokenVerificacion(token string, ahora time.Time) (string, error) {
+	partes := strings.Split(token, ".")
+	if len(partes) != 3 || partes[0] == "" {
+		return "", errTokenVerificacionInvalido
+	}
+	contenido := partes[0] + "." + partes[1]
+	esperada, err := firmarTokenVerificacion(contenido)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(partes[2]), []byte(esperada)) {
+		return "", errTokenVerificacionInvalido
+	}
+	vence, err := strconv.ParseInt(partes[1], 36, 64)
+	if err != nil || ahora.Unix() > vence {
+		return "", errTokenVerificacionInvalido
+	}
+	return partes[0], nil
+}
+
+// Número del certificado pedido en una ruta pública, a partir del token o
+// del número. Con los tokens activos un número suelto solo lo puede
+// consultar un administrador.
+func numeroVerificacionPublica(r *http.Request, numero, token string) (string, error) {
+	if !tokensVerificacionActivos() {
+		return numero, nil
+	}
+	if token != "" {
+		return validarTokenVerificacion(token, time.Now())
+	}
+	if numero != "" && !esAdmin(r) {
+		return "", errTokenVerificacionRequerido
+	}
+	return numero, nil
+}
+
+// Responder el rechazo de numeroVerificacionPublica. Un número suelto se
+// trata como un certificado inexistente, para que los señuelos sigan
+// detectando a quien prueba números.
+func responderErrorVerificacion(w http.ResponseWriter, r *http.Request, err error, numero, canal string) {
+	switch err {
+	case errTokenVerificacionRequerido:
+		certificadoNoEncontrado(r, numero, canal)
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errTokenVerificacionInvalido:
+		registrarFallo(r, FalloConsulta)
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, "Error al validar el enlace", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+	}
+}
+
+// Ruta pública de la página de un certificado: con los tokens activos lleva
+// un token vigente por verificacion.vigencia_dias en lugar del número
+func rutaPaginaCertificado(numeroCertificado string) string {
+	ajustes := configActual().Verificacion
+	if ajustes.ClaveTokens == "" {
+		return "/c/" + numeroCertificado
+	}
+	token, err := generarTokenVerificacion(numeroCertificado, time.Now().AddDate(0, 0, ajustes.VigenciaDias))
+	if err != nil {
+		// La clave se valida al cargar la configuración
+		log.Println("Error al generar el token de verificación:", err)
+		return "/c/" + numeroCertificado
+	}
+	return "/c/" + token
+}
+
+// Handler para /v/{token}: la página del certificado a partir del QR
+func tokenVerificacionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v/"), "/")
+	if !tokensVerificacionActivos() || token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	numero, err := validarTokenVerificacion(token, time.Now())
+	if err != nil {
+		responderErrorVerificacion(w, r, err, "", VerificacionQR)
+		return
+	}
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	responderPaginaCertificado(w, r, numero, "", VerificacionQR)
+}
+
+// Handler para GET /admin/certificados/{numero}/qr: el token y la URL que
+// se imprimen en el QR
+func tokenCertificadoHandler(w http.ResponseWriter, r *http.Request, numero string) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tokensVerificacionActivos() {
+		http.Error(w, "Falta configurar verificacion.clave_tokens", http.StatusServiceUnavailable)
+		return
+	}
+
+	data, err := obtenerCertificado(r.Context(), numero)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Certificado no encontrado", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	vence := time.Now().AddDate(0, 0, configActual().Verificacion.VigenciaDias)
+	token, err := generarTokenVerificacion(data.NumeroCertificado, vence)
+	if err != nil {
+		http.Error(w, "Error al generar el token", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	base, err := urlBasePublica()
+	if err != nil {
+		http.Error(w, "Error al generar la URL", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":    token,
+		"url":      base + "/v/" + token,
+		"vence_en": Fecha{vence},
+	})
+}
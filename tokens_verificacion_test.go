@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func claveTokensPrueba(relleno byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(relleno)), 32)))
+}
+
+func TestValidarTokenVerificacion(t *testing.T) {
+	anterior := config
+	defer func() { config = anterior }()
+	config.Verificacion.ClaveTokens = claveTokensPrueba('a')
+
+	ahora := time.Unix(1700000000, 0)
+	token, err := generarTokenVerificacion("MC-000123", ahora.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vencido, err := generarTokenVerificacion("MC-000123", ahora.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	partes := strings.Split(token, ".")
+
+	config.Verificacion.ClaveTokens = claveTokensPrueba('b')
+	deOtraClave, err := generarTokenVerificacion("MC-000123", ahora.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Verificacion.ClaveTokens = claveTokensPrueba('a')
+
+	casos := []struct {
+		nombre string
+		token  string
+		numero string
+		valido bool
+	}{
+		{"vigente", token, "MC-000123", true},
+		{"vencido", vencido, "", false},
+		{"otro número con la misma firma", "MC-000124." + partes[1] + "." + partes[2], "", false},
+		{"vencimiento extendido", partes[0] + ".zzzzzz." + partes[2], "", false},
+		{"firma recortada", token[:len(token)-2], "", false},
+		{"de otra clave", deOtraClave, "", false},
+		{"número suelto", "MC-000123", "", false},
+		{"sin número", "." + partes[1] + "." + partes[2], "", false},
+		{"vacío", "", "", false},
+	}
+	for _, caso := range casos {
+		numero, err := validarTokenVerificacion(caso.token, ahora)
+		if caso.valido && (err != nil || numero != caso.numero) {
+			t.Errorf("%s: %q, %v; se esperaba %q", caso.nombre, numero, err, caso.numero)
+		}
+		if !caso.valido && err != errTokenVerificacionInvalido {
+			t.Errorf("%s: %q, %v; se esperaba el error de token inválido", caso.nombre, numero, err)
+		}
+	}
+}
+
+// Con la clave configurada los números sueltos solo los consulta un
+// administrador
+func TestNumeroVerificacionPublica(t *testing.T) {
+	anterior := config
+	defer func() { config = anterior }()
+	config.Admin.Token = "token-admin"
+	config.Verificacion.ClaveTokens = claveTokensPrueba('a')
+	token, err := generarTokenVerificacion("MC-000123", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	casos := []struct {
+		nombre   string
+		clave    string
+		admin    bool
+		numero   string
+		token    string
+		esperado string
+		err      error
+	}{
+		{"sin clave acepta el número", "", false, "MC-000123", "", "MC-000123", nil},
+		{"número suelto rechazado", claveTokensPrueba('a'), false, "MC-000123", "", "", errTokenVerificacionRequerido},
+		{"número suelto de administrador", claveTokensPrueba('a'), true, "MC-000123", "", "MC-000123", nil},
+		{"token vigente", claveTokensPrueba('a'), false, "", token, "MC-000123", nil},
+		{"token prevalece sobre el número", claveTokensPrueba('a'), false, "MC-000999", token, "MC-000123", nil},
+		{"token alterado", claveTokensPrueba('a'), false, "", "MC-000124" + token[len("MC-000123"):], "", errTokenVerificacionInvalido},
+	}
+	for _, caso := range casos {
+		config.Verificacion.ClaveTokens = caso.clave
+		r := httptest.NewRequest("GET", "/obtener_certificado", nil)
+		if caso.admin {
+			r.Header.Set("Authorization", "Bearer token-admin")
+		}
+		numero, err := numeroVerificacionPublica(r, caso.numero, caso.token)
+		if numero != caso.esperado || err != caso.err {
+			t.Errorf("%s: %q, %v; se esperaba %q, %v", caso.nombre, numero, err, caso.esperado, caso.err)
+		}
+	}
+}
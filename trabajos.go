@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Cola de trabajos en segundo plano guardada en la base de datos. Un
+// trabajo tiene un tipo, sus parámetros y una lista de elementos
+// (TrabajosElementos) que una goroutine procesa de a lotes con el
+// procesador de su tipo. Los elementos se reservan con SKIP LOCKED y un
+// plazo, así varias instancias reparten el trabajo y lo que quedó a medias
+// al reiniciar se retoma. El progreso se calcula contando los elementos
+// por estado.
+
+const (
+	intervaloTrabajos = 2 * time.Second
+	loteTrabajos      = 20
+	// Si una instancia no termina un elemento en este plazo otra lo retoma
+	reservaTrabajo = 5 * time.Minute
+	// Errores por elemento incluidos en el detalle de un trabajo
+	maxErroresTrabajo = 500
+)
+
+// Estados de un trabajo
+const (
+	TrabajoPendiente = "pendiente"
+	TrabajoEnCurso   = "en_curso"
+	TrabajoTerminado = "terminado"
+)
+
+// Estados de un elemento de un trabajo
+const (
+	ElementoPendiente = "pendiente"
+	ElementoHecho     = "hecho"
+	ElementoFallido   = "fallido"
+)
+
+var errTrabajoInexistente = errors.New("Trabajo no encontrado")
+
+// Procesa un elemento de un trabajo con los parámetros del trabajo
+type procesadorTrabajo func(ctx context.Context, db *sql.DB, parametros json.RawMessage, elemento string) error
+
+// Procesador de cada tipo de trabajo
+var procesadoresTrabajo = map[string]procesadorTrabajo{
+	AccionRevocar:       revocarCertificadoMasivo,
+	AccionReenviarEmail: reenviarEmailCertificado,
+	AccionRegenerarPDF:  regenerarPDFCertificado,
+}
+
+// Trabajo con su progreso
+type Trabajo struct {
+	ID         int64           `json:"id"`
+	Tipo       string          `json:"tipo"`
+	Parametros json.RawMessage `json:"parametros"`
+	Estado     string          `json:"estado"`
+	Total      int             `json:"total"`
+	Procesados int             `json:"procesados"`
+	Exitosos   int             `json:"exitosos"`
+	Fallidos   int             `json:"fallidos"`
+	// Solo en el detalle de un trabajo
+	Errores     []ErrorTrabajo `json:"errores,omitempty"`
+	CreadoEn    *Fecha         `json:"creado_en"`
+	IniciadoEn  *Fecha         `json:"iniciado_en"`
+	TerminadoEn *Fecha         `json:"terminado_en"`
+}
+
+// Elemento de un trabajo que no se pudo procesar
+type ErrorTrabajo struct {
+	Elemento string `json:"elemento"`
+	Error    string `json:"error"`
+}
+
+// Elemento reservado para procesarlo
+type elementoTrabajo struct {
+	trabajoID  int64
+	tipo       string
+	parametros string
+	elemento   string
+}
+
+// Encolar un trabajo con sus elementos; los repetidos se procesan una vez
+func crearTrabajo(db *sql.DB, tipo string, parametros interface{}, elementos []string) (int64, error) {
+	datos, err := json.Marshal(parametros)
+	if err != nil {
+		return 0, err
+	}
+	var trabajoID int64
+	err = enTransaccion(db, func(tx *sql.Tx) error {
+		err := tx.QueryRow(`INSERT INTO Trabajos (tipo, parametros) VALUES ($1, $2) RETURNING trabajo_id`,
+			tipo, string(datos)).Scan(&trabajoID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO TrabajosElementos (trabajo_id, elemento)
+			SELECT $1, unnest($2::text[])
+			ON CONFLICT DO NOTHING`, trabajoID, pq.Array(elementos))
+		return err
+	})
+	return trabajoID, err
+}
+
+// Reservar elementos pendientes, de los trabajos más antiguos primero
+func reservarElementosTrabajo(db *sql.DB, limite int) ([]elementoTrabajo, error) {
+	rows, err := db.Query(`
+		UPDATE TrabajosElementos e SET reservado_hasta = now() + $2 * interval '1 second'
+		FROM Trabajos t
+		WHERE t.trabajo_id = e.trabajo_id
+			AND (e.trabajo_id, e.elemento) IN (
+				SELECT trabajo_id, elemento FROM TrabajosElementos
+				WHERE estado = 'pendiente' AND (reservado_hasta IS NULL OR reservado_hasta <= now())
+				ORDER BY trabajo_id, elemento
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED)
+		RETURNING e.trabajo_id, t.tipo, t.parametros, e.elemento`, limite, reservaTrabajo.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservados []elementoTrabajo
+	for rows.Next() {
+		var e elementoTrabajo
+		if err := rows.Scan(&e.trabajoID, &e.tipo, &e.parametros, &e.elemento); err != nil {
+			return nil, err
+		}
+		reservados = append(reservados, e)
+	}
+	return reservados, rows.Err()
+}
+
+// Anotar el resultado de un elemento
+func terminarElementoTrabajo(db *sql.DB, e elementoTrabajo, errProceso error) error {
+	estado := ElementoHecho
+	var mensaje *string
+	if errProceso != nil {
+		estado = ElementoFallido
+		texto := errProceso.Error()
+		mensaje = &texto
+	}
+	_, err := db.Exec(`
+		UPDATE TrabajosElementos SET estado = $3, error = $4, procesado_en = now(), reservado_hasta = NULL
+		WHERE trabajo_id = $1 AND elemento = $2`, e.trabajoID, e.elemento, estado, mensaje)
+	return err
+}
+
+// Procesar un elemento reservado con el procesador de su tipo
+func procesarElementoTrabajo(ctx context.Context, db *sql.DB, e elementoTrabajo) error {
+	procesar, ok := procesadoresTrabajo[e.tipo]
+	if !ok {
+		return terminarElementoTrabajo(db, e, errors.New("tipo de trabajo desconocido: "+e.tipo))
+	}
+	return terminarElementoTrabajo(db, e, procesar(ctx, db, json.RawMessage(e.parametros), e.elemento))
+}
+
+// Goroutine que procesa los elementos pendientes de la cola
+func despacharTrabajos() {
+	for range time.Tick(intervaloTrabajos) {
+		if escriturasBloqueadas() {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Trabajos: error al conectar a la base de datos:", err)
+			continue
+		}
+
+		// Seguir mientras haya lotes completos
+		for {
+			reservados, err := reservarElementosTrabajo(db, loteTrabajos)
+			if err != nil {
+				log.Println("Trabajos:", err)
+				break
+			}
+			for _, e := range reservados {
+				if err := procesarElementoTrabajo(context.Background(), db, e); err != nil {
+					log.Printf("Trabajos: trabajo %d, elemento %s: %v", e.trabajoID, e.elemento, err)
+				}
+			}
+			if len(reservados) < loteTrabajos || escriturasBloqueadas() {
+				break
+			}
+		}
+	}
+}
+
+// Trabajos con su progreso, del más reciente al más antiguo; con
+// trabajoID distinto de cero solo ese
+func consultarTrabajos(db *sql.DB, trabajoID int64, limite int) ([]Trabajo, error) {
+	rows, err := db.Query(`
+		SELECT
+			t.trabajo_id,
+			t.tipo,
+			t.parametros,
+			t.creado_en,
+			count(e.elemento),
+			count(e.elemento) FILTER (WHERE e.estado <> 'pendiente'),
+			count(e.elemento) FILTER (WHERE e.estado = 'hecho'),
+			count(e.elemento) FILTER (WHERE e.estado = 'fallido'),
+			min(e.procesado_en),
+			max(e.procesado_en)
+		FROM Trabajos t
+		LEFT JOIN TrabajosElementos e ON e.trabajo_id = t.trabajo_id
+		WHERE $1 = 0 OR t.trabajo_id = $1
+		GROUP BY t.trabajo_id
+		ORDER BY t.trabajo_id DESC
+		LIMIT $2`, trabajoID, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trabajos := []Trabajo{}
+	for rows.Next() {
+		var t Trabajo
+		var parametros string
+		err := rows.Scan(&t.ID, &t.Tipo, &parametros, &t.CreadoEn, &t.Total, &t.Procesados, &t.Exitosos,
+			&t.Fallidos, &t.IniciadoEn, &t.TerminadoEn)
+		if err != nil {
+			return nil, err
+		}
+		t.Parametros = json.RawMessage(parametros)
+		switch {
+		case t.Procesados == t.Total:
+			t.Estado = TrabajoTerminado
+		case t.Procesados > 0:
+			t.Estado = TrabajoEnCurso
+			t.TerminadoEn = nil
+		default:
+			t.Estado = TrabajoPendiente
+		}
+		trabajos = append(trabajos, t)
+	}
+	return trabajos, rows.Err()
+}
+
+// Un trabajo con su progreso y los elementos que fallaron
+func consultarTrabajo(db *sql.DB, trabajoID int64) (*Trabajo, error) {
+	trabajos, err := consultarTrabajos(db, trabajoID, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(trabajos) == 0 {
+		return nil, errTrabajoInexistente
+	}
+	trabajo := &trabajos[0]
+
+	rows, err := db.Query(`
+		SELECT elemento, error FROM TrabajosElementos
+		WHERE trabajo_id = $1 AND estado = 'fallido'
+		ORDER BY elemento
+		LIMIT $2`, trabajoID, maxErroresTrabajo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e ErrorTrabajo
+		if err := rows.Scan(&e.Elemento, &e.Error); err != nil {
+			return nil, err
+		}
+		trabajo.Errores = append(trabajo.Errores, e)
+	}
+	return trabajo, rows.Err()
+}
@@ -0,0 +1,19 @@
+package main
+
+import "database/sql"
+
+// Ejecutar una operación de varias escrituras como una unidad: la
+// transacción se confirma si la operación termina sin error y se revierte
+// si devuelve un error o entra en pánico.
+func enTransaccion(db *sql.DB, operacion func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := operacion(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
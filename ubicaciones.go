@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Catálogo de departamentos y municipios de Colombia con los códigos
+// DIVIPOLA del DANE (2 dígitos el departamento, 5 el municipio), para que
+// los formularios de dirección y las cotizaciones de envío usen ubicaciones
+// validadas.
+
+var errCiudadInexistente = errors.New("Ciudad no encontrada")
+
+type Departamento struct {
+	Codigo string `json:"codigo"`
+	Nombre string `json:"nombre"`
+}
+
+type Ciudad struct {
+	Codigo       string `json:"codigo"`
+	Departamento string `json:"departamento"`
+	Nombre       string `json:"nombre"`
+}
+
+func consultarDepartamentos(db *sql.DB) ([]Departamento, error) {
+	rows, err := db.Query(`SELECT codigo, nombre FROM Departamentos ORDER BY nombre`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	departamentos := []Departamento{}
+	for rows.Next() {
+		var d Departamento
+		if err := rows.Scan(&d.Codigo, &d.Nombre); err != nil {
+			return nil, err
+		}
+		departamentos = append(departamentos, d)
+	}
+	return departamentos, rows.Err()
+}
+
+func consultarCiudades(db *sql.DB, departamento string) ([]Ciudad, error) {
+	rows, err := db.Query(`
+		SELECT codigo, departamento, nombre FROM Ciudades
+		WHERE departamento = $1
+		ORDER BY nombre`, departamento)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ciudades := []Ciudad{}
+	for rows.Next() {
+		var c Ciudad
+		if err := rows.Scan(&c.Codigo, &c.Departamento, &c.Nombre); err != nil {
+			return nil, err
+		}
+		ciudades = append(ciudades, c)
+	}
+	return ciudades, rows.Err()
+}
+
+func consultarCiudad(db *sql.DB, codigo string) (*Ciudad, error) {
+	ciudad := Ciudad{Codigo: codigo}
+	err := db.QueryRow(`SELECT departamento, nombre FROM Ciudades WHERE codigo = $1`, codigo).
+		Scan(&ciudad.Departamento, &ciudad.Nombre)
+	if err == sql.ErrNoRows {
+		return nil, errCiudadInexistente
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ciudad, nil
+}
+
+// Código DANE de un municipio: cinco dígitos
+func codigoDANEValido(codigo string) bool {
+	if len(codigo) != 5 {
+		return false
+	}
+	for _, c := range codigo {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Importar el listado DIVIPOLA del DANE en CSV. Se buscan las columnas por
+// nombre (código y nombre de departamento y de municipio) y se actualizan
+// los nombres de los que ya existen; devuelve los municipios leídos. Las
+// filas se cargan con COPY y se guardan con un INSERT por tabla.
+func importarDivipola(db *sql.DB, r io.Reader) (int, error) {
+	lector := csv.NewReader(r)
+	lector.FieldsPerRecord = -1
+	encabezado, err := lector.Read()
+	if err != nil {
+		return 0, fmt.Errorf("Error al leer el encabezado: %v", err)
+	}
+
+	columnas := map[string]int{}
+	for i, nombre := range encabezado {
+		nombre = strings.ToUpper(reemplazoTildes.Replace(strings.TrimPrefix(strings.TrimSpace(nombre), "\ufeff")))
+		for _, clave := range []string{"CODIGO DEPARTAMENTO", "NOMBRE DEPARTAMENTO", "CODIGO MUNICIPIO", "NOMBRE MUNICIPIO"} {
+			if _, ok := columnas[clave]; !ok && strings.HasPrefix(nombre, clave) {
+				columnas[clave] = i
+			}
+		}
+	}
+	if len(columnas) != 4 {
+		return 0, errors.New("el archivo debe tener las columnas Código Departamento, Nombre Departamento, Código Municipio y Nombre Municipio")
+	}
+
+	// Cada departamento se repite en todas sus filas; si un municipio se
+	// repite queda la última
+	var departamentos, ciudades [][]interface{}
+	departamentosVistos := map[string]bool{}
+	ciudadesVistas := map[string]int{}
+	municipios := 0
+	for fila := 2; ; fila++ {
+		registro, err := lector.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Error al leer la fila %d: %v", fila, err)
+		}
+		valor := func(clave string) string {
+			if i := columnas[clave]; i < len(registro) {
+				return strings.TrimSpace(registro[i])
+			}
+			return ""
+		}
+
+		// Los códigos pueden venir sin los ceros a la izquierda
+		departamento := fmt.Sprintf("%02s", valor("CODIGO DEPARTAMENTO"))
+		municipio := fmt.Sprintf("%05s", valor("CODIGO MUNICIPIO"))
+		if !codigoDANEValido(municipio) || municipio[:2] != departamento {
+			return 0, fmt.Errorf("fila %d: código de municipio inválido %q", fila, municipio)
+		}
+
+		if !departamentosVistos[departamento] {
+			departamentosVistos[departamento] = true
+			departamentos = append(departamentos, []interface{}{departamento, valor("NOMBRE DEPARTAMENTO")})
+		}
+		ciudad := []interface{}{municipio, departamento, valor("NOMBRE MUNICIPIO")}
+		if i, ok := ciudadesVistas[municipio]; ok {
+			ciudades[i] = ciudad
+		} else {
+			ciudadesVistas[municipio] = len(ciudades)
+			ciudades = append(ciudades, ciudad)
+		}
+		municipios++
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = copiarTemporal(tx, "departamentos_divipola", "Departamentos", []string{"codigo", "nombre"}, departamentos)
+	if err != nil {
+		return 0, err
+	}
+	err = copiarTemporal(tx, "ciudades_divipola", "Ciudades", []string{"codigo", "departamento", "nombre"}, ciudades)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO Departamentos (codigo, nombre)
+		SELECT codigo, nombre FROM departamentos_divipola
+		ON CONFLICT (codigo) DO UPDATE SET nombre = EXCLUDED.nombre`)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO Ciudades (codigo, departamento, nombre)
+		SELECT codigo, departamento, nombre FROM ciudades_divipola
+		ON CONFLICT (codigo) DO UPDATE SET departamento = EXCLUDED.departamento, nombre = EXCLUDED.nombre`)
+	if err != nil {
+		return 0, err
+	}
+	return municipios, tx.Commit()
+}
+
+// Handler para GET /ubicaciones/departamentos y
+// GET /ubicaciones/ciudades?departamento=05
+func ubicacionesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var respuesta interface{}
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, "/ubicaciones/") {
+	case "departamentos":
+		respuesta, err = obtenerDepartamentos(r.Context())
+	case "ciudades":
+		departamento := r.URL.Query().Get("departamento")
+		if len(departamento) != 2 {
+			http.Error(w, "departamento debe ser el código DANE de dos dígitos", http.StatusBadRequest)
+			return
+		}
+		respuesta, err = obtenerCiudades(r.Context(), departamento)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error al consultar las ubicaciones", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	// El catálogo casi no cambia; se cachea como los productos
+	responderJSONConETag(w, r, respuesta, cacheControlProductos())
+}
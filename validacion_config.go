@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validación completa de config.yml. Se reportan todos los problemas
+// juntos en lugar de fallar con el primero.
+
+// Tiempo máximo para comprobar la conexión a la base de datos
+const timeoutComprobacionDB = 5 * time.Second
+
+// Longitud mínima recomendada del token de administrador
+const longitudMinimaTokenAdmin = 16
+
+type ProblemaConfig struct {
+	Campo       string
+	Mensaje     string
+	Advertencia bool
+}
+
+type problemasConfig []ProblemaConfig
+
+func (p *problemasConfig) error(campo, formato string, args ...interface{}) {
+	*p = append(*p, ProblemaConfig{Campo: campo, Mensaje: fmt.Sprintf(formato, args...)})
+}
+
+func (p *problemasConfig) advertencia(campo, formato string, args ...interface{}) {
+	*p = append(*p, ProblemaConfig{Campo: campo, Mensaje: fmt.Sprintf(formato, args...), Advertencia: true})
+}
+
+func (p *problemasConfig) requerido(campo, valor string) {
+	if valor == "" {
+		p.error(campo, "es obligatorio")
+	}
+}
+
+// Verificar que una URL sea absoluta y use uno de los esquemas dados
+func (p *problemasConfig) url(campo, valor string, esquemas ...string) *url.URL {
+	u, err := url.Parse(valor)
+	if err != nil || u.Host == "" {
+		p.error(campo, "URL inválida: %q", valor)
+		return nil
+	}
+	for _, esquema := range esquemas {
+		if u.Scheme == esquema {
+			return u
+		}
+	}
+	p.error(campo, "el esquema debe ser %v, es %q", esquemas, u.Scheme)
+	return nil
+}
+
+func puertoValido(puerto int) bool {
+	return puerto > 0 && puerto <= 65535
+}
+
+// Validar la configuración sin conectarse a servicios externos
+func validarConfig(c Config) []ProblemaConfig {
+	var p problemasConfig
+
+	p.requerido("db.host", c.DB.Host)
+	p.requerido("db.user", c.DB.User)
+	p.requerido("db.dbname", c.DB.DBName)
+	if !puertoValido(c.DB.Port) {
+		p.error("db.port", "debe estar entre 1 y 65535, es %d", c.DB.Port)
+	}
+	if strings.Contains(c.DB.Host, ",") {
+		for _, host := range strings.Split(c.DB.Host, ",") {
+			if strings.TrimSpace(host) == "" || strings.ContainsAny(host, " \t") {
+				p.error("db.host", "los hosts deben separarse con coma y sin espacios: %q", c.DB.Host)
+				break
+			}
+			if _, puerto, err := net.SplitHostPort(host); err == nil {
+				if n, err := strconv.Atoi(puerto); err != nil || !puertoValido(n) {
+					p.error("db.host", "puerto inválido en %q", host)
+				}
+			}
+		}
+	}
+	if c.DB.UmbralConsultaLentaMs < 0 {
+		p.error("db.umbral_consulta_lenta_ms", "no puede ser negativo")
+	}
+
+	p.url("rocketfy.url", c.API.URL, "https")
+	if c.API.Sandbox.Activo {
+		// Sin volver a producción: un staging mal configurado falla en
+		// lugar de tocar los datos reales
+		if c.API.Sandbox.URL == "" {
+			p.error("rocketfy.sandbox.url", "es obligatoria con el sandbox activo")
+		} else if p.url("rocketfy.sandbox.url", c.API.Sandbox.URL, "https", "http") != nil &&
+			strings.TrimSuffix(c.API.Sandbox.URL, "/") == strings.TrimSuffix(c.API.URL, "/") {
+			p.error("rocketfy.sandbox.url", "es la misma URL de producción")
+		}
+		if !c.API.Mock {
+			p.requerido("rocketfy.sandbox.x_secret", c.API.Sandbox.XSecret)
+			p.requerido("rocketfy.sandbox.x_api_key", c.API.Sandbox.XAPIKey)
+			if c.API.Sandbox.XAPIKey != "" && c.API.Sandbox.XAPIKey == c.API.XAPIKey {
+				p.advertencia("rocketfy.sandbox.x_api_key", "es la misma credencial de producción")
+			}
+		}
+	} else if !c.API.Mock {
+		p.requerido("rocketfy.x_secret", c.API.XSecret)
+		p.requerido("rocketfy.x_api_key", c.API.XAPIKey)
+	}
+	if c.API.IntervaloClientesMinutos < 0 {
+		p.error("rocketfy.intervalo_clientes_minutos", "no puede ser negativo")
+	}
+	if c.API.SolicitudesPorMinuto < 0 {
+		p.error("rocketfy.solicitudes_por_minuto", "no puede ser negativo")
+	}
+	for campo, regla := range c.API.MapeoProductos {
+		clave := "rocketfy.mapeo_productos." + campo
+		if _, ok := mapeoProductosPorDefecto[campo]; !ok {
+			p.error(clave, "no es un campo de Product")
+		}
+		if !transformacionValida(regla.Transformacion) {
+			p.error(clave+".transformacion", "desconocida: %q (html, texto, pulgadas_a_cm o cm)", regla.Transformacion)
+		}
+	}
+
+	if _, err := time.LoadLocation(c.ZonaHoraria); err != nil {
+		p.error("zona_horaria", "zona desconocida: %q", c.ZonaHoraria)
+	}
+
+	if c.Admin.Token == "" {
+		p.advertencia("admin.token", "vacío: los endpoints de administración quedan deshabilitados")
+	} else if len(c.Admin.Token) < longitudMinimaTokenAdmin {
+		p.advertencia("admin.token", "tiene menos de %d caracteres", longitudMinimaTokenAdmin)
+	}
+
+	for id, clave := range c.Cifrado.Claves {
+		if _, err := decodificarClave(clave); err != nil {
+			p.error("cifrado.claves."+id, "%v", err)
+		}
+	}
+	if c.Cifrado.ClaveActiva != "" {
+		if _, ok := c.Cifrado.Claves[c.Cifrado.ClaveActiva]; !ok {
+			p.error("cifrado.clave_activa", "no existe en cifrado.claves: %q", c.Cifrado.ClaveActiva)
+		}
+		if c.Cifrado.ClaveHash == "" {
+			p.error("cifrado.clave_hash", "es obligatoria cuando hay una clave activa")
+		}
+	}
+	if c.Cifrado.ClaveHash != "" {
+		if _, err := decodificarClave(c.Cifrado.ClaveHash); err != nil {
+			p.error("cifrado.clave_hash", "%v", err)
+		}
+	}
+	if c.Verificacion.ClaveTokens != "" {
+		if _, err := decodificarClave(c.Verificacion.ClaveTokens); err != nil {
+			p.error("verificacion.clave_tokens", "%v", err)
+		}
+		if c.Verificacion.VigenciaDias <= 0 {
+			p.error("verificacion.vigencia_dias", "debe ser mayor que cero")
+		}
+		if c.Verificacion.VigenciaDiasNFC < 0 {
+			p.error("verificacion.vigencia_dias_nfc", "no puede ser negativo")
+		}
+	}
+
+	if c.Servidor.Socket == "" && (c.Servidor.Puerto < 1 || c.Servidor.Puerto > 65535) {
+		p.error("servidor.puerto", "debe estar entre 1 y 65535, es %d", c.Servidor.Puerto)
+	}
+	if c.Servidor.EsperaApagadoSegundos < 0 {
+		p.error("servidor.espera_apagado_segundos", "no puede ser negativo")
+	}
+	if c.Servidor.Socket != "" {
+		if permisos, err := strconv.ParseUint(c.Servidor.PermisosSocket, 8, 32); err != nil || permisos > 0777 {
+			p.error("servidor.permisos_socket", "debe ser un modo octal como 0660, es %q", c.Servidor.PermisosSocket)
+		}
+	}
+
+	for _, lista := range []struct {
+		campo string
+		redes []string
+	}{
+		{"acceso_admin.permitidas", c.AccesoAdmin.Permitidas},
+		{"acceso_admin.denegadas", c.AccesoAdmin.Denegadas},
+		{"acceso_admin.proxies_confiables", c.AccesoAdmin.ProxiesConfiables},
+	} {
+		if _, err := parsearRedes(lista.redes); err != nil {
+			p.error(lista.campo, "%v", err)
+		}
+	}
+
+	if c.Proteccion.FallosLogin < 0 || c.Proteccion.FallosConsulta < 0 {
+		p.error("proteccion", "los umbrales de fallos no pueden ser negativos")
+	}
+
+	for prefijo, kb := range c.Limites.Rutas {
+		campo := fmt.Sprintf("limites.rutas[%q]", prefijo)
+		if !strings.HasPrefix(prefijo, "/") {
+			p.error(campo, "la ruta debe empezar con /")
+		}
+		if kb <= 0 {
+			p.error(campo, "debe ser mayor que cero")
+		}
+	}
+	if c.Cache.ObsoletoProductosSegundos < 0 {
+		p.error("cache.obsoleto_productos_segundos", "no puede ser negativo")
+	}
+	if c.DB.MaxConexiones < 0 {
+		p.error("db.max_conexiones", "no puede ser negativo")
+	}
+	if c.Saturacion.MaxSolicitudesEnCurso < 0 {
+		p.error("saturacion.max_solicitudes_en_curso", "no puede ser negativo")
+	}
+	if c.Saturacion.EsperaDBMs < 0 {
+		p.error("saturacion.espera_db_ms", "no puede ser negativo")
+	}
+	if c.Saturacion.EsperaDBMs > 0 && c.DB.MaxConexiones == 0 {
+		p.advertencia("saturacion.espera_db_ms", "sin db.max_conexiones el pool nunca espera")
+	}
+	for i, ruta := range c.Saturacion.RutasBajaPrioridad {
+		if !strings.HasPrefix(ruta, "/") {
+			p.error(fmt.Sprintf("saturacion.rutas_baja_prioridad[%d]", i), "la ruta debe empezar con /")
+		}
+	}
+	for prefijo, segundos := range c.Limites.TiemposRutas {
+		campo := fmt.Sprintf("limites.tiempos_rutas[%q]", prefijo)
+		if !strings.HasPrefix(prefijo, "/") {
+			p.error(campo, "la ruta debe empezar con /")
+		}
+		if segundos < 0 {
+			p.error(campo, "no puede ser negativo")
+		}
+	}
+
+	if c.Interno.Direccion != "" {
+		p.requerido("interno.certificado", c.Interno.Certificado)
+		p.requerido("interno.clave", c.Interno.Clave)
+		p.requerido("interno.ca_clientes", c.Interno.CAClientes)
+		if c.Interno.Certificado != "" && c.Interno.Clave != "" {
+			if _, err := tls.LoadX509KeyPair(c.Interno.Certificado, c.Interno.Clave); err != nil {
+				p.error("interno.certificado", "%v", err)
+			}
+		}
+		if c.Interno.CAClientes != "" {
+			if pem, err := os.ReadFile(c.Interno.CAClientes); err != nil {
+				p.error("interno.ca_clientes", "%v", err)
+			} else if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+				p.error("interno.ca_clientes", "no tiene certificados PEM")
+			}
+		}
+	}
+
+	if c.Escaneos.UmbralIPs < 0 || c.Escaneos.UmbralRegiones < 0 {
+		p.error("escaneos", "los umbrales no pueden ser negativos")
+	}
+	if c.Escaneos.UmbralIPs > 0 && c.Escaneos.VentanaMinutos <= 0 {
+		p.error("escaneos.ventana_minutos", "debe ser mayor que cero")
+	}
+	if c.GeoIP.Archivo != "" {
+		if _, err := os.Stat(c.GeoIP.Archivo); err != nil {
+			p.error("geoip.archivo", "%v", err)
+		}
+	}
+
+	if c.Publico.URLBase != "" {
+		p.url("publico.url_base", c.Publico.URLBase, "http", "https")
+	} else {
+		p.advertencia("publico.url_base", "vacío: /c/, los QR, NFC, el boletín y el sitemap responderán con error")
+	}
+
+	if c.Log.Nivel != "" && c.Log.Nivel != NivelLogInfo && c.Log.Nivel != NivelLogError {
+		p.error("log.nivel", "debe ser info o error, es %q", c.Log.Nivel)
+	}
+
+	if c.Mantenimiento.Modo != "" && !modoValido(c.Mantenimiento.Modo) {
+		p.error("mantenimiento.modo", "debe ser normal, solo_lectura o mantenimiento, es %q", c.Mantenimiento.Modo)
+	}
+
+	if c.Email.Servidor != "" {
+		if _, _, err := net.SplitHostPort(c.Email.Servidor); err != nil {
+			p.error("email.servidor", "debe tener el formato host:puerto, es %q", c.Email.Servidor)
+		}
+		p.requerido("email.remitente", c.Email.Remitente)
+	}
+
+	nombresReglas := map[string]bool{}
+	for i, regla := range c.Recordatorios.Reglas {
+		campo := fmt.Sprintf("recordatorios.reglas[%d]", i)
+		p.requerido(campo+".nombre", regla.Nombre)
+		if nombresReglas[regla.Nombre] {
+			p.error(campo+".nombre", "repetido: %q", regla.Nombre)
+		}
+		nombresReglas[regla.Nombre] = true
+		if regla.Semanas <= 0 {
+			p.error(campo+".semanas", "debe ser mayor que cero")
+		}
+		if len(regla.Canales) == 0 {
+			p.error(campo+".canales", "debe indicar al menos un canal")
+		}
+		for _, canal := range regla.Canales {
+			switch canal {
+			case CanalEmail:
+				p.requerido(campo+".mensaje", regla.Mensaje)
+				if c.Email.Servidor == "" {
+					p.error("email.servidor", "es obligatorio para la regla %q", regla.Nombre)
+				}
+			case CanalWhatsApp:
+				p.requerido(campo+".plantilla_whatsapp", regla.PlantillaWhatsApp)
+				if c.WhatsApp.Token == "" || c.WhatsApp.TelefonoID == "" {
+					p.error("whatsapp", "token y telefono_id son obligatorios para la regla %q", regla.Nombre)
+				}
+			case CanalPush:
+				p.requerido(campo+".mensaje", regla.Mensaje)
+				if c.FCM.Credenciales == "" {
+					p.error("fcm.credenciales", "es obligatorio para la regla %q", regla.Nombre)
+				}
+			default:
+				p.error(campo+".canales", "canal desconocido: %q", canal)
+			}
+		}
+	}
+
+	nombresEmision := map[string]bool{}
+	for i, regla := range c.EmisionAutomatica.Reglas {
+		campo := fmt.Sprintf("emision_automatica.reglas[%d]", i)
+		p.requerido(campo+".nombre", regla.Nombre)
+		if nombresEmision[regla.Nombre] {
+			p.error(campo+".nombre", "repetido: %q", regla.Nombre)
+		}
+		nombresEmision[regla.Nombre] = true
+		if regla.TotalMinimo < 0 || regla.TotalMaximo < 0 {
+			p.error(campo, "total_minimo y total_maximo no pueden ser negativos")
+		}
+		if regla.TotalMaximo > 0 && regla.TotalMinimo > regla.TotalMaximo {
+			p.error(campo, "total_minimo es mayor que total_maximo")
+		}
+		if regla.Plantilla != "" && !reNombrePlantilla.MatchString(regla.Plantilla) {
+			p.error(campo+".plantilla", "nombre de plantilla inválido: %q", regla.Plantilla)
+		}
+		for _, notificacion := range regla.Notificaciones {
+			switch notificacion {
+			case NotificarAviso, NotificarPush:
+			case NotificarNinguna:
+				if len(regla.Notificaciones) > 1 {
+					p.error(campo+".notificaciones", "ninguna no se combina con otras")
+				}
+			default:
+				p.error(campo+".notificaciones", "notificación desconocida: %q", notificacion)
+			}
+		}
+	}
+
+	if c.Facturacion.URLProveedor != "" {
+		p.url("facturacion.url_proveedor", c.Facturacion.URLProveedor, "https")
+		p.requerido("facturacion.token_proveedor", c.Facturacion.TokenProveedor)
+		p.requerido("facturacion.nit", c.Facturacion.NIT)
+		p.requerido("facturacion.razon_social", c.Facturacion.RazonSocial)
+		p.requerido("facturacion.resolucion", c.Facturacion.Resolucion)
+		p.requerido("facturacion.clave_tecnica", c.Facturacion.ClaveTecnica)
+		if c.Facturacion.Ambiente != "1" && c.Facturacion.Ambiente != "2" {
+			p.error("facturacion.ambiente", "debe ser 1 (producción) o 2 (pruebas), es %q", c.Facturacion.Ambiente)
+		}
+		if c.Facturacion.RangoDesde <= 0 || c.Facturacion.RangoHasta < c.Facturacion.RangoDesde {
+			p.error("facturacion.rango_desde", "rango de numeración inválido: %d-%d",
+				c.Facturacion.RangoDesde, c.Facturacion.RangoHasta)
+		}
+	}
+
+	if c.Impuestos.IVAPorDefecto < 0 || c.Impuestos.IVAPorDefecto > 100 {
+		p.error("impuestos.iva_por_defecto", "debe estar entre 0 y 100, es %v", c.Impuestos.IVAPorDefecto)
+	}
+	for i, regla := range c.Impuestos.Reglas {
+		campo := fmt.Sprintf("impuestos.reglas[%d]", i)
+		p.requerido(campo+".categoria", regla.Categoria)
+		if regla.IVA < 0 || regla.IVA > 100 {
+			p.error(campo+".iva", "debe estar entre 0 y 100, es %v", regla.IVA)
+		}
+	}
+
+	if c.Pagos.URLProveedor != "" {
+		p.url("pagos.url_proveedor", c.Pagos.URLProveedor, "https")
+		p.requerido("pagos.token", c.Pagos.Token)
+	}
+
+	for i, frecuencia := range c.Reportes.Frecuencias {
+		if !frecuenciaValida(frecuencia) {
+			p.error(fmt.Sprintf("reportes.frecuencias[%d]", i), "debe ser semanal o mensual, es %q", frecuencia)
+		}
+	}
+	if len(c.Reportes.Frecuencias) > 0 {
+		if len(c.Reportes.Destinatarios) == 0 {
+			p.error("reportes.destinatarios", "es obligatorio si hay frecuencias configuradas")
+		}
+		if c.Email.Servidor == "" {
+			p.error("email.servidor", "es obligatorio para los reportes programados")
+		}
+	}
+	for i, destino := range c.Reportes.Destinatarios {
+		if _, err := mail.ParseAddress(destino); err != nil {
+			p.error(fmt.Sprintf("reportes.destinatarios[%d]", i), "email inválido: %q", destino)
+		}
+	}
+
+	if c.Envios.IntervaloMinutos < 0 {
+		p.error("envios.intervalo_minutos", "no puede ser negativo")
+	}
+	for nombre, transportadora := range c.Envios.Transportadoras {
+		campo := "envios.transportadoras." + nombre
+		if _, ok := transportadoras[nombre]; !ok {
+			p.error(campo, "transportadora no soportada")
+			continue
+		}
+		p.url(campo+".url", transportadora.URL, "https")
+	}
+
+	if c.Contacto.Captcha != "" {
+		p.advertencia("contacto.captcha", "obsoleto: usar captcha.proveedor y captcha.secreto")
+	}
+	switch c.Captcha.Proveedor {
+	case "":
+		p.advertencia("captcha.proveedor", "vacío: contacto, reportes de falsificación y consulta de envíos no verifican captcha")
+	case CaptchaRecaptcha, CaptchaTurnstile, CaptchaHcaptcha:
+		p.requerido("captcha.secreto", c.Captcha.Secreto)
+	default:
+		p.error("captcha.proveedor", "debe ser recaptcha, turnstile o hcaptcha, es %q", c.Captcha.Proveedor)
+	}
+	if c.Captcha.PuntajeMinimo < 0 || c.Captcha.PuntajeMinimo > 1 {
+		p.error("captcha.puntaje_minimo", "debe estar entre 0 y 1, es %v", c.Captcha.PuntajeMinimo)
+	} else if c.Captcha.PuntajeMinimo > 0 && c.Captcha.Proveedor != CaptchaRecaptcha {
+		p.advertencia("captcha.puntaje_minimo", "solo aplica a recaptcha")
+	}
+	for i, destino := range c.Contacto.Destinatarios {
+		if _, err := mail.ParseAddress(destino); err != nil {
+			p.error(fmt.Sprintf("contacto.destinatarios[%d]", i), "email inválido: %q", destino)
+		}
+	}
+	if len(c.Contacto.Destinatarios) > 0 && c.Email.Servidor == "" {
+		p.error("email.servidor", "es obligatorio para avisar los mensajes de contacto")
+	}
+	if c.Contacto.SlackWebhook != "" {
+		p.url("contacto.slack_webhook", c.Contacto.SlackWebhook, "https")
+	}
+
+	for i, host := range c.ProxyImagenes.Hosts {
+		if host == "" || strings.ContainsAny(host, "/:*") {
+			p.error(fmt.Sprintf("proxy_imagenes.hosts[%d]", i), "debe ser un nombre de host, es %q", host)
+		}
+	}
+	if c.ProxyImagenes.MaxAgeDias < 0 {
+		p.error("proxy_imagenes.max_age_dias", "no puede ser negativo")
+	}
+	if c.ProxyImagenes.MaxMB < 0 {
+		p.error("proxy_imagenes.max_mb", "no puede ser negativo")
+	}
+
+	if c.FCM.Credenciales != "" {
+		if _, err := cargarCredencialesFCM(c.FCM.Credenciales); err != nil {
+			p.error("fcm.credenciales", "%v", err)
+		}
+	}
+
+	switch c.Telegram.Modo {
+	case "":
+	case TelegramWebhook:
+		p.requerido("telegram.token", c.Telegram.Token)
+		p.requerido("telegram.secreto_webhook", c.Telegram.SecretoWebhook)
+	case TelegramPolling:
+		p.requerido("telegram.token", c.Telegram.Token)
+	default:
+		p.error("telegram.modo", "debe ser webhook o polling, es %q", c.Telegram.Modo)
+	}
+
+	if c.Avisos.SlackWebhook != "" {
+		p.url("avisos.slack_webhook", c.Avisos.SlackWebhook, "https")
+	}
+	if c.Avisos.TelegramToken != "" {
+		p.requerido("avisos.telegram_chat_id", c.Avisos.TelegramChatID)
+	}
+	for i, tipo := range c.Avisos.Eventos {
+		if !tipoAvisoValido(tipo) {
+			p.error(fmt.Sprintf("avisos.eventos[%d]", i), "debe ser uno de %s, es %q", strings.Join(tiposAviso, ", "), tipo)
+		}
+	}
+	if c.Avisos.HoraResumen < 0 || c.Avisos.HoraResumen > 23 {
+		p.error("avisos.hora_resumen", "debe estar entre 0 y 23")
+	}
+
+	if c.Feeds.IntervaloMinutos < 0 {
+		p.error("feeds.intervalo_minutos", "no puede ser negativo")
+	}
+	if c.Feeds.URLProducto != "" {
+		p.url("feeds.url_producto", strings.NewReplacer("{id}", "id", "{sku}", "sku").Replace(c.Feeds.URLProducto), "https")
+	} else if c.Publico.URLBase == "" {
+		p.advertencia("feeds.url_producto", "vacío y sin publico.url_base: los feeds no tendrán enlaces válidos")
+	}
+
+	if c.Monedas.URLTasas != "" {
+		p.url("monedas.url_tasas", c.Monedas.URLTasas, "https")
+	}
+	if c.Monedas.CacheMinutos < 0 {
+		p.error("monedas.cache_minutos", "no puede ser negativo")
+	}
+	for moneda, tasa := range c.Monedas.TasasRespaldo {
+		if !reMoneda.MatchString(moneda) {
+			p.error("monedas.tasas_respaldo."+moneda, "debe ser un código ISO 4217 en mayúsculas")
+		} else if tasa <= 0 {
+			p.error("monedas.tasas_respaldo."+moneda, "debe ser mayor que cero, es %v", tasa)
+		}
+	}
+
+	if c.Archivado.RetencionDias < 0 {
+		p.error("archivado.retencion_dias", "no puede ser negativo")
+	}
+	if c.Archivado.Hora < 0 || c.Archivado.Hora > 23 {
+		p.error("archivado.hora", "debe estar entre 0 y 23")
+	}
+	if c.Archivado.S3.Bucket != "" {
+		p.url("archivado.s3.endpoint", c.Archivado.S3.Endpoint, "http", "https")
+		p.requerido("archivado.s3.region", c.Archivado.S3.Region)
+		p.requerido("archivado.s3.access_key", c.Archivado.S3.AccessKey)
+		p.requerido("archivado.s3.secret_key", c.Archivado.S3.SecretKey)
+	} else if c.Archivado.RetencionDias > 0 || c.Respaldos.Diario {
+		p.requerido("archivado.directorio", c.Archivado.Directorio)
+	}
+	if c.Respaldos.Hora < 0 || c.Respaldos.Hora > 23 {
+		p.error("respaldos.hora", "debe estar entre 0 y 23")
+	}
+
+	if c.Outbox.IntervaloSegundos < 0 {
+		p.error("outbox.intervalo_segundos", "no puede ser negativo")
+	}
+	for i, webhook := range c.Outbox.Webhooks {
+		p.url(fmt.Sprintf("outbox.webhooks[%d]", i), webhook, "http", "https")
+	}
+	if len(c.Outbox.Webhooks) > 0 && c.Outbox.SecretoWebhooks == "" {
+		p.advertencia("outbox.secreto_webhooks", "vacío: los webhooks se envían sin firma verificable")
+	}
+
+	for _, secreto := range []struct{ campo, valor string }{
+		{"rocketfy.secreto_webhook", c.API.SecretoWebhook},
+		{"pagos.secreto_webhook", c.Pagos.SecretoWebhook},
+	} {
+		if secreto.valor != "" && len(secreto.valor) < longitudMinimaSecretoWebhook {
+			p.advertencia(secreto.campo, "tiene menos de %d caracteres", longitudMinimaSecretoWebhook)
+		}
+	}
+	if c.WebhooksEntrantes.ToleranciaSegundos < 0 {
+		p.error("webhooks_entrantes.tolerancia_segundos", "no puede ser negativo")
+	}
+
+	switch c.Broker.Tipo {
+	case "":
+	case "nats":
+		p.url("broker.url", c.Broker.URL, "nats")
+	case "rabbitmq":
+		p.url("broker.url", c.Broker.URL, "http", "https")
+	default:
+		p.error("broker.tipo", "debe ser nats o rabbitmq, es %q", c.Broker.Tipo)
+	}
+
+	if c.Telemetria.OTLPEndpoint != "" {
+		p.url("telemetria.otlp_endpoint", c.Telemetria.OTLPEndpoint, "http", "https")
+	}
+
+	if c.Diagnostico.Direccion != "" {
+		_, puerto, err := net.SplitHostPort(c.Diagnostico.Direccion)
+		numero, errPuerto := strconv.Atoi(puerto)
+		if err != nil || errPuerto != nil || !puertoValido(numero) {
+			p.error("diagnostico.direccion", "debe tener el formato host:puerto, es %q", c.Diagnostico.Direccion)
+		}
+	}
+
+	if c.Sentry.DSN != "" {
+		if u := p.url("sentry.dsn", c.Sentry.DSN, "http", "https"); u != nil && u.User == nil {
+			p.error("sentry.dsn", "falta la clave pública del proyecto")
+		}
+	}
+
+	if c.Compresion.TamanoMinimo < 0 {
+		p.error("compresion.tamano_minimo", "no puede ser negativo")
+	}
+
+	return p
+}
+
+// Comprobar que la base de datos configurada responde
+func comprobarBaseDatos() error {
+	db, err := sql.Open(driverMedido, cadenaConexion())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutComprobacionDB)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+func hayErroresConfig(problemas []ProblemaConfig) bool {
+	for _, problema := range problemas {
+		if !problema.Advertencia {
+			return true
+		}
+	}
+	return false
+}
+
+func imprimirProblemasConfig(w io.Writer, problemas []ProblemaConfig) {
+	for _, problema := range problemas {
+		nivel := "ERROR"
+		if problema.Advertencia {
+			nivel = "AVISO"
+		}
+		fmt.Fprintf(w, "%-5s %s: %s\n", nivel, problema.Campo, problema.Mensaje)
+	}
+}
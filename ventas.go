@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Columnas requeridas en el CSV de ventas
+var columnasVentas = []string{"nombre", "apellido", "email", "producto_id", "fecha_compra", "estado_pago"}
+
+// Formatos aceptados para fecha_compra
+var formatosFechaVenta = []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05"}
+
+// Venta histórica leída del CSV para la emisión de certificados
+type Venta struct {
+	Fila        int
+	Nombre      string
+	Apellido    string
+	Email       string
+	ProductoID  int
+	FechaCompra string
+	EstadoPago  string
+	// Opcional, normalizado a E.164
+	Telefono string
+	// Opcional; las filas con el mismo pedido forman una sola compra con un
+	// certificado que cubre todos sus productos
+	Pedido string
+	// Opcional, precio unitario en centavos; sin él se usa el de catálogo
+	Precio *int64
+
+	// Completados por validarVentas
+	ClienteID      int
+	NombreProducto string
+	Errores        []string
+}
+
+// Leer las ventas de un CSV con encabezado. Las columnas pueden venir en
+// cualquier orden. Los errores de formato de cada fila se acumulan en la
+// venta para reportarlos todos juntos.
+func leerVentasCSV(r io.Reader) ([]Venta, error) {
+	lector := csv.NewReader(r)
+	lector.TrimLeadingSpace = true
+
+	encabezado, err := lector.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Error al leer el encabezado: %v", err)
+	}
+	indices := map[string]int{}
+	for i, columna := range encabezado {
+		indices[strings.ToLower(strings.TrimSpace(columna))] = i
+	}
+	for _, columna := range columnasVentas {
+		if _, ok := indices[columna]; !ok {
+			return nil, fmt.Errorf("Falta la columna requerida: %s", columna)
+		}
+	}
+
+	var ventas []Venta
+	for fila := 2; ; fila++ {
+		registro, err := lector.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		campo := func(nombre string) string {
+			return strings.TrimSpace(registro[indices[nombre]])
+		}
+		venta := Venta{
+			Fila:        fila,
+			Nombre:      campo("nombre"),
+			Apellido:    campo("apellido"),
+			Email:       strings.ToLower(campo("email")),
+			FechaCompra: campo("fecha_compra"),
+			EstadoPago:  campo("estado_pago"),
+		}
+
+		venta.ProductoID, err = strconv.Atoi(campo("producto_id"))
+		if err != nil {
+			venta.Errores = append(venta.Errores, fmt.Sprintf("producto_id inválido: %q", campo("producto_id")))
+		}
+		if venta.Nombre == "" {
+			venta.Errores = append(venta.Errores, "nombre requerido")
+		}
+		if _, err := mail.ParseAddress(venta.Email); err != nil {
+			venta.Errores = append(venta.Errores, fmt.Sprintf("email inválido: %q", venta.Email))
+		}
+		if !fechaVentaValida(venta.FechaCompra) {
+			venta.Errores = append(venta.Errores, fmt.Sprintf("fecha_compra inválida: %q", venta.FechaCompra))
+		}
+		if venta.EstadoPago == "" {
+			venta.Errores = append(venta.Errores, "estado_pago requerido")
+		}
+		if i, ok := indices["pedido"]; ok {
+			venta.Pedido = strings.TrimSpace(registro[i])
+		}
+		if i, ok := indices["precio_unitario"]; ok && strings.TrimSpace(registro[i]) != "" {
+			precio, err := parsearMonto(registro[i])
+			if err != nil {
+				venta.Errores = append(venta.Errores, fmt.Sprintf("precio_unitario inválido: %q", strings.TrimSpace(registro[i])))
+			} else {
+				venta.Precio = &precio
+			}
+		}
+		if i, ok := indices["telefono"]; ok && strings.TrimSpace(registro[i]) != "" {
+			venta.Telefono, err = normalizarTelefono(registro[i])
+			if err != nil {
+				venta.Errores = append(venta.Errores, fmt.Sprintf("telefono inválido: %q", strings.TrimSpace(registro[i])))
+			}
+		}
+
+		ventas = append(ventas, venta)
+	}
+
+	return ventas, nil
+}
+
+func fechaVentaValida(fecha string) bool {
+	for _, formato := range formatosFechaVenta {
+		if _, err := time.Parse(formato, fecha); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Validar las ventas contra la base de datos sin escribir: verifica que el
+// producto exista, detecta filas duplicadas y resuelve los clientes
+// existentes. Devuelve la cantidad de filas con errores. Los productos y los
+// clientes se consultan de una vez para todo el archivo.
+func validarVentas(db *sql.DB, ventas []Venta) (int, error) {
+	var idsProductos []int
+	emails := make([]string, 0, len(ventas))
+	for _, venta := range ventas {
+		if venta.ProductoID > 0 {
+			idsProductos = append(idsProductos, venta.ProductoID)
+		}
+		emails = append(emails, venta.Email)
+	}
+	nombresProductos, err := nombresProductosVentas(db, idsProductos)
+	if err != nil {
+		return 0, err
+	}
+	clientes, err := buscarClientesPorEmail(db, emails)
+	if err != nil {
+		return 0, err
+	}
+
+	vistas := map[string]int{}
+	pedidos := map[string]*Venta{}
+	invalidas := 0
+
+	for i := range ventas {
+		venta := &ventas[i]
+
+		clave := fmt.Sprintf("%s|%d|%s", venta.Email, venta.ProductoID, venta.FechaCompra)
+		if fila, ok := vistas[clave]; ok {
+			venta.Errores = append(venta.Errores, fmt.Sprintf("duplicada de la fila %d", fila))
+		} else {
+			vistas[clave] = venta.Fila
+		}
+
+		// Las filas de un mismo pedido deben coincidir en cliente, fecha y
+		// estado del pago
+		if venta.Pedido != "" {
+			if primera, ok := pedidos[venta.Pedido]; !ok {
+				pedidos[venta.Pedido] = venta
+			} else if primera.Email != venta.Email || primera.FechaCompra != venta.FechaCompra || primera.EstadoPago != venta.EstadoPago {
+				venta.Errores = append(venta.Errores, fmt.Sprintf("pedido %q con email, fecha o estado distintos a la fila %d", venta.Pedido, primera.Fila))
+			}
+		}
+
+		if venta.ProductoID > 0 {
+			nombre, ok := nombresProductos[venta.ProductoID]
+			if !ok {
+				venta.Errores = append(venta.Errores, fmt.Sprintf("producto %d no existe", venta.ProductoID))
+			}
+			venta.NombreProducto = nombre
+		}
+
+		venta.ClienteID = clientes[venta.Email]
+
+		if len(venta.Errores) > 0 {
+			invalidas++
+		}
+	}
+
+	return invalidas, nil
+}
+
+// Nombres de los productos existentes entre los ids dados
+func nombresProductosVentas(db *sql.DB, ids []int) (map[int]string, error) {
+	nombres := map[int]string{}
+	if len(ids) == 0 {
+		return nombres, nil
+	}
+	rows, err := db.Query(`SELECT producto_id, nombre FROM Productos WHERE producto_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var nombre string
+		if err := rows.Scan(&id, &nombre); err != nil {
+			return nil, err
+		}
+		nombres[id] = nombre
+	}
+	return nombres, rows.Err()
+}
+
+// Cantidad de certificados que se emitirán: uno por pedido y uno por cada
+// fila sin pedido
+func certificadosVentas(ventas []Venta) int {
+	pedidos := map[string]bool{}
+	total := 0
+	for _, venta := range ventas {
+		if venta.Pedido == "" || !pedidos[venta.Pedido] {
+			total++
+		}
+		if venta.Pedido != "" {
+			pedidos[venta.Pedido] = true
+		}
+	}
+	return total
+}
+
+// Certificado de una fila del archivo de ventas; las filas de un mismo
+// pedido comparten el número
+type CertificadoVenta struct {
+	Venta  Venta
+	Numero string
+}
+
+// Emitir los certificados de todas las ventas en una única transacción;
+// si una falla no se escribe ninguna. Devuelve el certificado de cada fila,
+// en el orden de las ventas.
+func emitirCertificadosVentas(db *sql.DB, ventas []Venta) ([]CertificadoVenta, error) {
+	emitidos := make([]CertificadoVenta, 0, len(ventas))
+	err := enTransaccion(db, func(tx *sql.Tx) error {
+		type compraPedido struct {
+			compraID int
+			numero   string
+		}
+		comprasPedido := map[string]compraPedido{}
+		for _, venta := range ventas {
+			// Las filas siguientes de un pedido agregan su producto a la
+			// compra ya certificada
+			if compra, ok := comprasPedido[venta.Pedido]; ok && venta.Pedido != "" {
+				if err := insertarDetalleVenta(tx, compra.compraID, venta); err != nil {
+					return fmt.Errorf("Fila %d: %v", venta.Fila, err)
+				}
+				emitidos = append(emitidos, CertificadoVenta{Venta: venta, Numero: compra.numero})
+				continue
+			}
+
+			compraID, numero, err := emitirCertificadoVenta(tx, venta)
+			if err != nil {
+				return fmt.Errorf("Fila %d: %v", venta.Fila, err)
+			}
+			comprasPedido[venta.Pedido] = compraPedido{compraID, numero}
+			emitidos = append(emitidos, CertificadoVenta{Venta: venta, Numero: numero})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return emitidos, nil
+}
+
+// Registrar el cliente, la compra y su detalle, y emitir el certificado
+// de una venta
+func emitirCertificadoVenta(tx *sql.Tx, venta Venta) (int, string, error) {
+	// Reutilizar el cliente si ya existe con el mismo email (incluidos los
+	// creados por filas anteriores del mismo archivo)
+	clienteID, err := buscarClientePorEmail(tx, venta.Email)
+	if err == sql.ErrNoRows {
+		clienteID, err = insertarCliente(tx, venta.Nombre, venta.Apellido, venta.Email, venta.Telefono)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	var compraID int
+	err = tx.QueryRow(`
+		INSERT INTO Compras (cliente_id, fecha_compra, estado_pago)
+		VALUES ($1, $2, $3)
+		RETURNING compra_id`, clienteID, venta.FechaCompra, venta.EstadoPago).Scan(&compraID)
+	if err != nil {
+		return 0, "", err
+	}
+	err = registrarEventoOutbox(tx, EventoCompraRegistrada, EventoCompra{
+		CompraID:   compraID,
+		ClienteID:  clienteID,
+		EstadoPago: venta.EstadoPago,
+		Origen:     OrigenCompraVentas,
+		Fecha:      time.Now(),
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := insertarDetalleVenta(tx, compraID, venta); err != nil {
+		return 0, "", err
+	}
+
+	numero, err := emitirCertificadoTx(tx, compraID)
+	return compraID, numero, err
+}
+
+func insertarDetalleVenta(tx *sql.Tx, compraID int, venta Venta) error {
+	_, err := tx.Exec(`
+		INSERT INTO DetallesCompra (compra_id, producto_id, precio_unitario)
+		VALUES ($1, $2, `+fmt.Sprintf(sqlPrecioLinea, "$3", "$2")+`)`, compraID, venta.ProductoID, venta.Precio)
+	return err
+}
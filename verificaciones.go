@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Registro de las verificaciones públicas de certificados y reporte de la
+// tasa de verificación por producto. Las verificaciones se cuentan por
+// día y canal para no crecer una fila por consulta.
+
+// Canales de verificación
+const (
+	VerificacionAPI      = "api"
+	VerificacionWeb      = "web"
+	VerificacionGraphQL  = "graphql"
+	VerificacionTelegram = "telegram"
+	VerificacionQR       = "qr"
+)
+
+// Tasa de verificación de los certificados de un producto emitidos en el
+// período
+type VerificacionProducto struct {
+	ProductoID              int     `json:"producto_id"`
+	Nombre                  string  `json:"nombre"`
+	CertificadosEmitidos    int     `json:"certificados_emitidos"`
+	CertificadosVerificados int     `json:"certificados_verificados"`
+	Verificaciones          int64   `json:"verificaciones"`
+	Tasa                    float64 `json:"tasa"`
+}
+
+func incrementarVerificacion(db *sql.DB, numeroCertificado, canal string) error {
+	sentencia, err := sentenciaPreparada(db, `
+		INSERT INTO Verificaciones (numero_certificado, dia, canal, cantidad)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (numero_certificado, dia, canal) DO UPDATE SET cantidad = Verificaciones.cantidad + 1`)
+	if err != nil {
+		return err
+	}
+	_, err = sentencia.Exec(numeroCertificado, time.Now().In(zonaHoraria).Format("2006-01-02"), canal)
+	return err
+}
+
+// Contar una verificación en segundo plano; un error no afecta la
+// respuesta al cliente
+func contarVerificacion(numeroCertificado, canal string) {
+	if escriturasBloqueadas() {
+		return
+	}
+	go func() {
+		if err := registrarVerificacion(numeroCertificado, canal); err != nil {
+			log.Println("Error al registrar la verificación:", err)
+		}
+	}()
+}
+
+// Certificados emitidos en [desde, hasta) por producto, cuántos fueron
+// verificados alguna vez y el total de verificaciones
+func consultarTasaVerificacion(db *sql.DB, desde, hasta time.Time) ([]VerificacionProducto, error) {
+	rows, err := db.Query(`
+		SELECT p.producto_id, p.nombre,
+			count(DISTINCT cer.certificado_id),
+			count(DISTINCT cer.certificado_id) FILTER (WHERE v.cantidad IS NOT NULL),
+			coalesce(sum(v.cantidad), 0)
+		FROM Certificados cer
+		JOIN Compras com ON com.certificado_id = cer.certificado_id
+		JOIN DetallesCompra dc ON dc.compra_id = com.compra_id
+		JOIN Productos p ON p.producto_id = dc.producto_id
+		LEFT JOIN (
+			SELECT numero_certificado, sum(cantidad) AS cantidad
+			FROM Verificaciones
+			GROUP BY numero_certificado
+		) v ON v.numero_certificado = cer.numero_certificado
+		WHERE cer.fecha_emision >= $1 AND cer.fecha_emision < $2
+		GROUP BY p.producto_id, p.nombre
+		ORDER BY count(DISTINCT cer.certificado_id) DESC, p.nombre`, desde, hasta)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	productos := []VerificacionProducto{}
+	for rows.Next() {
+		var p VerificacionProducto
+		err := rows.Scan(&p.ProductoID, &p.Nombre, &p.CertificadosEmitidos, &p.CertificadosVerificados, &p.Verificaciones)
+		if err != nil {
+			return nil, err
+		}
+		if p.CertificadosEmitidos > 0 {
+			p.Tasa = float64(p.CertificadosVerificados) / float64(p.CertificadosEmitidos)
+		}
+		productos = append(productos, p)
+	}
+	return productos, rows.Err()
+}
+
+// Handler para GET /admin/estadisticas/verificaciones?desde=...&hasta=...
+func tasaVerificacionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	desde, hasta, err := rangoFechasSolicitud(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	productos, err := obtenerTasaVerificacion(r.Context(), desde, hasta)
+	if err != nil {
+		http.Error(w, "Error al calcular la tasa de verificación", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"desde":     desde.Format(formatoFechaEstadisticas),
+		"hasta":     hasta.AddDate(0, 0, -1).Format(formatoFechaEstadisticas),
+		"productos": productos,
+	})
+}
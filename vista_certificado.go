@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // Decodificar imágenes de productos en JPEG
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Página HTML pública de un certificado (/c/{numero}) con etiquetas Open
+// Graph y una imagen de vista previa generada (/c/{numero}/og.png), para
+// compartir el certificado en Instagram o WhatsApp.
+
+// Tamaño recomendado para las imágenes Open Graph
+const (
+	anchoImagenOG = 1200
+	altoImagenOG  = 630
+)
+
+// Límites para descargar la foto del producto
+const (
+	timeoutImagenProducto = 5 * time.Second
+	tamanoMaximoImagen    = 5 << 20
+)
+
+// Paleta de la marca
+var (
+	colorFondoOG    = color.RGBA{0xF7, 0xF1, 0xEA, 0xFF}
+	colorTextoOG    = color.RGBA{0x3B, 0x2A, 0x20, 0xFF}
+	colorAcentoOG   = color.RGBA{0xB0, 0x8D, 0x57, 0xFF}
+	colorValidoOG   = color.RGBA{0x2E, 0x6B, 0x3A, 0xFF}
+	colorRevocadoOG = color.RGBA{0xA4, 0x26, 0x2C, 0xFF}
+)
+
+// Datos de la página del certificado
+type vistaCertificado struct {
+	Titulo      string
+	Descripcion string
+	URL         string
+	Imagen      string
+	AnchoImagen int
+	AltoImagen  int
+	Certificado CertificadoPublico
+}
+
+// URL pública del sitio según publico.url_base. No se deriva de Host ni de
+// X-Forwarded-Proto: los controla el cliente y acabarían en las páginas
+// compartidas o en caché.
+func urlBasePublica() (string, error) {
+	base := strings.TrimSuffix(configActual().Publico.URLBase, "/")
+	if base == "" {
+		return "", errSinURLBase
+	}
+	return base, nil
+}
+
+func textoOVacio(valor *string) string {
+	if valor == nil {
+		return ""
+	}
+	return *valor
+}
+
+// Nombres de los productos de un certificado: "A", "A y B", "A, B y C"
+func nombresProductos(productos []ProductoCertificado) string {
+	var nombres []string
+	for _, producto := range productos {
+		if nombre := textoOVacio(producto.Nombre); nombre != "" {
+			nombres = append(nombres, nombre)
+		}
+	}
+	if len(nombres) <= 1 {
+		return strings.Join(nombres, "")
+	}
+	return strings.Join(nombres[:len(nombres)-1], ", ") + " y " + nombres[len(nombres)-1]
+}
+
+// Handler para /c/{numero} y /c/{numero}/og.png; con los tokens de
+// verificación activos en lugar del número va el token
+func vistaCertificadoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/c/"), "/")
+	clave, recurso, _ := strings.Cut(ruta, "/")
+	if clave == "" || (recurso != "" && recurso != "og.png") {
+		http.NotFound(w, r)
+		return
+	}
+
+	numero, token := clave, ""
+	if esTokenVerificacion(clave) {
+		numero, token = "", clave
+	}
+	numero, err := numeroVerificacionPublica(r, numero, token)
+	if err != nil {
+		responderErrorVerificacion(w, r, err, clave, VerificacionWeb)
+		return
+	}
+
+	responderPaginaCertificado(w, r, numero, recurso, VerificacionWeb)
+}
+
+// Responder la página del certificado o su imagen og.png, contando la
+// verificación en el canal dado
+func responderPaginaCertificado(w http.ResponseWriter, r *http.Request, numero, recurso, canal string) {
+	data, err := obtenerCertificado(r.Context(), numero)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			certificadoNoEncontrado(r, numero, canal)
+			http.Error(w, "Certificado no encontrado", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+		}
+		logSolicitud(r.Context(), err)
+		return
+	}
+	certificado := certificadoPublico(data)
+
+	if recurso == "og.png" {
+		img := generarImagenOG(r.Context(), certificado)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			http.Error(w, "Error al generar la imagen", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	plantilla, err := plantillaDeCertificado(r.Context(), textoOVacio(data.Plantilla))
+	if err != nil {
+		http.Error(w, "Error al cargar la plantilla", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	contarVerificacionSolicitud(r, data.NumeroCertificado, canal)
+	responderVistaCertificado(w, r, plantilla, certificado)
+}
+
+// Renderizar la página de un certificado con la plantilla dada
+func responderVistaCertificado(w http.ResponseWriter, r *http.Request, plantilla *template.Template, certificado CertificadoPublico) {
+	base, err := urlBasePublica()
+	if err != nil {
+		http.Error(w, "Error al generar la página", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	ruta := rutaPaginaCertificado(certificado.NumeroCertificado)
+	vista := vistaCertificado{
+		Titulo:      "Certificado de autenticidad " + certificado.NumeroCertificado,
+		URL:         base + ruta,
+		Imagen:      base + ruta + "/og.png",
+		AnchoImagen: anchoImagenOG,
+		AltoImagen:  altoImagenOG,
+		Certificado: certificado,
+	}
+	if certificado.Revocado {
+		vista.Descripcion = "Este certificado fue revocado."
+	} else if certificado.ReemplazadoPor != nil {
+		vista.Descripcion = "Este certificado fue reemplazado por " + *certificado.ReemplazadoPor + "."
+	} else {
+		vista.Descripcion = strings.TrimSpace("Producto original Melenas Co. " + nombresProductos(certificado.Productos))
+	}
+
+	var buf bytes.Buffer
+	if err := plantilla.Execute(&buf, vista); err != nil {
+		http.Error(w, "Error al generar la página", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", cacheCertificados)
+	w.Write(buf.Bytes())
+}
+
+// Generar la imagen de vista previa: foto del producto a la izquierda (si
+// se puede descargar) y los datos del certificado a la derecha
+func generarImagenOG(ctx context.Context, certificado CertificadoPublico) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, anchoImagenOG, altoImagenOG))
+	draw.Draw(img, img.Bounds(), &image.Uniform{colorFondoOG}, image.Point{}, draw.Src)
+
+	panel := image.Rect(0, 0, altoImagenOG, altoImagenOG)
+	draw.Draw(img, panel, &image.Uniform{colorAcentoOG}, image.Point{}, draw.Src)
+	if url := textoOVacio(certificado.ImagenURL); url != "" {
+		foto, err := descargarImagen(ctx, url)
+		if err != nil {
+			logSolicitud(ctx, "No se pudo usar la imagen del producto:", err)
+		} else {
+			dibujarCubriendo(img, panel, foto)
+		}
+	}
+
+	// Marco
+	borde := 12
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, anchoImagenOG, borde),
+		image.Rect(0, altoImagenOG-borde, anchoImagenOG, altoImagenOG),
+		image.Rect(anchoImagenOG-borde, 0, anchoImagenOG, altoImagenOG),
+		image.Rect(0, 0, borde, altoImagenOG),
+	} {
+		draw.Draw(img, r, &image.Uniform{colorAcentoOG}, image.Point{}, draw.Src)
+	}
+
+	x, y := altoImagenOG+40, 60
+	anchoDisponible := anchoImagenOG - x - 40
+	dibujarTexto(img, x, y, "Melenas Co", 4, colorAcentoOG)
+	y += 60
+	dibujarTexto(img, x, y, "Certificado de", 3, colorTextoOG)
+	y += 32
+	dibujarTexto(img, x, y, "autenticidad", 3, colorTextoOG)
+	y += 60
+	dibujarTexto(img, x, y, certificado.NumeroCertificado, 5, colorTextoOG)
+	y += 70
+
+	lineas := partirTexto(nombresProductos(certificado.Productos), 3, anchoDisponible)
+	if len(lineas) > 4 {
+		lineas = lineas[:4]
+		lineas[3] += "..."
+	}
+	for _, linea := range lineas {
+		dibujarTexto(img, x, y, linea, 3, colorTextoOG)
+		y += 32
+	}
+
+	estado, colorEstado := "Original", colorValidoOG
+	if certificado.Revocado {
+		estado, colorEstado = "Revocado", colorRevocadoOG
+	}
+	dibujarTexto(img, x, altoImagenOG-100, estado, 6, colorEstado)
+
+	return img
+}
+
+// Descargar y decodificar la foto de un producto (JPEG o PNG)
+func descargarImagen(ctx context.Context, url string) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeoutImagenProducto)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("la imagen respondió con código de estado: %d", resp.StatusCode)
+	}
+
+	img, _, err := image.Decode(io.LimitReader(resp.Body, tamanoMaximoImagen))
+	return img, err
+}
+
+// Dibujar una imagen escalada para cubrir el rectángulo destino, recortando
+// lo que sobra (muestreo por vecino más cercano)
+func dibujarCubriendo(destino *image.RGBA, rect image.Rectangle, origen image.Image) {
+	limites := origen.Bounds()
+	if limites.Dx() == 0 || limites.Dy() == 0 {
+		return
+	}
+
+	// Escala que cubre el rectángulo en ambas dimensiones
+	escala := float64(rect.Dx()) / float64(limites.Dx())
+	if alto := float64(rect.Dy()) / float64(limites.Dy()); alto > escala {
+		escala = alto
+	}
+	desplazamientoX := (float64(limites.Dx())*escala - float64(rect.Dx())) / 2
+	desplazamientoY := (float64(limites.Dy())*escala - float64(rect.Dy())) / 2
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		origenY := limites.Min.Y + int((float64(y-rect.Min.Y)+desplazamientoY)/escala)
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			origenX := limites.Min.X + int((float64(x-rect.Min.X)+desplazamientoX)/escala)
+			destino.Set(x, y, origen.At(origenX, origenY))
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Registro de entregas de webhooks: cada intento, entrante (pedidos de
+// Rocketfy, estados del proveedor de pagos) o saliente (eventos del
+// outbox), se guarda en EntregasWebhooks con el payload, el código de
+// estado y la respuesta. Los administradores los consultan en
+// /admin/webhooks/entregas y reintentan los fallidos: un entrante se vuelve
+// a procesar con el payload guardado y un saliente se reenvía a su URL con
+// una firma nueva. Los webhooks entrantes con firma inválida o que no son
+// JSON no se registran.
+
+// Dirección de una entrega
+const (
+	WebhookEntrante = "entrante"
+	WebhookSaliente = "saliente"
+)
+
+// Orígenes de los webhooks entrantes
+const (
+	OrigenWebhookRocketfy = "rocketfy"
+	OrigenWebhookPagos    = "pagos"
+)
+
+const (
+	maxCuerpoWebhook = 1 << 20
+	// Bytes de la respuesta que se guardan de cada entrega
+	maxRespuestaEntrega      = 4 << 10
+	timeoutWebhookSaliente   = 10 * time.Second
+	limiteEntregasPorDefecto = 50
+	limiteEntregasMaximo     = 500
+)
+
+var (
+	errEntregaInexistente   = errors.New("Entrega no encontrada")
+	errEntregaExitosa       = errors.New("La entrega no falló; solo se reintentan las fallidas")
+	errWebhookNoConfigurado = errors.New("El webhook ya no está configurado")
+)
+
+var (
+	clienteWebhooks  = &http.Client{Timeout: timeoutWebhookSaliente}
+	entregasFallidas uint64
+)
+
+func init() {
+	registrarMetricaCalculada("melenas_webhooks_entregas_fallidas_total",
+		"Entregas de webhooks entrantes o salientes que fallaron", "counter",
+		func() float64 { return float64(atomic.LoadUint64(&entregasFallidas)) })
+}
+
+// Intento de entrega de un webhook
+type EntregaWebhook struct {
+	ID        int64  `json:"id"`
+	Direccion string `json:"direccion"`
+	// rocketfy o pagos para los entrantes, la URL para los salientes
+	Origen string `json:"origen"`
+	Tipo   string `json:"tipo"`
+	// Solo en el detalle de una entrega
+	Payload      string  `json:"payload,omitempty"`
+	Exitosa      bool    `json:"exitosa"`
+	CodigoEstado *int    `json:"codigo_estado"`
+	Respuesta    *string `json:"respuesta"`
+	Error        *string `json:"error"`
+	DuracionMs   int     `json:"duracion_ms"`
+	// Entrega original de un reintento manual
+	ReintentoDe *int64 `json:"reintento_de"`
+	CreadoEn    Fecha  `json:"creado_en"`
+}
+
+// Filtros del listado de entregas
+type filtroEntregas struct {
+	direccion string
+	origen    string
+	fallidas  bool
+	// Para paginar: entregas con identificador menor
+	antesDe int64
+	limite  int
+}
+
+// Rechazo de un webhook entrante por su contenido; se responde 422 y se
+// puede reintentar cuando se corrija el problema (p. ej. un SKU nuevo)
+type rechazoWebhook string
+
+func (r rechazoWebhook) Error() string { return string(r) }
+
+// Webhook entrante: su clave de firma y cómo se procesa
+type webhookEntrante struct {
+	secreto  func(c Config) string
+	procesar func(db *sql.DB, payload []byte) (interface{}, error)
+}
+
+var webhooksEntrantes = map[string]webhookEntrante{
+	OrigenWebhookRocketfy: {func(c Config) string { return c.API.SecretoWebhook }, procesarWebhookRocketfy},
+	OrigenWebhookPagos:    {func(c Config) string { return c.Pagos.SecretoWebhook }, procesarWebhookPagos},
+}
+
+// Tipo de evento de un webhook entrante, si el payload lo trae
+func tipoWebhookEntrante(payload []byte) string {
+	var datos map[string]interface{}
+	if json.Unmarshal(payload, &datos) != nil {
+		return ""
+	}
+	return textoRocketfy(datos, "event", "type", "tipo", "estado")
+}
+
+// Pedido creado o actualizado en Rocketfy, solo o dentro de "data"; se
+// guarda igual que en melenas sync orders
+func procesarWebhookRocketfy(db *sql.DB, payload []byte) (interface{}, error) {
+	var datos map[string]interface{}
+	if err := json.Unmarshal(payload, &datos); err != nil {
+		return nil, rechazoWebhook("JSON inválido")
+	}
+	if pedido, ok := datos["data"].(map[string]interface{}); ok {
+		datos = pedido
+	}
+
+	resumen := ResumenRocketfy{Recibidos: 1}
+	err := enTransaccion(db, func(tx *sql.Tx) error {
+		return guardarPedidosRocketfy(tx, []map[string]interface{}{datos}, &resumen)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resumen.Omitidos) > 0 {
+		return nil, rechazoWebhook(strings.Join(resumen.Omitidos, "; "))
+	}
+	return resumen, nil
+}
+
+// Resultado de un webhook de estado de pago
+type ResultadoWebhookPago struct {
+	CompraID           int    `json:"compra_id"`
+	EstadoPago         string `json:"estado_pago"`
+	Actualizada        bool   `json:"actualizada"`
+	CertificadoEmitido bool   `json:"certificado_emitido"`
+}
+
+// Cambio de estado de un pago, {"referencia": "...", "estado": "approved"},
+// para la compra con esa referencia_pago
+func procesarWebhookPagos(db *sql.DB, payload []byte) (interface{}, error) {
+	var notificacion struct {
+		Referencia string `json:"referencia"`
+		Estado     string `json:"estado"`
+	}
+	if err := json.Unmarshal(payload, &notificacion); err != nil || notificacion.Referencia == "" || notificacion.Estado == "" {
+		return nil, rechazoWebhook("se requieren referencia y estado")
+	}
+	// El proveedor usa las mismas palabras que Rocketfy para los estados
+	nuevo, ok := estadosPagoRocketfy[strings.ToLower(notificacion.Estado)]
+	if !ok {
+		nuevo = estadoPagoPendiente
+	}
+
+	var resultado ResultadoWebhookPago
+	err := enTransaccion(db, func(tx *sql.Tx) error {
+		var estado sql.NullString
+		var certificadoID sql.NullInt64
+		err := tx.QueryRow(`
+			SELECT compra_id, estado_pago, certificado_id FROM Compras
+			WHERE referencia_pago = $1
+			FOR UPDATE`, notificacion.Referencia).Scan(&resultado.CompraID, &estado, &certificadoID)
+		if err == sql.ErrNoRows {
+			return rechazoWebhook("no hay una compra con la referencia " + notificacion.Referencia)
+		}
+		if err != nil {
+			return err
+		}
+		resultado.Actualizada, resultado.CertificadoEmitido, err = aplicarEstadoPagoTx(tx, resultado.CompraID, estado, certificadoID, nuevo, strings.ToLower(notificacion.Estado))
+		resultado.EstadoPago = estado.String
+		if resultado.Actualizada {
+			resultado.EstadoPago = nuevo
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resultado, nil
+}
+
+// Procesar un webhook entrante, registrar la entrega y anotar el resultado
+// en la cola de fallidos (webhooks_fallidos.go); devuelve también el cuerpo
+// de la respuesta
+func atenderWebhookEntrante(ctx context.Context, origen string, payload []byte, reintentoDe *int64) (*EntregaWebhook, []byte) {
+	inicio := time.Now()
+	entrega := &EntregaWebhook{
+		Direccion:   WebhookEntrante,
+		Origen:      origen,
+		Tipo:        tipoWebhookEntrante(payload),
+		Payload:     string(payload),
+		ReintentoDe: reintentoDe,
+	}
+
+	var respuesta interface{}
+	db, err := poolBaseDatos()
+	if err == nil {
+		err = trazarConsulta(ctx, "webhook_"+origen, func() error {
+			var err error
+			respuesta, err = webhooksEntrantes[origen].procesar(db, payload)
+			return err
+		})
+	}
+	codigo := http.StatusOK
+	if rechazo, ok := err.(rechazoWebhook); ok {
+		codigo = http.StatusUnprocessableEntity
+		respuesta = map[string]string{"error": rechazo.Error()}
+	} else if err != nil {
+		codigo = http.StatusInternalServerError
+		respuesta = map[string]string{"error": "Error al procesar el webhook"}
+		logSolicitud(ctx, "Webhook de", origen+":", err)
+	}
+	cuerpo, _ := json.Marshal(respuesta)
+
+	terminarEntrega(ctx, entrega, inicio, codigo, cuerpo, err)
+	anotarResultadoWebhook(ctx, entrega, payload, err)
+	publicarEvento(EventoWebhookRecibido, map[string]interface{}{
+		"origen":     origen,
+		"entrega_id": entrega.ID,
+		"exitosa":    entrega.Exitosa,
+	})
+	return entrega, cuerpo
+}
+
+// Enviar un evento a un webhook saliente y registrar la entrega
+func entregarWebhookSaliente(url, tipo string, cuerpo []byte, reintentoDe *int64) (*EntregaWebhook, error) {
+	inicio := time.Now()
+	entrega := &EntregaWebhook{
+		Direccion:   WebhookSaliente,
+		Origen:      url,
+		Tipo:        tipo,
+		Payload:     string(cuerpo),
+		ReintentoDe: reintentoDe,
+	}
+	codigo, respuesta, err := enviarWebhook(url, tipo, cuerpo)
+	terminarEntrega(context.Background(), entrega, inicio, codigo, respuesta, err)
+	return entrega, err
+}
+
+// POST firmado a un webhook externo; devuelve el código y el inicio de la
+// respuesta aunque no sea 2xx
+func enviarWebhook(url, tipo string, cuerpo []byte) (int, []byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(cuerpo))
+	if err != nil {
+		return 0, nil, fmt.Errorf("Error al crear la solicitud: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Melenas-Evento", tipo)
+	if secreto := configActual().Outbox.SecretoWebhooks; secreto != "" {
+		req.Header.Set("X-Melenas-Firma", "sha256="+firmarWebhook(secreto, cuerpo))
+	}
+
+	resp, err := clienteWebhooks.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Error al hacer la solicitud a %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	respuesta, _ := io.ReadAll(io.LimitReader(resp.Body, maxRespuestaEntrega))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, respuesta, fmt.Errorf("Webhook %s respondió con código de estado: %d", url, resp.StatusCode)
+	}
+	return resp.StatusCode, respuesta, nil
+}
+
+// Completar el resultado de una entrega y guardarla; si no se puede
+// guardar solo queda en el log
+func terminarEntrega(ctx context.Context, entrega *EntregaWebhook, inicio time.Time, codigo int, respuesta []byte, err error) {
+	entrega.DuracionMs = int(time.Since(inicio) / time.Millisecond)
+	entrega.Exitosa = err == nil
+	if codigo != 0 {
+		entrega.CodigoEstado = &codigo
+	}
+	if respuesta != nil {
+		if len(respuesta) > maxRespuestaEntrega {
+			respuesta = respuesta[:maxRespuestaEntrega]
+		}
+		texto := strings.ToValidUTF8(string(respuesta), "")
+		entrega.Respuesta = &texto
+	}
+	if err != nil {
+		texto := err.Error()
+		entrega.Error = &texto
+		atomic.AddUint64(&entregasFallidas, 1)
+	}
+
+	if err := registrarEntregaWebhook(ctx, entrega); err != nil {
+		logSolicitud(ctx, "Error al registrar la entrega del webhook:", err)
+	}
+}
+
+// Guardar una entrega y completar su identificador y fecha
+func guardarEntregaWebhook(db *sql.DB, entrega *EntregaWebhook) error {
+	return db.QueryRow(`
+		INSERT INTO EntregasWebhooks
+			(direccion, origen, tipo, payload, exitosa, codigo_estado, respuesta, error, duracion_ms, reintento_de)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING entrega_id, creado_en`,
+		entrega.Direccion, entrega.Origen, entrega.Tipo, entrega.Payload, entrega.Exitosa, entrega.CodigoEstado,
+		entrega.Respuesta, entrega.Error, entrega.DuracionMs, entrega.ReintentoDe).
+		Scan(&entrega.ID, &entrega.CreadoEn)
+}
+
+// Entregas más recientes primero, sin el payload
+func consultarEntregasWebhooks(db *sql.DB, filtro filtroEntregas) ([]EntregaWebhook, error) {
+	rows, err := db.Query(`
+		SELECT entrega_id, direccion, origen, tipo, exitosa, codigo_estado, respuesta, error,
+			duracion_ms, reintento_de, creado_en
+		FROM EntregasWebhooks
+		WHERE ($1 = '' OR direccion = $1)
+			AND ($2 = '' OR origen = $2)
+			AND (NOT exitosa OR NOT $3)
+			AND ($4 = 0 OR entrega_id < $4)
+		ORDER BY entrega_id DESC
+		LIMIT $5`, filtro.direccion, filtro.origen, filtro.fallidas, filtro.antesDe, filtro.limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entregas := []EntregaWebhook{}
+	for rows.Next() {
+		var e EntregaWebhook
+		err := rows.Scan(&e.ID, &e.Direccion, &e.Origen, &e.Tipo, &e.Exitosa, &e.CodigoEstado, &e.Respuesta,
+			&e.Error, &e.DuracionMs, &e.ReintentoDe, &e.CreadoEn)
+		if err != nil {
+			return nil, err
+		}
+		entregas = append(entregas, e)
+	}
+	return entregas, rows.Err()
+}
+
+// Una entrega con su payload
+func consultarEntregaWebhook(db *sql.DB, id int64) (*EntregaWebhook, error) {
+	var e EntregaWebhook
+	err := db.QueryRow(`
+		SELECT entrega_id, direccion, origen, tipo, payload, exitosa, codigo_estado, respuesta, error,
+			duracion_ms, reintento_de, creado_en
+		FROM EntregasWebhooks
+		WHERE entrega_id = $1`, id).
+		Scan(&e.ID, &e.Direccion, &e.Origen, &e.Tipo, &e.Payload, &e.Exitosa, &e.CodigoEstado, &e.Respuesta,
+			&e.Error, &e.DuracionMs, &e.ReintentoDe, &e.CreadoEn)
+	if err == sql.ErrNoRows {
+		return nil, errEntregaInexistente
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Handler para POST /webhooks/{origen}; la firma ya la verificó
+// verificarFirmaWebhook (firmas_webhooks.go)
+func webhookEntranteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	cuerpo, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "No se pudo leer el cuerpo", http.StatusBadRequest)
+		return
+	}
+	if !json.Valid(cuerpo) {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+
+	entrega, respuesta := atenderWebhookEntrante(r.Context(), origenWebhook(r.URL.Path), cuerpo, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(*entrega.CodigoEstado)
+	w.Write(respuesta)
+}
+
+// Código HTTP para los errores de las entregas
+func estadoErrorEntrega(err error) int {
+	switch err {
+	case errEntregaInexistente:
+		return http.StatusNotFound
+	case errEntregaExitosa, errWebhookNoConfigurado:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func responderErrorEntrega(w http.ResponseWriter, r *http.Request, err error, mensaje string) {
+	estado := estadoErrorEntrega(err)
+	if estado == http.StatusInternalServerError {
+		http.Error(w, mensaje, estado)
+	} else {
+		http.Error(w, err.Error(), estado)
+	}
+	logSolicitud(r.Context(), err)
+}
+
+// Filtros de ?direccion=entrante|saliente&origen=...&fallidas=true&antes_de=id&limite=n
+func leerFiltroEntregas(r *http.Request) (filtroEntregas, error) {
+	q := r.URL.Query()
+	filtro := filtroEntregas{
+		direccion: q.Get("direccion"),
+		origen:    q.Get("origen"),
+		fallidas:  q.Get("fallidas") == "true",
+		limite:    limiteEntregasPorDefecto,
+	}
+	if filtro.direccion != "" && filtro.direccion != WebhookEntrante && filtro.direccion != WebhookSaliente {
+		return filtro, errors.New("direccion debe ser entrante o saliente")
+	}
+	if valor := q.Get("antes_de"); valor != "" {
+		n, err := strconv.ParseInt(valor, 10, 64)
+		if err != nil || n <= 0 {
+			return filtro, errors.New("antes_de debe ser un identificador de entrega")
+		}
+		filtro.antesDe = n
+	}
+	if valor := q.Get("limite"); valor != "" {
+		n, err := strconv.Atoi(valor)
+		if err != nil || n <= 0 || n > limiteEntregasMaximo {
+			return filtro, fmt.Errorf("limite debe estar entre 1 y %d", limiteEntregasMaximo)
+		}
+		filtro.limite = n
+	}
+	return filtro, nil
+}
+
+// Handler para GET /admin/webhooks/entregas, GET
+// /admin/webhooks/entregas/{id} y POST /admin/webhooks/entregas/{id}/reintentar
+func entregasWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/webhooks/entregas"), "/")
+	if ruta == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		filtro, err := leerFiltroEntregas(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entregas, err := obtenerEntregasWebhooks(r.Context(), filtro)
+		if err != nil {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entregas)
+		return
+	}
+
+	id, accion, _ := strings.Cut(ruta, "/")
+	entregaID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || entregaID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var entrega *EntregaWebhook
+	switch accion {
+	case "":
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		entrega, err = obtenerEntregaWebhook(r.Context(), entregaID)
+	case "reintentar":
+		if r.Method != "POST" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		entrega, err = reintentarEntregaWebhook(r.Context(), entregaID)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		responderErrorEntrega(w, r, err, "Error al consultar la entrega")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if accion == "reintentar" && !entrega.Exitosa {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(entrega)
+}
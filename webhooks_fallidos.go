@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cola de mensajes fallidos (dead letter) de los webhooks entrantes: un
+// pedido pagado que no se pudo guardar no puede perderse en silencio. Cada
+// webhook que falla queda en WebhooksFallidos con su payload y el error, y
+// una goroutine lo reintenta con espera creciente hasta
+// webhooks_fallidos.max_intentos; agotados los reintentos se avisa al
+// equipo. Si el proveedor reenvía el mismo payload no se duplica, y si
+// alguna entrega (del proveedor, manual o de la cola) se procesa bien, la
+// entrada queda resuelta.
+
+const (
+	intervaloWebhooksFallidos = time.Minute
+	// Espera antes del primer reintento; se duplica en cada uno
+	esperaBaseWebhookFallido   = time.Minute
+	esperaMaximaWebhookFallido = 6 * time.Hour
+	// Mientras se reintenta una entrada su próximo intento se corre este
+	// tiempo para que otra instancia no la tome
+	reservaWebhookFallido        = 10 * time.Minute
+	loteWebhooksFallidos         = 20
+	maxIntentosWebhookPorDefecto = 10
+)
+
+// Estados de una entrada de la cola
+const (
+	WebhookFallidoPendiente  = "pendiente"
+	WebhookFallidoAgotado    = "agotado"
+	WebhookFallidoResuelto   = "resuelto"
+	WebhookFallidoDescartado = "descartado"
+)
+
+var errWebhookFallidoInexistente = errors.New("Webhook fallido no encontrado o ya resuelto")
+
+// Webhook entrante en la cola de fallidos
+type WebhookFallido struct {
+	ID      int64  `json:"id"`
+	Origen  string `json:"origen"`
+	Payload string `json:"payload"`
+	Error   string `json:"error"`
+	// Primera entrega fallida en /admin/webhooks/entregas
+	EntregaID      *int64 `json:"entrega_id"`
+	Intentos       int    `json:"intentos"`
+	ProximoIntento *Fecha `json:"proximo_intento"`
+	Estado         string `json:"estado"`
+	ResueltoEn     *Fecha `json:"resuelto_en"`
+	CreadoEn       Fecha  `json:"creado_en"`
+	ActualizadoEn  Fecha  `json:"actualizado_en"`
+}
+
+func hashWebhook(payload []byte) string {
+	suma := sha256.Sum256(payload)
+	return hex.EncodeToString(suma[:])
+}
+
+// Espera antes del siguiente reintento tras intentos fallidos: 1, 2, 4...
+// minutos hasta 6 horas
+func esperaWebhookFallido(intentos int) time.Duration {
+	espera := esperaBaseWebhookFallido
+	for i := 0; i < intentos && espera < esperaMaximaWebhookFallido; i++ {
+		espera *= 2
+	}
+	if espera > esperaMaximaWebhookFallido {
+		espera = esperaMaximaWebhookFallido
+	}
+	return espera
+}
+
+// Poner en la cola un webhook que falló o, si ya estaba, actualizar su
+// error sin cambiar el calendario de reintentos
+func guardarWebhookFallido(db ejecutorConsultas, origen string, payload []byte, mensaje string, entregaID *int64) error {
+	_, err := db.Exec(`
+		INSERT INTO WebhooksFallidos (origen, hash, payload, error, entrega_id, proximo_intento)
+		VALUES ($1, $2, $3, $4, $5, now() + $6 * interval '1 second')
+		ON CONFLICT (origen, hash) WHERE resuelto_en IS NULL
+		DO UPDATE SET error = EXCLUDED.error, actualizado_en = now()`,
+		origen, hashWebhook(payload), string(payload), mensaje, entregaID, esperaWebhookFallido(0).Seconds())
+	return err
+}
+
+// Dar por resuelta la entrada pendiente de un payload que se procesó bien
+func resolverWebhookFallido(db *sql.DB, origen string, payload []byte) error {
+	_, err := db.Exec(`
+		UPDATE WebhooksFallidos SET resuelto_en = now(), proximo_intento = NULL, actualizado_en = now()
+		WHERE origen = $1 AND hash = $2 AND resuelto_en IS NULL`, origen, hashWebhook(payload))
+	return err
+}
+
+// Anotar en la cola el resultado de procesar un webhook entrante
+func anotarResultadoWebhook(ctx context.Context, entrega *EntregaWebhook, payload []byte, errProceso error) {
+	var entregaID *int64
+	if entrega.ID != 0 {
+		entregaID = &entrega.ID
+	}
+	db, err := poolBaseDatos()
+	if err == nil {
+		err = trazarConsultaSinReintento(ctx, "anotarWebhookFallido", func() error {
+			if errProceso == nil {
+				return resolverWebhookFallido(db, entrega.Origen, payload)
+			}
+			return guardarWebhookFallido(db, entrega.Origen, payload, errProceso.Error(), entregaID)
+		})
+	}
+	if err != nil && errProceso != nil {
+		// Sin la base el proveedor recibe 500 y lo reenvía por su cuenta
+		logSolicitud(ctx, "Error al guardar el webhook fallido de", entrega.Origen+":", err)
+	} else if err != nil {
+		logSolicitud(ctx, "Error al resolver el webhook fallido de", entrega.Origen+":", err)
+	}
+}
+
+// Reservar las entradas cuyo próximo intento ya llegó; SKIP LOCKED permite
+// que varias instancias reintenten en paralelo
+func reservarWebhooksFallidos(db *sql.DB, limite int) ([]WebhookFallido, error) {
+	return escanearReservaWebhooks(db.Query(`
+		UPDATE WebhooksFallidos SET proximo_intento = now() + $2 * interval '1 second'
+		WHERE fallido_id IN (
+			SELECT fallido_id FROM WebhooksFallidos
+			WHERE resuelto_en IS NULL AND proximo_intento <= now()
+			ORDER BY proximo_intento
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING fallido_id, origen, payload, entrega_id, intentos`, limite, reservaWebhookFallido.Seconds()))
+}
+
+// Reservar una entrada no resuelta para reintentarla al momento
+func reservarWebhookFallido(db *sql.DB, id int64) (*WebhookFallido, error) {
+	reservados, err := escanearReservaWebhooks(db.Query(`
+		UPDATE WebhooksFallidos SET proximo_intento = now() + $2 * interval '1 second'
+		WHERE fallido_id = $1 AND resuelto_en IS NULL
+		RETURNING fallido_id, origen, payload, entrega_id, intentos`, id, reservaWebhookFallido.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	if len(reservados) == 0 {
+		return nil, errWebhookFallidoInexistente
+	}
+	return &reservados[0], nil
+}
+
+func escanearReservaWebhooks(rows *sql.Rows, err error) ([]WebhookFallido, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservados []WebhookFallido
+	for rows.Next() {
+		var f WebhookFallido
+		if err := rows.Scan(&f.ID, &f.Origen, &f.Payload, &f.EntregaID, &f.Intentos); err != nil {
+			return nil, err
+		}
+		reservados = append(reservados, f)
+	}
+	return reservados, rows.Err()
+}
+
+// Reintentar una entrada reservada. Si vuelve a fallar se programa el
+// siguiente intento o, agotados los reintentos, se avisa al equipo.
+func reintentarWebhookFallido(ctx context.Context, db *sql.DB, f WebhookFallido) (*EntregaWebhook, error) {
+	entrega, _ := atenderWebhookEntrante(ctx, f.Origen, []byte(f.Payload), f.EntregaID)
+	if entrega.Exitosa {
+		// La entrada ya quedó resuelta al anotar el resultado
+		return entrega, nil
+	}
+
+	intentos := f.Intentos + 1
+	agotado := intentos >= configActual().WebhooksFallidos.MaxIntentos
+	var proximo *time.Time
+	if !agotado {
+		siguiente := time.Now().Add(esperaWebhookFallido(intentos))
+		proximo = &siguiente
+	}
+	_, err := db.Exec(`
+		UPDATE WebhooksFallidos SET intentos = $2, proximo_intento = $3, actualizado_en = now()
+		WHERE fallido_id = $1 AND resuelto_en IS NULL`, f.ID, intentos, proximo)
+	if err != nil {
+		return entrega, err
+	}
+	if agotado {
+		mensaje := ""
+		if entrega.Error != nil {
+			mensaje = *entrega.Error
+		}
+		avisar(AvisoWebhookFallido, fmt.Sprintf(
+			"El webhook de %s %d falló %d veces y no se volverá a intentar: %s. Revíselo en /admin/webhooks/fallidos",
+			f.Origen, f.ID, intentos, mensaje))
+	}
+	return entrega, nil
+}
+
+// Goroutine que reintenta los webhooks fallidos cuyo próximo intento ya
+// llegó
+func despacharWebhooksFallidos() {
+	for range time.Tick(intervaloWebhooksFallidos) {
+		if escriturasBloqueadas() {
+			continue
+		}
+
+		db, err := poolBaseDatos()
+		if err != nil {
+			log.Println("Webhooks fallidos: error al conectar a la base de datos:", err)
+			continue
+		}
+
+		reservados, err := reservarWebhooksFallidos(db, loteWebhooksFallidos)
+		if err != nil {
+			log.Println("Webhooks fallidos:", err)
+			continue
+		}
+		for _, f := range reservados {
+			if _, err := reintentarWebhookFallido(context.Background(), db, f); err != nil {
+				log.Printf("Webhooks fallidos: entrada %d: %v", f.ID, err)
+			}
+		}
+	}
+}
+
+// Entradas no resueltas o, con todos, también las resueltas y descartadas
+func consultarWebhooksFallidos(db *sql.DB, todos bool, limite int) ([]WebhookFallido, error) {
+	rows, err := db.Query(`
+		SELECT fallido_id, origen, payload, error, entrega_id, intentos, proximo_intento, resuelto_en,
+			CASE
+				WHEN descartado THEN $3
+				WHEN resuelto_en IS NOT NULL THEN $4
+				WHEN proximo_intento IS NULL THEN $5
+				ELSE $6
+			END,
+			creado_en, actualizado_en
+		FROM WebhooksFallidos
+		WHERE resuelto_en IS NULL OR $1
+		ORDER BY fallido_id DESC
+		LIMIT $2`, todos, limite,
+		WebhookFallidoDescartado, WebhookFallidoResuelto, WebhookFallidoAgotado, WebhookFallidoPendiente)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fallidos := []WebhookFallido{}
+	for rows.Next() {
+		var f WebhookFallido
+		err := rows.Scan(&f.ID, &f.Origen, &f.Payload, &f.Error, &f.EntregaID, &f.Intentos, &f.ProximoIntento,
+			&f.ResueltoEn, &f.Estado, &f.CreadoEn, &f.ActualizadoEn)
+		if err != nil {
+			return nil, err
+		}
+		fallidos = append(fallidos, f)
+	}
+	return fallidos, rows.Err()
+}
+
+// Sacar de la cola una entrada que no se va a procesar
+func descartarWebhookFallido(db *sql.DB, id int64) error {
+	resultado, err := db.Exec(`
+		UPDATE WebhooksFallidos
+		SET resuelto_en = now(), descartado = true, proximo_intento = NULL, actualizado_en = now()
+		WHERE fallido_id = $1 AND resuelto_en IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := resultado.RowsAffected(); n == 0 {
+		return errWebhookFallidoInexistente
+	}
+	return nil
+}
+
+// Handler para GET /admin/webhooks/fallidos y POST
+// /admin/webhooks/fallidos/{id}/reintentar|descartar
+func webhooksFallidosHandler(w http.ResponseWriter, r *http.Request) {
+	ruta := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/webhooks/fallidos"), "/")
+	if ruta == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		fallidos, err := obtenerWebhooksFallidos(r.Context(), r.URL.Query().Get("todos") == "true")
+		if err != nil {
+			http.Error(w, "Error al consultar la base de datos", http.StatusInternalServerError)
+			logSolicitud(r.Context(), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fallidos)
+		return
+	}
+
+	id, accion, _ := strings.Cut(ruta, "/")
+	fallidoID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || fallidoID <= 0 || (accion != "reintentar" && accion != "descartar") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if accion == "descartar" {
+		err = descartarWebhookFallidoID(r.Context(), fallidoID)
+	} else {
+		var entrega *EntregaWebhook
+		entrega, err = reintentarWebhookFallidoID(r.Context(), fallidoID)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			if !entrega.Exitosa {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			json.NewEncoder(w).Encode(entrega)
+			return
+		}
+	}
+	if err == errWebhookFallidoInexistente {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error al actualizar el webhook fallido", http.StatusInternalServerError)
+		logSolicitud(r.Context(), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}